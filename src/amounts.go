@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rounding modes for formatted amounts
+const (
+	roundNearest = "nearest"
+	roundDown    = "down"
+	roundUp      = "up"
+)
+
+// How formatted amounts show their currency
+const (
+	currencySymbol = "symbol"
+	currencyCode   = "code"
+	currencyNone   = "none"
+)
+
+// maxAmountDecimals is the most decimal places an amount can be shown with
+const maxAmountDecimals = 4
+
+// amountLocale is how a language writes amounts
+type amountLocale struct {
+	thousands, decimal string
+	// symbolAfter puts the currency after the number; spaced puts a space
+	// between them
+	symbolAfter, spaced bool
+}
+
+// amountLocales are the locales amounts can be formatted for, by language
+var amountLocales = map[string]amountLocale{
+	"en": {thousands: ",", decimal: "."},
+	"ja": {thousands: ",", decimal: "."},
+	"de": {thousands: ".", decimal: ",", symbolAfter: true, spaced: true},
+	"es": {thousands: ".", decimal: ",", symbolAfter: true, spaced: true},
+	"it": {thousands: ".", decimal: ",", symbolAfter: true, spaced: true},
+	// French separates thousands with a narrow no-break space
+	"fr": {thousands: "\u202f", decimal: ",", symbolAfter: true, spaced: true},
+	"pt": {thousands: ".", decimal: ",", spaced: true},
+	"nl": {thousands: ".", decimal: ",", spaced: true},
+}
+
+// currencySymbols are the symbols of the common currencies; others are shown
+// by their code
+var currencySymbols = map[string]string{
+	"USD": "$", "EUR": "€", "GBP": "£", "JPY": "¥", "CNY": "¥", "KRW": "₩",
+	"INR": "₹", "BRL": "R$", "CAD": "CA$", "AUD": "A$", "MXN": "MX$", "NZD": "NZ$",
+	"RUB": "₽", "TRY": "₺", "PLN": "zł", "SEK": "kr", "NOK": "kr", "DKK": "kr",
+}
+
+// zeroDecimalCurrencies have no minor unit, so their amounts are whole by
+// default
+var zeroDecimalCurrencies = map[string]bool{"JPY": true, "KRW": true, "VND": true, "CLP": true, "ISK": true}
+
+// AmountFormatSettings say how a channel's amounts are written in the
+// amount_text of its broadcasts, so every overlay shows the same thing.
+// Zero values fall back to the locale's, or English's.
+type AmountFormatSettings struct {
+	// Locale picks the separators and where the currency goes, e.g. "de" or
+	// "pt-BR"; only the language counts
+	Locale string `json:"locale,omitempty"`
+	// Decimals is the number of decimal places; by default 2, or 0 for
+	// currencies without a minor unit such as JPY
+	Decimals *int `json:"decimals,omitempty"`
+	// Rounding is nearest (the default), down or up
+	Rounding string `json:"rounding,omitempty"`
+	// ThousandsSeparator and DecimalSeparator override the locale's; ""
+	// thousands separator leaves thousands unseparated
+	ThousandsSeparator *string `json:"thousands_separator,omitempty"`
+	DecimalSeparator   *string `json:"decimal_separator,omitempty"`
+	// Currency is symbol (the default), code or none
+	Currency string `json:"currency,omitempty"`
+}
+
+func (s AmountFormatSettings) configured() bool {
+	return s != AmountFormatSettings{}
+}
+
+func (s AmountFormatSettings) validate() error {
+	if _, ok := amountLocales[localeLanguage(s.Locale)]; s.Locale != "" && !ok {
+		return fmt.Errorf("unknown amount_format locale: %s", s.Locale)
+	}
+	if s.Decimals != nil && (*s.Decimals < 0 || *s.Decimals > maxAmountDecimals) {
+		return fmt.Errorf("amount_format decimals must be between 0 and %d", maxAmountDecimals)
+	}
+	switch s.Rounding {
+	case "", roundNearest, roundDown, roundUp:
+	default:
+		return fmt.Errorf("amount_format rounding must be %q, %q or %q", roundNearest, roundDown, roundUp)
+	}
+	switch s.Currency {
+	case "", currencySymbol, currencyCode, currencyNone:
+	default:
+		return fmt.Errorf("amount_format currency must be %q, %q or %q", currencySymbol, currencyCode, currencyNone)
+	}
+	for _, separator := range []*string{s.ThousandsSeparator, s.DecimalSeparator} {
+		if separator != nil && utf8.RuneCountInString(*separator) > 3 {
+			return fmt.Errorf("amount_format separators must be at most 3 characters")
+		}
+	}
+	if s.DecimalSeparator != nil && *s.DecimalSeparator == "" {
+		return fmt.Errorf("amount_format decimal_separator must not be empty")
+	}
+	if s.ThousandsSeparator != nil && s.DecimalSeparator != nil && *s.ThousandsSeparator == *s.DecimalSeparator {
+		return fmt.Errorf("amount_format separators must differ")
+	}
+	return nil
+}
+
+// localeLanguage is the language of a locale tag such as "pt-BR"
+func localeLanguage(locale string) string {
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	language, _, _ = strings.Cut(language, "_")
+	return language
+}
+
+// roundAmount rounds an amount to decimals places. Amounts are float32, so
+// they are widened through their shortest decimal form: 5.1 rounds down to
+// 5.10, not 5.09.
+func roundAmount(amount float32, decimals int, mode string) float64 {
+	value, _ := strconv.ParseFloat(strconv.FormatFloat(float64(amount), 'f', -1, 32), 64)
+	scale := math.Pow10(decimals)
+	// What is left of binary error after scaling is far below a minor unit
+	const epsilon = 1e-9
+	switch mode {
+	case roundDown:
+		return math.Floor(value*scale+epsilon) / scale
+	case roundUp:
+		return math.Ceil(value*scale-epsilon) / scale
+	}
+	return math.Round(value*scale) / scale
+}
+
+// formatAmount writes an amount in the given currency the way the settings say
+func formatAmount(settings AmountFormatSettings, amount float32, currency string) string {
+	locale, ok := amountLocales[localeLanguage(settings.Locale)]
+	if !ok {
+		locale = amountLocales["en"]
+	}
+	if settings.ThousandsSeparator != nil {
+		locale.thousands = *settings.ThousandsSeparator
+	}
+	if settings.DecimalSeparator != nil {
+		locale.decimal = *settings.DecimalSeparator
+	}
+	currency = strings.ToUpper(currency)
+	decimals := 2
+	if zeroDecimalCurrencies[currency] {
+		decimals = 0
+	}
+	if settings.Decimals != nil {
+		decimals = *settings.Decimals
+	}
+
+	rounded := roundAmount(amount, decimals, settings.Rounding)
+	digits := strconv.FormatFloat(math.Abs(rounded), 'f', decimals, 64)
+	whole, fraction, _ := strings.Cut(digits, ".")
+	var number strings.Builder
+	if rounded < 0 {
+		number.WriteString("-")
+	}
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			number.WriteString(locale.thousands)
+		}
+		number.WriteRune(digit)
+	}
+	if fraction != "" {
+		number.WriteString(locale.decimal + fraction)
+	}
+
+	symbol := currency
+	switch settings.Currency {
+	case currencyNone:
+		return number.String()
+	case currencyCode:
+		return number.String() + "\u00a0" + currency
+	}
+	spaced := locale.spaced
+	if known, ok := currencySymbols[currency]; ok {
+		symbol = known
+	} else {
+		// Codes are always set apart from the number
+		spaced = true
+	}
+	space := ""
+	if spaced {
+		// A no-break space, so overlays never wrap between the two
+		space = "\u00a0"
+	}
+	if locale.symbolAfter {
+		return number.String() + space + symbol
+	}
+	return symbol + space + number.String()
+}
+
+// formatMessageAmount sets a message's amount_text from its channel's amount
+// format
+func formatMessageAmount(hub *Hub, msg *Message) {
+	if msg.Amount == 0 {
+		return
+	}
+	msg.AmountText = formatAmount(hub.channelSettings(msg.Channel).AmountFormat, msg.Amount, messageCurrency(hub, *msg))
+}
+
+// templateAmount is an amount as message templates fill in {amount}: in the
+// channel's amount format once it has one, and as a plain number until then
+func templateAmount(hub *Hub, channel string, amount float32, currency string) string {
+	return formatTemplateAmount(hub, hub.channelSettings(channel).AmountFormat, amount, currency)
+}
+
+// formatTemplateAmount is templateAmount for the given amount format
+func formatTemplateAmount(hub *Hub, settings AmountFormatSettings, amount float32, currency string) string {
+	if !settings.configured() {
+		return fmt.Sprintf("%.2f", amount)
+	}
+	return formatAmount(settings, amount, firstNonEmpty(currency, hub.currency))
+}
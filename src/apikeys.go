@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Key scopes
+const (
+	scopeListen = "listen"
+	scopeSend   = "send"
+	scopeAdmin  = "admin"
+)
+
+const (
+	apiKeyPrefix     = "tts_"
+	apiKeyContextKey = "api_key"
+)
+
+var validScopes = map[string]bool{scopeListen: true, scopeSend: true, scopeAdmin: true}
+
+// APIKey is a minted key. The plaintext is only returned once, at creation;
+// the database keeps its SHA-256 hash.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	Channel    string     `json:"channel,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// CreateAPIKeyRequest is the body of POST /admin/keys
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	Channel   string     `json:"channel"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsChannel reports whether the key may be used for channel; keys without
+// a channel work everywhere, and a channel's keys also work on its sandbox
+func (k *APIKey) allowsChannel(channel string) bool {
+	return k.Channel == "" || k.Channel == channel || channel == sandboxChannel(k.Channel)
+}
+
+// covers reports whether other can do nothing k can't: every one of its
+// scopes is k's, it is limited to a channel k may use, and it expires no later
+// than k does
+func (k *APIKey) covers(other *APIKey) bool {
+	for _, scope := range other.Scopes {
+		if !k.hasScope(scope) {
+			return false
+		}
+	}
+	if k.Channel != "" && (other.Channel == "" || !k.allowsChannel(other.Channel)) {
+		return false
+	}
+	return k.ExpiresAt == nil || (other.ExpiresAt != nil && !other.ExpiresAt.After(*k.ExpiresAt))
+}
+
+// mintableBy checks that the request minting key isn't authenticated with a
+// key that key would outreach, answering 403 if it is. Other credentials may
+// mint any key.
+func mintableBy(c *gin.Context, key *APIKey) bool {
+	if caller := apiKeyFrom(c); caller != nil && !caller.covers(key) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "A key can't mint keys with more access than its own"})
+		return false
+	}
+	return true
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// presentedKey reads a key from the Authorization bearer token, X-API-Key, or
+// the key query parameter (browsers can't set headers on WebSocket upgrades)
+func presentedKey(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	return c.Query("key")
+}
+
+// apiKeyFrom returns the key that authenticated the request, if any
+func apiKeyFrom(c *gin.Context) *APIKey {
+	if key, ok := c.Get(apiKeyContextKey); ok {
+		return key.(*APIKey)
+	}
+	return nil
+}
+
+// authenticateKey validates a presented key and checks it carries scope,
+// aborting the request if it doesn't
+func authenticateKey(c *gin.Context, db *postgresStore, raw string, scope string) (*APIKey, bool) {
+	key, err := db.lookupAPIKey(hashAPIKey(raw))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error validating API key: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate API key"})
+		return nil, false
+	}
+	if !key.hasScope(scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+		return nil, false
+	}
+	// Admin routes aren't limited by channel, so neither are keys that reach
+	// them. Keys minted before that was refused are turned away here.
+	if scope == scopeAdmin && key.Channel != "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin keys can't be limited to a channel"})
+		return nil, false
+	}
+
+	c.Set(apiKeyContextKey, key)
+	return key, true
+}
+
+// keyConnections tracks listeners by the key they connected with so revoking
+// or expiring a key disconnects them
+var keyConnections = struct {
+	mutex sync.Mutex
+	conns map[int64]map[transport]bool
+}{conns: make(map[int64]map[transport]bool)}
+
+// trackKeyConnection ties a listener to its key and returns a function that
+// releases it. Listeners are closed with CloseAuthExpired when the key expires.
+func trackKeyConnection(key *APIKey, conn transport) func() {
+	keyConnections.mutex.Lock()
+	if keyConnections.conns[key.ID] == nil {
+		keyConnections.conns[key.ID] = make(map[transport]bool)
+	}
+	keyConnections.conns[key.ID][conn] = true
+	keyConnections.mutex.Unlock()
+
+	var timer Timer
+	if key.ExpiresAt != nil {
+		timer = clock.AfterFunc(key.ExpiresAt.Sub(clock.Now()), func() {
+			log.Printf("Closing listener: API key %s expired", key.Prefix)
+			conn.closeWith(CloseAuthExpired, "")
+			conn.Close()
+		})
+	}
+
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		keyConnections.mutex.Lock()
+		delete(keyConnections.conns[key.ID], conn)
+		if len(keyConnections.conns[key.ID]) == 0 {
+			delete(keyConnections.conns, key.ID)
+		}
+		keyConnections.mutex.Unlock()
+	}
+}
+
+// closeKeyConnections disconnects every listener that used the given key
+func closeKeyConnections(id int64) int {
+	keyConnections.mutex.Lock()
+	defer keyConnections.mutex.Unlock()
+
+	count := 0
+	for conn := range keyConnections.conns[id] {
+		conn.closeWith(CloseAuthExpired, "")
+		conn.Close()
+		count++
+	}
+	return count
+}
+
+// mintAPIKey generates a new key, sets its prefix and stores it, returning the
+// plaintext
+func (s *postgresStore) mintAPIKey(key *APIKey) (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	raw := apiKeyPrefix + hex.EncodeToString(buf)
+	key.Prefix = raw[:len(apiKeyPrefix)+8]
+	if err := s.createAPIKey(key, hashAPIKey(raw)); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+func (s *Server) listAPIKeysHandler(c *gin.Context) {
+	keys, err := s.db.listAPIKeys()
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func (s *Server) createAPIKeyHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+			return
+		}
+	}
+	if req.Channel != "" && !validChannelName(req.Channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+	if req.Channel != "" && containsString(req.Scopes, scopeAdmin) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admin keys can't be limited to a channel"})
+		return
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(clock.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	key := &APIKey{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		Channel:   req.Channel,
+		ExpiresAt: req.ExpiresAt,
+		CreatedBy: user,
+	}
+	if !mintableBy(c, key) {
+		return
+	}
+	raw, err := s.db.mintAPIKey(key)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	s.db.recordAudit("apikey.created", user, key.Prefix, key)
+	c.JSON(http.StatusCreated, gin.H{"key": raw, "api_key": key})
+}
+
+func (s *Server) revokeAPIKeyHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+
+	revoked, err := s.db.revokeAPIKey(id)
+	if err != nil {
+		log.Printf("Error revoking API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found or already revoked"})
+		return
+	}
+
+	disconnected := closeKeyConnections(id)
+	s.db.recordAudit("apikey.revoked", user, strconv.FormatInt(id, 10), gin.H{"disconnected": disconnected})
+	c.JSON(http.StatusOK, gin.H{"status": "API key revoked", "disconnected": disconnected})
+}
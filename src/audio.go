@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rheddev/tts-server/src/tts"
+)
+
+// How synthesized audio reaches overlays
+const (
+	audioDeliveryURL    = "url"
+	audioDeliveryBase64 = "base64"
+)
+
+const (
+	metricSynthesisSeconds  = "tts_synthesis_seconds"
+	metricSynthesisFailures = "tts_synthesis_failures_total"
+)
+
+// AudioConfig controls server-side synthesis
+type AudioConfig struct {
+	TTS      tts.Config
+	Delivery string
+	TTL      time.Duration
+	// SegmentChars is the longest piece of text synthesized at once when
+	// streaming from an engine that can't stream; 0 renders messages whole
+	SegmentChars int
+	// ArchiveDir keeps a copy of every clip for exports; empty keeps none
+	ArchiveDir string
+}
+
+// Why a message was left to browser TTS
+const (
+	fallbackNoEngine = "no_engine"
+	fallbackDisabled = "disabled"
+	fallbackFailed   = "failed"
+)
+
+// ClientSpeech is what an overlay needs to read a message out with the Web
+// Speech API when the server has no audio for it
+type ClientSpeech struct {
+	// Text is the spoken text with whitespace collapsed, description first
+	Text     string  `json:"text"`
+	Voice    string  `json:"voice,omitempty"`
+	Language string  `json:"language"`
+	Rate     float64 `json:"rate"`
+	Reason   string  `json:"reason"`
+}
+
+// AudioPayload is attached to messages that were synthesized on the server.
+// Exactly one of URL (relative to the server) and Data (base64) is set.
+type AudioPayload struct {
+	URL         string `json:"url,omitempty"`
+	Data        string `json:"data,omitempty"`
+	ContentType string `json:"content_type"`
+	Provider    string `json:"provider"`
+	DurationMS  int64  `json:"duration_ms,omitempty"`
+}
+
+type storedAudio struct {
+	audio     *tts.Audio
+	expiresAt time.Time
+}
+
+// speech holds the active synthesizer and the audio served from /audio/:id
+type speech struct {
+	mutex       sync.Mutex
+	synthesizer tts.Synthesizer
+	delivery    string
+	ttl         time.Duration
+	// segmentChars splits long text for streaming listeners, see AudioConfig
+	segmentChars int
+	audio        map[string]storedAudio
+	health       string
+	// language is what browser TTS falls back to when a message names none
+	language string
+}
+
+// newSpeech sets up the configured provider; without one overlays keep using
+// browser TTS. It also points the audio archive at ArchiveDir.
+func newSpeech(config AudioConfig) (*speech, error) {
+	synthesizer, err := tts.New(config.TTS)
+	if err != nil {
+		return nil, err
+	}
+	if synthesizer != nil && chaos.Enabled {
+		synthesizer = chaosSynthesizer{synthesizer}
+	}
+
+	synthesis := &speech{
+		synthesizer:  synthesizer,
+		delivery:     config.Delivery,
+		ttl:          config.TTL,
+		segmentChars: config.SegmentChars,
+		audio:        make(map[string]storedAudio),
+		language:     firstNonEmpty(config.TTS.Language, "en-US"),
+	}
+	if config.ArchiveDir != "" {
+		if err := os.MkdirAll(config.ArchiveDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create AUDIO_ARCHIVE_DIR: %w", err)
+		}
+	}
+	audioArchive.mutex.Lock()
+	audioArchive.dir = config.ArchiveDir
+	audioArchive.mutex.Unlock()
+	if synthesizer != nil {
+		synthesis.health = "unknown"
+		log.Printf("Server-side TTS enabled with %s", synthesizer.Name())
+	}
+	return synthesis, nil
+}
+
+// spokenText is what TTS reads for a message: the description, then the message without emotes
+func spokenText(msg *Message) string {
+	text := msg.Message
+	if msg.Speech != "" {
+		text = msg.Speech
+	}
+	if msg.Description == "" {
+		return text
+	}
+	if text == "" {
+		return msg.Description
+	}
+	return strings.TrimRight(msg.Description, ".!? ") + ". " + text
+}
+
+// synthesizeMessage attaches server-side audio to msg, streaming it to hub's
+// listeners as it renders. Failures are logged and leave msg without audio so
+// overlays fall back to browser TTS.
+func synthesizeMessage(ctx context.Context, hub *Hub, msg *Message) {
+	msg.Audio = nil
+	msg.Synthesis, msg.ClientSpeech = "", nil
+
+	synthesis := hub.synthesis
+	synthesis.mutex.Lock()
+	synthesizer := synthesis.synthesizer
+	segmentChars := synthesis.segmentChars
+	language := synthesis.language
+	synthesis.mutex.Unlock()
+
+	// Runs last, once the kill switches below have had their say
+	fallback := fallbackNoEngine
+	defer func() {
+		if msg.Audio != nil {
+			msg.Synthesis = "server"
+			return
+		}
+		text := strings.Join(strings.Fields(spokenText(msg)), " ")
+		if msg.Quiet || text == "" {
+			return
+		}
+		msg.Synthesis = "client"
+		msg.ClientSpeech = &ClientSpeech{
+			Text:     text,
+			Voice:    msg.Voice,
+			Language: firstNonEmpty(msg.Language, language, "en-US"),
+			Rate:     msg.Speed,
+			Reason:   fallback,
+		}
+		if msg.ClientSpeech.Rate == 0 {
+			msg.ClientSpeech.Rate = 1
+		}
+	}()
+
+	// The channel's kill switches win over whatever the message asked for
+	rules := hub.channelSettings(msg.Channel).Synthesis
+	if rules.disablesVoice(msg.Voice) {
+		log.Printf("Voice %s is disabled on channel %s, using the default", msg.Voice, msg.Channel)
+		msg.Voice = ""
+	}
+	if synthesizer != nil && rules.disablesProvider(synthesizer.Name()) {
+		synthesizer, fallback = nil, fallbackDisabled
+	}
+	if rules.disablesProvider(engineBrowser) {
+		defer func() {
+			if msg.Audio == nil {
+				msg.Quiet = true
+			}
+		}()
+	}
+	if synthesizer == nil {
+		return
+	}
+
+	text := spokenText(msg)
+	if text == "" {
+		return
+	}
+
+	// Streaming listeners get the audio as it is rendered, ahead of the message
+	stream := hub.openAudioStream(msg)
+	labels := MetricLabels{Engine: synthesizer.Name(), Kind: "donation"}
+	hub.metrics.add(metricSynthesisQueue, labels, 1)
+	defer hub.metrics.add(metricSynthesisQueue, labels, -1)
+	started := time.Now()
+	var audio *tts.Audio
+	var err error
+	req := tts.Request{Text: text, Voice: msg.Voice, Language: msg.Language, Rate: msg.Speed}
+	if stream != nil {
+		audio, err = synthesizeStreamed(ctx, synthesizer, req, stream, segmentChars)
+	} else {
+		audio, err = synthesizer.Synthesize(ctx, req)
+	}
+	hub.metrics.observe(metricSynthesisSeconds, labels, time.Since(started).Seconds())
+	if stream != nil {
+		stream.end(err != nil)
+	}
+
+	synthesis.mutex.Lock()
+	defer synthesis.mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Error synthesizing message for session %s: %v", msg.SessionID, err)
+		hub.metrics.inc(metricSynthesisFailures, labels, 1)
+		synthesis.health = "error: " + err.Error()
+		synthesisOutcomes.record(false)
+		fallback = fallbackFailed
+		return
+	}
+	synthesis.health = "ok"
+	synthesisOutcomes.record(true)
+
+	payload := &AudioPayload{ContentType: audio.ContentType, Provider: synthesizer.Name(), DurationMS: tts.Duration(audio.Data).Milliseconds()}
+	if !msg.Test {
+		hub.usage.record(msg.Channel, 0, float64(payload.DurationMS)/1000, 0)
+		go archiveAudio(*msg, audio, payload.DurationMS)
+	}
+	if synthesis.delivery == audioDeliveryBase64 {
+		payload.Data = base64.StdEncoding.EncodeToString(audio.Data)
+	} else {
+		payload.URL = "/audio/" + synthesis.store(audio)
+	}
+	msg.Audio = payload
+}
+
+// store keeps audio for the TTL and returns its ID. Must be called with the mutex held.
+func (s *speech) store(audio *tts.Audio) string {
+	now := clock.Now()
+	for id, stored := range s.audio {
+		if now.After(stored.expiresAt) {
+			delete(s.audio, id)
+		}
+	}
+
+	id := ids.NewID()
+	s.audio[id] = storedAudio{audio: audio, expiresAt: now.Add(s.ttl)}
+	return id
+}
+
+// providerHealth reports the outcome of the last synthesis per provider, with
+// browser TTS always available as a fallback
+func (s *speech) providerHealth() map[string]string {
+	providers := map[string]string{engineBrowser: "ok"}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.synthesizer != nil {
+		providers[s.synthesizer.Name()] = s.health
+	}
+	return providers
+}
+
+// audioHandler serves synthesized audio by its unguessable ID
+func (s *Server) audioHandler(c *gin.Context) {
+	synthesis := s.hub.synthesis
+	synthesis.mutex.Lock()
+	stored, ok := synthesis.audio[c.Param("id")]
+	synthesis.mutex.Unlock()
+
+	if !ok || clock.Now().After(stored.expiresAt) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Audio not found"})
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(http.StatusOK, stored.audio.ContentType, stored.audio.Data)
+}
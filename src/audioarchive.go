@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rheddev/tts-server/src/tts"
+)
+
+// audioArchiveIndex is the file in each day's directory that lists its clips
+const audioArchiveIndex = "index.jsonl"
+
+// ArchivedClip is one synthesized alert kept in the audio archive. File is
+// relative to the day's directory, or to the zip's clips/ directory in an
+// export.
+type ArchivedClip struct {
+	File        string    `json:"file"`
+	SessionID   string    `json:"session_id"`
+	Channel     string    `json:"channel"`
+	Name        string    `json:"name"`
+	Amount      float32   `json:"amount"`
+	Message     string    `json:"message"`
+	ContentType string    `json:"content_type"`
+	DurationMS  int64     `json:"duration_ms"`
+	CreatedAt   time.Time `json:"created_at"`
+	// OffsetSeconds is how far into the exported range the clip was made
+	OffsetSeconds float64 `json:"offset_seconds"`
+}
+
+// AudioManifest is manifest.json in an exported archive
+type AudioManifest struct {
+	From  time.Time      `json:"from"`
+	To    time.Time      `json:"to"`
+	Clips []ArchivedClip `json:"clips"`
+}
+
+// audioArchive keeps every synthesized clip on disk, a directory per day, so
+// streamers can pull the alerts of a stream for VOD edits. It is off without
+// AUDIO_ARCHIVE_DIR.
+var audioArchive = struct {
+	mutex sync.Mutex
+	dir   string
+}{}
+
+var audioExtensions = map[string]string{
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/wav":  ".wav",
+}
+
+// archiveAudio writes a clip and its index entry. Archiving is best effort:
+// failures are logged and never hold up the alert.
+func archiveAudio(msg Message, audio *tts.Audio, durationMS int64) {
+	audioArchive.mutex.Lock()
+	defer audioArchive.mutex.Unlock()
+	if audioArchive.dir == "" {
+		return
+	}
+
+	now := clock.Now().UTC()
+	day := filepath.Join(audioArchive.dir, now.Format("2006-01-02"))
+	if err := os.MkdirAll(day, 0o700); err != nil {
+		log.Printf("Error creating audio archive directory: %v", err)
+		return
+	}
+	extension := audioExtensions[audio.ContentType]
+	if extension == "" {
+		extension = ".audio"
+	}
+	clip := ArchivedClip{
+		File:        now.Format("150405.000") + "-" + newDeliveryID()[:8] + extension,
+		SessionID:   msg.SessionID,
+		Channel:     msg.Channel,
+		Name:        msg.Name,
+		Amount:      msg.Amount,
+		Message:     msg.Message,
+		ContentType: audio.ContentType,
+		DurationMS:  durationMS,
+		CreatedAt:   now,
+	}
+	if err := os.WriteFile(filepath.Join(day, clip.File), audio.Data, 0o600); err != nil {
+		log.Printf("Error archiving audio for session %s: %v", msg.SessionID, err)
+		return
+	}
+
+	entry, err := json.Marshal(clip)
+	if err != nil {
+		return
+	}
+	index, err := os.OpenFile(filepath.Join(day, audioArchiveIndex), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Printf("Error opening audio archive index: %v", err)
+		return
+	}
+	defer index.Close()
+	if _, err := index.Write(append(entry, '\n')); err != nil {
+		log.Printf("Error writing audio archive index: %v", err)
+	}
+}
+
+// archivedClips lists the clips made in [from, to), oldest first, optionally
+// only channel's. Only the days the archive has are read, however long the
+// range.
+func archivedClips(from, to time.Time, channel string) ([]ArchivedClip, error) {
+	clips := []ArchivedClip{}
+	entries, err := os.ReadDir(audioArchive.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return clips, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	first := from.UTC().Truncate(24 * time.Hour)
+	// Entries come sorted by name, which for these is by date
+	for _, entry := range entries {
+		day, err := time.Parse("2006-01-02", entry.Name())
+		if !entry.IsDir() || err != nil || day.Before(first) || !day.Before(to) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(audioArchive.dir, entry.Name(), audioArchiveIndex))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var clip ArchivedClip
+			if err := json.Unmarshal(scanner.Bytes(), &clip); err != nil {
+				continue
+			}
+			if clip.CreatedAt.Before(from) || !clip.CreatedAt.Before(to) || (channel != "" && clip.Channel != channel) {
+				continue
+			}
+			clip.File = filepath.Join(day.Format("2006-01-02"), clip.File)
+			clip.OffsetSeconds = clip.CreatedAt.Sub(from).Seconds()
+			clips = append(clips, clip)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return clips, nil
+}
+
+// exportAudioHandler zips the archived clips of a time range with a manifest
+// of when each was made, for cutting a stream's alerts into its VOD
+func exportAudioHandler(c *gin.Context) {
+	if audioArchive.dir == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The audio archive is not configured"})
+		return
+	}
+	from, err := time.Parse(time.RFC3339, c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+	to := time.Now()
+	if raw := c.Query("to"); raw != "" {
+		if to, err = time.Parse(time.RFC3339, raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' parameter"})
+			return
+		}
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "'to' must be after 'from'"})
+		return
+	}
+
+	clips, err := archivedClips(from, to, c.Query("channel"))
+	if err != nil {
+		log.Printf("Error reading the audio archive: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the audio archive"})
+		return
+	}
+
+	filename := "audio-" + from.UTC().Format("20060102T150405Z") + ".zip"
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Header("Content-Type", "application/zip")
+	archive := zip.NewWriter(c.Writer)
+	manifest := AudioManifest{From: from, To: to, Clips: make([]ArchivedClip, 0, len(clips))}
+	for _, clip := range clips {
+		source := filepath.Join(audioArchive.dir, clip.File)
+		clip.File = filepath.Base(clip.File)
+		err = copyToZip(archive, "clips/"+clip.File, source, clip.CreatedAt)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("Skipping archived clip %s: its audio file is gone", source)
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		manifest.Clips = append(manifest.Clips, clip)
+	}
+	if err == nil {
+		var writer io.Writer
+		if writer, err = archive.Create("manifest.json"); err == nil {
+			encoder := json.NewEncoder(writer)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(manifest)
+		}
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	// As with message exports, a failure once the zip has started can only cut it short
+	if err != nil {
+		log.Printf("Error exporting audio: %v", err)
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export audio"})
+		}
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s exported %d audio clips", user, len(manifest.Clips))
+}
+
+// copyToZip stores the file at source in archive uncompressed, as audio is
+// compressed already
+func copyToZip(archive *zip.Writer, name string, source string, modified time.Time) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditEntry is a single record in the append-only audit log
+type AuditEntry struct {
+	ID        int64       `json:"id"`
+	Action    string      `json:"action"`
+	Actor     string      `json:"actor"`
+	Subject   string      `json:"subject"`
+	Details   interface{} `json:"details"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// actorSystem is recorded for actions the server takes on its own
+const actorSystem = "system"
+
+// recordAudit appends an entry to the audit log, logging rather than failing on errors
+func (s *postgresStore) recordAudit(action string, actor string, subject string, details interface{}) {
+	// The audit log lives in Postgres; under SQLite there is nowhere to record it
+	if err := s.addAuditEntry(action, actor, subject, details); err != nil && !errors.Is(err, errPostgresRequired) {
+		log.Printf("Error recording audit entry %s for %s: %v", action, subject, err)
+	}
+}
+
+func (s *Server) listAuditHandler(c *gin.Context) {
+	from := c.DefaultQuery("from", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
+	fromTime, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'limit' parameter"})
+		return
+	}
+
+	entries, err := s.db.getAuditEntries(fromTime, c.Query("action"), limit)
+	if err != nil {
+		log.Printf("Error listing audit entries: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Authentication schemes a route group's chain can be made of
+const (
+	authBasic  = "basic"
+	authBearer = "bearer"
+	authAPIKey = "apikey"
+	authMTLS   = "mtls"
+	authOAuth  = "oauth"
+)
+
+// AuthConfig picks the schemes each route group accepts, tried in order, and
+// configures the schemes that need it. Listen is /ws/listen, /ws/ticker, SSE
+// and WebRTC; Send is /ws/send and /preview; Admin is the authorized API.
+type AuthConfig struct {
+	Listen []string
+	Send   []string
+	Admin  []string
+	// BearerTokens are name=token or name:scope+scope=token entries for static
+	// bearer tokens; tokens without scopes may listen and send
+	BearerTokens []string
+	// MTLSClientCA verifies client certificates; MTLSSubjects, when set, lists
+	// the certificate common names let in
+	MTLSClientCA string
+	MTLSSubjects []string
+	OAuth        OAuthConfig
+}
+
+// OAuthConfig validates OAuth access tokens with token introspection (RFC 7662)
+type OAuthConfig struct {
+	IntrospectionURL string
+	ClientID         string
+	ClientSecret     string
+	// ScopePrefix, when set, requires tokens to carry <prefix>:<scope>, e.g.
+	// tts:admin for the authorized API
+	ScopePrefix string
+	CacheTTL    time.Duration
+}
+
+// authOutcome is what a scheme made of a request
+type authOutcome int
+
+const (
+	// authAbsent means the request carries no credentials for the scheme, so
+	// the next one in the chain is tried
+	authAbsent authOutcome = iota
+	authAccepted
+	// authRejected means the credentials were for the scheme but not good;
+	// the scheme has aborted the request
+	authRejected
+)
+
+// authScheme checks a request's credentials for a scope. Schemes that accept
+// a request set gin.AuthUserKey to who made it.
+type authScheme interface {
+	authenticate(c *gin.Context, scope string) authOutcome
+}
+
+// authChain tries its schemes in turn until one has credentials to judge.
+// Requests none of them recognize are let through anonymously unless the
+// chain is required.
+type authChain struct {
+	schemes  []authScheme
+	required bool
+	// challenge is sent with a 401 when the chain takes basic auth, so
+	// browsers prompt for it
+	challenge bool
+}
+
+// authChains holds each route group's chain, by the scope the group needs
+type authChains struct {
+	chains map[string]authChain
+	// clientCAs verifies client certificates when a chain takes mTLS
+	clientCAs *x509.CertPool
+}
+
+// configureAuth builds the chain of each route group, looking API keys up in
+// db. Admin routes always need credentials; listen and send routes need them
+// with REQUIRE_API_KEYS.
+func configureAuth(config AuthConfig, accounts gin.Accounts, required bool, useTLS bool, db *postgresStore) (*authChains, error) {
+	auth := &authChains{chains: make(map[string]authChain)}
+	schemes := make(map[string]authScheme)
+	build := func(name string) (authScheme, error) {
+		if scheme, ok := schemes[name]; ok {
+			return scheme, nil
+		}
+		var scheme authScheme
+		switch name {
+		case authBasic:
+			scheme = basicScheme{accounts: accounts}
+		case authAPIKey:
+			scheme = apiKeyScheme{db: db}
+		case authBearer:
+			tokens, err := parseBearerTokens(config.BearerTokens)
+			if err != nil {
+				return nil, err
+			}
+			scheme = bearerScheme{tokens: tokens}
+			if chainHas(config.Admin, authBearer) && !anyBearerToken(tokens, scopeAdmin) {
+				return nil, fmt.Errorf("the bearer scheme on the admin routes needs a token with the admin scope")
+			}
+		case authMTLS:
+			if !useTLS || config.MTLSClientCA == "" {
+				return nil, fmt.Errorf("the mtls scheme needs USE_TLS and AUTH_MTLS_CLIENT_CA")
+			}
+			pem, err := os.ReadFile(config.MTLSClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read AUTH_MTLS_CLIENT_CA: %w", err)
+			}
+			auth.clientCAs = x509.NewCertPool()
+			if !auth.clientCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("AUTH_MTLS_CLIENT_CA has no certificates")
+			}
+			scheme = mtlsScheme{subjects: config.MTLSSubjects}
+		case authOAuth:
+			if config.OAuth.IntrospectionURL == "" {
+				return nil, fmt.Errorf("the oauth scheme needs OAUTH_INTROSPECTION_URL")
+			}
+			// Without a prefix no scope is checked, and any token the
+			// authorization server issues would reach the admin routes
+			if chainHas(config.Admin, authOAuth) && config.OAuth.ScopePrefix == "" {
+				return nil, fmt.Errorf("the oauth scheme on the admin routes needs OAUTH_SCOPE_PREFIX")
+			}
+			scheme = &oauthScheme{
+				config: config.OAuth,
+				client: &http.Client{Timeout: 5 * time.Second},
+				cache:  make(map[string]oauthToken),
+			}
+		default:
+			return nil, fmt.Errorf("unknown authentication scheme %q", name)
+		}
+		schemes[name] = scheme
+		return scheme, nil
+	}
+
+	for _, group := range []struct {
+		scope    string
+		names    []string
+		required bool
+	}{
+		{scopeListen, config.Listen, required},
+		{scopeSend, config.Send, required},
+		{scopeAdmin, config.Admin, true},
+	} {
+		if len(group.names) == 0 {
+			return nil, fmt.Errorf("the %s routes need at least one authentication scheme", group.scope)
+		}
+		chain := authChain{required: group.required}
+		for _, name := range group.names {
+			scheme, err := build(strings.ToLower(name))
+			if err != nil {
+				return nil, err
+			}
+			chain.schemes = append(chain.schemes, scheme)
+			chain.challenge = chain.challenge || strings.EqualFold(name, authBasic)
+		}
+		auth.chains[group.scope] = chain
+	}
+	return auth, nil
+}
+
+// chainHas reports whether a chain's scheme names include name
+func chainHas(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig is the server's TLS configuration for the chains: client
+// certificates are asked for, but only checked by routes that take mTLS
+func (a *authChains) tlsConfig() *tls.Config {
+	if a.clientCAs == nil {
+		return nil
+	}
+	return &tls.Config{ClientCAs: a.clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+}
+
+// requireScope authenticates a request with the chain of the route group that
+// needs scope
+func (a *authChains) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		chain := a.chains[scope]
+		for _, scheme := range chain.schemes {
+			switch scheme.authenticate(c, scope) {
+			case authAccepted, authRejected:
+				return
+			}
+		}
+
+		if hasCredentials(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unsupported credentials"})
+			return
+		}
+		if chain.required {
+			if chain.challenge {
+				c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		}
+	}
+}
+
+// hasCredentials reports whether the request carries credentials of any kind
+func hasCredentials(c *gin.Context) bool {
+	return c.GetHeader("Authorization") != "" || c.GetHeader("X-API-Key") != "" || c.Query("key") != ""
+}
+
+func bearerToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// basicScheme is HTTP basic auth against the admin account, which may do anything
+type basicScheme struct {
+	accounts gin.Accounts
+}
+
+func (s basicScheme) authenticate(c *gin.Context, scope string) authOutcome {
+	user, password, ok := c.Request.BasicAuth()
+	if !ok {
+		return authAbsent
+	}
+	expected, known := s.accounts[user]
+	if !known || expected == "" || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		c.Header("WWW-Authenticate", `Basic realm="Authorization Required"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return authRejected
+	}
+	c.Set(gin.AuthUserKey, user)
+	return authAccepted
+}
+
+// apiKeyScheme takes minted API keys: any X-API-Key or ?key=, and bearer
+// tokens with the key prefix
+type apiKeyScheme struct {
+	db *postgresStore
+}
+
+func (s apiKeyScheme) authenticate(c *gin.Context, scope string) authOutcome {
+	raw := presentedKey(c)
+	if raw == "" || (raw == bearerToken(c) && !strings.HasPrefix(raw, apiKeyPrefix)) {
+		return authAbsent
+	}
+	key, ok := authenticateKey(c, s.db, raw, scope)
+	if !ok {
+		return authRejected
+	}
+	c.Set(gin.AuthUserKey, "key:"+key.Name)
+	return authAccepted
+}
+
+// bearerScheme takes static bearer tokens from AUTH_BEARER_TOKENS. Tokens it
+// doesn't know are left to the rest of the chain.
+type bearerScheme struct {
+	tokens map[string]bearerTokenEntry
+}
+
+// bearerTokenEntry is a static bearer token and the scopes it carries
+type bearerTokenEntry struct {
+	token  string
+	scopes []string
+}
+
+func parseBearerTokens(entries []string) (map[string]bearerTokenEntry, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("the bearer scheme needs AUTH_BEARER_TOKENS")
+	}
+	tokens := make(map[string]bearerTokenEntry)
+	for _, entry := range entries {
+		name, token, ok := strings.Cut(entry, "=")
+		name, scopes, scoped := strings.Cut(name, ":")
+		if !ok || name == "" || len(token) < 16 {
+			return nil, fmt.Errorf("invalid bearer token %q, expected name=token with a token of at least 16 characters", name)
+		}
+		parsed := bearerTokenEntry{token: token, scopes: []string{scopeListen, scopeSend}}
+		if scoped {
+			parsed.scopes = strings.Split(scopes, "+")
+			for _, scope := range parsed.scopes {
+				if !validScopes[scope] {
+					return nil, fmt.Errorf("invalid scope %q for bearer token %q", scope, name)
+				}
+			}
+		}
+		tokens[name] = parsed
+	}
+	return tokens, nil
+}
+
+// anyBearerToken reports whether any of tokens carries scope
+func anyBearerToken(tokens map[string]bearerTokenEntry, scope string) bool {
+	for _, entry := range tokens {
+		if containsString(entry.scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s bearerScheme) authenticate(c *gin.Context, scope string) authOutcome {
+	raw := bearerToken(c)
+	if raw == "" {
+		return authAbsent
+	}
+	for name, entry := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(raw), []byte(entry.token)) == 1 {
+			if !containsString(entry.scopes, scope) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Bearer token lacks the " + scope + " scope"})
+				return authRejected
+			}
+			c.Set(gin.AuthUserKey, "bearer:"+name)
+			return authAccepted
+		}
+	}
+	return authAbsent
+}
+
+// mtlsScheme takes client certificates the server verified against
+// AUTH_MTLS_CLIENT_CA
+type mtlsScheme struct {
+	subjects []string
+}
+
+func (s mtlsScheme) authenticate(c *gin.Context, scope string) authOutcome {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return authAbsent
+	}
+	subject := state.VerifiedChains[0][0].Subject.CommonName
+	if len(s.subjects) > 0 && !containsString(s.subjects, subject) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Client certificate is not allowed"})
+		return authRejected
+	}
+	c.Set(gin.AuthUserKey, "cert:"+subject)
+	return authAccepted
+}
+
+// oauthScheme takes OAuth access tokens, asking the authorization server
+// about each and remembering the answer for a while
+type oauthScheme struct {
+	config OAuthConfig
+	client *http.Client
+	mutex  sync.Mutex
+	cache  map[string]oauthToken
+}
+
+// oauthToken is the part of an introspection response the scheme uses
+type oauthToken struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	Username string `json:"username"`
+	Subject  string `json:"sub"`
+	Expiry   int64  `json:"exp"`
+	cachedAt time.Time
+}
+
+func (s *oauthScheme) authenticate(c *gin.Context, scope string) authOutcome {
+	raw := bearerToken(c)
+	if raw == "" {
+		return authAbsent
+	}
+	token, err := s.introspect(raw)
+	if err != nil {
+		log.Printf("Error introspecting OAuth token: %v", err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to validate access token"})
+		return authRejected
+	}
+	if !token.Active || (token.Expiry > 0 && clock.Now().Unix() >= token.Expiry) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired access token"})
+		return authRejected
+	}
+	if prefix := s.config.ScopePrefix; prefix != "" && !containsString(strings.Fields(token.Scope), prefix+":"+scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access token lacks the " + prefix + ":" + scope + " scope"})
+		return authRejected
+	}
+
+	who := token.Username
+	if who == "" {
+		who = token.Subject
+	}
+	c.Set(gin.AuthUserKey, "oauth:"+who)
+	return authAccepted
+}
+
+// introspect asks the authorization server about a token, or answers from the cache
+func (s *oauthScheme) introspect(raw string) (oauthToken, error) {
+	sum := sha256.Sum256([]byte(raw))
+	key := hex.EncodeToString(sum[:])
+	s.mutex.Lock()
+	if token, ok := s.cache[key]; ok && clock.Now().Sub(token.cachedAt) < s.config.CacheTTL {
+		s.mutex.Unlock()
+		return token, nil
+	}
+	s.mutex.Unlock()
+
+	form := url.Values{"token": {raw}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, s.config.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.config.ClientID != "" {
+		req.SetBasicAuth(s.config.ClientID, s.config.ClientSecret)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return oauthToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return oauthToken{}, fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+	var token oauthToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return oauthToken{}, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+
+	token.cachedAt = clock.Now()
+	s.mutex.Lock()
+	for cached, entry := range s.cache {
+		if clock.Now().Sub(entry.cachedAt) >= s.config.CacheTTL {
+			delete(s.cache, cached)
+		}
+	}
+	s.cache[key] = token
+	s.mutex.Unlock()
+	return token, nil
+}
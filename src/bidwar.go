@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BidWar is a set of options donations compete for
+type BidWar struct {
+	ID        int64         `json:"id"`
+	Title     string        `json:"title"`
+	Options   []TallyOption `json:"options"`
+	Open      bool          `json:"open"`
+	CreatedAt time.Time     `json:"created_at"`
+	ClosedAt  *time.Time    `json:"closed_at,omitempty"`
+	Tallies   []Tally       `json:"tallies"`
+}
+
+// BidWarTally is the payload of a bidwar_tally event
+type BidWarTally struct {
+	ID      int64   `json:"id"`
+	Title   string  `json:"title"`
+	Option  string  `json:"option"`
+	Name    string  `json:"name"`
+	Amount  float32 `json:"amount"`
+	Tallies []Tally `json:"tallies"`
+}
+
+type bidWarRegistry struct {
+	mutex sync.Mutex
+	open  map[int64]*BidWar
+}
+
+var bidWars = &bidWarRegistry{open: make(map[int64]*BidWar)}
+
+// loadBidWars restores open bid wars and their tallies after a restart
+func loadBidWars(hub *Hub) {
+	wars, err := hub.db.getOpenBidWars()
+	if err != nil {
+		log.Printf("Error loading open bid wars: %v", err)
+		return
+	}
+
+	bidWars.mutex.Lock()
+	defer bidWars.mutex.Unlock()
+	for i := range wars {
+		bidWars.open[wars[i].ID] = &wars[i]
+	}
+}
+
+// applyBids attributes a donation to every open bid war it matches
+func applyBids(hub *Hub, msg Message) {
+	if msg.Amount <= 0 {
+		return
+	}
+
+	bidWars.mutex.Lock()
+	var events []BidWarTally
+	for _, war := range bidWars.open {
+		option, ok := matchOption(war.Options, msg.BidOption, msg.Message)
+		if !ok {
+			continue
+		}
+
+		if err := hub.db.addBid(war.ID, option.Key, msg.SessionID, msg.Name, msg.Amount); err != nil {
+			log.Printf("Error recording bid for war %d: %v", war.ID, err)
+			continue
+		}
+
+		for i := range war.Tallies {
+			if war.Tallies[i].Key == option.Key {
+				war.Tallies[i].Total += msg.Amount
+				war.Tallies[i].Bids++
+			}
+		}
+
+		events = append(events, BidWarTally{
+			ID:      war.ID,
+			Title:   war.Title,
+			Option:  option.Key,
+			Name:    msg.Name,
+			Amount:  msg.Amount,
+			Tallies: append([]Tally(nil), war.Tallies...),
+		})
+	}
+	bidWars.mutex.Unlock()
+
+	for _, event := range events {
+		hub.publishEvent("", EventBidWarTally, event)
+	}
+}
+
+func (s *Server) createBidWarHandler(c *gin.Context) {
+	var req BidWar
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	if req.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A title is required"})
+		return
+	}
+	if err := validateOptions(req.Options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	war, err := s.db.createBidWar(req.Title, req.Options)
+	if err != nil {
+		log.Printf("Error creating bid war: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bid war"})
+		return
+	}
+
+	bidWars.mutex.Lock()
+	bidWars.open[war.ID] = war
+	bidWars.mutex.Unlock()
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s started bid war %d: %s", user, war.ID, war.Title)
+	c.JSON(http.StatusCreated, war)
+}
+
+func (s *Server) listBidWarsHandler(c *gin.Context) {
+	wars, err := s.db.listBidWars()
+	if err != nil {
+		log.Printf("Error listing bid wars: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list bid wars"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"bid_wars": wars})
+}
+
+func (s *Server) closeBidWarHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bid war ID"})
+		return
+	}
+
+	if err := s.db.closeBidWar(id); err != nil {
+		log.Printf("Error closing bid war %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close bid war"})
+		return
+	}
+
+	bidWars.mutex.Lock()
+	delete(bidWars.open, id)
+	bidWars.mutex.Unlock()
+
+	war, err := s.db.getBidWar(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bid war not found"})
+		return
+	}
+	c.JSON(http.StatusOK, war)
+}
+
+// bidWarStatsHandler serves the results of a bid war, open or closed
+func (s *Server) bidWarStatsHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bid war ID"})
+		return
+	}
+
+	war, err := s.db.getBidWar(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Bid war not found"})
+		return
+	}
+	c.JSON(http.StatusOK, war)
+}
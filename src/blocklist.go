@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// homoglyphs maps look-alike characters (mostly Cyrillic and Greek) and
+// leetspeak substitutions onto the Latin letter they imitate. "l" and "1"
+// both fold to "i" so that the ambiguity never matters when comparing.
+var homoglyphs = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p',
+	'τ': 't', 'υ': 'u', 'χ': 'x',
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '|': 'i', 'l': 'i',
+}
+
+// normalizeName reduces a name to a comparison skeleton: compatibility
+// decomposition, accents removed, case folded, look-alikes mapped and every
+// remaining non-letter (dots, spaces, underscores) dropped
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(name) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if mapped, ok := homoglyphs[r]; ok {
+			r = mapped
+		}
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// matchBannedName returns the banned entry a donor name matches, if any. A name
+// matches when its skeleton contains the banned skeleton, or when both are long
+// enough and differ by a single edit.
+func matchBannedName(name string, banned []string) (string, bool) {
+	candidate := normalizeName(name)
+	if candidate == "" {
+		return "", false
+	}
+
+	for _, entry := range banned {
+		skeleton := normalizeName(entry)
+		if skeleton == "" {
+			continue
+		}
+		if strings.Contains(candidate, skeleton) {
+			return entry, true
+		}
+		if len([]rune(skeleton)) >= 5 && editDistance(candidate, skeleton) <= 1 {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
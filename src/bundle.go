@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	bundleVersion    = 1
+	bundleKDF        = "pbkdf2-sha256"
+	bundleIterations = 600000
+)
+
+// ConfigBundle is everything needed to bring a new instance up with the same
+// configuration: channel settings, wheel rules, webhook subscriptions and
+// keys. Donations are not included.
+type ConfigBundle struct {
+	ExportedAt      time.Time         `json:"exported_at"`
+	ExportedBy      string            `json:"exported_by"`
+	ChannelSettings []ChannelSettings `json:"channel_settings"`
+	WheelRules      []WheelRule       `json:"wheel_rules"`
+	Webhooks        []BundledWebhook  `json:"webhooks"`
+	APIKeys         []BundledAPIKey   `json:"api_keys"`
+	SigningKeys     []BundledSigning  `json:"signing_keys"`
+}
+
+// BundledAPIKey carries a key's hash so existing keys keep working after import
+type BundledAPIKey struct {
+	APIKey
+	KeyHash string `json:"key_hash"`
+}
+
+// BundledWebhook carries a webhook together with its secret, so receivers
+// keep verifying its deliveries after import
+type BundledWebhook struct {
+	Webhook
+	Secret []byte `json:"secret"`
+}
+
+// BundledSigning carries a signing key together with its secret
+type BundledSigning struct {
+	SigningKey
+	Secret []byte `json:"secret"`
+}
+
+// sealedBundle is the file format: the bundle encrypted with AES-256-GCM under
+// a key derived from the passphrase
+type sealedBundle struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Data       []byte `json:"data"`
+}
+
+// runBundleCommand handles `export-config <file>` and `import-config <file>`.
+// The passphrase comes from CONFIG_BUNDLE_PASSPHRASE.
+func runBundleCommand(command string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s <file>", command)
+	}
+	path := args[0]
+
+	db, err := connectCommandDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	passphrase := os.Getenv("CONFIG_BUNDLE_PASSPHRASE")
+	if passphrase == "" {
+		return fmt.Errorf("CONFIG_BUNDLE_PASSPHRASE environment variable is required")
+	}
+
+	if command == "export-config" {
+		return exportBundle(db, path, passphrase)
+	}
+	return importBundle(db, path, passphrase)
+}
+
+func exportBundle(db *postgresStore, path string, passphrase string) error {
+	bundle := ConfigBundle{ExportedAt: time.Now().UTC(), ExportedBy: instance.ID}
+
+	var err error
+	if bundle.ChannelSettings, err = db.listChannelSettings(); err != nil {
+		return err
+	}
+	if bundle.WheelRules, err = db.listWheelRules(); err != nil {
+		return err
+	}
+	webhooks, err := db.listWebhooks()
+	if err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		bundle.Webhooks = append(bundle.Webhooks, BundledWebhook{Webhook: *webhook, Secret: webhook.secret})
+	}
+	if bundle.APIKeys, err = db.exportAPIKeys(); err != nil {
+		return err
+	}
+	signing, err := db.listSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range signing {
+		bundle.SigningKeys = append(bundle.SigningKeys, BundledSigning{SigningKey: *key, Secret: key.secret})
+	}
+
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("failed to encode bundle: %w", err)
+	}
+	sealed, err := sealBundle(plaintext, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, sealed, 0o600); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+
+	log.Printf("Exported %d channels, %d wheel rules, %d webhooks, %d API keys and %d signing keys to %s",
+		len(bundle.ChannelSettings), len(bundle.WheelRules), len(bundle.Webhooks), len(bundle.APIKeys), len(bundle.SigningKeys), path)
+	return nil
+}
+
+// importBundle restores a bundle. Settings and wheel rules replace the local
+// ones; webhooks and keys that already exist are left alone.
+func importBundle(db *postgresStore, path string, passphrase string) error {
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	}
+	plaintext, err := openBundle(sealed, passphrase)
+	if err != nil {
+		return err
+	}
+
+	var bundle ConfigBundle
+	if err := json.Unmarshal(plaintext, &bundle); err != nil {
+		return fmt.Errorf("failed to decode bundle: %w", err)
+	}
+
+	for i := range bundle.ChannelSettings {
+		if err := db.saveChannelSettings(&bundle.ChannelSettings[i], anyVersion); err != nil {
+			return err
+		}
+	}
+	for _, rule := range bundle.WheelRules {
+		if _, err := db.saveWheelRule(rule, anyVersion); err != nil {
+			return err
+		}
+	}
+	importedWebhooks := 0
+	for _, webhook := range bundle.Webhooks {
+		webhook.secret = webhook.Secret
+		added, err := db.importWebhook(&webhook.Webhook)
+		if err != nil {
+			return err
+		}
+		if added {
+			importedWebhooks++
+		}
+	}
+	imported := 0
+	for _, key := range bundle.APIKeys {
+		added, err := db.importAPIKey(key)
+		if err != nil {
+			return err
+		}
+		if added {
+			imported++
+		}
+	}
+	importedSigning := 0
+	for _, key := range bundle.SigningKeys {
+		key.secret = key.Secret
+		added, err := db.importSigningKey(&key.SigningKey)
+		if err != nil {
+			return err
+		}
+		if added {
+			importedSigning++
+		}
+	}
+
+	db.recordAudit("config.imported", actorSystem, path, map[string]interface{}{
+		"exported_at": bundle.ExportedAt, "exported_by": bundle.ExportedBy,
+	})
+	log.Printf("Imported %d channels, %d wheel rules, %d new webhooks, %d new API keys and %d new signing keys from %s (exported %s by %s)",
+		len(bundle.ChannelSettings), len(bundle.WheelRules), importedWebhooks, imported, importedSigning, path,
+		bundle.ExportedAt.Format(time.RFC3339), bundle.ExportedBy)
+	return nil
+}
+
+func bundleKey(passphrase string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+}
+
+func sealBundle(plaintext []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key, err := bundleKey(passphrase, salt, bundleIterations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive bundle key: %w", err)
+	}
+	data, err := encryptField(key, string(plaintext))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt bundle: %w", err)
+	}
+
+	return json.MarshalIndent(sealedBundle{
+		Version:    bundleVersion,
+		KDF:        bundleKDF,
+		Iterations: bundleIterations,
+		Salt:       salt,
+		Data:       data,
+	}, "", "  ")
+}
+
+func openBundle(raw []byte, passphrase string) ([]byte, error) {
+	var sealed sealedBundle
+	if err := json.Unmarshal(raw, &sealed); err != nil {
+		return nil, fmt.Errorf("failed to decode bundle file: %w", err)
+	}
+	if sealed.Version != bundleVersion || sealed.KDF != bundleKDF {
+		return nil, fmt.Errorf("unsupported bundle version %d (%s)", sealed.Version, sealed.KDF)
+	}
+	// Every bundle is sealed with bundleIterations, and any other count would
+	// let a corrupt file weaken the key or stall the import
+	if sealed.Iterations != bundleIterations {
+		return nil, fmt.Errorf("unsupported bundle iteration count %d", sealed.Iterations)
+	}
+
+	key, err := bundleKey(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive bundle key: %w", err)
+	}
+	plaintext, err := decryptField(key, sealed.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt bundle, wrong passphrase?")
+	}
+	return []byte(plaintext), nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// busEnvelope carries a message or event between instances. Fields hidden
+// from listeners travel alongside so the receiving instance that sent the
+// message can still store it. Audio chunks carry the channel they are for.
+type busEnvelope struct {
+	Origin        string           `json:"origin"`
+	Message       *Message         `json:"message,omitempty"`
+	Event         *Event           `json:"event,omitempty"`
+	AudioChunk    *AudioChunkFrame `json:"audio_chunk,omitempty"`
+	Channel       string           `json:"channel,omitempty"`
+	Replay        bool             `json:"replay,omitempty"`
+	Status        string           `json:"status,omitempty"`
+	StatusToken   string           `json:"status_token,omitempty"`
+	EncryptedName []byte           `json:"name_encrypted,omitempty"`
+	PrivateNote   string           `json:"private_note,omitempty"`
+	RequestID     string           `json:"request_id,omitempty"`
+	// Handoff says a draining instance has left its queue in Redis
+	Handoff bool `json:"handoff,omitempty"`
+	// Delivered is the session ID of an alert that reached listeners of
+	// Channel on the sending instance
+	Delivered string `json:"delivered,omitempty"`
+}
+
+// redisBus fans broadcasts out to every instance through Redis pub/sub
+type redisBus struct {
+	client  *redis.Client
+	channel string
+	// prefix namespaces the other keys the instances share
+	prefix string
+	// hub takes the messages and events published by any instance
+	hub *Hub
+}
+
+// startBus connects to Redis and feeds messages published by any instance
+// into hub. Without a REDIS_URL it returns nil and broadcasts stay in-process.
+func startBus(redisURL string, prefix string, hub *Hub) (*redisBus, error) {
+	if redisURL == "" {
+		return nil, nil
+	}
+
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	bus := &redisBus{client: client, channel: prefix + ":broadcast", prefix: prefix, hub: hub}
+	subscription := client.Subscribe(context.Background(), bus.channel)
+	go bus.receive(subscription)
+
+	log.Printf("Broadcasting through Redis channel %s", bus.channel)
+	return bus, nil
+}
+
+func (b *redisBus) receive(subscription *redis.PubSub) {
+	for payload := range subscription.Channel() {
+		var envelope busEnvelope
+		if err := json.Unmarshal([]byte(payload.Payload), &envelope); err != nil {
+			log.Printf("Error decoding broadcast from Redis: %v", err)
+			continue
+		}
+
+		switch {
+		case envelope.Message != nil:
+			msg := *envelope.Message
+			msg.RequestID = envelope.RequestID
+			if envelope.Origin == instance.ID {
+				msg.Replay = envelope.Replay
+				msg.Status = envelope.Status
+				msg.StatusToken = envelope.StatusToken
+				msg.EncryptedName = envelope.EncryptedName
+				msg.PrivateNote = envelope.PrivateNote
+			} else {
+				// Only the instance that accepted the message stores it
+				msg.Remote = true
+			}
+			b.hub.send(msg)
+		case envelope.Event != nil:
+			b.hub.sendEvent(*envelope.Event)
+		case envelope.Delivered != "":
+			if envelope.Origin != instance.ID {
+				b.hub.dropDelivered(envelope.Channel, envelope.Delivered)
+			}
+		case envelope.AudioChunk != nil:
+			b.hub.streamAudio(envelope.Channel, *envelope.AudioChunk)
+		case envelope.Handoff && envelope.Origin != instance.ID && !b.hub.standby.active():
+			// A standby adopts handed off queues when it is promoted
+			go b.hub.adoptHandoffs()
+		}
+	}
+}
+
+func (b *redisBus) publish(envelope busEnvelope) error {
+	envelope.Origin = instance.ID
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return b.client.Publish(ctx, b.channel, payload).Err()
+}
+
+func (b *redisBus) close() {
+	if err := b.client.Close(); err != nil {
+		log.Printf("Error closing Redis client: %v", err)
+	}
+}
+
+// dispatch hands a message to every instance's hub, or just this one
+// without Redis. If Redis is unreachable the message is still delivered here.
+func (hub *Hub) dispatch(msg Message) {
+	if msg.Test && !msg.Canary {
+		msg.Canary = canary.sample(hub, canaryTest)
+	}
+	formatMessageAmount(hub, &msg)
+	if hub.bus != nil {
+		err := hub.bus.publish(busEnvelope{
+			Message:       &msg,
+			Replay:        msg.Replay,
+			Status:        msg.Status,
+			StatusToken:   msg.StatusToken,
+			EncryptedName: msg.EncryptedName,
+			PrivateNote:   msg.PrivateNote,
+			RequestID:     msg.RequestID,
+		})
+		if err == nil {
+			return
+		}
+		log.Printf("Error publishing message to Redis, delivering locally: %v", err)
+	}
+	hub.send(msg)
+}
+
+// send hands msg to the hub's run loop, waiting for it to start if it hasn't
+// yet. Once the hub has stopped the message is dropped, as nothing would
+// ever take it.
+func (hub *Hub) send(msg Message) {
+	select {
+	case hub.broadcast <- msg:
+	case <-hub.quit:
+		log.Printf("Dropped message for session %s: the hub has stopped", msg.SessionID)
+	}
+}
+
+// sendEvent is send for events
+func (hub *Hub) sendEvent(event Event) {
+	select {
+	case hub.events <- event:
+	case <-hub.quit:
+		log.Printf("Dropped %s event: the hub has stopped", event.Type)
+	}
+}
+
+// announceDelivered tells the other instances an alert reached this
+// instance's listeners, so those holding it for want of their own let it go
+// rather than play it again to a listener that connects later
+func (hub *Hub) announceDelivered(message Message) {
+	if hub.bus == nil || message.Canary {
+		return
+	}
+	go func() {
+		err := hub.bus.publish(busEnvelope{Delivered: message.SessionID, Channel: message.Channel, RequestID: message.RequestID})
+		if err != nil {
+			log.Printf("Error announcing delivery of session %s to Redis: %v", message.SessionID, err)
+		}
+	}()
+}
+
+// dispatchEvent is dispatch for events
+func (hub *Hub) dispatchEvent(event Event) {
+	if hub.bus != nil {
+		err := hub.bus.publish(busEnvelope{Event: &event})
+		if err == nil {
+			return
+		}
+		log.Printf("Error publishing %s event to Redis, delivering locally: %v", event.Type, err)
+	}
+	hub.sendEvent(event)
+}
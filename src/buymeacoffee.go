@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type bmcWebhook struct {
+	Type string `json:"type"`
+	Data struct {
+		ID             json.Number `json:"id"`
+		Status         string      `json:"status"`
+		Amount         json.Number `json:"amount"`
+		Currency       string      `json:"currency"`
+		SupporterName  string      `json:"supporter_name"`
+		SupporterEmail string      `json:"supporter_email"`
+		SupportNote    string      `json:"support_note"`
+		TransactionID  string      `json:"transaction_id"`
+	} `json:"data"`
+}
+
+// verifyBMCSignature checks X-Signature-Sha256, the hex HMAC-SHA256 of the
+// body keyed with the webhook secret
+func verifyBMCSignature(secret string, signature string, body []byte) bool {
+	expected, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// bmcProvider turns Buy Me a Coffee support into messages, with the
+// supporter's note as the message
+type bmcProvider struct{}
+
+func (bmcProvider) Name() string  { return "buymeacoffee" }
+func (bmcProvider) Title() string { return "Buy Me a Coffee" }
+func (bmcProvider) Path() string  { return "buymeacoffee" }
+
+func (bmcProvider) Init(config PaymentConfig) (bool, error) {
+	return config.BMCWebhookSecret != "", nil
+}
+
+func (bmcProvider) Verify(c *gin.Context, hub *Hub, body []byte) *sendError {
+	if !verifyBMCSignature(hub.payments.BMCWebhookSecret, c.GetHeader("X-Signature-Sha256"), body) {
+		return &sendError{http.StatusUnauthorized, "Invalid signature", errInvalidSignature}
+	}
+	return nil
+}
+
+func (bmcProvider) Ingest(c *gin.Context, hub *Hub, body []byte) {
+	var webhook bmcWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if webhook.Type != "donation.created" || webhook.Data.Status != "succeeded" {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Unhandled event type"})
+		return
+	}
+
+	data := webhook.Data
+	amount, err := data.Amount.Float64()
+	id := firstNonEmpty(data.TransactionID, data.ID.String())
+	if err != nil || id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	// Supporters who don't give a name show up as "Someone"
+	name := data.SupporterName
+	acceptWebhookMessage(c, hub, "buymeacoffee", Message{
+		SessionID:  "bmc_" + id,
+		Channel:    webhookChannel(c, ""),
+		Name:       name,
+		Amount:     float32(amount),
+		Currency:   strings.ToUpper(data.Currency),
+		Message:    data.SupportNote,
+		Anonymous:  name == "" || name == "Someone",
+		DonorEmail: data.SupporterEmail,
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// canaryTest is the sampling kind of test alerts; any other kind is an
+// event type. Donations are never sampled.
+const canaryTest = "test"
+
+// CanaryConfig marks a fraction of non-critical broadcasts as canaries,
+// delivered only to listeners that connected with ?canary=1, so changes to
+// what overlays are sent can be tried on a few production overlays first
+type CanaryConfig struct {
+	// Sampling lists kind=fraction pairs, e.g. test=0.1,hype=1
+	Sampling []string
+}
+
+type canarySampler struct {
+	rates map[string]float64
+}
+
+var canary = &canarySampler{}
+
+// configureCanary reads the sampling fractions
+func configureCanary(config CanaryConfig) error {
+	rates := map[string]float64{}
+	for _, entry := range config.Sampling {
+		kind, fraction, ok := strings.Cut(entry, "=")
+		kind = strings.TrimSpace(kind)
+		rate, err := strconv.ParseFloat(strings.TrimSpace(fraction), 64)
+		if !ok || kind == "" || err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid canary sampling %q, expected kind=fraction with a fraction between 0 and 1", entry)
+		}
+		rates[kind] = rate
+	}
+	if len(rates) > 0 {
+		log.Printf("Sampling canary broadcasts for %d kinds", len(rates))
+	}
+	canary = &canarySampler{rates: rates}
+	return nil
+}
+
+// sample decides whether a broadcast of kind on hub goes only to canary
+// listeners
+func (s *canarySampler) sample(hub *Hub, kind string) bool {
+	rate := s.rates[kind]
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+	hub.metrics.inc(metricCanaryBroadcasts, MetricLabels{Kind: kind}, 1)
+	return true
+}
+
+// wantsCanary reports whether a listener asked for canary broadcasts
+func wantsCanary(c *gin.Context) bool {
+	value := c.Query("canary")
+	return value == "1" || value == "true"
+}
+
+// deliverCanary hands a canary message to the channel's canary listeners.
+// Canaries skip the playback queue: they go out to the canary listeners
+// connected now, or to nobody. Must be called with the mutex held.
+func (hub *Hub) deliverCanary(message Message, messageJSON []byte) {
+	rendered := map[string][]byte{formatNative: messageJSON}
+	for client := range hub.clients[message.Channel] {
+		if !client.canary {
+			continue
+		}
+		payload, ok := rendered[client.format]
+		if !ok {
+			var err error
+			if payload, err = renderMessage(hub, client.format, message, messageJSON); err != nil {
+				log.Printf("Error rendering %s message: %v", client.format, err)
+				continue
+			}
+			rendered[client.format] = payload
+		}
+		hub.deliver(client, payload)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// defaultChannel receives messages and listeners that don't name a channel
+const defaultChannel = "default"
+
+// ChannelSettings holds integration settings scoped to a single channel
+type ChannelSettings struct {
+	Channel string `json:"channel"`
+	// Webhooks are URLs POSTed each message broadcast on the channel
+	Webhooks []string         `json:"webhooks"`
+	Discord  DiscordSettings  `json:"discord"`
+	Telegram TelegramSettings `json:"telegram"`
+	OBS      OBSSettings      `json:"obs"`
+	Fraud    FraudSettings    `json:"fraud"`
+	// HomeAssistant flashes lights and runs other automations on alerts
+	HomeAssistant HomeAssistantSettings `json:"home_assistant"`
+	// BannedNames are donor names rejected before broadcast, matched fuzzily
+	BannedNames []string `json:"banned_names"`
+	// FilterActions overrides the content filter's action for words of a
+	// tier, e.g. {"severe": "block"}
+	FilterActions map[string]string `json:"filter_actions,omitempty"`
+	// Pricing limits message length by the amount; it is public, see
+	// GET /channels/:channel/pricing
+	Pricing PricingSettings `json:"pricing"`
+	// Refunds says whether overlays hear about refunded donations
+	Refunds RefundSettings `json:"refunds"`
+	// Billing is the channel's account when usage is metered
+	Billing BillingSettings `json:"billing"`
+	// Synthesis switches off TTS providers and voices on the channel
+	Synthesis SynthesisSettings `json:"synthesis"`
+	// ThankYou thanks donors once their alert has played
+	ThankYou ThankYouSettings `json:"thank_you"`
+	// Hype raises events when donations pick up, e.g. 100 raised in 10 minutes
+	Hype HypeSettings `json:"hype"`
+	// PrivateNotes publishes the key donors encrypt notes to the streamer with
+	PrivateNotes PrivateNoteSettings `json:"private_notes"`
+	// AmountFormat is how amounts are written out for overlays and templates
+	AmountFormat AmountFormatSettings `json:"amount_format"`
+	// Streaks recognizes donors who keep donating stream after stream
+	Streaks   StreakSettings `json:"streaks"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	// Version increases on every save; updates may require it via If-Match
+	Version int `json:"version"`
+}
+
+// DiscordSettings posts a channel's donations to a Discord webhook
+type DiscordSettings struct {
+	WebhookURL string `json:"webhook_url"`
+}
+
+// TelegramSettings has a bot post a channel's donations to a Telegram chat
+type TelegramSettings struct {
+	BotToken string `json:"bot_token"`
+	ChatID   string `json:"chat_id"`
+}
+
+// OBSSettings drives OBS through obs-websocket while a channel's alerts
+// play: it switches to AlertScene and shows AlertSource, and puts both back
+// once the alert is done
+type OBSSettings struct {
+	WebSocketURL string `json:"websocket_url"`
+	Password     string `json:"password"`
+	AlertScene   string `json:"alert_scene"`
+	AlertSource  string `json:"alert_source"`
+}
+
+// FraudSettings holds the thresholds used by the donation anomaly detector.
+// Zero values fall back to the detector defaults.
+type FraudSettings struct {
+	Disabled             bool    `json:"disabled"`
+	WindowSeconds        int     `json:"window_seconds"`
+	IdenticalAmountLimit int     `json:"identical_amount_limit"`
+	SmallAmount          float32 `json:"small_amount"`
+	SmallDonationLimit   int     `json:"small_donation_limit"`
+	RefundLimit          int     `json:"refund_limit"`
+	// AmountCeiling holds donations over it for a moderator to confirm
+	// before they are read out; 0 holds none
+	AmountCeiling float32 `json:"amount_ceiling,omitempty"`
+	// CeilingTrustsProviders lets donations over the ceiling through when
+	// they came from a payment provider's signed webhook, so the payment was
+	// captured; only amounts sent straight to /ws/send are held
+	CeilingTrustsProviders bool `json:"ceiling_trusts_providers,omitempty"`
+}
+
+// settingsCacheTTL bounds how stale cached channel settings may be on the hot path
+const settingsCacheTTL = 30 * time.Second
+
+type cachedSettings struct {
+	settings *ChannelSettings
+	loadedAt time.Time
+}
+
+// settingsCache holds the channel settings a hub has loaded
+type settingsCache struct {
+	mutex   sync.Mutex
+	entries map[string]cachedSettings
+}
+
+// channelSettings returns a channel's settings from the cache, loading them on a miss.
+// On database errors it returns empty settings so callers can fall back to defaults.
+func (hub *Hub) channelSettings(channel string) *ChannelSettings {
+	hub.settings.mutex.Lock()
+	entry, ok := hub.settings.entries[channel]
+	hub.settings.mutex.Unlock()
+	if ok && clock.Now().Sub(entry.loadedAt) < settingsCacheTTL {
+		return entry.settings
+	}
+
+	settings, err := hub.db.getChannelSettings(channel)
+	if errors.Is(err, errPostgresRequired) {
+		// Channel settings need Postgres; SQLite setups always run on the defaults
+		settings, err = &ChannelSettings{Channel: channel}, nil
+	}
+	if err != nil {
+		log.Printf("Error loading settings for channel %s: %v", channel, err)
+		return &ChannelSettings{Channel: channel}
+	}
+	if settings.Version == 0 && isSandboxChannel(channel) {
+		settings = sandboxSettings(channel, hub.channelSettings(sandboxOwner(channel)))
+	}
+
+	hub.settings.mutex.Lock()
+	hub.settings.entries[channel] = cachedSettings{settings: settings, loadedAt: clock.Now()}
+	hub.settings.mutex.Unlock()
+	return settings
+}
+
+func (hub *Hub) invalidateChannelSettings(channel string) {
+	hub.settings.mutex.Lock()
+	delete(hub.settings.entries, channel)
+	hub.settings.mutex.Unlock()
+}
+
+// validChannelName reports whether name is usable as a channel identifier
+func validChannelName(name string) bool {
+	return channelNamePattern.MatchString(name)
+}
+
+// validate checks the settings before they are stored
+func (s *ChannelSettings) validate(smtp SMTPConfig) error {
+	for _, hook := range s.Webhooks {
+		if err := validateWebhookURL(hook); err != nil {
+			return err
+		}
+	}
+	if s.Discord.WebhookURL != "" {
+		if err := validateWebhookURL(s.Discord.WebhookURL); err != nil {
+			return err
+		}
+	}
+	if s.Telegram.ChatID != "" && s.Telegram.BotToken == "" {
+		return errors.New("telegram bot_token is required when chat_id is set")
+	}
+	if s.OBS.WebSocketURL != "" {
+		u, err := url.Parse(s.OBS.WebSocketURL)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return fmt.Errorf("invalid obs websocket_url: %s", s.OBS.WebSocketURL)
+		}
+	}
+	if s.Fraud.WindowSeconds < 0 || s.Fraud.IdenticalAmountLimit < 0 || s.Fraud.SmallAmount < 0 ||
+		s.Fraud.SmallDonationLimit < 0 || s.Fraud.RefundLimit < 0 || s.Fraud.AmountCeiling < 0 {
+		return errors.New("fraud thresholds must not be negative")
+	}
+	if err := s.Pricing.validate(); err != nil {
+		return err
+	}
+	if err := s.Billing.validate(); err != nil {
+		return err
+	}
+	if err := s.Synthesis.validate(); err != nil {
+		return err
+	}
+	if err := s.ThankYou.validate(smtp); err != nil {
+		return err
+	}
+	if err := s.Hype.validate(); err != nil {
+		return err
+	}
+	if err := s.Refunds.validate(); err != nil {
+		return err
+	}
+	if err := s.PrivateNotes.validate(); err != nil {
+		return err
+	}
+	if err := s.AmountFormat.validate(); err != nil {
+		return err
+	}
+	if err := s.Streaks.validate(); err != nil {
+		return err
+	}
+	for tier, action := range s.FilterActions {
+		if tierReasons[tier] == "" {
+			return fmt.Errorf("unknown content filter tier: %s", tier)
+		}
+		if !validFilterAction(action) {
+			return fmt.Errorf("invalid content filter action for %s: %s", tier, action)
+		}
+	}
+	return s.HomeAssistant.validate()
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL: %s", raw)
+	}
+	return nil
+}
+
+func (s *Server) listChannelsHandler(c *gin.Context) {
+	channels, err := s.db.listChannelSettings()
+	if err != nil {
+		log.Printf("Error listing channels: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list channels"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"channels": channels})
+}
+
+func (s *Server) getChannelSettingsHandler(c *gin.Context) {
+	channel := c.Param("channel")
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+
+	settings, err := s.db.getChannelSettings(channel)
+	if err != nil {
+		log.Printf("Error loading settings for channel %s: %v", channel, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load channel settings"})
+		return
+	}
+	setVersionETag(c, settings.Version)
+	c.JSON(http.StatusOK, settings)
+}
+
+func (s *Server) putChannelSettingsHandler(c *gin.Context) {
+	channel := c.Param("channel")
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+
+	expected, err := expectedVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	problems, err := validateSettingsJSON(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel settings don't match the schema", "problems": problems})
+		return
+	}
+	var settings ChannelSettings
+	if err := json.Unmarshal(body, &settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	settings.Channel = channel
+
+	if err := settings.validate(s.hub.smtp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("dry_run") == "true" {
+		s.dryRunChannelSettings(c, &settings, expected)
+		return
+	}
+
+	err = s.db.saveChannelSettings(&settings, expected)
+	if errors.Is(err, errVersionConflict) {
+		current, loadErr := s.db.getChannelSettings(channel)
+		if loadErr != nil {
+			log.Printf("Error loading settings for channel %s: %v", channel, loadErr)
+			c.JSON(http.StatusConflict, gin.H{"error": "Channel settings were changed by someone else"})
+			return
+		}
+		setVersionETag(c, current.Version)
+		c.JSON(http.StatusConflict, gin.H{"error": "Channel settings were changed by someone else", "current": current})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving settings for channel %s: %v", channel, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save channel settings"})
+		return
+	}
+	s.hub.invalidateChannelSettings(channel)
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s updated settings for channel %s", user, channel)
+	setVersionETag(c, settings.Version)
+	c.JSON(http.StatusOK, settings)
+}
+
+// dryRunChannelSettings answers a settings update with what it would change
+// and a sample alert rendered with the new settings, saving nothing. A stale
+// If-Match is refused as the update itself would be.
+func (s *Server) dryRunChannelSettings(c *gin.Context, settings *ChannelSettings, expected int) {
+	current, err := s.db.getChannelSettings(settings.Channel)
+	if err != nil {
+		log.Printf("Error loading settings for channel %s: %v", settings.Channel, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load channel settings"})
+		return
+	}
+	if expected != anyVersion && expected != current.Version {
+		setVersionETag(c, current.Version)
+		c.JSON(http.StatusConflict, gin.H{"error": "Channel settings were changed by someone else", "current": current})
+		return
+	}
+	settings.Version, settings.UpdatedAt = current.Version, current.UpdatedAt
+
+	setVersionETag(c, current.Version)
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":  true,
+		"changes":  settingsChanges(current, settings),
+		"warnings": templateWarnings(settings),
+		"preview":  previewSettings(s.hub, settings),
+		"settings": settings,
+	})
+}
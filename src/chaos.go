@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/rheddev/tts-server/src/tts"
+)
+
+// errChaosSynthesis is the failure injected into synthesis in chaos mode
+var errChaosSynthesis = errors.New("synthesis failure injected by chaos mode")
+
+// ChaosConfig injects faults so the retry and fallback paths can be exercised
+// in staging. Rates are the chance, from 0 to 1, of each synthesis call
+// failing, each database call being held up by DBLatency, and each listener
+// write disconnecting the listener instead. It needs a -tags chaos build.
+type ChaosConfig struct {
+	Enabled              bool
+	SynthesisFailureRate float64
+	DBLatencyRate        float64
+	DBLatency            time.Duration
+	DisconnectRate       float64
+}
+
+var chaos ChaosConfig
+
+// configureChaos turns on fault injection, which a build without the chaos
+// tag refuses
+func configureChaos(config ChaosConfig) error {
+	if !config.Enabled {
+		return nil
+	}
+	if !chaosBuild {
+		return fmt.Errorf("CHAOS_ENABLED needs a server built with -tags chaos")
+	}
+	for _, rate := range []float64{config.SynthesisFailureRate, config.DBLatencyRate, config.DisconnectRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("chaos rates must be between 0 and 1")
+		}
+	}
+	if config.DBLatency < 0 {
+		return fmt.Errorf("CHAOS_DB_LATENCY_MS must not be negative")
+	}
+	chaos = config
+	log.Printf("CHAOS MODE: failing %g of synthesis calls, delaying %g of database calls by %s, disconnecting %g of listener writes",
+		config.SynthesisFailureRate, config.DBLatencyRate, config.DBLatency, config.DisconnectRate)
+	return nil
+}
+
+// strikes reports whether a fault with the given rate happens this time
+func (c ChaosConfig) strikes(rate float64) bool {
+	return chaosBuild && c.Enabled && rate > 0 && rand.Float64() < rate
+}
+
+// delayQuery holds a database call up, or returns early when ctx is done
+func (c ChaosConfig) delayQuery(ctx context.Context) {
+	if !c.strikes(c.DBLatencyRate) {
+		return
+	}
+	timer := time.NewTimer(c.DBLatency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// chaosSynthesizer fails a share of the calls to the synthesizer it wraps
+type chaosSynthesizer struct {
+	tts.Synthesizer
+}
+
+func (s chaosSynthesizer) Synthesize(ctx context.Context, req tts.Request) (*tts.Audio, error) {
+	if chaos.strikes(chaos.SynthesisFailureRate) {
+		return nil, errChaosSynthesis
+	}
+	return s.Synthesizer.Synthesize(ctx, req)
+}
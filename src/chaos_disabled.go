@@ -0,0 +1,6 @@
+//go:build !chaos
+
+package main
+
+// chaosBuild is unset in normal builds, which never inject faults
+const chaosBuild = false
@@ -0,0 +1,6 @@
+//go:build chaos
+
+package main
+
+// chaosBuild is set in builds made with -tags chaos, which can inject faults
+const chaosBuild = true
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CharityMatch configures a sponsor who matches donations up to a cap on
+// each channel. Total is how much has been matched on the channel asked about.
+type CharityMatch struct {
+	Enabled bool    `json:"enabled"`
+	Sponsor string  `json:"sponsor"`
+	Ratio   float32 `json:"ratio"`
+	Cap     float32 `json:"cap"`
+	Total   float32 `json:"total"`
+}
+
+// MatchedDonation is the payload of a matched_donation event
+type MatchedDonation struct {
+	Sponsor      string  `json:"sponsor"`
+	Name         string  `json:"name"`
+	Amount       float32 `json:"amount"`
+	Matched      float32 `json:"matched"`
+	SponsorTotal float32 `json:"sponsor_total"`
+	Remaining    float32 `json:"remaining"`
+}
+
+// charityMatchAttempts is how many times a donation is matched again after
+// another instance moved the channel's total first
+const charityMatchAttempts = 3
+
+type charityState struct {
+	mutex  sync.Mutex
+	config CharityMatch
+}
+
+var charity = &charityState{}
+
+// initCharity loads the matcher from config. The sponsor's running totals
+// are kept in Postgres, where every instance adds to them.
+func initCharity(hub *Hub, config *Config) {
+	if config.CharitySponsor == "" {
+		return
+	}
+	if !usesPostgres(hub.store) {
+		log.Printf("Charity matching needs Postgres, not matching for %s", config.CharitySponsor)
+		return
+	}
+
+	charity.configure(CharityMatch{
+		Enabled: true,
+		Sponsor: config.CharitySponsor,
+		Ratio:   config.CharityMatchRatio,
+		Cap:     config.CharityMatchCap,
+	})
+	log.Printf("Charity mode enabled: %s matching %.2fx up to %.2f", config.CharitySponsor, config.CharityMatchRatio, config.CharityMatchCap)
+}
+
+func (s *charityState) configure(match CharityMatch) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// Totals are each channel's, read from Postgres when asked for
+	match.Total = 0
+	s.config = match
+}
+
+func (s *charityState) snapshot() CharityMatch {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.config
+}
+
+// match computes the sponsor's contribution to a donation on a channel where
+// total has been matched so far. It returns false once the cap has been reached.
+func (m CharityMatch) match(msg Message, total float32) (MatchedDonation, bool) {
+	if msg.Amount <= 0 {
+		return MatchedDonation{}, false
+	}
+
+	matched := msg.Amount * m.Ratio
+	if m.Cap > 0 {
+		remaining := m.Cap - total
+		if remaining <= 0 {
+			return MatchedDonation{}, false
+		}
+		if matched > remaining {
+			matched = remaining
+			// Postgres adds in the same precision, so the last match has to
+			// land on the cap there as well
+			for matched > 0 && float32(total+matched) > m.Cap {
+				matched = math.Nextafter32(matched, 0)
+			}
+		}
+	}
+	if matched <= 0 {
+		return MatchedDonation{}, false
+	}
+
+	return MatchedDonation{
+		Sponsor: m.Sponsor,
+		Name:    msg.Name,
+		Amount:  msg.Amount,
+		Matched: matched,
+	}, true
+}
+
+// applyCharityMatch matches a broadcast donation, adds it to the channel's
+// total and notifies listeners. The total only moves while it stays within
+// the cap, so when another instance got there first the match is worked out
+// again from the new total.
+func applyCharityMatch(hub *Hub, msg Message) {
+	config := charity.snapshot()
+	if !config.Enabled {
+		return
+	}
+
+	for attempt := 0; attempt < charityMatchAttempts; attempt++ {
+		total, err := hub.db.getCharityTotal(config.Sponsor, msg.Channel)
+		if err != nil {
+			log.Printf("Error loading charity total for %s on %s: %v", config.Sponsor, msg.Channel, err)
+			return
+		}
+		match, ok := config.match(msg, total)
+		if !ok {
+			return
+		}
+
+		total, added, err := hub.db.addCharityMatch(config.Sponsor, msg.Channel, msg.SessionID, match.Amount, match.Matched, config.Cap)
+		if err != nil {
+			log.Printf("Error recording charity match for session %s: %v", msg.SessionID, err)
+			return
+		}
+		if !added {
+			continue
+		}
+
+		match.SponsorTotal = total
+		if config.Cap > 0 {
+			match.Remaining = config.Cap - total
+		}
+		hub.publishEvent(msg.Channel, EventMatchedDonation, match)
+		return
+	}
+	log.Printf("Gave up matching session %s: the charity total on %s kept moving", msg.SessionID, msg.Channel)
+}
+
+// getCharityHandler shows the charity matcher with the sponsor's total on
+// ?channel=
+func (s *Server) getCharityHandler(c *gin.Context) {
+	match := charity.snapshot()
+	if match.Sponsor != "" {
+		channel := c.DefaultQuery("channel", requestChannel(c))
+		total, err := s.db.getCharityTotal(match.Sponsor, channel)
+		if err != nil {
+			log.Printf("Error loading charity total for %s on %s: %v", match.Sponsor, channel, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load sponsor total"})
+			return
+		}
+		match.Total = total
+	}
+	c.JSON(http.StatusOK, match)
+}
+
+func (s *Server) putCharityHandler(c *gin.Context) {
+	var req CharityMatch
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	if req.Enabled && req.Sponsor == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sponsor is required when matching is enabled"})
+		return
+	}
+	if req.Ratio < 0 || req.Cap < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Ratio and cap must not be negative"})
+		return
+	}
+	if req.Ratio == 0 {
+		req.Ratio = 1
+	}
+
+	// The running total always comes from the channel's total in Postgres, never
+	// from the request
+	channel := c.DefaultQuery("channel", requestChannel(c))
+	total, err := s.db.getCharityTotal(req.Sponsor, channel)
+	if err != nil {
+		log.Printf("Error loading charity total for %s on %s: %v", req.Sponsor, channel, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load sponsor total"})
+		return
+	}
+
+	charity.configure(req)
+	req.Total = total
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s configured charity matching for %s (enabled: %t)", user, req.Sponsor, req.Enabled)
+	c.JSON(http.StatusOK, req)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// charityPool keeps charity totals in memory, adding to them the way the
+// conditional update does. raced is matched on a channel by another
+// instance right after this one first reads the channel's total.
+type charityPool struct {
+	unavailablePool
+	mutex  sync.Mutex
+	totals map[string]float32
+	raced  float32
+}
+
+func (p *charityPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if sql != insertCharityTotalQuery {
+		return p.unavailablePool.Exec(ctx, sql, args...)
+	}
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func (p *charityPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch sql {
+	case getCharityTotalQuery:
+		channel := args[1].(string)
+		total := p.totals[channel]
+		p.totals[channel] += p.raced
+		p.raced = 0
+		return scanRow(func(dest ...any) error {
+			*dest[0].(*float32) = total
+			return nil
+		})
+	case addCharityMatchQuery:
+		channel, matched, limit := args[1].(string), args[3].(float32), args[4].(float32)
+		if limit > 0 && p.totals[channel]+matched > limit {
+			return scanRow(func(...any) error { return pgx.ErrNoRows })
+		}
+		p.totals[channel] += matched
+		total := p.totals[channel]
+		return scanRow(func(dest ...any) error {
+			*dest[0].(*float32) = total
+			return nil
+		})
+	}
+	return p.unavailablePool.QueryRow(ctx, sql, args...)
+}
+
+// receiveMatch waits for the next matched_donation event queued for client
+func receiveMatch(t *testing.T, client *listener) MatchedDonation {
+	t.Helper()
+	select {
+	case payload := <-client.send:
+		var event struct {
+			Type string          `json:"type"`
+			Data MatchedDonation `json:"data"`
+		}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Fatalf("decoding delivered payload: %v", err)
+		}
+		if event.Type != EventMatchedDonation {
+			t.Fatalf("delivered a %s event, want %s", event.Type, EventMatchedDonation)
+		}
+		return event.Data
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing delivered to the listener on channel %s", client.channel)
+	}
+	return MatchedDonation{}
+}
+
+func TestCharityCapHoldsWhenAnotherInstanceMatchesFirst(t *testing.T) {
+	previous := charity.snapshot()
+	t.Cleanup(func() { charity.configure(previous) })
+	charity.configure(CharityMatch{Enabled: true, Sponsor: "Acme", Ratio: 1, Cap: 10})
+
+	pool := &charityPool{totals: make(map[string]float32), raced: 7}
+	hub := startTestHub(t)
+	hub.db = &postgresStore{pool: pool}
+	client, _ := connect(hub, "alpha")
+	other, _ := connect(hub, "beta")
+
+	applyCharityMatch(hub, Message{SessionID: "session-1", Channel: "alpha", Name: "Ada", Amount: 7})
+	match := receiveMatch(t, client)
+	if match.Matched != 3 || match.SponsorTotal != 10 || match.Remaining != 0 {
+		t.Fatalf("matched %v to a total of %v with %v remaining, want what was left of the cap after the other instance's match",
+			match.Matched, match.SponsorTotal, match.Remaining)
+	}
+
+	applyCharityMatch(hub, Message{SessionID: "session-2", Channel: "alpha", Name: "Ada", Amount: 5})
+	applyCharityMatch(hub, Message{SessionID: "session-3", Channel: "beta", Name: "Bo", Amount: 5})
+	if match := receiveMatch(t, other); match.Matched != 5 || match.SponsorTotal != 5 {
+		t.Fatalf("matched %v to a total of %v on another channel, want its own total", match.Matched, match.SponsorTotal)
+	}
+	if queued := len(client.send); queued != 0 {
+		t.Fatalf("%d more matches on a channel at its cap, want none", queued)
+	}
+	if total := pool.totals["alpha"]; total != 10 {
+		t.Fatalf("channel total is %v, want the cap of 10", total)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time and runs timers. Logic that depends on how much time
+// has passed (queue and audio TTLs, pacing and rate limits, caches, usage
+// periods, key expiry, the ticker's replay buffer, retention cutoffs) reads it
+// from clock rather than the time package, and timers for poll deadlines, key
+// expiry and the stream stop grace period are armed on it, so a manualClock
+// can drive them step by step in tests. Request deadlines, signature
+// timestamps and latency metrics stay on the wall clock.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call waiting on a Clock
+type Timer interface {
+	// Stop cancels the call, reporting whether it was still waiting
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// packageClock is the clock the package reads. What drives it can be swapped
+// while timers and alerts from earlier work are still reading it.
+type packageClock struct {
+	current atomic.Pointer[Clock]
+}
+
+func newPackageClock(c Clock) *packageClock {
+	p := &packageClock{}
+	p.current.Store(&c)
+	return p
+}
+
+func (p *packageClock) Now() time.Time { return (*p.current.Load()).Now() }
+
+func (p *packageClock) AfterFunc(d time.Duration, f func()) Timer {
+	return (*p.current.Load()).AfterFunc(d, f)
+}
+
+// swap drives the package clock with c, returning what drove it before
+func (p *packageClock) swap(c Clock) Clock {
+	return *p.current.Swap(&c)
+}
+
+var clock = newPackageClock(systemClock{})
+
+// manualClock only moves when told to
+type manualClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+func newManualClock(start time.Time) *manualClock {
+	return &manualClock{now: start}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// AfterFunc arms a timer that runs when Advance reaches it
+func (c *manualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &manualTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by d and runs the timers that came due, in
+// the order they were due
+func (c *manualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	var due, waiting []*manualTimer
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			waiting = append(waiting, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	c.timers = waiting
+	c.mutex.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, timer := range due {
+		timer.f()
+	}
+}
+
+type manualTimer struct {
+	clock *manualClock
+	at    time.Time
+	f     func()
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// IDSource makes the 32 hex character IDs used for webhook deliveries,
+// status tokens, and synthesized and archived clips
+type IDSource interface {
+	NewID() string
+}
+
+type randomIDs struct{}
+
+func (randomIDs) NewID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+var ids IDSource = randomIDs{}
+
+// sequentialIDs hands out 000…001, 000…002 and so on, for reproducible runs
+type sequentialIDs struct {
+	mutex sync.Mutex
+	next  uint64
+}
+
+func (s *sequentialIDs) NewID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.next++
+	return fmt.Sprintf("%032x", s.next)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rheddev/tts-server/src/tts"
+)
+
+// useClock drives the package clock with c for the rest of the test
+func useClock(t *testing.T, c Clock) {
+	t.Helper()
+	previous := clock.swap(c)
+	t.Cleanup(func() { clock.swap(previous) })
+}
+
+// useIDs hands out IDs from source for the rest of the test
+func useIDs(t *testing.T, source IDSource) {
+	t.Helper()
+	previous := ids
+	ids = source
+	t.Cleanup(func() { ids = previous })
+}
+
+func TestSequentialIDs(t *testing.T) {
+	source := &sequentialIDs{}
+	for i := 1; i <= 3; i++ {
+		if id, want := source.NewID(), fmt.Sprintf("%032x", i); id != want {
+			t.Fatalf("ID %d = %s, want %s", i, id, want)
+		}
+	}
+}
+
+func TestManualClockOnlyMovesWhenAdvanced(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newManualClock(start)
+	if !c.Now().Equal(start) {
+		t.Fatalf("Now() = %s, want %s", c.Now(), start)
+	}
+	c.Advance(90 * time.Second)
+	if want := start.Add(90 * time.Second); !c.Now().Equal(want) {
+		t.Fatalf("Now() after Advance = %s, want %s", c.Now(), want)
+	}
+}
+
+func TestSynthesizedAudioExpires(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	manual := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	useClock(t, manual)
+	useIDs(t, &sequentialIDs{})
+
+	hub := newHub(nil)
+	hub.synthesis = &speech{audio: make(map[string]storedAudio), ttl: time.Minute}
+	synthesis := hub.synthesis
+
+	synthesis.mutex.Lock()
+	id := synthesis.store(&tts.Audio{Data: []byte("mp3"), ContentType: "audio/mpeg"})
+	synthesis.mutex.Unlock()
+	if want := fmt.Sprintf("%032x", 1); id != want {
+		t.Fatalf("clip ID = %s, want %s", id, want)
+	}
+
+	router := gin.New()
+	router.GET("/audio/:id", (&Server{hub: hub}).audioHandler)
+	fetch := func() int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/audio/"+id, nil))
+		return recorder.Code
+	}
+
+	if code := fetch(); code != http.StatusOK {
+		t.Fatalf("fresh audio: status %d, want %d", code, http.StatusOK)
+	}
+	manual.Advance(time.Minute + time.Second)
+	if code := fetch(); code != http.StatusNotFound {
+		t.Fatalf("expired audio: status %d, want %d", code, http.StatusNotFound)
+	}
+
+	// The next clip stored sweeps out the expired one
+	synthesis.mutex.Lock()
+	synthesis.store(&tts.Audio{Data: []byte("mp3"), ContentType: "audio/mpeg"})
+	_, kept := synthesis.audio[id]
+	synthesis.mutex.Unlock()
+	if kept {
+		t.Fatalf("expired clip %s was kept", id)
+	}
+}
+
+func TestRateLimiterRefillsWithTheClock(t *testing.T) {
+	manual := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	useClock(t, manual)
+
+	// A token a second, up to two at once
+	limiter := newRateLimiter(60, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("203.0.113.1"); !ok {
+			t.Fatalf("request %d refused within the burst", i+1)
+		}
+	}
+	ok, wait := limiter.allow("203.0.113.1")
+	if ok {
+		t.Fatal("request past the burst allowed")
+	}
+	if wait != time.Second {
+		t.Fatalf("wait = %s, want 1s", wait)
+	}
+
+	manual.Advance(time.Second)
+	if ok, _ := limiter.allow("203.0.113.1"); !ok {
+		t.Fatal("request refused once a token refilled")
+	}
+	if ok, _ := limiter.allow("203.0.113.2"); !ok {
+		t.Fatal("another key shares the first key's bucket")
+	}
+}
+
+func TestManualClockRunsTimersAsTheyComeDue(t *testing.T) {
+	c := newManualClock(time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC))
+	var fired []string
+	c.AfterFunc(2*time.Minute, func() { fired = append(fired, "second") })
+	c.AfterFunc(time.Minute, func() { fired = append(fired, "first") })
+	stopped := c.AfterFunc(90*time.Second, func() { fired = append(fired, "stopped") })
+	if !stopped.Stop() {
+		t.Fatal("Stop() = false for a waiting timer")
+	}
+
+	c.Advance(59 * time.Second)
+	if len(fired) != 0 {
+		t.Fatalf("fired %v before any timer was due", fired)
+	}
+	c.Advance(2 * time.Minute)
+	if fmt.Sprint(fired) != "[first second]" {
+		t.Fatalf("fired %v, want [first second]", fired)
+	}
+	if stopped.Stop() {
+		t.Fatal("Stop() = true for a timer already stopped")
+	}
+}
+
+func TestListenersAreClosedWhenTheirKeyExpires(t *testing.T) {
+	manual := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	useClock(t, manual)
+
+	expires := manual.Now().Add(time.Hour)
+	conn := newFakeTransport()
+	release := trackKeyConnection(&APIKey{ID: 1, Prefix: "tts_test", ExpiresAt: &expires}, conn)
+	defer release()
+
+	manual.Advance(time.Hour - time.Second)
+	select {
+	case code := <-conn.closed:
+		t.Fatalf("listener closed with %d before its key expired", code)
+	default:
+	}
+	manual.Advance(time.Second)
+	select {
+	case code := <-conn.closed:
+		if code != CloseAuthExpired {
+			t.Fatalf("closed with %d, want %d", code, CloseAuthExpired)
+		}
+	default:
+		t.Fatal("listener still open after its key expired")
+	}
+}
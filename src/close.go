@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Application close codes sent to WebSocket listeners. See PROTOCOL.md.
+const (
+	CloseAuthExpired       = 4001
+	CloseServerDraining    = 4002
+	CloseKickedByAdmin     = 4003
+	CloseProtocolViolation = 4004
+	CloseSlowConsumer      = 4005
+)
+
+// frameLimits protects the hub from hostile or buggy WebSocket clients
+type frameLimits struct {
+	// MaxFrameBytes is the largest frame a client may send; gorilla closes the
+	// connection with 1009 (message too big) on a larger one
+	MaxFrameBytes int64
+	// MaxViolations is how many malformed frames a listener may send before
+	// it is closed with CloseProtocolViolation; 0 closes on the first
+	MaxViolations int
+}
+
+// readLimited applies the frame size limit to a new connection
+func readLimited(ws *websocket.Conn, limits frameLimits) {
+	if limits.MaxFrameBytes > 0 {
+		ws.SetReadLimit(limits.MaxFrameBytes)
+	}
+}
+
+// CloseReason is the JSON payload carried in the reason field of a close frame.
+// Close frame reasons are limited to 123 bytes, so keep additions short.
+type CloseReason struct {
+	Code       int    `json:"code"`
+	Reason     string `json:"reason"`
+	Reconnect  bool   `json:"reconnect"`
+	RetryAfter int64  `json:"retry_ms,omitempty"`
+	Cursor     string `json:"cursor,omitempty"`
+}
+
+// ReconnectPolicy controls the reconnect delay suggested to clients on reconnectable closes
+type ReconnectPolicy struct {
+	BaseDelay time.Duration
+	Jitter    time.Duration
+}
+
+// suggestDelay spreads reconnects over the jitter window so overlays don't all return at once
+func (p ReconnectPolicy) suggestDelay() time.Duration {
+	delay := p.BaseDelay
+	if p.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return delay
+}
+
+var closeReasons = map[int]CloseReason{
+	CloseAuthExpired:       {Code: CloseAuthExpired, Reason: "auth_expired", Reconnect: false},
+	CloseServerDraining:    {Code: CloseServerDraining, Reason: "server_draining", Reconnect: true},
+	CloseKickedByAdmin:     {Code: CloseKickedByAdmin, Reason: "kicked_by_admin", Reconnect: false},
+	CloseProtocolViolation: {Code: CloseProtocolViolation, Reason: "protocol_violation", Reconnect: false},
+	CloseSlowConsumer:      {Code: CloseSlowConsumer, Reason: "slow_consumer", Reconnect: true},
+}
+
+// closeReason builds the reason sent with a close code. For reconnectable
+// codes a suggested delay and the resume cursor are included.
+func (p ReconnectPolicy) closeReason(code int, cursor string) CloseReason {
+	reason, ok := closeReasons[code]
+	if !ok {
+		reason = CloseReason{Code: code, Reason: "unknown", Reconnect: false}
+	}
+
+	if reason.Reconnect {
+		reason.RetryAfter = p.suggestDelay().Milliseconds()
+		reason.Cursor = cursor
+	}
+	return reason
+}
+
+// sendClose writes a close frame with a structured reason to the client.
+// The connection itself is left for the caller to close.
+func sendClose(ws *websocket.Conn, policy ReconnectPolicy, code int, cursor string) error {
+	reason := policy.closeReason(code, cursor)
+	payload, err := json.Marshal(reason)
+	if err != nil {
+		return err
+	}
+
+	frame := websocket.FormatCloseMessage(code, string(payload))
+	if err := ws.WriteControl(websocket.CloseMessage, frame, time.Now().Add(5*time.Second)); err != nil {
+		log.Printf("Error sending close frame (%s): %v", reason.Reason, err)
+		return err
+	}
+
+	return nil
+}
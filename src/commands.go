@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Overlay commands that replace TTS with media
+const (
+	EventClip     = "clip"
+	EventShoutout = "shoutout"
+)
+
+var defaultMediaHosts = append([]string{"clips.twitch.tv", "twitch.tv", "www.twitch.tv"}, youtubeHosts...)
+
+// CommandRequest is an admin instruction for overlays to play a clip or show a shoutout card
+type CommandRequest struct {
+	Type        string `json:"type" binding:"required"`
+	URL         string `json:"url"`
+	Channel     string `json:"channel"`
+	DisplayName string `json:"display_name"`
+	Message     string `json:"message"`
+	DurationMs  int    `json:"duration_ms"`
+}
+
+// ClipCommand is the data of a clip event
+type ClipCommand struct {
+	URL        string `json:"url"`
+	DurationMs int    `json:"duration_ms,omitempty"`
+	IssuedBy   string `json:"issued_by"`
+}
+
+// ShoutoutCommand is the data of a shoutout event
+type ShoutoutCommand struct {
+	Channel     string `json:"channel"`
+	DisplayName string `json:"display_name"`
+	URL         string `json:"url,omitempty"`
+	Message     string `json:"message,omitempty"`
+	DurationMs  int    `json:"duration_ms,omitempty"`
+	IssuedBy    string `json:"issued_by"`
+}
+
+// allowedMediaURL reports whether raw is an https URL on an allowlisted host
+func allowedMediaURL(hub *Hub, raw string) bool {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme != "https" {
+		return false
+	}
+	for _, allowed := range hub.mediaHosts {
+		if strings.EqualFold(parsed.Hostname(), allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) commandHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	var req CommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.URL != "" && !allowedMediaURL(s.hub, req.URL) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Media host is not allowed"})
+		return
+	}
+
+	var data interface{}
+	switch req.Type {
+	case EventClip:
+		if req.URL == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Clip URL is required"})
+			return
+		}
+		data = ClipCommand{URL: req.URL, DurationMs: req.DurationMs, IssuedBy: user}
+	case EventShoutout:
+		if !validChannelName(strings.ToLower(req.Channel)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid shoutout channel"})
+			return
+		}
+		displayName := req.DisplayName
+		if displayName == "" {
+			displayName = req.Channel
+		}
+		data = ShoutoutCommand{
+			Channel:     strings.ToLower(req.Channel),
+			DisplayName: displayName,
+			URL:         req.URL,
+			Message:     req.Message,
+			DurationMs:  req.DurationMs,
+			IssuedBy:    user,
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown command type"})
+		return
+	}
+
+	s.hub.publishEvent("", req.Type, data)
+	s.db.recordAudit("command."+req.Type, user, req.URL, data)
+
+	c.JSON(http.StatusAccepted, gin.H{"type": req.Type, "data": data})
+}
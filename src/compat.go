@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Payload formats spoken by listeners and senders
+const (
+	formatNative         = "native"
+	formatStreamElements = "streamelements"
+	formatStreamlabs     = "streamlabs"
+)
+
+// errInvalidSignature rejects a signed send whose signature doesn't verify
+var errInvalidSignature = errors.New("invalid request signature")
+
+// payloadFormat reads the ?format= query parameter, defaulting to the native format
+func payloadFormat(c *gin.Context) (string, error) {
+	format := strings.ToLower(c.DefaultQuery("format", formatNative))
+	switch format {
+	case formatNative, formatStreamElements, formatStreamlabs:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+// streamElementsEvent is the shape of a tip on the StreamElements realtime socket
+type streamElementsEvent struct {
+	ID        string             `json:"_id"`
+	Channel   string             `json:"channel"`
+	Type      string             `json:"type"`
+	Provider  string             `json:"provider,omitempty"`
+	Data      streamElementsData `json:"data"`
+	CreatedAt time.Time          `json:"createdAt"`
+}
+
+type streamElementsData struct {
+	TipID       string  `json:"tipId"`
+	Username    string  `json:"username"`
+	DisplayName string  `json:"displayName"`
+	Amount      float32 `json:"amount"`
+	Currency    string  `json:"currency"`
+	Message     string  `json:"message"`
+}
+
+// streamlabsEvent is the shape of a donation on the Streamlabs socket API
+type streamlabsEvent struct {
+	Type    string              `json:"type"`
+	For     string              `json:"for,omitempty"`
+	Message []streamlabsMessage `json:"message"`
+}
+
+type streamlabsMessage struct {
+	ID              string  `json:"_id"`
+	Name            string  `json:"name"`
+	Amount          float32 `json:"amount"`
+	FormattedAmount string  `json:"formatted_amount"`
+	Currency        string  `json:"currency"`
+	Message         string  `json:"message"`
+}
+
+// messageCurrency is the currency a message was paid in, or COMPAT_CURRENCY
+func messageCurrency(hub *Hub, msg Message) string {
+	if msg.Currency != "" {
+		return msg.Currency
+	}
+	return hub.currency
+}
+
+// renderMessage encodes a message for a listener's format. native is the
+// already-encoded native payload, reused as is.
+func renderMessage(hub *Hub, format string, msg Message, native []byte) ([]byte, error) {
+	switch format {
+	case formatStreamElements:
+		return json.Marshal(streamElementsEvent{
+			ID:      msg.SessionID,
+			Channel: msg.Channel,
+			Type:    "tip",
+			Data: streamElementsData{
+				TipID:       msg.SessionID,
+				Username:    msg.Name,
+				DisplayName: msg.Name,
+				Amount:      msg.Amount,
+				Currency:    messageCurrency(hub, msg),
+				Message:     msg.Message,
+			},
+			CreatedAt: time.Now().UTC(),
+		})
+	case formatStreamlabs:
+		return json.Marshal(streamlabsEvent{
+			Type: "donation",
+			For:  "streamlabs",
+			Message: []streamlabsMessage{{
+				ID:              msg.SessionID,
+				Name:            msg.Name,
+				Amount:          msg.Amount,
+				FormattedAmount: firstNonEmpty(msg.AmountText, fmt.Sprintf("%.2f %s", msg.Amount, messageCurrency(hub, msg))),
+				Currency:        messageCurrency(hub, msg),
+				Message:         msg.Message,
+			}},
+		})
+	default:
+		return native, nil
+	}
+}
+
+// wantsEvents reports whether listeners in a format understand internal events.
+// Third-party widgets only know about donations, so they don't get them.
+func wantsEvents(format string) bool {
+	return format == formatNative
+}
+
+// decodeStreamElements accepts either a realtime socket event or a tips API object
+func decodeStreamElements(body []byte, msg *Message) error {
+	var tip struct {
+		streamElementsEvent
+		User struct {
+			Username string `json:"username"`
+		} `json:"user"`
+		Amount  float32 `json:"amount"`
+		Message string  `json:"message"`
+	}
+	if err := json.Unmarshal(body, &tip); err != nil {
+		return err
+	}
+
+	msg.SessionID = firstNonEmpty(tip.Data.TipID, tip.ID)
+	msg.Name = firstNonEmpty(tip.Data.DisplayName, tip.Data.Username, tip.User.Username)
+	msg.Amount = tip.Data.Amount
+	if msg.Amount == 0 {
+		msg.Amount = tip.Amount
+	}
+	msg.Message = firstNonEmpty(tip.Data.Message, tip.Message)
+	return nil
+}
+
+// decodeStreamlabs accepts either a socket API donation event or a flat donation object
+func decodeStreamlabs(body []byte, msg *Message) error {
+	var event streamlabsEvent
+	if err := json.Unmarshal(body, &event); err == nil && len(event.Message) > 0 {
+		donation := event.Message[0]
+		msg.SessionID = donation.ID
+		msg.Name = donation.Name
+		msg.Amount = donation.Amount
+		msg.Message = donation.Message
+		return nil
+	}
+
+	var donation struct {
+		streamlabsMessage
+		Identifier string `json:"identifier"`
+	}
+	if err := json.Unmarshal(body, &donation); err != nil {
+		return err
+	}
+	msg.SessionID = firstNonEmpty(donation.ID, donation.Identifier)
+	msg.Name = donation.Name
+	msg.Amount = donation.Amount
+	msg.Message = donation.Message
+	return nil
+}
+
+// bindSendRequest decodes a send request in the format named by ?format=.
+// Requests carrying a signature header must be signed with an active signing key.
+func bindSendRequest(hub *Hub, c *gin.Context, msg *Message) error {
+	format, err := payloadFormat(c)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		return err
+	}
+	if header := c.GetHeader(signatureHeader); header != "" {
+		if err := hub.signingKeys.verify(header, body); err != nil {
+			return errInvalidSignature
+		}
+	}
+
+	// Widget platforms that can only post forms send the native fields
+	switch c.ContentType() {
+	case binding.MIMEPOSTForm, binding.MIMEMultipartPOSTForm:
+		return decodeSendForm(c.GetHeader("Content-Type"), body, msg)
+	}
+
+	switch format {
+	case formatNative:
+		if err := json.Unmarshal(body, msg); err != nil {
+			return err
+		}
+		return decodePrivateNote(body, msg)
+	case formatStreamElements:
+		err = decodeStreamElements(body, msg)
+	default:
+		err = decodeStreamlabs(body, msg)
+	}
+	if err != nil {
+		return err
+	}
+	if msg.SessionID == "" {
+		return fmt.Errorf("%s payload has no donation ID", format)
+	}
+	return nil
+}
+
+// maxFormMemory bounds the multipart form kept in memory; the body is
+// already limited to SEND_MAX_BODY_BYTES
+const maxFormMemory = 1 << 20
+
+// decodeSendForm decodes an urlencoded or multipart form whose fields are
+// named like the native JSON ones. Only fields holding a string, number or
+// bool can be sent this way; files are ignored.
+func decodeSendForm(contentType string, body []byte, msg *Message) error {
+	var values url.Values
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	if mediaType == binding.MIMEMultipartPOSTForm {
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(maxFormMemory)
+		if err != nil {
+			return err
+		}
+		defer form.RemoveAll()
+		values = form.Value
+	} else if values, err = url.ParseQuery(string(body)); err != nil {
+		return err
+	}
+
+	fields := map[string]interface{}{}
+	messageType := reflect.TypeOf(Message{})
+	for i := 0; i < messageType.NumField(); i++ {
+		field := messageType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || !values.Has(name) {
+			continue
+		}
+		value := strings.TrimSpace(values.Get(name))
+		switch field.Type.Kind() {
+		case reflect.String:
+			fields[name] = values.Get(name)
+		case reflect.Bool:
+			// Checkboxes send "on"
+			enabled, err := strconv.ParseBool(value)
+			if value == "on" {
+				enabled, err = true, nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			fields[name] = enabled
+		case reflect.Float32, reflect.Float64, reflect.Int, reflect.Int64:
+			if value == "" {
+				continue
+			}
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			fields[name] = number
+		}
+	}
+
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(encoded, msg); err != nil {
+		return err
+	}
+	msg.PrivateNote = values.Get(privateNoteField)
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anyVersion makes a versioned update unconditional
+const anyVersion = -1
+
+// errVersionConflict means a conditional update lost the race to another editor
+var errVersionConflict = errors.New("version conflict")
+
+// setVersionETag exposes a record's version so clients can send it back as If-Match
+func setVersionETag(c *gin.Context, version int) {
+	c.Header("ETag", fmt.Sprintf(`"%d"`, version))
+}
+
+// expectedVersion reads the version a client last saw from If-Match. Requests
+// without the header (or with "*") are applied unconditionally.
+func expectedVersion(c *gin.Context) (int, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return anyVersion, nil
+	}
+
+	tag := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+	version, err := strconv.Atoi(tag)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid If-Match header: %s", header)
+	}
+	return version, nil
+}
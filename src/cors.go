@@ -0,0 +1,88 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig sets the origins browsers may call each group of routes from.
+// Webhook routes are only ever called by payment providers' servers and
+// answer no cross-origin requests at all.
+type CORSConfig struct {
+	// PublicOrigins may call the donor and overlay routes: /ws, /sse, /rtc,
+	// /preview, /stats, /voices, message status and the like. "*" allows any
+	// origin, without credentials.
+	PublicOrigins []string
+	// AdminOrigins may call the admin API and Stream Deck routes
+	AdminOrigins []string
+}
+
+// Route groups with a CORS policy of their own, and that can be served on
+// listeners of their own
+const (
+	routePublic  = "public"
+	routeAdmin   = "admin"
+	routeWebhook = "webhook"
+)
+
+// routeGroup is the group a request path falls under. It goes by path rather
+// than by router group because preflight requests match no route.
+func routeGroup(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/webhooks/"):
+		return routeWebhook
+	case path == "/messages", path == "/ws/admin", path == "/admin", strings.HasPrefix(path, "/admin/"),
+		path == "/streamdeck", strings.HasPrefix(path, "/streamdeck/"),
+		// Prometheus scrapes from inside the network, like admins
+		path == "/metrics":
+		return routeAdmin
+	}
+	return routePublic
+}
+
+// corsPolicy is the CORS handler for a group's origins
+func corsPolicy(origins []string) gin.HandlerFunc {
+	corsConfig := cors.DefaultConfig()
+	if slices.Contains(origins, "*") {
+		corsConfig.AllowAllOrigins = true
+	} else {
+		corsConfig.AllowOrigins = origins
+		corsConfig.AllowCredentials = true
+	}
+	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", "Idempotency-Key", requestIDHeader}
+	corsConfig.ExposeHeaders = []string{requestIDHeader}
+	corsConfig.MaxAge = 12 * time.Hour
+	return cors.New(corsConfig)
+}
+
+// corsPolicies applies each route group's CORS policy. Overlays served from
+// custom domains may call the public routes. Groups without origins of their
+// own allow the frontend's.
+func corsPolicies(config CORSConfig, frontendURL string) gin.HandlerFunc {
+	frontend := []string{frontendURL, "http://localhost:3000"}
+	public := append([]string{}, config.PublicOrigins...)
+	if len(public) == 0 {
+		public = frontend
+	}
+	if !slices.Contains(public, "*") {
+		public = append(public, domainOrigins()...)
+	}
+	admin := config.AdminOrigins
+	if len(admin) == 0 {
+		admin = frontend
+	}
+	policies := map[string]gin.HandlerFunc{
+		routePublic: corsPolicy(public),
+		routeAdmin:  corsPolicy(admin),
+	}
+	return func(c *gin.Context) {
+		if policy := policies[routeGroup(c.Request.URL.Path)]; policy != nil {
+			policy(c)
+		}
+	}
+}
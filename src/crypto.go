@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const coingeckoPriceURL = "https://api.coingecko.com/api/v3/simple/price"
+
+// Coins the listeners price, by their CoinGecko ID
+const (
+	coinBitcoin  = "bitcoin"
+	coinEthereum = "ethereum"
+)
+
+// cryptoPriceTTL is how long a fetched exchange rate is used for
+const cryptoPriceTTL = time.Minute
+
+// CryptoConfig selects the wallets watched for donations. Each listener is
+// off until its settings are given.
+type CryptoConfig struct {
+	// LNDURL is the REST address of a Lightning node, authorized with a hex
+	// invoice macaroon; LNDCert is its TLS certificate when self-signed
+	LNDURL      string
+	LNDMacaroon string
+	LNDCert     string
+	// ETHRPCURL is an Ethereum JSON-RPC endpoint and ETHAddress the address
+	// donations are sent to, counted after ETHConfirmations blocks
+	ETHRPCURL        string
+	ETHAddress       string
+	ETHConfirmations int
+	ETHPoll          time.Duration
+	Channel          string
+	// PriceURL is a CoinGecko compatible simple price endpoint
+	PriceURL string
+}
+
+// cryptoPrices converts coins to COMPAT_CURRENCY at the rate when the payment arrives
+type cryptoPrices struct {
+	mutex sync.Mutex
+	url   string
+	// currency is COMPAT_CURRENCY
+	currency string
+	client   *http.Client
+	rates    map[string]float64
+	fetched  map[string]time.Time
+}
+
+// rate is the price of one coin. An expired rate is refetched; if that fails
+// the last known rate is used rather than losing the alert's amount.
+func (p *cryptoPrices) rate(coin string) (float64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if rate, ok := p.rates[coin]; ok && clock.Now().Sub(p.fetched[coin]) < cryptoPriceTTL {
+		return rate, nil
+	}
+
+	currency := strings.ToLower(p.currency)
+	params := url.Values{"ids": {coin}, "vs_currencies": {currency}}
+	rate, err := p.fetch(params, coin, currency)
+	if err != nil {
+		if last, ok := p.rates[coin]; ok {
+			log.Printf("Error fetching %s price, using the rate from %s: %v", coin, p.fetched[coin].Format(time.RFC3339), err)
+			return last, nil
+		}
+		return 0, err
+	}
+	p.rates[coin] = rate
+	p.fetched[coin] = clock.Now()
+	return rate, nil
+}
+
+func (p *cryptoPrices) fetch(params url.Values, coin string, currency string) (float64, error) {
+	resp, err := p.client.Get(p.url + "?" + params.Encode())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("price API returned %s", resp.Status)
+	}
+	var prices map[string]map[string]float64
+	if err := json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		return 0, fmt.Errorf("failed to decode prices: %w", err)
+	}
+	rate, ok := prices[coin][currency]
+	if !ok || rate <= 0 {
+		return 0, fmt.Errorf("no %s price for %s", currency, coin)
+	}
+	return rate, nil
+}
+
+// cryptoMessage builds the alert for a confirmed payment of amount coins.
+// Memos of the form "name: message" set the donor name.
+func cryptoMessage(prices *cryptoPrices, channel string, sessionID string, memo string, coin string, amount float64, display string) Message {
+	name, text := "Anonymous", strings.TrimSpace(memo)
+	if before, after, ok := strings.Cut(text, ":"); ok && strings.TrimSpace(before) != "" && len(before) <= 50 {
+		name, text = strings.TrimSpace(before), strings.TrimSpace(after)
+	}
+
+	msg := Message{SessionID: sessionID, Channel: channel, Name: name, Message: text}
+	rate, err := prices.rate(coin)
+	if err != nil {
+		log.Printf("Error converting %s payment %s, showing it without an amount: %v", coin, sessionID, err)
+	} else {
+		msg.Amount = float32(amount * rate)
+	}
+	msg.Description = fmt.Sprintf("%s sent %s", name, display)
+	return msg
+}
+
+// acceptCrypto sends a confirmed payment down the regular send pipeline.
+// Payment IDs are stable, so payments seen again are refused as duplicates.
+// On an instance that stepped down the listener pauses here, holding the
+// payment, until the instance is primary again.
+func acceptCrypto(hub *Hub, provider string, msg Message) {
+	hub.standby.waitPrimary(provider + " payment " + msg.SessionID)
+	msg.Provider = provider
+	hub.metrics.inc(metricMessagesReceived, MetricLabels{Channel: msg.Channel, Kind: "donation"}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if result, err := hub.acceptMessage(ctx, msg, ""); err != nil {
+		if !result.Duplicate {
+			log.Printf("Ignoring %s payment %s: %s", provider, msg.SessionID, err.message)
+		}
+		return
+	}
+	hub.db.recordAudit("payment.received", provider, msg.SessionID, gin.H{"amount": msg.Amount, "channel": msg.Channel})
+}
+
+// startCrypto starts the configured wallet listeners
+func startCrypto(config CryptoConfig, hub *Hub) error {
+	if config.LNDURL == "" && config.ETHRPCURL == "" {
+		return nil
+	}
+	if config.Channel == "" {
+		config.Channel = defaultChannel
+	}
+	if !validChannelName(config.Channel) {
+		return fmt.Errorf("invalid CRYPTO_CHANNEL %q", config.Channel)
+	}
+	if config.PriceURL == "" {
+		config.PriceURL = coingeckoPriceURL
+	}
+	prices := &cryptoPrices{
+		url:      config.PriceURL,
+		currency: hub.currency,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		rates:    make(map[string]float64),
+		fetched:  make(map[string]time.Time),
+	}
+
+	if config.LNDURL != "" {
+		listener, err := newLightningListener(config, prices, hub)
+		if err != nil {
+			return err
+		}
+		go listener.run()
+		log.Printf("Watching Lightning invoices on %s into channel %s", config.LNDURL, config.Channel)
+	}
+	if config.ETHRPCURL != "" {
+		if !ethAddressPattern(config.ETHAddress) {
+			return fmt.Errorf("invalid ETH_ADDRESS %q", config.ETHAddress)
+		}
+		listener := &ethListener{
+			config: config,
+			client: &http.Client{Timeout: 10 * time.Second},
+			prices: prices,
+			hub:    hub,
+		}
+		go listener.run()
+		log.Printf("Watching Ethereum address %s into channel %s", config.ETHAddress, config.Channel)
+	}
+	return nil
+}
+
+// lightningListener follows a Lightning node's settled invoices
+type lightningListener struct {
+	config CryptoConfig
+	client *http.Client
+	prices *cryptoPrices
+	hub    *Hub
+	// settleIndex is the last settlement seen, so a reconnect picks up from there
+	settleIndex uint64
+}
+
+type lndInvoice struct {
+	Memo        string `json:"memo"`
+	RHash       []byte `json:"r_hash"`
+	State       string `json:"state"`
+	AmtPaidSat  string `json:"amt_paid_sat"`
+	SettleIndex string `json:"settle_index"`
+}
+
+func newLightningListener(config CryptoConfig, prices *cryptoPrices, hub *Hub) (*lightningListener, error) {
+	if _, err := hex.DecodeString(config.LNDMacaroon); err != nil || config.LNDMacaroon == "" {
+		return nil, fmt.Errorf("LND_MACAROON must be the hex-encoded invoice macaroon")
+	}
+	// The stream stays open, so only the connection has a timeout
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.LNDCert != "" {
+		pem, err := os.ReadFile(config.LNDCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read LND_TLS_CERT: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("LND_TLS_CERT has no PEM certificate")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &lightningListener{config: config, client: &http.Client{Transport: transport}, prices: prices, hub: hub}, nil
+}
+
+// run keeps the invoice subscription open, reconnecting with a backoff of up to five minutes
+func (l *lightningListener) run() {
+	backoff := time.Duration(0)
+	for {
+		connected, err := l.subscribe()
+		if connected {
+			backoff = 0
+		}
+		backoff = min(max(2*backoff, 5*time.Second), 5*time.Minute)
+		log.Printf("Error reading Lightning invoices, reconnecting in %s: %v", backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+// subscribe reads invoice updates until the stream ends. LND replays
+// settlements after settle_index, so nothing is missed while disconnected.
+func (l *lightningListener) subscribe() (bool, error) {
+	endpoint := strings.TrimSuffix(l.config.LNDURL, "/") + "/v1/invoices/subscribe"
+	if l.settleIndex > 0 {
+		endpoint += "?settle_index=" + strconv.FormatUint(l.settleIndex, 10)
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Grpc-Metadata-macaroon", l.config.LNDMacaroon)
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("LND returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var update struct {
+			Result *lndInvoice `json:"result"`
+			Error  *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &update); err != nil {
+			log.Printf("Ignoring invalid Lightning invoice update: %v", err)
+			continue
+		}
+		if update.Error != nil {
+			return true, errors.New(update.Error.Message)
+		}
+		if update.Result != nil && update.Result.State == "SETTLED" {
+			l.settled(*update.Result)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, errors.New("invoice stream ended")
+}
+
+func (l *lightningListener) settled(invoice lndInvoice) {
+	if index, err := strconv.ParseUint(invoice.SettleIndex, 10, 64); err == nil && index > l.settleIndex {
+		l.settleIndex = index
+	}
+	sats, err := strconv.ParseInt(invoice.AmtPaidSat, 10, 64)
+	if err != nil || sats <= 0 || len(invoice.RHash) == 0 {
+		return
+	}
+	msg := cryptoMessage(l.prices, l.config.Channel, "lightning_"+hex.EncodeToString(invoice.RHash), invoice.Memo,
+		coinBitcoin, float64(sats)/1e8, fmt.Sprintf("%d sats", sats))
+	acceptCrypto(l.hub, "lightning", msg)
+}
+
+// ethListener scans new blocks for transfers to the watched address
+type ethListener struct {
+	config CryptoConfig
+	client *http.Client
+	prices *cryptoPrices
+	hub    *Hub
+	// next is the next block to scan once it has enough confirmations
+	next uint64
+}
+
+type ethTransaction struct {
+	Hash  string `json:"hash"`
+	To    string `json:"to"`
+	Value string `json:"value"`
+	Input string `json:"input"`
+}
+
+func ethAddressPattern(address string) bool {
+	if len(address) != 42 || !strings.HasPrefix(address, "0x") {
+		return false
+	}
+	_, err := hex.DecodeString(address[2:])
+	return err == nil
+}
+
+// call makes a JSON-RPC call and decodes its result into out
+func (l *ethListener) call(method string, params []interface{}, out interface{}) error {
+	body, err := json.Marshal(gin.H{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Post(l.config.ETHRPCURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("RPC returned %s", resp.Status)
+	}
+
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", method, err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("%s failed: %s", method, reply.Error.Message)
+	}
+	return json.Unmarshal(reply.Result, out)
+}
+
+// run polls for new confirmed blocks, starting from the chain head. Errors
+// back off up to five minutes and the scan resumes where it stopped.
+func (l *ethListener) run() {
+	backoff := time.Duration(0)
+	for {
+		if err := l.poll(); err != nil {
+			backoff = min(max(2*backoff, 5*time.Second), 5*time.Minute)
+			log.Printf("Error reading Ethereum blocks, retrying in %s: %v", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		time.Sleep(l.config.ETHPoll)
+	}
+}
+
+func (l *ethListener) poll() error {
+	var head string
+	if err := l.call("eth_blockNumber", []interface{}{}, &head); err != nil {
+		return err
+	}
+	latest, err := strconv.ParseUint(strings.TrimPrefix(head, "0x"), 16, 64)
+	if err != nil {
+		return fmt.Errorf("invalid block number %q", head)
+	}
+	confirmed := latest - min(uint64(l.config.ETHConfirmations), latest)
+	if l.next == 0 {
+		l.next = confirmed + 1
+	}
+
+	for ; l.next <= confirmed; l.next++ {
+		var block struct {
+			Transactions []ethTransaction `json:"transactions"`
+		}
+		if err := l.call("eth_getBlockByNumber", []interface{}{"0x" + strconv.FormatUint(l.next, 16), true}, &block); err != nil {
+			return err
+		}
+		for _, tx := range block.Transactions {
+			if strings.EqualFold(tx.To, l.config.ETHAddress) {
+				l.received(tx)
+			}
+		}
+	}
+	return nil
+}
+
+// received turns a confirmed transfer into an alert. Text sent as the
+// transaction's input data is the memo.
+func (l *ethListener) received(tx ethTransaction) {
+	wei, ok := new(big.Int).SetString(strings.TrimPrefix(tx.Value, "0x"), 16)
+	if !ok || wei.Sign() <= 0 {
+		return
+	}
+	ether, _ := new(big.Float).Quo(new(big.Float).SetInt(wei), big.NewFloat(1e18)).Float64()
+
+	memo := ""
+	if data, err := hex.DecodeString(strings.TrimPrefix(tx.Input, "0x")); err == nil && utf8.Valid(data) {
+		memo = string(data)
+	}
+	msg := cryptoMessage(l.prices, l.config.Channel, "eth_"+strings.ToLower(tx.Hash), memo,
+		coinEthereum, ether, strconv.FormatFloat(ether, 'f', -1, 64)+" ETH")
+	acceptCrypto(l.hub, "ethereum", msg)
+}
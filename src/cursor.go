@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cursorMACBytes is how much of the HMAC a resume cursor carries. Cursors
+// travel in close frame reasons, which are limited to 123 bytes.
+const cursorMACBytes = 12
+
+// cursorClockSkew is how far in the future a cursor may have been issued,
+// for instances whose clocks disagree a little
+const cursorClockSkew = time.Minute
+
+var (
+	errInvalidCursor = errors.New("invalid resume cursor")
+	errExpiredCursor = errors.New("resume cursor has expired, reconnect without one")
+)
+
+// ResumeCursorConfig sets how resume cursors are signed. Cursors are only
+// good for the channel they were issued on, so a listener can't ask for
+// another channel's history, or for history it was never sent.
+type ResumeCursorConfig struct {
+	// Key signs cursors. Every instance serving the same listeners needs the
+	// same one; without it a key is derived from ADMIN_PASSWORD.
+	Key string
+	// MaxAge is how long a cursor can be resumed from
+	MaxAge time.Duration
+}
+
+func (c ResumeCursorConfig) validate() error {
+	if c.MaxAge <= 0 {
+		return fmt.Errorf("RESUME_CURSOR_MAX_AGE_HOURS must be positive")
+	}
+	return nil
+}
+
+type cursorSigner struct {
+	key    []byte
+	maxAge time.Duration
+}
+
+// newCursorSigner signs with the configured key, falling back to one derived
+// from the admin password so cursors stay good across restarts
+func newCursorSigner(config ResumeCursorConfig, adminPassword string) *cursorSigner {
+	key := []byte(config.Key)
+	if len(key) == 0 {
+		sum := sha256.Sum256([]byte("resume-cursor:" + adminPassword))
+		key = sum[:]
+	}
+	return &cursorSigner{key: key, maxAge: config.MaxAge}
+}
+
+func (s *cursorSigner) mac(channel string, id int64, issued string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(channel + "\x00" + strconv.FormatInt(id, 10) + "\x00" + issued))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:cursorMACBytes])
+}
+
+// sign is the cursor for resuming a channel after the given message ID, as
+// <id>.<issued>.<mac>, or "" before anything has been broadcast
+func (s *cursorSigner) sign(channel string, id int64) string {
+	if id <= 0 {
+		return ""
+	}
+	issued := strconv.FormatInt(clock.Now().Unix(), 36)
+	return strconv.FormatInt(id, 10) + "." + issued + "." + s.mac(channel, id, issued)
+}
+
+// verify reads the message ID out of a cursor a listener of channel resumes
+// from. A cursor signed for another channel, issued before the listener's API
+// key was created, or older than the max age is refused. "" resumes from
+// nothing.
+func (s *cursorSigner) verify(raw string, channel string, key *APIKey) (int64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return 0, errInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalidCursor
+	}
+	seconds, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(s.mac(channel, id, parts[1]))) {
+		return 0, errInvalidCursor
+	}
+
+	issued := time.Unix(seconds, 0)
+	now := clock.Now()
+	if issued.After(now.Add(cursorClockSkew)) {
+		return 0, errInvalidCursor
+	}
+	if now.Sub(issued) > s.maxAge {
+		return 0, errExpiredCursor
+	}
+	// A replacement key doesn't pick up where a leaked one left off
+	if key != nil && issued.Before(key.CreatedAt.Truncate(time.Second)) {
+		return 0, errExpiredCursor
+	}
+	return id, nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -9,26 +11,631 @@ import (
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rheddev/tts-server/src/report"
 )
 
 var (
-	dbPool *pgxpool.Pool
 	// SQL queries as constants to avoid string concatenation and improve maintainability
 	insertMessageQuery = `
-		INSERT INTO tts_messages (session_id, name, amount, message, description) 
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO tts_messages (id, session_id, name, amount, message, description, anonymous, name_encrypted, status, channel, status_token, filtered, original_message, filter_reasons, currency, kind, metadata, private_note) 
+		VALUES (COALESCE(NULLIF($11, 0), nextval('tts_messages_id_seq')), $1, $2, $3, $4, $5, $6, $7, COALESCE(NULLIF($8, ''), 'broadcast'), $9, NULLIF($10, ''), $12, NULLIF($13, ''), COALESCE($14, '{}'::TEXT[]), $15, $16, $17::JSONB, NULLIF($18, ''))
+		ON CONFLICT (session_id) DO NOTHING
+	`
+	nextMessageIDQuery = `
+		SELECT nextval('tts_messages_id_seq')
+	`
+	selectMessagesSinceQuery = `
+		SELECT id, session_id, name, amount, message, description, anonymous, channel
+		FROM tts_messages
+		WHERE channel = $1 AND id > $2 AND status NOT IN ('hidden', 'rejected', 'missed', 'blocked', 'redacted')
+		ORDER BY id
+		LIMIT $3
+	`
+	ackMessageQuery = `
+		UPDATE tts_messages SET played_at = NOW()
+		WHERE id = $1 AND channel = $2 AND played_at IS NULL
 	`
+	// selectMessagesQuery is formatted with the sort direction
 	selectMessagesQuery = `
-		SELECT name, amount, message, description, created_at 
+		SELECT session_id, name, amount, message, description, anonymous, channel, created_at 
 		FROM tts_messages 
-		WHERE created_at >= $1 AND created_at <= $2 
+		WHERE created_at >= $1 AND created_at <= $2 AND status NOT IN ('hidden', 'rejected', 'blocked', 'redacted')
+			AND ($3 = '' OR channel = $3)
+			AND ($4 = '' OR name ILIKE '%%' || $4 || '%%')
+		ORDER BY created_at %[1]s, id %[1]s
+		LIMIT $5 OFFSET $6
+	`
+	// Redacting a message erases its events' data too, leaving a tombstone
+	// the first time
+	redactMessageQuery = `
+		WITH redacted AS (
+			UPDATE tts_messages
+			SET name = '', message = '', description = '', name_encrypted = NULL, original_message = NULL, private_note = NULL, status = 'redacted'
+			WHERE session_id = $1
+			RETURNING id, session_id, channel
+		), erased AS (
+			UPDATE tts_message_events SET data = NULL
+			WHERE session_id IN (SELECT session_id FROM redacted) AND data IS NOT NULL
+		), tombstones AS (
+			INSERT INTO tts_message_events (session_id, message_id, channel, type, created_at)
+			SELECT r.session_id, r.id, r.channel, 'redacted', NOW()
+			FROM redacted r
+			WHERE EXISTS (SELECT 1 FROM tts_message_events e WHERE e.session_id = r.session_id)
+				AND NOT EXISTS (SELECT 1 FROM tts_message_events e WHERE e.session_id = r.session_id AND e.type = 'redacted')
+		)
+		SELECT COUNT(*) FROM redacted
+	`
+	exportMessagesQuery = `
+		SELECT id, session_id, channel, name, amount, message, description, anonymous, status, created_at, played_at
+		FROM tts_messages
+		WHERE created_at >= $1 AND created_at < $2 AND ($3 = '' OR channel = $3)
+		ORDER BY created_at, id
+	`
+	selectMessageByIDQuery = `
+		SELECT id, session_id, channel, name, amount, message, description, anonymous, status, created_at, played_at
+		FROM tts_messages
+		WHERE id = $1
+	`
+	// donorMessagesFilter picks a donor's counted donations: $1 is the
+	// channel and $2 the name
+	donorMessagesFilter = `
+		channel = $1 AND LOWER(name) = LOWER($2) AND NOT anonymous AND kind = 'donation' AND amount > 0
+		AND status NOT IN ('hidden', 'rejected', 'blocked', 'redacted', 'pending')
+		AND session_id NOT IN (SELECT session_id FROM refunds)
+	`
+	selectDonorTotalsQuery = `
+		SELECT COUNT(*), COALESCE(SUM(amount), 0)::float8,
+			COUNT(*) FILTER (WHERE created_at >= $3), COALESCE(SUM(amount) FILTER (WHERE created_at >= $3), 0)::float8,
+			MIN(created_at), MAX(created_at)
+		FROM tts_messages
+		WHERE` + donorMessagesFilter
+	// selectStreakDonorsQuery finds the donors of the stream on channel $1
+	// that started at $2, and stopped at $3 if it has, whose streak doesn't
+	// count it yet, with their last donation before it
+	selectStreakDonorsQuery = `
+		WITH donors AS (
+			SELECT LOWER(m.name) AS donor, MAX(m.name) AS name
+			FROM tts_messages m
+			LEFT JOIN donor_streaks s ON s.channel = m.channel AND s.donor = LOWER(m.name)
+			WHERE m.channel = $1 AND m.created_at >= $2 AND ($3::timestamptz IS NULL OR m.created_at <= $3)
+				AND NOT m.anonymous AND m.kind = 'donation' AND m.amount > 0
+				AND m.status NOT IN ('hidden', 'rejected', 'blocked', 'redacted', 'pending')
+				AND m.session_id NOT IN (SELECT session_id FROM refunds)
+				AND (s.last_stream_at IS NULL OR s.last_stream_at < $2)
+			GROUP BY LOWER(m.name)
+		)
+		SELECT d.donor, d.name, (
+			SELECT MAX(p.created_at) FROM tts_messages p
+			WHERE p.channel = $1 AND LOWER(p.name) = d.donor AND NOT p.anonymous AND p.kind = 'donation'
+				AND p.amount > 0 AND p.created_at < $2
+		)
+		FROM donors d
+	`
+	// selectPreviousStreamQuery is when the last stream on channel $1 before
+	// $2 that ran at least $3 started
+	selectPreviousStreamQuery = `
+		SELECT MAX(started_at) FROM tts_streams
+		WHERE channel = $1 AND started_at < $2 AND stopped_at - started_at >= $3
+	`
+	// upsertDonorStreakQuery counts the stream that started at $4 in a
+	// donor's streak, which goes on if the last stream they donated in was
+	// the one before it ($5)
+	upsertDonorStreakQuery = `
+		INSERT INTO donor_streaks (channel, donor, name, streak, best_streak, streams, last_stream_at)
+		VALUES ($1, $2, $3, 1, 1, 1, $4)
+		ON CONFLICT (channel, donor) DO UPDATE SET
+			name = EXCLUDED.name,
+			streak = CASE WHEN donor_streaks.last_stream_at = $5 THEN donor_streaks.streak + 1 ELSE 1 END,
+			best_streak = GREATEST(donor_streaks.best_streak,
+				CASE WHEN donor_streaks.last_stream_at = $5 THEN donor_streaks.streak + 1 ELSE 1 END),
+			streams = donor_streaks.streams + 1,
+			last_stream_at = EXCLUDED.last_stream_at
+		WHERE donor_streaks.last_stream_at < EXCLUDED.last_stream_at
+		RETURNING streak, best_streak, streams
+	`
+	// stopStaleStreamsQuery stops the running streams that no instance has
+	// seen listeners of for $1, as of when they were last seen; with a
+	// channel ($2) only its stream
+	stopStaleStreamsQuery = `
+		UPDATE tts_streams SET stopped_at = last_seen_at
+		WHERE stopped_at IS NULL AND last_seen_at < NOW() - $1::interval AND ($2 = '' OR channel = $2)
+	`
+	// touchStreamQuery keeps channel $1's running stream going, or starts
+	// one. The database's clock is used so instances' clocks can't disagree.
+	touchStreamQuery = `
+		WITH running AS (
+			UPDATE tts_streams SET last_seen_at = NOW()
+			WHERE channel = $1 AND stopped_at IS NULL
+			RETURNING started_at
+		)
+		INSERT INTO tts_streams (channel, started_at, last_seen_at)
+		SELECT $1, NOW(), NOW() WHERE NOT EXISTS (SELECT 1 FROM running)
+		ON CONFLICT DO NOTHING
+	`
+	// selectCountedStreamsQuery lists the streams that have run at least $2
+	// and are running, or stopped at $1 or later
+	selectCountedStreamsQuery = `
+		SELECT channel, started_at, stopped_at FROM tts_streams
+		WHERE (stopped_at IS NULL OR stopped_at >= $1) AND COALESCE(stopped_at, last_seen_at) - started_at >= $2
+		ORDER BY started_at
+	`
+	selectDonorDonationsQuery = `
+		SELECT id, amount, currency, created_at
+		FROM tts_messages
+		WHERE` + donorMessagesFilter + `
+		ORDER BY id DESC
+		LIMIT $3
+	`
+	// tableHealthQuery reads the statistics ANALYZE just refreshed for the
+	// tables named in $1
+	tableHealthQuery = `
+		SELECT c.relname, COALESCE(s.n_live_tup, 0), COALESCE(s.n_dead_tup, 0), pg_total_relation_size(c.oid)
+		FROM pg_class c
+		LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+		WHERE c.relname = ANY($1) AND c.relkind = 'r' AND pg_table_is_visible(c.oid)
+		ORDER BY c.relname
+	`
+	// invalidIndexesQuery finds indexes on the tables named in $1 that a
+	// failed CREATE INDEX CONCURRENTLY or REINDEX left unusable
+	invalidIndexesQuery = `
+		SELECT i.relname, t.relname
+		FROM pg_index x
+		JOIN pg_class i ON i.oid = x.indexrelid
+		JOIN pg_class t ON t.oid = x.indrelid
+		WHERE t.relname = ANY($1) AND pg_table_is_visible(t.oid) AND (NOT x.indisvalid OR NOT x.indisready)
+		ORDER BY i.relname
+	`
+	// The deletes erase what the event log holds of the messages they delete
+	// and leave a tombstone, so a rebuild doesn't bring them back
+	deleteExpiredMessagesQuery = `
+		WITH deleted AS (
+			DELETE FROM tts_messages
+			WHERE id IN (SELECT id FROM tts_messages WHERE created_at < $1 ORDER BY created_at LIMIT $2)
+			RETURNING id, session_id, channel
+		), erased AS (
+			UPDATE tts_message_events SET data = NULL
+			WHERE session_id IN (SELECT session_id FROM deleted) AND data IS NOT NULL
+		), tombstones AS (
+			INSERT INTO tts_message_events (session_id, message_id, channel, type, data, created_at)
+			SELECT d.session_id, d.id, d.channel, 'deleted', '{"reason": "retention"}', NOW()
+			FROM deleted d
+			WHERE EXISTS (SELECT 1 FROM tts_message_events e WHERE e.session_id = d.session_id)
+		)
+		SELECT COUNT(*) FROM deleted
+	`
+	deleteSandboxMessagesQuery = `
+		WITH deleted AS (
+			DELETE FROM tts_messages
+			WHERE id IN (
+				SELECT id FROM tts_messages
+				WHERE created_at < $1 AND channel LIKE '%-sandbox' AND ($3 = '' OR channel = $3)
+				ORDER BY created_at LIMIT $2
+			)
+			RETURNING id, session_id, channel
+		), erased AS (
+			UPDATE tts_message_events SET data = NULL
+			WHERE session_id IN (SELECT session_id FROM deleted) AND data IS NOT NULL
+		), tombstones AS (
+			INSERT INTO tts_message_events (session_id, message_id, channel, type, data, created_at)
+			SELECT d.session_id, d.id, d.channel, 'deleted', '{"reason": "sandbox"}', NOW()
+			FROM deleted d
+			WHERE EXISTS (SELECT 1 FROM tts_message_events e WHERE e.session_id = d.session_id)
+		)
+		SELECT COUNT(*) FROM deleted
+	`
+	selectMessagesByStatusQuery = `
+		SELECT session_id, name, amount, message, description, anonymous, channel, created_at
+		FROM tts_messages
+		WHERE status = $1 AND created_at >= $2
+		ORDER BY created_at DESC
+	`
+	selectFilteredMessagesQuery = `
+		SELECT session_id, name, amount, message, description, anonymous, channel, created_at, status, COALESCE(original_message, ''), filter_reasons
+		FROM tts_messages
+		WHERE filtered AND created_at >= $1 AND ($2 = '' OR channel = $2) AND ($3 = '' OR status = $3)
+		ORDER BY created_at DESC
+		LIMIT 1000
+	`
+	selectMessageBySessionQuery = `
+		SELECT id, session_id, name, amount, message, description, anonymous, channel, status
+		FROM tts_messages
+		WHERE session_id = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+	`
+	selectStatusByTokenQuery = `
+		SELECT status FROM (
+			SELECT status, 0 AS source FROM tts_messages WHERE status_token = $1
+			UNION ALL
+			SELECT status, 1 AS source FROM pending_messages WHERE status_token = $1
+		) AS found
+		ORDER BY source
+		LIMIT 1
+	`
+	insertPendingMessageQuery = `
+		INSERT INTO pending_messages (session_id, channel, payload, name_encrypted, status_token, private_note,
+			filtered, original_message, filter_reasons, provider)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, NULLIF($8, ''), COALESCE($9, '{}'::TEXT[]), NULLIF($10, ''))
+		RETURNING id, status, created_at
+	`
+	selectPendingMessagesQuery = `
+		SELECT id, payload, name_encrypted, COALESCE(status_token, ''), COALESCE(private_note, ''),
+			filtered, COALESCE(original_message, ''), filter_reasons, COALESCE(provider, ''),
+			status, reason, created_at, decided_by, decided_at
+		FROM pending_messages
+		WHERE status = 'pending' AND ($1 = '' OR channel = $1)
+		ORDER BY id
+	`
+	decidePendingMessageQuery = `
+		UPDATE pending_messages SET status = $2, reason = $3, decided_by = $4, decided_at = NOW()
+		WHERE id = $1 AND status = 'pending'
+		RETURNING id, payload, name_encrypted, COALESCE(status_token, ''), COALESCE(private_note, ''),
+			filtered, COALESCE(original_message, ''), filter_reasons, COALESCE(provider, ''),
+			status, reason, created_at, decided_by, decided_at
+	`
+	pendingMessageExistsQuery = `SELECT EXISTS (SELECT 1 FROM pending_messages WHERE id = $1)`
+	messageFilterClause       = `
+		WHERE created_at >= $1 AND created_at <= $2
+			AND ($3 = '' OR LOWER(name) = LOWER($3))
+			AND ($4 = '' OR message ILIKE '%' || $4 || '%')
+			AND ($5 = '' OR channel = $5)
+	`
+	insertNoteQuery = `
+		INSERT INTO message_notes (session_id, author, note)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	selectNotesQuery = `
+		SELECT id, session_id, author, note, created_at
+		FROM message_notes
+		WHERE session_id = ANY($1)
+		ORDER BY created_at
+	`
+	deleteNoteQuery = `
+		DELETE FROM message_notes WHERE id = $1
+	`
+	updateMessageStatusQuery = `
+		UPDATE tts_messages SET status = $2
+		WHERE session_id = $1
+	`
+	selectChannelSettingsQuery = `
+		SELECT settings, updated_at, version
+		FROM channel_settings
+		WHERE channel = $1
+	`
+	listChannelSettingsQuery = `
+		SELECT channel, settings, updated_at, version
+		FROM channel_settings
+		ORDER BY channel
+	`
+	upsertChannelSettingsQuery = `
+		INSERT INTO channel_settings (channel, settings, updated_at, version)
+		VALUES ($1, $2, NOW(), 1)
+		ON CONFLICT (channel) DO UPDATE SET settings = EXCLUDED.settings, updated_at = NOW(), version = channel_settings.version + 1
+		WHERE $3 < 0 OR channel_settings.version = $3
+		RETURNING updated_at, version
+	`
+	selectEncryptedNameQuery = `
+		SELECT name_encrypted
+		FROM tts_messages
+		WHERE session_id = $1 AND anonymous AND name_encrypted IS NOT NULL
+		LIMIT 1
+	`
+	// selectPrivateNoteQuery finds a message's private note, whether it was
+	// delivered or is still waiting for a moderator
+	selectPrivateNoteQuery = `
+		SELECT private_note FROM tts_messages WHERE session_id = $1 AND private_note IS NOT NULL
+		UNION ALL
+		SELECT private_note FROM pending_messages WHERE session_id = $1 AND private_note IS NOT NULL
+		LIMIT 1
+	`
+	insertRefundQuery = `
+		INSERT INTO refunds (session_id, amount, reason)
+		VALUES ($1, $2, $3)
+	`
+	selectReportEntriesQuery = `
+		SELECT created_at, 'donation', session_id, name, amount, ''
+		FROM tts_messages
+		WHERE created_at >= $1 AND created_at < $2 AND amount > 0 AND channel NOT LIKE '%-sandbox'
+		UNION ALL
+		SELECT r.created_at, 'refund', r.session_id,
+			COALESCE((SELECT m.name FROM tts_messages m WHERE m.session_id = r.session_id LIMIT 1), ''),
+			r.amount, r.reason
+		FROM refunds r
+		WHERE r.created_at >= $1 AND r.created_at < $2
+			AND NOT EXISTS (SELECT 1 FROM tts_messages m WHERE m.session_id = r.session_id AND m.channel LIKE '%-sandbox')
+		ORDER BY 1
+	`
+	insertAuditEntryQuery = `
+		INSERT INTO audit_log (action, actor, subject, details)
+		VALUES ($1, $2, $3, $4)
+	`
+	selectAuditEntriesQuery = `
+		SELECT id, action, actor, subject, details, created_at
+		FROM audit_log
+		WHERE created_at >= $1 AND ($2 = '' OR action = $2)
+		ORDER BY id DESC
+		LIMIT $3
+	`
+	exportAuditEntriesQuery = `
+		SELECT id, action, actor, subject, details, created_at
+		FROM audit_log
+		WHERE created_at >= $1 AND created_at < $2
+		ORDER BY id
+	`
+	insertMessageEventQuery = `
+		INSERT INTO tts_message_events (session_id, message_id, channel, type, data, created_at)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5, $6)
+	`
+	selectSessionEventsQuery = `
+		SELECT id, session_id, COALESCE(message_id, 0), channel, type, data, created_at
+		FROM tts_message_events
+		WHERE session_id = $1 OR message_id IN (
+			SELECT message_id FROM tts_message_events WHERE session_id = $1 AND message_id IS NOT NULL
+		)
+		ORDER BY id
+	`
+	selectEventsSinceQuery = `
+		SELECT id, session_id, COALESCE(message_id, 0), channel, type, data, created_at
+		FROM tts_message_events
+		WHERE created_at >= $1
+		ORDER BY id
+	`
+	insertNotificationQuery = `
+		INSERT INTO admin_notifications (kind, message, details)
+		VALUES ($1, $2, $3)
+	`
+	selectNotificationsQuery = `
+		SELECT id, kind, message, details, created_at, read_at
+		FROM admin_notifications
+		WHERE NOT $1 OR read_at IS NULL
+		ORDER BY id DESC
+		LIMIT 200
+	`
+	markNotificationReadQuery = `
+		UPDATE admin_notifications SET read_at = NOW()
+		WHERE id = $1 AND read_at IS NULL
+	`
+	countDonorRefundsQuery = `
+		SELECT COUNT(*)
+		FROM refunds r
+		WHERE r.session_id IN (SELECT session_id FROM tts_messages WHERE name = $1)
+	`
+	insertCharityTotalQuery = `
+		INSERT INTO charity_totals (sponsor, channel)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`
+	// The total only moves while it stays within the cap, and the match is
+	// recorded only when it moved
+	addCharityMatchQuery = `
+		WITH total AS (
+			UPDATE charity_totals
+			SET matched = matched + $4
+			WHERE sponsor = $1 AND channel = $2 AND ($5::REAL <= 0 OR matched + $4 <= $5::REAL)
+			RETURNING matched
+		), recorded AS (
+			INSERT INTO charity_matches (sponsor, channel, session_id, amount, matched)
+			SELECT $1, $2, $3, $6, $4 FROM total
+		)
+		SELECT matched FROM total
+	`
+	getCharityTotalQuery = `
+		SELECT matched
+		FROM charity_totals
+		WHERE sponsor = $1 AND channel = $2
+	`
+	insertBidWarQuery = `
+		INSERT INTO bid_wars (title, options)
+		VALUES ($1, $2)
+		RETURNING id, created_at
+	`
+	selectBidWarsQuery = `
+		SELECT id, title, options, open, created_at, closed_at
+		FROM bid_wars
+	`
+	closeBidWarQuery = `
+		UPDATE bid_wars SET open = FALSE, closed_at = NOW()
+		WHERE id = $1 AND open
+	`
+	insertBidQuery = `
+		INSERT INTO bid_war_bids (bid_war_id, option_key, session_id, name, amount)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	selectBidTalliesQuery = `
+		SELECT option_key, COALESCE(SUM(amount), 0), COUNT(*)
+		FROM bid_war_bids
+		WHERE bid_war_id = $1
+		GROUP BY option_key
+	`
+	insertPollQuery = `
+		INSERT INTO polls (title, choices, closes_at)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	selectPollsQuery = `
+		SELECT id, title, choices, open, closes_at, created_at, closed_at, COALESCE(winner, '')
+		FROM polls
+	`
+	closePollQuery = `
+		UPDATE polls SET open = FALSE, closed_at = NOW(), winner = NULLIF($2, '')
+		WHERE id = $1 AND open
+	`
+	insertVoteQuery = `
+		INSERT INTO poll_votes (poll_id, choice_key, session_id, name, amount)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	selectPollTalliesQuery = `
+		SELECT choice_key, COALESCE(SUM(amount), 0), COUNT(*)
+		FROM poll_votes
+		WHERE poll_id = $1
+		GROUP BY choice_key
+	`
+	selectWheelRulesQuery = `
+		SELECT name, min_amount, rewards, enabled, version
+		FROM wheel_rules
+		ORDER BY min_amount
+	`
+	upsertWheelRuleQuery = `
+		INSERT INTO wheel_rules (name, min_amount, rewards, enabled, version)
+		VALUES ($1, $2, $3, $4, 1)
+		ON CONFLICT (name) DO UPDATE SET min_amount = EXCLUDED.min_amount, rewards = EXCLUDED.rewards, enabled = EXCLUDED.enabled,
+			version = wheel_rules.version + 1
+		WHERE $5 < 0 OR wheel_rules.version = $5
+		RETURNING version
+	`
+	deleteWheelRuleQuery = `
+		DELETE FROM wheel_rules WHERE name = $1
+	`
+	insertWheelSpinQuery = `
+		INSERT INTO wheel_spins (rule, session_id, name, amount, seed, roll, reward, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	selectWheelSpinsQuery = `
+		SELECT rule, session_id, name, amount, seed, roll, reward, created_at
+		FROM wheel_spins
+		WHERE created_at >= $1
+		ORDER BY created_at DESC
+	`
+	insertAPIKeyQuery = `
+		INSERT INTO api_keys (name, key_hash, prefix, scopes, channel, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+		RETURNING id, created_at
+	`
+	lookupAPIKeyQuery = `
+		UPDATE api_keys SET last_used_at = NOW()
+		WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING id, name, prefix, scopes, COALESCE(channel, ''), expires_at, created_by, created_at, revoked_at, last_used_at
+	`
+	selectAPIKeysQuery = `
+		SELECT id, name, prefix, scopes, COALESCE(channel, ''), expires_at, created_by, created_at, revoked_at, last_used_at
+		FROM api_keys
+		ORDER BY created_at DESC
+	`
+	revokeAPIKeyQuery = `
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+	`
+	exportAPIKeysQuery = `
+		SELECT id, name, prefix, scopes, COALESCE(channel, ''), expires_at, created_by, created_at, revoked_at, last_used_at, key_hash
+		FROM api_keys
+		ORDER BY created_at
+	`
+	importAPIKeyQuery = `
+		INSERT INTO api_keys (name, key_hash, prefix, scopes, channel, expires_at, created_by, created_at, revoked_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9)
+		ON CONFLICT (key_hash) DO NOTHING
+	`
+	importWebhookQuery = `
+		INSERT INTO webhooks (url, events, channel, secret, created_by, created_at)
+		SELECT $1, $2, NULLIF($3, ''), $4, $5, $6
+		WHERE NOT EXISTS (SELECT 1 FROM webhooks WHERE secret = $4 AND deleted_at IS NULL)
+	`
+	importSigningKeyQuery = `
+		INSERT INTO signing_keys (prefix, secret, created_by, created_at, retires_at, revoked_at)
+		SELECT $1, $2, $3, $4, $5, $6
+		WHERE NOT EXISTS (SELECT 1 FROM signing_keys WHERE secret = $2)
+	`
+	rotateSigningKeyQuery = `
+		WITH retired AS (
+			UPDATE signing_keys SET retires_at = $3
+			WHERE revoked_at IS NULL AND (retires_at IS NULL OR retires_at > $3)
+		)
+		INSERT INTO signing_keys (prefix, secret, created_by)
+		VALUES ($1, $2, $4)
+		RETURNING id, created_at
+	`
+	selectSigningKeysQuery = `
+		SELECT id, prefix, secret, created_by, created_at, retires_at, revoked_at
+		FROM signing_keys
+		ORDER BY created_at DESC
+	`
+	revokeSigningKeyQuery = `
+		UPDATE signing_keys SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+	`
+	insertMediaRequestQuery = `
+		INSERT INTO media_requests (session_id, name, amount, url, video_id, title, author, duration_seconds, status, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''))
+		RETURNING id, created_at
+	`
+	selectMediaRequestsQuery = `
+		SELECT id, session_id, name, amount, url, video_id, title, author, duration_seconds, status,
+			COALESCE(reason, ''), created_at, COALESCE(decided_by, ''), decided_at
+		FROM media_requests
+		WHERE $1 = '' OR status = $1
 		ORDER BY created_at DESC
+		LIMIT 200
+	`
+	decideMediaRequestQuery = `
+		UPDATE media_requests
+		SET status = $2, reason = NULLIF($3, ''), decided_by = $4, decided_at = NOW()
+		WHERE id = $1 AND status = 'pending'
+		RETURNING id, session_id, name, amount, url, video_id, title, author, duration_seconds, status,
+			COALESCE(reason, ''), created_at, COALESCE(decided_by, ''), decided_at
+	`
+	insertWebhookQuery = `
+		INSERT INTO webhooks (url, events, channel, secret, created_by)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+		RETURNING id, created_at
+	`
+	selectWebhooksQuery = `
+		SELECT id, url, events, COALESCE(channel, ''), secret, created_by, created_at
+		FROM webhooks
+		WHERE deleted_at IS NULL
+		ORDER BY created_at
+	`
+	deleteWebhookQuery = `
+		UPDATE webhooks SET deleted_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	insertWebhookDeliveryQuery = `
+		INSERT INTO webhook_deliveries (webhook_id, delivery_id, event, attempt, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7)
+	`
+	upsertUsageQuery = `
+		INSERT INTO usage_records (channel, period_start, messages, synthesis_seconds, listener_minutes)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (channel, period_start) DO UPDATE SET
+			messages = usage_records.messages + EXCLUDED.messages,
+			synthesis_seconds = usage_records.synthesis_seconds + EXCLUDED.synthesis_seconds,
+			listener_minutes = usage_records.listener_minutes + EXCLUDED.listener_minutes,
+			updated_at = NOW()
+	`
+	selectUsageQuery = `
+		SELECT channel, period_start, messages, synthesis_seconds, listener_minutes
+		FROM usage_records
+		WHERE period_start >= $1 AND period_start < $2 AND ($3 = '' OR channel = $3)
+		ORDER BY period_start, channel
+	`
+	selectUsageMessagesQuery = `
+		SELECT COALESCE(SUM(messages), 0)
+		FROM usage_records
+		WHERE channel = $1 AND period_start >= $2
+	`
+	insertPendingDeliveryQuery = `
+		INSERT INTO webhook_pending_deliveries (webhook_id, delivery_id, event, body, attempt)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	// Deleting what it returns lets only one instance resume each delivery
+	takePendingDeliveriesQuery = `
+		DELETE FROM webhook_pending_deliveries
+		RETURNING webhook_id, delivery_id, event, body, attempt
+	`
+	selectWebhookDeliveriesQuery = `
+		SELECT id, delivery_id, event, attempt, COALESCE(status_code, 0), error, duration_ms, created_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
 	`
 )
 
 // DBConfig holds database configuration
 type DBConfig struct {
+	Driver          string
 	URL             string
+	SQLitePath      string
 	MaxConns        int32
 	MinConns        int32
 	MaxConnLifetime time.Duration
@@ -37,13 +644,10 @@ type DBConfig struct {
 
 // loadDBConfig loads database configuration from environment variables
 func loadDBConfig() (*DBConfig, error) {
-	url := os.Getenv("DATABASE_URL")
-	if url == "" {
-		return nil, fmt.Errorf("DATABASE_URL environment variable is required")
-	}
-
 	return &DBConfig{
-		URL:             url,
+		Driver:          getEnvOrDefault("DB_DRIVER", driverPostgres),
+		URL:             os.Getenv("DATABASE_URL"),
+		SQLitePath:      getEnvOrDefault("SQLITE_PATH", "tts-server.db"),
 		MaxConns:        int32(getEnvIntOrDefault("DB_MAX_CONNS", 25)),
 		MinConns:        int32(getEnvIntOrDefault("DB_MIN_CONNS", 5)),
 		MaxConnLifetime: time.Duration(getEnvIntOrDefault("DB_MAX_CONN_LIFETIME", 3600)) * time.Second,
@@ -51,13 +655,22 @@ func loadDBConfig() (*DBConfig, error) {
 	}, nil
 }
 
-// Check if Row with given session ID exists
-func checkSessionID(sessionID string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// postgresStore is the Store on a Postgres pool. Under SQLite the server
+// keeps one on unavailablePool for the features that need Postgres.
+type postgresStore struct {
+	pool pgPool
+}
+
+// CheckSessionID reports whether a message with the session ID was stored or is awaiting moderation
+func (s *postgresStore) CheckSessionID(ctx context.Context, sessionID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	var count int
-	err := dbPool.QueryRow(ctx, "SELECT COUNT(*) FROM tts_messages WHERE session_id = $1", sessionID).Scan(&count)
+	err := s.pool.QueryRow(ctx, `
+		SELECT (SELECT COUNT(*) FROM tts_messages WHERE session_id = $1)
+			+ (SELECT COUNT(*) FROM pending_messages WHERE session_id = $1 AND status = 'pending')
+	`, sessionID).Scan(&count)
 	if err != nil {
 		return false, fmt.Errorf("failed to query database: %w", err)
 	}
@@ -67,15 +680,21 @@ func checkSessionID(sessionID string) (bool, error) {
 	return count > 0, nil
 }
 
-func initDB() error {
+// connectPostgres opens a pool on DATABASE_URL, timing its queries in
+// metrics, and checks it can reach the server
+func connectPostgres(metrics *metricsRegistry) (*postgresStore, error) {
 	config, err := loadDBConfig()
 	if err != nil {
-		return fmt.Errorf("failed to load database config: %w", err)
+		return nil, fmt.Errorf("failed to load database config: %w", err)
+	}
+
+	if config.URL == "" {
+		return nil, fmt.Errorf("DATABASE_URL environment variable is required")
 	}
 
 	poolConfig, err := pgxpool.ParseConfig(config.URL)
 	if err != nil {
-		return fmt.Errorf("failed to parse database URL: %w", err)
+		return nil, fmt.Errorf("failed to parse database URL: %w", err)
 	}
 
 	// Configure connection pool
@@ -88,48 +707,110 @@ func initDB() error {
 	poolConfig.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
 
 	// Create connection pool
-	dbPool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
-		return fmt.Errorf("failed to create connection pool: %w", err)
+		return nil, fmt.Errorf("failed to create connection pool: %w", err)
 	}
+	s := &postgresStore{pool: timedPool{Pool: pool, metrics: metrics}}
 
 	// Verify connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := dbPool.Ping(ctx); err != nil {
-		return fmt.Errorf("failed to ping database: %w", err)
+	if err := s.pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
 	log.Printf("Successfully connected to database with pool size: %d", config.MaxConns)
-	return nil
+	return s, nil
 }
 
-// addMessage adds a new message to the database
-func addMessage(sessionID string, name string, amount float32, message string, description string) error {
+// AddMessage adds a new message to the database
+func (s *postgresStore) AddMessage(msg Message) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := dbPool.Exec(ctx, insertMessageQuery,
-		sessionID,
-		name,
-		amount,
-		message,
-		description,
+	tag, err := s.pool.Exec(ctx, insertMessageQuery,
+		msg.SessionID,
+		msg.Name,
+		msg.Amount,
+		msg.Message,
+		msg.Description,
+		msg.Anonymous,
+		msg.EncryptedName,
+		msg.Status,
+		msg.Channel,
+		msg.StatusToken,
+		msg.ID,
+		msg.Filtered,
+		msg.OriginalMessage,
+		msg.FilterReasons,
+		msg.Currency,
+		messageKind(msg),
+		messageMetadata(msg),
+		msg.PrivateNote,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to insert message: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return errDuplicateSession
+	}
+
+	return nil
+}
+
+func (s *postgresStore) NextMessageID(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var id int64
+	if err := s.pool.QueryRow(ctx, nextMessageIDQuery).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to reserve message ID: %w", err)
+	}
+	return id, nil
+}
+
+func (s *postgresStore) GetMessagesSince(channel string, since int64, limit int) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectMessagesSinceQuery, channel, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *postgresStore) AckMessage(id int64, channel string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
+	if _, err := s.pool.Exec(ctx, ackMessageQuery, id, channel); err != nil {
+		return fmt.Errorf("failed to acknowledge message: %w", err)
+	}
 	return nil
 }
 
-// getMessages retrieves messages from the database within the specified time range
-func getMessages(from time.Time, to time.Time) []Message {
+// GetMessages retrieves messages from the database within the specified time range
+func (s *postgresStore) GetMessages(query MessageQuery) []Message {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	rows, err := dbPool.Query(ctx, selectMessagesQuery, from, to)
+	rows, err := s.pool.Query(ctx, fmt.Sprintf(selectMessagesQuery, query.order()),
+		query.From, query.To, query.Channel, query.Name, query.Limit, query.Offset)
 	if err != nil {
 		log.Printf("Error querying database: %v", err)
 		return []Message{}
@@ -140,7 +821,7 @@ func getMessages(from time.Time, to time.Time) []Message {
 	for rows.Next() {
 		var msg Message
 		var createdAt time.Time
-		if err := rows.Scan(&msg.Name, &msg.Amount, &msg.Message, &msg.Description, &createdAt); err != nil {
+		if err := rows.Scan(&msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel, &createdAt); err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
 		}
@@ -154,10 +835,1674 @@ func getMessages(from time.Time, to time.Time) []Message {
 	return messages
 }
 
-// closeDB closes the database connection pool
-func closeDB() {
-	if dbPool != nil {
-		dbPool.Close()
-		log.Println("Database connection pool closed")
+func (s *postgresStore) RedactMessage(sessionID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var redacted int64
+	if err := s.pool.QueryRow(ctx, redactMessageQuery, sessionID).Scan(&redacted); err != nil {
+		return false, fmt.Errorf("failed to redact message: %w", err)
+	}
+	return redacted > 0, nil
+}
+
+func (s *postgresStore) ExportMessages(ctx context.Context, query ExportQuery, fn func(ExportedMessage) error) error {
+	rows, err := s.pool.Query(ctx, exportMessagesQuery, query.From, query.To, query.Channel)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanExportedMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *postgresStore) GetMessageByID(ctx context.Context, id int64) (ExportedMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	msg, err := scanExportedMessage(s.pool.QueryRow(ctx, selectMessageByIDQuery, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return msg, errMessageNotFound
+	}
+	return msg, err
+}
+
+func (s *postgresStore) GetDonorSummary(ctx context.Context, query DonorQuery) (DonorSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	summary := DonorSummary{Recent: []DonorDonation{}}
+	err := s.pool.QueryRow(ctx, selectDonorTotalsQuery, query.Channel, query.Donor, query.Month).Scan(
+		&summary.Lifetime.Count, &summary.Lifetime.Total, &summary.ThisMonth.Count, &summary.ThisMonth.Total, &summary.FirstAt, &summary.LastAt)
+	if err != nil {
+		return summary, fmt.Errorf("failed to add up donor donations: %w", err)
+	}
+	if summary.Lifetime.Count == 0 {
+		return summary, nil
+	}
+
+	rows, err := s.pool.Query(ctx, selectDonorDonationsQuery, query.Channel, query.Donor, query.Recent)
+	if err != nil {
+		return summary, fmt.Errorf("failed to query donor donations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var donation DonorDonation
+		if err := rows.Scan(&donation.ID, &donation.Amount, &donation.Currency, &donation.CreatedAt); err != nil {
+			return summary, fmt.Errorf("failed to scan donor donation: %w", err)
+		}
+		summary.Recent = append(summary.Recent, donation)
+	}
+	return summary, rows.Err()
+}
+
+// updateDonorStreaks counts the donations of a stream in their donors'
+// streaks, returning the streaks that changed
+func (s *postgresStore) updateDonorStreaks(stream StreamRun) ([]DonorStreak, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var previous *time.Time
+	if err := s.pool.QueryRow(ctx, selectPreviousStreamQuery, stream.Channel, stream.StartedAt, minStreakStream).Scan(&previous); err != nil {
+		return nil, fmt.Errorf("failed to query previous stream: %w", err)
+	}
+
+	rows, err := s.pool.Query(ctx, selectStreakDonorsQuery, stream.Channel, stream.StartedAt, stream.StoppedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stream donors: %w", err)
+	}
+	type streamDonor struct {
+		donor  string
+		streak DonorStreak
+	}
+	var donors []streamDonor
+	for rows.Next() {
+		var donor streamDonor
+		if err := rows.Scan(&donor.donor, &donor.streak.Name, &donor.streak.PreviousAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan stream donor: %w", err)
+		}
+		donors = append(donors, donor)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query stream donors: %w", err)
+	}
+
+	var streaks []DonorStreak
+	for _, donor := range donors {
+		streak := donor.streak
+		err := s.pool.QueryRow(ctx, upsertDonorStreakQuery, stream.Channel, donor.donor, streak.Name, stream.StartedAt, previous).
+			Scan(&streak.Streak, &streak.BestStreak, &streak.Streams)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Another run counted it first
+			continue
+		}
+		if err != nil {
+			return streaks, fmt.Errorf("failed to update donor streak: %w", err)
+		}
+		streaks = append(streaks, streak)
+	}
+	return streaks, nil
+}
+
+// touchStream records that a channel's stream is still running, starting a
+// new one if the last was stopped or hasn't been seen for grace
+func (s *postgresStore) touchStream(channel string, grace time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, stopStaleStreamsQuery, grace, channel); err != nil {
+		return fmt.Errorf("failed to stop stale stream: %w", err)
+	}
+	if _, err := s.pool.Exec(ctx, touchStreamQuery, channel); err != nil {
+		return fmt.Errorf("failed to record stream: %w", err)
+	}
+	return nil
+}
+
+// countedStreams stops the streams no instance has seen for grace, then
+// lists those that have run long enough to count in streaks and are running
+// or stopped since the given time
+func (s *postgresStore) countedStreams(since time.Time, grace time.Duration) ([]StreamRun, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, stopStaleStreamsQuery, grace, ""); err != nil {
+		return nil, fmt.Errorf("failed to stop stale streams: %w", err)
+	}
+	rows, err := s.pool.Query(ctx, selectCountedStreamsQuery, since, minStreakStream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query streams: %w", err)
+	}
+	defer rows.Close()
+
+	var streams []StreamRun
+	for rows.Next() {
+		var stream StreamRun
+		if err := rows.Scan(&stream.Channel, &stream.StartedAt, &stream.StoppedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan stream: %w", err)
+		}
+		streams = append(streams, stream)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query streams: %w", err)
+	}
+	return streams, nil
+}
+
+func (s *postgresStore) DeleteExpiredMessages(before time.Time, limit int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var deleted int64
+	if err := s.pool.QueryRow(ctx, deleteExpiredMessagesQuery, before, limit).Scan(&deleted); err != nil {
+		return 0, fmt.Errorf("failed to delete messages: %w", err)
+	}
+	return deleted, nil
+}
+
+func (s *postgresStore) DeleteSandboxMessages(channel string, before time.Time, limit int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var deleted int64
+	if err := s.pool.QueryRow(ctx, deleteSandboxMessagesQuery, before, limit, channel).Scan(&deleted); err != nil {
+		return 0, fmt.Errorf("failed to delete sandbox messages: %w", err)
+	}
+	return deleted, nil
+}
+
+func scanExportedMessage(row rowScanner) (ExportedMessage, error) {
+	var msg ExportedMessage
+	err := row.Scan(&msg.ID, &msg.SessionID, &msg.Channel, &msg.Name, &msg.Amount, &msg.Message, &msg.Description,
+		&msg.Anonymous, &msg.Status, &msg.CreatedAt, &msg.PlayedAt)
+	if err != nil {
+		return msg, fmt.Errorf("failed to scan message: %w", err)
+	}
+	return msg, nil
+}
+
+// StoredMessage is a message row along with its storage metadata
+type StoredMessage struct {
+	Message
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// getMessagesByStatus returns messages in the given playback state created since from
+func (s *postgresStore) getMessagesByStatus(status string, from time.Time) ([]StoredMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectMessagesByStatusQuery, status, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []StoredMessage{}
+	for rows.Next() {
+		var msg StoredMessage
+		if err := rows.Scan(&msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel, &msg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		msg.Status = status
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// getFilteredMessages returns messages the content filter changed or blocked,
+// optionally for one channel and status, newest first
+func (s *postgresStore) getFilteredMessages(from time.Time, channel string, status string) ([]FilteredMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectFilteredMessagesQuery, from, channel, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query filtered messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []FilteredMessage{}
+	for rows.Next() {
+		var msg FilteredMessage
+		if err := rows.Scan(&msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel, &msg.CreatedAt,
+			&msg.Status, &msg.OriginalMessage, &msg.FilterReasons); err != nil {
+			return nil, fmt.Errorf("failed to scan filtered message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// getMessageBySession loads the stored message for a session ID
+func (s *postgresStore) getMessageBySession(sessionID string) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var msg Message
+	err := s.pool.QueryRow(ctx, selectMessageBySessionQuery, sessionID).Scan(
+		&msg.ID, &msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel, &msg.Status,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message: %w", err)
+	}
+	return &msg, nil
+}
+
+// findMessages returns stored messages matching a filter, newest first
+func (s *postgresStore) findMessages(filter MessageFilter) ([]StoredMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := `SELECT session_id, name, amount, message, description, anonymous, channel, status, created_at FROM tts_messages` +
+		messageFilterClause + ` ORDER BY created_at DESC LIMIT 1000`
+	rows, err := s.pool.Query(ctx, query, filter.From, filter.To, filter.Name, filter.Keyword, filter.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []StoredMessage{}
+	for rows.Next() {
+		var msg StoredMessage
+		if err := rows.Scan(&msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel, &msg.Status, &msg.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// getStatusByToken returns the stored status of the message with the given donor status token
+func (s *postgresStore) getStatusByToken(token string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var status string
+	if err := s.pool.QueryRow(ctx, selectStatusByTokenQuery, token).Scan(&status); err != nil {
+		return "", fmt.Errorf("failed to query message status: %w", err)
+	}
+	return status, nil
+}
+
+// setStatusByFilter updates the status of every message matching a filter
+func (s *postgresStore) setStatusByFilter(filter MessageFilter, status string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	query := `UPDATE tts_messages SET status = $6` + messageFilterClause
+	tag, err := s.pool.Exec(ctx, query, filter.From, filter.To, filter.Name, filter.Keyword, filter.Channel, status)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update messages: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// addNote attaches a moderator note to a message
+func (s *postgresStore) addNote(sessionID string, author string, text string) (*MessageNote, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	note := &MessageNote{SessionID: sessionID, Author: author, Note: text}
+	if err := s.pool.QueryRow(ctx, insertNoteQuery, sessionID, author, text).Scan(&note.ID, &note.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to insert note: %w", err)
+	}
+	return note, nil
+}
+
+// getNotesForSessions returns the notes of each session, oldest first
+func (s *postgresStore) getNotesForSessions(sessionIDs []string) (map[string][]MessageNote, error) {
+	notes := make(map[string][]MessageNote)
+	if len(sessionIDs) == 0 {
+		return notes, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectNotesQuery, sessionIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note MessageNote
+		if err := rows.Scan(&note.ID, &note.SessionID, &note.Author, &note.Note, &note.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan note: %w", err)
+		}
+		notes[note.SessionID] = append(notes[note.SessionID], note)
+	}
+
+	return notes, rows.Err()
+}
+
+// deleteNote removes a moderator note
+func (s *postgresStore) deleteNote(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, deleteNoteQuery, id); err != nil {
+		return fmt.Errorf("failed to delete note: %w", err)
+	}
+	return nil
+}
+
+// setMessageStatus updates the playback state of a stored message
+func (s *postgresStore) setMessageStatus(sessionID string, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, updateMessageStatusQuery, sessionID, status); err != nil {
+		return fmt.Errorf("failed to update message status: %w", err)
+	}
+	return nil
+}
+
+// getEncryptedName returns the sealed donor name of an anonymous donation
+func (s *postgresStore) getEncryptedName(sessionID string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var sealed []byte
+	if err := s.pool.QueryRow(ctx, selectEncryptedNameQuery, sessionID).Scan(&sealed); err != nil {
+		return nil, fmt.Errorf("failed to query encrypted name: %w", err)
+	}
+	return sealed, nil
+}
+
+// getPrivateNote returns a message's encrypted private note, or
+// errMessageNotFound if it has none
+func (s *postgresStore) getPrivateNote(sessionID string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var note string
+	err := s.pool.QueryRow(ctx, selectPrivateNoteQuery, sessionID).Scan(&note)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errMessageNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query private note: %w", err)
+	}
+	return note, nil
+}
+
+// addRefund records a refund against a stored donation
+func (s *postgresStore) addRefund(sessionID string, amount float32, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, insertRefundQuery, sessionID, amount, reason); err != nil {
+		return fmt.Errorf("failed to insert refund: %w", err)
+	}
+	return nil
+}
+
+// getReportEntries returns donations and refunds in [from, to), oldest first
+func (s *postgresStore) getReportEntries(from time.Time, to time.Time) ([]report.Entry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectReportEntriesQuery, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query report entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []report.Entry{}
+	for rows.Next() {
+		var entry report.Entry
+		var amount float32
+		if err := rows.Scan(&entry.Time, &entry.Kind, &entry.SessionID, &entry.Name, &amount, &entry.Note); err != nil {
+			return nil, fmt.Errorf("failed to scan report entry: %w", err)
+		}
+		entry.Amount = float64(amount)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// addAuditEntry appends an entry to the audit log
+func (s *postgresStore) addAuditEntry(action string, actor string, subject string, details interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit details: %w", err)
+	}
+
+	if _, err := s.pool.Exec(ctx, insertAuditEntryQuery, action, actor, subject, raw); err != nil {
+		return fmt.Errorf("failed to insert audit entry: %w", err)
+	}
+	return nil
+}
+
+// getAuditEntries returns the newest audit entries since from, optionally for one action
+func (s *postgresStore) getAuditEntries(from time.Time, action string, limit int) ([]AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectAuditEntriesQuery, from, action, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var raw []byte
+		if err := rows.Scan(&entry.ID, &entry.Action, &entry.Actor, &entry.Subject, &raw, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entry.Details = json.RawMessage(raw)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// exportAuditEntries calls fn with every audit entry made in [from, to), oldest first
+func (s *postgresStore) exportAuditEntries(ctx context.Context, from, to time.Time, fn func(AuditEntry) error) error {
+	rows, err := s.pool.Query(ctx, exportAuditEntriesQuery, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry AuditEntry
+		var raw []byte
+		if err := rows.Scan(&entry.ID, &entry.Action, &entry.Actor, &entry.Subject, &raw, &entry.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan audit entry: %w", err)
+		}
+		entry.Details = json.RawMessage(raw)
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// addMessageEvent appends an event to the message event log
+func (s *postgresStore) addMessageEvent(event MessageEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, insertMessageEventQuery, event.SessionID, event.MessageID, event.Channel, event.Type, []byte(event.Data), event.CreatedAt); err != nil {
+		return fmt.Errorf("failed to insert message event: %w", err)
+	}
+	return nil
+}
+
+// getSessionEvents returns every event of a session's message, oldest first
+func (s *postgresStore) getSessionEvents(sessionID string) ([]MessageEvent, error) {
+	return s.queryMessageEvents(selectSessionEventsQuery, sessionID)
+}
+
+// getEventsSince returns every event recorded since from, oldest first
+func (s *postgresStore) getEventsSince(from time.Time) ([]MessageEvent, error) {
+	return s.queryMessageEvents(selectEventsSinceQuery, from)
+}
+
+func (s *postgresStore) queryMessageEvents(query string, args ...any) ([]MessageEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query message events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []MessageEvent{}
+	for rows.Next() {
+		var event MessageEvent
+		var data []byte
+		if err := rows.Scan(&event.ID, &event.SessionID, &event.MessageID, &event.Channel, &event.Type, &data, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan message event: %w", err)
+		}
+		if data != nil {
+			event.Data = json.RawMessage(data)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// addNotification stores an admin notification
+func (s *postgresStore) addNotification(kind string, message string, details interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification details: %w", err)
+	}
+
+	if _, err := s.pool.Exec(ctx, insertNotificationQuery, kind, message, raw); err != nil {
+		return fmt.Errorf("failed to insert notification: %w", err)
+	}
+	return nil
+}
+
+// getNotifications returns recent notifications, optionally only unread ones
+func (s *postgresStore) getNotifications(unreadOnly bool) ([]Notification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectNotificationsQuery, unreadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notifications: %w", err)
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var raw []byte
+		if err := rows.Scan(&n.ID, &n.Kind, &n.Message, &raw, &n.CreatedAt, &n.ReadAt); err != nil {
+			return nil, fmt.Errorf("failed to scan notification: %w", err)
+		}
+		n.Details = json.RawMessage(raw)
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
+
+// markNotificationRead marks a notification as read
+func (s *postgresStore) markNotificationRead(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, markNotificationReadQuery, id); err != nil {
+		return fmt.Errorf("failed to update notification: %w", err)
+	}
+	return nil
+}
+
+// countDonorRefunds returns how many refunds were recorded against a donor name
+func (s *postgresStore) countDonorRefunds(name string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var count int
+	if err := s.pool.QueryRow(ctx, countDonorRefundsQuery, name).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count donor refunds: %w", err)
+	}
+	return count, nil
+}
+
+// getChannelSettings loads a channel's settings, returning empty settings if none are stored
+func (s *postgresStore) getChannelSettings(channel string) (*ChannelSettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var raw []byte
+	var updatedAt time.Time
+	var version int
+	err := s.pool.QueryRow(ctx, selectChannelSettingsQuery, channel).Scan(&raw, &updatedAt, &version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &ChannelSettings{Channel: channel, Webhooks: []string{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query channel settings: %w", err)
+	}
+
+	settings := &ChannelSettings{}
+	if err := json.Unmarshal(raw, settings); err != nil {
+		return nil, fmt.Errorf("failed to decode channel settings: %w", err)
+	}
+	settings.Channel = channel
+	settings.UpdatedAt = updatedAt
+	settings.Version = version
+
+	return settings, nil
+}
+
+// listChannelSettings returns the settings of every configured channel
+func (s *postgresStore) listChannelSettings() ([]ChannelSettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, listChannelSettingsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query channel settings: %w", err)
+	}
+	defer rows.Close()
+
+	channels := []ChannelSettings{}
+	for rows.Next() {
+		var settings ChannelSettings
+		var channel string
+		var raw []byte
+		var updatedAt time.Time
+		var version int
+		if err := rows.Scan(&channel, &raw, &updatedAt, &version); err != nil {
+			return nil, fmt.Errorf("failed to scan channel settings: %w", err)
+		}
+		if err := json.Unmarshal(raw, &settings); err != nil {
+			log.Printf("Error decoding settings for channel %s: %v", channel, err)
+			continue
+		}
+		settings.Channel = channel
+		settings.UpdatedAt = updatedAt
+		settings.Version = version
+		channels = append(channels, settings)
+	}
+
+	return channels, rows.Err()
+}
+
+// saveChannelSettings creates or replaces a channel's settings. Replacing only
+// succeeds while the stored version still matches expected (or expected is anyVersion).
+func (s *postgresStore) saveChannelSettings(settings *ChannelSettings, expected int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode channel settings: %w", err)
+	}
+
+	err = s.pool.QueryRow(ctx, upsertChannelSettingsQuery, settings.Channel, raw, expected).Scan(&settings.UpdatedAt, &settings.Version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errVersionConflict
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save channel settings: %w", err)
+	}
+
+	return nil
+}
+
+// addCharityMatch adds a sponsor's matched contribution to a donation to the
+// channel's total and records it, unless that would take the total past limit
+// (0 for none). It returns the new total, and false when the total was left
+// alone.
+func (s *postgresStore) addCharityMatch(sponsor string, channel string, sessionID string, amount float32, matched float32, limit float32) (float32, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, insertCharityTotalQuery, sponsor, channel); err != nil {
+		return 0, false, fmt.Errorf("failed to create charity total: %w", err)
+	}
+
+	var total float32
+	err := s.pool.QueryRow(ctx, addCharityMatchQuery, sponsor, channel, sessionID, matched, limit, amount).Scan(&total)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to add charity match: %w", err)
+	}
+
+	return total, true, nil
+}
+
+// getCharityTotal returns how much a sponsor has matched on a channel so far
+func (s *postgresStore) getCharityTotal(sponsor string, channel string) (float32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var total float32
+	err := s.pool.QueryRow(ctx, getCharityTotalQuery, sponsor, channel).Scan(&total)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load charity total: %w", err)
+	}
+
+	return total, nil
+}
+
+// createBidWar stores a new open bid war
+func (s *postgresStore) createBidWar(title string, options []TallyOption) (*BidWar, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw, err := json.Marshal(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode bid war options: %w", err)
+	}
+
+	war := &BidWar{Title: title, Options: options, Open: true}
+	if err := s.pool.QueryRow(ctx, insertBidWarQuery, title, raw).Scan(&war.ID, &war.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to insert bid war: %w", err)
+	}
+	war.Tallies = buildTallies(options, nil)
+
+	return war, nil
+}
+
+// queryBidWars loads bid wars matching the given filter along with their tallies
+func (s *postgresStore) queryBidWars(filter string, args ...interface{}) ([]BidWar, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectBidWarsQuery+filter, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query bid wars: %w", err)
+	}
+
+	wars := []BidWar{}
+	for rows.Next() {
+		var war BidWar
+		var raw []byte
+		if err := rows.Scan(&war.ID, &war.Title, &raw, &war.Open, &war.CreatedAt, &war.ClosedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan bid war: %w", err)
+		}
+		if err := json.Unmarshal(raw, &war.Options); err != nil {
+			log.Printf("Error decoding options for bid war %d: %v", war.ID, err)
+			continue
+		}
+		wars = append(wars, war)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate bid wars: %w", err)
+	}
+
+	for i := range wars {
+		sums, err := s.getBidTallies(ctx, wars[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		wars[i].Tallies = buildTallies(wars[i].Options, sums)
+	}
+
+	return wars, nil
+}
+
+func (s *postgresStore) getOpenBidWars() ([]BidWar, error) {
+	return s.queryBidWars(" WHERE open ORDER BY id")
+}
+
+func (s *postgresStore) listBidWars() ([]BidWar, error) {
+	return s.queryBidWars(" ORDER BY id DESC")
+}
+
+func (s *postgresStore) getBidWar(id int64) (*BidWar, error) {
+	wars, err := s.queryBidWars(" WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(wars) == 0 {
+		return nil, fmt.Errorf("bid war %d not found", id)
+	}
+	return &wars[0], nil
+}
+
+// closeBidWar stops a bid war from accepting further bids
+func (s *postgresStore) closeBidWar(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, closeBidWarQuery, id); err != nil {
+		return fmt.Errorf("failed to close bid war: %w", err)
+	}
+	return nil
+}
+
+// addBid records a donation's contribution to a bid war option
+func (s *postgresStore) addBid(warID int64, option string, sessionID string, name string, amount float32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, insertBidQuery, warID, option, sessionID, name, amount); err != nil {
+		return fmt.Errorf("failed to insert bid: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) getBidTallies(ctx context.Context, warID int64) (map[string]Tally, error) {
+	return s.queryTallies(ctx, selectBidTalliesQuery, warID)
+}
+
+// queryTallies runs a grouped sum query returning key, total and count rows
+func (s *postgresStore) queryTallies(ctx context.Context, query string, id int64) (map[string]Tally, error) {
+	rows, err := s.pool.Query(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tallies: %w", err)
+	}
+	defer rows.Close()
+
+	sums := make(map[string]Tally)
+	for rows.Next() {
+		var tally Tally
+		if err := rows.Scan(&tally.Key, &tally.Total, &tally.Bids); err != nil {
+			return nil, fmt.Errorf("failed to scan tally: %w", err)
+		}
+		sums[tally.Key] = tally
+	}
+
+	return sums, rows.Err()
+}
+
+// createPoll stores a new open poll
+func (s *postgresStore) createPoll(title string, choices []TallyOption, closesAt *time.Time) (*Poll, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw, err := json.Marshal(choices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode poll choices: %w", err)
+	}
+
+	poll := &Poll{Title: title, Choices: choices, Open: true, ClosesAt: closesAt}
+	if err := s.pool.QueryRow(ctx, insertPollQuery, title, raw, closesAt).Scan(&poll.ID, &poll.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to insert poll: %w", err)
+	}
+	poll.Results = buildTallies(choices, nil)
+
+	return poll, nil
+}
+
+// queryPolls loads polls matching the given filter along with their results
+func (s *postgresStore) queryPolls(filter string, args ...interface{}) ([]Poll, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectPollsQuery+filter, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query polls: %w", err)
+	}
+
+	result := []Poll{}
+	for rows.Next() {
+		var poll Poll
+		var raw []byte
+		if err := rows.Scan(&poll.ID, &poll.Title, &raw, &poll.Open, &poll.ClosesAt, &poll.CreatedAt, &poll.ClosedAt, &poll.Winner); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan poll: %w", err)
+		}
+		if err := json.Unmarshal(raw, &poll.Choices); err != nil {
+			log.Printf("Error decoding choices for poll %d: %v", poll.ID, err)
+			continue
+		}
+		result = append(result, poll)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate polls: %w", err)
+	}
+
+	for i := range result {
+		sums, err := s.queryTallies(ctx, selectPollTalliesQuery, result[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		result[i].Results = buildTallies(result[i].Choices, sums)
+	}
+
+	return result, nil
+}
+
+func (s *postgresStore) getOpenPolls() ([]Poll, error) {
+	return s.queryPolls(" WHERE open ORDER BY id")
+}
+
+func (s *postgresStore) listPolls() ([]Poll, error) {
+	return s.queryPolls(" ORDER BY id DESC")
+}
+
+func (s *postgresStore) getPoll(id int64) (*Poll, error) {
+	result, err := s.queryPolls(" WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("poll %d not found", id)
+	}
+	return &result[0], nil
+}
+
+// closePoll marks a poll closed and records its winner. It reports false if
+// the poll was already closed, e.g. by another instance's timer.
+func (s *postgresStore) closePoll(id int64, winner string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, closePollQuery, id, winner)
+	if err != nil {
+		return false, fmt.Errorf("failed to close poll: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// addVote records a donation's contribution to a poll choice
+func (s *postgresStore) addVote(pollID int64, choice string, sessionID string, name string, amount float32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, insertVoteQuery, pollID, choice, sessionID, name, amount); err != nil {
+		return fmt.Errorf("failed to insert vote: %w", err)
+	}
+	return nil
+}
+
+// listWheelRules returns all configured wheel rules
+func (s *postgresStore) listWheelRules() ([]WheelRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectWheelRulesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wheel rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []WheelRule{}
+	for rows.Next() {
+		var rule WheelRule
+		var raw []byte
+		if err := rows.Scan(&rule.Name, &rule.MinAmount, &raw, &rule.Enabled, &rule.Version); err != nil {
+			return nil, fmt.Errorf("failed to scan wheel rule: %w", err)
+		}
+		if err := json.Unmarshal(raw, &rule.Rewards); err != nil {
+			log.Printf("Error decoding rewards for wheel rule %s: %v", rule.Name, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// saveWheelRule creates or replaces a wheel rule, returning its new version.
+// Replacing only succeeds while the stored version still matches expected.
+func (s *postgresStore) saveWheelRule(rule WheelRule, expected int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	raw, err := json.Marshal(rule.Rewards)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode wheel rewards: %w", err)
+	}
+
+	var version int
+	err = s.pool.QueryRow(ctx, upsertWheelRuleQuery, rule.Name, rule.MinAmount, raw, rule.Enabled, expected).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errVersionConflict
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to save wheel rule: %w", err)
+	}
+	return version, nil
+}
+
+// deleteWheelRule removes a wheel rule
+func (s *postgresStore) deleteWheelRule(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.pool.Exec(ctx, deleteWheelRuleQuery, name); err != nil {
+		return fmt.Errorf("failed to delete wheel rule: %w", err)
+	}
+	return nil
+}
+
+// addWheelSpin records a spin so its outcome can be audited later
+func (s *postgresStore) addWheelSpin(spin WheelSpin) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Postgres has no unsigned 64-bit type; the roll is stored as its bit pattern
+	_, err := s.pool.Exec(ctx, insertWheelSpinQuery,
+		spin.Rule,
+		spin.SessionID,
+		spin.Name,
+		spin.Amount,
+		spin.Seed,
+		int64(spin.Roll),
+		spin.Reward,
+		spin.CreatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert wheel spin: %w", err)
+	}
+	return nil
+}
+
+// getWheelSpins returns spins recorded since the given time
+func (s *postgresStore) getWheelSpins(from time.Time) ([]WheelSpin, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectWheelSpinsQuery, from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query wheel spins: %w", err)
+	}
+	defer rows.Close()
+
+	spins := []WheelSpin{}
+	for rows.Next() {
+		var spin WheelSpin
+		var roll int64
+		if err := rows.Scan(&spin.Rule, &spin.SessionID, &spin.Name, &spin.Amount, &spin.Seed, &roll, &spin.Reward, &spin.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan wheel spin: %w", err)
+		}
+		spin.Roll = uint64(roll)
+		spins = append(spins, spin)
+	}
+
+	return spins, rows.Err()
+}
+
+// createAPIKey stores a new key by its hash and sets its ID
+func (s *postgresStore) createAPIKey(key *APIKey, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.pool.QueryRow(ctx, insertAPIKeyQuery,
+		key.Name, hash, key.Prefix, key.Scopes, key.Channel, key.ExpiresAt, key.CreatedBy,
+	).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert API key: %w", err)
+	}
+	return nil
+}
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.Channel, &key.ExpiresAt,
+		&key.CreatedBy, &key.CreatedAt, &key.RevokedAt, &key.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// lookupAPIKey finds a live key by hash and records that it was used
+func (s *postgresStore) lookupAPIKey(hash string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key, err := scanAPIKey(s.pool.QueryRow(ctx, lookupAPIKeyQuery, hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up API key: %w", err)
+	}
+	return key, nil
+}
+
+// listAPIKeys returns every key, including revoked and expired ones
+func (s *postgresStore) listAPIKeys() ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectAPIKeysQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// revokeAPIKey revokes a key, reporting false if it was missing or already revoked
+func (s *postgresStore) revokeAPIKey(id int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, revokeAPIKeyQuery, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// exportAPIKeys returns every key with its hash, oldest first, for a configuration bundle
+func (s *postgresStore) exportAPIKeys() ([]BundledAPIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, exportAPIKeysQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []BundledAPIKey{}
+	for rows.Next() {
+		var key BundledAPIKey
+		err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.Channel, &key.ExpiresAt,
+			&key.CreatedBy, &key.CreatedAt, &key.RevokedAt, &key.LastUsedAt, &key.KeyHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// importAPIKey stores a bundled key unless one with the same hash exists,
+// reporting whether it was added
+func (s *postgresStore) importAPIKey(key BundledAPIKey) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, importAPIKeyQuery,
+		key.Name, key.KeyHash, key.Prefix, key.Scopes, key.Channel, key.ExpiresAt, key.CreatedBy, key.CreatedAt, key.RevokedAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to import API key: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// importWebhook stores a bundled webhook unless one with its secret is
+// already subscribed, reporting whether it was added
+func (s *postgresStore) importWebhook(webhook *Webhook) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, importWebhookQuery,
+		webhook.URL, webhook.Events, webhook.Channel, webhook.secret, webhook.CreatedBy, webhook.CreatedAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to import webhook: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// importSigningKey stores a bundled signing key unless its secret is already
+// known, reporting whether it was added
+func (s *postgresStore) importSigningKey(key *SigningKey) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, importSigningKeyQuery,
+		key.Prefix, key.secret, key.CreatedBy, key.CreatedAt, key.RetiresAt, key.RevokedAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to import signing key: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// rotateSigningKey stores a new signing key and schedules every key that is
+// still active to retire at retiresAt
+func (s *postgresStore) rotateSigningKey(key *SigningKey, retiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.pool.QueryRow(ctx, rotateSigningKeyQuery, key.Prefix, key.secret, retiresAt, key.CreatedBy).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert signing key: %w", err)
+	}
+	return nil
+}
+
+// listSigningKeys returns every signing key, newest first
+func (s *postgresStore) listSigningKeys() ([]*SigningKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectSigningKeysQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*SigningKey{}
+	for rows.Next() {
+		var key SigningKey
+		if err := rows.Scan(&key.ID, &key.Prefix, &key.secret, &key.CreatedBy, &key.CreatedAt, &key.RetiresAt, &key.RevokedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// revokeSigningKey revokes a signing key, reporting false if it was missing or already revoked
+func (s *postgresStore) revokeSigningKey(id int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, revokeSigningKeyQuery, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke signing key: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// addMediaRequest stores a media-share request and sets its ID
+func (s *postgresStore) addMediaRequest(request *MediaRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.pool.QueryRow(ctx, insertMediaRequestQuery,
+		request.SessionID, request.Name, request.Amount, request.URL, request.VideoID,
+		request.Title, request.Author, request.DurationSeconds, request.Status, request.Reason,
+	).Scan(&request.ID, &request.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert media request: %w", err)
+	}
+	return nil
+}
+
+// rowScanner is satisfied by both pgx.Row and pgx.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMediaRequest(row rowScanner) (*MediaRequest, error) {
+	var request MediaRequest
+	err := row.Scan(&request.ID, &request.SessionID, &request.Name, &request.Amount, &request.URL,
+		&request.VideoID, &request.Title, &request.Author, &request.DurationSeconds, &request.Status,
+		&request.Reason, &request.CreatedAt, &request.DecidedBy, &request.DecidedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// getMediaRequests returns the latest media requests, optionally only those with the given status
+func (s *postgresStore) getMediaRequests(status string) ([]*MediaRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectMediaRequestsQuery, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query media requests: %w", err)
+	}
+	defer rows.Close()
+
+	requests := []*MediaRequest{}
+	for rows.Next() {
+		request, err := scanMediaRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan media request: %w", err)
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, rows.Err()
+}
+
+// decideMediaRequest moves a pending media request to approved or rejected
+func (s *postgresStore) decideMediaRequest(id int64, status string, reason string, decidedBy string) (*MediaRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	request, err := scanMediaRequest(s.pool.QueryRow(ctx, decideMediaRequestQuery, id, status, reason, decidedBy))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update media request: %w", err)
+	}
+	return request, nil
+}
+
+func (s *postgresStore) MaintainTables(ctx context.Context, _ float64) ([]TableHealth, []string, error) {
+	// A plain VACUUM takes no lock that blocks reads or writes, so it is
+	// safe to run while alerts are still coming in
+	for _, table := range maintenanceTables {
+		vacuumCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+		_, err := s.pool.Exec(vacuumCtx, "VACUUM (ANALYZE) "+table)
+		cancel()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to vacuum %s: %w", table, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	rows, err := s.pool.Query(ctx, tableHealthQuery, maintenanceTables)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query table health: %w", err)
+	}
+	defer rows.Close()
+	var tables []TableHealth
+	for rows.Next() {
+		var table TableHealth
+		if err := rows.Scan(&table.Table, &table.Rows, &table.DeadRows, &table.SizeBytes); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan table health: %w", err)
+		}
+		if total := table.Rows + table.DeadRows; total > 0 {
+			table.BloatPercent = float64(table.DeadRows) / float64(total) * 100
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to query table health: %w", err)
+	}
+
+	rows, err = s.pool.Query(ctx, invalidIndexesQuery, maintenanceTables)
+	if err != nil {
+		return tables, nil, fmt.Errorf("failed to query invalid indexes: %w", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var index, table string
+		if err := rows.Scan(&index, &table); err != nil {
+			return tables, nil, fmt.Errorf("failed to scan invalid index: %w", err)
+		}
+		problems = append(problems, fmt.Sprintf("index %s on %s is invalid; rebuild it with REINDEX INDEX CONCURRENTLY %s", index, table, index))
+	}
+	return tables, problems, rows.Err()
+}
+
+// Ping checks the connection to Postgres
+func (s *postgresStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// Close closes the database connection pool
+func (s *postgresStore) Close() {
+	s.pool.Close()
+	log.Println("Database connection pool closed")
+}
+
+// addPendingMessage stores a message in the moderation queue
+func (s *postgresStore) addPendingMessage(msg Message) (*PendingMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pending message: %w", err)
+	}
+
+	pending := &PendingMessage{Message: msg}
+	pending.showFilter()
+	err = s.pool.QueryRow(ctx, insertPendingMessageQuery,
+		msg.SessionID,
+		msg.Channel,
+		payload,
+		msg.EncryptedName,
+		msg.StatusToken,
+		msg.PrivateNote,
+		msg.Filtered,
+		msg.OriginalMessage,
+		msg.FilterReasons,
+		msg.Provider,
+	).Scan(&pending.ID, &pending.Status, &pending.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert pending message: %w", err)
+	}
+	return pending, nil
+}
+
+// scanPendingMessage reads a moderation queue row, restoring the fields the payload does not carry
+func scanPendingMessage(row rowScanner) (*PendingMessage, error) {
+	var pending PendingMessage
+	var payload []byte
+	var kept Message
+	var reason, decidedBy *string
+	if err := row.Scan(&pending.ID, &payload, &kept.EncryptedName, &kept.StatusToken, &kept.PrivateNote,
+		&kept.Filtered, &kept.OriginalMessage, &kept.FilterReasons, &kept.Provider,
+		&pending.Status, &reason, &pending.CreatedAt, &decidedBy, &pending.DecidedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(payload, &pending.Message); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pending message: %w", err)
+	}
+	pending.Message.EncryptedName, pending.Message.StatusToken, pending.Message.PrivateNote = kept.EncryptedName, kept.StatusToken, kept.PrivateNote
+	pending.Message.Filtered, pending.Message.OriginalMessage, pending.Message.Provider = kept.Filtered, kept.OriginalMessage, kept.Provider
+	if len(kept.FilterReasons) > 0 {
+		pending.Message.FilterReasons = kept.FilterReasons
+	}
+	pending.showFilter()
+
+	if reason != nil {
+		pending.Reason = *reason
+	}
+	if decidedBy != nil {
+		pending.DecidedBy = *decidedBy
+	}
+	return &pending, nil
+}
+
+// getPendingMessages returns the messages waiting for a moderator, oldest first
+func (s *postgresStore) getPendingMessages(channel string) ([]PendingMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectPendingMessagesQuery, channel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []PendingMessage{}
+	for rows.Next() {
+		pending, err := scanPendingMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan pending message: %w", err)
+		}
+		messages = append(messages, *pending)
+	}
+	return messages, rows.Err()
+}
+
+// decidePendingMessage approves or rejects a message that is still pending
+func (s *postgresStore) decidePendingMessage(id int64, status string, reason string, user string) (*PendingMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	row := s.pool.QueryRow(ctx, decidePendingMessageQuery, id, status, reason, user)
+	pending, err := scanPendingMessage(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		var exists bool
+		if err := s.pool.QueryRow(ctx, pendingMessageExistsQuery, id).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to look up pending message: %w", err)
+		}
+		if !exists {
+			return nil, errPendingNotFound
+		}
+		return nil, errNotPending
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decide pending message: %w", err)
+	}
+	return pending, nil
+}
+
+// createWebhook stores a new outbound webhook and sets its ID
+func (s *postgresStore) createWebhook(webhook *Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.pool.QueryRow(ctx, insertWebhookQuery,
+		webhook.URL, webhook.Events, webhook.Channel, webhook.secret, webhook.CreatedBy,
+	).Scan(&webhook.ID, &webhook.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook: %w", err)
+	}
+	return nil
+}
+
+// listWebhooks returns every webhook that hasn't been deleted, with its secret
+func (s *postgresStore) listWebhooks() ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectWebhooksQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &webhook.Events, &webhook.Channel,
+			&webhook.secret, &webhook.CreatedBy, &webhook.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// deleteWebhook stops deliveries to a webhook, reporting false if it was
+// missing or already deleted. Its delivery log is kept.
+func (s *postgresStore) deleteWebhook(id int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tag, err := s.pool.Exec(ctx, deleteWebhookQuery, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// addWebhookDelivery records one attempt at delivering an event to a webhook
+func (s *postgresStore) addWebhookDelivery(webhookID int64, delivery WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.pool.Exec(ctx, insertWebhookDeliveryQuery, webhookID, delivery.DeliveryID, delivery.Event,
+		delivery.Attempt, delivery.StatusCode, delivery.Error, delivery.DurationMS)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// addUsage adds metered usage to each record's channel and hour
+func (s *postgresStore) addUsage(records []UsageRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, record := range records {
+		_, err := s.pool.Exec(ctx, upsertUsageQuery, record.Channel, record.PeriodStart,
+			record.Messages, record.SynthesisSeconds, record.ListenerMinutes)
+		if err != nil {
+			return fmt.Errorf("failed to upsert usage: %w", err)
+		}
+	}
+	return nil
+}
+
+// getUsage returns the usage metered between from and to, for one channel or all
+func (s *postgresStore) getUsage(from, to time.Time, channel string) ([]UsageRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectUsageQuery, from, to, channel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	records := []UsageRecord{}
+	for rows.Next() {
+		var record UsageRecord
+		if err := rows.Scan(&record.Channel, &record.PeriodStart, &record.Messages,
+			&record.SynthesisSeconds, &record.ListenerMinutes); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// getUsageMessages returns how many messages a channel has been metered for since from
+func (s *postgresStore) getUsageMessages(channel string, from time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var messages int64
+	if err := s.pool.QueryRow(ctx, selectUsageMessagesQuery, channel, from).Scan(&messages); err != nil {
+		return 0, fmt.Errorf("failed to query usage: %w", err)
+	}
+	return messages, nil
+}
+
+// savePendingDeliveries stores webhook deliveries left unfinished at
+// shutdown, returning how many were saved
+func (s *postgresStore) savePendingDeliveries(deliveries []pendingDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i, delivery := range deliveries {
+		_, err := s.pool.Exec(ctx, insertPendingDeliveryQuery, delivery.webhookID, delivery.deliveryID,
+			delivery.event, delivery.body, delivery.attempt)
+		if err != nil {
+			return i, fmt.Errorf("failed to insert pending webhook delivery: %w", err)
+		}
+	}
+	return len(deliveries), nil
+}
+
+// takePendingDeliveries removes and returns the webhook deliveries a previous
+// shutdown left unfinished
+func (s *postgresStore) takePendingDeliveries() ([]pendingDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, takePendingDeliveriesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take pending webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []pendingDelivery
+	for rows.Next() {
+		var delivery pendingDelivery
+		if err := rows.Scan(&delivery.webhookID, &delivery.deliveryID, &delivery.event, &delivery.body, &delivery.attempt); err != nil {
+			return nil, fmt.Errorf("failed to scan pending webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// getWebhookDeliveries returns a webhook's most recent delivery attempts, newest first
+func (s *postgresStore) getWebhookDeliveries(webhookID int64, limit int) ([]WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.pool.Query(ctx, selectWebhookDeliveriesQuery, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := rows.Scan(&delivery.ID, &delivery.DeliveryID, &delivery.Event, &delivery.Attempt,
+			&delivery.StatusCode, &delivery.Error, &delivery.DurationMS, &delivery.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
 	}
+	return deliveries, rows.Err()
 }
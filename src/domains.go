@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DomainConfig gives channels domains of their own, so each streamer's
+// donation endpoints and overlay live on their own domain
+type DomainConfig struct {
+	// Domains are domain=channel entries
+	Domains []string
+	// AutocertDir turns on Let's Encrypt certificates for the domains, cached
+	// in this directory; without it the certificate in CERT_FILE must cover them
+	AutocertDir   string
+	AutocertEmail string
+}
+
+// domainChannels maps each custom domain to its channel; nil without any
+var domainChannels map[string]string
+
+// certManager gets certificates for the custom domains, when AutocertDir is set
+var certManager *autocert.Manager
+
+// configureDomains parses the domain=channel entries
+func configureDomains(config DomainConfig) error {
+	channels := map[string]string{}
+	for _, entry := range config.Domains {
+		domain, channel, ok := strings.Cut(entry, "=")
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		channel = strings.TrimSpace(channel)
+		if !ok || domain == "" || strings.Contains(domain, ":") || !validChannelName(channel) {
+			return fmt.Errorf("invalid custom domain %q, expected domain=channel", entry)
+		}
+		if other, dup := channels[domain]; dup {
+			return fmt.Errorf("custom domain %s is given to both %s and %s", domain, other, channel)
+		}
+		channels[domain] = channel
+	}
+	if len(channels) == 0 {
+		if config.AutocertDir != "" {
+			return fmt.Errorf("AUTOCERT_DIR requires CUSTOM_DOMAINS")
+		}
+		return nil
+	}
+
+	domainChannels = channels
+	if config.AutocertDir != "" {
+		hosts := make([]string, 0, len(channels))
+		for domain := range channels {
+			hosts = append(hosts, domain)
+		}
+		certManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(config.AutocertDir),
+			Email:      config.AutocertEmail,
+		}
+	}
+	log.Printf("Serving %d channels on custom domains", len(channels))
+	return nil
+}
+
+// domainChannel returns the channel of the custom domain a request came in on
+func domainChannel(c *gin.Context) (string, bool) {
+	if domainChannels == nil {
+		return "", false
+	}
+	host := c.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	channel, ok := domainChannels[strings.ToLower(strings.TrimSuffix(host, "."))]
+	return channel, ok
+}
+
+// requestChannel is the channel a request that names none is for: its
+// custom domain's, or the default channel
+func requestChannel(c *gin.Context) string {
+	if channel, ok := domainChannel(c); ok {
+		return channel
+	}
+	return defaultChannel
+}
+
+// domainAllows reports whether a request may name channel: on a custom
+// domain, only the domain's own channel can be used
+func domainAllows(c *gin.Context, channel string) bool {
+	own, ok := domainChannel(c)
+	return !ok || channel == own
+}
+
+// pinDomainChannel refuses requests on a custom domain that name another
+// channel in their path or ?channel=, so one streamer's domain can't be used
+// to reach another's alerts. Channels in request bodies are checked by
+// their handlers.
+func pinDomainChannel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, channel := range []string{c.Param("channel"), c.Query("channel")} {
+			if channel != "" && !domainAllows(c, channel) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// domainTLSConfig adds the custom domains' certificates to the server's TLS
+// configuration. Other names get the certificate from CERT_FILE.
+func domainTLSConfig(base *tls.Config) *tls.Config {
+	if certManager == nil {
+		return base
+	}
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if _, ok := domainChannels[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]; ok {
+			return certManager.GetCertificate(hello)
+		}
+		// Falls back to the certificates loaded from CERT_FILE
+		return nil, nil
+	}
+	// The TLS-ALPN-01 challenge is answered on the TLS port itself
+	config.NextProtos = append(config.NextProtos, "h2", "http/1.1", acme.ALPNProto)
+	return config
+}
+
+// domainOrigins are the origins of overlays served on the custom domains
+func domainOrigins() []string {
+	origins := make([]string, 0, len(domainChannels))
+	for domain := range domainChannels {
+		origins = append(origins, "https://"+domain)
+	}
+	return origins
+}
+
+// isDomainOrigin reports whether a WebSocket upgrade comes from an overlay on
+// the custom domain it is connecting to
+func isDomainOrigin(r *http.Request) bool {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	_, ok := domainChannels[strings.ToLower(origin.Hostname())]
+	return ok && strings.EqualFold(origin.Hostname(), host)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// donorSummaryTTL is how long a donor's summary is served from memory; new
+// donations show up in it after at most this long
+const donorSummaryTTL = time.Minute
+
+// donorSummaryRecent is how many of a donor's latest donations a summary lists
+const donorSummaryRecent = 5
+
+// maxCachedDonorSummaries bounds the summaries kept in memory
+const maxCachedDonorSummaries = 10000
+
+// DonorSummary is a donor's history on a channel, for overlays to show
+// badges such as "3rd donation this month". Donors are matched by name,
+// ignoring case; anonymous donations, refunded ones and those kept off the
+// overlays aren't counted.
+type DonorSummary struct {
+	Channel   string      `json:"channel"`
+	Donor     string      `json:"donor"`
+	Lifetime  DonorTotals `json:"lifetime"`
+	ThisMonth DonorTotals `json:"this_month"`
+	// FirstAt and LastAt are when the donor first and last donated
+	FirstAt *time.Time      `json:"first_at,omitempty"`
+	LastAt  *time.Time      `json:"last_at,omitempty"`
+	Recent  []DonorDonation `json:"recent"`
+	// CachedAt is when the summary was read from the store
+	CachedAt time.Time `json:"cached_at"`
+}
+
+// DonorTotals counts a donor's donations and adds up their amounts, in the
+// units they were sent in
+type DonorTotals struct {
+	Count int     `json:"count"`
+	Total float64 `json:"total"`
+}
+
+// DonorDonation is one of a donor's recent donations
+type DonorDonation struct {
+	ID        int64     `json:"id"`
+	Amount    float32   `json:"amount"`
+	Currency  string    `json:"currency,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DonorQuery selects the donor a summary is for. Month is the start of the
+// calendar month ThisMonth counts from.
+type DonorQuery struct {
+	Channel string
+	Donor   string
+	Month   time.Time
+	Recent  int
+}
+
+type donorSummaryCache struct {
+	mutex   sync.Mutex
+	entries map[string]DonorSummary
+}
+
+var donorSummaries = &donorSummaryCache{entries: make(map[string]DonorSummary)}
+
+// summary returns the donor's summary, from memory while it is fresh
+func (d *donorSummaryCache) summary(c *gin.Context, store Store, channel string, donor string) (DonorSummary, error) {
+	key := channel + "\x00" + strings.ToLower(donor)
+	now := clock.Now()
+	d.mutex.Lock()
+	cached, ok := d.entries[key]
+	d.mutex.Unlock()
+	if ok && now.Sub(cached.CachedAt) < donorSummaryTTL {
+		return cached, nil
+	}
+
+	utc := now.UTC()
+	summary, err := store.GetDonorSummary(c.Request.Context(), DonorQuery{
+		Channel: channel,
+		Donor:   donor,
+		Month:   time.Date(utc.Year(), utc.Month(), 1, 0, 0, 0, 0, time.UTC),
+		Recent:  donorSummaryRecent,
+	})
+	if err != nil {
+		return summary, err
+	}
+	summary.Channel = channel
+	summary.Donor = donor
+	summary.CachedAt = now
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.entries) >= maxCachedDonorSummaries {
+		for key, entry := range d.entries {
+			if now.Sub(entry.CachedAt) >= donorSummaryTTL {
+				delete(d.entries, key)
+			}
+		}
+		if len(d.entries) >= maxCachedDonorSummaries {
+			d.entries = make(map[string]DonorSummary)
+		}
+	}
+	d.entries[key] = summary
+	return summary, nil
+}
+
+// donorSummaryHandler serves a donor's recent donations and lifetime totals
+func (s *Server) donorSummaryHandler(c *gin.Context) {
+	channel := c.Param("channel")
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+	donor := strings.TrimSpace(c.Param("donor"))
+	if donor == "" || (s.hub.sendLimits.MaxNameLength > 0 && utf8.RuneCountInString(donor) > s.hub.sendLimits.MaxNameLength) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid donor name"})
+		return
+	}
+
+	summary, err := donorSummaries.summary(c, s.store, channel, donor)
+	if err != nil {
+		log.Printf("Error loading donor summary on channel %s: %v", channel, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load donor summary"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=60")
+	c.JSON(http.StatusOK, summary)
+}
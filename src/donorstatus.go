@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Message states shown to donors
+const (
+	donorPending  = "pending"
+	donorQueued   = "queued"
+	donorPlayed   = "played"
+	donorMissed   = "missed"
+	donorRejected = "rejected"
+)
+
+// newStatusToken returns the unguessable ID donors use to look up their message
+func newStatusToken() string {
+	return ids.NewID()
+}
+
+// donorState maps a stored message status onto what donors are told
+func donorState(status string) string {
+	switch status {
+	case statusPending:
+		return donorPending
+	case statusMissed:
+		return donorMissed
+	case statusRejected, statusHidden:
+		return donorRejected
+	default:
+		return donorPlayed
+	}
+}
+
+// heldPosition finds a message in the playback queue by status token
+func (hub *Hub) heldPosition(token string) (int, bool) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for i, alert := range hub.pending {
+		if alert.message.StatusToken != token {
+			continue
+		}
+		position := 0
+		for _, ahead := range hub.pending[:i] {
+			if ahead.message.Channel == alert.message.Channel {
+				position++
+			}
+		}
+		return position, true
+	}
+	return 0, false
+}
+
+// messageStatusHandler lets donors check on their message without authentication.
+// Only the state is returned, never the message content.
+func (s *Server) messageStatusHandler(c *gin.Context) {
+	token := c.Param("session_id")
+
+	if position, ok := s.hub.heldPosition(token); ok {
+		c.JSON(http.StatusOK, gin.H{"id": token, "state": donorQueued, "queue_position": position})
+		return
+	}
+
+	status, err := s.db.getStatusByToken(token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up message status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up message"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": token, "state": donorState(status)})
+}
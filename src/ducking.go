@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Events bracketing each alert so automations can duck background audio
+const (
+	EventAudioDuckStart = "audio_duck_start"
+	EventAudioDuckEnd   = "audio_duck_end"
+)
+
+// AudioDuck is the data of the ducking events. DurationMS, on the start event,
+// is how long the alert is expected to play before the matching end event.
+type AudioDuck struct {
+	Channel    string `json:"channel"`
+	SessionID  string `json:"session_id"`
+	DurationMS int64  `json:"duration_ms,omitempty"`
+}
+
+// ducker keeps the timeline of each channel's alerts, which overlays play one
+// after another, to schedule what happens around them
+type ducker struct {
+	mutex sync.Mutex
+	// ends is when the last alert cued on each channel finishes
+	ends map[string]time.Time
+}
+
+var ducking = &ducker{ends: make(map[string]time.Time)}
+
+// clipDuration is how long msg plays: the alert animation plus the length of
+// its server-side audio, or the estimated reading time without it
+func (p *playbackEstimator) clipDuration(msg *Message) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if msg.Audio != nil && msg.Audio.DurationMS > 0 {
+		return p.config.AlertOverhead + time.Duration(msg.Audio.DurationMS)*time.Millisecond
+	}
+	return p.duration(msg)
+}
+
+// cue schedules what happens when an alert that has just reached the
+// channel's overlays starts playing, once the alerts ahead of it are done:
+// the ducking events, the channel's smart home trigger and its OBS scene.
+func (d *ducker) cue(hub *Hub, msg Message) {
+	playback := hub.playback
+	playback.mutex.Lock()
+	// Quiet alerts have no speech to duck for
+	enabled := playback.config.DuckEvents && !msg.Quiet
+	release := playback.config.DuckRelease
+	playback.mutex.Unlock()
+
+	duration := playback.clipDuration(&msg)
+
+	d.mutex.Lock()
+	now := clock.Now()
+	start := now
+	if end := d.ends[msg.Channel]; end.After(now) {
+		start = end
+	}
+	end := start.Add(duration)
+	d.ends[msg.Channel] = end
+	for channel, end := range d.ends {
+		if !end.After(now) {
+			delete(d.ends, channel)
+		}
+	}
+	d.mutex.Unlock()
+
+	duck := AudioDuck{Channel: msg.Channel, SessionID: msg.SessionID}
+	time.AfterFunc(start.Sub(now), func() {
+		if enabled {
+			started := duck
+			started.DurationMS = duration.Milliseconds()
+			hub.publishEvent(duck.Channel, EventAudioDuckStart, started)
+		}
+		triggerSmartHome(hub, msg, duration)
+		showOnOBS(hub, msg, duration)
+		recordTranscript(hub, msg, start, duration)
+		thankDonor(hub, msg, start)
+		hooks.run(hookOnPlay, msg, "")
+	})
+	if enabled {
+		time.AfterFunc(end.Add(release).Sub(now), func() {
+			hub.publishEvent(duck.Channel, EventAudioDuckEnd, duck)
+		})
+	}
+}
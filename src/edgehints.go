@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How an edge hint picked its region
+const (
+	edgeBasisNetwork  = "network"
+	edgeBasisLocation = "location"
+	edgeBasisCountry  = "country"
+	edgeBasisDefault  = "default"
+)
+
+// earthRadiusKM is the mean radius of the Earth, for great-circle distances
+const earthRadiusKM = 6371.0
+
+// edgeLocationHeaders are the latitude and longitude headers CDNs and load
+// balancers add with the client's location, tried in order
+var edgeLocationHeaders = [][2]string{
+	{"CF-IPLatitude", "CF-IPLongitude"},
+	{"CloudFront-Viewer-Latitude", "CloudFront-Viewer-Longitude"},
+	{"X-Vercel-IP-Latitude", "X-Vercel-IP-Longitude"},
+}
+
+// edgeCountryHeaders are the headers with the client's country, tried in
+// order when it can't be located more precisely
+var edgeCountryHeaders = []string{
+	"CF-IPCountry",
+	"CloudFront-Viewer-Country",
+	"X-Vercel-IP-Country",
+	"X-Country-Code",
+}
+
+// EdgeConfig places this instance in a multi-region deployment, so GET
+// /edge-hint can send overlays and moderators to the region nearest them
+type EdgeConfig struct {
+	// Region is the region this instance runs in, and the hint for clients
+	// that can't be placed
+	Region string
+	// TopologyFile lists the deployment's regions, as a JSON array of
+	// EdgeRegion
+	TopologyFile string
+}
+
+// EdgeRegion is one region of the deployment clients can connect to
+type EdgeRegion struct {
+	Name string `json:"name"`
+	// URL is the region's public address, such as its load balancer
+	URL string `json:"url"`
+	// Latitude and Longitude place the region, for sending clients to the
+	// one nearest them
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	// Countries are the ISO 3166 codes of the countries sent to the region
+	// when a client's location isn't known, only its country
+	Countries []string `json:"countries"`
+	// Networks are CIDR ranges always sent to the region, such as a studio's
+	// own network
+	Networks []string `json:"networks"`
+}
+
+type edgeRegion struct {
+	EdgeRegion
+	networks []netip.Prefix
+}
+
+// edgeTopology is the deployment's regions as loaded from EDGE_TOPOLOGY_FILE
+var edgeTopology []edgeRegion
+
+// configureEdgeHints loads and checks the topology for routing hints. Without
+// a topology file GET /edge-hint is off.
+func configureEdgeHints(config EdgeConfig) error {
+	instance.Region = config.Region
+	if config.TopologyFile == "" {
+		edgeTopology = nil
+		return nil
+	}
+	data, err := os.ReadFile(config.TopologyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read edge topology: %w", err)
+	}
+	var configs []EdgeRegion
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("failed to parse edge topology: %w", err)
+	}
+	if len(configs) == 0 {
+		return errors.New("the edge topology has no regions")
+	}
+
+	regions := make([]edgeRegion, 0, len(configs))
+	names := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		region, err := compileEdgeRegion(config)
+		if err != nil {
+			return fmt.Errorf("edge region %q: %w", config.Name, err)
+		}
+		if names[region.Name] {
+			return fmt.Errorf("edge region %q is listed twice", region.Name)
+		}
+		names[region.Name] = true
+		regions = append(regions, region)
+	}
+	if config.Region != "" && !names[config.Region] {
+		return fmt.Errorf("EDGE_REGION %q is not in the edge topology", config.Region)
+	}
+	edgeTopology = regions
+	log.Printf("Loaded an edge topology of %d regions", len(regions))
+	return nil
+}
+
+func compileEdgeRegion(config EdgeRegion) (edgeRegion, error) {
+	region := edgeRegion{EdgeRegion: config}
+	if !validChannelName(config.Name) {
+		return region, errors.New("names must be lowercase letters, digits, _ and -")
+	}
+	address, err := url.Parse(config.URL)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return region, errors.New("an http or https url is required")
+	}
+	switch {
+	case (config.Latitude == nil) != (config.Longitude == nil):
+		return region, errors.New("latitude and longitude must be given together")
+	case config.Latitude != nil && (math.Abs(*config.Latitude) > 90 || math.Abs(*config.Longitude) > 180):
+		return region, errors.New("latitude must be within 90 and longitude within 180 degrees")
+	}
+	region.Countries = make([]string, len(config.Countries))
+	for i, country := range config.Countries {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if !validCountryCode(country) {
+			return region, fmt.Errorf("invalid country code %q", config.Countries[i])
+		}
+		region.Countries[i] = country
+	}
+	for _, network := range config.Networks {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+		if err != nil {
+			return region, fmt.Errorf("invalid network %q", network)
+		}
+		region.networks = append(region.networks, prefix.Masked())
+	}
+	return region, nil
+}
+
+// validCountryCode is whether code is two capital letters. CDNs send XX when
+// they don't know the country.
+func validCountryCode(code string) bool {
+	if len(code) != 2 || code == "XX" {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r edgeRegion) located() bool {
+	return r.Latitude != nil
+}
+
+// clientLocation is where a request came from, as far as its headers tell
+type clientLocation struct {
+	country  string
+	lat, lon float64
+	located  bool
+}
+
+// locateClient reads the client's location from the headers a CDN or load
+// balancer in front of the server adds. A client can send them itself, but
+// only changes its own hint by doing so.
+func locateClient(r *http.Request) clientLocation {
+	var location clientLocation
+	for _, headers := range edgeLocationHeaders {
+		lat, err := strconv.ParseFloat(r.Header.Get(headers[0]), 64)
+		if err != nil || math.Abs(lat) > 90 {
+			continue
+		}
+		lon, err := strconv.ParseFloat(r.Header.Get(headers[1]), 64)
+		if err != nil || math.Abs(lon) > 180 {
+			continue
+		}
+		location.lat, location.lon, location.located = lat, lon, true
+		break
+	}
+	for _, header := range edgeCountryHeaders {
+		if country := strings.ToUpper(r.Header.Get(header)); validCountryCode(country) {
+			location.country = country
+			break
+		}
+	}
+	return location
+}
+
+// distanceKM is the great-circle distance between two points
+func distanceKM(lat1, lon1, lat2, lon2 float64) float64 {
+	radians := math.Pi / 180
+	dLat := (lat2 - lat1) * radians
+	dLon := (lon2 - lon1) * radians
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*radians)*math.Cos(lat2*radians)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKM * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// EdgeRegionHint is one region of an edge hint
+type EdgeRegionHint struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// DistanceKM is how far the region is from the client, when both are
+	// located
+	DistanceKM *float64 `json:"distance_km,omitempty"`
+}
+
+// EdgeHint is the region a client should connect to, as GET /edge-hint
+// answers
+type EdgeHint struct {
+	EdgeRegionHint
+	// Basis is how the region was picked: network, location, country or
+	// default
+	Basis   string `json:"basis"`
+	Country string `json:"country,omitempty"`
+	// Regions are every region, the hint first and then nearest first when
+	// the client is located, for clients that measure latency themselves
+	Regions  []EdgeRegionHint `json:"regions"`
+	Instance string           `json:"instance_id"`
+	// ServedBy is the region of the instance that answered
+	ServedBy string `json:"served_by,omitempty"`
+}
+
+// edgeHint picks the region for a client at ip and location. A region
+// listing the client's network wins, then the region nearest the client,
+// then one listing its country, then this instance's own region.
+func edgeHint(regions []edgeRegion, ip netip.Addr, location clientLocation) EdgeHint {
+	hints := make([]EdgeRegionHint, len(regions))
+	for i, region := range regions {
+		hints[i] = EdgeRegionHint{Name: region.Name, URL: region.URL}
+		if location.located && region.located() {
+			distance := math.Round(distanceKM(location.lat, location.lon, *region.Latitude, *region.Longitude))
+			hints[i].DistanceKM = &distance
+		}
+	}
+
+	chosen, basis := -1, edgeBasisDefault
+	if ip.IsValid() {
+		for i, region := range regions {
+			for _, network := range region.networks {
+				if network.Contains(ip.Unmap()) {
+					chosen, basis = i, edgeBasisNetwork
+					break
+				}
+			}
+			if chosen >= 0 {
+				break
+			}
+		}
+	}
+	if chosen < 0 {
+		for i, hint := range hints {
+			if hint.DistanceKM != nil && (chosen < 0 || *hint.DistanceKM < *hints[chosen].DistanceKM) {
+				chosen, basis = i, edgeBasisLocation
+			}
+		}
+	}
+	if chosen < 0 && location.country != "" {
+		for i, region := range regions {
+			if containsString(region.Countries, location.country) {
+				chosen, basis = i, edgeBasisCountry
+				break
+			}
+		}
+	}
+	if chosen < 0 {
+		chosen = 0
+		for i, region := range regions {
+			if region.Name == instance.Region {
+				chosen = i
+			}
+		}
+	}
+
+	ordered := make([]EdgeRegionHint, 0, len(hints))
+	ordered = append(ordered, hints[chosen])
+	rest := append(append([]EdgeRegionHint{}, hints[:chosen]...), hints[chosen+1:]...)
+	sort.SliceStable(rest, func(i, j int) bool {
+		a, b := rest[i].DistanceKM, rest[j].DistanceKM
+		return a != nil && (b == nil || *a < *b)
+	})
+	ordered = append(ordered, rest...)
+
+	return EdgeHint{
+		EdgeRegionHint: hints[chosen],
+		Basis:          basis,
+		Country:        location.country,
+		Regions:        ordered,
+		Instance:       instance.ID,
+		ServedBy:       instance.Region,
+	}
+}
+
+// edgeHintHandler tells overlays and moderators which region to connect to,
+// so that in a multi-region deployment each lands on the one nearest them
+func edgeHintHandler(c *gin.Context) {
+	regions := edgeTopology
+	if len(regions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Edge hints are not configured"})
+		return
+	}
+	ip, _ := netip.ParseAddr(c.ClientIP())
+
+	c.Header("X-Instance-ID", instance.ID)
+	// The hint depends on who asks, so shared caches mustn't keep it
+	c.Header("Cache-Control", "private, max-age=300")
+	c.JSON(http.StatusOK, edgeHint(regions, ip, locateClient(c.Request)))
+}
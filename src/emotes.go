@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Emote providers that can be enabled with EMOTE_PROVIDERS
+const (
+	emoteProviderTwitch = "twitch"
+	emoteProviderBTTV   = "bttv"
+)
+
+const (
+	bttvAPIURL         = "https://api.betterttv.net/3/cached"
+	emoteRefreshPeriod = time.Hour
+)
+
+// Emote is an emote code found in a message. Start and End are inclusive rune
+// offsets into the message, matching the positions Twitch uses in chat tags.
+type Emote struct {
+	ID       string `json:"id"`
+	Code     string `json:"code"`
+	Provider string `json:"provider"`
+	URL      string `json:"url"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
+
+type emoteDefinition struct {
+	ID       string
+	Provider string
+}
+
+// emoteSet holds the known emote codes, refreshed in the background so sends never wait on it
+type emoteSet struct {
+	mutex     sync.RWMutex
+	providers []string
+	// twitch holds the credentials Twitch and BTTV emotes are looked up with
+	twitch TwitchConfig
+	client *http.Client
+	codes  map[string]emoteDefinition
+}
+
+var emotes = &emoteSet{client: &http.Client{Timeout: 10 * time.Second}}
+
+// startEmotes loads the configured emote providers and refreshes them periodically
+func startEmotes(providers []string, twitch TwitchConfig) {
+	if len(providers) == 0 {
+		return
+	}
+	emotes.providers = providers
+	emotes.twitch = twitch
+
+	go func() {
+		emotes.refresh()
+		ticker := time.NewTicker(emoteRefreshPeriod)
+		defer ticker.Stop()
+		for range ticker.C {
+			emotes.refresh()
+		}
+	}()
+	log.Printf("Emote parsing enabled for %s", strings.Join(providers, ", "))
+}
+
+func (e *emoteSet) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	codes := make(map[string]emoteDefinition)
+	for _, provider := range e.providers {
+		var err error
+		switch provider {
+		case emoteProviderTwitch:
+			err = e.loadTwitch(ctx, codes)
+		case emoteProviderBTTV:
+			err = e.loadBTTV(ctx, codes)
+		default:
+			err = fmt.Errorf("unknown emote provider")
+		}
+		if err != nil {
+			log.Printf("Error loading %s emotes: %v", provider, err)
+		}
+	}
+
+	// Keep the previous set if every provider failed
+	if len(codes) == 0 {
+		return
+	}
+
+	e.mutex.Lock()
+	e.codes = codes
+	e.mutex.Unlock()
+}
+
+func (e *emoteSet) loadTwitch(ctx context.Context, codes map[string]emoteDefinition) error {
+	config := e.twitch
+	if !config.enabled() {
+		return fmt.Errorf("twitch credentials are not configured")
+	}
+
+	var response struct {
+		Data []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+
+	endpoints := []struct {
+		path   string
+		params url.Values
+	}{
+		{twitchHelixURL + "/chat/emotes/global", url.Values{}},
+		{twitchHelixURL + "/chat/emotes", url.Values{"broadcaster_id": {config.BroadcasterID}}},
+	}
+	for _, endpoint := range endpoints {
+		response.Data = nil
+		if err := helixGet(ctx, e.client, config, endpoint.path, endpoint.params, &response); err != nil {
+			return err
+		}
+		for _, emote := range response.Data {
+			codes[emote.Name] = emoteDefinition{ID: emote.ID, Provider: emoteProviderTwitch}
+		}
+	}
+	return nil
+}
+
+type bttvEmote struct {
+	ID   string `json:"id"`
+	Code string `json:"code"`
+}
+
+func (e *emoteSet) loadBTTV(ctx context.Context, codes map[string]emoteDefinition) error {
+	var global []bttvEmote
+	if err := getJSON(ctx, e.client, bttvAPIURL+"/emotes/global", &global); err != nil {
+		return err
+	}
+
+	var channel struct {
+		ChannelEmotes []bttvEmote `json:"channelEmotes"`
+		SharedEmotes  []bttvEmote `json:"sharedEmotes"`
+	}
+	if broadcasterID := e.twitch.BroadcasterID; broadcasterID != "" {
+		if err := getJSON(ctx, e.client, bttvAPIURL+"/users/twitch/"+url.PathEscape(broadcasterID), &channel); err != nil {
+			return err
+		}
+	}
+
+	// Twitch emotes take precedence when both providers define a code
+	for _, list := range [][]bttvEmote{global, channel.ChannelEmotes, channel.SharedEmotes} {
+		for _, emote := range list {
+			if _, exists := codes[emote.Code]; !exists {
+				codes[emote.Code] = emoteDefinition{ID: emote.ID, Provider: emoteProviderBTTV}
+			}
+		}
+	}
+	return nil
+}
+
+func emoteURL(definition emoteDefinition) string {
+	if definition.Provider == emoteProviderBTTV {
+		return "https://cdn.betterttv.net/emote/" + definition.ID + "/1x"
+	}
+	return "https://static-cdn.jtvnw.net/emoticons/v2/" + definition.ID + "/default/dark/1.0"
+}
+
+// parse finds emote codes in text and returns them along with the text that should be spoken
+func (e *emoteSet) parse(text string) ([]Emote, string) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if len(e.codes) == 0 {
+		return nil, text
+	}
+
+	var found []Emote
+	var spoken []string
+	runes := []rune(text)
+
+	for start := 0; start < len(runes); {
+		if unicode.IsSpace(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && !unicode.IsSpace(runes[end]) {
+			end++
+		}
+
+		word := string(runes[start:end])
+		if definition, ok := e.codes[word]; ok {
+			found = append(found, Emote{
+				ID:       definition.ID,
+				Code:     word,
+				Provider: definition.Provider,
+				URL:      emoteURL(definition),
+				Start:    start,
+				End:      end - 1,
+			})
+		} else {
+			spoken = append(spoken, word)
+		}
+		start = end
+	}
+
+	if len(found) == 0 {
+		return nil, text
+	}
+	return found, strings.Join(spoken, " ")
+}
+
+// annotateEmotes attaches emote positions to the message and sets the text for TTS
+func annotateEmotes(msg *Message) {
+	found, spoken := emotes.parse(msg.Message)
+	if len(found) == 0 {
+		return
+	}
+	msg.Emotes = found
+	msg.Speech = spoken
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reasons a message is refused. Errors from acceptMessage, the stores and the
+// limiters wrap one of these, so callers can tell them apart with errors.Is
+// instead of by their text.
+var (
+	// ErrSessionUsed means a message with the same session ID was already sent
+	ErrSessionUsed = errors.New("session ID has already been used")
+	// ErrMessageRejected means the message was refused for what it says or
+	// who it is from
+	ErrMessageRejected = errors.New("message was rejected")
+	// ErrQuotaExceeded means the sender has used up their allowance for now
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// QuotaError is returned when a limit is hit, with how long until it frees up.
+// It wraps ErrQuotaExceeded.
+type QuotaError struct {
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v, retry after %s", ErrQuotaExceeded, e.RetryAfter)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// sendError is a refused message with the status and message to answer with.
+// It wraps what caused the refusal, when there is a cause.
+type sendError struct {
+	status  int
+	message string
+	cause   error
+}
+
+func (e *sendError) Error() string {
+	if e.cause == nil {
+		return e.message
+	}
+	return e.message + ": " + e.cause.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Message event types, in the order a message normally goes through them
+const (
+	eventMessageReceived    = "message_received"
+	eventMessageModerated   = "moderated"
+	eventMessageSynthesized = "synthesized"
+	eventMessageBroadcast   = "broadcast"
+	eventMessageAcked       = "acked"
+	// Tombstones, left when retention or a sandbox purge deletes a message
+	// or it is redacted, and the data of its earlier events erased
+	eventMessageDeleted  = "deleted"
+	eventMessageRedacted = "redacted"
+)
+
+// eventLogBuffer is how many events can wait to be written before recording
+// one blocks
+const eventLogBuffer = 4096
+
+// MessageEvent is one entry in the append-only message event log
+type MessageEvent struct {
+	ID int64 `json:"id"`
+	// SessionID is empty for acks, which listeners send by message ID
+	SessionID string          `json:"session_id,omitempty"`
+	MessageID int64           `json:"message_id,omitempty"`
+	Channel   string          `json:"channel"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// moderationEvent is the data of a moderated event
+type moderationEvent struct {
+	// Decision is pending when a message is held, then approved or rejected;
+	// blocked is the content filter's
+	Decision string `json:"decision"`
+	By       string `json:"by"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// MessageProjection is a message's current state, as built from its events
+type MessageProjection struct {
+	SessionID string `json:"session_id"`
+	MessageID int64  `json:"message_id,omitempty"`
+	Channel   string `json:"channel"`
+	// Status is the last stage the message reached: received, a moderation
+	// decision, synthesized, broadcast, missed or acked, or deleted or
+	// redacted, which end it
+	Status        string     `json:"status"`
+	Message       *Message   `json:"message,omitempty"`
+	Decision      string     `json:"decision,omitempty"`
+	ModeratedBy   string     `json:"moderated_by,omitempty"`
+	ReceivedAt    *time.Time `json:"received_at,omitempty"`
+	ModeratedAt   *time.Time `json:"moderated_at,omitempty"`
+	SynthesizedAt *time.Time `json:"synthesized_at,omitempty"`
+	BroadcastAt   *time.Time `json:"broadcast_at,omitempty"`
+	AckedAt       *time.Time `json:"acked_at,omitempty"`
+	RemovedAt     *time.Time `json:"removed_at,omitempty"`
+	Events        int        `json:"events"`
+}
+
+// removed reports whether the message was deleted or redacted on purpose
+func (p *MessageProjection) removed() bool {
+	return p.RemovedAt != nil
+}
+
+// apply folds the next event into the projection
+func (p *MessageProjection) apply(event MessageEvent) {
+	at := event.CreatedAt
+	p.Events++
+	if event.SessionID != "" {
+		p.SessionID = event.SessionID
+	}
+	if event.MessageID != 0 {
+		p.MessageID = event.MessageID
+	}
+	p.Channel = event.Channel
+	// Nothing that happens to a removed message brings it back
+	if p.removed() {
+		return
+	}
+
+	switch event.Type {
+	case eventMessageReceived:
+		var msg Message
+		if err := json.Unmarshal(event.Data, &msg); err == nil {
+			p.Message = &msg
+		}
+		p.Status = "received"
+		p.ReceivedAt = &at
+	case eventMessageModerated:
+		var decision moderationEvent
+		json.Unmarshal(event.Data, &decision)
+		p.Status = decision.Decision
+		p.Decision = decision.Decision
+		p.ModeratedBy = decision.By
+		p.ModeratedAt = &at
+	case eventMessageSynthesized:
+		p.Status = event.Type
+		p.SynthesizedAt = &at
+	case eventMessageBroadcast:
+		var data struct {
+			Status string `json:"status"`
+		}
+		json.Unmarshal(event.Data, &data)
+		p.Status = data.Status
+		p.BroadcastAt = &at
+	case eventMessageAcked:
+		p.Status = event.Type
+		p.AckedAt = &at
+	case eventMessageDeleted, eventMessageRedacted:
+		p.Status = event.Type
+		p.Message = nil
+		p.RemovedAt = &at
+	}
+}
+
+// projectMessages builds the projection of each message in events, which
+// must be in the order they were recorded
+func projectMessages(events []MessageEvent) []*MessageProjection {
+	var projections []*MessageProjection
+	bySession := make(map[string]*MessageProjection)
+	byID := make(map[int64]*MessageProjection)
+	for _, event := range events {
+		projection := bySession[event.SessionID]
+		if event.SessionID == "" {
+			projection = byID[event.MessageID]
+		}
+		if projection == nil {
+			// An ack without the rest of its message's events has nothing to add to
+			if event.SessionID == "" {
+				continue
+			}
+			projection = &MessageProjection{}
+			bySession[event.SessionID] = projection
+			projections = append(projections, projection)
+		}
+		projection.apply(event)
+		if projection.MessageID != 0 {
+			byID[projection.MessageID] = projection
+		}
+	}
+	return projections
+}
+
+// eventLog writes message events in the order they are recorded, off the
+// paths that record them
+type eventLog struct {
+	db     *postgresStore
+	events chan MessageEvent
+	done   chan struct{}
+	// mutex guards closed; record holds it for reading while it queues
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// startEventLog starts writing message events to db when the event log is
+// enabled. It returns nil when it isn't.
+func startEventLog(enabled bool, db *postgresStore) *eventLog {
+	if !enabled {
+		return nil
+	}
+	l := &eventLog{
+		db:     db,
+		events: make(chan MessageEvent, eventLogBuffer),
+		done:   make(chan struct{}),
+	}
+	go l.write()
+	log.Printf("Recording message events")
+	return l
+}
+
+func (l *eventLog) write() {
+	defer close(l.done)
+	for event := range l.events {
+		if err := l.db.addMessageEvent(event); err != nil {
+			log.Printf("Error recording %s event for session %s: %v", event.Type, event.SessionID, err)
+		}
+	}
+}
+
+// record queues an event for msg. It is a no-op when the event log is off,
+// and for test alerts, which are never stored.
+func (l *eventLog) record(eventType string, msg Message, data interface{}) {
+	if l == nil || msg.Test || msg.Probe {
+		return
+	}
+	event := MessageEvent{
+		SessionID: msg.SessionID,
+		MessageID: msg.ID,
+		Channel:   msg.Channel,
+		Type:      eventType,
+		CreatedAt: time.Now(),
+	}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			log.Printf("Error encoding %s event for session %s: %v", eventType, msg.SessionID, err)
+			return
+		}
+		event.Data = raw
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.closed {
+		log.Printf("Dropped %s event for session %s recorded after shutdown", eventType, msg.SessionID)
+		return
+	}
+	l.events <- event
+}
+
+// close writes out the queued events and stops the writer, or gives up when
+// ctx is done. It returns how many events were left unwritten.
+func (l *eventLog) close(ctx context.Context) int {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.mutex.Unlock()
+
+	select {
+	case <-l.done:
+		return 0
+	case <-ctx.Done():
+		log.Printf("Event log shutdown timed out with %d events unwritten: %v", len(l.events), ctx.Err())
+		return len(l.events)
+	}
+}
+
+// rebuildMessages replays the events recorded since from and restores each
+// message the log has as delivered or blocked but the message store is
+// missing. Messages deleted or redacted on purpose stay gone. It returns how
+// many messages were replayed and how many restored.
+func (s *Server) rebuildMessages(from time.Time) (int, int, error) {
+	events, err := s.db.getEventsSince(from)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	projections := projectMessages(events)
+	restored := 0
+	for _, projection := range projections {
+		if projection.removed() || projection.Message == nil || projection.MessageID == 0 {
+			continue
+		}
+		msg := *projection.Message
+		msg.ID = projection.MessageID
+		switch projection.Status {
+		case statusBroadcast, statusMissed, statusBlocked:
+			msg.Status = projection.Status
+		case eventMessageAcked:
+			msg.Status = statusBroadcast
+		default:
+			// Anything else is still being delivered, or is held elsewhere
+			continue
+		}
+
+		exists, err := s.store.CheckSessionID(context.Background(), msg.SessionID)
+		if err != nil {
+			return len(projections), restored, err
+		}
+		if exists {
+			continue
+		}
+		if err := s.store.AddMessage(msg); err != nil {
+			return len(projections), restored, err
+		}
+		if projection.Status == eventMessageAcked {
+			if err := s.store.AckMessage(msg.ID, msg.Channel); err != nil {
+				log.Printf("Error acknowledging restored message %d: %v", msg.ID, err)
+			}
+		}
+		restored++
+	}
+	return len(projections), restored, nil
+}
+
+// messageEventsHandler shows a message's events and the state they add up to
+func (s *Server) messageEventsHandler(c *gin.Context) {
+	events, err := s.db.getSessionEvents(c.Param("session_id"))
+	if err != nil {
+		log.Printf("Error loading message events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load message events"})
+		return
+	}
+	projections := projectMessages(events)
+	if len(projections) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No events recorded for this message"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events, "projection": projections[0]})
+}
+
+// rebuildMessagesHandler restores lost messages from the event log
+func (s *Server) rebuildMessagesHandler(c *gin.Context) {
+	if s.hub.eventLog == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The message event log is not enabled"})
+		return
+	}
+	from, err := time.Parse(time.RFC3339, c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+
+	replayed, restored, err := s.rebuildMessages(from)
+	if err != nil {
+		log.Printf("Error rebuilding messages from events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rebuild messages", "replayed": replayed, "restored": restored})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.db.recordAudit("events.rebuild", user, "", gin.H{"from": from, "replayed": replayed, "restored": restored})
+	c.JSON(http.StatusOK, gin.H{"replayed": replayed, "restored": restored})
+}
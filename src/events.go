@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+// Event types broadcast to listeners in addition to donation messages
+const (
+	EventMatchedDonation = "matched_donation"
+	EventBidWarTally     = "bidwar_tally"
+	EventPollResults     = "poll_results"
+	EventPollClosed      = "poll_closed"
+	EventWheelSpin       = "wheel_spin"
+)
+
+// Event is a non-message frame sent to listeners. Unlike donation messages,
+// events always carry a "type" field so overlays can tell them apart.
+type Event struct {
+	Type string `json:"type"`
+	// Channel is the channel whose listeners get the event; events about no
+	// one channel, such as poll results, leave it empty and go to all of them
+	Channel   string      `json:"channel,omitempty"`
+	Data      interface{} `json:"data"`
+	Timestamp time.Time   `json:"timestamp"`
+	// Canary marks events sampled to go only to canary listeners
+	Canary bool `json:"canary,omitempty"`
+}
+
+// publishEvent queues an event for broadcast to a channel's listeners, or to
+// every listener when channel is ""
+func (hub *Hub) publishEvent(channel string, eventType string, data interface{}) {
+	hub.metrics.inc(metricEventsPublished, MetricLabels{Channel: channel, Kind: eventType}, 1)
+	hub.dispatchEvent(Event{
+		Type:      eventType,
+		Channel:   channel,
+		Data:      data,
+		Timestamp: time.Now(),
+		Canary:    canary.sample(hub, eventType),
+	})
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusBlocked marks a stored message the content filter kept off the overlays
+const statusBlocked = "blocked"
+
+// What the filter does with a message containing a listed word, from the
+// mildest to the strictest. Listed words are masked whatever the action.
+const (
+	filterActionMask  = "mask"
+	filterActionHold  = "hold"
+	filterActionBlock = "block"
+	filterActionBan   = "ban"
+)
+
+var filterActionRank = map[string]int{filterActionMask: 1, filterActionHold: 2, filterActionBlock: 3, filterActionBan: 4}
+
+// Wordlist tiers, from the mildest to the most severe
+const (
+	filterTierMild   = "mild"
+	filterTierSevere = "severe"
+	filterTierSlur   = "slur"
+)
+
+var filterTiers = []string{filterTierMild, filterTierSevere, filterTierSlur}
+
+// Reasons recorded on filtered messages
+const (
+	filterReasonProfanity = "profanity"
+	filterReasonSevere    = "profanity_severe"
+	filterReasonSlur      = "slur"
+	filterReasonHTML      = "html"
+	filterReasonControl   = "control"
+	filterReasonURL       = "url"
+	filterReasonCaps      = "caps"
+	filterReasonEmoji     = "emoji"
+)
+
+// tierReasons is the reason recorded for words of each tier
+var tierReasons = map[string]string{
+	filterTierMild:   filterReasonProfanity,
+	filterTierSevere: filterReasonSevere,
+	filterTierSlur:   filterReasonSlur,
+}
+
+// FilterTierConfig is one tier's wordlist. Words come from Words and from
+// WordlistFile, one per line.
+type FilterTierConfig struct {
+	Words        []string
+	WordlistFile string
+	Action       string
+}
+
+// ContentFilterConfig configures the filter every message passes before it is
+// read out
+type ContentFilterConfig struct {
+	// Tiers holds the wordlist of each of filterTiers
+	Tiers     map[string]FilterTierConfig
+	StripURLs bool
+	// MaxCapsRatio lowercases messages where more than this share of letters
+	// are capitals (0 = off); MaxEmoji drops emoji beyond this many (0 = off)
+	MaxCapsRatio float64
+	MaxEmoji     int
+}
+
+var (
+	htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+	urlPattern     = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+	spacePattern   = regexp.MustCompile(`[ \t]{2,}`)
+	// leetReplacer undoes common letter substitutions before words are compared
+	leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s")
+)
+
+// contentFilter is the configured pipeline
+type contentFilter struct {
+	// words maps each listed word to its tier; a word listed in several
+	// tiers belongs to the most severe
+	words        map[string]string
+	actions      map[string]string
+	stripURLs    bool
+	maxCapsRatio float64
+	maxEmoji     int
+}
+
+// validFilterAction reports whether action is one of the filter actions
+func validFilterAction(action string) bool {
+	return filterActionRank[action] > 0
+}
+
+// newContentFilter loads the wordlists and sets up the pipeline
+func newContentFilter(config ContentFilterConfig) (*contentFilter, error) {
+	words := make(map[string]string)
+	actions := make(map[string]string)
+	for _, tier := range filterTiers {
+		tierConfig := config.Tiers[tier]
+		if tierConfig.Action == "" {
+			tierConfig.Action = filterActionMask
+		}
+		if !validFilterAction(tierConfig.Action) {
+			return nil, fmt.Errorf("action for %s words must be %q, %q, %q or %q", tier, filterActionMask, filterActionHold, filterActionBlock, filterActionBan)
+		}
+		actions[tier] = tierConfig.Action
+
+		count := 0
+		for _, word := range tierConfig.Words {
+			if word = normalizeWord(word); word != "" {
+				words[word] = tier
+				count++
+			}
+		}
+		if tierConfig.WordlistFile != "" {
+			data, err := os.ReadFile(tierConfig.WordlistFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s wordlist: %w", tier, err)
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				if word := normalizeWord(line); word != "" {
+					words[word] = tier
+					count++
+				}
+			}
+		}
+		if count > 0 {
+			log.Printf("Content filter loaded %d %s words (action: %s)", count, tier, tierConfig.Action)
+		}
+	}
+
+	return &contentFilter{
+		words:        words,
+		actions:      actions,
+		stripURLs:    config.StripURLs,
+		maxCapsRatio: config.MaxCapsRatio,
+		maxEmoji:     config.MaxEmoji,
+	}, nil
+}
+
+// holds reports whether any tier with words in it holds messages for
+// moderation by default
+func (f *contentFilter) holds() bool {
+	for _, tier := range f.words {
+		if f.actions[tier] == filterActionHold {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeWord is the form words are compared in: lowercase, substitutions
+// undone and anything but letters removed
+func normalizeWord(word string) string {
+	word = leetReplacer.Replace(strings.ToLower(word))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) {
+			return r
+		}
+		return -1
+	}, word)
+}
+
+// apply runs msg's name, description and message through the pipeline. It
+// marks msg filtered (keeping the original text) when anything changed, and
+// returns the strictest action of the tiers whose words it found, as set for
+// msg's channel: "" when there were none.
+func (f *contentFilter) apply(hub *Hub, msg *Message) string {
+	original := msg.Message
+	reasons := make(map[string]bool)
+	tiers := make(map[string]bool)
+
+	for _, field := range []*string{&msg.Name, &msg.Description, &msg.Message} {
+		*field = f.clean(*field, reasons, tiers)
+	}
+
+	if len(reasons) == 0 {
+		return ""
+	}
+	msg.Filtered = true
+	msg.OriginalMessage = original
+	msg.FilterReasons = nil
+	for _, reason := range []string{filterReasonProfanity, filterReasonSevere, filterReasonSlur, filterReasonHTML, filterReasonControl, filterReasonURL, filterReasonCaps, filterReasonEmoji} {
+		if reasons[reason] {
+			msg.FilterReasons = append(msg.FilterReasons, reason)
+		}
+	}
+
+	if len(tiers) == 0 {
+		return ""
+	}
+	overrides := hub.channelSettings(msg.Channel).FilterActions
+	action := ""
+	for tier := range tiers {
+		tierAction := f.actions[tier]
+		if override, ok := overrides[tier]; ok {
+			tierAction = override
+		}
+		if filterActionRank[tierAction] > filterActionRank[action] {
+			action = tierAction
+		}
+	}
+	return action
+}
+
+// countFilterTiers counts a message's listed words by tier, once per message
+func countFilterTiers(hub *Hub, msg Message) {
+	for _, tier := range filterTiers {
+		if slices.Contains(msg.FilterReasons, tierReasons[tier]) {
+			hub.metrics.inc(metricFilterHits, MetricLabels{Channel: msg.Channel, Kind: tier}, 1)
+		}
+	}
+}
+
+// banDonor adds the sender's name to their channel's banned names, so the ban
+// applies to whatever they send next. Like the rest of the channel settings
+// this needs Postgres; under SQLite the message is only blocked.
+func banDonor(hub *Hub, msg Message) {
+	if msg.Name == "" {
+		return
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		settings, err := hub.db.getChannelSettings(msg.Channel)
+		if errors.Is(err, errPostgresRequired) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error loading settings to ban donor of session %s: %v", msg.SessionID, err)
+			return
+		}
+		if _, banned := matchBannedName(msg.Name, settings.BannedNames); banned {
+			return
+		}
+
+		settings.BannedNames = append(settings.BannedNames, msg.Name)
+		err = hub.db.saveChannelSettings(settings, settings.Version)
+		if errors.Is(err, errVersionConflict) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error banning donor of session %s: %v", msg.SessionID, err)
+			return
+		}
+		hub.invalidateChannelSettings(msg.Channel)
+		hub.db.recordAudit("donor.auto_banned", actorSystem, msg.SessionID, gin.H{"channel": msg.Channel, "reasons": msg.FilterReasons})
+		return
+	}
+	log.Printf("Gave up banning donor of session %s: channel settings kept changing", msg.SessionID)
+}
+
+// clean runs one piece of text through each step, adding the reasons for what
+// it changed and the tiers of the listed words it masked
+func (f *contentFilter) clean(text string, reasons map[string]bool, tiers map[string]bool) string {
+	if stripped := htmlTagPattern.ReplaceAllString(text, ""); stripped != text {
+		reasons[filterReasonHTML] = true
+		text = stripped
+	}
+	text = html.UnescapeString(text)
+
+	// Control and invisible formatting characters (zero-width, bidi overrides);
+	// line breaks become spaces. The joiner emoji sequences rely on is kept.
+	removed := false
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case r == '\u200d':
+			return r
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			removed = true
+			return -1
+		}
+		return r
+	}, text)
+	if removed {
+		reasons[filterReasonControl] = true
+	}
+
+	if f.stripURLs {
+		if stripped := urlPattern.ReplaceAllString(text, ""); stripped != text {
+			reasons[filterReasonURL] = true
+			text = stripped
+		}
+	}
+
+	if len(f.words) > 0 {
+		fields := strings.Fields(text)
+		masked := false
+		for i, field := range fields {
+			if tier, ok := f.words[normalizeWord(field)]; ok {
+				fields[i] = maskWord(field)
+				reasons[tierReasons[tier]] = true
+				tiers[tier] = true
+				masked = true
+			}
+		}
+		if masked {
+			text = strings.Join(fields, " ")
+		}
+	}
+
+	if f.maxCapsRatio > 0 && shoutRatio(text) > f.maxCapsRatio {
+		reasons[filterReasonCaps] = true
+		lower := []rune(strings.ToLower(text))
+		for i, r := range lower {
+			if unicode.IsLetter(r) {
+				lower[i] = unicode.ToUpper(r)
+				break
+			}
+		}
+		text = string(lower)
+	}
+
+	if f.maxEmoji > 0 {
+		if limited, dropped := limitEmoji(text, f.maxEmoji); dropped {
+			reasons[filterReasonEmoji] = true
+			text = limited
+		}
+	}
+
+	return strings.TrimSpace(spacePattern.ReplaceAllString(text, " "))
+}
+
+// maskWord keeps a word's punctuation and first letter and stars out the rest
+func maskWord(word string) string {
+	masked := []rune(word)
+	first := true
+	for i, r := range masked {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("@$", r) {
+			continue
+		}
+		if first {
+			first = false
+			continue
+		}
+		masked[i] = '*'
+	}
+	return string(masked)
+}
+
+// shoutRatio is the share of capitals among the letters of text. Short texts
+// count as 0 so "OK" or "GG" aren't touched.
+func shoutRatio(text string) float64 {
+	letters, upper := 0, 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters < 8 {
+		return 0
+	}
+	return float64(upper) / float64(letters)
+}
+
+// limitEmoji keeps the first max emoji, dropping later ones along with the
+// modifiers and joiners attached to them
+func limitEmoji(text string, max int) (string, bool) {
+	var b strings.Builder
+	count := 0
+	dropping := false
+	dropped := false
+	for _, r := range text {
+		if isEmojiModifier(r) {
+			if !dropping {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		if isEmoji(r) {
+			count++
+			dropping = count > max
+			if dropping {
+				dropped = true
+				continue
+			}
+		} else {
+			dropping = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), dropped
+}
+
+func isEmoji(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || (r >= 0x2600 && r <= 0x27BF)
+}
+
+// isEmojiModifier covers skin tones, variation selectors and the zero-width joiner
+func isEmojiModifier(r rune) bool {
+	return (r >= 0x1F3FB && r <= 0x1F3FF) || r == 0xFE0F || r == 0xFE0E || r == 0x200D
+}
+
+// FilteredMessage is a stored message the content filter changed or blocked
+type FilteredMessage struct {
+	StoredMessage
+	Status          string   `json:"status"`
+	OriginalMessage string   `json:"original_message"`
+	FilterReasons   []string `json:"filter_reasons"`
+}
+
+// listFilteredHandler lists messages the content filter changed or blocked
+// since from (default: last 24 hours) so moderators can review them
+func (s *Server) listFilteredHandler(c *gin.Context) {
+	from := c.DefaultQuery("from", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
+	fromTime, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+
+	messages, err := s.db.getFilteredMessages(fromTime, c.Query("channel"), c.Query("status"))
+	if err != nil {
+		log.Printf("Error listing filtered messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list filtered messages"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Default thresholds for the anomaly detector, used when channel settings leave them zero
+var defaultFraudSettings = FraudSettings{
+	WindowSeconds:        600,
+	IdenticalAmountLimit: 5,
+	SmallAmount:          1,
+	SmallDonationLimit:   10,
+	RefundLimit:          3,
+}
+
+// Fraud pattern identifiers, used as notification kinds and audit actions
+const (
+	fraudIdenticalAmounts = "fraud.identical_amounts"
+	fraudRapidSmall       = "fraud.rapid_small_donations"
+	fraudRefundProne      = "fraud.refund_prone_donor"
+	fraudAmountCeiling    = "fraud.amount_ceiling"
+)
+
+// FraudAlert describes a suspicious pattern that was detected
+type FraudAlert struct {
+	Pattern   string  `json:"pattern"`
+	IP        string  `json:"ip,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Amount    float32 `json:"amount,omitempty"`
+	Count     int     `json:"count"`
+	Window    int     `json:"window_seconds,omitempty"`
+	SessionID string  `json:"session_id"`
+}
+
+type donationSample struct {
+	amount float32
+	at     time.Time
+}
+
+// fraudDetector tracks recent donations per IP in memory
+type fraudDetector struct {
+	mutex   sync.Mutex
+	byIP    map[string][]donationSample
+	alerted map[string]time.Time
+}
+
+var fraud = &fraudDetector{
+	byIP:    make(map[string][]donationSample),
+	alerted: make(map[string]time.Time),
+}
+
+// withDefaults fills zero thresholds from the detector defaults
+func (s FraudSettings) withDefaults() FraudSettings {
+	if s.WindowSeconds == 0 {
+		s.WindowSeconds = defaultFraudSettings.WindowSeconds
+	}
+	if s.IdenticalAmountLimit == 0 {
+		s.IdenticalAmountLimit = defaultFraudSettings.IdenticalAmountLimit
+	}
+	if s.SmallAmount == 0 {
+		s.SmallAmount = defaultFraudSettings.SmallAmount
+	}
+	if s.SmallDonationLimit == 0 {
+		s.SmallDonationLimit = defaultFraudSettings.SmallDonationLimit
+	}
+	if s.RefundLimit == 0 {
+		s.RefundLimit = defaultFraudSettings.RefundLimit
+	}
+	return s
+}
+
+// checkFraud looks for suspicious patterns around a donation. Alerts are advisory:
+// the donation is not blocked, but admins are notified and the audit log updated.
+func checkFraud(hub *Hub, msg Message, ip string) {
+	settings := hub.channelSettings(msg.Channel).Fraud
+	if settings.Disabled {
+		return
+	}
+	settings = settings.withDefaults()
+
+	for _, alert := range fraud.observe(msg, ip, settings) {
+		raiseFraudAlert(hub, alert)
+	}
+
+	if !msg.Anonymous && msg.Name != "" {
+		refunds, err := hub.db.countDonorRefunds(msg.Name)
+		if err != nil {
+			log.Printf("Error counting refunds for donor: %v", err)
+			return
+		}
+		if refunds >= settings.RefundLimit && fraud.shouldAlert(fraudRefundProne+":"+msg.Name, settings) {
+			raiseFraudAlert(hub, FraudAlert{
+				Pattern:   fraudRefundProne,
+				Name:      msg.Name,
+				Count:     refunds,
+				SessionID: msg.SessionID,
+			})
+		}
+	}
+}
+
+// overCeiling reports whether a donation is over its channel's amount ceiling,
+// and so has to be confirmed by a moderator before it is read out. Unlike the
+// other patterns, this one holds the donation.
+func overCeiling(hub *Hub, msg Message) bool {
+	settings := hub.channelSettings(msg.Channel).Fraud
+	if settings.Disabled || settings.AmountCeiling <= 0 || msg.Amount <= settings.AmountCeiling || msg.Test {
+		return false
+	}
+	if settings.CeilingTrustsProviders && msg.Provider != "" {
+		return false
+	}
+	raiseFraudAlert(hub, FraudAlert{
+		Pattern:   fraudAmountCeiling,
+		Name:      msg.Name,
+		Amount:    msg.Amount,
+		Count:     1,
+		SessionID: msg.SessionID,
+	})
+	return true
+}
+
+// observe records the donation and returns any IP-based patterns it completes
+func (d *fraudDetector) observe(msg Message, ip string, settings FraudSettings) []FraudAlert {
+	window := time.Duration(settings.WindowSeconds) * time.Second
+	now := clock.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Keep only samples inside the window
+	samples := d.byIP[ip][:0]
+	for _, sample := range d.byIP[ip] {
+		if now.Sub(sample.at) <= window {
+			samples = append(samples, sample)
+		}
+	}
+	samples = append(samples, donationSample{amount: msg.Amount, at: now})
+	d.byIP[ip] = samples
+
+	identical, small := 0, 0
+	for _, sample := range samples {
+		if sample.amount == msg.Amount {
+			identical++
+		}
+		if sample.amount < settings.SmallAmount {
+			small++
+		}
+	}
+
+	var alerts []FraudAlert
+	if identical >= settings.IdenticalAmountLimit && d.shouldAlertLocked(fmt.Sprintf("%s:%s:%.2f", fraudIdenticalAmounts, ip, msg.Amount), settings) {
+		alerts = append(alerts, FraudAlert{
+			Pattern:   fraudIdenticalAmounts,
+			IP:        ip,
+			Amount:    msg.Amount,
+			Count:     identical,
+			Window:    settings.WindowSeconds,
+			SessionID: msg.SessionID,
+		})
+	}
+	if msg.Amount < settings.SmallAmount && small >= settings.SmallDonationLimit && d.shouldAlertLocked(fraudRapidSmall+":"+ip, settings) {
+		alerts = append(alerts, FraudAlert{
+			Pattern:   fraudRapidSmall,
+			IP:        ip,
+			Count:     small,
+			Window:    settings.WindowSeconds,
+			SessionID: msg.SessionID,
+		})
+	}
+
+	d.prune(now, window)
+	return alerts
+}
+
+// shouldAlert rate-limits alerts so each pattern fires at most once per window
+func (d *fraudDetector) shouldAlert(key string, settings FraudSettings) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.shouldAlertLocked(key, settings)
+}
+
+func (d *fraudDetector) shouldAlertLocked(key string, settings FraudSettings) bool {
+	window := time.Duration(settings.WindowSeconds) * time.Second
+	if last, ok := d.alerted[key]; ok && clock.Now().Sub(last) < window {
+		return false
+	}
+	d.alerted[key] = clock.Now()
+	return true
+}
+
+// prune drops IPs with no recent donations. Must be called with the mutex held.
+func (d *fraudDetector) prune(now time.Time, window time.Duration) {
+	for ip, samples := range d.byIP {
+		if len(samples) == 0 || now.Sub(samples[len(samples)-1].at) > window {
+			delete(d.byIP, ip)
+		}
+	}
+	for key, at := range d.alerted {
+		if now.Sub(at) > window {
+			delete(d.alerted, key)
+		}
+	}
+}
+
+func raiseFraudAlert(hub *Hub, alert FraudAlert) {
+	log.Printf("Suspicious donation pattern %s (session %s, count %d)", alert.Pattern, alert.SessionID, alert.Count)
+
+	var text string
+	switch alert.Pattern {
+	case fraudIdenticalAmounts:
+		text = fmt.Sprintf("%d donations of %.2f from %s within %d seconds", alert.Count, alert.Amount, alert.IP, alert.Window)
+	case fraudRapidSmall:
+		text = fmt.Sprintf("%d small donations from %s within %d seconds", alert.Count, alert.IP, alert.Window)
+	case fraudRefundProne:
+		text = fmt.Sprintf("Donor %s has %d recorded refunds", alert.Name, alert.Count)
+	case fraudAmountCeiling:
+		text = fmt.Sprintf("Donation of %.2f from %s is over the channel's ceiling and is held for confirmation", alert.Amount, firstNonEmpty(alert.Name, "an anonymous donor"))
+	}
+
+	hub.db.notifyAdmins(alert.Pattern, text, alert)
+	hub.db.recordAudit(alert.Pattern, actorSystem, alert.SessionID, alert)
+}
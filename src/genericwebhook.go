@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// genericWebhookFields are the message fields a generic webhook can map
+var genericWebhookFields = map[string]bool{
+	"session_id":  true,
+	"channel":     true,
+	"name":        true,
+	"amount":      true,
+	"currency":    true,
+	"message":     true,
+	"description": true,
+	"anonymous":   true,
+}
+
+var templatePattern = regexp.MustCompile(`\{\{\s*(\$[^}]*?)\s*\}\}`)
+
+// GenericWebhook maps the payload of a provider without a built-in adapter
+// onto a message. Field values are JSONPath expressions ("$.data.amount"),
+// templates with paths in double braces ("{{ $.donor }} sent a tip") or plain
+// text.
+type GenericWebhook struct {
+	// Secret is checked against the X-Webhook-Secret header or ?token=, or
+	// with SignatureHeader set, used to verify a hex HMAC-SHA256 of the body
+	Secret          string `json:"secret"`
+	SignatureHeader string `json:"signature_header"`
+	// When lists paths and the values they must have for a payload to be
+	// announced; other payloads are acknowledged and ignored
+	When   map[string]string `json:"when"`
+	Fields map[string]string `json:"fields"`
+	// AmountDivisor converts amounts given in minor units, e.g. 100 for cents
+	AmountDivisor float64 `json:"amount_divisor"`
+}
+
+type genericWebhook struct {
+	config GenericWebhook
+	when   map[string]jsonPath
+	fields map[string]valueMapping
+}
+
+// genericWebhooks holds the mappings from GENERIC_WEBHOOKS_FILE by name
+var genericWebhooks = map[string]*genericWebhook{}
+
+// jsonPath is a parsed JSONPath expression: object keys and array indexes
+// from the root, as in $.data.items[0]['display name']
+type jsonPath []pathStep
+
+type pathStep struct {
+	key   string
+	index int
+	// isIndex selects index rather than key
+	isIndex bool
+}
+
+// valueMapping is a parsed field value. A value that is a single path keeps
+// the JSON type it points to; templates and plain text are strings.
+type valueMapping struct {
+	path  jsonPath
+	parts []templatePart
+}
+
+// templatePart is literal text, or the value at path when path is set
+type templatePart struct {
+	text string
+	path jsonPath
+}
+
+// configureGenericWebhooks loads and checks the mappings in path, a JSON
+// object of GenericWebhook by name
+func configureGenericWebhooks(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read generic webhooks: %w", err)
+	}
+	var configs map[string]GenericWebhook
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("failed to parse generic webhooks: %w", err)
+	}
+
+	webhooks := make(map[string]*genericWebhook, len(configs))
+	for name, config := range configs {
+		webhook, err := compileGenericWebhook(config)
+		if err != nil {
+			return fmt.Errorf("generic webhook %s: %w", name, err)
+		}
+		if !validChannelName(name) {
+			return fmt.Errorf("generic webhook name %q must be lowercase letters, digits, _ and -", name)
+		}
+		webhooks[name] = webhook
+	}
+	genericWebhooks = webhooks
+	if len(webhooks) > 0 {
+		log.Printf("Loaded %d generic webhooks", len(webhooks))
+	}
+	return nil
+}
+
+func compileGenericWebhook(config GenericWebhook) (*genericWebhook, error) {
+	if config.Secret == "" {
+		return nil, fmt.Errorf("a secret is required")
+	}
+	if config.Fields["session_id"] == "" {
+		return nil, fmt.Errorf("fields must map session_id")
+	}
+	if config.AmountDivisor < 0 {
+		return nil, fmt.Errorf("amount_divisor must not be negative")
+	}
+
+	webhook := &genericWebhook{config: config, when: map[string]jsonPath{}, fields: map[string]valueMapping{}}
+	for raw := range config.When {
+		path, err := parseJSONPath(raw)
+		if err != nil {
+			return nil, err
+		}
+		webhook.when[raw] = path
+	}
+	for field, raw := range config.Fields {
+		if !genericWebhookFields[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		mapping, err := parseValueMapping(raw)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field, err)
+		}
+		webhook.fields[field] = mapping
+	}
+	return webhook, nil
+}
+
+// parseJSONPath parses the supported subset of JSONPath: $ followed by .key,
+// ['key'] and [index] steps
+func parseJSONPath(raw string) (jsonPath, error) {
+	if !strings.HasPrefix(raw, "$") {
+		return nil, fmt.Errorf("invalid path %q: must start with $", raw)
+	}
+	path := jsonPath{}
+	rest := raw[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid path %q: empty key", raw)
+			}
+			path = append(path, pathStep{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unclosed [", raw)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path = append(path, pathStep{key: inner[1 : len(inner)-1]})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid path %q: bad index %q", raw, inner)
+			}
+			path = append(path, pathStep{index: index, isIndex: true})
+		default:
+			return nil, fmt.Errorf("invalid path %q", raw)
+		}
+	}
+	return path, nil
+}
+
+// lookup returns the value at the path, or nil if the payload doesn't have it
+func (p jsonPath) lookup(doc interface{}) interface{} {
+	for _, step := range p {
+		if step.isIndex {
+			items, ok := doc.([]interface{})
+			if !ok || step.index >= len(items) {
+				return nil
+			}
+			doc = items[step.index]
+			continue
+		}
+		object, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		doc = object[step.key]
+	}
+	return doc
+}
+
+func parseValueMapping(raw string) (valueMapping, error) {
+	if !strings.Contains(raw, "{{") {
+		if strings.HasPrefix(raw, "$") {
+			path, err := parseJSONPath(raw)
+			return valueMapping{path: path}, err
+		}
+		return valueMapping{parts: []templatePart{{text: raw}}}, nil
+	}
+
+	var parts []templatePart
+	last := 0
+	for _, match := range templatePattern.FindAllStringSubmatchIndex(raw, -1) {
+		path, err := parseJSONPath(raw[match[2]:match[3]])
+		if err != nil {
+			return valueMapping{}, err
+		}
+		parts = append(parts, templatePart{text: raw[last:match[0]]}, templatePart{path: path})
+		last = match[1]
+	}
+	parts = append(parts, templatePart{text: raw[last:]})
+	return valueMapping{parts: parts}, nil
+}
+
+// resolve evaluates the mapping against a payload
+func (m valueMapping) resolve(doc interface{}) interface{} {
+	if m.path != nil {
+		return m.path.lookup(doc)
+	}
+	var text strings.Builder
+	for _, part := range m.parts {
+		if part.path != nil {
+			text.WriteString(jsonText(part.path.lookup(doc)))
+		} else {
+			text.WriteString(part.text)
+		}
+	}
+	return text.String()
+}
+
+// jsonText is a JSON value as text: strings as they are, numbers and
+// booleans as written, and nothing for null or missing values
+func jsonText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// text is a mapped field as a string, "" when unmapped
+func (w *genericWebhook) text(doc interface{}, field string) string {
+	mapping, ok := w.fields[field]
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(jsonText(mapping.resolve(doc)))
+}
+
+// authorized checks the shared secret or the body signature
+func (w *genericWebhook) authorized(c *gin.Context, body []byte) bool {
+	if w.config.SignatureHeader == "" {
+		presented := firstNonEmpty(c.GetHeader("X-Webhook-Secret"), c.Query("token"))
+		return subtle.ConstantTimeCompare([]byte(presented), []byte(w.config.Secret)) == 1
+	}
+	signature := strings.TrimPrefix(strings.TrimSpace(c.GetHeader(w.config.SignatureHeader)), "sha256=")
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(w.config.Secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// genericProvider turns payloads into messages with the mapping named in
+// the URL
+type genericProvider struct{}
+
+func (genericProvider) Name() string  { return "generic" }
+func (genericProvider) Title() string { return "Generic" }
+func (genericProvider) Path() string  { return "generic/:name" }
+
+func (genericProvider) Init(config PaymentConfig) (bool, error) {
+	if err := configureGenericWebhooks(config.GenericWebhooksFile); err != nil {
+		return false, fmt.Errorf("invalid GENERIC_WEBHOOKS_FILE: %w", err)
+	}
+	return len(genericWebhooks) > 0, nil
+}
+
+func (genericProvider) Verify(c *gin.Context, hub *Hub, body []byte) *sendError {
+	webhook, ok := genericWebhooks[c.Param("name")]
+	if !ok {
+		return &sendError{http.StatusNotFound, "Generic webhook not found", nil}
+	}
+	if !webhook.authorized(c, body) {
+		return &sendError{http.StatusUnauthorized, "Invalid secret", errInvalidSignature}
+	}
+	return nil
+}
+
+func (genericProvider) Ingest(c *gin.Context, hub *Hub, body []byte) {
+	name := c.Param("name")
+	webhook := genericWebhooks[name]
+
+	// Numbers are kept as written so IDs and amounts aren't rounded
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	for raw, path := range webhook.when {
+		if jsonText(path.lookup(doc)) != webhook.config.When[raw] {
+			c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Unhandled event type"})
+			return
+		}
+	}
+
+	sessionID := webhook.text(doc, "session_id")
+	var amount float64
+	if raw := webhook.text(doc, "amount"); raw != "" {
+		var err error
+		if amount, err = strconv.ParseFloat(raw, 32); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+			return
+		}
+	}
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload has no session ID"})
+		return
+	}
+	if webhook.config.AmountDivisor > 0 {
+		amount /= webhook.config.AmountDivisor
+	}
+	anonymous, _ := strconv.ParseBool(webhook.text(doc, "anonymous"))
+
+	acceptWebhookMessage(c, hub, "generic:"+name, Message{
+		SessionID:   "generic_" + name + "_" + sessionID,
+		Channel:     webhookChannel(c, webhook.text(doc, "channel")),
+		Name:        webhook.text(doc, "name"),
+		Amount:      float32(amount),
+		Currency:    strings.ToUpper(webhook.text(doc, "currency")),
+		Message:     webhook.text(doc, "message"),
+		Description: webhook.text(doc, "description"),
+		Anonymous:   anonymous,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type githubSponsorshipEvent struct {
+	Action      string `json:"action"`
+	Sponsorship struct {
+		NodeID       string `json:"node_id"`
+		PrivacyLevel string `json:"privacy_level"`
+		Sponsor      struct {
+			Login string `json:"login"`
+		} `json:"sponsor"`
+		Tier struct {
+			Name                string `json:"name"`
+			MonthlyPriceInCents int64  `json:"monthly_price_in_cents"`
+			IsOneTime           bool   `json:"is_one_time"`
+		} `json:"tier"`
+	} `json:"sponsorship"`
+}
+
+// githubTierAmounts maps tier names, lower-cased, to the amount they are announced with
+var githubTierAmounts map[string]float32
+
+// parseTierAmounts reads tier=amount pairs, e.g. "Backer=5"
+func parseTierAmounts(pairs []string) (map[string]float32, error) {
+	amounts := make(map[string]float32)
+	for _, pair := range pairs {
+		tier, value, ok := strings.Cut(pair, "=")
+		amount, err := strconv.ParseFloat(strings.TrimSpace(value), 32)
+		if !ok || err != nil || amount < 0 {
+			return nil, fmt.Errorf("invalid tier amount %q, expected tier=amount", pair)
+		}
+		amounts[strings.ToLower(strings.TrimSpace(tier))] = float32(amount)
+	}
+	return amounts, nil
+}
+
+// verifyGitHubSignature checks X-Hub-Signature-256, "sha256=" and the hex
+// HMAC-SHA256 of the body keyed with the webhook secret
+func verifyGitHubSignature(secret string, signature string, body []byte) bool {
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// githubSponsorsProvider turns new GitHub sponsorships into messages, with
+// the sponsor's login as the donor name. Private sponsorships are shown as
+// anonymous.
+type githubSponsorsProvider struct{}
+
+func (githubSponsorsProvider) Name() string  { return "github" }
+func (githubSponsorsProvider) Title() string { return "GitHub Sponsors" }
+func (githubSponsorsProvider) Path() string  { return "github" }
+
+func (githubSponsorsProvider) Init(config PaymentConfig) (bool, error) {
+	amounts, err := parseTierAmounts(config.GitHubTierAmounts)
+	if err != nil {
+		return false, fmt.Errorf("invalid GITHUB_SPONSORS_TIER_AMOUNTS: %w", err)
+	}
+	githubTierAmounts = amounts
+	return config.GitHubWebhookSecret != "", nil
+}
+
+func (githubSponsorsProvider) Verify(c *gin.Context, hub *Hub, body []byte) *sendError {
+	if !verifyGitHubSignature(hub.payments.GitHubWebhookSecret, c.GetHeader("X-Hub-Signature-256"), body) {
+		return &sendError{http.StatusUnauthorized, "Invalid signature", errInvalidSignature}
+	}
+	return nil
+}
+
+func (githubSponsorsProvider) Ingest(c *gin.Context, hub *Hub, body []byte) {
+	// GitHub sends a ping when the webhook is created
+	if c.GetHeader("X-GitHub-Event") != "sponsorship" {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Unhandled event type"})
+		return
+	}
+	var event githubSponsorshipEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.Sponsorship.NodeID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if event.Action != "created" {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Unhandled event type"})
+		return
+	}
+
+	sponsorship := event.Sponsorship
+	tier := sponsorship.Tier
+	amount, ok := githubTierAmounts[strings.ToLower(tier.Name)]
+	if !ok {
+		amount = float32(tier.MonthlyPriceInCents) / 100
+	}
+	msg := Message{
+		SessionID: "github_" + sponsorship.NodeID,
+		Channel:   webhookChannel(c, ""),
+		Name:      sponsorship.Sponsor.Login,
+		Amount:    amount,
+		Anonymous: sponsorship.PrivacyLevel == "private",
+	}
+	// Private sponsors get the anonymity template, which doesn't name them
+	if !msg.Anonymous {
+		verb := "sponsored you"
+		if tier.IsOneTime {
+			verb = "sent a one-time sponsorship"
+		}
+		msg.Description = strings.TrimSuffix(fmt.Sprintf("%s %s on GitHub (%s)", msg.Name, verb, tier.Name), " ()")
+	}
+	acceptWebhookMessage(c, hub, "github", msg)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// handoffState is what a draining instance passes on: the alerts still in its
+// playback queue, each already stored as missed, the queue controls it had
+// and its resume cursor
+type handoffState struct {
+	Origin    string        `json:"origin"`
+	Cursor    int64         `json:"cursor"`
+	Alerts    []busEnvelope `json:"alerts"`
+	Controls  []QueueState  `json:"controls,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+func (b *redisBus) handoffKey() string {
+	return b.prefix + ":handoff"
+}
+
+// handOff queues state for another instance and tells the running ones it is
+// there. Instances that start later pick it up as they start.
+func (b *redisBus) handOff(state handoffState, ttl time.Duration) error {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	pipe := b.client.TxPipeline()
+	pipe.RPush(ctx, b.handoffKey(), payload)
+	pipe.Expire(ctx, b.handoffKey(), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return b.publish(busEnvelope{Handoff: true})
+}
+
+// handOffDrain passes the alerts the drained hub stored as missed on to another
+// instance. It does nothing without Redis, with handoff off, or when the
+// drain timed out and those alerts may not all be stored yet.
+func (hub *Hub) handOffDrain(drain HubDrain) int {
+	if hub.bus == nil || hub.handoffTTL <= 0 || drain.TimedOut || (len(drain.missed) == 0 && len(drain.controls) == 0) {
+		return 0
+	}
+
+	state := handoffState{Origin: instance.ID, Controls: drain.controls, CreatedAt: time.Now().UTC()}
+	hub.mutex.Lock()
+	state.Cursor = hub.lastMessageID
+	hub.mutex.Unlock()
+	for _, msg := range drain.missed {
+		state.Alerts = append(state.Alerts, busEnvelope{
+			Message:       &msg,
+			Status:        msg.Status,
+			StatusToken:   msg.StatusToken,
+			EncryptedName: msg.EncryptedName,
+			RequestID:     msg.RequestID,
+		})
+	}
+	if err := hub.bus.handOff(state, hub.handoffTTL); err != nil {
+		log.Printf("Error handing off %d queued alerts, leaving them missed: %v", len(state.Alerts), err)
+		return 0
+	}
+	log.Printf("Handed off %d queued alerts and %d queue controls", len(state.Alerts), len(state.Controls))
+	return len(state.Alerts)
+}
+
+// adoptHandoffs takes every handoff waiting in Redis and plays its alerts
+// from here. Each handoff is popped by exactly one instance, so its alerts
+// go out once.
+func (hub *Hub) adoptHandoffs() {
+	if hub.bus == nil || hub.handoffTTL <= 0 {
+		return
+	}
+	for {
+		hub.mutex.Lock()
+		draining := hub.draining
+		hub.mutex.Unlock()
+		if draining {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		payload, err := hub.bus.client.LPop(ctx, hub.bus.handoffKey()).Bytes()
+		cancel()
+		if errors.Is(err, redis.Nil) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error taking a handoff from Redis: %v", err)
+			return
+		}
+
+		var state handoffState
+		if err := json.Unmarshal(payload, &state); err != nil {
+			log.Printf("Error decoding handoff: %v", err)
+			continue
+		}
+		hub.adoptHandoff(state)
+	}
+}
+
+// adoptHandoff restores a handoff's queue controls and cursor on this
+// instance, then requeues its alerts in the order they were held
+func (hub *Hub) adoptHandoff(state handoffState) {
+	hub.mutex.Lock()
+	for _, control := range state.Controls {
+		// Anything set here since is newer than what the old instance had
+		if _, set := hub.controls[control.Channel]; !set {
+			hub.controls[control.Channel] = control
+		}
+	}
+	if state.Cursor > hub.lastMessageID {
+		hub.lastMessageID = state.Cursor
+	}
+	hub.mutex.Unlock()
+
+	adopted := 0
+	for _, envelope := range state.Alerts {
+		if envelope.Message == nil {
+			continue
+		}
+		msg := *envelope.Message
+		msg.Status = envelope.Status
+		msg.StatusToken = envelope.StatusToken
+		msg.EncryptedName = envelope.EncryptedName
+		msg.RequestID = envelope.RequestID
+
+		// As when requeued from /admin/missed: the stored row stops being missed
+		// and the message goes out as a replay, so it isn't stored again
+		if err := hub.db.setMessageStatus(msg.SessionID, statusBroadcast); err != nil {
+			log.Printf("Error adopting handed off alert for session %s, leaving it missed: %v", msg.SessionID, err)
+			continue
+		}
+		// Audio URLs point at the instance that made them, so synthesize it again
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		synthesizeMessage(ctx, hub, &msg)
+		cancel()
+		msg.Replay = true
+		hub.dispatch(msg)
+		adopted++
+	}
+	log.Printf("Adopted %d queued alerts and %d queue controls handed off by instance %s", adopted, len(state.Controls), state.Origin)
+}
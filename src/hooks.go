@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Lifecycle events hook scripts can run on
+const (
+	// hookOnMessage runs when a message is accepted, before it is broadcast
+	// or queued for moderation
+	hookOnMessage = "on_message"
+	// hookOnPlay runs when an alert starts playing on its channel
+	hookOnPlay = "on_play"
+	// hookOnReject runs when a message is blocked by the content filter or a
+	// banned name, or rejected by a moderator
+	hookOnReject = "on_reject"
+)
+
+// maxHooksRunning bounds how many hook scripts run at once; events past
+// that are skipped rather than queued without end
+const maxHooksRunning = 8
+
+// HookConfig names the command each lifecycle event runs. Commands get the
+// event as JSON on stdin and run like filter plugins do, in an empty
+// directory with nothing in their environment but PATH.
+type HookConfig struct {
+	OnMessage string
+	OnPlay    string
+	OnReject  string
+	Timeout   time.Duration
+}
+
+// HookEvent is what hook scripts read from stdin
+type HookEvent struct {
+	Event   string  `json:"event"`
+	Message Message `json:"message"`
+	// Reason says why a message was rejected
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type hookRunner struct {
+	commands map[string]string
+	timeout  time.Duration
+	running  chan struct{}
+}
+
+var hooks = &hookRunner{}
+
+// configureHooks checks the hook commands exist
+func configureHooks(config HookConfig) error {
+	if config.Timeout <= 0 {
+		return fmt.Errorf("HOOK_TIMEOUT_MS must be positive")
+	}
+	runner := &hookRunner{commands: map[string]string{}, timeout: config.Timeout, running: make(chan struct{}, maxHooksRunning)}
+	for event, command := range map[string]string{hookOnMessage: config.OnMessage, hookOnPlay: config.OnPlay, hookOnReject: config.OnReject} {
+		if command == "" {
+			continue
+		}
+		resolved, err := resolveExecutable(command)
+		if err != nil {
+			return fmt.Errorf("%s hook %s: %w", event, command, err)
+		}
+		runner.commands[event] = resolved
+	}
+	if len(runner.commands) > 0 {
+		log.Printf("Running hook scripts on %d lifecycle events", len(runner.commands))
+	}
+	hooks = runner
+	return nil
+}
+
+// run starts the event's hook script in the background, if it has one.
+// Hooks can't change what happens to the message; their output is only
+// logged when they fail.
+func (h *hookRunner) run(event string, msg Message, reason string) {
+	command := h.commands[event]
+	if command == "" || msg.Probe {
+		return
+	}
+	input, err := json.Marshal(HookEvent{Event: event, Message: msg, Reason: reason, Timestamp: clock.Now()})
+	if err != nil {
+		log.Printf("Error marshaling %s hook event: %v", event, err)
+		return
+	}
+
+	select {
+	case h.running <- struct{}{}:
+	default:
+		log.Printf("Skipped %s hook for session %s: %d hooks are already running", event, msg.SessionID, maxHooksRunning)
+		return
+	}
+	go func() {
+		defer func() { <-h.running }()
+		if _, err := runExecutable(context.Background(), command, input, h.timeout); err != nil {
+			log.Printf("Error running %s hook for session %s: %v", event, msg.SessionID, err)
+		}
+	}()
+}
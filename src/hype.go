@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventHype tells overlays a channel hit one of its hype triggers, e.g.
+// raising 100 within 10 minutes
+const EventHype = "hype"
+
+// maxHypeTriggers bounds the triggers a channel can have
+const maxHypeTriggers = 20
+
+// maxHypeWindow is the longest window a trigger can look back over
+const maxHypeWindow = 24 * time.Hour
+
+// HypeTrigger fires when a channel's broadcast donations reach Amount, or
+// Count donations, within WindowSeconds. It fires at most once per window.
+type HypeTrigger struct {
+	// Name is passed to overlays so they can tell triggers apart
+	Name          string  `json:"name"`
+	Amount        float32 `json:"amount,omitempty"`
+	Count         int     `json:"count,omitempty"`
+	WindowSeconds int     `json:"window_seconds"`
+}
+
+// HypeSettings are a channel's hype triggers
+type HypeSettings struct {
+	Triggers []HypeTrigger `json:"triggers,omitempty"`
+}
+
+func (s HypeSettings) validate() error {
+	if len(s.Triggers) > maxHypeTriggers {
+		return fmt.Errorf("at most %d hype triggers are allowed", maxHypeTriggers)
+	}
+	for i, trigger := range s.Triggers {
+		if trigger.Amount <= 0 && trigger.Count <= 0 {
+			return fmt.Errorf("hype trigger %d needs an amount or a count", i)
+		}
+		if trigger.Amount < 0 || trigger.Count < 0 {
+			return fmt.Errorf("hype trigger %d has a negative threshold", i)
+		}
+		window := time.Duration(trigger.WindowSeconds) * time.Second
+		if window <= 0 || window > maxHypeWindow {
+			return fmt.Errorf("hype trigger %d window_seconds must be between 1 and %d", i, int(maxHypeWindow.Seconds()))
+		}
+	}
+	return nil
+}
+
+// label names a trigger for notifications: its name, or its thresholds
+func (t HypeTrigger) label() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	window := (time.Duration(t.WindowSeconds) * time.Second).String()
+	if t.Amount > 0 {
+		return fmt.Sprintf("raised %.2f in %s", t.Amount, window)
+	}
+	return fmt.Sprintf("%d donations in %s", t.Count, window)
+}
+
+// HypeEvent is the data of an EventHype event
+type HypeEvent struct {
+	Channel       string  `json:"channel"`
+	Trigger       string  `json:"trigger"`
+	Raised        float32 `json:"raised"`
+	Count         int     `json:"count"`
+	WindowSeconds int     `json:"window_seconds"`
+	// SessionID is the donation that reached the threshold
+	SessionID string `json:"session_id"`
+}
+
+// hypeTracker keeps each channel's recent donations in memory, as long as
+// its longest trigger window
+type hypeTracker struct {
+	mutex     sync.Mutex
+	byChannel map[string][]donationSample
+	fired     map[string]time.Time
+}
+
+var hype = &hypeTracker{
+	byChannel: make(map[string][]donationSample),
+	fired:     make(map[string]time.Time),
+}
+
+// observe adds a broadcast donation to its channel's window and raises the
+// triggers it completes
+func (h *hypeTracker) observe(hub *Hub, msg Message) {
+	if msg.Test || msg.announcement() || msg.Summary != nil || msg.Amount <= 0 {
+		return
+	}
+	triggers := hub.channelSettings(msg.Channel).Hype.Triggers
+	if len(triggers) == 0 {
+		return
+	}
+	for _, event := range h.add(msg, triggers, clock.Now()) {
+		raiseHype(hub, event)
+	}
+}
+
+func (h *hypeTracker) add(msg Message, triggers []HypeTrigger, now time.Time) []HypeEvent {
+	longest := time.Duration(0)
+	for _, trigger := range triggers {
+		longest = max(longest, time.Duration(trigger.WindowSeconds)*time.Second)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	samples := h.byChannel[msg.Channel][:0]
+	for _, sample := range h.byChannel[msg.Channel] {
+		if now.Sub(sample.at) <= longest {
+			samples = append(samples, sample)
+		}
+	}
+	samples = append(samples, donationSample{amount: msg.Amount, at: now})
+	h.byChannel[msg.Channel] = samples
+
+	var events []HypeEvent
+	for i, trigger := range triggers {
+		window := time.Duration(trigger.WindowSeconds) * time.Second
+		var raised float32
+		count := 0
+		for _, sample := range samples {
+			if now.Sub(sample.at) <= window {
+				raised += sample.amount
+				count++
+			}
+		}
+		if (trigger.Amount > 0 && raised < trigger.Amount) || (trigger.Count > 0 && count < trigger.Count) {
+			continue
+		}
+		// Triggers are keyed by position, so editing a channel's
+		// triggers may let one fire again early
+		key := msg.Channel + ":" + strconv.Itoa(i)
+		if last, ok := h.fired[key]; ok && now.Sub(last) < window {
+			continue
+		}
+		h.fired[key] = now
+		events = append(events, HypeEvent{
+			Channel:       msg.Channel,
+			Trigger:       trigger.label(),
+			Raised:        raised,
+			Count:         count,
+			WindowSeconds: trigger.WindowSeconds,
+			SessionID:     msg.SessionID,
+		})
+	}
+
+	h.prune(now)
+	return events
+}
+
+// prune drops channels with no donations and triggers that fired a window
+// ago. Must be called with the mutex held.
+func (h *hypeTracker) prune(now time.Time) {
+	for channel, samples := range h.byChannel {
+		if len(samples) == 0 || now.Sub(samples[len(samples)-1].at) > maxHypeWindow {
+			delete(h.byChannel, channel)
+		}
+	}
+	for key, at := range h.fired {
+		if now.Sub(at) > maxHypeWindow {
+			delete(h.fired, key)
+		}
+	}
+}
+
+func raiseHype(hub *Hub, event HypeEvent) {
+	log.Printf("Hype trigger %q reached on channel %s: %.2f from %d donations", event.Trigger, event.Channel, event.Raised, event.Count)
+	hub.publishEvent(event.Channel, EventHype, event)
+	hub.db.notifyAdmins(EventHype, fmt.Sprintf("Channel %s: %s (%.2f from %d donations)", event.Channel, event.Trigger, event.Raised, event.Count), event)
+}
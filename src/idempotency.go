@@ -0,0 +1,157 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sessionClaimTTL is how long an accepted session ID is remembered along with
+// its result. Older repeats are still refused by the stored message log and
+// the unique session_id index, just without the original result.
+const sessionClaimTTL = 24 * time.Hour
+
+// errDuplicateSession is returned when storing a session ID that is already stored
+var errDuplicateSession = fmt.Errorf("session ID is already stored: %w", ErrSessionUsed)
+
+// sessionClaim is a session ID being accepted, or accepted with result
+type sessionClaim struct {
+	id      string
+	result  *SendResult
+	expires time.Time
+}
+
+// sessionClaims makes sure each session ID is accepted once even when a
+// frontend retries while the first request is still running. Claims are
+// shared through the bus when there is one, and kept in memory otherwise.
+// Every claim lives for sessionClaimTTL, so order has them oldest first and
+// expired ones are dropped from its front.
+type sessionClaims struct {
+	mutex  sync.Mutex
+	claims map[string]*sessionClaim
+	order  *list.List
+}
+
+func newSessionClaims() *sessionClaims {
+	return &sessionClaims{claims: make(map[string]*sessionClaim), order: list.New()}
+}
+
+// claimSession reserves a session ID for this request on hub. If it is taken
+// it returns false, with the first request's result once that is known.
+func claimSession(hub *Hub, sessionID string) (bool, *SendResult) {
+	if hub.bus != nil {
+		claimed, result, err := hub.bus.claimSession(sessionID)
+		if err == nil {
+			return claimed, result
+		}
+		log.Printf("Error claiming session %s in Redis, claiming locally: %v", sessionID, err)
+	}
+
+	claims := hub.sessionClaims
+	claims.mutex.Lock()
+	defer claims.mutex.Unlock()
+	now := clock.Now()
+	for front := claims.order.Front(); front != nil; front = claims.order.Front() {
+		claim := front.Value.(*sessionClaim)
+		if claim.expires.After(now) {
+			break
+		}
+		claims.order.Remove(front)
+		// A released session may have been claimed again since
+		if claims.claims[claim.id] == claim {
+			delete(claims.claims, claim.id)
+		}
+	}
+	if claim, ok := claims.claims[sessionID]; ok {
+		return false, claim.result
+	}
+	claim := &sessionClaim{id: sessionID, expires: now.Add(sessionClaimTTL)}
+	claims.claims[sessionID] = claim
+	claims.order.PushBack(claim)
+	return true, nil
+}
+
+// completeSession records the result repeats of a claimed session are answered
+// with. The audio isn't kept; repeats get the queue state only.
+func completeSession(hub *Hub, sessionID string, result SendResult) {
+	result.Audio = nil
+	if hub.bus != nil {
+		if err := hub.bus.completeSession(sessionID, result); err != nil {
+			log.Printf("Error recording result of session %s in Redis: %v", sessionID, err)
+		}
+	}
+
+	claims := hub.sessionClaims
+	claims.mutex.Lock()
+	defer claims.mutex.Unlock()
+	if claim, ok := claims.claims[sessionID]; ok {
+		claim.result = &result
+	}
+}
+
+// releaseSession gives up a claim so the session can be retried, after a
+// failure or a refusal of the message before it was accepted. Its place in
+// the expiry order is dropped when it comes up.
+func releaseSession(hub *Hub, sessionID string) {
+	if hub.bus != nil {
+		if err := hub.bus.releaseSession(sessionID); err != nil {
+			log.Printf("Error releasing session %s in Redis: %v", sessionID, err)
+		}
+	}
+
+	hub.sessionClaims.mutex.Lock()
+	delete(hub.sessionClaims.claims, sessionID)
+	hub.sessionClaims.mutex.Unlock()
+}
+
+func (b *redisBus) sessionKey(sessionID string) string {
+	return b.prefix + ":session:" + sessionID
+}
+
+// claimSession is an atomic SET NX: the first instance to set the key owns
+// the session. The value is empty until the result is recorded.
+func (b *redisBus) claimSession(sessionID string) (bool, *SendResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	claimed, err := b.client.SetNX(ctx, b.sessionKey(sessionID), "", sessionClaimTTL).Result()
+	if err != nil || claimed {
+		return claimed, nil, err
+	}
+
+	value, err := b.client.Get(ctx, b.sessionKey(sessionID)).Result()
+	if errors.Is(err, redis.Nil) || value == "" {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	var result SendResult
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		return false, nil, nil
+	}
+	return false, &result, nil
+}
+
+func (b *redisBus) completeSession(sessionID string, result SendResult) error {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return b.client.Set(ctx, b.sessionKey(sessionID), payload, redis.KeepTTL).Err()
+}
+
+func (b *redisBus) releaseSession(sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return b.client.Del(ctx, b.sessionKey(sessionID)).Err()
+}
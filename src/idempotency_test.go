@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionIsClaimedOnce(t *testing.T) {
+	// Without a bus the hub claims sessions locally
+	hub := newHub(nil)
+
+	if claimed, _ := claimSession(hub, "session-1"); !claimed {
+		t.Fatal("first claim refused")
+	}
+	claimed, result := claimSession(hub, "session-1")
+	if claimed {
+		t.Fatal("repeat claimed while the first request is running")
+	}
+	if result != nil {
+		t.Fatalf("repeat got result %+v before the first request finished", result)
+	}
+
+	completeSession(hub, "session-1", SendResult{QueuePosition: 3})
+	claimed, result = claimSession(hub, "session-1")
+	if claimed {
+		t.Fatal("repeat claimed after the first request finished")
+	}
+	if result == nil || result.QueuePosition != 3 {
+		t.Fatalf("repeat got result %+v, want the first request's", result)
+	}
+}
+
+func TestReleasedSessionCanBeRetried(t *testing.T) {
+	hub := newHub(nil)
+
+	claimSession(hub, "session-1")
+	releaseSession(hub, "session-1")
+	if claimed, _ := claimSession(hub, "session-1"); !claimed {
+		t.Fatal("released session could not be claimed again")
+	}
+}
+
+func TestSessionClaimsExpire(t *testing.T) {
+	hub := newHub(nil)
+	manual := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	useClock(t, manual)
+
+	claimSession(hub, "session-1")
+	manual.Advance(sessionClaimTTL - time.Second)
+	if claimed, _ := claimSession(hub, "session-1"); claimed {
+		t.Fatal("session claimed again before its claim expired")
+	}
+	manual.Advance(time.Second)
+	if claimed, _ := claimSession(hub, "session-1"); !claimed {
+		t.Fatal("session could not be claimed once its claim expired")
+	}
+}
+
+func TestConcurrentClaimsHaveOneWinner(t *testing.T) {
+	hub := newHub(nil)
+
+	const requests = 32
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	winners := 0
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if claimed, _ := claimSession(hub, "session-1"); claimed {
+				mutex.Lock()
+				winners++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("%d of %d concurrent requests claimed the session, want 1", winners, requests)
+	}
+}
+
+func TestHubsClaimSessionsSeparately(t *testing.T) {
+	first, second := newHub(nil), newHub(nil)
+
+	claimSession(first, "session-1")
+	if claimed, _ := claimSession(second, "session-1"); !claimed {
+		t.Fatal("session claimed on one hub was refused on another")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// instanceCookie is set on the listen handshake so load balancers can pin overlays to a node
+const instanceCookie = "tts_instance"
+
+// Instance describes this server process in a multi-instance deployment
+type Instance struct {
+	ID        string    `json:"instance_id"`
+	Hostname  string    `json:"hostname"`
+	StartedAt time.Time `json:"started_at"`
+	// Region is set from EDGE_REGION in multi-region deployments
+	Region string `json:"region,omitempty"`
+}
+
+var instance = newInstance(os.Getenv("INSTANCE_ID"))
+
+// newInstance builds the instance identity, generating a random ID when none is configured
+func newInstance(id string) Instance {
+	hostname, _ := os.Hostname()
+	if id == "" {
+		buf := make([]byte, 6)
+		rand.Read(buf)
+		id = hex.EncodeToString(buf)
+		if hostname != "" {
+			id = hostname + "-" + id
+		}
+	}
+
+	return Instance{
+		ID:        id,
+		Hostname:  hostname,
+		StartedAt: time.Now(),
+	}
+}
+
+// handshakeHeaders returns the headers attached to the WebSocket upgrade response
+func (i Instance) handshakeHeaders() http.Header {
+	header := http.Header{}
+	header.Set("X-Instance-ID", i.ID)
+	if i.Region != "" {
+		header.Set("X-Instance-Region", i.Region)
+	}
+	header.Add("Set-Cookie", (&http.Cookie{
+		Name:     instanceCookie,
+		Value:    i.ID,
+		Path:     "/",
+		HttpOnly: true,
+	}).String())
+	return header
+}
+
+// instanceHandler reports which node served the request, for debugging LB affinity
+func (s *Server) instanceHandler(c *gin.Context) {
+	s.hub.mutex.Lock()
+	listeners := s.hub.listenerCount()
+	s.hub.mutex.Unlock()
+
+	c.Header("X-Instance-ID", instance.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"instance_id": instance.ID,
+		"hostname":    instance.Hostname,
+		"region":      instance.Region,
+		"started_at":  instance.StartedAt.Format(time.RFC3339),
+		"uptime":      time.Since(instance.StartedAt).Round(time.Second).String(),
+		"listeners":   listeners,
+	})
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// telegramAPI is the Bot API the Telegram integration posts through
+const telegramAPI = "https://api.telegram.org"
+
+// obsTimeout bounds each conversation with obs-websocket
+const obsTimeout = 5 * time.Second
+
+var integrationClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyChannelIntegrations tells the channel's own webhooks, Discord and
+// Telegram about a message that was broadcast. Test alerts and messages
+// another instance accepted are left out, so each donation is posted once.
+// Failures are only logged.
+func notifyChannelIntegrations(hub *Hub, msg Message) {
+	if msg.Test || msg.Probe || msg.Remote || msg.Canary || msg.Status == statusMissed {
+		return
+	}
+	settings := hub.channelSettings(msg.Channel)
+	if len(settings.Webhooks) == 0 && settings.Discord.WebhookURL == "" && settings.Telegram.ChatID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if len(settings.Webhooks) > 0 {
+		body, err := json.Marshal(WebhookPayload{
+			ID:        newDeliveryID(),
+			Event:     webhookMessageBroadcast,
+			CreatedAt: time.Now().UTC(),
+			Data: WebhookMessage{
+				ID:          msg.ID,
+				SessionID:   msg.SessionID,
+				Channel:     msg.Channel,
+				Name:        msg.Name,
+				Amount:      msg.Amount,
+				Message:     msg.Message,
+				Description: msg.Description,
+				Anonymous:   msg.Anonymous,
+			},
+		})
+		if err != nil {
+			log.Printf("Error marshaling channel webhook: %v", err)
+		} else {
+			for _, hook := range settings.Webhooks {
+				headers := map[string]string{webhookEventHeader: webhookMessageBroadcast}
+				if hub.signingKeys.configured() {
+					headers[signatureHeader] = hub.signingKeys.sign(body)
+				}
+				if err := postIntegration(ctx, hook, body, headers); err != nil {
+					log.Printf("Error calling webhook of channel %s: %v", msg.Channel, err)
+				}
+			}
+		}
+	}
+
+	text := integrationText(hub, msg)
+	if settings.Discord.WebhookURL != "" {
+		// Donors choose the text, so it may mention nobody
+		body, _ := json.Marshal(map[string]any{"content": text, "allowed_mentions": map[string]any{"parse": []string{}}})
+		if err := postIntegration(ctx, settings.Discord.WebhookURL, body, nil); err != nil {
+			log.Printf("Error posting to Discord for channel %s: %v", msg.Channel, err)
+		}
+	}
+	if settings.Telegram.ChatID != "" {
+		body, _ := json.Marshal(map[string]any{"chat_id": settings.Telegram.ChatID, "text": text, "disable_web_page_preview": true})
+		endpoint := telegramAPI + "/bot" + settings.Telegram.BotToken + "/sendMessage"
+		if err := postIntegration(ctx, endpoint, body, nil); err != nil {
+			// Leave out the URL, and with it the bot token
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			log.Printf("Error posting to Telegram for channel %s: %v", msg.Channel, err)
+		}
+	}
+}
+
+// integrationText is how a message reads in chat notifications
+func integrationText(hub *Hub, msg Message) string {
+	if msg.Amount == 0 {
+		return fmt.Sprintf("%s: %s", msg.Name, msg.Message)
+	}
+	amount := msg.AmountText
+	if amount == "" {
+		amount = templateAmount(hub, msg.Channel, msg.Amount, messageCurrency(hub, msg))
+	}
+	if msg.Message == "" {
+		return fmt.Sprintf("%s donated %s", msg.Name, amount)
+	}
+	return fmt.Sprintf("%s donated %s: %s", msg.Name, amount, msg.Message)
+}
+
+func postIntegration(ctx context.Context, endpoint string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := integrationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// obsAlert is what OBS looked like before a channel's alerts started playing.
+// Alerts that follow on from each other share one; the first to start
+// changes OBS and the last to end puts it back.
+type obsAlert struct {
+	// mutex serializes the channel's conversations with OBS
+	mutex    sync.Mutex
+	playing  int
+	previous string
+	scene    string
+	item     int
+}
+
+var obsAlerts = struct {
+	mutex    sync.Mutex
+	channels map[string]*obsAlert
+}{channels: make(map[string]*obsAlert)}
+
+// showOnOBS switches the channel's OBS to its alert scene and shows its
+// alert source for as long as an alert plays. Failures are only logged; the
+// alert plays regardless.
+func showOnOBS(hub *Hub, msg Message, duration time.Duration) {
+	settings := hub.channelSettings(msg.Channel).OBS
+	if settings.WebSocketURL == "" || (settings.AlertScene == "" && settings.AlertSource == "") {
+		return
+	}
+	obsAlerts.mutex.Lock()
+	alert := obsAlerts.channels[msg.Channel]
+	if alert == nil {
+		alert = &obsAlert{}
+		obsAlerts.channels[msg.Channel] = alert
+	}
+	obsAlerts.mutex.Unlock()
+
+	alert.mutex.Lock()
+	alert.playing++
+	if alert.playing == 1 {
+		if err := alert.start(settings); err != nil {
+			log.Printf("Error switching OBS to the alert for channel %s: %v", msg.Channel, err)
+		}
+	}
+	alert.mutex.Unlock()
+
+	time.AfterFunc(duration, func() {
+		alert.mutex.Lock()
+		defer alert.mutex.Unlock()
+		alert.playing--
+		if alert.playing > 0 {
+			return
+		}
+		if err := alert.end(settings); err != nil {
+			log.Printf("Error putting OBS back after the alert for channel %s: %v", msg.Channel, err)
+		}
+	})
+}
+
+// start switches to the alert scene and shows the alert source in it,
+// remembering what to put back
+func (a *obsAlert) start(settings OBSSettings) error {
+	client, err := dialOBS(settings)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	var current struct {
+		Scene string `json:"currentProgramSceneName"`
+	}
+	if err := client.call("GetCurrentProgramScene", nil, &current); err != nil {
+		return err
+	}
+	a.previous, a.scene, a.item = "", current.Scene, 0
+	if settings.AlertScene != "" && settings.AlertScene != current.Scene {
+		if err := client.call("SetCurrentProgramScene", map[string]any{"sceneName": settings.AlertScene}, nil); err != nil {
+			return err
+		}
+		a.previous, a.scene = current.Scene, settings.AlertScene
+	}
+	if settings.AlertSource != "" {
+		var item struct {
+			ID int `json:"sceneItemId"`
+		}
+		if err := client.call("GetSceneItemId", map[string]any{"sceneName": a.scene, "sourceName": settings.AlertSource}, &item); err != nil {
+			return err
+		}
+		if err := client.call("SetSceneItemEnabled", map[string]any{"sceneName": a.scene, "sceneItemId": item.ID, "sceneItemEnabled": true}, nil); err != nil {
+			return err
+		}
+		a.item = item.ID
+	}
+	return nil
+}
+
+// end hides the alert source and switches back to the scene before the alert
+func (a *obsAlert) end(settings OBSSettings) error {
+	if a.item == 0 && a.previous == "" {
+		return nil
+	}
+	client, err := dialOBS(settings)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	if a.item != 0 {
+		if err := client.call("SetSceneItemEnabled", map[string]any{"sceneName": a.scene, "sceneItemId": a.item, "sceneItemEnabled": false}, nil); err != nil {
+			return err
+		}
+		a.item = 0
+	}
+	if a.previous != "" {
+		if err := client.call("SetCurrentProgramScene", map[string]any{"sceneName": a.previous}, nil); err != nil {
+			return err
+		}
+		a.previous = ""
+	}
+	return nil
+}
+
+// obsClient is a connection to obs-websocket (protocol version 5)
+type obsClient struct {
+	conn *websocket.Conn
+	next int
+}
+
+// obsMessage is an obs-websocket frame: an op code and its data
+type obsMessage struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+// obs-websocket op codes
+const (
+	obsOpHello           = 0
+	obsOpIdentify        = 1
+	obsOpIdentified      = 2
+	obsOpRequest         = 6
+	obsOpRequestResponse = 7
+)
+
+// dialOBS connects to obs-websocket and identifies, answering its
+// authentication challenge with the password when it sets one
+func dialOBS(settings OBSSettings) (*obsClient, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: obsTimeout}
+	conn, _, err := dialer.Dial(settings.WebSocketURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to obs-websocket: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(obsTimeout))
+	conn.SetWriteDeadline(time.Now().Add(obsTimeout))
+	client := &obsClient{conn: conn}
+
+	var hello struct {
+		Authentication *struct {
+			Challenge string `json:"challenge"`
+			Salt      string `json:"salt"`
+		} `json:"authentication"`
+	}
+	if err := client.read(obsOpHello, &hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	identify := map[string]any{"rpcVersion": 1}
+	if hello.Authentication != nil {
+		secret := sha256.Sum256([]byte(settings.Password + hello.Authentication.Salt))
+		answer := sha256.Sum256([]byte(base64.StdEncoding.EncodeToString(secret[:]) + hello.Authentication.Challenge))
+		identify["authentication"] = base64.StdEncoding.EncodeToString(answer[:])
+	}
+	if err := client.write(obsOpIdentify, identify); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := client.read(obsOpIdentified, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// call makes a request and decodes its response data into out, if given
+func (c *obsClient) call(requestType string, data any, out any) error {
+	c.next++
+	id := strconv.Itoa(c.next)
+	request := map[string]any{"requestType": requestType, "requestId": id}
+	if data != nil {
+		request["requestData"] = data
+	}
+	if err := c.write(obsOpRequest, request); err != nil {
+		return err
+	}
+
+	var response struct {
+		ID     string `json:"requestId"`
+		Status struct {
+			Result  bool   `json:"result"`
+			Code    int    `json:"code"`
+			Comment string `json:"comment"`
+		} `json:"requestStatus"`
+		Data json.RawMessage `json:"responseData"`
+	}
+	for response.ID != id {
+		if err := c.read(obsOpRequestResponse, &response); err != nil {
+			return err
+		}
+	}
+	if !response.Status.Result {
+		return fmt.Errorf("obs-websocket refused %s (%d): %s", requestType, response.Status.Code, response.Status.Comment)
+	}
+	if out != nil && len(response.Data) > 0 {
+		return json.Unmarshal(response.Data, out)
+	}
+	return nil
+}
+
+func (c *obsClient) write(op int, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteJSON(obsMessage{Op: op, Data: raw})
+}
+
+// read waits for a frame with op, skipping events and anything else OBS
+// sends in between
+func (c *obsClient) read(op int, out any) error {
+	for {
+		var message obsMessage
+		if err := c.conn.ReadJSON(&message); err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok && closeErr.Code == 4009 {
+				return fmt.Errorf("obs-websocket refused the password")
+			}
+			return fmt.Errorf("failed to read from obs-websocket: %w", err)
+		}
+		if message.Op != op {
+			continue
+		}
+		if out != nil {
+			return json.Unmarshal(message.Data, out)
+		}
+		return nil
+	}
+}
+
+func (c *obsClient) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Kinds of stored message
+const (
+	kindDonation = "donation"
+	kindMessage  = "message"
+)
+
+// backfillBatchSize is how many ids each backfill UPDATE covers
+const backfillBatchSize = 5000
+
+// messageColumns are the tts_messages columns the server reads and writes
+var messageColumns = []string{
+	"id", "session_id", "name", "amount", "message", "description", "anonymous", "name_encrypted",
+	"status", "channel", "status_token", "played_at", "filtered", "original_message", "filter_reasons",
+	"currency", "kind", "metadata", "created_at",
+}
+
+// messageStatuses are every status a stored message can have
+var messageStatuses = []string{
+	statusBroadcast, statusMissed, statusRedacted, statusBlocked, statusPending, statusApproved, statusRejected, statusHidden,
+}
+
+// legacyProviders maps the session ID prefixes providers have always used to
+// their names, so rows stored before the metadata column can be given one
+var legacyProviders = []struct{ prefix, provider string }{
+	{"cs_", "stripe"},
+	{"kofi_", "kofi"},
+	{"bmc_", "buymeacoffee"},
+	{"github_", "github"},
+	{"opencollective_", "opencollective"},
+	{"generic_", "generic"},
+	{"tiktok_", "tiktok"},
+	{"youtube_", "youtube"},
+}
+
+// messageKind is the kind a message is stored as: anything paid, or from a
+// payment provider, is a donation
+func messageKind(msg Message) string {
+	if msg.Amount > 0 || msg.Provider != "" {
+		return kindDonation
+	}
+	return kindMessage
+}
+
+// messageMetadata is the metadata column of a message, as JSON
+func messageMetadata(msg Message) string {
+	metadata := map[string]string{}
+	if msg.Provider != "" {
+		metadata["provider"] = msg.Provider
+	}
+	raw, _ := json.Marshal(metadata)
+	return string(raw)
+}
+
+// legacyProviderSQL is a CASE expression naming the provider of a row from its
+// session ID, NULL when there is none
+func legacyProviderSQL() string {
+	var expr strings.Builder
+	expr.WriteString("CASE")
+	for _, legacy := range legacyProviders {
+		fmt.Fprintf(&expr, " WHEN substr(session_id, 1, %d) = '%s' THEN '%s'", len(legacy.prefix), legacy.prefix, legacy.provider)
+	}
+	expr.WriteString(" END")
+	return expr.String()
+}
+
+// detectLegacySchema reports whether tts_messages was created by hand, before
+// the server had migrations, and which of the columns it needs are missing
+func (s *postgresStore) detectLegacySchema(ctx context.Context) (bool, []string, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'tts_messages'
+	`)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to read tts_messages columns: %w", err)
+	}
+	defer rows.Close()
+
+	present := map[string]bool{}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return false, nil, fmt.Errorf("failed to scan column: %w", err)
+		}
+		present[column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+	if len(present) == 0 {
+		return false, nil, nil
+	}
+
+	var migrated bool
+	if err := s.pool.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&migrated); err != nil {
+		return false, nil, fmt.Errorf("failed to look for schema_migrations: %w", err)
+	}
+	missing := []string{}
+	for _, column := range messageColumns {
+		if !present[column] {
+			missing = append(missing, column)
+		}
+	}
+	return !migrated, missing, nil
+}
+
+// backfillMessages fills in kind, metadata and, when currency is given, the
+// currency of rows stored before those columns existed. It works through the
+// table a batch of ids at a time, so it can run beside a live server, and
+// returns how many rows it changed.
+func (s *postgresStore) backfillMessages(ctx context.Context, currency string) (int64, error) {
+	var maxID int64
+	if err := s.pool.QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM tts_messages").Scan(&maxID); err != nil {
+		return 0, fmt.Errorf("failed to read the newest message id: %w", err)
+	}
+
+	provider := legacyProviderSQL()
+	query := `
+		UPDATE tts_messages SET
+			metadata = jsonb_strip_nulls(jsonb_build_object('provider', ` + provider + `)),
+			kind = CASE WHEN amount > 0 OR ` + provider + ` IS NOT NULL THEN 'donation' ELSE 'message' END,
+			currency = CASE WHEN currency = '' AND amount > 0 THEN $3 ELSE currency END
+		WHERE id > $1 AND id <= $2 AND metadata = '{}'::JSONB
+	`
+	var updated int64
+	for from := int64(0); from < maxID; from += backfillBatchSize {
+		tag, err := s.pool.Exec(ctx, query, from, from+backfillBatchSize, currency)
+		if err != nil {
+			return updated, fmt.Errorf("failed to backfill messages after id %d: %w", from, err)
+		}
+		updated += tag.RowsAffected()
+		select {
+		case <-ctx.Done():
+			return updated, ctx.Err()
+		case <-time.After(retentionBatchPause):
+		}
+	}
+	return updated, nil
+}
+
+// verifyMessages checks tts_messages for anything that would trip the server
+// up after an upgrade and describes each problem found
+func (s *postgresStore) verifyMessages(ctx context.Context) ([]string, error) {
+	problems := []string{}
+	_, missing, err := s.detectLegacySchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		// The data checks need the columns
+		return append(problems, "tts_messages is missing columns: "+strings.Join(missing, ", ")), nil
+	}
+
+	migrations, err := s.migrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, migration := range migrations {
+		if migration.AppliedAt == nil {
+			problems = append(problems, fmt.Sprintf("migration %04d_%s has not been applied", migration.Version, migration.Name))
+		}
+	}
+
+	quoted := make([]string, len(messageStatuses))
+	for i, status := range messageStatuses {
+		quoted[i] = "'" + status + "'"
+	}
+	checks := []struct {
+		query   string
+		problem string
+	}{
+		{"SELECT COUNT(*) - COUNT(DISTINCT session_id) FROM tts_messages", "%d messages share a session_id with another"},
+		{"SELECT COUNT(*) FROM tts_messages WHERE status NOT IN (" + strings.Join(quoted, ", ") + ")", "%d messages have an unknown status"},
+		{"SELECT COUNT(*) FROM tts_messages WHERE kind NOT IN ('donation', 'message')", "%d messages have an unknown kind"},
+		{"SELECT COUNT(*) FROM tts_messages WHERE channel = ''", "%d messages have no channel"},
+		{"SELECT COUNT(*) FROM tts_messages WHERE metadata = '{}'::JSONB AND " + legacyProviderSQL() + " IS NOT NULL",
+			"%d messages need `migrate backfill`"},
+		// New messages would collide with existing ids
+		{`SELECT GREATEST(COALESCE(MAX(id), 0) - (SELECT last_value FROM tts_messages_id_seq), 0) FROM tts_messages`,
+			"the id sequence is %d behind the newest message"},
+	}
+	for _, check := range checks {
+		var count int64
+		if err := s.pool.QueryRow(ctx, check.query).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to verify messages: %w", err)
+		}
+		if count > 0 {
+			problems = append(problems, fmt.Sprintf(check.problem, count))
+		}
+	}
+	return problems, nil
+}
+
+// logLegacySchema says what startup is about to upgrade, for databases from
+// before migrations
+func (s *postgresStore) logLegacySchema(ctx context.Context) {
+	legacy, missing, err := s.detectLegacySchema(ctx)
+	if err != nil {
+		log.Printf("Warning: could not inspect the message table: %v", err)
+		return
+	}
+	if legacy && len(missing) > 0 {
+		log.Printf("Upgrading a message table from before migrations, adding columns: %s", strings.Join(missing, ", "))
+	} else if legacy {
+		log.Printf("Upgrading a message table from before migrations")
+	}
+}
+
+// logVerification warns about every problem verifyMessages finds
+func (s *postgresStore) logVerification(ctx context.Context) {
+	problems, err := s.verifyMessages(ctx)
+	if err != nil {
+		log.Printf("Warning: could not verify the message table: %v", err)
+		return
+	}
+	for _, problem := range problems {
+		log.Printf("Warning: %s", problem)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// ListenConfig sets the addresses the server takes connections on. Each is
+// a host:port; "[::]:8080" takes IPv6 and, where the system maps them, IPv4
+// connections too, "0.0.0.0:8080" only IPv4 and ":8080" both.
+type ListenConfig struct {
+	// Addrs serve every route, or all but the admin API when AdminAddrs is
+	// set. They default to ":PORT".
+	Addrs []string
+	// AdminAddrs, when set, are the only addresses the admin API and
+	// metrics are served on, e.g. a loopback or internal address. They serve
+	// the public routes too. ADMIN_PORT is short for 127.0.0.1:ADMIN_PORT.
+	AdminAddrs []string
+}
+
+// adminPortAddrs are the admin addresses ADMIN_PORT stands for
+func adminPortAddrs() []string {
+	if port := os.Getenv("ADMIN_PORT"); port != "" {
+		return []string{net.JoinHostPort("127.0.0.1", port)}
+	}
+	return nil
+}
+
+func (c ListenConfig) validate() error {
+	if len(c.Addrs) == 0 {
+		return fmt.Errorf("LISTEN_ADDR must name at least one address")
+	}
+	seen := map[string]bool{}
+	for _, addr := range append(append([]string{}, c.Addrs...), c.AdminAddrs...) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %w", addr, err)
+		}
+		if seen[addr] {
+			return fmt.Errorf("listen address %q is given twice", addr)
+		}
+		seen[addr] = true
+	}
+	return nil
+}
+
+// serverListener is a listener and the server that serves it
+type serverListener struct {
+	net.Listener
+	server *http.Server
+}
+
+// listen opens every configured address, closing the ones already open if
+// one fails, so the server starts on all of them or none
+func (s *Server) listen() ([]serverListener, error) {
+	var listeners []serverListener
+	open := func(addrs []string, server *http.Server, kind string) error {
+		for _, addr := range addrs {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			log.Printf("Server listening on %s for %s routes", l.Addr(), kind)
+			if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok && server == s.adminHTTP && tcpAddr.IP.IsUnspecified() {
+				log.Printf("Warning: admin address %s listens on every interface; bind it to a loopback or internal address to keep the admin API off the public network", addr)
+			}
+			listeners = append(listeners, serverListener{Listener: l, server: server})
+		}
+		return nil
+	}
+
+	kind := "all"
+	if s.adminHTTP != nil {
+		kind = "public"
+	}
+	err := open(s.config.Listen.Addrs, s.http, kind)
+	if err == nil && s.adminHTTP != nil {
+		err = open(s.config.Listen.AdminAddrs, s.adminHTTP, "admin and public")
+	}
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// publicRoutes answers admin routes and metrics as if they didn't exist, for
+// the listeners that face donors and overlays when the admin API has its own
+func publicRoutes(router http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if routeGroup(r.URL.Path) == routeAdmin {
+			http.NotFound(w, r)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
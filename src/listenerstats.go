@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeWindow is how many of a listener's most recent writes its latency
+// percentiles are taken over
+const writeWindow = 128
+
+// writeStats keeps a listener's recent write latencies
+type writeStats struct {
+	mutex   sync.Mutex
+	samples [writeWindow]time.Duration
+	next    int
+	filled  int
+	total   uint64
+}
+
+func (w *writeStats) record(took time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.samples[w.next] = took
+	w.next = (w.next + 1) % writeWindow
+	if w.filled < writeWindow {
+		w.filled++
+	}
+	w.total++
+}
+
+// percentiles returns the 50th, 95th and 99th percentile and the slowest of
+// the recent writes, in milliseconds, and how many writes there were in all
+func (w *writeStats) percentiles() ([4]float64, uint64) {
+	w.mutex.Lock()
+	recent := make([]time.Duration, w.filled)
+	copy(recent, w.samples[:w.filled])
+	total := w.total
+	w.mutex.Unlock()
+
+	var result [4]float64
+	if len(recent) == 0 {
+		return result, total
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	for i, p := range []float64{0.50, 0.95, 0.99, 1} {
+		rank := int(p*float64(len(recent))+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(recent) {
+			rank = len(recent) - 1
+		}
+		result[i] = float64(recent[rank].Microseconds()) / 1000
+	}
+	return result, total
+}
+
+// ListenerStats is one connected listener's send queue and write latency
+type ListenerStats struct {
+	ID          string    `json:"id"`
+	Channel     string    `json:"channel"`
+	Format      string    `json:"format"`
+	Remote      string    `json:"remote,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// QueueDepth is how many payloads are waiting to be written, out of
+	// QueueCapacity; a listener whose queue fills up overflows
+	QueueDepth    int     `json:"queue_depth"`
+	QueueCapacity int     `json:"queue_capacity"`
+	Occupancy     float64 `json:"occupancy"`
+	Writes        uint64  `json:"writes"`
+	// The write latencies are over the listener's last writeWindow writes
+	WriteP50MS float64 `json:"write_p50_ms"`
+	WriteP95MS float64 `json:"write_p95_ms"`
+	WriteP99MS float64 `json:"write_p99_ms"`
+	WriteMaxMS float64 `json:"write_max_ms"`
+	// Violations is how many malformed frames the listener has sent
+	Violations int `json:"violations"`
+	// Canary is set for listeners that take canary broadcasts
+	Canary bool `json:"canary,omitempty"`
+}
+
+func newListenerID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (l *listener) stats() ListenerStats {
+	latency, writes := l.writes.percentiles()
+	stats := ListenerStats{
+		ID:            l.id,
+		Channel:       l.channel,
+		Format:        l.format,
+		Remote:        l.remote,
+		ConnectedAt:   l.connectedAt,
+		QueueDepth:    len(l.send),
+		QueueCapacity: cap(l.send),
+		Writes:        writes,
+		WriteP50MS:    latency[0],
+		WriteP95MS:    latency[1],
+		WriteP99MS:    latency[2],
+		WriteMaxMS:    latency[3],
+		Violations:    int(l.violations.Load()),
+		Canary:        l.canary,
+	}
+	if stats.QueueCapacity > 0 {
+		stats.Occupancy = float64(stats.QueueDepth) / float64(stats.QueueCapacity)
+	}
+	return stats
+}
+
+// listenerStats lists every listener, the ones furthest behind first
+func (hub *Hub) listenerStats() []ListenerStats {
+	hub.mutex.Lock()
+	stats := make([]ListenerStats, 0, hub.listenerCount())
+	for _, clients := range hub.clients {
+		for client := range clients {
+			stats = append(stats, client.stats())
+		}
+	}
+	hub.mutex.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Occupancy != stats[j].Occupancy {
+			return stats[i].Occupancy > stats[j].Occupancy
+		}
+		return stats[i].WriteP99MS > stats[j].WriteP99MS
+	})
+	return stats
+}
+
+// listenersHandler shows each connected listener's queue and write latency,
+// so a slow overlay can be found before it overflows
+func (s *Server) listenersHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"listeners": s.hub.listenerStats()})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sendErrorTranslations translates the errors donation frontends show
+// donors, keyed by the English text. Placeholders are filled in with the
+// values from the English message, in order unless indexed as %[2]s.
+var sendErrorTranslations = map[string]map[string]string{
+	"Invalid request signature": {
+		"es": "La firma de la solicitud no es válida",
+		"fr": "La signature de la requête n'est pas valide",
+		"de": "Die Signatur der Anfrage ist ungültig",
+		"pt": "A assinatura da solicitação é inválida",
+		"it": "La firma della richiesta non è valida",
+		"ja": "リクエストの署名が無効です",
+	},
+	"Request body is larger than %d bytes": {
+		"es": "El cuerpo de la solicitud supera los %s bytes",
+		"fr": "Le corps de la requête dépasse %s octets",
+		"de": "Der Inhalt der Anfrage ist größer als %s Bytes",
+		"pt": "O corpo da solicitação é maior que %s bytes",
+		"it": "Il corpo della richiesta supera i %s byte",
+		"ja": "リクエスト本文が%sバイトを超えています",
+	},
+	"Invalid request format": {
+		"es": "El formato de la solicitud no es válido",
+		"fr": "Le format de la requête n'est pas valide",
+		"de": "Das Format der Anfrage ist ungültig",
+		"pt": "O formato da solicitação é inválido",
+		"it": "Il formato della richiesta non è valido",
+		"ja": "リクエストの形式が無効です",
+	},
+	"Idempotency-Key does not match session_id": {
+		"es": "Idempotency-Key no coincide con session_id",
+		"fr": "Idempotency-Key ne correspond pas à session_id",
+		"de": "Idempotency-Key stimmt nicht mit session_id überein",
+		"pt": "Idempotency-Key não corresponde a session_id",
+		"it": "Idempotency-Key non corrisponde a session_id",
+		"ja": "Idempotency-Key が session_id と一致しません",
+	},
+	"session_id or an Idempotency-Key header is required": {
+		"es": "Se requiere session_id o un encabezado Idempotency-Key",
+		"fr": "session_id ou un en-tête Idempotency-Key est requis",
+		"de": "session_id oder ein Idempotency-Key-Header ist erforderlich",
+		"pt": "É necessário session_id ou um cabeçalho Idempotency-Key",
+		"it": "È richiesto session_id o un'intestazione Idempotency-Key",
+		"ja": "session_id または Idempotency-Key ヘッダーが必要です",
+	},
+	"Invalid channel name": {
+		"es": "El nombre del canal no es válido",
+		"fr": "Le nom du canal n'est pas valide",
+		"de": "Der Kanalname ist ungültig",
+		"pt": "O nome do canal é inválido",
+		"it": "Il nome del canale non è valido",
+		"ja": "チャンネル名が無効です",
+	},
+	"API key is not valid for this channel": {
+		"es": "La clave de API no es válida para este canal",
+		"fr": "La clé d'API n'est pas valide pour ce canal",
+		"de": "Der API-Schlüssel gilt nicht für diesen Kanal",
+		"pt": "A chave de API não é válida para este canal",
+		"it": "La chiave API non è valida per questo canale",
+		"ja": "この API キーはこのチャンネルでは使用できません",
+	},
+	"Message cannot be empty": {
+		"es": "El mensaje no puede estar vacío",
+		"fr": "Le message ne peut pas être vide",
+		"de": "Die Nachricht darf nicht leer sein",
+		"pt": "A mensagem não pode estar vazia",
+		"it": "Il messaggio non può essere vuoto",
+		"ja": "メッセージを入力してください",
+	},
+	"Message is longer than %d characters": {
+		"es": "El mensaje supera los %s caracteres",
+		"fr": "Le message dépasse %s caractères",
+		"de": "Die Nachricht ist länger als %s Zeichen",
+		"pt": "A mensagem tem mais de %s caracteres",
+		"it": "Il messaggio supera i %s caratteri",
+		"ja": "メッセージが%s文字を超えています",
+	},
+	"Message is longer than %d seconds of speech": {
+		"es": "El mensaje dura más de %s segundos hablado",
+		"fr": "Le message dure plus de %s secondes à l'oral",
+		"de": "Die Nachricht ist gesprochen länger als %s Sekunden",
+		"pt": "A mensagem falada dura mais de %s segundos",
+		"it": "Il messaggio parlato dura più di %s secondi",
+		"ja": "メッセージの読み上げが%s秒を超えています",
+	},
+	"Monthly message quota reached": {
+		"es": "Se alcanzó la cuota mensual de mensajes",
+		"fr": "Le quota mensuel de messages est atteint",
+		"de": "Das monatliche Nachrichtenkontingent ist erreicht",
+		"pt": "A cota mensal de mensagens foi atingida",
+		"it": "La quota mensile di messaggi è stata raggiunta",
+		"ja": "今月のメッセージ上限に達しました",
+	},
+	"Name is longer than %d characters": {
+		"es": "El nombre supera los %s caracteres",
+		"fr": "Le nom dépasse %s caractères",
+		"de": "Der Name ist länger als %s Zeichen",
+		"pt": "O nome tem mais de %s caracteres",
+		"it": "Il nome supera i %s caratteri",
+		"ja": "名前が%s文字を超えています",
+	},
+	"Amount must be a number of at least 0": {
+		"es": "El importe debe ser un número mayor o igual que 0",
+		"fr": "Le montant doit être un nombre supérieur ou égal à 0",
+		"de": "Der Betrag muss eine Zahl von mindestens 0 sein",
+		"pt": "O valor deve ser um número maior ou igual a 0",
+		"it": "L'importo deve essere un numero maggiore o uguale a 0",
+		"ja": "金額は0以上の数値で指定してください",
+	},
+	"Amount is below the minimum of %g": {
+		"es": "El importe es inferior al mínimo de %s",
+		"fr": "Le montant est inférieur au minimum de %s",
+		"de": "Der Betrag liegt unter dem Mindestbetrag von %s",
+		"pt": "O valor está abaixo do mínimo de %s",
+		"it": "L'importo è inferiore al minimo di %s",
+		"ja": "金額が最低額の%sを下回っています",
+	},
+	"Amount is above the maximum of %g": {
+		"es": "El importe supera el máximo de %s",
+		"fr": "Le montant dépasse le maximum de %s",
+		"de": "Der Betrag liegt über dem Höchstbetrag von %s",
+		"pt": "O valor está acima do máximo de %s",
+		"it": "L'importo supera il massimo di %s",
+		"ja": "金額が上限の%sを超えています",
+	},
+	"Unknown voice: %s": {
+		"es": "Voz desconocida: %s",
+		"fr": "Voix inconnue : %s",
+		"de": "Unbekannte Stimme: %s",
+		"pt": "Voz desconhecida: %s",
+		"it": "Voce sconosciuta: %s",
+		"ja": "不明な音声です: %s",
+	},
+	"Voice %s needs a donation of at least %g": {
+		"es": "La voz %s requiere una donación de al menos %s",
+		"fr": "La voix %s nécessite un don d'au moins %s",
+		"de": "Die Stimme %s erfordert eine Spende von mindestens %s",
+		"pt": "A voz %s exige uma doação de pelo menos %s",
+		"it": "La voce %s richiede una donazione di almeno %s",
+		"ja": "音声「%s」には%s以上の寄付が必要です",
+	},
+	"Unknown language: %s": {
+		"es": "Idioma desconocido: %s",
+		"fr": "Langue inconnue : %s",
+		"de": "Unbekannte Sprache: %s",
+		"pt": "Idioma desconhecido: %s",
+		"it": "Lingua sconosciuta: %s",
+		"ja": "不明な言語です: %s",
+	},
+	"Speed must be between %g and %g": {
+		"es": "La velocidad debe estar entre %s y %s",
+		"fr": "La vitesse doit être comprise entre %s et %s",
+		"de": "Die Geschwindigkeit muss zwischen %s und %s liegen",
+		"pt": "A velocidade deve estar entre %s e %s",
+		"it": "La velocità deve essere compresa tra %s e %s",
+		"ja": "速度は%sから%sの間で指定してください",
+	},
+	"This channel does not accept private notes": {
+		"es": "Este canal no acepta notas privadas",
+		"fr": "Ce canal n'accepte pas les notes privées",
+		"de": "Dieser Kanal nimmt keine privaten Notizen an",
+		"pt": "Este canal não aceita notas privadas",
+		"it": "Questo canale non accetta note private",
+		"ja": "このチャンネルはプライベートメモを受け付けていません",
+	},
+	"Private note must be base64 ciphertext of at most %d bytes": {
+		"es": "La nota privada debe ser texto cifrado en base64 de como máximo %s bytes",
+		"fr": "La note privée doit être un texte chiffré en base64 d'au plus %s octets",
+		"de": "Die private Notiz muss ein Base64-Chiffretext von höchstens %s Bytes sein",
+		"pt": "A nota privada deve ser um texto cifrado em base64 de no máximo %s bytes",
+		"it": "La nota privata deve essere un testo cifrato in base64 di al massimo %s byte",
+		"ja": "プライベートメモは%sバイト以下のbase64暗号文である必要があります",
+	},
+	"Too many requests, try again later": {
+		"es": "Demasiadas solicitudes, inténtalo de nuevo más tarde",
+		"fr": "Trop de requêtes, réessayez plus tard",
+		"de": "Zu viele Anfragen, bitte versuche es später erneut",
+		"pt": "Muitas solicitações, tente novamente mais tarde",
+		"it": "Troppe richieste, riprova più tardi",
+		"ja": "リクエストが多すぎます。しばらくしてから再度お試しください",
+	},
+	"Session already exists": {
+		"es": "Esta donación ya se ha enviado",
+		"fr": "Ce don a déjà été envoyé",
+		"de": "Diese Spende wurde bereits gesendet",
+		"pt": "Esta doação já foi enviada",
+		"it": "Questa donazione è già stata inviata",
+		"ja": "この寄付はすでに送信されています",
+	},
+	"Failed to check session ID": {
+		"es": "No se pudo comprobar la donación, inténtalo de nuevo",
+		"fr": "Impossible de vérifier le don, réessayez",
+		"de": "Die Spende konnte nicht geprüft werden, bitte versuche es erneut",
+		"pt": "Não foi possível verificar a doação, tente novamente",
+		"it": "Impossibile verificare la donazione, riprova",
+		"ja": "寄付を確認できませんでした。もう一度お試しください",
+	},
+	"Donor name is not allowed": {
+		"es": "Este nombre no está permitido",
+		"fr": "Ce nom n'est pas autorisé",
+		"de": "Dieser Name ist nicht erlaubt",
+		"pt": "Este nome não é permitido",
+		"it": "Questo nome non è consentito",
+		"ja": "この名前は使用できません",
+	},
+	"Failed to store message": {
+		"es": "No se pudo guardar el mensaje, inténtalo de nuevo",
+		"fr": "Impossible d'enregistrer le message, réessayez",
+		"de": "Die Nachricht konnte nicht gespeichert werden, bitte versuche es erneut",
+		"pt": "Não foi possível salvar a mensagem, tente novamente",
+		"it": "Impossibile salvare il messaggio, riprova",
+		"ja": "メッセージを保存できませんでした。もう一度お試しください",
+	},
+	"Failed to queue message for moderation": {
+		"es": "No se pudo enviar el mensaje a moderación, inténtalo de nuevo",
+		"fr": "Impossible d'envoyer le message en modération, réessayez",
+		"de": "Die Nachricht konnte nicht zur Moderation eingereiht werden, bitte versuche es erneut",
+		"pt": "Não foi possível enviar a mensagem para moderação, tente novamente",
+		"it": "Impossibile inviare il messaggio alla moderazione, riprova",
+		"ja": "メッセージをモデレーションに送れませんでした。もう一度お試しください",
+	},
+	"Message was blocked by the content filter": {
+		"es": "El filtro de contenido ha bloqueado el mensaje",
+		"fr": "Le message a été bloqué par le filtre de contenu",
+		"de": "Die Nachricht wurde vom Inhaltsfilter blockiert",
+		"pt": "A mensagem foi bloqueada pelo filtro de conteúdo",
+		"it": "Il messaggio è stato bloccato dal filtro dei contenuti",
+		"ja": "メッセージはコンテンツフィルターによりブロックされました",
+	},
+}
+
+// translatedError is an English error message matched back to its format,
+// so the values in it can be put into a translation
+type translatedError struct {
+	pattern      *regexp.Regexp
+	translations map[string]string
+}
+
+var (
+	formatVerb       = regexp.MustCompile(`%[dgs]`)
+	translatedErrors = compileTranslations(sendErrorTranslations)
+)
+
+// errorLanguages lists the languages errors are translated to, besides English
+var errorLanguages = map[string]bool{"en": true, "es": true, "fr": true, "de": true, "pt": true, "it": true, "ja": true}
+
+func compileTranslations(translations map[string]map[string]string) []translatedError {
+	compiled := make([]translatedError, 0, len(translations))
+	for format, localized := range translations {
+		literals := formatVerb.Split(format, -1)
+		for i := range literals {
+			literals[i] = regexp.QuoteMeta(literals[i])
+		}
+		compiled = append(compiled, translatedError{
+			pattern:      regexp.MustCompile("^" + strings.Join(literals, "(.+?)") + "$"),
+			translations: localized,
+		})
+	}
+	return compiled
+}
+
+// localize translates an English error message, leaving messages without a
+// translation in English
+func localize(message string, language string) string {
+	if language == "" || language == "en" {
+		return message
+	}
+	for _, translated := range translatedErrors {
+		values := translated.pattern.FindStringSubmatch(message)
+		template, ok := translated.translations[language]
+		if values == nil || !ok {
+			continue
+		}
+		args := make([]any, len(values)-1)
+		for i, value := range values[1:] {
+			args[i] = value
+		}
+		return fmt.Sprintf(template, args...)
+	}
+	return message
+}
+
+// acceptedLanguage picks the supported language the request prefers from
+// its Accept-Language header, or "en"
+func acceptedLanguage(header string) string {
+	type preference struct {
+		language string
+		quality  float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		// Regional variants get the language's one translation
+		language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if errorLanguages[language] && quality > 0 {
+			preferences = append(preferences, preference{language, quality})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].quality > preferences[j].quality })
+	if len(preferences) == 0 {
+		return "en"
+	}
+	return preferences[0].language
+}
+
+// localizedError responds with an error message in the language the request
+// prefers
+func localizedError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": localizeFor(c, message)})
+}
+
+// localizeFor translates an error message for the request, noting the
+// language in the response headers
+func localizeFor(c *gin.Context, message string) string {
+	language := acceptedLanguage(c.GetHeader("Accept-Language"))
+	c.Header("Vary", "Accept-Language")
+	c.Header("Content-Language", language)
+	return localize(message, language)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Log output formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// requestIDHeader carries the request ID in and out of the server
+const requestIDHeader = "X-Request-ID"
+
+// LogConfig selects the log format and the least severe level written
+type LogConfig struct {
+	Level  string
+	Format string
+}
+
+// sensitiveLogKeys are attributes holding what donors wrote or who they are.
+// They are only written at debug level.
+var sensitiveLogKeys = map[string]bool{
+	"name":             true,
+	"message":          true,
+	"description":      true,
+	"original_message": true,
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns a context carrying id, which log records made with it include
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom is the request ID carried by ctx, or ""
+func requestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// parseLogLevel reads LOG_LEVEL: debug, info, warn or error
+func parseLogLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error")
+	}
+	return parsed, nil
+}
+
+// configureLogging makes slog the default logger. Lines still written with
+// the log package go through it as well, at a level inferred from how they
+// start, so every line comes out in the same format.
+func configureLogging(config LogConfig, out io.Writer) error {
+	level, err := parseLogLevel(config.Level)
+	if err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch config.Format {
+	case logFormatText, "":
+		handler = slog.NewTextHandler(out, options)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		return fmt.Errorf("LOG_FORMAT must be %q or %q", logFormatText, logFormatJSON)
+	}
+
+	slog.SetDefault(slog.New(&logHandler{Handler: handler, level: level}))
+	// slog writes its own timestamps
+	log.SetFlags(0)
+	return nil
+}
+
+// logHandler filters by level, adds the request ID from the context and
+// redacts donor content above debug level
+type logHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+// Enabled lets info through regardless, as lines from the log package arrive
+// at info and only get their real level in Handle
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level || level == slog.LevelInfo
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level == slog.LevelInfo {
+		record.Level = inferLevel(record.Message)
+	}
+	if record.Level < h.level {
+		return nil
+	}
+
+	redact := record.Level > slog.LevelDebug
+	out := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	if id := requestIDFrom(ctx); id != "" {
+		out.AddAttrs(slog.String("request_id", id))
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		if redact {
+			attr = redactAttr(attr)
+		}
+		out.AddAttrs(attr)
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+// inferLevel gives a line from the log package a level by its wording
+func inferLevel(message string) slog.Level {
+	switch {
+	case strings.HasPrefix(message, "Error"), strings.HasPrefix(message, "Failed"):
+		return slog.LevelError
+	case strings.HasPrefix(message, "Warning"), strings.HasPrefix(message, "Rejected"):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// redactAttr blanks sensitive attributes, including inside groups
+func redactAttr(attr slog.Attr) slog.Attr {
+	if attr.Value.Kind() == slog.KindGroup {
+		attrs := attr.Value.Group()
+		redacted := make([]any, len(attrs))
+		for i, inner := range attrs {
+			redacted[i] = redactAttr(inner)
+		}
+		return slog.Group(attr.Key, redacted...)
+	}
+	if sensitiveLogKeys[attr.Key] && !attr.Value.Equal(slog.StringValue("")) {
+		return slog.String(attr.Key, "[redacted]")
+	}
+	return attr
+}
+
+// messageAttrs describes a message for the log. Its text and the donor's
+// name are redacted unless logging at debug level.
+func messageAttrs(msg Message) []any {
+	return []any{
+		slog.String("session_id", msg.SessionID),
+		slog.String("channel", msg.Channel),
+		slog.Float64("amount", float64(msg.Amount)),
+		slog.String("name", msg.Name),
+		slog.String("message", msg.Message),
+	}
+}
+
+// newRequestID makes a random ID for a request that didn't bring one
+func newRequestID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// validRequestID accepts IDs from clients and proxies that are short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID gives every request an ID, reusing X-Request-ID from a proxy
+// when there is one, and returns it in the response and in the request context
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(withRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// requestLogger writes one line per request. The query string is left out,
+// as it can carry keys and donor details.
+func requestLogger(skipPaths ...string) gin.HandlerFunc {
+	skip := make(map[string]bool, len(skipPaths))
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+	return func(c *gin.Context) {
+		started := time.Now()
+		c.Next()
+		if skip[c.Request.URL.Path] {
+			return
+		}
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		slog.LogAttrs(c.Request.Context(), level, "Request",
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(started)),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
@@ -8,33 +8,194 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/rheddev/tts-server/src/tts"
 )
 
 type Message struct {
+	// ID orders delivered messages; listeners resume from the last one they saw
+	ID          int64   `json:"id,omitempty"`
 	SessionID   string  `json:"session_id"`
+	Channel     string  `json:"channel"`
 	Name        string  `json:"name"`
 	Amount      float32 `json:"amount"`
 	Message     string  `json:"message"`
 	Description string  `json:"description"`
+	BidOption   string  `json:"bid_option,omitempty"`
+	PollChoice  string  `json:"poll_choice,omitempty"`
+	Anonymous   bool    `json:"anonymous,omitempty"`
+	// Currency is the ISO code of Amount, when the payment provider gave one
+	Currency string `json:"currency,omitempty"`
+	// Receipt is the code donors quote to support about a donation
+	Receipt string `json:"receipt,omitempty"`
+	// AmountText is Amount written in the channel's amount format, e.g.
+	// "1.234,50 €", for overlays to show as it is
+	AmountText string `json:"amount_text,omitempty"`
+	// Cursor is what a listener passes back as ?since= to resume after this
+	// message, signed for the channel it was broadcast on
+	Cursor string `json:"cursor,omitempty"`
+	// Voice, Language and Speed pick how the message is read out, from the
+	// choices listed by GET /voices; empty uses the defaults
+	Voice    string  `json:"voice,omitempty"`
+	Language string  `json:"language,omitempty"`
+	Speed    float64 `json:"speed,omitempty"`
+	// TwitchVerified tells overlays whether the donor name was seen in Twitch chat
+	TwitchVerified string `json:"twitch_verified,omitempty"`
+	// MediaURL is a media-share link; it is held for moderation, never broadcast with the message
+	MediaURL string `json:"media_url,omitempty"`
+	// Audio is set when the server synthesized the message itself
+	Audio *AudioPayload `json:"audio,omitempty"`
+	// Synthesis is "server" when Audio is attached and "client" when overlays
+	// should read ClientSpeech out with the browser's own TTS instead
+	Synthesis    string        `json:"synthesis,omitempty"`
+	ClientSpeech *ClientSpeech `json:"client_speech,omitempty"`
+	// Emotes found in Message; Speech is the message with them removed, for TTS
+	Emotes []Emote `json:"emotes,omitempty"`
+	Speech string  `json:"speech,omitempty"`
+	// Quiet tells overlays to show the alert without reading it out (quiet hours)
+	Quiet bool `json:"quiet,omitempty"`
+	// Test marks test alerts, which play like any other but are never stored
+	Test bool `json:"test,omitempty"`
+	// Canary marks test alerts sampled to go only to canary listeners
+	Canary bool `json:"canary,omitempty"`
+	// PlayAt is when, in milliseconds since the Unix epoch on the server's
+	// clock, overlays should start playing the alert, so all of a channel's
+	// overlays play it together
+	PlayAt int64 `json:"play_at,omitempty"`
+	// Correction is set on an alert that corrects a refunded donation; like
+	// test alerts, corrections are never stored
+	Correction *RefundCorrection `json:"correction,omitempty"`
+	// Recognition is set on an alert that celebrates a donor's streak or
+	// return; like corrections, recognitions are never stored
+	Recognition *DonorRecognition `json:"recognition,omitempty"`
+	// Summary is set on an alert that stands in for several held while the
+	// channel had no listener
+	Summary *HeldSummary `json:"summary,omitempty"`
+
+	// Status is the stored playback state; it is not sent to listeners
+	Status string `json:"-"`
+
+	// Replay marks a message that is already stored and must not be inserted again
+	Replay bool `json:"-"`
+
+	// Probe marks synthetic self-test messages that must not reach overlays or storage
+	Probe bool `json:"-"`
+	// Remote marks messages received from another instance, which stores them itself
+	Remote bool `json:"-"`
+	// RequestID is the ID of the request that sent the message, for the logs
+	RequestID string `json:"-"`
+
+	// EncryptedName holds the real donor name of anonymous messages; it is never serialized
+	EncryptedName []byte `json:"-"`
+	// PrivateNote is the donor's note to the streamer, encrypted with the
+	// channel's public key; it is never serialized either
+	PrivateNote string `json:"-"`
+	// StatusToken is the unguessable ID donors use to check on their message
+	StatusToken string `json:"-"`
+	// Provider is the payment provider a donation came from, and DonorEmail
+	// the address it gave for the donor, if any; the email is only kept in
+	// memory, for thank-you emails
+	Provider   string `json:"-"`
+	DonorEmail string `json:"-"`
+
+	// Filtered marks messages the content filter changed or blocked; the
+	// original text and what was changed are kept for moderators
+	Filtered        bool     `json:"-"`
+	OriginalMessage string   `json:"-"`
+	FilterReasons   []string `json:"-"`
+}
+
+// announcement reports whether a message is an alert the server made up,
+// such as a refund correction or a donor recognition, rather than one a
+// donor sent. Announcements are played but never stored.
+func (m Message) announcement() bool {
+	return m.Correction != nil || m.Recognition != nil
 }
 
 type Config struct {
-	Port            string
-	FrontendURL     string
-	AdminUsername   string
-	AdminPassword   string
-	ReadTimeout     time.Duration
-	WriteTimeout    time.Duration
-	ShutdownTimeout time.Duration
-	UseTLS          bool
-	CertFile        string
-	KeyFile         string
+	Port               string
+	FrontendURL        string
+	AdminUsername      string
+	AdminPassword      string
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
+	ShutdownTimeout    time.Duration
+	UseTLS             bool
+	CertFile           string
+	KeyFile            string
+	ReconnectDelay     time.Duration
+	ReconnectJitter    time.Duration
+	CharitySponsor     string
+	CharityMatchRatio  float32
+	CharityMatchCap    float32
+	TickerRetention    time.Duration
+	TickerMaxEntries   int
+	AnonymousName      string
+	AnonymousTemplate  string
+	DonorNameKey       string
+	ReportSigningKey   string
+	MetricsMaxSeries   int
+	MetricsToken       string
+	SelfTest           SelfTestConfig
+	Simulation         SimulationConfig
+	Retention          RetentionConfig
+	MessageTTL         time.Duration
+	OfflineSummaryMin  int
+	Twitch             TwitchConfig
+	EmoteProviders     []string
+	MediaHosts         []string
+	MediaShare         MediaShareConfig
+	Audio              AudioConfig
+	Voices             VoiceConfig
+	Log                LogConfig
+	Playback           PlaybackConfig
+	Pacing             PacingConfig
+	RequireAPIKeys     bool
+	Auth               AuthConfig
+	RedisURL           string
+	RedisChannelPrefix string
+	HandoffTTL         time.Duration
+	ModerationEnabled  bool
+	EventLog           bool
+	CompatCurrency     string
+	Payments           PaymentConfig
+	SendLimits         SendLimits
+	ContentFilter      ContentFilterConfig
+	SendBuffer         int
+	OverflowPolicy     string
+	SendDetach         string
+	SigningKeyOverlap  time.Duration
+	ResumeLimit        int
+	TranscriptDir      string
+	StreamLifecycle    bool
+	PresenceGrace      time.Duration
+	WSLimits           frameLimits
+	AutoMigrate        bool
+	RTC                RTCConfig
+	StreamDeckBudget   time.Duration
+	YouTube            YouTubeConfig
+	TikTok             TikTokConfig
+	Crypto             CryptoConfig
+	Usage              UsageConfig
+	Shipping           ShippingConfig
+	SMTP               SMTPConfig
+	Chaos              ChaosConfig
+	Domains            DomainConfig
+	Plugins            PluginConfig
+	Hooks              HookConfig
+	CORS               CORSConfig
+	Listen             ListenConfig
+	Standby            StandbyConfig
+	Canary             CanaryConfig
+	Maintenance        MaintenanceConfig
+	ResumeCursors      ResumeCursorConfig
+	Streaks            StreakConfig
+	Edge               EdgeConfig
 }
 
 func loadConfig() (*Config, error) {
@@ -43,24 +204,384 @@ func loadConfig() (*Config, error) {
 	}
 
 	config := &Config{
-		Port:            getEnvOrDefault("PORT", "8080"),
-		FrontendURL:     getEnvOrDefault("FRONTEND_URL", "http://localhost:5173"),
-		AdminUsername:   getEnvOrDefault("ADMIN_USERNAME", "admin"),
-		AdminPassword:   os.Getenv("ADMIN_PASSWORD"),
-		ReadTimeout:     time.Duration(getEnvIntOrDefault("READ_TIMEOUT", 5)) * time.Second,
-		WriteTimeout:    time.Duration(getEnvIntOrDefault("WRITE_TIMEOUT", 10)) * time.Second,
-		ShutdownTimeout: time.Duration(getEnvIntOrDefault("SHUTDOWN_TIMEOUT", 30)) * time.Second,
-		UseTLS:          getEnvBoolOrDefault("USE_TLS", true),
-		CertFile:        getEnvOrDefault("CERT_FILE", "./tts-server.pem"),
-		KeyFile:         getEnvOrDefault("KEY_FILE", "./tts-server-key.pem"),
+		Port:               getEnvOrDefault("PORT", "8080"),
+		FrontendURL:        getEnvOrDefault("FRONTEND_URL", "http://localhost:5173"),
+		AdminUsername:      getEnvOrDefault("ADMIN_USERNAME", "admin"),
+		AdminPassword:      os.Getenv("ADMIN_PASSWORD"),
+		ReadTimeout:        time.Duration(getEnvIntOrDefault("READ_TIMEOUT", 5)) * time.Second,
+		WriteTimeout:       time.Duration(getEnvIntOrDefault("WRITE_TIMEOUT", 10)) * time.Second,
+		ShutdownTimeout:    time.Duration(getEnvIntOrDefault("SHUTDOWN_TIMEOUT", 30)) * time.Second,
+		UseTLS:             getEnvBoolOrDefault("USE_TLS", true),
+		CertFile:           getEnvOrDefault("CERT_FILE", "./tts-server.pem"),
+		KeyFile:            getEnvOrDefault("KEY_FILE", "./tts-server-key.pem"),
+		ReconnectDelay:     time.Duration(getEnvIntOrDefault("RECONNECT_DELAY_MS", 2000)) * time.Millisecond,
+		ReconnectJitter:    time.Duration(getEnvIntOrDefault("RECONNECT_JITTER_MS", 10000)) * time.Millisecond,
+		CharitySponsor:     os.Getenv("CHARITY_SPONSOR"),
+		CharityMatchRatio:  float32(getEnvFloatOrDefault("CHARITY_MATCH_RATIO", 1)),
+		CharityMatchCap:    float32(getEnvFloatOrDefault("CHARITY_MATCH_CAP", 0)),
+		TickerRetention:    time.Duration(getEnvIntOrDefault("TICKER_RETENTION_MINUTES", 60)) * time.Minute,
+		TickerMaxEntries:   getEnvIntOrDefault("TICKER_MAX_ENTRIES", 50),
+		AnonymousName:      getEnvOrDefault("ANONYMOUS_NAME", "Anonymous"),
+		AnonymousTemplate:  getEnvOrDefault("ANONYMOUS_TEMPLATE", "An anonymous supporter donated {amount}"),
+		DonorNameKey:       os.Getenv("DONOR_NAME_KEY"),
+		ReportSigningKey:   os.Getenv("REPORT_SIGNING_KEY"),
+		MetricsMaxSeries:   getEnvIntOrDefault("METRICS_MAX_SERIES", defaultMetricsMaxSeries),
+		MetricsToken:       getEnvOrDefault("METRICS_TOKEN", ""),
+		MessageTTL:         time.Duration(getEnvIntOrDefault("MESSAGE_TTL_MINUTES", 10)) * time.Minute,
+		OfflineSummaryMin:  getEnvIntOrDefault("OFFLINE_SUMMARY_MIN", 0),
+		RequireAPIKeys:     getEnvBoolOrDefault("REQUIRE_API_KEYS", false),
+		RedisURL:           os.Getenv("REDIS_URL"),
+		RedisChannelPrefix: getEnvOrDefault("REDIS_CHANNEL_PREFIX", "tts"),
+		HandoffTTL:         time.Duration(getEnvIntOrDefault("HANDOFF_TTL_SECONDS", 600)) * time.Second,
+		ModerationEnabled:  getEnvBoolOrDefault("MODERATION_ENABLED", false),
+		EventLog:           getEnvBoolOrDefault("EVENT_LOG_ENABLED", false),
+		CompatCurrency:     getEnvOrDefault("COMPAT_CURRENCY", "USD"),
+		SendBuffer:         getEnvIntOrDefault("CLIENT_SEND_BUFFER", 64),
+		OverflowPolicy:     getEnvOrDefault("CLIENT_OVERFLOW_POLICY", overflowDisconnect),
+		SendDetach:         getEnvOrDefault("SEND_DETACH", detachBroadcast),
+		SigningKeyOverlap:  time.Duration(getEnvIntOrDefault("SIGNING_KEY_OVERLAP_HOURS", 24)) * time.Hour,
+		ResumeLimit:        getEnvIntOrDefault("RESUME_MAX_MESSAGES", 50),
+		TranscriptDir:      os.Getenv("TRANSCRIPT_DIR"),
+		StreamLifecycle:    getEnvBoolOrDefault("STREAM_LIFECYCLE_EVENTS", false),
+		PresenceGrace:      time.Duration(getEnvIntOrDefault("STREAM_LIFECYCLE_GRACE_SECONDS", 30)) * time.Second,
+		AutoMigrate:        getEnvBoolOrDefault("DB_AUTO_MIGRATE", false),
+		StreamDeckBudget:   time.Duration(getEnvIntOrDefault("STREAMDECK_BUDGET_MS", 250)) * time.Millisecond,
+		EmoteProviders:     getEnvListOrDefault("EMOTE_PROVIDERS", nil),
+		MediaShare: MediaShareConfig{
+			Enabled:       getEnvBoolOrDefault("MEDIA_SHARE_ENABLED", false),
+			MinAmount:     getEnvFloatOrDefault("MEDIA_SHARE_MIN_AMOUNT", 0),
+			MaxDuration:   time.Duration(getEnvIntOrDefault("MEDIA_SHARE_MAX_DURATION_SECONDS", 300)) * time.Second,
+			YouTubeAPIKey: os.Getenv("YOUTUBE_API_KEY"),
+		},
+		Audio: AudioConfig{
+			TTS: tts.Config{
+				Provider:           os.Getenv("TTS_PROVIDER"),
+				Voice:              os.Getenv("TTS_VOICE"),
+				Language:           getEnvOrDefault("TTS_LANGUAGE", "en-US"),
+				Rate:               getEnvFloatOrDefault("TTS_RATE", 1),
+				MaxRate:            getEnvFloatOrDefault("TTS_MAX_RATE", 2),
+				TrimSilence:        getEnvBoolOrDefault("TTS_TRIM_SILENCE", true),
+				GoogleAPIKey:       os.Getenv("GOOGLE_TTS_API_KEY"),
+				AWSRegion:          os.Getenv("AWS_REGION"),
+				AWSAccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				AWSSecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				AWSSessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+				PollyEngine:        getEnvOrDefault("POLLY_ENGINE", "neural"),
+			},
+			Delivery:     getEnvOrDefault("TTS_AUDIO_DELIVERY", audioDeliveryURL),
+			TTL:          time.Duration(getEnvIntOrDefault("TTS_AUDIO_TTL_MINUTES", 30)) * time.Minute,
+			SegmentChars: getEnvIntOrDefault("TTS_STREAM_SEGMENT_CHARS", 200),
+			ArchiveDir:   os.Getenv("AUDIO_ARCHIVE_DIR"),
+		},
+		Voices: VoiceConfig{
+			Voices:    getEnvListOrDefault("TTS_VOICES", nil),
+			Tiers:     getEnvListOrDefault("TTS_VOICE_TIERS", nil),
+			Overflow:  getEnvOrDefault("TTS_VOICE_TIER_OVERFLOW", voiceTierReject),
+			Languages: getEnvListOrDefault("TTS_LANGUAGES", nil),
+			MinSpeed:  getEnvFloatOrDefault("VOICE_MIN_SPEED", 0.5),
+			MaxSpeed:  getEnvFloatOrDefault("VOICE_MAX_SPEED", 2),
+		},
+		Log: LogConfig{
+			Level:  getEnvOrDefault("LOG_LEVEL", "info"),
+			Format: getEnvOrDefault("LOG_FORMAT", logFormatText),
+		},
+		Playback: PlaybackConfig{
+			WordsPerMinute: getEnvIntOrDefault("PLAYBACK_WORDS_PER_MINUTE", 150),
+			AlertOverhead:  time.Duration(getEnvIntOrDefault("PLAYBACK_ALERT_SECONDS", 5)) * time.Second,
+			DuckEvents:     getEnvBoolOrDefault("DUCKING_EVENTS", true),
+			DuckRelease:    time.Duration(getEnvIntOrDefault("DUCKING_RELEASE_MS", 500)) * time.Millisecond,
+			SyncDelay:      time.Duration(getEnvIntOrDefault("PLAYBACK_SYNC_DELAY_MS", 0)) * time.Millisecond,
+		},
+		Pacing: PacingConfig{
+			Enabled:    getEnvBoolOrDefault("ALERT_PACING", false),
+			MinGap:     time.Duration(getEnvIntOrDefault("ALERT_PACING_GAP_MS", 2000)) * time.Millisecond,
+			WaitForAck: getEnvBoolOrDefault("ALERT_PACING_WAIT_FOR_ACK", false),
+			MaxWait:    time.Duration(getEnvIntOrDefault("ALERT_PACING_MAX_WAIT_SECONDS", 60)) * time.Second,
+			Priority:   getEnvBoolOrDefault("ALERT_PACING_PRIORITY", false),
+		},
+		Twitch: TwitchConfig{
+			ClientID:      os.Getenv("TWITCH_CLIENT_ID"),
+			AccessToken:   os.Getenv("TWITCH_ACCESS_TOKEN"),
+			BroadcasterID: os.Getenv("TWITCH_BROADCASTER_ID"),
+			ModeratorID:   os.Getenv("TWITCH_MODERATOR_ID"),
+		},
+		Auth: AuthConfig{
+			Listen:       getEnvListOrDefault("AUTH_LISTEN", []string{authAPIKey}),
+			Send:         getEnvListOrDefault("AUTH_SEND", []string{authAPIKey}),
+			Admin:        getEnvListOrDefault("AUTH_ADMIN", []string{authAPIKey, authBasic}),
+			BearerTokens: getEnvListOrDefault("AUTH_BEARER_TOKENS", nil),
+			MTLSClientCA: os.Getenv("AUTH_MTLS_CLIENT_CA"),
+			MTLSSubjects: getEnvListOrDefault("AUTH_MTLS_SUBJECTS", nil),
+			OAuth: OAuthConfig{
+				IntrospectionURL: os.Getenv("OAUTH_INTROSPECTION_URL"),
+				ClientID:         os.Getenv("OAUTH_CLIENT_ID"),
+				ClientSecret:     os.Getenv("OAUTH_CLIENT_SECRET"),
+				ScopePrefix:      os.Getenv("OAUTH_SCOPE_PREFIX"),
+				CacheTTL:         time.Duration(getEnvIntOrDefault("OAUTH_CACHE_SECONDS", 60)) * time.Second,
+			},
+		},
+		WSLimits: frameLimits{
+			MaxFrameBytes: int64(getEnvIntOrDefault("WS_MAX_FRAME_BYTES", 4096)),
+			MaxViolations: getEnvIntOrDefault("WS_MAX_VIOLATIONS", 5),
+		},
+		Usage: UsageConfig{
+			Enabled:       getEnvBoolOrDefault("USAGE_METERING", false),
+			FlushInterval: time.Duration(getEnvIntOrDefault("USAGE_FLUSH_SECONDS", 60)) * time.Second,
+			Hooks:         getEnvListOrDefault("USAGE_HOOKS", nil),
+			Stripe: StripeMeterConfig{
+				APIKey:                os.Getenv("STRIPE_API_KEY"),
+				MessagesMeter:         os.Getenv("STRIPE_METER_MESSAGES"),
+				SynthesisSecondsMeter: os.Getenv("STRIPE_METER_SYNTHESIS_SECONDS"),
+				ListenerMinutesMeter:  os.Getenv("STRIPE_METER_LISTENER_MINUTES"),
+			},
+			WebhookURL:    os.Getenv("USAGE_WEBHOOK_URL"),
+			WebhookSecret: os.Getenv("USAGE_WEBHOOK_SECRET"),
+		},
+		Edge: EdgeConfig{
+			Region:       os.Getenv("EDGE_REGION"),
+			TopologyFile: os.Getenv("EDGE_TOPOLOGY_FILE"),
+		},
+		Streaks: StreakConfig{
+			Interval: time.Duration(getEnvIntOrDefault("STREAK_INTERVAL_SECONDS", 60)) * time.Second,
+		},
+		ResumeCursors: ResumeCursorConfig{
+			Key:    os.Getenv("RESUME_CURSOR_KEY"),
+			MaxAge: time.Duration(getEnvIntOrDefault("RESUME_CURSOR_MAX_AGE_HOURS", 24)) * time.Hour,
+		},
+		Maintenance: MaintenanceConfig{
+			Windows:          getEnvListOrDefault("MAINTENANCE_WINDOWS", nil),
+			BloatWarnPercent: getEnvFloatOrDefault("MAINTENANCE_BLOAT_WARN_PERCENT", 20),
+		},
+		Canary: CanaryConfig{
+			Sampling: getEnvListOrDefault("CANARY_SAMPLING", nil),
+		},
+		Standby: StandbyConfig{
+			Enabled:  getEnvBoolOrDefault("STANDBY", false),
+			LeaseTTL: time.Duration(getEnvIntOrDefault("STANDBY_LEASE_SECONDS", 10)) * time.Second,
+		},
+		Listen: ListenConfig{
+			Addrs:      getEnvListOrDefault("LISTEN_ADDR", []string{":" + getEnvOrDefault("PORT", "8080")}),
+			AdminAddrs: getEnvListOrDefault("ADMIN_LISTEN_ADDR", adminPortAddrs()),
+		},
+		CORS: CORSConfig{
+			PublicOrigins: getEnvListOrDefault("CORS_PUBLIC_ORIGINS", nil),
+			AdminOrigins:  getEnvListOrDefault("CORS_ADMIN_ORIGINS", nil),
+		},
+		Hooks: HookConfig{
+			OnMessage: os.Getenv("HOOK_ON_MESSAGE"),
+			OnPlay:    os.Getenv("HOOK_ON_PLAY"),
+			OnReject:  os.Getenv("HOOK_ON_REJECT"),
+			Timeout:   time.Duration(getEnvIntOrDefault("HOOK_TIMEOUT_MS", 5000)) * time.Millisecond,
+		},
+		Plugins: PluginConfig{
+			Paths:      getEnvListOrDefault("FILTER_PLUGINS", nil),
+			Timeout:    time.Duration(getEnvIntOrDefault("FILTER_PLUGIN_TIMEOUT_MS", 500)) * time.Millisecond,
+			FailAction: os.Getenv("FILTER_PLUGIN_FAIL_ACTION"),
+		},
+		Domains: DomainConfig{
+			Domains:       getEnvListOrDefault("CUSTOM_DOMAINS", nil),
+			AutocertDir:   os.Getenv("AUTOCERT_DIR"),
+			AutocertEmail: os.Getenv("AUTOCERT_EMAIL"),
+		},
+		SMTP: SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     getEnvIntOrDefault("SMTP_PORT", 587),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		},
+		Shipping: ShippingConfig{
+			Endpoint:        os.Getenv("ARCHIVE_S3_ENDPOINT"),
+			Bucket:          os.Getenv("ARCHIVE_S3_BUCKET"),
+			Region:          getEnvOrDefault("ARCHIVE_S3_REGION", "us-east-1"),
+			AccessKeyID:     os.Getenv("ARCHIVE_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("ARCHIVE_S3_SECRET_ACCESS_KEY"),
+			Prefix:          os.Getenv("ARCHIVE_S3_PREFIX"),
+			PathStyle:       getEnvBoolOrDefault("ARCHIVE_S3_PATH_STYLE", true),
+			Interval:        time.Duration(getEnvIntOrDefault("ARCHIVE_SHIP_INTERVAL_MINUTES", 60)) * time.Minute,
+			Retention:       time.Duration(getEnvIntOrDefault("ARCHIVE_S3_RETENTION_DAYS", 0)) * 24 * time.Hour,
+		},
+		Chaos: ChaosConfig{
+			Enabled:              getEnvBoolOrDefault("CHAOS_ENABLED", false),
+			SynthesisFailureRate: getEnvFloatOrDefault("CHAOS_SYNTHESIS_FAILURE_RATE", 0),
+			DBLatencyRate:        getEnvFloatOrDefault("CHAOS_DB_LATENCY_RATE", 0),
+			DBLatency:            time.Duration(getEnvIntOrDefault("CHAOS_DB_LATENCY_MS", 500)) * time.Millisecond,
+			DisconnectRate:       getEnvFloatOrDefault("CHAOS_DISCONNECT_RATE", 0),
+		},
+		RTC: RTCConfig{
+			Enabled:    getEnvBoolOrDefault("WEBRTC_ENABLED", false),
+			ICEServers: getEnvListOrDefault("WEBRTC_ICE_SERVERS", []string{"stun:stun.l.google.com:19302"}),
+		},
+		ContentFilter: ContentFilterConfig{
+			Tiers: map[string]FilterTierConfig{
+				filterTierMild: {
+					Words:        getEnvListOrDefault("CONTENT_FILTER_WORDS", nil),
+					WordlistFile: os.Getenv("CONTENT_FILTER_WORDLIST_FILE"),
+					Action:       getEnvOrDefault("CONTENT_FILTER_ACTION", filterActionMask),
+				},
+				filterTierSevere: {
+					Words:        getEnvListOrDefault("CONTENT_FILTER_SEVERE_WORDS", nil),
+					WordlistFile: os.Getenv("CONTENT_FILTER_SEVERE_WORDLIST_FILE"),
+					Action:       getEnvOrDefault("CONTENT_FILTER_SEVERE_ACTION", filterActionHold),
+				},
+				filterTierSlur: {
+					Words:        getEnvListOrDefault("CONTENT_FILTER_SLUR_WORDS", nil),
+					WordlistFile: os.Getenv("CONTENT_FILTER_SLUR_WORDLIST_FILE"),
+					Action:       getEnvOrDefault("CONTENT_FILTER_SLUR_ACTION", filterActionBan),
+				},
+			},
+			StripURLs:    getEnvBoolOrDefault("CONTENT_FILTER_STRIP_URLS", true),
+			MaxCapsRatio: getEnvFloatOrDefault("CONTENT_FILTER_MAX_CAPS_RATIO", 0),
+			MaxEmoji:     getEnvIntOrDefault("CONTENT_FILTER_MAX_EMOJI", 0),
+		},
+		SendLimits: SendLimits{
+			PerIPRate:        getEnvFloatOrDefault("SEND_RATE_PER_IP", 30),
+			PerIPBurst:       getEnvIntOrDefault("SEND_BURST_PER_IP", 10),
+			PerSessionRate:   getEnvFloatOrDefault("SEND_RATE_PER_SESSION", 6),
+			PerSessionBurst:  getEnvIntOrDefault("SEND_BURST_PER_SESSION", 3),
+			MaxBodyBytes:     int64(getEnvIntOrDefault("SEND_MAX_BODY_BYTES", 16*1024)),
+			MaxMessageLength: getEnvIntOrDefault("SEND_MAX_MESSAGE_LENGTH", 500),
+			MaxNameLength:    getEnvIntOrDefault("SEND_MAX_NAME_LENGTH", 50),
+			MinAmount:        getEnvFloatOrDefault("SEND_MIN_AMOUNT", 0),
+			MaxAmount:        getEnvFloatOrDefault("SEND_MAX_AMOUNT", 100000),
+		},
+		YouTube: YouTubeConfig{
+			APIKey:      os.Getenv("YOUTUBE_API_KEY"),
+			AccessToken: os.Getenv("YOUTUBE_ACCESS_TOKEN"),
+			VideoID:     os.Getenv("YOUTUBE_VIDEO_ID"),
+			LiveChatID:  os.Getenv("YOUTUBE_LIVE_CHAT_ID"),
+			Channel:     getEnvOrDefault("YOUTUBE_CHANNEL", defaultChannel),
+			Memberships: getEnvBoolOrDefault("YOUTUBE_MEMBERSHIPS", true),
+			MinPoll:     time.Duration(getEnvIntOrDefault("YOUTUBE_MIN_POLL_SECONDS", 5)) * time.Second,
+			Rates:       getEnvListOrDefault("YOUTUBE_CURRENCY_RATES", nil),
+		},
+		Crypto: CryptoConfig{
+			LNDURL:           os.Getenv("LND_REST_URL"),
+			LNDMacaroon:      os.Getenv("LND_MACAROON"),
+			LNDCert:          os.Getenv("LND_TLS_CERT"),
+			ETHRPCURL:        os.Getenv("ETH_RPC_URL"),
+			ETHAddress:       os.Getenv("ETH_ADDRESS"),
+			ETHConfirmations: getEnvIntOrDefault("ETH_CONFIRMATIONS", 12),
+			ETHPoll:          time.Duration(getEnvIntOrDefault("ETH_POLL_SECONDS", 15)) * time.Second,
+			Channel:          getEnvOrDefault("CRYPTO_CHANNEL", defaultChannel),
+			PriceURL:         getEnvOrDefault("CRYPTO_PRICE_URL", coingeckoPriceURL),
+		},
+		TikTok: TikTokConfig{
+			URL:        os.Getenv("TIKTOK_WS_URL"),
+			Username:   os.Getenv("TIKTOK_USERNAME"),
+			Channel:    getEnvOrDefault("TIKTOK_CHANNEL", defaultChannel),
+			CoinValue:  getEnvFloatOrDefault("TIKTOK_COIN_VALUE", 0.01),
+			GiftValues: getEnvListOrDefault("TIKTOK_GIFT_VALUES", nil),
+		},
+		Payments: PaymentConfig{
+			StripeWebhookSecret:        os.Getenv("STRIPE_WEBHOOK_SECRET"),
+			StripeTestWebhookSecret:    os.Getenv("STRIPE_TEST_WEBHOOK_SECRET"),
+			KofiVerificationToken:      os.Getenv("KOFI_VERIFICATION_TOKEN"),
+			BMCWebhookSecret:           os.Getenv("BMC_WEBHOOK_SECRET"),
+			OpenCollectiveWebhookToken: os.Getenv("OPEN_COLLECTIVE_WEBHOOK_TOKEN"),
+			GenericWebhooksFile:        os.Getenv("GENERIC_WEBHOOKS_FILE"),
+			PatreonWebhookSecret:       os.Getenv("PATREON_WEBHOOK_SECRET"),
+			PatreonAnnounceRenewals:    getEnvBoolOrDefault("PATREON_ANNOUNCE_RENEWALS", false),
+			GitHubWebhookSecret:        os.Getenv("GITHUB_SPONSORS_WEBHOOK_SECRET"),
+			GitHubTierAmounts:          getEnvListOrDefault("GITHUB_SPONSORS_TIER_AMOUNTS", nil),
+			Enabled:                    providerFlags(),
+		},
+		SelfTest: SelfTestConfig{
+			Interval:         time.Duration(getEnvIntOrDefault("SELFTEST_INTERVAL", 60)) * time.Second,
+			Timeout:          time.Duration(getEnvIntOrDefault("SELFTEST_TIMEOUT", 5)) * time.Second,
+			FailureThreshold: getEnvIntOrDefault("SELFTEST_FAILURE_THRESHOLD", 3),
+			AlertWebhook:     os.Getenv("SELFTEST_ALERT_WEBHOOK"),
+		},
+		Retention: RetentionConfig{
+			MaxAge:        time.Duration(getEnvIntOrDefault("MESSAGE_RETENTION_DAYS", 0)) * 24 * time.Hour,
+			ArchiveDir:    os.Getenv("MESSAGE_ARCHIVE_DIR"),
+			SandboxMaxAge: time.Duration(getEnvIntOrDefault("SANDBOX_RETENTION_HOURS", 24)) * time.Hour,
+		},
+		Simulation: SimulationConfig{
+			Interval: time.Duration(getEnvIntOrDefault("SIMULATION_INTERVAL", 0)) * time.Second,
+			Channel:  getEnvOrDefault("SIMULATION_CHANNEL", defaultChannel),
+		},
 	}
 
 	if config.AdminPassword == "" {
 		return nil, fmt.Errorf("ADMIN_PASSWORD environment variable is required")
 	}
 
-	// Validate TLS configuration
-	if config.UseTLS {
+	if err := configureAnonymity(config); err != nil {
+		return nil, err
+	}
+
+	if config.OverflowPolicy != overflowDrop && config.OverflowPolicy != overflowDisconnect {
+		return nil, fmt.Errorf("CLIENT_OVERFLOW_POLICY must be %q or %q", overflowDrop, overflowDisconnect)
+	}
+	switch config.SendDetach {
+	case detachAccept, detachBroadcast, detachNever:
+	default:
+		return nil, fmt.Errorf("SEND_DETACH must be %q, %q or %q", detachAccept, detachBroadcast, detachNever)
+	}
+	if config.SendBuffer < 1 {
+		return nil, fmt.Errorf("CLIENT_SEND_BUFFER must be at least 1")
+	}
+
+	if config.Audio.Delivery != audioDeliveryURL && config.Audio.Delivery != audioDeliveryBase64 {
+		return nil, fmt.Errorf("TTS_AUDIO_DELIVERY must be %q or %q", audioDeliveryURL, audioDeliveryBase64)
+	}
+	if err := configurePlugins(config.Plugins); err != nil {
+		return nil, fmt.Errorf("invalid filter plugins: %w", err)
+	}
+	if err := configureHooks(config.Hooks); err != nil {
+		return nil, fmt.Errorf("invalid hook scripts: %w", err)
+	}
+	if err := configureCanary(config.Canary); err != nil {
+		return nil, err
+	}
+	// Chaos mode has to be on before newServer sets up the synthesizer to wrap it
+	if err := configureChaos(config.Chaos); err != nil {
+		return nil, err
+	}
+	if err := configureVoices(config.Voices); err != nil {
+		return nil, fmt.Errorf("invalid voice configuration: %w", err)
+	}
+	if !validChannelName(config.Simulation.Channel) {
+		return nil, fmt.Errorf("SIMULATION_CHANNEL is not a valid channel name")
+	}
+	if config.Retention.MaxAge < 0 {
+		return nil, fmt.Errorf("MESSAGE_RETENTION_DAYS must not be negative")
+	}
+	if err := configureEdgeHints(config.Edge); err != nil {
+		return nil, fmt.Errorf("invalid edge configuration: %w", err)
+	}
+	if err := config.Streaks.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.ResumeCursors.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Maintenance.validate(); err != nil {
+		return nil, err
+	}
+	if err := configureProviders(config.Payments); err != nil {
+		return nil, err
+	}
+
+	if config.Standby.LeaseTTL < 3*time.Second {
+		return nil, fmt.Errorf("STANDBY_LEASE_SECONDS must be at least 3")
+	}
+	if err := config.Listen.validate(); err != nil {
+		return nil, err
+	}
+	if err := configureDomains(config.Domains); err != nil {
+		return nil, fmt.Errorf("invalid custom domain configuration: %w", err)
+	}
+
+	// Validate TLS configuration. With autocert, the certificate files are
+	// only for names other than the custom domains and may be left out.
+	if config.UseTLS && certManager != nil {
+		if _, err := os.Stat(config.CertFile); os.IsNotExist(err) {
+			config.CertFile, config.KeyFile = "", ""
+		}
+	}
+	if config.UseTLS && (certManager == nil || config.CertFile != "") {
 		if config.CertFile == "" || config.KeyFile == "" {
 			return nil, fmt.Errorf("CERT_FILE and KEY_FILE environment variables are required when USE_TLS is true")
 		}
@@ -77,26 +598,23 @@ func loadConfig() (*Config, error) {
 	return config, nil
 }
 
-func setupRouter(config *Config) *gin.Engine {
+func (s *Server) setupRouter() *gin.Engine {
+	config := s.config
 	if os.Getenv("GIN_MODE") == "release" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	r := gin.New()
+	r.Use(requestID())
 	r.Use(gin.Recovery())
-	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{
-		SkipPaths: []string{"/ping"},
-	}))
+	r.Use(metricsMiddleware(s.hub.metrics))
+	r.Use(requestLogger("/ping"))
+	r.Use(watchUpgrades(s.hub.metrics))
+	r.Use(pinDomainChannel())
+	r.Use(standbyGuard(s.hub.standby))
 
-	// CORS middleware configuration
-	corsConfig := cors.DefaultConfig()
-	corsConfig.AllowOrigins = []string{config.FrontendURL, "http://localhost:3000"}
-	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
-	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
-	corsConfig.AllowCredentials = true
-	corsConfig.MaxAge = 12 * time.Hour
-
-	r.Use(cors.New(corsConfig))
+	// Public, admin and webhook routes each get their own CORS policy
+	r.Use(corsPolicies(config.CORS, config.FrontendURL))
 
 	// Health check endpoint
 	r.GET("/ping", func(c *gin.Context) {
@@ -107,19 +625,87 @@ func setupRouter(config *Config) *gin.Engine {
 		})
 	})
 
+	// Instance identity for load balancer affinity and debugging
+	r.GET("/_instance", s.instanceHandler)
+	r.GET("/edge-hint", edgeHintHandler)
+	r.GET("/status", s.publicStatusHandler)
+	r.GET("/metrics", s.prometheusHandler)
+	r.GET("/audio/:id", s.audioHandler)
+	r.GET("/voices", voicesHandler)
+	r.GET("/channels/:channel/pricing", s.pricingHandler)
+	r.GET("/channels/:channel/config", s.channelConfigHandler)
+	r.GET("/channels/:channel/donors/:donor/summary", s.donorSummaryHandler)
+	r.GET("/messages/:session_id/status", s.messageStatusHandler)
+	routeProviders(r, s.hub)
+
+	// Public stats for overlays
+	stats := r.Group("/stats")
+	{
+		stats.GET("bidwars/:id", s.bidWarStatsHandler)
+		stats.GET("polls/:id", s.pollStatsHandler)
+		stats.GET("ticker", tickerHandler)
+	}
+
+	s.hub.mediaHosts = config.MediaHosts
+	s.hub.mediaShare = config.MediaShare
+
 	// WebSocket setup
-	go hub.run()
+	s.hub.reconnect = ReconnectPolicy{
+		BaseDelay: config.ReconnectDelay,
+		Jitter:    config.ReconnectJitter,
+	}
+	s.hub.messageTTL = config.MessageTTL
+	s.hub.summaryMin = config.OfflineSummaryMin
+	s.hub.sendBuffer = config.SendBuffer
+	s.hub.overflow = config.OverflowPolicy
+	s.hub.resumeLimit = config.ResumeLimit
+	s.hub.wsLimits = config.WSLimits
+	s.hub.presence.lifecycle = config.StreamLifecycle
+	s.hub.presence.grace = config.PresenceGrace
+	s.hub.pacing = config.Pacing
+	s.hub.syncDelay = config.Playback.SyncDelay
+	s.hub.moderation = config.ModerationEnabled
+	s.hub.sendDetach = config.SendDetach
+	s.hub.currency = config.CompatCurrency
+	s.hub.payments = config.Payments
+	s.hub.smtp = config.SMTP
+	s.hub.rtc = config.RTC
+	s.hub.handoffTTL = config.HandoffTTL
+	s.hub.sendLimits = config.SendLimits
+	s.hub.sessionLimiter = newRateLimiter(config.SendLimits.PerSessionRate, config.SendLimits.PerSessionBurst)
+	ipLimiter := newRateLimiter(config.SendLimits.PerIPRate, config.SendLimits.PerIPBurst)
+	// Previews are limited like sends, in buckets of their own
+	previewLimiter := newRateLimiter(config.SendLimits.PerIPRate, config.SendLimits.PerIPBurst)
+	startSelfTest(config.SelfTest, s.hub)
+	startEmotes(config.EmoteProviders, config.Twitch)
+
+	donationTicker.configure(config.TickerRetention, config.TickerMaxEntries)
 
 	wss := r.Group("/ws")
 	{
-		wss.GET("/listen", listenHandler)
-		wss.POST("/send", sendHandler) // Changed to POST as it's more appropriate for sending messages
+		wss.GET("/listen", s.auth.requireScope(scopeListen), s.listenHandler)
+		wss.GET("/listen/:channel", s.auth.requireScope(scopeListen), s.listenHandler)
+		wss.GET("/ticker", s.auth.requireScope(scopeListen), s.tickerListenHandler)
+		wss.POST("/send", rateLimit(ipLimiter, (*gin.Context).ClientIP), limitBody(config.SendLimits.MaxBodyBytes), s.auth.requireScope(scopeSend), s.sendHandler) // Changed to POST as it's more appropriate for sending messages
+	}
+	// Previews run a message through the checks of /ws/send without sending it
+	r.POST("/preview", rateLimit(previewLimiter, (*gin.Context).ClientIP), limitBody(config.SendLimits.MaxBodyBytes), s.auth.requireScope(scopeSend), s.previewHandler)
+
+	sse := r.Group("/sse")
+	{
+		sse.GET("/listen", s.auth.requireScope(scopeListen), s.sseListenHandler)
+		sse.GET("/listen/:channel", s.auth.requireScope(scopeListen), s.sseListenHandler)
+	}
+
+	// Experimental WebRTC transport; the offer is answered over HTTP
+	rtc := r.Group("/rtc")
+	{
+		rtc.POST("/offer", s.auth.requireScope(scopeListen), s.rtcOfferHandler)
+		rtc.POST("/offer/:channel", s.auth.requireScope(scopeListen), s.rtcOfferHandler)
 	}
 
 	// Authorized group
-	authorized := r.Group("/", gin.BasicAuth(gin.Accounts{
-		config.AdminUsername: config.AdminPassword,
-	}))
+	authorized := r.Group("/", s.auth.requireScope(scopeAdmin))
 
 	authorized.GET("messages", func(c *gin.Context) {
 		user := c.MustGet(gin.AuthUserKey).(string)
@@ -139,55 +725,190 @@ func setupRouter(config *Config) *gin.Engine {
 			return
 		}
 
-		messages := getMessages(fromTime, toTime)
-		c.JSON(http.StatusOK, gin.H{"messages": messages})
+		query := MessageQuery{From: fromTime, To: toTime, Channel: c.Query("channel"), Name: c.Query("name")}
+		switch c.DefaultQuery("sort", "desc") {
+		case "desc":
+		case "asc":
+			query.Ascending = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'sort' parameter, use 'asc' or 'desc'"})
+			return
+		}
+		if query.Limit, err = strconv.Atoi(c.DefaultQuery("limit", "100")); err != nil || query.Limit < 1 || query.Limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'limit' parameter, must be between 1 and 1000"})
+			return
+		}
+		if query.Offset, err = strconv.Atoi(c.DefaultQuery("offset", "0")); err != nil || query.Offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'offset' parameter"})
+			return
+		}
+
+		// One extra row tells whether there is another page
+		limit := query.Limit
+		query.Limit++
+		page := s.store.GetMessages(query)
+		hasMore := len(page) > limit
+		if hasMore {
+			page = page[:limit]
+		}
+
+		messages, err := s.withNotes(page)
+		if err != nil {
+			log.Printf("Error loading notes: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load messages"})
+			return
+		}
+		response := gin.H{"messages": messages, "limit": limit, "offset": query.Offset, "has_more": hasMore}
+		if hasMore {
+			response["next_offset"] = query.Offset + limit
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	authorized.GET("ws/admin", s.moderatorHandler)
+
+	// Stream Deck actions answer within the latency budget and can be retried
+	// safely with an Idempotency-Key
+	deck := authorized.Group("streamdeck", latencyBudget(config.StreamDeckBudget), idempotent())
+	deck.GET("state", s.deckStateHandler)
+	deck.POST("pause", s.deckPauseHandler)
+	deck.POST("resume", s.deckResumeHandler)
+	deck.POST("next", s.deckNextHandler)
+	deck.POST("skip", s.deckSkipHandler)
+	deck.POST("quiet-hours", s.deckQuietHoursHandler)
+	deck.POST("test-alert", s.deckTestAlertHandler)
+
+	admin := authorized.Group("admin")
+
+	admin.GET("status", s.statusHandler)
+	admin.GET("providers", listProvidersHandler)
+	admin.POST("test-alert", s.testAlertHandler)
+	admin.GET("audit", s.listAuditHandler)
+	admin.GET("notifications", s.listNotificationsHandler)
+	admin.POST("notifications/:id/read", s.readNotificationHandler)
+	admin.GET("metrics/summary", s.metricsSummaryHandler)
+
+	admin.GET("queue", s.queueHandler)
+	admin.DELETE("queue", s.clearQueueHandler)
+	admin.GET("missed", s.listMissedHandler)
+	admin.GET("messages/filtered", s.listFilteredHandler)
+	admin.POST("missed/:session_id/requeue", s.requeueMissedHandler)
+
+	admin.POST("messages/bulk", s.bulkModerationHandler)
+	admin.GET("messages/export", s.exportMessagesHandler)
+	admin.GET("audio/export", exportAudioHandler)
+	admin.GET("transcripts/:channel", s.listTranscriptsHandler)
+	admin.GET("transcripts/:channel/:session", s.transcriptHandler)
+	admin.POST("messages/cleanup", s.cleanupMessagesHandler)
+	admin.POST("maintenance", s.runMaintenanceHandler)
+	admin.POST("archive/ship", s.shipArchivesHandler)
+	admin.POST("messages/rebuild", s.rebuildMessagesHandler)
+	admin.GET("receipts/:code", s.lookupReceiptHandler)
+	admin.GET("messages/:session_id/events", s.messageEventsHandler)
+	admin.GET("messages/:session_id/donor", s.revealDonorHandler)
+	admin.GET("messages/:session_id/private-note", s.privateNoteHandler)
+	admin.GET("messages/:session_id/notes", s.listNotesHandler)
+	admin.POST("messages/:session_id/notes", s.addNoteHandler)
+	admin.DELETE("notes/:id", s.deleteNoteHandler)
+	admin.POST("messages/:session_id/refund", s.refundHandler)
+	admin.POST("messages/:session_id/replay", s.replayMessageHandler)
+	admin.DELETE("messages/:session_id", s.redactMessageHandler)
+	admin.GET("reports/:period", s.reportHandler)
+
+	admin.GET("charity", s.getCharityHandler)
+	admin.PUT("charity", s.putCharityHandler)
+
+	admin.GET("bidwars", s.listBidWarsHandler)
+	admin.POST("bidwars", s.createBidWarHandler)
+	admin.POST("bidwars/:id/close", s.closeBidWarHandler)
+
+	admin.GET("polls", s.listPollsHandler)
+	admin.POST("polls", s.createPollHandler)
+	admin.POST("polls/:id/close", s.closePollHandler)
+
+	admin.GET("wheel/rules", listWheelRulesHandler)
+	admin.PUT("wheel/rules/:name", s.putWheelRuleHandler)
+	admin.DELETE("wheel/rules/:name", s.deleteWheelRuleHandler)
+	admin.GET("wheel/spins", s.listWheelSpinsHandler)
+
+	admin.GET("channels", s.listChannelsHandler)
+	admin.GET("channels/:channel/settings", s.getChannelSettingsHandler)
+	admin.PUT("channels/:channel/settings", s.putChannelSettingsHandler)
+	admin.GET("settings/schema", settingsSchemaHandler)
+	admin.POST("channels/:channel/sandbox/impersonate", s.impersonateSandboxHandler)
+	admin.DELETE("channels/:channel/sandbox", s.purgeSandboxHandler)
+
+	admin.GET("keys", s.listAPIKeysHandler)
+	admin.POST("keys", s.createAPIKeyHandler)
+	admin.DELETE("keys/:id", s.revokeAPIKeyHandler)
+	admin.GET("keys/signing", s.listSigningKeysHandler)
+	admin.POST("keys/signing", s.rotateSigningKeyHandler)
+	admin.DELETE("keys/signing/:id", s.revokeSigningKeyHandler)
+	admin.GET("webhooks", s.listWebhooksHandler)
+	admin.POST("webhooks", s.createWebhookHandler)
+	admin.DELETE("webhooks/:id", s.deleteWebhookHandler)
+	admin.GET("webhooks/:id/deliveries", s.listWebhookDeliveriesHandler)
+	admin.POST("commands", s.commandHandler)
+	admin.GET("media", s.listMediaRequestsHandler)
+	admin.POST("media/:id/approve", s.decideMediaRequestHandler(statusApproved))
+	admin.POST("media/:id/reject", s.decideMediaRequestHandler(statusRejected))
+	admin.GET("pending", s.listPendingHandler)
+	admin.POST("pending/:id/approve", s.approvePendingHandler)
+	admin.POST("pending/:id/reject", s.rejectPendingHandler)
+	admin.GET("listeners", s.listenersHandler)
+	admin.GET("diagnostics/ws", wsDiagnosticsHandler)
+	admin.GET("usage", s.usageHandler)
+	// Disconnect every listener; overlays are told not to reconnect automatically
+	admin.POST("listeners/kick", func(c *gin.Context) {
+		user := c.MustGet(gin.AuthUserKey).(string)
+		count := s.hub.closeAll(CloseKickedByAdmin)
+		log.Printf("User %s kicked %d listeners", user, count)
+		c.JSON(http.StatusOK, gin.H{"kicked": count})
 	})
 
 	return r
 }
 
 func main() {
+	// Subcommands run against the database and exit
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "migrate":
+			err = runMigrateCommand(os.Args[2:])
+		case "export-config", "import-config":
+			err = runBundleCommand(os.Args[1], os.Args[2:])
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+		if err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	// Load configuration
 	config, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
-
-	// Initialize database
-	if err := initDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	if err := configureLogging(config.Log, os.Stderr); err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
 	}
-	defer dbPool.Close()
-
-	// Setup router
-	router := setupRouter(config)
 
-	// Create HTTP server
-	srv := &http.Server{
-		Addr:         ":" + config.Port,
-		Handler:      router,
-		ReadTimeout:  config.ReadTimeout,
-		WriteTimeout: config.WriteTimeout,
+	server, err := newServer(config)
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
 	}
 
 	// Start server in a goroutine
 	go func() {
-		log.Printf("Server starting on port %s", config.Port)
-		var err error
-
-		if config.UseTLS {
-			log.Printf("TLS enabled with certificate: %s and key: %s", config.CertFile, config.KeyFile)
-			err = srv.ListenAndServeTLS(config.CertFile, config.KeyFile)
-		} else {
-			err = srv.ListenAndServe()
-		}
-
-		if err != nil && err != http.ErrServerClosed {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Failed to start server: %v", err)
 		}
 	}()
 
-	// Wait for interrupt signal to gracefully shutdown the ser0ver
+	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
@@ -197,14 +918,10 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
 	defer cancel()
 
-	// Attempt graceful shutdown
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := server.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
-	// Close database connection
-	closeDB()
-
 	log.Println("Server exiting")
 }
 
@@ -225,6 +942,15 @@ func getEnvIntOrDefault(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvFloatOrDefault(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvBoolOrDefault(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
@@ -233,3 +959,17 @@ func getEnvBoolOrDefault(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+func getEnvListOrDefault(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
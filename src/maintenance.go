@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceCheckInterval is how often the scheduler looks for a window
+// that has opened
+const maintenanceCheckInterval = time.Minute
+
+// maintenanceTables are the message tables maintenance analyzes and reports
+// on. SQLite only has the first.
+var maintenanceTables = []string{"tts_messages", "tts_message_events", "pending_messages"}
+
+var errMaintenanceRunning = errors.New("maintenance is already running")
+
+// MaintenanceConfig schedules database maintenance: vacuuming and analyzing
+// the message tables, and reporting invalid indexes and bloat
+type MaintenanceConfig struct {
+	// Windows are the low-traffic times of day maintenance runs in, in UTC,
+	// like "03:00-05:00". A window can wrap past midnight. Maintenance runs
+	// once each time a window opens; with no windows it only runs when asked.
+	Windows []string
+	// BloatWarnPercent is the share of a table's rows that can be dead, or of
+	// the SQLite file that can be free pages, before admins are notified
+	BloatWarnPercent float64
+}
+
+// maintenanceWindow is a daily window, as offsets from midnight UTC
+type maintenanceWindow struct {
+	start, end time.Duration
+}
+
+// parseMaintenanceWindows reads "HH:MM-HH:MM" windows
+func parseMaintenanceWindows(specs []string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, spec := range specs {
+		from, to, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid maintenance window %q, use HH:MM-HH:MM", spec)
+		}
+		start, err := time.Parse("15:04", strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q, use HH:MM-HH:MM", spec)
+		}
+		end, err := time.Parse("15:04", strings.TrimSpace(to))
+		if err != nil || end.Equal(start) {
+			return nil, fmt.Errorf("invalid maintenance window %q, use HH:MM-HH:MM", spec)
+		}
+		windows = append(windows, maintenanceWindow{
+			start: time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+			end:   time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute,
+		})
+	}
+	return windows, nil
+}
+
+func (c MaintenanceConfig) validate() error {
+	if _, err := parseMaintenanceWindows(c.Windows); err != nil {
+		return fmt.Errorf("MAINTENANCE_WINDOWS: %w", err)
+	}
+	if c.BloatWarnPercent <= 0 || c.BloatWarnPercent > 100 {
+		return fmt.Errorf("MAINTENANCE_BLOAT_WARN_PERCENT must be between 0 and 100")
+	}
+	return nil
+}
+
+// opened is when the window now falls in opened, or the zero time when now
+// falls in none of them
+func (w maintenanceWindow) opened(now time.Time) time.Time {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	offset := now.Sub(midnight)
+	switch {
+	case w.start < w.end && offset >= w.start && offset < w.end:
+		return midnight.Add(w.start)
+	case w.start > w.end && offset >= w.start:
+		return midnight.Add(w.start)
+	case w.start > w.end && offset < w.end:
+		// It opened yesterday and wraps past midnight
+		return midnight.Add(w.start - 24*time.Hour)
+	}
+	return time.Time{}
+}
+
+// TableHealth is what maintenance found out about one table
+type TableHealth struct {
+	Table    string `json:"table"`
+	Rows     int64  `json:"rows"`
+	DeadRows int64  `json:"dead_rows"`
+	// SizeBytes includes the table's indexes, or with SQLite is the size of
+	// the whole database file
+	SizeBytes int64 `json:"size_bytes"`
+	// BloatPercent is the share of rows that are dead, or with SQLite the
+	// share of the database file that is free pages
+	BloatPercent float64 `json:"bloat_percent"`
+}
+
+// MaintenanceReport is the outcome of a maintenance run, as the admin status
+// endpoint shows the last one
+type MaintenanceReport struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration_seconds"`
+	// Scheduled is false for runs an admin asked for
+	Scheduled bool          `json:"scheduled"`
+	Tables    []TableHealth `json:"tables"`
+	// Problems are invalid indexes and integrity check failures
+	Problems []string `json:"problems,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type maintenanceScheduler struct {
+	config MaintenanceConfig
+	// running is held for the length of a run
+	running sync.Mutex
+	mutex   sync.Mutex
+	last    *MaintenanceReport
+}
+
+var maintenance = &maintenanceScheduler{}
+
+// startMaintenance runs maintenance each time one of the windows opens. Only
+// the primary runs it, so standbys sharing the database leave it alone.
+func startMaintenance(config MaintenanceConfig, hub *Hub) {
+	windows, _ := parseMaintenanceWindows(config.Windows)
+	maintenance.config = config
+	if len(windows) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(maintenanceCheckInterval)
+		defer ticker.Stop()
+		var lastOpened time.Time
+		for {
+			now := clock.Now()
+			for _, window := range windows {
+				if hub.standby.active() {
+					// A primary that stepped down leaves it to the new one
+					break
+				}
+				if opened := window.opened(now); !opened.IsZero() && opened.After(lastOpened) {
+					lastOpened = opened
+					if _, err := maintenance.run(context.Background(), hub, true); err != nil && !errors.Is(err, errMaintenanceRunning) {
+						log.Printf("Error running database maintenance: %v", err)
+					}
+					break
+				}
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Running database maintenance in windows %s UTC", strings.Join(config.Windows, ", "))
+}
+
+// run maintains the message tables of the hub's store, keeps the report for
+// the status endpoint and notifies admins of problems and bloat
+func (m *maintenanceScheduler) run(ctx context.Context, hub *Hub, scheduled bool) (MaintenanceReport, error) {
+	if !m.running.TryLock() {
+		return MaintenanceReport{}, errMaintenanceRunning
+	}
+	defer m.running.Unlock()
+
+	report := MaintenanceReport{StartedAt: clock.Now(), Scheduled: scheduled}
+	started := time.Now()
+	tables, problems, err := hub.store.MaintainTables(ctx, m.config.BloatWarnPercent)
+	report.Duration = time.Since(started).Seconds()
+	report.Tables, report.Problems = tables, problems
+	if err != nil {
+		report.Error = err.Error()
+	}
+	m.mutex.Lock()
+	m.last = &report
+	m.mutex.Unlock()
+	if err != nil {
+		return report, err
+	}
+
+	var bloated []string
+	for _, table := range tables {
+		if table.BloatPercent >= m.config.BloatWarnPercent {
+			bloated = append(bloated, fmt.Sprintf("%s (%.0f%%)", table.Table, table.BloatPercent))
+		}
+	}
+	if len(problems) > 0 || len(bloated) > 0 {
+		text := fmt.Sprintf("Database maintenance found %d problems", len(problems))
+		if len(bloated) > 0 {
+			text += " and bloat in " + strings.Join(bloated, ", ")
+		}
+		hub.db.notifyAdmins("db.maintenance", text, report)
+	}
+	log.Printf("Database maintenance took %.1fs: %d tables, %d problems", report.Duration, len(tables), len(problems))
+	return report, nil
+}
+
+// lastReport is the latest run's report, or nil before the first
+func (m *maintenanceScheduler) lastReport() *MaintenanceReport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.last
+}
+
+// runMaintenanceHandler runs maintenance now instead of waiting for the next
+// window
+func (s *Server) runMaintenanceHandler(c *gin.Context) {
+	report, err := maintenance.run(c.Request.Context(), s.hub, false)
+	if errors.Is(err, errMaintenanceRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Maintenance is already running"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error running database maintenance: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run database maintenance", "report": report})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.db.recordAudit("db.maintenance", user, "", gin.H{"problems": len(report.Problems)})
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventMediaPlay tells overlays to play an approved media-share request
+const EventMediaPlay = "media_play"
+
+// statusPending marks a media request waiting for a moderator
+const statusPending = "pending"
+
+const (
+	youtubeVideosURL = "https://www.googleapis.com/youtube/v3/videos"
+	youtubeOEmbedURL = "https://www.youtube.com/oembed"
+)
+
+var (
+	youtubeHosts   = []string{"youtube.com", "www.youtube.com", "m.youtube.com", "youtu.be"}
+	youtubeIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+	isoDuration    = regexp.MustCompile(`^P(?:(\d+)D)?T?(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?$`)
+)
+
+// MediaShareConfig controls which media links donors may attach
+type MediaShareConfig struct {
+	Enabled       bool
+	MinAmount     float64
+	MaxDuration   time.Duration
+	YouTubeAPIKey string
+}
+
+// MediaRequest is a donor's media link awaiting, or past, moderation
+type MediaRequest struct {
+	ID              int64      `json:"id"`
+	SessionID       string     `json:"session_id"`
+	Name            string     `json:"name"`
+	Amount          float32    `json:"amount"`
+	URL             string     `json:"url"`
+	VideoID         string     `json:"video_id"`
+	Title           string     `json:"title"`
+	Author          string     `json:"author"`
+	DurationSeconds int        `json:"duration_seconds"`
+	Status          string     `json:"status"`
+	Reason          string     `json:"reason,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	DecidedBy       string     `json:"decided_by,omitempty"`
+	DecidedAt       *time.Time `json:"decided_at,omitempty"`
+}
+
+// MediaPlay is the data of a media_play event
+type MediaPlay struct {
+	ID              int64   `json:"id"`
+	URL             string  `json:"url"`
+	VideoID         string  `json:"video_id"`
+	Title           string  `json:"title"`
+	DurationSeconds int     `json:"duration_seconds"`
+	Name            string  `json:"name"`
+	Amount          float32 `json:"amount"`
+}
+
+// youtubeVideoID extracts the video ID from the common YouTube link forms
+func youtubeVideoID(raw string) (string, bool) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+
+	isYouTube := false
+	for _, host := range youtubeHosts {
+		if strings.EqualFold(parsed.Hostname(), host) {
+			isYouTube = true
+		}
+	}
+	if !isYouTube {
+		return "", false
+	}
+
+	var id string
+	path := strings.Trim(parsed.Path, "/")
+	switch {
+	case strings.EqualFold(parsed.Hostname(), "youtu.be"):
+		id = path
+	case path == "watch":
+		id = parsed.Query().Get("v")
+	case strings.HasPrefix(path, "shorts/"), strings.HasPrefix(path, "embed/"), strings.HasPrefix(path, "live/"):
+		id = path[strings.Index(path, "/")+1:]
+	}
+	return id, youtubeIDRegex.MatchString(id)
+}
+
+func parseISODuration(value string) (int, bool) {
+	parts := isoDuration.FindStringSubmatch(value)
+	if parts == nil {
+		return 0, false
+	}
+	seconds := 0
+	for i, unit := range []int{86400, 3600, 60, 1} {
+		if parts[i+1] != "" {
+			n, _ := strconv.Atoi(parts[i+1])
+			seconds += n * unit
+		}
+	}
+	return seconds, true
+}
+
+// fetchVideoMetadata fills in title, author and duration. Without an API key only
+// oEmbed is available, which doesn't report duration or embeddability.
+func fetchVideoMetadata(hub *Hub, ctx context.Context, request *MediaRequest) (embeddable bool, err error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if hub.mediaShare.YouTubeAPIKey == "" {
+		params := url.Values{"url": {request.URL}, "format": {"json"}}
+		var oembed struct {
+			Title      string `json:"title"`
+			AuthorName string `json:"author_name"`
+		}
+		if err := getJSON(ctx, client, youtubeOEmbedURL+"?"+params.Encode(), &oembed); err != nil {
+			return false, err
+		}
+		request.Title = oembed.Title
+		request.Author = oembed.AuthorName
+		return true, nil
+	}
+
+	params := url.Values{
+		"part": {"snippet,contentDetails,status"},
+		"id":   {request.VideoID},
+		"key":  {hub.mediaShare.YouTubeAPIKey},
+	}
+	var videos struct {
+		Items []struct {
+			Snippet struct {
+				Title        string `json:"title"`
+				ChannelTitle string `json:"channelTitle"`
+			} `json:"snippet"`
+			ContentDetails struct {
+				Duration string `json:"duration"`
+			} `json:"contentDetails"`
+			Status struct {
+				Embeddable bool `json:"embeddable"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := getJSON(ctx, client, youtubeVideosURL+"?"+params.Encode(), &videos); err != nil {
+		return false, err
+	}
+	if len(videos.Items) == 0 {
+		return false, fmt.Errorf("video not found")
+	}
+
+	video := videos.Items[0]
+	request.Title = video.Snippet.Title
+	request.Author = video.Snippet.ChannelTitle
+	request.DurationSeconds, _ = parseISODuration(video.ContentDetails.Duration)
+	return video.Status.Embeddable, nil
+}
+
+// getJSON fetches endpoint and decodes its JSON body into out
+func getJSON(ctx context.Context, client *http.Client, endpoint string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// submitMediaRequest checks a donor's media link against policy and stores it
+// for moderation. Links that fail policy are stored as rejected with a reason.
+func submitMediaRequest(hub *Hub, msg Message, link string) {
+	request := &MediaRequest{
+		SessionID: msg.SessionID,
+		Name:      msg.Name,
+		Amount:    msg.Amount,
+		URL:       link,
+		Status:    statusPending,
+	}
+
+	reject := func(reason string) {
+		request.Status = statusRejected
+		request.Reason = reason
+	}
+
+	videoID, ok := youtubeVideoID(link)
+	switch {
+	case !allowedMediaURL(hub, link) || !ok:
+		reject("unsupported media link")
+	case float64(msg.Amount) < hub.mediaShare.MinAmount:
+		reject("donation below media share minimum")
+	default:
+		request.VideoID = videoID
+
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		embeddable, err := fetchVideoMetadata(hub, ctx, request)
+		cancel()
+
+		switch {
+		case err != nil:
+			log.Printf("Error fetching metadata for %s: %v", link, err)
+			reject("video metadata unavailable")
+		case !embeddable:
+			reject("video cannot be embedded")
+		case hub.mediaShare.MaxDuration > 0 && time.Duration(request.DurationSeconds)*time.Second > hub.mediaShare.MaxDuration:
+			reject("video is too long")
+		}
+	}
+
+	if err := hub.db.addMediaRequest(request); err != nil {
+		log.Printf("Error storing media request for %s: %v", msg.SessionID, err)
+		return
+	}
+
+	if request.Status == statusPending {
+		hub.db.notifyAdmins("media.pending", fmt.Sprintf("%s requested %q", request.Name, request.Title), request)
+	}
+}
+
+func (s *Server) listMediaRequestsHandler(c *gin.Context) {
+	status := c.DefaultQuery("status", statusPending)
+	if status == "all" {
+		status = ""
+	}
+
+	requests, err := s.db.getMediaRequests(status)
+	if err != nil {
+		log.Printf("Error listing media requests: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list media requests"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": requests})
+}
+
+// decideMediaRequestHandler approves or rejects a pending request. Approval
+// sends the media to the overlays.
+func (s *Server) decideMediaRequestHandler(status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet(gin.AuthUserKey).(string)
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media request ID"})
+			return
+		}
+
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if c.Request.ContentLength > 0 {
+			if err := c.ShouldBindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		request, err := s.db.decideMediaRequest(id, status, body.Reason, user)
+		if err != nil {
+			log.Printf("Error deciding media request %d: %v", id, err)
+			c.JSON(http.StatusConflict, gin.H{"error": "Media request is not pending"})
+			return
+		}
+
+		if status == statusApproved {
+			s.hub.publishEvent("", EventMediaPlay, MediaPlay{
+				ID:              request.ID,
+				URL:             request.URL,
+				VideoID:         request.VideoID,
+				Title:           request.Title,
+				DurationSeconds: request.DurationSeconds,
+				Name:            request.Name,
+				Amount:          request.Amount,
+			})
+		}
+		s.db.recordAudit("media."+status, user, request.SessionID, request)
+
+		c.JSON(http.StatusOK, request)
+	}
+}
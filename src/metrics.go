@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Label values used when a metric doesn't name a channel or synthesis engine
+const (
+	engineBrowser = "browser"
+	labelOverflow = "other"
+)
+
+// Metric names
+const (
+	metricMessagesReceived  = "tts_messages_received_total"
+	metricMessagesBroadcast = "tts_messages_broadcast_total"
+	metricEventsPublished   = "tts_events_published_total"
+	metricBroadcastSeconds  = "tts_broadcast_seconds"
+	metricListenerOverflows = "tts_listener_overflows_total"
+	metricListeners         = "tts_listeners"
+	metricSynthesisQueue    = "tts_synthesis_in_flight"
+	metricDBQuerySeconds    = "tts_db_query_seconds"
+	metricDBErrors          = "tts_db_errors_total"
+	metricHTTPRequests      = "tts_http_requests_total"
+	metricHTTPSeconds       = "tts_http_request_seconds"
+	metricFilterHits        = "tts_filter_hits_total"
+	metricPluginFailures    = "tts_filter_plugin_failures_total"
+	metricCanaryBroadcasts  = "tts_canary_broadcasts_total"
+
+	metricListenerWriteSeconds   = "tts_listener_write_seconds"
+	metricListenerQueueOccupancy = "tts_listener_queue_occupancy"
+
+	metricListenerViolations = "tts_listener_violations_total"
+	metricWSUpgrades         = "tts_ws_upgrades_total"
+)
+
+// defaultMetricsMaxSeries is METRICS_MAX_SERIES when it isn't set
+const defaultMetricsMaxSeries = 100
+
+// latencyBuckets are the histogram upper bounds, in seconds, for every observation
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricLabels is the fixed label set every metric carries
+type MetricLabels struct {
+	Channel string `json:"channel"`
+	Engine  string `json:"engine"`
+	Kind    string `json:"kind"`
+}
+
+// CounterSample is one labelled counter value in the summary
+type CounterSample struct {
+	Labels MetricLabels `json:"labels"`
+	Value  float64      `json:"value"`
+}
+
+// ObservationSample summarizes one labelled series of observations
+type ObservationSample struct {
+	Labels MetricLabels `json:"labels"`
+	Count  uint64       `json:"count"`
+	Sum    float64      `json:"sum"`
+	Min    float64      `json:"min"`
+	Max    float64      `json:"max"`
+	Avg    float64      `json:"avg"`
+}
+
+// GaugeSample is one labelled gauge value in the summary
+type GaugeSample struct {
+	Labels MetricLabels `json:"labels"`
+	Value  float64      `json:"value"`
+}
+
+type observation struct {
+	count uint64
+	sum   float64
+	min   float64
+	max   float64
+	// buckets counts the observations at or below each of latencyBuckets
+	buckets []uint64
+}
+
+// metricsRegistry keeps counters and observations in memory. To keep
+// cardinality bounded, each metric accepts at most maxSeries label sets;
+// anything beyond that is folded into an "other" series.
+type metricsRegistry struct {
+	mutex        sync.Mutex
+	maxSeries    int
+	counters     map[string]map[MetricLabels]float64
+	gauges       map[string]map[MetricLabels]float64
+	observations map[string]map[MetricLabels]*observation
+	// token guards /metrics when set
+	token string
+}
+
+func newMetricsRegistry(maxSeries int, token string) *metricsRegistry {
+	return &metricsRegistry{
+		maxSeries:    maxSeries,
+		counters:     make(map[string]map[MetricLabels]float64),
+		gauges:       make(map[string]map[MetricLabels]float64),
+		observations: make(map[string]map[MetricLabels]*observation),
+		token:        token,
+	}
+}
+
+// withDefaults fills in label values that weren't provided
+func (l MetricLabels) withDefaults() MetricLabels {
+	if l.Channel == "" {
+		l.Channel = defaultChannel
+	}
+	if l.Engine == "" {
+		l.Engine = engineBrowser
+	}
+	if l.Kind == "" {
+		l.Kind = "donation"
+	}
+	return l
+}
+
+var overflowLabels = MetricLabels{Channel: labelOverflow, Engine: labelOverflow, Kind: labelOverflow}
+
+// inc adds delta to a labelled counter
+func (m *metricsRegistry) inc(name string, labels MetricLabels, delta float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[MetricLabels]float64)
+		m.counters[name] = series
+	}
+
+	key := labels.withDefaults()
+	if _, exists := series[key]; !exists && len(series) >= m.maxSeries {
+		key = overflowLabels
+	}
+	series[key] += delta
+}
+
+// add moves a labelled gauge by delta. Gauges only move by deltas so a series
+// folded into "other" still returns to zero.
+func (m *metricsRegistry) add(name string, labels MetricLabels, delta float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	series, ok := m.gauges[name]
+	if !ok {
+		series = make(map[MetricLabels]float64)
+		m.gauges[name] = series
+	}
+
+	key := labels.withDefaults()
+	if _, exists := series[key]; !exists && len(series) >= m.maxSeries {
+		key = overflowLabels
+	}
+	series[key] += delta
+}
+
+// observe records a sample (e.g. a latency in seconds) for a labelled series
+func (m *metricsRegistry) observe(name string, labels MetricLabels, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	series, ok := m.observations[name]
+	if !ok {
+		series = make(map[MetricLabels]*observation)
+		m.observations[name] = series
+	}
+
+	key := labels.withDefaults()
+	if _, exists := series[key]; !exists && len(series) >= m.maxSeries {
+		key = overflowLabels
+	}
+
+	obs, ok := series[key]
+	if !ok {
+		obs = &observation{min: value, max: value, buckets: make([]uint64, len(latencyBuckets))}
+		series[key] = obs
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			obs.buckets[i]++
+		}
+	}
+	obs.count++
+	obs.sum += value
+	if value < obs.min {
+		obs.min = value
+	}
+	if value > obs.max {
+		obs.max = value
+	}
+}
+
+// summary returns a JSON-friendly snapshot of every metric
+func (m *metricsRegistry) summary() (map[string][]CounterSample, map[string][]GaugeSample, map[string][]ObservationSample) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counters := make(map[string][]CounterSample, len(m.counters))
+	for name, series := range m.counters {
+		samples := make([]CounterSample, 0, len(series))
+		for labels, value := range series {
+			samples = append(samples, CounterSample{Labels: labels, Value: value})
+		}
+		sort.Slice(samples, func(i, j int) bool { return labelsLess(samples[i].Labels, samples[j].Labels) })
+		counters[name] = samples
+	}
+
+	gauges := make(map[string][]GaugeSample, len(m.gauges))
+	for name, series := range m.gauges {
+		samples := make([]GaugeSample, 0, len(series))
+		for labels, value := range series {
+			samples = append(samples, GaugeSample{Labels: labels, Value: value})
+		}
+		sort.Slice(samples, func(i, j int) bool { return labelsLess(samples[i].Labels, samples[j].Labels) })
+		gauges[name] = samples
+	}
+
+	observations := make(map[string][]ObservationSample, len(m.observations))
+	for name, series := range m.observations {
+		samples := make([]ObservationSample, 0, len(series))
+		for labels, obs := range series {
+			samples = append(samples, ObservationSample{
+				Labels: labels,
+				Count:  obs.count,
+				Sum:    obs.sum,
+				Min:    obs.min,
+				Max:    obs.max,
+				Avg:    obs.sum / float64(obs.count),
+			})
+		}
+		sort.Slice(samples, func(i, j int) bool { return labelsLess(samples[i].Labels, samples[j].Labels) })
+		observations[name] = samples
+	}
+
+	return counters, gauges, observations
+}
+
+func labelsLess(a, b MetricLabels) bool {
+	if a.Channel != b.Channel {
+		return a.Channel < b.Channel
+	}
+	if a.Engine != b.Engine {
+		return a.Engine < b.Engine
+	}
+	return a.Kind < b.Kind
+}
+
+// metricsSummaryHandler serves metrics as JSON for dashboards that can't scrape Prometheus
+func (s *Server) metricsSummaryHandler(c *gin.Context) {
+	counters, gauges, observations := s.hub.metrics.summary()
+	c.JSON(http.StatusOK, gin.H{
+		"counters":     counters,
+		"gauges":       gauges,
+		"observations": observations,
+	})
+}
+
+// writePrometheus renders every metric in the Prometheus text exposition
+// format. Observations are exposed as histograms over latencyBuckets.
+func (m *metricsRegistry) writePrometheus(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, name := range sortedNames(m.counters) {
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		for _, labels := range sortedLabels(m.counters[name]) {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, promLabels(labels, ""), promValue(m.counters[name][labels]))
+		}
+	}
+
+	for _, name := range sortedNames(m.gauges) {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, labels := range sortedLabels(m.gauges[name]) {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, promLabels(labels, ""), promValue(m.gauges[name][labels]))
+		}
+	}
+
+	for _, name := range sortedNames(m.observations) {
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, labels := range sortedLabels(m.observations[name]) {
+			obs := m.observations[name][labels]
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, promLabels(labels, promValue(bound)), obs.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, promLabels(labels, "+Inf"), obs.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", name, promLabels(labels, ""), promValue(obs.sum))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, promLabels(labels, ""), obs.count)
+		}
+	}
+}
+
+func sortedNames[V any](series map[string]V) []string {
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedLabels[V any](series map[MetricLabels]V) []MetricLabels {
+	labels := make([]MetricLabels, 0, len(series))
+	for l := range series {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labelsLess(labels[i], labels[j]) })
+	return labels
+}
+
+// promLabels formats a label set, adding le for histogram buckets when given
+func promLabels(l MetricLabels, le string) string {
+	text := fmt.Sprintf(`channel="%s",engine="%s",kind="%s"`, promEscape(l.Channel), promEscape(l.Engine), promEscape(l.Kind))
+	if le != "" {
+		text += `,le="` + le + `"`
+	}
+	return text
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promEscape(value string) string {
+	return promEscaper.Replace(value)
+}
+
+func promValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// prometheusHandler serves /metrics for Prometheus to scrape. With
+// METRICS_TOKEN set, scrapers must send it as a bearer token.
+func (s *Server) prometheusHandler(c *gin.Context) {
+	metrics := s.hub.metrics
+	metrics.mutex.Lock()
+	token := metrics.token
+	metrics.mutex.Unlock()
+
+	if token != "" {
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid metrics token"})
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	metrics.writePrometheus(c.Writer)
+}
+
+// metricsMiddleware counts requests and their latency in metrics per route, with the
+// route in kind and the response status in engine. Requests that match no
+// route share one series so probes for random paths don't add any.
+func metricsMiddleware(metrics *metricsRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		route = c.Request.Method + " " + route
+		metrics.inc(metricHTTPRequests, MetricLabels{Engine: strconv.Itoa(c.Writer.Status()), Kind: route}, 1)
+		metrics.observe(metricHTTPSeconds, MetricLabels{Engine: "http", Kind: route}, time.Since(started).Seconds())
+	}
+}
+
+// timedPool records the latency and failures of every query on the Postgres
+// pool in metrics
+type timedPool struct {
+	*pgxpool.Pool
+	metrics *metricsRegistry
+}
+
+func (p timedPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	chaos.delayQuery(ctx)
+	started := time.Now()
+	tag, err := p.Pool.Exec(ctx, sql, args...)
+	p.observe(ctx, "exec", started, err)
+	return tag, err
+}
+
+func (p timedPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	chaos.delayQuery(ctx)
+	started := time.Now()
+	rows, err := p.Pool.Query(ctx, sql, args...)
+	p.observe(ctx, "query", started, err)
+	return rows, err
+}
+
+// QueryRow is timed up to the first result; errors only surface on Scan and aren't counted
+func (p timedPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	chaos.delayQuery(ctx)
+	started := time.Now()
+	row := p.Pool.QueryRow(ctx, sql, args...)
+	p.observe(ctx, "query_row", started, nil)
+	return row
+}
+
+// observe records a database call's duration, and logs it at debug level
+// with the ID of the request it was made for
+func (p timedPool) observe(ctx context.Context, operation string, started time.Time, err error) {
+	labels := MetricLabels{Engine: driverPostgres, Kind: operation}
+	elapsed := time.Since(started)
+	p.metrics.observe(metricDBQuerySeconds, labels, elapsed.Seconds())
+	if err != nil {
+		p.metrics.inc(metricDBErrors, labels, 1)
+		slog.DebugContext(ctx, "Database call failed", "operation", operation, "duration", elapsed, "error", err)
+		return
+	}
+	slog.DebugContext(ctx, "Database call", "operation", operation, "duration", elapsed)
+}
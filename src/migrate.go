@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/joho/godotenv"
+)
+
+// migrationFiles holds the schema migrations, named <version>_<name>.sql.
+// Migrations are applied in version order and never edited once released;
+// schema changes ship as a new file.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock that keeps instances starting together
+// from migrating at the same time
+const migrationLockID = 72417
+
+const createMigrationsTableQuery = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)
+`
+
+// Migration is one embedded schema change
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	sql       string
+}
+
+// loadMigrations reads the embedded migrations, sorted by version
+func loadMigrations() ([]*Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	migrations := []*Migration{}
+	seen := map[int]string{}
+	for _, entry := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		if other, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, entry.Name(), version)
+		}
+		seen[version] = entry.Name()
+
+		sql, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+		migrations = append(migrations, &Migration{Version: version, Name: name, sql: string(sql)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// migrationStatus returns every embedded migration with when it was applied
+func (s *postgresStore) migrationStatus(ctx context.Context) ([]*Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.pool.Exec(ctx, createMigrationsTableQuery); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	rows, err := s.pool.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, migration := range migrations {
+		if at, ok := applied[migration.Version]; ok {
+			migration.AppliedAt = &at
+		}
+	}
+	return migrations, nil
+}
+
+// runMigrations applies every migration that hasn't been applied yet, each in
+// its own transaction, and returns how many ran
+func (s *postgresStore) runMigrations(ctx context.Context) (int, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return 0, fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	// Read the status only once the lock is held, so migrations another
+	// instance just applied aren't run again
+	migrations, err := s.migrationStatus(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, migration := range migrations {
+		if migration.AppliedAt != nil {
+			continue
+		}
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, migration.sql); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+			return err
+		})
+		if err != nil {
+			return applied, fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+		applied++
+	}
+	return applied, nil
+}
+
+// connectCommandDB loads .env and connects to the database for a subcommand
+func connectCommandDB() (*postgresStore, error) {
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found, using defaults")
+	}
+	// Nothing serves what a subcommand's queries record
+	db, err := connectPostgres(newMetricsRegistry(defaultMetricsMaxSeries, ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	return db, nil
+}
+
+// runMigrateCommand handles `migrate` (apply pending migrations),
+// `migrate status`, `migrate verify` and `migrate backfill [currency]`
+func runMigrateCommand(args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	valid := len(args) <= 1 && (command == "up" || command == "status" || command == "verify")
+	if command == "backfill" && len(args) <= 2 {
+		valid = true
+	}
+	if !valid {
+		return fmt.Errorf("usage: migrate [up|status|verify|backfill [currency]]")
+	}
+	db, err := connectCommandDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	switch command {
+	case "verify":
+		problems, err := db.verifyMessages(ctx)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d problems", len(problems))
+		}
+		log.Printf("Message table verified")
+		return nil
+	case "backfill":
+		currency := ""
+		if len(args) == 2 {
+			currency = strings.ToUpper(args[1])
+		}
+		// Backfilling a large table can take a while
+		backfillCtx, cancel := context.WithTimeout(context.Background(), 2*time.Hour)
+		defer cancel()
+		updated, err := db.backfillMessages(backfillCtx, currency)
+		if err != nil {
+			return err
+		}
+		log.Printf("Backfilled %d messages", updated)
+		return nil
+	}
+
+	if command == "status" {
+		migrations, err := db.migrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			state := "pending"
+			if migration.AppliedAt != nil {
+				state = "applied " + migration.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", migration.Version, migration.Name, state)
+		}
+		return nil
+	}
+
+	db.logLegacySchema(ctx)
+	applied, err := db.runMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Database is up to date (%d migrations applied)", applied)
+	db.logVerification(ctx)
+	return nil
+}
@@ -0,0 +1,9 @@
+-- The original message log, as deployed before migrations existed
+CREATE TABLE IF NOT EXISTS tts_messages (
+    session_id  TEXT NOT NULL,
+    name        TEXT NOT NULL,
+    amount      REAL NOT NULL,
+    message     TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,10 @@
+-- Columns added to tts_messages since the first release. Tables created by
+-- hand from an older README may already have some of them.
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY;
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS anonymous BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS name_encrypted BYTEA;
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'broadcast';
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS status_token TEXT UNIQUE;
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS played_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS tts_messages_channel_id_idx ON tts_messages (channel, id);
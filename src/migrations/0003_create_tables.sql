@@ -0,0 +1,167 @@
+-- Every other table the server uses
+
+CREATE TABLE IF NOT EXISTS channel_settings (
+    channel    TEXT PRIMARY KEY,
+    settings   JSONB NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    version    INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS message_notes (
+    id         BIGSERIAL PRIMARY KEY,
+    session_id TEXT NOT NULL,
+    author     TEXT NOT NULL,
+    note       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS refunds (
+    session_id TEXT NOT NULL,
+    amount     REAL NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id         BIGSERIAL PRIMARY KEY,
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    subject    TEXT NOT NULL,
+    details    JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS admin_notifications (
+    id         BIGSERIAL PRIMARY KEY,
+    kind       TEXT NOT NULL,
+    message    TEXT NOT NULL,
+    details    JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    read_at    TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS charity_matches (
+    sponsor    TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    amount     REAL NOT NULL,
+    matched    REAL NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS bid_wars (
+    id         BIGSERIAL PRIMARY KEY,
+    title      TEXT NOT NULL,
+    options    JSONB NOT NULL,
+    open       BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    closed_at  TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS bid_war_bids (
+    bid_war_id BIGINT NOT NULL REFERENCES bid_wars (id),
+    option_key TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    amount     REAL NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS polls (
+    id         BIGSERIAL PRIMARY KEY,
+    title      TEXT NOT NULL,
+    choices    JSONB NOT NULL,
+    open       BOOLEAN NOT NULL DEFAULT TRUE,
+    closes_at  TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    closed_at  TIMESTAMPTZ,
+    winner     TEXT
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+    poll_id    BIGINT NOT NULL REFERENCES polls (id),
+    choice_key TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    amount     REAL NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS wheel_rules (
+    name       TEXT PRIMARY KEY,
+    min_amount REAL NOT NULL,
+    rewards    JSONB NOT NULL,
+    enabled    BOOLEAN NOT NULL DEFAULT TRUE,
+    version    INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS wheel_spins (
+    rule       TEXT NOT NULL,
+    session_id TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    amount     REAL NOT NULL,
+    seed       TEXT NOT NULL,
+    roll       BIGINT NOT NULL,
+    reward     TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           BIGSERIAL PRIMARY KEY,
+    name         TEXT NOT NULL,
+    key_hash     TEXT NOT NULL UNIQUE,
+    prefix       TEXT NOT NULL,
+    scopes       TEXT[] NOT NULL,
+    channel      TEXT,
+    expires_at   TIMESTAMPTZ,
+    created_by   TEXT NOT NULL,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    revoked_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id         BIGSERIAL PRIMARY KEY,
+    prefix     TEXT NOT NULL,
+    secret     BYTEA NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    retires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS media_requests (
+    id               BIGSERIAL PRIMARY KEY,
+    session_id       TEXT NOT NULL,
+    name             TEXT NOT NULL,
+    amount           REAL NOT NULL,
+    url              TEXT NOT NULL,
+    video_id         TEXT NOT NULL,
+    title            TEXT NOT NULL,
+    author           TEXT NOT NULL,
+    duration_seconds INTEGER NOT NULL DEFAULT 0,
+    status           TEXT NOT NULL DEFAULT 'pending',
+    reason           TEXT,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    decided_by       TEXT,
+    decided_at       TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS media_requests_status_idx ON media_requests (status, created_at);
+
+CREATE TABLE IF NOT EXISTS pending_messages (
+    id             BIGSERIAL PRIMARY KEY,
+    session_id     TEXT NOT NULL,
+    channel        TEXT NOT NULL DEFAULT 'default',
+    payload        JSONB NOT NULL,
+    name_encrypted BYTEA,
+    status_token   TEXT UNIQUE,
+    status         TEXT NOT NULL DEFAULT 'pending',
+    reason         TEXT,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    decided_by     TEXT,
+    decided_at     TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS pending_messages_status_idx ON pending_messages (status, channel, id);
+
+-- Optimistic concurrency versions, for tables created before they existed
+ALTER TABLE channel_settings ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE wheel_rules ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- Content filter results, kept so moderators can review filtered and blocked messages
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS filtered BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS original_message TEXT;
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS filter_reasons TEXT[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS tts_messages_filtered_idx ON tts_messages (created_at) WHERE filtered;
@@ -0,0 +1,5 @@
+-- One message per session ID, so a retried send can never be stored twice.
+-- Earlier duplicates keep their first row.
+DELETE FROM tts_messages a USING tts_messages b
+WHERE a.session_id = b.session_id AND a.id > b.id;
+CREATE UNIQUE INDEX IF NOT EXISTS tts_messages_session_id_key ON tts_messages (session_id);
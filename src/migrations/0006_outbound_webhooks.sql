@@ -0,0 +1,26 @@
+-- Outbound webhooks and a log of every delivery attempt made to them
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id         BIGSERIAL PRIMARY KEY,
+    url        TEXT NOT NULL,
+    events     TEXT[] NOT NULL,
+    channel    TEXT,
+    secret     BYTEA NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    deleted_at TIMESTAMPTZ
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id          BIGSERIAL PRIMARY KEY,
+    webhook_id  BIGINT NOT NULL REFERENCES webhooks (id),
+    delivery_id TEXT NOT NULL,
+    event       TEXT NOT NULL,
+    attempt     INTEGER NOT NULL,
+    status_code INTEGER,
+    error       TEXT NOT NULL DEFAULT '',
+    duration_ms BIGINT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, created_at DESC);
@@ -0,0 +1,2 @@
+-- Retention deletes messages by age, oldest first
+CREATE INDEX IF NOT EXISTS tts_messages_created_idx ON tts_messages (created_at);
@@ -0,0 +1,33 @@
+-- Append-only log of what happened to each message, from which the message
+-- views can be rebuilt
+
+CREATE TABLE IF NOT EXISTS tts_message_events (
+    id         BIGSERIAL PRIMARY KEY,
+    session_id TEXT NOT NULL DEFAULT '',
+    message_id BIGINT,
+    channel    TEXT NOT NULL,
+    type       TEXT NOT NULL,
+    data       JSONB,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tts_message_events_session_idx ON tts_message_events (session_id, id);
+CREATE INDEX IF NOT EXISTS tts_message_events_message_idx ON tts_message_events (message_id, id);
+CREATE INDEX IF NOT EXISTS tts_message_events_created_idx ON tts_message_events (created_at);
+
+-- Events are never changed once written, except that their data is erased
+-- when retention or a sandbox purge deletes their message, or it is redacted
+CREATE OR REPLACE FUNCTION tts_message_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND NEW.data IS NULL
+        AND (NEW.id, NEW.session_id, NEW.message_id, NEW.channel, NEW.type, NEW.created_at)
+            IS NOT DISTINCT FROM (OLD.id, OLD.session_id, OLD.message_id, OLD.channel, OLD.type, OLD.created_at) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'tts_message_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tts_message_events_append_only ON tts_message_events;
+CREATE TRIGGER tts_message_events_append_only BEFORE UPDATE OR DELETE ON tts_message_events
+    FOR EACH ROW EXECUTE FUNCTION tts_message_events_append_only();
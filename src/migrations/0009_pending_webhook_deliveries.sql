@@ -0,0 +1,11 @@
+-- Webhook deliveries left unfinished at shutdown, resumed by the next start
+
+CREATE TABLE IF NOT EXISTS webhook_pending_deliveries (
+    id          BIGSERIAL PRIMARY KEY,
+    webhook_id  BIGINT NOT NULL REFERENCES webhooks (id),
+    delivery_id TEXT NOT NULL,
+    event       TEXT NOT NULL,
+    body        BYTEA NOT NULL,
+    attempt     INTEGER NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
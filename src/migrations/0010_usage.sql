@@ -0,0 +1,13 @@
+-- Metered usage per channel and hour, for hosted deployments that bill for it
+
+CREATE TABLE IF NOT EXISTS usage_records (
+    channel           TEXT NOT NULL,
+    period_start      TIMESTAMPTZ NOT NULL,
+    messages          BIGINT NOT NULL DEFAULT 0,
+    synthesis_seconds DOUBLE PRECISION NOT NULL DEFAULT 0,
+    listener_minutes  BIGINT NOT NULL DEFAULT 0,
+    updated_at        TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (channel, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS usage_records_period_idx ON usage_records (period_start);
@@ -0,0 +1,6 @@
+-- What kind of message each row is, in which currency, and where it came
+-- from. Rows from before these columns existed are filled in by
+-- `migrate backfill`.
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT '';
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'donation';
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+-- Donor summaries look donors up by channel and name, ignoring case
+CREATE INDEX IF NOT EXISTS tts_messages_donor_idx ON tts_messages (channel, LOWER(name)) WHERE NOT anonymous;
@@ -0,0 +1,4 @@
+-- Private notes donors encrypt for the streamer. The server only ever sees
+-- the ciphertext, so these columns hold nothing it could read.
+ALTER TABLE tts_messages ADD COLUMN IF NOT EXISTS private_note TEXT;
+ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS private_note TEXT;
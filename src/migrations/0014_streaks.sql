@@ -0,0 +1,25 @@
+-- Streams, kept running by every instance with the channel's overlays until
+-- none has seen them for the grace period, and each donor's run of
+-- consecutive streams with a donation, for recognition events
+
+CREATE TABLE IF NOT EXISTS tts_streams (
+    channel      TEXT NOT NULL,
+    started_at   TIMESTAMPTZ NOT NULL,
+    stopped_at   TIMESTAMPTZ,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (channel, started_at)
+);
+
+-- At most one stream runs on a channel at a time
+CREATE UNIQUE INDEX IF NOT EXISTS tts_streams_running_idx ON tts_streams (channel) WHERE stopped_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS donor_streaks (
+    channel        TEXT NOT NULL,
+    donor          TEXT NOT NULL, -- the donor's name, lower-cased
+    name           TEXT NOT NULL,
+    streak         INTEGER NOT NULL,
+    best_streak    INTEGER NOT NULL,
+    streams        INTEGER NOT NULL,
+    last_stream_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (channel, donor)
+);
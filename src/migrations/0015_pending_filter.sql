@@ -0,0 +1,7 @@
+-- Held messages keep the content filter's results and the payment provider,
+-- which the JSON payload leaves out, so approving them stores and thanks them
+-- like messages that were never held
+ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS filtered BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS original_message TEXT;
+ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS filter_reasons TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE pending_messages ADD COLUMN IF NOT EXISTS provider TEXT;
@@ -0,0 +1,22 @@
+-- Each channel's running total of what the sponsor has matched there, updated
+-- in place only while it stays within the cap, so the cap holds however many
+-- instances match donations
+ALTER TABLE charity_matches ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT 'default';
+
+UPDATE charity_matches m
+SET channel = t.channel
+FROM tts_messages t
+WHERE t.session_id = m.session_id;
+
+CREATE TABLE IF NOT EXISTS charity_totals (
+    sponsor TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    matched REAL NOT NULL DEFAULT 0,
+    PRIMARY KEY (sponsor, channel)
+);
+
+INSERT INTO charity_totals (sponsor, channel, matched)
+SELECT sponsor, channel, SUM(matched)
+FROM charity_matches
+GROUP BY sponsor, channel
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stored playback states of a message
+const (
+	statusBroadcast = "broadcast"
+	statusMissed    = "missed"
+	statusRedacted  = "redacted"
+)
+
+// listMissedHandler shows alerts that expired in the playback queue without being played
+func (s *Server) listMissedHandler(c *gin.Context) {
+	from := c.DefaultQuery("from", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
+	fromTime, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+
+	messages, err := s.db.getMessagesByStatus(statusMissed, fromTime)
+	if err != nil {
+		log.Printf("Error listing missed alerts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list missed alerts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
+
+// requeueMissedHandler puts a missed alert back into the playback queue
+func (s *Server) requeueMissedHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	msg, err := s.db.getMessageBySession(sessionID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if msg.Status != statusMissed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message is not in the missed state"})
+		return
+	}
+
+	if err := s.db.setMessageStatus(sessionID, statusBroadcast); err != nil {
+		log.Printf("Error requeueing session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue message"})
+		return
+	}
+
+	// Audio isn't stored, so synthesize it again for server-side TTS
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	synthesizeMessage(ctx, s.hub, msg)
+	cancel()
+
+	msg.Replay = true
+	s.hub.dispatch(*msg)
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.db.recordAudit("message.requeued", user, sessionID, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "Message requeued"})
+}
+
+// replayMessageHandler re-sends a stored message through the hub, e.g. when the
+// streamer missed an alert and wants to honor it on air
+func (s *Server) replayMessageHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	msg, err := s.db.getMessageBySession(sessionID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	if msg.Status == statusRedacted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message has been redacted"})
+		return
+	}
+
+	// Audio isn't stored, so synthesize it again for server-side TTS
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	synthesizeMessage(ctx, s.hub, msg)
+	cancel()
+
+	msg.Replay = true
+	s.hub.dispatch(*msg)
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s replayed message for session %s", user, sessionID)
+	s.db.recordAudit("message.replayed", user, sessionID, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "Message replayed"})
+}
+
+// redactMessageHandler removes a stored message's text and donor, e.g. when a
+// donor asks for it to be deleted. The row stays so totals and reports still
+// add up, but it no longer appears in the history and can't be replayed.
+func (s *Server) redactMessageHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	found, err := s.store.RedactMessage(sessionID)
+	if err != nil {
+		log.Printf("Error redacting message for session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redact message"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s redacted message for session %s", user, sessionID)
+	s.db.recordAudit("message.redacted", user, sessionID, nil)
+	c.JSON(http.StatusOK, gin.H{"status": "Message redacted"})
+}
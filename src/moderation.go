@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Moderation states applied to stored messages
+const (
+	statusApproved = "approved"
+	statusRejected = "rejected"
+	statusHidden   = "hidden"
+)
+
+// bulkActions maps a bulk moderation action to the status it sets
+var bulkActions = map[string]string{
+	"approve": statusApproved,
+	"reject":  statusRejected,
+	"hide":    statusHidden,
+}
+
+// MessageFilter selects stored messages for bulk operations
+type MessageFilter struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Name    string    `json:"name"`
+	Keyword string    `json:"keyword"`
+	Channel string    `json:"channel"`
+}
+
+// BulkModerationRequest is the body of POST /admin/messages/bulk
+type BulkModerationRequest struct {
+	Action string        `json:"action"`
+	Filter MessageFilter `json:"filter"`
+	DryRun bool          `json:"dry_run"`
+}
+
+// bulkModerationHandler applies one moderation action to every message matching a filter.
+// With dry_run the matching messages are returned without changing anything.
+func (s *Server) bulkModerationHandler(c *gin.Context) {
+	var req BulkModerationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	status, ok := bulkActions[req.Action]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Action must be approve, reject or hide"})
+		return
+	}
+
+	// A filter without bounds would touch the whole table; require a time range
+	if req.Filter.From.IsZero() || req.Filter.To.IsZero() || req.Filter.To.Before(req.Filter.From) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid 'from' and 'to' range is required"})
+		return
+	}
+
+	if req.DryRun {
+		matches, err := s.db.findMessages(req.Filter)
+		if err != nil {
+			log.Printf("Error previewing bulk %s: %v", req.Action, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to preview bulk action"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"dry_run": true, "action": req.Action, "count": len(matches), "messages": matches})
+		return
+	}
+
+	count, err := s.db.setStatusByFilter(req.Filter, status)
+	if err != nil {
+		log.Printf("Error applying bulk %s: %v", req.Action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply bulk action"})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s applied bulk %s to %d messages", user, req.Action, count)
+	s.db.recordAudit("message.bulk_"+req.Action, user, "", gin.H{"filter": req.Filter, "count": count})
+	c.JSON(http.StatusOK, gin.H{"dry_run": false, "action": req.Action, "count": count})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// moderatorProtocol is the WebSocket subprotocol spoken on /ws/admin. See PROTOCOL.md.
+const moderatorProtocol = "tts-moderator.v1"
+
+// EventSkip tells overlays to stop the alert that is currently playing
+const EventSkip = "skip"
+
+var moderatorUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{moderatorProtocol},
+	CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") == os.Getenv("FRONTEND_URL")
+	},
+}
+
+// ModeratorCommand is a request frame from a moderator client. ID is echoed
+// back in the response so clients can match them up.
+type ModeratorCommand struct {
+	ID      string          `json:"id"`
+	Command string          `json:"command"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// ModeratorFrame is sent to moderator clients: responses to commands, and the
+// live feed of messages and events
+type ModeratorFrame struct {
+	Type   string          `json:"type"`
+	ID     string          `json:"id,omitempty"`
+	OK     *bool           `json:"ok,omitempty"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+type moderatorParams struct {
+	SessionID string `json:"session_id"`
+	Channel   string `json:"channel"`
+	Name      string `json:"name"`
+	PendingID int64  `json:"pending_id"`
+	Reason    string `json:"reason"`
+}
+
+// moderatorCommands maps command names to their implementations
+var moderatorCommands = map[string]func(hub *Hub, user string, params moderatorParams) (interface{}, error){
+	"approve": approveCommand,
+	"reject":  rejectCommand,
+	"skip":    skipCommand,
+	"ban":     banCommand,
+}
+
+// approveCommand releases a message from the moderation queue, or marks a
+// stored message as approved
+func approveCommand(hub *Hub, user string, params moderatorParams) (interface{}, error) {
+	if params.PendingID != 0 {
+		pending, result, err := approvePending(hub, params.PendingID, user)
+		if err != nil {
+			log.Printf("Error approving pending message %d: %v", params.PendingID, err)
+			return nil, fmt.Errorf("message is not pending")
+		}
+		return gin.H{"pending": pending, "delivery": result}, nil
+	}
+	if params.SessionID == "" {
+		return nil, fmt.Errorf("session_id or pending_id is required")
+	}
+	if _, err := hub.db.getMessageBySession(params.SessionID); err != nil {
+		return nil, fmt.Errorf("message not found")
+	}
+	if err := hub.db.setMessageStatus(params.SessionID, statusApproved); err != nil {
+		log.Printf("Error approving session %s: %v", params.SessionID, err)
+		return nil, fmt.Errorf("failed to approve message")
+	}
+	hub.db.recordAudit("message.approved", user, params.SessionID, nil)
+	return gin.H{"session_id": params.SessionID, "status": statusApproved}, nil
+}
+
+// rejectCommand drops a message from the moderation queue
+func rejectCommand(hub *Hub, user string, params moderatorParams) (interface{}, error) {
+	if params.PendingID == 0 {
+		return nil, fmt.Errorf("pending_id is required")
+	}
+	pending, err := rejectPending(hub, params.PendingID, params.Reason, user)
+	if err != nil {
+		log.Printf("Error rejecting pending message %d: %v", params.PendingID, err)
+		return nil, fmt.Errorf("message is not pending")
+	}
+	return pending, nil
+}
+
+// skipCommand tells a channel's overlays to cut the current alert short
+func skipCommand(hub *Hub, user string, params moderatorParams) (interface{}, error) {
+	channel := params.Channel
+	if channel == "" {
+		channel = defaultChannel
+	}
+	if !validChannelName(channel) {
+		return nil, fmt.Errorf("invalid channel name")
+	}
+
+	skip := gin.H{"channel": channel, "session_id": params.SessionID, "skipped_by": user}
+	hub.publishEvent(channel, EventSkip, skip)
+	hub.db.recordAudit("message.skipped", user, params.SessionID, skip)
+	return skip, nil
+}
+
+// banCommand adds a donor name to a channel's banned names
+func banCommand(hub *Hub, user string, params moderatorParams) (interface{}, error) {
+	name := strings.TrimSpace(params.Name)
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	channel := params.Channel
+	if channel == "" {
+		channel = defaultChannel
+	}
+	if !validChannelName(channel) {
+		return nil, fmt.Errorf("invalid channel name")
+	}
+
+	settings, err := hub.db.getChannelSettings(channel)
+	if err != nil {
+		log.Printf("Error loading settings for channel %s: %v", channel, err)
+		return nil, fmt.Errorf("failed to load channel settings")
+	}
+	if _, banned := matchBannedName(name, settings.BannedNames); !banned {
+		settings.BannedNames = append(settings.BannedNames, name)
+		if err := hub.db.saveChannelSettings(settings, settings.Version); err != nil {
+			log.Printf("Error saving settings for channel %s: %v", channel, err)
+			return nil, fmt.Errorf("failed to save channel settings")
+		}
+		hub.invalidateChannelSettings(channel)
+	}
+
+	hub.db.recordAudit("donor.banned", user, name, gin.H{"channel": channel})
+	return gin.H{"channel": channel, "banned_names": settings.BannedNames}, nil
+}
+
+// moderatorHandler serves the moderator subprotocol: a live feed plus commands over one socket
+func (s *Server) moderatorHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	if !containsString(websocket.Subprotocols(c.Request), moderatorProtocol) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subprotocol " + moderatorProtocol + " is required"})
+		return
+	}
+
+	ws, err := s.upgradeWebSocket(c, &moderatorUpgrader)
+	if err != nil {
+		log.Printf("Error upgrading moderator connection: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	feed := s.hub.addModerator(64)
+	defer s.hub.removeModerator(feed)
+
+	// All writes go through this goroutine; gorilla connections allow one writer at a time
+	outbound := make(chan ModeratorFrame, 16)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ping := time.NewTicker(30 * time.Second)
+		defer ping.Stop()
+		for {
+			var frame interface{}
+			select {
+			case <-done:
+				return
+			case <-ping.C:
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					return
+				}
+				continue
+			case f := <-outbound:
+				frame = f
+			case f := <-feed:
+				frame = f
+			}
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := ws.WriteJSON(frame); err != nil {
+				log.Printf("Error writing to moderator %s: %v", user, err)
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	log.Printf("Moderator %s connected", user)
+	for {
+		var cmd ModeratorCommand
+		if err := ws.ReadJSON(&cmd); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Error reading moderator frame: %v", err)
+			}
+			return
+		}
+
+		response := ModeratorFrame{Type: "response", ID: cmd.ID}
+		result, err := runModeratorCommand(s.hub, user, cmd)
+		ok := err == nil
+		response.OK = &ok
+		if err != nil {
+			response.Error = err.Error()
+		} else {
+			response.Result = result
+		}
+
+		select {
+		case outbound <- response:
+		case <-time.After(5 * time.Second):
+			log.Printf("Dropping response to moderator %s: writer is stalled", user)
+		}
+	}
+}
+
+func runModeratorCommand(hub *Hub, user string, cmd ModeratorCommand) (interface{}, error) {
+	run, ok := moderatorCommands[cmd.Command]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", cmd.Command)
+	}
+
+	var params moderatorParams
+	if len(cmd.Params) > 0 {
+		if err := json.Unmarshal(cmd.Params, &params); err != nil {
+			return nil, fmt.Errorf("invalid params: %v", err)
+		}
+	}
+	return run(hub, user, params)
+}
+
+// addModerator registers a moderator feed for broadcast messages and events
+func (hub *Hub) addModerator(buffer int) chan ModeratorFrame {
+	feed := make(chan ModeratorFrame, buffer)
+	hub.mutex.Lock()
+	hub.moderators[feed] = true
+	hub.mutex.Unlock()
+	return feed
+}
+
+func (hub *Hub) removeModerator(feed chan ModeratorFrame) {
+	hub.mutex.Lock()
+	delete(hub.moderators, feed)
+	hub.mutex.Unlock()
+}
+
+// notifyModerators copies a frame to every moderator feed, dropping it for
+// moderators that have fallen behind. Must be called with the mutex held.
+func (hub *Hub) notifyModerators(frameType string, payload []byte) {
+	frame := ModeratorFrame{Type: frameType, Data: payload}
+	for feed := range hub.moderators {
+		select {
+		case feed <- frame:
+		default:
+		}
+	}
+}
+
+func containsString(values []string, target string) bool {
+	for _, value := range values {
+		if value == target {
+			return true
+		}
+	}
+	return false
+}
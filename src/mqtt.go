@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+)
+
+// publishMQTT connects to an MQTT 3.1.1 broker, publishes one QoS 0 message
+// and disconnects. Alerts are rare enough that a connection per alert is
+// cheaper than keeping one open. broker is mqtt://[user:pass@]host[:port],
+// or mqtts:// for TLS.
+func publishMQTT(ctx context.Context, broker string, topic string, payload []byte) error {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT broker: %w", err)
+	}
+
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	switch u.Scheme {
+	case "mqtt":
+		conn, err = dialer.DialContext(ctx, "tcp", hostWithPort(u, "1883"))
+	case "mqtts":
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", hostWithPort(u, "8883"))
+	default:
+		return fmt.Errorf("unsupported MQTT scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	id := make([]byte, 6)
+	rand.Read(id)
+
+	// CONNECT with a clean session
+	var flags byte = 0x02
+	body := append(mqttString("MQTT"), 4, 0, 0, 30)
+	body = append(body, mqttString("tts-server-"+hex.EncodeToString(id))...)
+	if u.User != nil {
+		flags |= 0x80
+		body = append(body, mqttString(u.User.Username())...)
+		if password, ok := u.User.Password(); ok {
+			flags |= 0x40
+			body = append(body, mqttString(password)...)
+		}
+	}
+	body[7] = flags
+	if _, err := conn.Write(mqttPacket(0x10, body)); err != nil {
+		return fmt.Errorf("failed to send MQTT connect: %w", err)
+	}
+
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		return fmt.Errorf("failed to read MQTT connack: %w", err)
+	}
+	if connack[0] != 0x20 {
+		return errors.New("unexpected reply to MQTT connect")
+	}
+	if connack[3] != 0 {
+		return fmt.Errorf("MQTT broker refused the connection (code %d)", connack[3])
+	}
+
+	publish := append(mqttString(topic), payload...)
+	if _, err := conn.Write(mqttPacket(0x30, publish)); err != nil {
+		return fmt.Errorf("failed to publish to MQTT: %w", err)
+	}
+	conn.Write([]byte{0xE0, 0})
+	return nil
+}
+
+// mqttPacket frames a control packet with its variable-length remaining length
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttString is a length-prefixed UTF-8 string
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func hostWithPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxNoteLength bounds moderator notes so they stay short coordination messages
+const maxNoteLength = 2000
+
+// MessageNote is a moderator's note attached to a stored message
+type MessageNote struct {
+	ID        int64     `json:"id"`
+	SessionID string    `json:"session_id"`
+	Author    string    `json:"author"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AdminMessage is a message as shown in admin listings, with its moderator notes
+type AdminMessage struct {
+	Message
+	Notes []MessageNote `json:"notes"`
+}
+
+// withNotes attaches the notes of each message for admin listings
+func (s *Server) withNotes(messages []Message) ([]AdminMessage, error) {
+	sessionIDs := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		sessionIDs = append(sessionIDs, msg.SessionID)
+	}
+
+	// Notes need Postgres; under SQLite messages are listed without them
+	notes, err := s.db.getNotesForSessions(sessionIDs)
+	if err != nil && !errors.Is(err, errPostgresRequired) {
+		return nil, err
+	}
+
+	result := make([]AdminMessage, 0, len(messages))
+	for _, msg := range messages {
+		entry := AdminMessage{Message: msg, Notes: notes[msg.SessionID]}
+		if entry.Notes == nil {
+			entry.Notes = []MessageNote{}
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+func (s *Server) listNotesHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	notes, err := s.db.getNotesForSessions([]string{sessionID})
+	if err != nil {
+		log.Printf("Error listing notes for session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list notes"})
+		return
+	}
+
+	list := notes[sessionID]
+	if list == nil {
+		list = []MessageNote{}
+	}
+	c.JSON(http.StatusOK, gin.H{"notes": list})
+}
+
+func (s *Server) addNoteHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	var req struct {
+		Note string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	req.Note = strings.TrimSpace(req.Note)
+	if req.Note == "" || len(req.Note) > maxNoteLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Note must be between 1 and 2000 characters"})
+		return
+	}
+
+	exists, err := s.store.CheckSessionID(c.Request.Context(), sessionID)
+	if err != nil {
+		log.Printf("Error checking session ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session ID"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	note, err := s.db.addNote(sessionID, user, req.Note)
+	if err != nil {
+		log.Printf("Error adding note to session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add note"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, note)
+}
+
+func (s *Server) deleteNoteHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid note ID"})
+		return
+	}
+
+	if err := s.db.deleteNote(id); err != nil {
+		log.Printf("Error deleting note %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete note"})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.db.recordAudit("note.deleted", user, strconv.FormatInt(id, 10), nil)
+	c.Status(http.StatusNoContent)
+}
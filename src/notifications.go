@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notification is an alert for admins, shown until it is marked read
+type Notification struct {
+	ID        int64       `json:"id"`
+	Kind      string      `json:"kind"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details"`
+	CreatedAt time.Time   `json:"created_at"`
+	ReadAt    *time.Time  `json:"read_at,omitempty"`
+}
+
+// notifyAdmins stores a notification for the admin dashboard
+func (s *postgresStore) notifyAdmins(kind string, message string, details interface{}) {
+	if err := s.addNotification(kind, message, details); err != nil && !errors.Is(err, errPostgresRequired) {
+		log.Printf("Error storing %s notification: %v", kind, err)
+	}
+}
+
+func (s *Server) listNotificationsHandler(c *gin.Context) {
+	unread := c.Query("unread") == "true"
+
+	notifications, err := s.db.getNotifications(unread)
+	if err != nil {
+		log.Printf("Error listing notifications: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list notifications"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"notifications": notifications})
+}
+
+func (s *Server) readNotificationHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+
+	if err := s.db.markNotificationRead(id); err != nil {
+		log.Printf("Error marking notification %d read: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type openCollectiveWebhook struct {
+	Type string `json:"type"`
+	Data struct {
+		Transaction struct {
+			ID       int64  `json:"id"`
+			UUID     string `json:"uuid"`
+			Kind     string `json:"kind"`
+			Type     string `json:"type"`
+			Amount   int64  `json:"amount"`
+			Currency string `json:"currency"`
+		} `json:"transaction"`
+		FromCollective struct {
+			Name        string `json:"name"`
+			Slug        string `json:"slug"`
+			IsIncognito bool   `json:"isIncognito"`
+		} `json:"fromCollective"`
+		Order struct {
+			PublicMessage string `json:"publicMessage"`
+		} `json:"order"`
+	} `json:"data"`
+}
+
+// openCollectiveProvider turns Open Collective contributions into messages.
+// Open Collective doesn't sign its webhooks, so the URL carries a shared
+// token instead.
+type openCollectiveProvider struct{}
+
+func (openCollectiveProvider) Name() string  { return "opencollective" }
+func (openCollectiveProvider) Title() string { return "Open Collective" }
+func (openCollectiveProvider) Path() string  { return "opencollective" }
+
+func (openCollectiveProvider) Init(config PaymentConfig) (bool, error) {
+	return config.OpenCollectiveWebhookToken != "", nil
+}
+
+func (openCollectiveProvider) Verify(c *gin.Context, hub *Hub, body []byte) *sendError {
+	if subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(hub.payments.OpenCollectiveWebhookToken)) != 1 {
+		return &sendError{http.StatusUnauthorized, "Invalid token", errInvalidSignature}
+	}
+	return nil
+}
+
+func (openCollectiveProvider) Ingest(c *gin.Context, hub *Hub, body []byte) {
+	var webhook openCollectiveWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	// Expenses, fees and refunds also create transactions; only incoming contributions are read out
+	transaction := webhook.Data.Transaction
+	if webhook.Type != "collective.transaction.created" || transaction.Kind != "CONTRIBUTION" || transaction.Type != "CREDIT" {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Unhandled event type"})
+		return
+	}
+	id := transaction.UUID
+	if id == "" && transaction.ID != 0 {
+		id = strconv.FormatInt(transaction.ID, 10)
+	}
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	contributor := webhook.Data.FromCollective
+	acceptWebhookMessage(c, hub, "opencollective", Message{
+		SessionID: "opencollective_" + id,
+		Channel:   webhookChannel(c, ""),
+		Name:      firstNonEmpty(contributor.Name, contributor.Slug),
+		Amount:    float32(transaction.Amount) / 100,
+		Currency:  strings.ToUpper(transaction.Currency),
+		Message:   webhook.Data.Order.PublicMessage,
+		Anonymous: contributor.IsIncognito,
+	})
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Message lifecycle events sent to outbound webhooks
+const (
+	webhookMessageReceived  = "message.received"
+	webhookMessageBroadcast = "message.broadcast"
+	webhookMessageFiltered  = "message.filtered"
+)
+
+const (
+	// webhookEventHeader and webhookDeliveryHeader name the event and the
+	// delivery, which stays the same across retries
+	webhookEventHeader    = "X-TTS-Event"
+	webhookDeliveryHeader = "X-TTS-Delivery"
+	// webhooksCacheTTL is how long each instance trusts its copy of the
+	// webhook list, so webhooks registered elsewhere are picked up
+	webhooksCacheTTL = 30 * time.Second
+)
+
+var validWebhookEvents = map[string]bool{
+	webhookMessageReceived:  true,
+	webhookMessageBroadcast: true,
+	webhookMessageFiltered:  true,
+	webhookStreamStarted:    true,
+	webhookStreamStopped:    true,
+}
+
+// webhookRetryDelays are the waits before each retry of a failed delivery
+var webhookRetryDelays = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook is a URL that is POSTed the events it subscribes to. The secret
+// that signs them is only returned once, at creation.
+type Webhook struct {
+	ID     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Channel limits the webhook to one channel's messages
+	Channel   string    `json:"channel,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	secret    []byte
+}
+
+// CreateWebhookRequest is the body of POST /admin/webhooks
+type CreateWebhookRequest struct {
+	URL     string   `json:"url" binding:"required"`
+	Events  []string `json:"events" binding:"required"`
+	Channel string   `json:"channel"`
+}
+
+// WebhookDelivery is one attempt at delivering an event to a webhook
+type WebhookDelivery struct {
+	ID         int64  `json:"id"`
+	DeliveryID string `json:"delivery_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	// StatusCode is 0 when no response came back
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookPayload is the JSON body POSTed to a webhook
+type WebhookPayload struct {
+	ID        string         `json:"id"`
+	Event     string         `json:"event"`
+	CreatedAt time.Time      `json:"created_at"`
+	Data      WebhookMessage `json:"data"`
+}
+
+// WebhookMessage is the message an event is about. Audio is left out, and
+// so is the text of filtered messages.
+type WebhookMessage struct {
+	ID            int64    `json:"id,omitempty"`
+	SessionID     string   `json:"session_id"`
+	Channel       string   `json:"channel"`
+	Name          string   `json:"name"`
+	Amount        float32  `json:"amount"`
+	Message       string   `json:"message"`
+	Description   string   `json:"description"`
+	Anonymous     bool     `json:"anonymous,omitempty"`
+	Test          bool     `json:"test,omitempty"`
+	FilterReasons []string `json:"filter_reasons,omitempty"`
+}
+
+func (w *Webhook) wants(event string, channel string) bool {
+	if w.Channel != "" && w.Channel != channel {
+		return false
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookCache holds the registered webhooks a hub last loaded
+type webhookCache struct {
+	mutex    sync.Mutex
+	webhooks []*Webhook
+	loadedAt time.Time
+}
+
+// activeWebhooks returns the registered webhooks from the cache, loading them
+// when it is stale. Without Postgres there are none.
+func (hub *Hub) activeWebhooks() []*Webhook {
+	hub.webhooks.mutex.Lock()
+	defer hub.webhooks.mutex.Unlock()
+	if clock.Now().Sub(hub.webhooks.loadedAt) < webhooksCacheTTL {
+		return hub.webhooks.webhooks
+	}
+
+	webhooks, err := hub.db.listWebhooks()
+	if err != nil {
+		if !errors.Is(err, errPostgresRequired) {
+			log.Printf("Error loading webhooks: %v", err)
+		}
+		// Keep using the last list rather than asking the database on every message
+		hub.webhooks.loadedAt = clock.Now()
+		return hub.webhooks.webhooks
+	}
+	hub.webhooks.webhooks = webhooks
+	hub.webhooks.loadedAt = clock.Now()
+	return webhooks
+}
+
+// invalidateWebhooks makes the next event reload the webhook list
+func (hub *Hub) invalidateWebhooks() {
+	hub.webhooks.mutex.Lock()
+	hub.webhooks.loadedAt = time.Time{}
+	hub.webhooks.mutex.Unlock()
+}
+
+// webhookTargets returns the webhooks subscribed to event on channel
+func (hub *Hub) webhookTargets(event string, channel string) []*Webhook {
+	var targets []*Webhook
+	for _, webhook := range hub.activeWebhooks() {
+		if webhook.wants(event, channel) {
+			targets = append(targets, webhook)
+		}
+	}
+	return targets
+}
+
+// notifyWebhooks sends an event about msg to every webhook subscribed to it.
+// Deliveries happen in the background and never hold up the message.
+func (hub *Hub) notifyWebhooks(event string, msg Message) {
+	if msg.Probe || msg.Remote {
+		return
+	}
+	targets := hub.webhookTargets(event, msg.Channel)
+	if len(targets) == 0 {
+		return
+	}
+
+	payload := WebhookPayload{
+		ID:        newDeliveryID(),
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data: WebhookMessage{
+			ID:          msg.ID,
+			SessionID:   msg.SessionID,
+			Channel:     msg.Channel,
+			Name:        msg.Name,
+			Amount:      msg.Amount,
+			Message:     msg.Message,
+			Description: msg.Description,
+			Anonymous:   msg.Anonymous,
+			Test:        msg.Test,
+		},
+	}
+	if event == webhookMessageFiltered {
+		payload.Data.Message = ""
+		payload.Data.FilterReasons = msg.FilterReasons
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling %s webhook: %v", event, err)
+		return
+	}
+
+	for _, webhook := range targets {
+		go hub.deliverWebhook(pendingDelivery{webhook.ID, payload.ID, event, body, 1}, webhook)
+	}
+}
+
+// pendingDelivery is a webhook delivery that hasn't finished, and the attempt
+// it is on
+type pendingDelivery struct {
+	webhookID  int64
+	deliveryID string
+	event      string
+	body       []byte
+	attempt    int
+}
+
+// webhookDeliveries tracks the deliveries under way, so those still retrying
+// at shutdown can be saved for the next start
+type webhookDeliveries struct {
+	mutex   sync.Mutex
+	pending map[*pendingDelivery]bool
+	stopped bool
+	stop    chan struct{}
+}
+
+// trackDelivery registers a delivery, or reports false once shutdown has begun
+func (hub *Hub) trackDelivery(delivery *pendingDelivery) bool {
+	hub.deliveries.mutex.Lock()
+	defer hub.deliveries.mutex.Unlock()
+	if hub.deliveries.stopped {
+		return false
+	}
+	hub.deliveries.pending[delivery] = true
+	return true
+}
+
+func (hub *Hub) untrackDelivery(delivery *pendingDelivery) {
+	hub.deliveries.mutex.Lock()
+	delete(hub.deliveries.pending, delivery)
+	hub.deliveries.mutex.Unlock()
+}
+
+// stopWebhookDeliveries stops retries and returns the deliveries that hadn't
+// finished, each on the attempt it would make next
+func (hub *Hub) stopWebhookDeliveries() []pendingDelivery {
+	hub.deliveries.mutex.Lock()
+	defer hub.deliveries.mutex.Unlock()
+	if !hub.deliveries.stopped {
+		hub.deliveries.stopped = true
+		close(hub.deliveries.stop)
+	}
+	deliveries := make([]pendingDelivery, 0, len(hub.deliveries.pending))
+	for delivery := range hub.deliveries.pending {
+		deliveries = append(deliveries, *delivery)
+	}
+	return deliveries
+}
+
+// resumeWebhookDeliveries picks up the deliveries a previous shutdown saved.
+// Receivers may see an attempt again if it was under way at shutdown; the
+// delivery header stays the same, so they can tell.
+func (hub *Hub) resumeWebhookDeliveries() {
+	deliveries, err := hub.db.takePendingDeliveries()
+	if err != nil {
+		if !errors.Is(err, errPostgresRequired) {
+			log.Printf("Error loading unfinished webhook deliveries: %v", err)
+		}
+		return
+	}
+	resumed := 0
+	for _, delivery := range deliveries {
+		for _, webhook := range hub.activeWebhooks() {
+			if webhook.ID == delivery.webhookID {
+				go hub.deliverWebhook(delivery, webhook)
+				resumed++
+				break
+			}
+		}
+	}
+	if len(deliveries) > 0 {
+		log.Printf("Resumed %d of %d unfinished webhook deliveries", resumed, len(deliveries))
+	}
+}
+
+// deliverWebhook POSTs the delivery's body to a webhook from its attempt on,
+// retrying with backoff until it is accepted, refused outright or the retries
+// run out. Every attempt is logged for GET /admin/webhooks/:id/deliveries.
+// Shutdown stops the retries, leaving the delivery to be saved.
+func (hub *Hub) deliverWebhook(pending pendingDelivery, webhook *Webhook) {
+	if !hub.trackDelivery(&pending) {
+		log.Printf("Dropped %s delivery to webhook %d raised during shutdown", pending.event, webhook.ID)
+		return
+	}
+	deliveryID, event, body := pending.deliveryID, pending.event, pending.body
+	for attempt := pending.attempt; ; attempt++ {
+		started := time.Now()
+		status, err := postWebhook(webhook, deliveryID, event, body)
+		delivery := WebhookDelivery{
+			DeliveryID: deliveryID,
+			Event:      event,
+			Attempt:    attempt,
+			StatusCode: status,
+			DurationMS: time.Since(started).Milliseconds(),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := hub.db.addWebhookDelivery(webhook.ID, delivery); err != nil {
+			log.Printf("Error recording delivery to webhook %d: %v", webhook.ID, err)
+		}
+
+		if err == nil {
+			hub.untrackDelivery(&pending)
+			return
+		}
+		if !retryableWebhookStatus(status) || attempt > len(webhookRetryDelays) {
+			log.Printf("Failed to deliver %s to webhook %d after %d attempts: %v", event, webhook.ID, attempt, err)
+			hub.untrackDelivery(&pending)
+			return
+		}
+
+		hub.deliveries.mutex.Lock()
+		pending.attempt = attempt + 1
+		hub.deliveries.mutex.Unlock()
+		timer := time.NewTimer(webhookRetryDelays[attempt-1])
+		select {
+		case <-timer.C:
+		case <-hub.deliveries.stop:
+			timer.Stop()
+			return
+		}
+		if !hub.webhookRegistered(webhook.ID) {
+			hub.untrackDelivery(&pending)
+			return
+		}
+	}
+}
+
+// webhookRegistered reports whether a webhook still exists, so retries to a
+// deleted one stop
+func (hub *Hub) webhookRegistered(id int64) bool {
+	for _, webhook := range hub.activeWebhooks() {
+		if webhook.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// postWebhook makes one delivery attempt, returning the response status if there was one
+func postWebhook(webhook *Webhook, deliveryID string, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, "t="+timestamp+",v1="+timestampedSignature(webhook.secret, timestamp, body))
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookDeliveryHeader, deliveryID)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryableWebhookStatus reports whether a failed attempt is worth repeating:
+// no response, a server error, or the receiver asking us to slow down
+func retryableWebhookStatus(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+func newDeliveryID() string {
+	return ids.NewID()
+}
+
+func (s *Server) listWebhooksHandler(c *gin.Context) {
+	webhooks, err := s.db.listWebhooks()
+	if err != nil {
+		log.Printf("Error listing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhooks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+func (s *Server) createWebhookHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validateWebhookURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Events) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one event is required"})
+		return
+	}
+	for _, event := range req.Events {
+		if !validWebhookEvents[event] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event: " + event})
+			return
+		}
+	}
+	if req.Channel != "" && !validChannelName(req.Channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating webhook secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+		return
+	}
+	raw := signingKeyPrefix + hex.EncodeToString(buf)
+
+	webhook := &Webhook{
+		URL:       req.URL,
+		Events:    req.Events,
+		Channel:   req.Channel,
+		CreatedBy: user,
+		secret:    []byte(raw),
+	}
+	if err := s.db.createWebhook(webhook); err != nil {
+		log.Printf("Error storing webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+	s.hub.invalidateWebhooks()
+
+	s.db.recordAudit("webhook.created", user, strconv.FormatInt(webhook.ID, 10), webhook)
+	c.JSON(http.StatusCreated, gin.H{"secret": raw, "webhook": webhook})
+}
+
+func (s *Server) deleteWebhookHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+
+	deleted, err := s.db.deleteWebhook(id)
+	if err != nil {
+		log.Printf("Error deleting webhook %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	s.hub.invalidateWebhooks()
+
+	s.db.recordAudit("webhook.deleted", user, strconv.FormatInt(id, 10), nil)
+	c.JSON(http.StatusOK, gin.H{"status": "Webhook deleted"})
+}
+
+func (s *Server) listWebhookDeliveriesHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'limit' parameter"})
+		return
+	}
+
+	deliveries, err := s.db.getWebhookDeliveries(id, limit)
+	if err != nil {
+		log.Printf("Error listing deliveries for webhook %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhook deliveries"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventQueueCleared tells every instance to drop a channel's held alerts
+const EventQueueCleared = "queue_cleared"
+
+// PacingConfig spaces a channel's alerts out so their audio never overlaps.
+// Alerts that arrive while one is playing wait in the playback queue.
+type PacingConfig struct {
+	Enabled bool
+	// MinGap is the pause between one alert finishing and the next starting
+	MinGap time.Duration
+	// WaitForAck waits for the overlay's ack frame instead of the playback
+	// estimate; MaxWait gives up on an ack that never comes
+	WaitForAck bool
+	MaxWait    time.Duration
+	// Priority plays the largest held donation first instead of the oldest
+	Priority bool
+}
+
+// pacedAlert is the alert a paced channel is playing
+type pacedAlert struct {
+	id        int64
+	sessionID string
+	startedAt time.Time
+	// nextAt is when the next alert may start
+	nextAt time.Time
+}
+
+// QueueCleared is the data of an EventQueueCleared event
+type QueueCleared struct {
+	Channel   string `json:"channel"`
+	ClearedBy string `json:"cleared_by"`
+}
+
+// HeldAlert is an alert in the playback queue, as shown to admins
+type HeldAlert struct {
+	Position  int       `json:"position"`
+	ID        int64     `json:"id,omitempty"`
+	SessionID string    `json:"session_id"`
+	Name      string    `json:"name"`
+	Amount    float32   `json:"amount"`
+	QueuedAt  time.Time `json:"queued_at"`
+}
+
+// pacingBusy reports whether a channel must hold new alerts because one is
+// still playing. Must be called with the mutex held.
+func (hub *Hub) pacingBusy(channel string) bool {
+	if !hub.pacing.Enabled {
+		return false
+	}
+	current, ok := hub.playing[channel]
+	return ok && clock.Now().Before(current.nextAt)
+}
+
+// startPlaying records that msg was just handed to its channel's listeners.
+// Must be called with the mutex held.
+func (hub *Hub) startPlaying(msg Message) {
+	if !hub.pacing.Enabled {
+		return
+	}
+	now := clock.Now()
+	wait := hub.playback.duration(&msg) + hub.pacing.MinGap
+	if hub.pacing.WaitForAck {
+		wait = hub.pacing.MaxWait
+	}
+	hub.playing[msg.Channel] = pacedAlert{id: msg.ID, sessionID: msg.SessionID, startedAt: now, nextAt: now.Add(wait)}
+}
+
+// finishPlaying lets a channel's next alert start after the gap, once its
+// overlay acked the playing alert (id) or it was skipped (id 0).
+// Must be called with the mutex held.
+func (hub *Hub) finishPlaying(channel string, id int64) {
+	current, ok := hub.playing[channel]
+	if !ok || (id != 0 && current.id != id) {
+		return
+	}
+	if next := clock.Now().Add(hub.pacing.MinGap); next.Before(current.nextAt) {
+		current.nextAt = next
+		hub.playing[channel] = current
+	}
+}
+
+// advancePacing starts the next held alert on every channel that is free.
+// Must be called with the mutex held.
+func (hub *Hub) advancePacing() {
+	now := clock.Now()
+	ready := make(map[string]bool)
+	for _, alert := range hub.pending {
+		channel := alert.message.Channel
+		if current, ok := hub.playing[channel]; ok && now.Before(current.nextAt) {
+			continue
+		}
+		if hub.controls[channel].Paused {
+			continue
+		}
+		ready[channel] = true
+	}
+	for channel := range ready {
+		hub.releasePending(channel, 1)
+	}
+	for channel, current := range hub.playing {
+		if !now.Before(current.nextAt) && !ready[channel] {
+			delete(hub.playing, channel)
+		}
+	}
+}
+
+// releaseOrder is the indexes into pending of a channel's held alerts, in the
+// order they are released. Must be called with the mutex held.
+func (hub *Hub) releaseOrder(channel string) []int {
+	var order []int
+	for i, alert := range hub.pending {
+		if alert.message.Channel == channel {
+			order = append(order, i)
+		}
+	}
+	if hub.pacing.Priority {
+		sort.SliceStable(order, func(a, b int) bool {
+			return hub.pending[order[a]].message.Amount > hub.pending[order[b]].message.Amount
+		})
+	}
+	return order
+}
+
+// heldAlerts lists a channel's playback queue in release order
+func (hub *Hub) heldAlerts(channel string) []HeldAlert {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	alerts := []HeldAlert{}
+	for position, i := range hub.releaseOrder(channel) {
+		msg := hub.pending[i].message
+		alerts = append(alerts, HeldAlert{
+			Position:  position,
+			ID:        msg.ID,
+			SessionID: msg.SessionID,
+			Name:      msg.Name,
+			Amount:    msg.Amount,
+			QueuedAt:  hub.pending[i].queuedAt,
+		})
+	}
+	return alerts
+}
+
+// clearPending drops a channel's held alerts, storing them as missed so
+// they can still be requeued. Must be called with the mutex held.
+func (hub *Hub) clearPending(channel string) int {
+	kept := hub.pending[:0]
+	cleared := 0
+	for _, alert := range hub.pending {
+		if alert.message.Channel != channel {
+			kept = append(kept, alert)
+			continue
+		}
+		cleared++
+		hub.storeMissed(alert.message)
+	}
+	hub.pending = kept
+	return cleared
+}
+
+// queueHandler shows a channel's playback queue and the alert playing on it
+func (s *Server) queueHandler(c *gin.Context) {
+	channel, ok := deckChannel(c)
+	if !ok {
+		return
+	}
+	response := gin.H{"channel": channel, "pacing": s.hub.pacing.Enabled, "held": s.hub.heldAlerts(channel)}
+
+	s.hub.mutex.Lock()
+	if current, playing := s.hub.playing[channel]; playing && clock.Now().Before(current.nextAt) {
+		response["playing"] = gin.H{"id": current.id, "session_id": current.sessionID, "started_at": current.startedAt, "next_at": current.nextAt}
+	}
+	s.hub.mutex.Unlock()
+	c.JSON(http.StatusOK, response)
+}
+
+// clearQueueHandler drops a channel's held alerts on every instance
+func (s *Server) clearQueueHandler(c *gin.Context) {
+	channel, ok := deckChannel(c)
+	if !ok {
+		return
+	}
+	held := len(s.hub.heldAlerts(channel))
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.hub.publishEvent(channel, EventQueueCleared, QueueCleared{Channel: channel, ClearedBy: user})
+	s.db.recordAudit("queue.cleared", user, channel, gin.H{"held": held})
+	c.JSON(http.StatusOK, gin.H{"channel": channel, "cleared": held})
+}
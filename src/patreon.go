@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EventMembership announces a new or renewed paid membership
+const EventMembership = "membership"
+
+// Patreon webhook triggers, sent in the X-Patreon-Event header
+const (
+	patreonMemberCreate = "members:create"
+	patreonMemberUpdate = "members:update"
+	patreonPledgeCreate = "members:pledge:create"
+	patreonPledgeUpdate = "members:pledge:update"
+)
+
+// Kinds of membership announcements
+const (
+	membershipNew     = "new"
+	membershipUpdated = "updated"
+	membershipRenewed = "renewed"
+)
+
+// Membership is the data of an EventMembership event
+type Membership struct {
+	Provider string  `json:"provider"`
+	Channel  string  `json:"channel"`
+	Kind     string  `json:"kind"`
+	Name     string  `json:"name"`
+	Tier     string  `json:"tier,omitempty"`
+	TierID   string  `json:"tier_id,omitempty"`
+	Amount   float32 `json:"amount"`
+}
+
+// patreonResource is a JSON:API resource from a Patreon webhook
+type patreonResource struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		FullName                     string `json:"full_name"`
+		PatronStatus                 string `json:"patron_status"`
+		CurrentlyEntitledAmountCents int64  `json:"currently_entitled_amount_cents"`
+		LastChargeDate               string `json:"last_charge_date"`
+		LastChargeStatus             string `json:"last_charge_status"`
+		Title                        string `json:"title"`
+	} `json:"attributes"`
+	Relationships struct {
+		CurrentlyEntitledTiers struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		} `json:"currently_entitled_tiers"`
+		User struct {
+			Data struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		} `json:"user"`
+	} `json:"relationships"`
+}
+
+type patreonWebhook struct {
+	Data     patreonResource   `json:"data"`
+	Included []patreonResource `json:"included"`
+}
+
+// included finds a resource sideloaded with the member
+func (w patreonWebhook) included(resourceType string, id string) (patreonResource, bool) {
+	for _, resource := range w.Included {
+		if resource.Type == resourceType && resource.ID == id {
+			return resource, true
+		}
+	}
+	return patreonResource{}, false
+}
+
+// verifyPatreonSignature checks X-Patreon-Signature, the hex HMAC-MD5 of the
+// body keyed with the webhook secret
+func verifyPatreonSignature(secret string, signature string, body []byte) bool {
+	expected, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// patreonProvider announces new patrons, and with PATREON_ANNOUNCE_RENEWALS
+// changed pledges and monthly charges too. Memberships are events rather
+// than messages, so nothing is read out.
+type patreonProvider struct{}
+
+func (patreonProvider) Name() string  { return "patreon" }
+func (patreonProvider) Title() string { return "Patreon" }
+func (patreonProvider) Path() string  { return "patreon" }
+
+func (patreonProvider) Init(config PaymentConfig) (bool, error) {
+	return config.PatreonWebhookSecret != "", nil
+}
+
+func (patreonProvider) Verify(c *gin.Context, hub *Hub, body []byte) *sendError {
+	if !verifyPatreonSignature(hub.payments.PatreonWebhookSecret, c.GetHeader("X-Patreon-Signature"), body) {
+		return &sendError{http.StatusUnauthorized, "Invalid signature", errInvalidSignature}
+	}
+	return nil
+}
+
+func (patreonProvider) Ingest(c *gin.Context, hub *Hub, body []byte) {
+	var webhook patreonWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil || webhook.Data.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	member := webhook.Data.Attributes
+	if member.PatronStatus != "active_patron" {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Member is not an active patron"})
+		return
+	}
+
+	// Patreon retries deliveries, so each announcement has a stable ID
+	var kind, sessionID string
+	switch c.GetHeader("X-Patreon-Event") {
+	case patreonMemberCreate, patreonPledgeCreate:
+		kind, sessionID = membershipNew, "patreon_"+webhook.Data.ID+"_new"
+	case patreonPledgeUpdate:
+		// Nothing in a pledge update identifies it, but a retry is the same body
+		sum := md5.Sum(body)
+		kind, sessionID = membershipUpdated, "patreon_"+webhook.Data.ID+"_"+hex.EncodeToString(sum[:8])
+	case patreonMemberUpdate:
+		if member.LastChargeStatus != "Paid" || member.LastChargeDate == "" {
+			c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Not a completed charge"})
+			return
+		}
+		kind, sessionID = membershipRenewed, "patreon_"+webhook.Data.ID+"_"+member.LastChargeDate
+	default:
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Unhandled event type"})
+		return
+	}
+	if kind != membershipNew && !hub.payments.PatreonAnnounceRenewals {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Renewals are not announced"})
+		return
+	}
+
+	channel := webhookChannel(c, "")
+	if !validChannelName(channel) {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Invalid channel name"})
+		return
+	}
+
+	membership := Membership{
+		Provider: "patreon",
+		Channel:  channel,
+		Kind:     kind,
+		Name:     member.FullName,
+		Amount:   float32(member.CurrentlyEntitledAmountCents) / 100,
+	}
+	if membership.Name == "" {
+		if user, ok := webhook.included("user", webhook.Data.Relationships.User.Data.ID); ok {
+			membership.Name = user.Attributes.FullName
+		}
+	}
+	if tiers := webhook.Data.Relationships.CurrentlyEntitledTiers.Data; len(tiers) > 0 {
+		membership.TierID = tiers[0].ID
+		if tier, ok := webhook.included("tier", tiers[0].ID); ok {
+			membership.Tier = tier.Attributes.Title
+		}
+	}
+
+	if claimed, _ := claimSession(hub, sessionID); !claimed {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Session already exists"})
+		return
+	}
+	hub.publishEvent(channel, EventMembership, membership)
+	hub.db.recordAudit("membership.received", "patreon", sessionID, membership)
+	c.JSON(http.StatusOK, gin.H{"status": "Membership announced", "kind": kind})
+}
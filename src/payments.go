@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stripeSignatureTolerance is how old a signed Stripe delivery may be before it is refused as a replay
+const stripeSignatureTolerance = 5 * time.Minute
+
+// PaymentConfig holds the secrets used to verify payment provider webhooks.
+// A provider's endpoint is disabled while its secret is empty.
+type PaymentConfig struct {
+	StripeWebhookSecret   string
+	KofiVerificationToken string
+	BMCWebhookSecret      string
+	// OpenCollectiveWebhookToken is the ?token= Open Collective webhook URLs must carry
+	OpenCollectiveWebhookToken string
+	// GenericWebhooksFile holds the mappings for /webhooks/generic/:name
+	GenericWebhooksFile  string
+	PatreonWebhookSecret string
+	GitHubWebhookSecret  string
+	// GitHubTierAmounts overrides what sponsor tiers are worth, as tier=amount pairs
+	GitHubTierAmounts []string
+	// Enabled turns providers on and off by name
+	Enabled map[string]bool
+	// PatreonAnnounceRenewals also announces changed pledges and monthly charges
+	PatreonAnnounceRenewals bool
+	// StripeTestWebhookSecret verifies the Stripe test mode endpoint's events,
+	// which go to the channel's sandbox
+	StripeTestWebhookSecret string
+}
+
+// stripeZeroDecimal lists currencies Stripe amounts are not given in cents for
+var stripeZeroDecimal = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true, "krw": true, "mga": true,
+	"pyg": true, "rwf": true, "ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Livemode is false for events from the Stripe test mode
+	Livemode *bool `json:"livemode"`
+	Data     struct {
+		Object stripeCheckoutSession `json:"object"`
+	} `json:"data"`
+}
+
+type stripeCheckoutSession struct {
+	ID              string            `json:"id"`
+	AmountTotal     int64             `json:"amount_total"`
+	Currency        string            `json:"currency"`
+	PaymentStatus   string            `json:"payment_status"`
+	Metadata        map[string]string `json:"metadata"`
+	CustomerDetails struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"customer_details"`
+}
+
+type kofiPayload struct {
+	VerificationToken string `json:"verification_token"`
+	MessageID         string `json:"message_id"`
+	Type              string `json:"type"`
+	IsPublic          bool   `json:"is_public"`
+	FromName          string `json:"from_name"`
+	Message           string `json:"message"`
+	Amount            string `json:"amount"`
+	Currency          string `json:"currency"`
+	TransactionID     string `json:"kofi_transaction_id"`
+	Email             string `json:"email"`
+}
+
+// stripeAmount converts a Stripe minor-unit amount into the currency's major unit
+func stripeAmount(amount int64, currency string) float32 {
+	if stripeZeroDecimal[strings.ToLower(currency)] {
+		return float32(amount)
+	}
+	return float32(amount) / 100
+}
+
+// webhookChannel picks the channel of a webhook donation: the custom domain
+// it was sent to, the provider's own field, then ?channel=
+func webhookChannel(c *gin.Context, fromPayload string) string {
+	if channel, ok := domainChannel(c); ok {
+		return channel
+	}
+	if fromPayload != "" {
+		return fromPayload
+	}
+	return c.DefaultQuery("channel", defaultChannel)
+}
+
+// acceptWebhookMessage sends a verified donation down the regular send pipeline.
+// Providers retry anything that isn't a 2xx, so refusals that a retry can't fix
+// (duplicates, banned names) are acknowledged rather than failed.
+func acceptWebhookMessage(c *gin.Context, hub *Hub, provider string, msg Message) {
+	if !validChannelName(msg.Channel) {
+		log.Printf("Ignoring %s donation %s for invalid channel %q", provider, msg.SessionID, msg.Channel)
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Invalid channel name"})
+		return
+	}
+	// Anonymous donations get their description from the anonymity template instead
+	if msg.Message == "" && msg.Description == "" && !msg.Anonymous {
+		msg.Description = fmt.Sprintf("%s donated %.2f", msg.Name, msg.Amount)
+	}
+	msg.Provider = provider
+	hub.metrics.inc(metricMessagesReceived, MetricLabels{Channel: msg.Channel, Kind: "donation"}, 1)
+
+	result, err := hub.acceptMessage(c.Request.Context(), msg, c.ClientIP())
+	if err != nil {
+		if err.status >= http.StatusInternalServerError {
+			c.JSON(err.status, gin.H{"error": err.message})
+			return
+		}
+		log.Printf("Ignoring %s donation %s: %s", provider, msg.SessionID, err.message)
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": err.message})
+		return
+	}
+
+	hub.db.recordAudit("payment.received", provider, msg.SessionID, gin.H{"amount": msg.Amount, "channel": msg.Channel})
+	c.JSON(http.StatusOK, result)
+}
+
+// stripeProvider reads completed Stripe Checkout sessions
+type stripeProvider struct{}
+
+func (stripeProvider) Name() string  { return "stripe" }
+func (stripeProvider) Title() string { return "Stripe" }
+func (stripeProvider) Path() string  { return "stripe" }
+
+func (stripeProvider) Init(config PaymentConfig) (bool, error) {
+	return config.StripeWebhookSecret != "" || config.StripeTestWebhookSecret != "", nil
+}
+
+// Verify checks the Stripe-Signature header, refusing old deliveries as replays
+func (stripeProvider) Verify(c *gin.Context, hub *Hub, body []byte) *sendError {
+	secrets := [][]byte{}
+	for _, secret := range []string{hub.payments.StripeWebhookSecret, hub.payments.StripeTestWebhookSecret} {
+		if secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	if err := verifyTimestampedSignature(c.GetHeader("Stripe-Signature"), body, secrets, stripeSignatureTolerance); err != nil {
+		return &sendError{http.StatusUnauthorized, "Invalid signature", errInvalidSignature}
+	}
+	return nil
+}
+
+// Ingest turns completed Stripe Checkout sessions into messages. The donor's
+// name, message and channel are read from the session metadata.
+func (stripeProvider) Ingest(c *gin.Context, hub *Hub, body []byte) {
+	var event stripeEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	session := event.Data.Object
+	if event.Type != "checkout.session.completed" || session.PaymentStatus != "paid" {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "Unhandled event type"})
+		return
+	}
+
+	name := session.Metadata["name"]
+	if name == "" {
+		name = session.CustomerDetails.Name
+	}
+	anonymous, _ := strconv.ParseBool(session.Metadata["anonymous"])
+	channel := webhookChannel(c, session.Metadata["channel"])
+	if event.Livemode != nil && !*event.Livemode {
+		channel = sandboxChannel(channel)
+	}
+
+	acceptWebhookMessage(c, hub, "stripe", Message{
+		SessionID:  session.ID,
+		Channel:    channel,
+		Name:       name,
+		Amount:     stripeAmount(session.AmountTotal, session.Currency),
+		Currency:   strings.ToUpper(session.Currency),
+		Message:    session.Metadata["message"],
+		Anonymous:  anonymous,
+		DonorEmail: session.CustomerDetails.Email,
+	})
+}
+
+// kofiProvider reads Ko-fi donations. Ko-fi posts a form with the JSON
+// payload in its data field, authenticated by a shared token inside it.
+type kofiProvider struct{}
+
+func (kofiProvider) Name() string  { return "kofi" }
+func (kofiProvider) Title() string { return "Ko-fi" }
+func (kofiProvider) Path() string  { return "kofi" }
+
+func (kofiProvider) Init(config PaymentConfig) (bool, error) {
+	return config.KofiVerificationToken != "", nil
+}
+
+// parseKofiPayload reads the payload out of the posted form
+func parseKofiPayload(body []byte) (kofiPayload, bool) {
+	var payload kofiPayload
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return payload, false
+	}
+	return payload, json.Unmarshal([]byte(form.Get("data")), &payload) == nil
+}
+
+func (kofiProvider) Verify(c *gin.Context, hub *Hub, body []byte) *sendError {
+	payload, ok := parseKofiPayload(body)
+	if !ok {
+		return &sendError{http.StatusBadRequest, "Invalid request format", nil}
+	}
+	if subtle.ConstantTimeCompare([]byte(payload.VerificationToken), []byte(hub.payments.KofiVerificationToken)) != 1 {
+		return &sendError{http.StatusUnauthorized, "Invalid verification token", errInvalidSignature}
+	}
+	return nil
+}
+
+func (kofiProvider) Ingest(c *gin.Context, hub *Hub, body []byte) {
+	payload, _ := parseKofiPayload(body)
+	amount, err := strconv.ParseFloat(payload.Amount, 32)
+	if err != nil || firstNonEmpty(payload.TransactionID, payload.MessageID) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	// Private Ko-fi donations keep both the donor and their message off stream
+	msg := Message{
+		SessionID:  "kofi_" + firstNonEmpty(payload.TransactionID, payload.MessageID),
+		Channel:    webhookChannel(c, ""),
+		Name:       payload.FromName,
+		Amount:     float32(amount),
+		Currency:   strings.ToUpper(payload.Currency),
+		Message:    payload.Message,
+		Anonymous:  !payload.IsPublic,
+		DonorEmail: payload.Email,
+	}
+	if !payload.IsPublic {
+		msg.Message = ""
+	}
+	acceptWebhookMessage(c, hub, "kofi", msg)
+}
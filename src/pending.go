@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Why a pending message can't be decided
+var (
+	errPendingNotFound = errors.New("pending message not found")
+	errNotPending      = errors.New("message is not pending")
+)
+
+// PendingMessage is a message in the moderation queue
+type PendingMessage struct {
+	ID        int64      `json:"id"`
+	Message   Message    `json:"message"`
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+
+	// Filtered, OriginalMessage and FilterReasons show moderators what the
+	// content filter did to the message, which keeps them out of its own JSON
+	Filtered        bool     `json:"filtered,omitempty"`
+	OriginalMessage string   `json:"original_message,omitempty"`
+	FilterReasons   []string `json:"filter_reasons,omitempty"`
+}
+
+// showFilter copies the message's filter results to where moderators see them
+func (p *PendingMessage) showFilter() {
+	p.Filtered, p.OriginalMessage, p.FilterReasons = p.Message.Filtered, p.Message.OriginalMessage, p.Message.FilterReasons
+}
+
+// holdForModeration stores a message in the moderation queue and tells the sender it is pending
+func (hub *Hub) holdForModeration(msg Message) (SendResult, *sendError) {
+	pending, err := hub.db.addPendingMessage(msg)
+	if err != nil {
+		log.Printf("Error queueing session %s for moderation: %v", msg.SessionID, err)
+		return SendResult{}, &sendError{http.StatusInternalServerError, "Failed to queue message for moderation", err}
+	}
+
+	hub.eventLog.record(eventMessageModerated, msg, moderationEvent{Decision: statusPending, By: actorSystem})
+	hub.announcePending(pending)
+	return SendResult{
+		Status:    "Message awaiting moderation",
+		ID:        msg.SessionID,
+		StatusID:  msg.StatusToken,
+		Receipt:   msg.Receipt,
+		State:     deliveryPending,
+		PendingID: pending.ID,
+	}, nil
+}
+
+// announcePending shows a newly queued message on moderator feeds
+func (hub *Hub) announcePending(pending *PendingMessage) {
+	payload, err := json.Marshal(pending)
+	if err != nil {
+		log.Printf("Error marshaling pending message: %v", err)
+		return
+	}
+
+	hub.mutex.Lock()
+	hub.notifyModerators("pending", payload)
+	hub.mutex.Unlock()
+}
+
+// approvePending releases a queued message to the overlays
+func approvePending(hub *Hub, id int64, user string) (*PendingMessage, SendResult, error) {
+	pending, err := hub.db.decidePendingMessage(id, statusApproved, "", user)
+	if err != nil {
+		return nil, SendResult{}, err
+	}
+
+	hub.eventLog.record(eventMessageModerated, pending.Message, moderationEvent{Decision: statusApproved, By: user})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	result, serr := hub.deliverMessage(ctx, pending.Message)
+	if serr != nil {
+		return nil, SendResult{}, serr
+	}
+
+	hub.db.recordAudit("message.approved", user, pending.Message.SessionID, gin.H{"pending_id": id})
+	return pending, result, nil
+}
+
+// rejectPending drops a queued message without broadcasting it
+func rejectPending(hub *Hub, id int64, reason string, user string) (*PendingMessage, error) {
+	pending, err := hub.db.decidePendingMessage(id, statusRejected, reason, user)
+	if err != nil {
+		return nil, err
+	}
+	hub.eventLog.record(eventMessageModerated, pending.Message, moderationEvent{Decision: statusRejected, By: user, Reason: reason})
+	hub.db.recordAudit("message.rejected", user, pending.Message.SessionID, gin.H{"pending_id": id, "reason": reason})
+	hooks.run(hookOnReject, pending.Message, firstNonEmpty(reason, "rejected by "+user))
+	return pending, nil
+}
+
+func (s *Server) listPendingHandler(c *gin.Context) {
+	messages, err := s.db.getPendingMessages(c.Query("channel"))
+	if err != nil {
+		log.Printf("Error listing pending messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list pending messages"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pending": messages})
+}
+
+func (s *Server) approvePendingHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pending message ID"})
+		return
+	}
+
+	pending, result, err := approvePending(s.hub, id, user)
+	if err != nil {
+		log.Printf("Error approving pending message %d: %v", id, err)
+		answerDecisionError(c, err, "Failed to approve pending message")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"pending": pending, "delivery": result})
+}
+
+func (s *Server) rejectPendingHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pending message ID"})
+		return
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	pending, err := rejectPending(s.hub, id, body.Reason, user)
+	if err != nil {
+		log.Printf("Error rejecting pending message %d: %v", id, err)
+		answerDecisionError(c, err, "Failed to reject pending message")
+		return
+	}
+	c.JSON(http.StatusOK, pending)
+}
+
+// answerDecisionError answers a failed approval or rejection: 404 for an
+// unknown ID, 409 for one already decided, the refusal's own status when
+// delivery was refused, and 500 with failure otherwise
+func answerDecisionError(c *gin.Context, err error, failure string) {
+	var serr *sendError
+	switch {
+	case errors.Is(err, errPendingNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pending message not found"})
+	case errors.Is(err, errNotPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "Message is not pending"})
+	case errors.As(err, &serr):
+		c.JSON(serr.status, gin.H{"error": serr.message})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": failure})
+	}
+}
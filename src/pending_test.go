@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// scanRow is a pgx.Row that scans with a function
+type scanRow func(dest ...any) error
+
+func (r scanRow) Scan(dest ...any) error { return r(dest...) }
+
+// pendingRow is a pending_messages row as the queries write it
+type pendingRow struct {
+	payload         []byte
+	sealed          []byte
+	token           string
+	note            string
+	filtered        bool
+	originalMessage string
+	filterReasons   []string
+	provider        string
+	status          string
+	reason          *string
+	createdAt       time.Time
+	decidedBy       *string
+	decidedAt       *time.Time
+}
+
+// pendingPool answers the moderation queue's insert and decide queries from
+// memory, and fails everything else as if Postgres were unavailable
+type pendingPool struct {
+	unavailablePool
+	mutex sync.Mutex
+	rows  []*pendingRow
+}
+
+func (p *pendingPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch sql {
+	case insertPendingMessageQuery:
+		row := &pendingRow{
+			payload:         args[2].([]byte),
+			sealed:          args[3].([]byte),
+			token:           args[4].(string),
+			note:            args[5].(string),
+			filtered:        args[6].(bool),
+			originalMessage: args[7].(string),
+			filterReasons:   args[8].([]string),
+			provider:        args[9].(string),
+			status:          statusPending,
+			createdAt:       clock.Now(),
+		}
+		p.rows = append(p.rows, row)
+		id := int64(len(p.rows))
+		return scanRow(func(dest ...any) error {
+			*dest[0].(*int64), *dest[1].(*string), *dest[2].(*time.Time) = id, row.status, row.createdAt
+			return nil
+		})
+	case decidePendingMessageQuery:
+		id := args[0].(int64)
+		if id < 1 || id > int64(len(p.rows)) || p.rows[id-1].status != statusPending {
+			return scanRow(func(...any) error { return pgx.ErrNoRows })
+		}
+		row := p.rows[id-1]
+		reason, user, now := args[2].(string), args[3].(string), clock.Now()
+		row.status, row.reason, row.decidedBy, row.decidedAt = args[1].(string), &reason, &user, &now
+		return scanRow(func(dest ...any) error {
+			*dest[0].(*int64), *dest[1].(*[]byte), *dest[2].(*[]byte) = id, row.payload, row.sealed
+			*dest[3].(*string), *dest[4].(*string) = row.token, row.note
+			*dest[5].(*bool), *dest[6].(*string), *dest[7].(*[]string), *dest[8].(*string) = row.filtered, row.originalMessage, row.filterReasons, row.provider
+			*dest[9].(*string), *dest[10].(**string), *dest[11].(*time.Time) = row.status, row.reason, row.createdAt
+			*dest[12].(**string), *dest[13].(**time.Time) = row.decidedBy, row.decidedAt
+			return nil
+		})
+	}
+	return p.unavailablePool.QueryRow(ctx, sql, args...)
+}
+
+// recordingStore passes messages on to a store, and to stored as well
+type recordingStore struct {
+	Store
+	stored chan Message
+}
+
+func (s *recordingStore) AddMessage(msg Message) error {
+	s.stored <- msg
+	return s.Store.AddMessage(msg)
+}
+
+func TestApprovedMessageKeepsWhatTheFilterAndProviderSet(t *testing.T) {
+	sqlite, err := openSQLiteStore(filepath.Join(t.TempDir(), "tts.db"))
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	store := &recordingStore{Store: sqlite, stored: make(chan Message, 1)}
+	hub := newHub(store)
+	hub.db = &postgresStore{pool: &pendingPool{}}
+	go hub.run()
+	t.Cleanup(func() {
+		close(hub.quit)
+		<-hub.stopped
+		hub.storing.Wait()
+		sqlite.Close()
+	})
+	client, _ := connect(hub, "alpha")
+
+	held, serr := hub.holdForModeration(Message{
+		ID:              1,
+		SessionID:       "kofi_held",
+		Channel:         "alpha",
+		Name:            "Ada",
+		Amount:          5,
+		Message:         "what a ***",
+		Filtered:        true,
+		OriginalMessage: "what a word",
+		FilterReasons:   []string{"tier:hold"},
+		Provider:        "kofi",
+	})
+	if serr != nil {
+		t.Fatalf("holding message: %v", serr)
+	}
+
+	pending, _, err := approvePending(hub, held.PendingID, "mod")
+	if err != nil {
+		t.Fatalf("approving message: %v", err)
+	}
+	if !pending.Filtered || pending.OriginalMessage != "what a word" || !slices.Equal(pending.FilterReasons, []string{"tier:hold"}) {
+		t.Fatalf("approved pending message shows filtered %t, original %q, reasons %v; want the filter's results",
+			pending.Filtered, pending.OriginalMessage, pending.FilterReasons)
+	}
+
+	if msg := receive(t, client); msg.SessionID != "kofi_held" || msg.Message != "what a ***" {
+		t.Fatalf("delivered session %q with %q, want the held message as filtered", msg.SessionID, msg.Message)
+	}
+	select {
+	case msg := <-store.stored:
+		if !msg.Filtered || msg.OriginalMessage != "what a word" || !slices.Equal(msg.FilterReasons, []string{"tier:hold"}) {
+			t.Fatalf("stored filtered %t, original %q, reasons %v; want the filter's results",
+				msg.Filtered, msg.OriginalMessage, msg.FilterReasons)
+		}
+		if msg.Provider != "kofi" {
+			t.Fatalf("stored provider %q, want kofi", msg.Provider)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("approved message was never stored")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery states reported to senders
+const (
+	deliveryBroadcast = "broadcast"
+	deliveryQueued    = "queued"
+	deliveryPending   = "pending"
+)
+
+// PlaybackConfig tunes how long an alert is assumed to take to read out
+type PlaybackConfig struct {
+	WordsPerMinute int
+	AlertOverhead  time.Duration
+	// DuckEvents brackets each alert with ducking events, the end one sent
+	// DuckRelease after the alert is expected to finish
+	DuckEvents  bool
+	DuckRelease time.Duration
+	// SyncDelay is how far ahead alerts are given a play_at, so they reach
+	// every overlay of a channel before it; 0 sends none
+	SyncDelay time.Duration
+}
+
+// SendResult tells the sender what happened to their message and roughly when
+// it will be read. ETA is omitted while no overlay is connected.
+type SendResult struct {
+	Status        string        `json:"status"`
+	ID            string        `json:"id"`
+	StatusID      string        `json:"status_id"`
+	Receipt       string        `json:"receipt,omitempty"`
+	State         string        `json:"state"`
+	QueuePosition int           `json:"queue_position"`
+	ETASeconds    *float64      `json:"eta_seconds,omitempty"`
+	Audio         *AudioPayload `json:"audio,omitempty"`
+	PendingID     int64         `json:"pending_id,omitempty"`
+	// Duplicate marks the answer to a repeat of an accepted session ID
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// playbackEstimator tracks when recently broadcast alerts are expected to
+// finish playing on each channel, assuming overlays read them one after another
+type playbackEstimator struct {
+	mutex  sync.Mutex
+	config PlaybackConfig
+	ends   map[string][]time.Time
+}
+
+func newPlaybackEstimator(config PlaybackConfig) *playbackEstimator {
+	return &playbackEstimator{config: config, ends: make(map[string][]time.Time)}
+}
+
+// wordsPerSecond is the reading speed durations are estimated at
+func (p *playbackEstimator) wordsPerSecond() float64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return float64(p.config.WordsPerMinute) / 60
+}
+
+// duration estimates how long msg takes to play, including the alert animation
+func (p *playbackEstimator) duration(msg *Message) time.Duration {
+	words := len(strings.Fields(spokenText(msg)))
+	if p.config.WordsPerMinute <= 0 {
+		return p.config.AlertOverhead
+	}
+	return p.config.AlertOverhead + time.Duration(words)*time.Minute/time.Duration(p.config.WordsPerMinute)
+}
+
+// schedule places msg after the alerts still playing on its channel and
+// returns how many are ahead of it and how long until it starts
+func (p *playbackEstimator) schedule(msg *Message) (int, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := clock.Now()
+	var active []time.Time
+	for _, end := range p.ends[msg.Channel] {
+		if end.After(now) {
+			active = append(active, end)
+		}
+	}
+
+	start := now
+	if len(active) > 0 {
+		start = active[len(active)-1]
+	}
+	p.ends[msg.Channel] = append(active, start.Add(p.duration(msg)))
+
+	return len(active), start.Sub(now)
+}
+
+// enqueueResult estimates delivery for a message about to be handed to the hub
+func (hub *Hub) enqueueResult(msg *Message) SendResult {
+	result := SendResult{Status: "Message successfully sent", ID: msg.SessionID, StatusID: msg.StatusToken, Receipt: msg.Receipt, Audio: msg.Audio}
+
+	hub.mutex.Lock()
+	listeners := len(hub.clients[msg.Channel])
+	held := hub.pendingCount(msg.Channel)
+	paused := hub.controls[msg.Channel].Paused
+	busy := hub.pacingBusy(msg.Channel)
+	if busy && hub.pacing.Priority {
+		held = 0
+		for _, alert := range hub.pending {
+			if alert.message.Channel == msg.Channel && alert.message.Amount >= msg.Amount {
+				held++
+			}
+		}
+	}
+	hub.mutex.Unlock()
+
+	if listeners == 0 || paused || busy {
+		result.State = deliveryQueued
+		result.QueuePosition = held
+		return result
+	}
+
+	position, wait := hub.playback.schedule(msg)
+	eta := math.Round(wait.Seconds()*10) / 10
+	result.State = deliveryBroadcast
+	result.QueuePosition = position
+	result.ETASeconds = &eta
+	return result
+}
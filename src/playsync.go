@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// TimeSyncFrame answers a listener's time_sync frame. The listener works
+// out how far its clock is from the server's the way NTP does: with t0 the
+// client_time it sent and t1 when the answer arrived, the offset is
+// server_time - (t0 + t1) / 2. Times are milliseconds since the Unix epoch.
+type TimeSyncFrame struct {
+	Type       string `json:"type"`
+	ClientTime int64  `json:"client_time"`
+	ServerTime int64  `json:"server_time"`
+}
+
+// answerTimeSync queues the answer to a time_sync frame. It is dropped if
+// the listener's queue is full, as a late answer would skew the offset.
+func answerTimeSync(client *listener, clientTime int64) {
+	payload, err := json.Marshal(TimeSyncFrame{Type: "time_sync", ClientTime: clientTime, ServerTime: clock.Now().UnixMilli()})
+	if err != nil {
+		log.Printf("Error marshaling time sync frame: %v", err)
+		return
+	}
+	client.enqueue(payload)
+}
+
+// withPlayAt stamps an alert released now with when its channel's overlays
+// should start playing it, syncDelay from now, so that every one of them
+// plays it at once. Alerts going to a single overlay with no other instances
+// are left to play on arrival. Must be called with the mutex held.
+func (hub *Hub) withPlayAt(msg Message, payload []byte) (Message, []byte) {
+	if hub.syncDelay <= 0 || (len(hub.clients[msg.Channel]) < 2 && hub.bus == nil) {
+		return msg, payload
+	}
+	msg.PlayAt = clock.Now().Add(hub.syncDelay).UnixMilli()
+	native, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return msg, payload
+	}
+	return msg, native
+}
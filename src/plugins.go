@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// filterPluginVersion is the version of the JSON plugins are sent
+const filterPluginVersion = 1
+
+// maxPluginOutput bounds what a plugin may write to stdout or stderr
+const maxPluginOutput = 64 << 10
+
+// PluginConfig configures the filter plugins: executables that each message
+// is passed through, after the built-in content filter, as JSON on stdin.
+// They answer with JSON on stdout and can change the text or ask for the
+// message to be held, blocked or its sender banned, like a wordlist tier.
+type PluginConfig struct {
+	// Paths are the plugin executables, run in this order
+	Paths []string
+	// Timeout is how long each plugin gets per message before it is killed
+	Timeout time.Duration
+	// FailAction is what happens to a message when a plugin fails or times
+	// out: "" lets it through unchanged, or one of the filter actions
+	FailAction string
+}
+
+// PluginRequest is what filter plugins read from stdin
+type PluginRequest struct {
+	Version     int     `json:"version"`
+	SessionID   string  `json:"session_id"`
+	Channel     string  `json:"channel"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Message     string  `json:"message"`
+	Amount      float32 `json:"amount"`
+	Currency    string  `json:"currency,omitempty"`
+	Anonymous   bool    `json:"anonymous"`
+	// Reasons are the filter reasons recorded so far
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// PluginResponse is what filter plugins write to stdout. Fields left out keep
+// their text; an empty object lets the message through as it is.
+type PluginResponse struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Message     *string `json:"message,omitempty"`
+	// Action is "", or one of the filter actions
+	Action string `json:"action,omitempty"`
+	// Reason is recorded on the message when the plugin changed it
+	Reason string `json:"reason,omitempty"`
+}
+
+type filterPlugin struct {
+	name string
+	path string
+}
+
+type pluginPipeline struct {
+	plugins    []filterPlugin
+	timeout    time.Duration
+	failAction string
+}
+
+var filterPlugins = &pluginPipeline{}
+
+// configurePlugins checks the plugin executables exist
+func configurePlugins(config PluginConfig) error {
+	if config.FailAction != "" && !validFilterAction(config.FailAction) {
+		return fmt.Errorf("FILTER_PLUGIN_FAIL_ACTION must be empty, %q, %q, %q or %q", filterActionMask, filterActionHold, filterActionBlock, filterActionBan)
+	}
+	if config.Timeout <= 0 {
+		return fmt.Errorf("FILTER_PLUGIN_TIMEOUT_MS must be positive")
+	}
+
+	pipeline := &pluginPipeline{timeout: config.Timeout, failAction: config.FailAction}
+	for _, path := range config.Paths {
+		resolved, err := resolveExecutable(path)
+		if err != nil {
+			return fmt.Errorf("filter plugin %s: %w", path, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(resolved), filepath.Ext(resolved))
+		pipeline.plugins = append(pipeline.plugins, filterPlugin{name: name, path: resolved})
+	}
+	if len(pipeline.plugins) > 0 {
+		log.Printf("Loaded %d filter plugins", len(pipeline.plugins))
+	}
+	filterPlugins = pipeline
+	return nil
+}
+
+// apply passes msg through every plugin in turn and returns the strictest of
+// action and the actions they asked for. Each plugin sees the text as the
+// ones before it left it. Without holds, for want of a moderation queue,
+// plugins asking to hold a message block it instead.
+func (p *pluginPipeline) apply(ctx context.Context, hub *Hub, msg *Message, action string, holds bool) string {
+	for _, plugin := range p.plugins {
+		response, err := p.run(ctx, plugin, msg)
+		if err != nil {
+			slog.WarnContext(ctx, "Filter plugin failed", "plugin", plugin.name, "session_id", msg.SessionID, "error", err)
+			hub.metrics.inc(metricPluginFailures, MetricLabels{Channel: msg.Channel, Kind: plugin.name}, 1)
+			if filterActionRank[p.failAction] > filterActionRank[action] {
+				action = p.failAction
+			}
+			continue
+		}
+
+		original := msg.Message
+		changed := false
+		for _, field := range []struct {
+			text        *string
+			replacement *string
+		}{{&msg.Name, response.Name}, {&msg.Description, response.Description}, {&msg.Message, response.Message}} {
+			if field.replacement != nil && *field.replacement != *field.text {
+				*field.text = *field.replacement
+				changed = true
+			}
+		}
+		if changed || response.Action != "" {
+			if !msg.Filtered {
+				msg.Filtered = true
+				msg.OriginalMessage = original
+			}
+			msg.FilterReasons = append(msg.FilterReasons, "plugin:"+plugin.name+reasonSuffix(response.Reason))
+		}
+		if response.Action == filterActionHold && !holds {
+			response.Action = filterActionBlock
+		}
+		if filterActionRank[response.Action] > filterActionRank[action] {
+			action = response.Action
+		}
+	}
+	return action
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ":" + reason
+}
+
+// run runs a plugin on a message
+func (p *pluginPipeline) run(ctx context.Context, plugin filterPlugin, msg *Message) (PluginResponse, error) {
+	var response PluginResponse
+	input, err := json.Marshal(PluginRequest{
+		Version:     filterPluginVersion,
+		SessionID:   msg.SessionID,
+		Channel:     msg.Channel,
+		Name:        msg.Name,
+		Description: msg.Description,
+		Message:     msg.Message,
+		Amount:      msg.Amount,
+		Currency:    msg.Currency,
+		Anonymous:   msg.Anonymous,
+		Reasons:     msg.FilterReasons,
+	})
+	if err != nil {
+		return response, err
+	}
+	output, err := runExecutable(ctx, plugin.path, input, p.timeout)
+	if err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(output), &response); err != nil {
+		return response, fmt.Errorf("invalid output: %w", err)
+	}
+	if response.Action != "" && !validFilterAction(response.Action) {
+		return response, fmt.Errorf("unknown action %q", response.Action)
+	}
+	return response, nil
+}
+
+// runExecutable runs path with input on stdin and returns its stdout. It
+// starts in an empty directory with nothing in its environment but PATH, and
+// is killed when it overruns the timeout or writes more than maxPluginOutput.
+func runExecutable(ctx context.Context, path string, input []byte, timeout time.Duration) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "tts-exec-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Dir = dir
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "TMPDIR=" + dir}
+	cmd.Stdin = bytes.NewReader(input)
+	stdout := &limitedBuffer{limit: maxPluginOutput}
+	stderr := &limitedBuffer{limit: maxPluginOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// Children it started can keep its pipes open after it is killed
+	cmd.WaitDelay = 100 * time.Millisecond
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.overflowed {
+		return nil, errors.New("output is too long")
+	}
+	return stdout.Bytes(), nil
+}
+
+// resolveExecutable finds an executable on PATH, or by its path
+func resolveExecutable(path string) (string, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
+
+// limitedBuffer keeps the first limit bytes written to it and fails writes
+// past that, which ends a plugin writing without end
+type limitedBuffer struct {
+	bytes.Buffer
+	limit      int
+	overflowed bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.limit {
+		b.overflowed = true
+		b.Buffer.Write(p[:b.limit-b.Len()])
+		return 0, errors.New("plugin output is too long")
+	}
+	return b.Buffer.Write(p)
+}
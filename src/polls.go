@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Poll is a donation-weighted vote that closes automatically at its deadline
+type Poll struct {
+	ID        int64         `json:"id"`
+	Title     string        `json:"title"`
+	Choices   []TallyOption `json:"choices"`
+	Open      bool          `json:"open"`
+	ClosesAt  *time.Time    `json:"closes_at,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	ClosedAt  *time.Time    `json:"closed_at,omitempty"`
+	Winner    string        `json:"winner,omitempty"`
+	Results   []Tally       `json:"results"`
+}
+
+// PollResults is the payload of poll_results and poll_closed events
+type PollResults struct {
+	ID      int64   `json:"id"`
+	Title   string  `json:"title"`
+	Results []Tally `json:"results"`
+	Winner  string  `json:"winner,omitempty"`
+}
+
+// CreatePollRequest is the body of POST /admin/polls
+type CreatePollRequest struct {
+	Title           string        `json:"title"`
+	Choices         []TallyOption `json:"choices"`
+	DurationSeconds int           `json:"duration_seconds"`
+}
+
+type pollRegistry struct {
+	mutex  sync.Mutex
+	open   map[int64]*Poll
+	timers map[int64]Timer
+}
+
+var polls = &pollRegistry{
+	open:   make(map[int64]*Poll),
+	timers: make(map[int64]Timer),
+}
+
+// loadPolls restores open polls after a restart and re-arms their deadlines,
+// announcing the results on hub
+func loadPolls(hub *Hub) {
+	open, err := hub.db.getOpenPolls()
+	if err != nil {
+		log.Printf("Error loading open polls: %v", err)
+		return
+	}
+
+	for i := range open {
+		polls.track(hub, &open[i])
+	}
+}
+
+// track registers an open poll and schedules its automatic close
+func (r *pollRegistry) track(hub *Hub, poll *Poll) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.open[poll.ID] = poll
+	if poll.ClosesAt != nil {
+		id := poll.ID
+		r.timers[id] = clock.AfterFunc(poll.ClosesAt.Sub(clock.Now()), func() {
+			if _, err := finishPoll(hub, id); err != nil {
+				log.Printf("Error auto-closing poll %d: %v", id, err)
+			}
+		})
+	}
+}
+
+// untrack removes a poll from the registry, returning it if it was open
+func (r *pollRegistry) untrack(id int64) (*Poll, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	poll, ok := r.open[id]
+	delete(r.open, id)
+	if timer, ok := r.timers[id]; ok {
+		timer.Stop()
+		delete(r.timers, id)
+	}
+	return poll, ok
+}
+
+// applyVotes attributes a donation to every open poll it matches
+func applyVotes(hub *Hub, msg Message) {
+	if msg.Amount <= 0 {
+		return
+	}
+
+	polls.mutex.Lock()
+	var events []PollResults
+	for _, poll := range polls.open {
+		choice, ok := matchOption(poll.Choices, msg.PollChoice, msg.Message)
+		if !ok {
+			continue
+		}
+
+		if err := hub.db.addVote(poll.ID, choice.Key, msg.SessionID, msg.Name, msg.Amount); err != nil {
+			log.Printf("Error recording vote for poll %d: %v", poll.ID, err)
+			continue
+		}
+
+		for i := range poll.Results {
+			if poll.Results[i].Key == choice.Key {
+				poll.Results[i].Total += msg.Amount
+				poll.Results[i].Bids++
+			}
+		}
+
+		events = append(events, PollResults{
+			ID:      poll.ID,
+			Title:   poll.Title,
+			Results: append([]Tally(nil), poll.Results...),
+		})
+	}
+	polls.mutex.Unlock()
+
+	for _, event := range events {
+		hub.publishEvent("", EventPollResults, event)
+	}
+}
+
+// finishPoll closes a poll, announces the winner and broadcasts the final results
+func finishPoll(hub *Hub, id int64) (*Poll, error) {
+	if _, ok := polls.untrack(id); !ok {
+		return nil, fmt.Errorf("poll %d is not open", id)
+	}
+
+	poll, err := hub.db.getPoll(id)
+	if err != nil {
+		return nil, err
+	}
+
+	winner, hasWinner := leader(poll.Results)
+	if hasWinner {
+		poll.Winner = winner.Key
+	}
+
+	closed, err := hub.db.closePoll(id, poll.Winner)
+	if err != nil {
+		return nil, err
+	}
+	if !closed {
+		return nil, fmt.Errorf("poll %d was already closed", id)
+	}
+	poll.Open = false
+
+	hub.publishEvent("", EventPollClosed, PollResults{
+		ID:      poll.ID,
+		Title:   poll.Title,
+		Results: poll.Results,
+		Winner:  poll.Winner,
+	})
+
+	// Read the result out loud like any other alert
+	announcement := fmt.Sprintf("The poll %q has closed with no votes.", poll.Title)
+	if hasWinner {
+		announcement = fmt.Sprintf("The poll %q has closed. The winner is %s with %.2f.", poll.Title, winner.Label, winner.Total)
+	}
+	hub.dispatch(Message{
+		SessionID: fmt.Sprintf("poll-%d", poll.ID),
+		Name:      "Poll",
+		Message:   announcement,
+	})
+
+	log.Printf("Poll %d closed, winner: %q", poll.ID, poll.Winner)
+	return poll, nil
+}
+
+func (s *Server) createPollHandler(c *gin.Context) {
+	var req CreatePollRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	if req.Title == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A title is required"})
+		return
+	}
+	if err := validateOptions(req.Choices); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.DurationSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Duration must not be negative"})
+		return
+	}
+
+	var closesAt *time.Time
+	if req.DurationSeconds > 0 {
+		deadline := clock.Now().Add(time.Duration(req.DurationSeconds) * time.Second)
+		closesAt = &deadline
+	}
+
+	poll, err := s.db.createPoll(req.Title, req.Choices, closesAt)
+	if err != nil {
+		log.Printf("Error creating poll: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create poll"})
+		return
+	}
+	polls.track(s.hub, poll)
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s started poll %d: %s", user, poll.ID, poll.Title)
+	c.JSON(http.StatusCreated, poll)
+}
+
+func (s *Server) listPollsHandler(c *gin.Context) {
+	all, err := s.db.listPolls()
+	if err != nil {
+		log.Printf("Error listing polls: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list polls"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"polls": all})
+}
+
+func (s *Server) closePollHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid poll ID"})
+		return
+	}
+
+	poll, err := finishPoll(s.hub, id)
+	if err != nil {
+		log.Printf("Error closing poll %d: %v", id, err)
+		c.JSON(http.StatusConflict, gin.H{"error": "Poll is not open"})
+		return
+	}
+	c.JSON(http.StatusOK, poll)
+}
+
+// pollStatsHandler serves the live or final results of a poll
+func (s *Server) pollStatsHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid poll ID"})
+		return
+	}
+
+	poll, err := s.db.getPoll(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Poll not found"})
+		return
+	}
+	c.JSON(http.StatusOK, poll)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Stream lifecycle events, sent to outbound webhooks and to listeners
+const (
+	webhookStreamStarted = "stream.started"
+	webhookStreamStopped = "stream.stopped"
+	EventStreamStarted   = "stream_started"
+	EventStreamStopped   = "stream_stopped"
+)
+
+// StreamLifecycle is the data of the stream lifecycle events. A channel's
+// stream is taken to run from its first listener connecting to its last one
+// disconnecting.
+type StreamLifecycle struct {
+	Channel   string     `json:"channel"`
+	StartedAt time.Time  `json:"started_at"`
+	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+	// DurationSeconds is set on stream_stopped
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// lifecyclePayload is the JSON body POSTed to webhooks for lifecycle events
+type lifecyclePayload struct {
+	ID        string          `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      StreamLifecycle `json:"data"`
+}
+
+type channelPresence struct {
+	startedAt time.Time
+	// stopping is set while the channel has no listeners, until the grace
+	// period is over; generation tells a stale timer from the current one
+	stopping   Timer
+	generation int
+}
+
+// presenceState tracks which channels have listeners on a hub
+type presenceState struct {
+	mutex    sync.Mutex
+	channels map[string]*channelPresence
+	// grace is how long a channel can go without listeners before its
+	// stream counts as stopped, so overlays reloading or reconnecting don't
+	// stop and start it again
+	grace time.Duration
+	// lifecycle turns the lifecycle events on. Streams are tracked either
+	// way, as transcripts are kept per stream.
+	lifecycle bool
+}
+
+// listenerJoined is called when a channel gains its first listener. Must be
+// called with the hub mutex held.
+func (hub *Hub) listenerJoined(channel string) {
+	hub.presence.mutex.Lock()
+	defer hub.presence.mutex.Unlock()
+	state, ok := hub.presence.channels[channel]
+	if ok {
+		// Back within the grace period, so the stream never stopped
+		if state.stopping != nil {
+			state.stopping.Stop()
+			state.stopping = nil
+			state.generation++
+		}
+		return
+	}
+
+	state = &channelPresence{startedAt: clock.Now().UTC()}
+	hub.presence.channels[channel] = state
+	go hub.heartbeat(channel)
+	if hub.presence.lifecycle {
+		lifecycle := StreamLifecycle{Channel: channel, StartedAt: state.startedAt}
+		go hub.announceLifecycle(webhookStreamStarted, EventStreamStarted, lifecycle)
+	}
+}
+
+// listenerLeft is called when a channel loses its last listener. Listeners
+// leaving a draining hub are moving to another instance, so their streams
+// don't stop. Must be called with the hub mutex held.
+func (hub *Hub) listenerLeft(channel string, draining bool) {
+	if draining {
+		return
+	}
+	hub.presence.mutex.Lock()
+	defer hub.presence.mutex.Unlock()
+	state, ok := hub.presence.channels[channel]
+	if !ok || state.stopping != nil {
+		return
+	}
+
+	state.generation++
+	generation := state.generation
+	state.stopping = clock.AfterFunc(hub.presence.grace, func() {
+		hub.presence.mutex.Lock()
+		if hub.presence.channels[channel] != state || state.generation != generation {
+			hub.presence.mutex.Unlock()
+			return
+		}
+		delete(hub.presence.channels, channel)
+		hub.presence.mutex.Unlock()
+		stoppedAt := clock.Now().UTC()
+		if !hub.presence.lifecycle {
+			return
+		}
+
+		hub.announceLifecycle(webhookStreamStopped, EventStreamStopped, StreamLifecycle{
+			Channel:         channel,
+			StartedAt:       state.startedAt,
+			StoppedAt:       &stoppedAt,
+			DurationSeconds: stoppedAt.Sub(state.startedAt).Round(time.Second).Seconds(),
+		})
+	})
+}
+
+// streamStartedAt returns when the stream on channel started, if it is running
+func (hub *Hub) streamStartedAt(channel string) (time.Time, bool) {
+	hub.presence.mutex.Lock()
+	defer hub.presence.mutex.Unlock()
+	state, ok := hub.presence.channels[channel]
+	if !ok {
+		return time.Time{}, false
+	}
+	return state.startedAt, true
+}
+
+// startStreamHeartbeats keeps the streams of the channels with listeners on
+// this instance running in the database, every third of the grace period.
+// Every instance does, so a stream runs while any of them has the channel's
+// listeners, and stops once none has for the grace period; donor streaks
+// count streams by them.
+func (hub *Hub) startStreamHeartbeats() {
+	go func() {
+		ticker := time.NewTicker(hub.streamStaleAfter() / 3)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, channel := range hub.listenedChannels() {
+				if !hub.heartbeat(channel) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// streamStaleAfter is how long a stream runs on without heartbeats: the
+// grace period, or three seconds if that is shorter, so that a heartbeat
+// arriving a little late doesn't stop it
+func (hub *Hub) streamStaleAfter() time.Duration {
+	return max(hub.presence.grace, 3*time.Second)
+}
+
+// listenedChannels are the channels with listeners on this instance, leaving
+// out those in their grace period
+func (hub *Hub) listenedChannels() []string {
+	hub.presence.mutex.Lock()
+	defer hub.presence.mutex.Unlock()
+	channels := make([]string, 0, len(hub.presence.channels))
+	for channel, state := range hub.presence.channels {
+		if state.stopping == nil {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// heartbeat records that a channel's stream is running, reporting false if
+// streams can't be recorded at all
+func (hub *Hub) heartbeat(channel string) bool {
+	err := hub.db.touchStream(channel, hub.streamStaleAfter())
+	if errors.Is(err, errPostgresRequired) {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error recording stream on channel %s: %v", channel, err)
+	}
+	return true
+}
+
+// announceLifecycle tells listeners and subscribed webhooks a stream started
+// or stopped
+func (hub *Hub) announceLifecycle(webhookEvent string, event string, lifecycle StreamLifecycle) {
+	log.Printf("Announcing %s on channel %s", webhookEvent, lifecycle.Channel)
+	hub.publishEvent(lifecycle.Channel, event, lifecycle)
+
+	targets := hub.webhookTargets(webhookEvent, lifecycle.Channel)
+	if len(targets) == 0 {
+		return
+	}
+	payload := lifecyclePayload{ID: newDeliveryID(), Event: webhookEvent, CreatedAt: time.Now().UTC(), Data: lifecycle}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling %s webhook: %v", webhookEvent, err)
+		return
+	}
+	for _, webhook := range targets {
+		go hub.deliverWebhook(pendingDelivery{webhook.ID, payload.ID, webhookEvent, body, 1}, webhook)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MessagePreview is what a message would look and sound like on stream
+type MessagePreview struct {
+	// Accepted is false when sending the message would be refused, for the
+	// Reasons given
+	Accepted bool     `json:"accepted"`
+	Reasons  []string `json:"reasons"`
+	// Held is set when an accepted message would wait for a moderator
+	Held bool `json:"held,omitempty"`
+	// Truncated is set when the message is cut to what the amount pays for
+	Truncated bool `json:"truncated,omitempty"`
+	// Voice is the voice the message is read in, after any downgrade to one
+	// the amount unlocks; DowngradedFrom is the voice asked for
+	Voice          string `json:"voice,omitempty"`
+	DowngradedFrom string `json:"downgraded_from,omitempty"`
+	Channel        string `json:"channel"`
+	// Name, Message and Description are as shown, after the content filter
+	// and the anonymity template
+	Name        string `json:"name"`
+	Message     string `json:"message"`
+	Description string `json:"description"`
+	Anonymous   bool   `json:"anonymous,omitempty"`
+	// Spoken is the exact text read out; it is empty during quiet hours
+	Spoken     string `json:"spoken"`
+	DurationMS int64  `json:"duration_ms"`
+	Quiet      bool   `json:"quiet,omitempty"`
+	// Filtered is set when the content filter changed or blocked the message
+	Filtered      bool     `json:"filtered,omitempty"`
+	FilterReasons []string `json:"filter_reasons,omitempty"`
+	Emotes        []Emote  `json:"emotes,omitempty"`
+}
+
+// previewMessage runs a message through the checks and rendering sending it
+// would, without storing, synthesizing or broadcasting anything
+func previewMessage(hub *Hub, msg Message) MessagePreview {
+	var reasons []string
+	if msg.Message == "" {
+		reasons = append(reasons, "Message cannot be empty")
+	}
+	if reason := checkSendLimits(hub, msg); reason != "" {
+		reasons = append(reasons, reason)
+	}
+	if reason := voices.check(msg); reason != "" {
+		reasons = append(reasons, reason)
+	}
+	if reason := checkPricing(hub, msg); reason != "" {
+		reasons = append(reasons, reason)
+	}
+	if _, banned := matchBannedName(msg.Name, hub.channelSettings(msg.Channel).BannedNames); banned {
+		reasons = append(reasons, "Donor name is not allowed")
+	}
+	downgradedFrom := voices.fit(&msg)
+	truncated := applyPricing(hub, &msg)
+	action := hub.filter.apply(hub, &msg)
+	if action == filterActionBlock || action == filterActionBan || (msg.Message == "" && msg.OriginalMessage != "") {
+		reasons = append(reasons, "Message was blocked by the content filter")
+	}
+
+	anonymize(hub, &msg)
+	annotateEmotes(&msg)
+	// Sending replaces any audio with the server's own, so the estimate goes by the text
+	msg.Audio = nil
+	msg.Quiet = hub.isQuiet(msg.Channel)
+
+	preview := MessagePreview{
+		Accepted:       len(reasons) == 0,
+		Held:           hub.moderation || action == filterActionHold,
+		Truncated:      truncated,
+		Voice:          msg.Voice,
+		DowngradedFrom: downgradedFrom,
+		Reasons:        reasons,
+		Channel:        msg.Channel,
+		Name:           msg.Name,
+		Message:        msg.Message,
+		Description:    msg.Description,
+		Anonymous:      msg.Anonymous,
+		Quiet:          msg.Quiet,
+		Filtered:       msg.Filtered,
+		FilterReasons:  msg.FilterReasons,
+		Emotes:         msg.Emotes,
+		DurationMS:     hub.playback.clipDuration(&msg).Milliseconds(),
+	}
+	if !msg.Quiet {
+		preview.Spoken = spokenText(&msg)
+	}
+	if preview.Reasons == nil {
+		preview.Reasons = []string{}
+	}
+	return preview
+}
+
+// previewHandler shows a donor what their message would look and sound like.
+// Refusals are part of the preview, in the request's language, so it answers
+// 200 for any well-formed message.
+func (s *Server) previewHandler(c *gin.Context) {
+	var msg Message
+	if err := c.ShouldBindJSON(&msg); err != nil {
+		localizedError(c, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	if msg.Channel == "" {
+		if key := apiKeyFrom(c); key != nil {
+			msg.Channel = key.Channel
+		}
+	}
+	if msg.Channel == "" {
+		msg.Channel = requestChannel(c)
+	}
+	if !validChannelName(msg.Channel) {
+		localizedError(c, http.StatusBadRequest, "Invalid channel name")
+		return
+	}
+
+	preview := previewMessage(s.hub, msg)
+	for i, reason := range preview.Reasons {
+		preview.Reasons[i] = localizeFor(c, reason)
+	}
+	c.JSON(http.StatusOK, preview)
+}
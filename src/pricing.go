@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What happens to a message longer than its amount pays for
+const (
+	pricingTruncate = "truncate"
+	pricingReject   = "reject"
+)
+
+// PricingSettings makes message length a function of the amount: each 1.00
+// buys CharactersPerUnit characters and SecondsPerUnit seconds of speech on
+// top of the free allowance. A rate of 0 leaves that dimension unpriced.
+type PricingSettings struct {
+	CharactersPerUnit float64 `json:"characters_per_unit"`
+	FreeCharacters    int     `json:"free_characters"`
+	// Seconds are reckoned at the reading speed alert playback is estimated at
+	SecondsPerUnit float64 `json:"seconds_per_unit"`
+	FreeSeconds    float64 `json:"free_seconds"`
+	// Overflow is truncate (the default) or reject. Only /ws/send rejects;
+	// payment webhooks are for donations already made, so they are truncated.
+	Overflow string `json:"overflow,omitempty"`
+}
+
+// MessageAllowance is how much message an amount pays for; -1 is no limit
+type MessageAllowance struct {
+	Characters int `json:"characters"`
+	Seconds    int `json:"seconds"`
+	// Words is Seconds as a number of words at the reading speed
+	Words int `json:"words"`
+}
+
+func (p PricingSettings) enabled() bool {
+	return p.CharactersPerUnit > 0 || p.SecondsPerUnit > 0
+}
+
+func (p PricingSettings) validate() error {
+	if p.CharactersPerUnit < 0 || p.SecondsPerUnit < 0 || p.FreeCharacters < 0 || p.FreeSeconds < 0 {
+		return fmt.Errorf("pricing rates and allowances must not be negative")
+	}
+	if p.Overflow != "" && p.Overflow != pricingTruncate && p.Overflow != pricingReject {
+		return fmt.Errorf("pricing overflow must be %q or %q", pricingTruncate, pricingReject)
+	}
+	return nil
+}
+
+// allowance is what amount pays for, with words counted at wordsPerSecond
+func (p PricingSettings) allowance(amount float32, wordsPerSecond float64) MessageAllowance {
+	allowance := MessageAllowance{Characters: -1, Seconds: -1, Words: -1}
+	if p.CharactersPerUnit > 0 {
+		allowance.Characters = p.FreeCharacters + int(math.Floor(float64(amount)*p.CharactersPerUnit))
+	}
+	if p.SecondsPerUnit > 0 {
+		seconds := p.FreeSeconds + float64(amount)*p.SecondsPerUnit
+		allowance.Seconds = int(math.Floor(seconds))
+		allowance.Words = int(math.Floor(seconds * wordsPerSecond))
+	}
+	return allowance
+}
+
+// checkPricing returns why msg would be rejected for being longer than its
+// amount pays for, or "" when it fits or the channel truncates instead
+func checkPricing(hub *Hub, msg Message) string {
+	pricing := hub.channelSettings(msg.Channel).Pricing
+	if !pricing.enabled() || pricing.Overflow != pricingReject {
+		return ""
+	}
+	allowance := pricing.allowance(msg.Amount, hub.playback.wordsPerSecond())
+	if allowance.Characters >= 0 && utf8.RuneCountInString(msg.Message) > allowance.Characters {
+		return fmt.Sprintf("Message is longer than %d characters", allowance.Characters)
+	}
+	if allowance.Words >= 0 && len(strings.Fields(msg.Message)) > allowance.Words {
+		return fmt.Sprintf("Message is longer than %d seconds of speech", allowance.Seconds)
+	}
+	return ""
+}
+
+// applyPricing cuts msg's message down to what its amount pays for and
+// reports whether it had to
+func applyPricing(hub *Hub, msg *Message) bool {
+	pricing := hub.channelSettings(msg.Channel).Pricing
+	if !pricing.enabled() {
+		return false
+	}
+	allowance := pricing.allowance(msg.Amount, hub.playback.wordsPerSecond())
+	truncated := false
+	if allowance.Words >= 0 {
+		if words := strings.Fields(msg.Message); len(words) > allowance.Words {
+			msg.Message = strings.Join(words[:allowance.Words], " ")
+			truncated = true
+		}
+	}
+	if allowance.Characters >= 0 && utf8.RuneCountInString(msg.Message) > allowance.Characters {
+		msg.Message = strings.TrimSpace(string([]rune(msg.Message)[:allowance.Characters]))
+		truncated = true
+	}
+	return truncated
+}
+
+// pricingHandler publishes a channel's pricing so donation frontends can show
+// donors how much message their amount buys, optionally for ?amount=
+func (s *Server) pricingHandler(c *gin.Context) {
+	channel := c.Param("channel")
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+
+	pricing := s.hub.channelSettings(channel).Pricing
+	response := gin.H{"channel": channel, "enabled": pricing.enabled(), "pricing": pricing}
+	if amount := c.Query("amount"); amount != "" && pricing.enabled() {
+		value, err := strconv.ParseFloat(amount, 32)
+		if err != nil || value < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'amount' parameter"})
+			return
+		}
+		response["allowance"] = pricing.allowance(float32(value), s.hub.playback.wordsPerSecond())
+	}
+	c.JSON(http.StatusOK, response)
+}
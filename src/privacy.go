@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnonymityConfig controls how anonymous donations are presented and stored
+type AnonymityConfig struct {
+	Name                string
+	DescriptionTemplate string
+	key                 []byte
+}
+
+var anonymity = AnonymityConfig{
+	Name:                "Anonymous",
+	DescriptionTemplate: "An anonymous supporter donated {amount}",
+}
+
+// configureAnonymity sets the display strings and the key used to encrypt donor names.
+// The key is base64 encoded and must decode to 16, 24 or 32 bytes.
+func configureAnonymity(config *Config) error {
+	anonymity.Name = config.AnonymousName
+	anonymity.DescriptionTemplate = config.AnonymousTemplate
+
+	if config.DonorNameKey == "" {
+		log.Println("Warning: DONOR_NAME_KEY not set, anonymous donor names will not be retained")
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.DonorNameKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode DONOR_NAME_KEY: %w", err)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("invalid DONOR_NAME_KEY: %w", err)
+	}
+	anonymity.key = key
+
+	return nil
+}
+
+// anonymize hides the donor name on a message, keeping an encrypted copy for storage
+func anonymize(hub *Hub, msg *Message) {
+	if !msg.Anonymous {
+		return
+	}
+
+	if anonymity.key != nil {
+		encrypted, err := encryptField(anonymity.key, msg.Name)
+		if err != nil {
+			log.Printf("Error encrypting donor name for session %s: %v", msg.SessionID, err)
+		} else {
+			msg.EncryptedName = encrypted
+		}
+	}
+
+	msg.Name = anonymity.Name
+	if msg.Description == "" {
+		msg.Description = strings.ReplaceAll(anonymity.DescriptionTemplate, "{amount}", templateAmount(hub, msg.Channel, msg.Amount, msg.Currency))
+	}
+}
+
+// encryptField seals plaintext with AES-GCM, prefixing the random nonce
+func encryptField(key []byte, plaintext string) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, []byte(plaintext), nil), nil
+}
+
+// decryptField opens a value produced by encryptField
+func decryptField(key []byte, sealed []byte) (string, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// revealDonorHandler decrypts the real name behind an anonymous donation, for accounting
+func (s *Server) revealDonorHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	if anonymity.key == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Donor name encryption is not configured"})
+		return
+	}
+
+	sealed, err := s.db.getEncryptedName(sessionID)
+	if err != nil {
+		log.Printf("Error loading donor name for session %s: %v", sessionID, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "No anonymous donation for this session"})
+		return
+	}
+
+	name, err := decryptField(anonymity.key, sealed)
+	if err != nil {
+		log.Printf("Error decrypting donor name for session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt donor name"})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s revealed anonymous donor for session %s", user, sessionID)
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "name": name})
+}
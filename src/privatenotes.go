@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// privateNoteField is the /ws/send field donors' frontends send the
+// encrypted note in
+const privateNoteField = "private_note"
+
+// maxPrivateNoteBytes bounds a private note's ciphertext, once decoded
+const maxPrivateNoteBytes = 4096
+
+// maxPrivateNoteKeyLength bounds the public key a channel publishes
+const maxPrivateNoteKeyLength = 4096
+
+// PrivateNoteSettings let donors send the streamer a note only the streamer
+// can read: donation frontends encrypt it with PublicKey before sending, and
+// the server keeps and hands out the ciphertext as it came. The key is
+// public, see GET /channels/:channel/config.
+type PrivateNoteSettings struct {
+	// PublicKey is the streamer's public key, e.g. an age recipient or a
+	// JWK; the server never reads it, only passes it on
+	PublicKey string `json:"public_key,omitempty"`
+	// Scheme names how notes are encrypted with the key, e.g. "age" or
+	// "RSA-OAEP-256", for frontends that support more than one
+	Scheme string `json:"scheme,omitempty"`
+}
+
+func (s PrivateNoteSettings) enabled() bool {
+	return s.PublicKey != ""
+}
+
+func (s PrivateNoteSettings) validate() error {
+	if len(s.PublicKey) > maxPrivateNoteKeyLength {
+		return fmt.Errorf("private_notes public_key must be at most %d bytes", maxPrivateNoteKeyLength)
+	}
+	// A key pasted from the wrong file would be published to everyone
+	upper := strings.ToUpper(s.PublicKey)
+	if strings.Contains(upper, "PRIVATE KEY") || strings.Contains(upper, "AGE-SECRET-KEY-") || strings.Contains(s.PublicKey, `"d"`) {
+		return errors.New("private_notes public_key looks like a private key")
+	}
+	if s.Scheme != "" && s.PublicKey == "" {
+		return errors.New("private_notes scheme needs a public_key")
+	}
+	return nil
+}
+
+// decodePrivateNote reads the private note out of a native /ws/send body.
+// Messages never serialize it, so it can't reach overlays, feeds or TTS.
+func decodePrivateNote(body []byte, msg *Message) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	if raw, ok := fields[privateNoteField]; ok {
+		return json.Unmarshal(raw, &msg.PrivateNote)
+	}
+	return nil
+}
+
+// checkPrivateNote is why a message's private note is refused, or ""
+func checkPrivateNote(hub *Hub, msg Message) string {
+	if msg.PrivateNote == "" {
+		return ""
+	}
+	if !hub.channelSettings(msg.Channel).PrivateNotes.enabled() {
+		return "This channel does not accept private notes"
+	}
+	// Only ciphertext is taken, so a frontend that forgot to encrypt can't
+	// leave a note readable on the server
+	ciphertext, err := base64.StdEncoding.DecodeString(msg.PrivateNote)
+	if err != nil || len(ciphertext) > maxPrivateNoteBytes {
+		return fmt.Sprintf("Private note must be base64 ciphertext of at most %d bytes", maxPrivateNoteBytes)
+	}
+	return ""
+}
+
+// channelConfigHandler serves the parts of a channel's settings donation
+// frontends need before sending: its pricing and the key to encrypt private
+// notes with
+func (s *Server) channelConfigHandler(c *gin.Context) {
+	channel := c.Param("channel")
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+
+	settings := s.hub.channelSettings(channel)
+	c.JSON(http.StatusOK, gin.H{
+		"channel": channel,
+		"pricing": gin.H{"enabled": settings.Pricing.enabled(), "pricing": settings.Pricing},
+		"private_notes": gin.H{
+			"enabled":    settings.PrivateNotes.enabled(),
+			"public_key": settings.PrivateNotes.PublicKey,
+			"scheme":     settings.PrivateNotes.Scheme,
+		},
+	})
+}
+
+// privateNoteHandler hands a message's private note to the streamer, still
+// encrypted, for them to decrypt with their private key
+func (s *Server) privateNoteHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	note, err := s.db.getPrivateNote(sessionID)
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No private note for this session"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading private note for session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load private note"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "private_note": note})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PaymentProvider is a payment provider that sends donations by webhook.
+// Deliveries are read, verified and then ingested; nothing in a delivery is
+// trusted until Verify has passed.
+type PaymentProvider interface {
+	// Name identifies the provider in audits, PROVIDER_<NAME>_ENABLED and /admin/providers
+	Name() string
+	// Title is the provider's name as shown to people
+	Title() string
+	// Path is where deliveries are routed, under /webhooks/
+	Path() string
+	// Init checks the provider's settings and reports whether it has the
+	// secrets it needs to accept deliveries
+	Init(config PaymentConfig) (bool, error)
+	// Verify authenticates a delivery
+	Verify(c *gin.Context, hub *Hub, body []byte) *sendError
+	// Ingest handles a verified delivery and writes the response, sending
+	// what it accepts to hub
+	Ingest(c *gin.Context, hub *Hub, body []byte)
+}
+
+// Provider health states
+const (
+	providerDisabled      = "disabled"
+	providerNotConfigured = "not_configured"
+	providerWaiting       = "waiting"
+	providerOK            = "ok"
+	providerFailing       = "failing"
+)
+
+// ProviderStatus is the health of a payment provider, as of its last delivery
+type ProviderStatus struct {
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+	Endpoint   string `json:"endpoint"`
+	Enabled    bool   `json:"enabled"`
+	Configured bool   `json:"configured"`
+	// Status is waiting until the first delivery, then ok or failing by
+	// how the last one went
+	Status         string     `json:"status"`
+	Received       int64      `json:"received"`
+	Rejected       int64      `json:"rejected"`
+	Failed         int64      `json:"failed"`
+	LastDeliveryAt *time.Time `json:"last_delivery_at,omitempty"`
+	LastSuccessAt  *time.Time `json:"last_success_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+type registeredProvider struct {
+	provider PaymentProvider
+
+	mutex  sync.Mutex
+	status ProviderStatus
+}
+
+// paymentProviders lists every built-in provider in the order they are shown
+var paymentProviders = []*registeredProvider{
+	{provider: stripeProvider{}},
+	{provider: kofiProvider{}},
+	{provider: patreonProvider{}},
+	{provider: githubSponsorsProvider{}},
+	{provider: bmcProvider{}},
+	{provider: openCollectiveProvider{}},
+	{provider: genericProvider{}},
+}
+
+// providerFlags reads PROVIDER_<NAME>_ENABLED for each provider; providers
+// are enabled unless turned off
+func providerFlags() map[string]bool {
+	flags := make(map[string]bool, len(paymentProviders))
+	for _, entry := range paymentProviders {
+		name := entry.provider.Name()
+		flags[name] = getEnvBoolOrDefault("PROVIDER_"+strings.ToUpper(name)+"_ENABLED", true)
+	}
+	return flags
+}
+
+// configureProviders initializes every enabled provider
+func configureProviders(config PaymentConfig) error {
+	for _, entry := range paymentProviders {
+		provider := entry.provider
+		status := ProviderStatus{
+			Name:     provider.Name(),
+			Title:    provider.Title(),
+			Endpoint: "/webhooks/" + provider.Path(),
+			Enabled:  config.Enabled[provider.Name()],
+		}
+		if status.Enabled {
+			configured, err := provider.Init(config)
+			if err != nil {
+				return err
+			}
+			status.Configured = configured
+		}
+
+		entry.mutex.Lock()
+		entry.status = status
+		entry.mutex.Unlock()
+	}
+	return nil
+}
+
+// routeProviders routes each provider's webhooks, for deliveries to hub
+func routeProviders(r *gin.Engine, hub *Hub) {
+	for _, entry := range paymentProviders {
+		r.POST("/webhooks/"+entry.provider.Path(), func(c *gin.Context) {
+			entry.handle(c, hub)
+		})
+	}
+}
+
+// handle runs a delivery through the provider's lifecycle and records how it went
+func (entry *registeredProvider) handle(c *gin.Context, hub *Hub) {
+	provider := entry.provider
+	entry.mutex.Lock()
+	status := entry.status
+	entry.mutex.Unlock()
+	if !status.Enabled || !status.Configured {
+		c.JSON(http.StatusNotFound, gin.H{"error": provider.Title() + " webhooks are not configured"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	if verr := provider.Verify(c, hub, body); verr != nil {
+		log.Printf("Rejected %s webhook: %s", provider.Title(), verr.message)
+		entry.record(verr.status, verr.message)
+		c.JSON(verr.status, gin.H{"error": verr.message})
+		return
+	}
+
+	provider.Ingest(c, hub, body)
+	code := c.Writer.Status()
+	if code < http.StatusBadRequest {
+		entry.record(code, "")
+	} else {
+		entry.record(code, http.StatusText(code))
+	}
+}
+
+// record notes the outcome of a delivery
+func (entry *registeredProvider) record(code int, failure string) {
+	now := time.Now()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	status := &entry.status
+	status.LastDeliveryAt = &now
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusNotFound:
+		status.Rejected++
+	case code >= http.StatusBadRequest:
+		status.Failed++
+	default:
+		status.Received++
+		status.LastSuccessAt = &now
+		status.Status = providerOK
+		return
+	}
+	status.LastError = failure
+	status.LastErrorAt = &now
+	status.Status = providerFailing
+}
+
+// snapshot is the provider's current status
+func (entry *registeredProvider) snapshot() ProviderStatus {
+	entry.mutex.Lock()
+	status := entry.status
+	entry.mutex.Unlock()
+
+	switch {
+	case !status.Enabled:
+		status.Status = providerDisabled
+	case !status.Configured:
+		status.Status = providerNotConfigured
+	case status.Status == "":
+		status.Status = providerWaiting
+	}
+	return status
+}
+
+// listProvidersHandler shows each payment provider and how its deliveries are going
+func listProvidersHandler(c *gin.Context) {
+	providers := make([]ProviderStatus, 0, len(paymentProviders))
+	for _, entry := range paymentProviders {
+		providers = append(providers, entry.snapshot())
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Incidents the public status page can show
+const (
+	incidentProviderOutage  = "provider_outage"
+	incidentDegradedAudio   = "degraded_audio"
+	incidentDeliveryStalled = "delivery_stalled"
+	incidentDatabase        = "database_unreachable"
+)
+
+// outcomeWindow is how far back the public status page's success rates go,
+// in minute buckets
+const outcomeWindow = 60
+
+// outcomes counts successes and failures over the last outcomeWindow minutes
+type outcomes struct {
+	mutex   sync.Mutex
+	buckets [outcomeWindow]outcomeBucket
+}
+
+type outcomeBucket struct {
+	minute    int64
+	succeeded int
+	failed    int
+}
+
+func (o *outcomes) record(ok bool) {
+	minute := clock.Now().Unix() / 60
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	bucket := &o.buckets[minute%outcomeWindow]
+	if bucket.minute != minute {
+		*bucket = outcomeBucket{minute: minute}
+	}
+	if ok {
+		bucket.succeeded++
+	} else {
+		bucket.failed++
+	}
+}
+
+// totals adds up the last window minutes
+func (o *outcomes) totals(window int) (succeeded, failed int) {
+	oldest := clock.Now().Unix()/60 - int64(window)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, bucket := range o.buckets {
+		if bucket.minute > oldest {
+			succeeded += bucket.succeeded
+			failed += bucket.failed
+		}
+	}
+	return succeeded, failed
+}
+
+// broadcastOutcomes counts alerts played against alerts missed, and
+// synthesisOutcomes syntheses against ones that fell back to browser TTS
+var broadcastOutcomes, synthesisOutcomes outcomes
+
+// PublicStatus is what the status page shows. It leaves out anything that
+// says more about the deployment than whether alerts are working.
+type PublicStatus struct {
+	Status    string   `json:"status"`
+	Uptime    float64  `json:"uptime_seconds"`
+	Incidents []string `json:"incidents"`
+	// BroadcastSuccessRate is the share of alerts played rather than missed in
+	// the last hour; it is absent when there were none
+	BroadcastSuccessRate *float64  `json:"broadcast_success_rate,omitempty"`
+	Broadcasts           int       `json:"broadcasts"`
+	Timestamp            time.Time `json:"timestamp"`
+}
+
+func (s *Server) collectPublicStatus(c *gin.Context) PublicStatus {
+	status := PublicStatus{
+		Status:    "operational",
+		Uptime:    time.Since(instance.StartedAt).Seconds(),
+		Incidents: []string{},
+		Timestamp: time.Now(),
+	}
+
+	for provider, health := range s.hub.synthesis.providerHealth() {
+		if provider != engineBrowser && strings.HasPrefix(health, "error") {
+			status.Incidents = append(status.Incidents, incidentProviderOutage)
+		}
+	}
+	// Some of the last 15 minutes' alerts fell back to browser TTS
+	if _, failed := synthesisOutcomes.totals(15); failed > 0 && !containsString(status.Incidents, incidentProviderOutage) {
+		status.Incidents = append(status.Incidents, incidentDegradedAudio)
+	}
+	if selfTest.snapshot().Stalled {
+		status.Incidents = append(status.Incidents, incidentDeliveryStalled)
+	}
+	if !pingDatabase(c.Request.Context(), s.store).OK {
+		status.Incidents = append(status.Incidents, incidentDatabase)
+	}
+
+	played, missed := broadcastOutcomes.totals(outcomeWindow)
+	status.Broadcasts = played + missed
+	if status.Broadcasts > 0 {
+		rate := float64(played) / float64(status.Broadcasts)
+		status.BroadcastSuccessRate = &rate
+	}
+
+	switch {
+	case containsString(status.Incidents, incidentDeliveryStalled) || containsString(status.Incidents, incidentDatabase):
+		status.Status = "outage"
+	case len(status.Incidents) > 0:
+		status.Status = "degraded"
+	}
+	return status
+}
+
+var publicStatusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(rate *float64) string {
+		if rate == nil {
+			return "no alerts yet"
+		}
+		return fmt.Sprintf("%.1f%%", *rate*100)
+	},
+	"uptime": func(seconds float64) string {
+		return (time.Duration(seconds) * time.Second).Round(time.Minute).String()
+	},
+	"incident": func(name string) string {
+		return incidentDescriptions[name]
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="60">
+<title>TTS alerts status</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 3rem auto; padding: 0 1rem; color: #222; }
+.operational { color: #1a7f37; } .degraded { color: #9a6700; } .outage { color: #cf222e; }
+dt { font-weight: bold; margin-top: 1rem; }
+</style>
+</head>
+<body>
+<h1 class="{{.Status}}">{{if eq .Status "operational"}}All systems operational{{else if eq .Status "degraded"}}Partially degraded{{else}}Alerts are down{{end}}</h1>
+{{if .Incidents}}<ul>{{range .Incidents}}<li>{{incident .}}</li>{{end}}</ul>{{end}}
+<dl>
+<dt>Alerts played in the last hour</dt><dd>{{percent .BroadcastSuccessRate}}{{if .Broadcasts}} of {{.Broadcasts}}{{end}}</dd>
+<dt>Up for</dt><dd>{{uptime .Uptime}}</dd>
+</dl>
+<p><small>Updated {{.Timestamp.UTC.Format "2006-01-02 15:04 UTC"}}</small></p>
+</body>
+</html>
+`))
+
+var incidentDescriptions = map[string]string{
+	incidentProviderOutage:  "The text-to-speech provider is failing; alerts are read out by the browser instead",
+	incidentDegradedAudio:   "Some recent alerts were read out by the browser instead of the text-to-speech provider",
+	incidentDeliveryStalled: "Alerts aren't reaching overlays",
+	incidentDatabase:        "Alerts can't be saved",
+}
+
+// publicStatusHandler serves the status page streamers can share with their
+// community: JSON by default, HTML for browsers or with ?format=html
+func (s *Server) publicStatusHandler(c *gin.Context) {
+	status := s.collectPublicStatus(c)
+	c.Header("Cache-Control", "public, max-age=15")
+
+	format := c.Query("format")
+	if format == "html" || (format == "" && c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML) {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		publicStatusTemplate.Execute(c.Writer, status)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
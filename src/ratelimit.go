@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SendLimits protects /ws/send from spam. Rates are requests per minute with
+// bursts of up to the burst size; a rate of 0 turns that limit off, as does 0
+// for any of the sizes and amounts.
+type SendLimits struct {
+	PerIPRate        float64
+	PerIPBurst       int
+	PerSessionRate   float64
+	PerSessionBurst  int
+	MaxBodyBytes     int64
+	MaxMessageLength int
+	MaxNameLength    int
+	MinAmount        float64
+	MaxAmount        float64
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a set of token buckets, one per key (an IP, a session ID).
+// Limits are kept in memory, so each instance enforces its own.
+type rateLimiter struct {
+	mutex sync.Mutex
+	// rate is in tokens per second
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a limiter allowing perMinute requests a minute per
+// key, or nil (which allows everything) when perMinute is 0
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   math.Max(float64(burst), 1),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from key's bucket. When it is empty, it returns how long
+// until the next token is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := clock.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		l.prune(now)
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// take is allow as an error: a *QuotaError when key's bucket is empty
+func (l *rateLimiter) take(key string) error {
+	if ok, wait := l.allow(key); !ok {
+		return &QuotaError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// prune forgets buckets that have refilled, which behave the same as new ones.
+// Must be called with the mutex held.
+func (l *rateLimiter) prune(now time.Time) {
+	if len(l.buckets) < 1024 {
+		return
+	}
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rejectRateLimited answers 429 with the number of seconds to wait
+func rejectRateLimited(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	localizedError(c, http.StatusTooManyRequests, "Too many requests, try again later")
+}
+
+// rateLimit is middleware that limits requests per key, e.g. per client IP
+func rateLimit(limiter *rateLimiter, key func(*gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, wait := limiter.allow(key(c)); !ok {
+			log.Printf("Rate limited %s %s from %s", c.Request.Method, c.FullPath(), c.ClientIP())
+			rejectRateLimited(c, wait)
+		}
+	}
+}
+
+// limitBody is middleware that caps the size of request bodies
+func limitBody(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if maxBytes > 0 {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		}
+	}
+}
+
+// checkSendLimits validates a message against the payload limits, returning
+// the reason it is refused or "" if it is within them
+func checkSendLimits(hub *Hub, msg Message) string {
+	limits := hub.sendLimits
+	if limits.MaxMessageLength > 0 && utf8.RuneCountInString(msg.Message) > limits.MaxMessageLength {
+		return fmt.Sprintf("Message is longer than %d characters", limits.MaxMessageLength)
+	}
+	if limits.MaxNameLength > 0 && utf8.RuneCountInString(msg.Name) > limits.MaxNameLength {
+		return fmt.Sprintf("Name is longer than %d characters", limits.MaxNameLength)
+	}
+	amount := float64(msg.Amount)
+	if math.IsNaN(amount) || math.IsInf(amount, 0) || amount < 0 {
+		return "Amount must be a number of at least 0"
+	}
+	if limits.MinAmount > 0 && amount < limits.MinAmount {
+		return fmt.Sprintf("Amount is below the minimum of %g", limits.MinAmount)
+	}
+	if limits.MaxAmount > 0 && amount > limits.MaxAmount {
+		return fmt.Sprintf("Amount is above the maximum of %g", limits.MaxAmount)
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Receipt codes look like TTS-2024-ABCD12: the year the donation was accepted
+// and its message ID, scrambled so that consecutive donations don't get
+// consecutive codes, in Crockford's base32. IDs past 2^30 get longer codes.
+const (
+	receiptPrefix   = "TTS"
+	receiptAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	receiptDigits   = 6
+	receiptBits     = 5 * receiptDigits
+	receiptMask     = 1<<receiptBits - 1
+	// receiptMultiplier is odd, so multiplying by it modulo 2^30 can be undone
+	receiptMultiplier = 0x2545F491
+	receiptXOR        = 0x15A3C96B & receiptMask
+)
+
+// receiptInverse undoes receiptMultiplier modulo 2^30
+var receiptInverse = func() uint64 {
+	// Each Newton step doubles the bits that are right, from the 3 of x = m
+	inverse := uint64(receiptMultiplier)
+	for i := 0; i < 5; i++ {
+		inverse *= 2 - receiptMultiplier*inverse
+	}
+	return inverse & receiptMask
+}()
+
+var errInvalidReceipt = errors.New("invalid receipt code")
+
+// receiptCode is the receipt of the message with the given ID, accepted at
+func receiptCode(id int64, accepted time.Time) string {
+	low := uint64(id) & receiptMask
+	scrambled := ((low ^ receiptXOR) * receiptMultiplier) & receiptMask
+
+	var body []byte
+	for i := 0; i < receiptDigits; i++ {
+		body = append([]byte{receiptAlphabet[scrambled&31]}, body...)
+		scrambled >>= 5
+	}
+	for high := uint64(id) >> receiptBits; high > 0; high >>= 5 {
+		body = append([]byte{receiptAlphabet[high&31]}, body...)
+	}
+	return fmt.Sprintf("%s-%d-%s", receiptPrefix, accepted.UTC().Year(), body)
+}
+
+// parseReceipt reads the message ID and year out of a receipt code. Codes
+// read out over the phone are forgiven their case and the letters O, I and L
+// for the digits they look like.
+func parseReceipt(code string) (int64, int, error) {
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(code)), "-")
+	if len(parts) != 3 || parts[0] != receiptPrefix || len(parts[2]) < receiptDigits || len(parts[2]) > 13 {
+		return 0, 0, errInvalidReceipt
+	}
+	year, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 4 {
+		return 0, 0, errInvalidReceipt
+	}
+
+	var value uint64
+	digits := strings.NewReplacer("O", "0", "I", "1", "L", "1").Replace(parts[2])
+	for _, digit := range digits {
+		index := strings.IndexRune(receiptAlphabet, digit)
+		if index < 0 || value>>59 != 0 {
+			return 0, 0, errInvalidReceipt
+		}
+		value = value<<5 | uint64(index)
+	}
+	low := ((value&receiptMask)*receiptInverse)&receiptMask ^ receiptXOR
+	id := (value>>receiptBits)<<receiptBits | low
+	if id == 0 || id > 1<<63-1 {
+		return 0, 0, errInvalidReceipt
+	}
+	return int64(id), year, nil
+}
+
+// lookupReceiptHandler finds the donation a receipt code was given for, for
+// support and payment disputes
+func (s *Server) lookupReceiptHandler(c *gin.Context) {
+	code := c.Param("code")
+	id, year, err := parseReceipt(code)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid receipt code"})
+		return
+	}
+
+	msg, err := s.store.GetMessageByID(c.Request.Context(), id)
+	if errors.Is(err, errMessageNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error looking up receipt %s: %v", code, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up receipt"})
+		return
+	}
+	// A code with the right ID but the wrong year is someone guessing. The
+	// row is written just after the code is made, so a donation accepted
+	// right before New Year may be stored right after.
+	created := msg.CreatedAt.UTC()
+	if year != created.Year() && year != created.Add(-time.Minute).Year() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Receipt not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"receipt": receiptCode(id, time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)), "message": msg})
+}
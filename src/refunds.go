@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// What happens on a channel when a refund is recorded against one of its
+// donations
+const (
+	refundIgnore   = "ignore"
+	refundEvent    = "event"
+	refundAnnounce = "announce"
+)
+
+// EventDonationRefunded tells overlays such as leaderboards to take a refunded
+// donation off their totals
+const EventDonationRefunded = "donation_refunded"
+
+const defaultRefundTemplate = "Correction: {name}'s donation of {amount} was refunded"
+
+// RefundSettings is how a channel's overlays hear about refunds. With the
+// ignore policy (the default) they don't; event publishes donation_refunded,
+// and announce also plays a correction alert read from Template.
+type RefundSettings struct {
+	Policy string `json:"policy,omitempty"`
+	// Template may use {name}, {amount} and {reason}
+	Template string `json:"template,omitempty"`
+}
+
+func (r RefundSettings) validate() error {
+	switch r.Policy {
+	case "", refundIgnore, refundEvent, refundAnnounce:
+		return nil
+	}
+	return fmt.Errorf("refunds policy must be %q, %q or %q", refundIgnore, refundEvent, refundAnnounce)
+}
+
+// RefundCorrection marks a correction alert and says what was refunded.
+// Corrections are played like any alert but never stored.
+type RefundCorrection struct {
+	SessionID string  `json:"session_id"`
+	Channel   string  `json:"channel"`
+	Name      string  `json:"name"`
+	Amount    float32 `json:"amount"`
+	Reason    string  `json:"reason,omitempty"`
+}
+
+// refundText is a correction alert's text from a channel's refund template
+func refundText(hub *Hub, settings *ChannelSettings, name string, amount float32, currency string, reason string) string {
+	template := firstNonEmpty(settings.Refunds.Template, defaultRefundTemplate)
+	amountText := formatTemplateAmount(hub, settings.AmountFormat, amount, currency)
+	return strings.NewReplacer("{name}", name, "{amount}", amountText, "{reason}", reason).Replace(template)
+}
+
+// announceRefund tells the refunded donation's channel about the refund, as
+// its refund settings say to
+func announceRefund(hub *Hub, sessionID string, amount float32, reason string) {
+	donation, err := hub.db.getMessageBySession(sessionID)
+	if err != nil {
+		log.Printf("Error loading refunded donation for session %s: %v", sessionID, err)
+		return
+	}
+	settings := hub.channelSettings(donation.Channel).Refunds
+	if settings.Policy == "" || settings.Policy == refundIgnore {
+		return
+	}
+
+	// Anonymous donations are stored under the anonymous name already
+	correction := RefundCorrection{
+		SessionID: sessionID,
+		Channel:   donation.Channel,
+		Name:      donation.Name,
+		Amount:    amount,
+		Reason:    reason,
+	}
+	hub.publishEvent(correction.Channel, EventDonationRefunded, correction)
+	if settings.Policy != refundAnnounce {
+		return
+	}
+
+	msg := Message{
+		SessionID:  "refund-" + sessionID + "-" + newDeliveryID()[:8],
+		Channel:    donation.Channel,
+		Name:       donation.Name,
+		Message:    refundText(hub, hub.channelSettings(donation.Channel), donation.Name, amount, donation.Currency, reason),
+		Anonymous:  donation.Anonymous,
+		Correction: &correction,
+	}
+	if hub.isQuiet(msg.Channel) {
+		msg.Quiet = true
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		synthesizeMessage(ctx, hub, &msg)
+		cancel()
+	}
+	hub.dispatch(msg)
+}
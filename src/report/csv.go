@@ -0,0 +1,48 @@
+package report
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WriteCSV renders the report as CSV with a header row and trailing totals
+func WriteCSV(w io.Writer, r *Report) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write([]string{"time", "kind", "session_id", "name", "amount", "note"}); err != nil {
+		return err
+	}
+
+	for _, entry := range r.Entries {
+		record := []string{
+			entry.Time.UTC().Format(time.RFC3339),
+			entry.Kind,
+			entry.SessionID,
+			entry.Name,
+			formatAmount(entry.Amount),
+			entry.Note,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	gross, refunds, net := r.Totals()
+	totals := [][]string{
+		{"", "total_donations", "", "", formatAmount(gross), ""},
+		{"", "total_refunds", "", "", formatAmount(refunds), ""},
+		{"", "net", "", "", formatAmount(net), ""},
+		{r.GeneratedAt.UTC().Format(time.RFC3339), "generated_at", "", "", "", r.Period},
+	}
+	if err := writer.WriteAll(totals); err != nil {
+		return err
+	}
+
+	return writer.Error()
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
@@ -0,0 +1,132 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	pdfLinesPerPage = 60
+	pdfFontSize     = 9
+	pdfLineHeight   = 12
+	pdfMarginLeft   = 40
+	pdfTop          = 800
+)
+
+// WritePDF renders the report as a plain single-font PDF document
+func WritePDF(w io.Writer, r *Report) error {
+	lines := pdfLines(r)
+
+	var pages [][]string
+	for len(lines) > 0 {
+		n := pdfLinesPerPage
+		if len(lines) < n {
+			n = len(lines)
+		}
+		pages = append(pages, lines[:n])
+		lines = lines[n:]
+	}
+
+	// Objects: 1 catalog, 2 page tree, 3 font, then a page and a content stream per page
+	var objects []string
+	objects = append(objects, "<< /Type /Catalog /Pages 2 0 R >>")
+
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+i*2)
+	}
+	objects = append(objects, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	objects = append(objects, "<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>")
+
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLineHeight, pdfMarginLeft, pdfTop)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+i*2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// pdfLines lays the report out as fixed-width text lines
+func pdfLines(r *Report) []string {
+	gross, refunds, net := r.Totals()
+
+	lines := []string{
+		r.Title,
+		fmt.Sprintf("Period: %s (%s to %s)", r.Period, r.From.UTC().Format("2006-01-02"), r.To.UTC().Format("2006-01-02")),
+		fmt.Sprintf("Generated: %s", r.GeneratedAt.UTC().Format(time.RFC3339)),
+		"",
+		fmt.Sprintf("%-20s %-9s %-24s %-24s %10s", "Time", "Kind", "Session", "Name", "Amount"),
+	}
+
+	for _, entry := range r.Entries {
+		lines = append(lines, fmt.Sprintf("%-20s %-9s %-24s %-24s %10.2f",
+			entry.Time.UTC().Format("2006-01-02 15:04:05"),
+			entry.Kind,
+			truncate(entry.SessionID, 24),
+			truncate(entry.Name, 24),
+			entry.Amount,
+		))
+	}
+
+	lines = append(lines,
+		"",
+		fmt.Sprintf("Total donations: %.2f", gross),
+		fmt.Sprintf("Total refunds:   %.2f", refunds),
+		fmt.Sprintf("Net:             %.2f", net),
+	)
+	return lines
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "~"
+}
+
+// pdfEscape escapes a string for a PDF literal, replacing non-ASCII characters
+// since the built-in fonts only cover Latin-1
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,85 @@
+// Package report renders donation reports for tax and compliance purposes.
+package report
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry kinds
+const (
+	KindDonation = "donation"
+	KindRefund   = "refund"
+)
+
+// Entry is a single line of a report. Refund amounts are positive; the kind
+// decides whether they are added or subtracted.
+type Entry struct {
+	Time      time.Time
+	Kind      string
+	SessionID string
+	Name      string
+	Amount    float64
+	Note      string
+}
+
+// Report is the set of entries for a period along with its metadata
+type Report struct {
+	Title       string
+	Period      string
+	From        time.Time
+	To          time.Time
+	GeneratedAt time.Time
+	Entries     []Entry
+}
+
+// Totals sums the donations and refunds in the report
+func (r *Report) Totals() (gross float64, refunds float64, net float64) {
+	for _, entry := range r.Entries {
+		switch entry.Kind {
+		case KindDonation:
+			gross += entry.Amount
+		case KindRefund:
+			refunds += entry.Amount
+		}
+	}
+	return gross, refunds, gross - refunds
+}
+
+// Sign returns a hex HMAC-SHA256 of the rendered report so recipients can verify it
+func Sign(key []byte, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParsePeriod turns a period name into a half-open [from, to) range in UTC.
+// Supported forms are a year (2024), a quarter (2024-Q2), a month (2024-05)
+// and a day (2024-05-10).
+func ParsePeriod(period string) (time.Time, time.Time, error) {
+	if t, err := time.Parse("2006-01-02", period); err == nil {
+		return t, t.AddDate(0, 0, 1), nil
+	}
+	if t, err := time.Parse("2006-01", period); err == nil {
+		return t, t.AddDate(0, 1, 0), nil
+	}
+	if t, err := time.Parse("2006", period); err == nil {
+		return t, t.AddDate(1, 0, 0), nil
+	}
+
+	if year, quarter, ok := strings.Cut(strings.ToUpper(period), "-Q"); ok {
+		y, err := strconv.Atoi(year)
+		q, qerr := strconv.Atoi(quarter)
+		if err == nil && qerr == nil && q >= 1 && q <= 4 && len(year) == 4 {
+			from := time.Date(y, time.Month((q-1)*3+1), 1, 0, 0, 0, 0, time.UTC)
+			return from, from.AddDate(0, 3, 0), nil
+		}
+	}
+
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q", period)
+}
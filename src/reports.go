@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rheddev/tts-server/src/report"
+)
+
+// RefundRequest is the body of POST /admin/messages/:session_id/refund
+type RefundRequest struct {
+	Amount float32 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+func (s *Server) refundHandler(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	var req RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if req.Amount <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Refund amount must be positive"})
+		return
+	}
+
+	exists, err := s.store.CheckSessionID(c.Request.Context(), sessionID)
+	if err != nil {
+		log.Printf("Error checking session ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session ID"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := s.db.addRefund(sessionID, req.Amount, req.Reason); err != nil {
+		log.Printf("Error recording refund for session %s: %v", sessionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s recorded a refund of %.2f for session %s", user, req.Amount, sessionID)
+	go announceRefund(s.hub, sessionID, req.Amount, req.Reason)
+	c.JSON(http.StatusCreated, gin.H{"status": "Refund recorded"})
+}
+
+// reportHandler renders a signed donation report for a period as CSV or PDF
+func (s *Server) reportHandler(c *gin.Context) {
+	if !s.hub.signingKeys.configured() {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Report signing key is not configured"})
+		return
+	}
+
+	period := c.Param("period")
+	from, to, err := report.ParsePeriod(period)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period, expected YYYY, YYYY-QN, YYYY-MM or YYYY-MM-DD"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'format' parameter"})
+		return
+	}
+
+	entries, err := s.db.getReportEntries(from, to)
+	if err != nil {
+		log.Printf("Error loading report entries for %s: %v", period, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load report data"})
+		return
+	}
+
+	rep := &report.Report{
+		Title:       "Donation Report",
+		Period:      period,
+		From:        from,
+		To:          to,
+		GeneratedAt: time.Now(),
+		Entries:     entries,
+	}
+
+	var body bytes.Buffer
+	contentType := "text/csv"
+	if format == "pdf" {
+		contentType = "application/pdf"
+		err = report.WritePDF(&body, rep)
+	} else {
+		err = report.WriteCSV(&body, rep)
+	}
+	if err != nil {
+		log.Printf("Error rendering %s report for %s: %v", format, period, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render report"})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s generated %s report for %s", user, format, period)
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="donations-%s.%s"`, period, format))
+	c.Header("X-Report-Generated-At", rep.GeneratedAt.UTC().Format(time.RFC3339))
+	c.Header("X-Report-Signature", s.hub.signingKeys.signReport(body.Bytes()))
+	c.Data(http.StatusOK, contentType, body.Bytes())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// ListenerFrame is a control frame sent by a listener
+type ListenerFrame struct {
+	Type string `json:"type"`
+	ID   int64  `json:"id,omitempty"`
+	// Cursor is the signed resume cursor, on resume frames
+	Cursor string `json:"cursor,omitempty"`
+	// ClientTime is the listener's clock, on time_sync frames
+	ClientTime int64 `json:"client_time,omitempty"`
+}
+
+// ResumedFrame tells a listener that catching up is done and live alerts follow
+type ResumedFrame struct {
+	Type     string `json:"type"`
+	Replayed int    `json:"replayed"`
+	LastID   int64  `json:"last_id"`
+	// Cursor resumes from LastID on the next reconnect
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// replaySince sends a listener the messages stored on its channel after the
+// given ID, followed by a resumed frame. Replayed messages carry no audio, so
+// overlays read them with browser TTS.
+func (hub *Hub) replaySince(client *listener, since int64) {
+	messages, err := hub.store.GetMessagesSince(client.channel, since, hub.resumeLimit)
+	if err != nil {
+		log.Printf("Error loading messages to replay on channel %s: %v", client.channel, err)
+		return
+	}
+
+	lastID := since
+	for _, msg := range messages {
+		msg.Replay = true
+		annotateEmotes(&msg)
+		formatMessageAmount(hub, &msg)
+		msg.Cursor = hub.cursors.sign(client.channel, msg.ID)
+
+		native, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Error marshaling replayed message: %v", err)
+			continue
+		}
+		payload, err := renderMessage(hub, client.format, msg, native)
+		if err != nil {
+			log.Printf("Error rendering %s message: %v", client.format, err)
+			continue
+		}
+		if !client.sendWait(payload) {
+			return
+		}
+		lastID = msg.ID
+	}
+
+	if wantsEvents(client.format) {
+		frame, _ := json.Marshal(ResumedFrame{
+			Type:     "resumed",
+			Replayed: len(messages),
+			LastID:   lastID,
+			Cursor:   hub.cursors.sign(client.channel, lastID),
+		})
+		client.sendWait(frame)
+	}
+	if len(messages) > 0 {
+		log.Printf("Replayed %d messages to listener on channel %s", len(messages), client.channel)
+	}
+}
+
+// sendWait queues a payload, waiting for room in the send queue. It gives up
+// when the listener is dropped or its writer stops draining.
+func (l *listener) sendWait(payload []byte) bool {
+	select {
+	case l.send <- payload:
+		return true
+	case <-l.done:
+		return false
+	case <-time.After(10 * time.Second):
+		return false
+	}
+}
+
+// handleListenerFrame acts on a control frame from a listener. It reports
+// false for a malformed or unknown frame, which is otherwise ignored.
+func (hub *Hub) handleListenerFrame(client *listener, data []byte) bool {
+	var frame ListenerFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return false
+	}
+
+	switch frame.Type {
+	case "resume":
+		// Only a cursor the server signed for this channel is resumed from
+		since, err := hub.cursors.verify(frame.Cursor, client.channel, client.key)
+		if err != nil || since == 0 {
+			return false
+		}
+		hub.replaySince(client, since)
+	case "ack":
+		if frame.ID <= 0 {
+			return false
+		}
+		hub.mutex.Lock()
+		hub.finishPlaying(client.channel, frame.ID)
+		hub.mutex.Unlock()
+		hub.eventLog.record(eventMessageAcked, Message{ID: frame.ID, Channel: client.channel}, nil)
+		go func() {
+			if err := hub.store.AckMessage(frame.ID, client.channel); err != nil {
+				log.Printf("Error acknowledging message %d: %v", frame.ID, err)
+			}
+		}()
+	case "time_sync":
+		answerTimeSync(client, frame.ClientTime)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// retentionInterval is how often expired messages are cleaned up
+	retentionInterval = time.Hour
+	// retentionBatchSize is how many messages each delete removes, so no
+	// delete holds its locks for long
+	retentionBatchSize = 1000
+	// retentionBatchPause lets other writes in between batches
+	retentionBatchPause = 100 * time.Millisecond
+)
+
+var errCleanupRunning = errors.New("a cleanup is already running")
+
+// RetentionConfig controls how long the message log is kept
+type RetentionConfig struct {
+	// MaxAge is how long messages are kept; 0 keeps them forever
+	MaxAge time.Duration
+	// ArchiveDir gets a JSON Lines file of the messages each cleanup is about
+	// to delete, written before any of them are
+	ArchiveDir string
+	// SandboxMaxAge is how long messages on sandbox channels are kept; they
+	// are never archived
+	SandboxMaxAge time.Duration
+}
+
+// ExportQuery selects the messages to export: created in [From, To), on
+// Channel if set
+type ExportQuery struct {
+	From    time.Time
+	To      time.Time
+	Channel string
+}
+
+// ExportedMessage is a stored message with its status and times, as exported
+// and archived. Anonymous donors are exported under the name shown on
+// stream, never their real one.
+type ExportedMessage struct {
+	ID          int64      `json:"id"`
+	SessionID   string     `json:"session_id"`
+	Channel     string     `json:"channel"`
+	Name        string     `json:"name"`
+	Amount      float32    `json:"amount"`
+	Message     string     `json:"message"`
+	Description string     `json:"description"`
+	Anonymous   bool       `json:"anonymous"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PlayedAt    *time.Time `json:"played_at,omitempty"`
+}
+
+// exportColumns is the CSV header, in the order of ExportedMessage.record
+var exportColumns = []string{"id", "session_id", "channel", "name", "amount", "message", "description", "anonymous", "status", "created_at", "played_at"}
+
+// record is the message as a CSV row
+func (m ExportedMessage) record() []string {
+	playedAt := ""
+	if m.PlayedAt != nil {
+		playedAt = m.PlayedAt.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatInt(m.ID, 10), m.SessionID, m.Channel, m.Name,
+		strconv.FormatFloat(float64(m.Amount), 'f', 2, 32), m.Message, m.Description,
+		strconv.FormatBool(m.Anonymous), m.Status, m.CreatedAt.UTC().Format(time.RFC3339), playedAt,
+	}
+}
+
+type messageRetention struct {
+	config RetentionConfig
+	// running is held for the length of a cleanup
+	running sync.Mutex
+}
+
+var retention = &messageRetention{}
+
+// startRetention cleans up hub's expired messages now and then every
+// retentionInterval
+func startRetention(config RetentionConfig, hub *Hub) {
+	retention.config = config
+	if config.MaxAge <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for {
+			if hub.standby.active() {
+				<-ticker.C
+				continue
+			}
+			if _, _, err := retention.cleanup(context.Background(), hub.store); err != nil && !errors.Is(err, errCleanupRunning) {
+				log.Printf("Error cleaning up expired messages: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Keeping messages for %s", config.MaxAge)
+}
+
+// cleanup archives and then deletes every message in store older than
+// MaxAge, a batch at a time. It returns how many messages it deleted and the
+// archive they were written to, if any.
+func (r *messageRetention) cleanup(ctx context.Context, store Store) (int64, string, error) {
+	if !r.running.TryLock() {
+		return 0, "", errCleanupRunning
+	}
+	defer r.running.Unlock()
+
+	// Messages are stored as they arrive, so none can join the range once the
+	// archive is written
+	cutoff := clock.Now().Add(-r.config.MaxAge)
+	archive := ""
+	if r.config.ArchiveDir != "" {
+		var err error
+		if archive, err = archiveMessages(ctx, store, r.config.ArchiveDir, cutoff); err != nil {
+			return 0, "", err
+		}
+	}
+
+	var deleted int64
+	for {
+		count, err := store.DeleteExpiredMessages(cutoff, retentionBatchSize)
+		deleted += count
+		if err != nil {
+			return deleted, archive, err
+		}
+		if count < retentionBatchSize {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return deleted, archive, ctx.Err()
+		case <-time.After(retentionBatchPause):
+		}
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d messages created before %s", deleted, cutoff.Format(time.RFC3339))
+	}
+	return deleted, archive, nil
+}
+
+// archiveMessages writes every message in store created before the cutoff to
+// a new JSON Lines file in dir. It returns "" when there was nothing to archive.
+func archiveMessages(ctx context.Context, store Store, dir string, cutoff time.Time) (string, error) {
+	path := filepath.Join(dir, "messages-"+cutoff.UTC().Format("20060102T150405.000Z")+".jsonl")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %w", err)
+	}
+
+	count := 0
+	encoder := json.NewEncoder(file)
+	err = store.ExportMessages(ctx, ExportQuery{To: cutoff}, func(msg ExportedMessage) error {
+		count++
+		return encoder.Encode(msg)
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || count == 0 {
+		os.Remove(path)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write archive: %w", err)
+	}
+	if count == 0 {
+		return "", nil
+	}
+
+	log.Printf("Archived %d messages to %s", count, path)
+	return path, nil
+}
+
+// cleanupMessagesHandler runs a cleanup now instead of waiting for the next one
+func (s *Server) cleanupMessagesHandler(c *gin.Context) {
+	if retention.config.MaxAge <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message retention is not configured"})
+		return
+	}
+
+	deleted, archive, err := retention.cleanup(c.Request.Context(), s.store)
+	if errors.Is(err, errCleanupRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A cleanup is already running"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error cleaning up expired messages: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clean up messages", "deleted": deleted})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.db.recordAudit("messages.cleanup", user, "", gin.H{"deleted": deleted, "archive": archive})
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted, "archive": archive})
+}
+
+// exportMessagesHandler streams stored messages as CSV or a JSON array, so
+// they can be archived before retention deletes them
+func (s *Server) exportMessagesHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'format' parameter, use 'csv' or 'json'"})
+		return
+	}
+
+	query := ExportQuery{To: time.Now(), Channel: c.Query("channel")}
+	var err error
+	if from := c.Query("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+			return
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' parameter"})
+			return
+		}
+	}
+
+	filename := "messages-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	count := 0
+	if format == "json" {
+		c.Header("Content-Type", "application/json")
+		err = s.store.ExportMessages(c.Request.Context(), query, func(msg ExportedMessage) error {
+			separator := ",\n"
+			if count == 0 {
+				separator = "[\n"
+			}
+			count++
+			data, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			_, err = c.Writer.WriteString(separator + string(data))
+			return err
+		})
+		if err == nil {
+			if count == 0 {
+				c.Writer.WriteString("[")
+			}
+			c.Writer.WriteString("\n]\n")
+		}
+	} else {
+		c.Header("Content-Type", "text/csv")
+		writer := csv.NewWriter(c.Writer)
+		writer.Write(exportColumns)
+		err = s.store.ExportMessages(c.Request.Context(), query, func(msg ExportedMessage) error {
+			count++
+			return writer.Write(msg.record())
+		})
+		if err == nil {
+			writer.Flush()
+			err = writer.Error()
+		}
+	}
+
+	// Once rows have gone out the status can't change, so a failure can only
+	// cut the export short
+	if err != nil {
+		log.Printf("Error exporting messages: %v", err)
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export messages"})
+		}
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s exported %d messages as %s", user, count, format)
+}
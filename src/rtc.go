@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rtcDataChannel is the label of the data channel overlays open for alerts
+const rtcDataChannel = "tts"
+
+// errRTCUnavailable is returned when the binary was built without WebRTC support
+var errRTCUnavailable = errors.New("server was built without WebRTC support")
+
+// RTCConfig controls the experimental WebRTC data-channel transport
+type RTCConfig struct {
+	Enabled    bool
+	ICEServers []string
+}
+
+// RTCSessionDescription is an SDP offer or answer exchanged over POST /rtc/offer
+type RTCSessionDescription struct {
+	Type string `json:"type" binding:"required"`
+	SDP  string `json:"sdp" binding:"required"`
+}
+
+// rtcCloseFrame tells a data-channel listener why it is being disconnected,
+// standing in for a WebSocket close frame
+type rtcCloseFrame struct {
+	Type string `json:"type"`
+	CloseReason
+}
+
+func rtcClosePayload(policy ReconnectPolicy, code int, cursor string) []byte {
+	payload, _ := json.Marshal(rtcCloseFrame{Type: "close", CloseReason: policy.closeReason(code, cursor)})
+	return payload
+}
+
+// rtcOfferHandler answers an overlay's WebRTC offer. Signaling is a single
+// round trip: the answer is returned once ICE gathering is complete, so no
+// trickle candidates are exchanged. Alerts then arrive on the overlay's "tts"
+// data channel in the native format, with audio streamed as it is synthesized.
+func (s *Server) rtcOfferHandler(c *gin.Context) {
+	if !s.hub.rtc.Enabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "WebRTC is not enabled"})
+		return
+	}
+
+	channel := c.Param("channel")
+	if channel == "" {
+		channel = requestChannel(c)
+	}
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+	key := apiKeyFrom(c)
+	if key != nil && !key.allowsChannel(channel) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key is not valid for this channel"})
+		return
+	}
+
+	var offer RTCSessionDescription
+	if err := c.ShouldBindJSON(&offer); err != nil || offer.Type != "offer" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected an SDP offer"})
+		return
+	}
+
+	answer, err := s.hub.answerRTCOffer(c.Request.Context(), channel, key, offer)
+	if errors.Is(err, errRTCUnavailable) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error answering WebRTC offer on channel %s: %v", channel, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to negotiate WebRTC session"})
+		return
+	}
+	c.JSON(http.StatusOK, answer)
+}
@@ -0,0 +1,10 @@
+//go:build !webrtc
+
+package main
+
+import "context"
+
+// answerRTCOffer is unavailable unless the server is built with -tags webrtc
+func (hub *Hub) answerRTCOffer(ctx context.Context, channel string, key *APIKey, offer RTCSessionDescription) (*RTCSessionDescription, error) {
+	return nil, errRTCUnavailable
+}
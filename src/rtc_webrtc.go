@@ -0,0 +1,112 @@
+//go:build webrtc
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// rtcTransport is a listener's WebRTC data channel
+type rtcTransport struct {
+	pc        *webrtc.PeerConnection
+	dc        *webrtc.DataChannel
+	reconnect ReconnectPolicy
+}
+
+func (t *rtcTransport) write(payload []byte) error {
+	return t.dc.SendText(string(payload))
+}
+
+// ping is a no-op: SCTP heartbeats and ICE consent checks keep the connection alive
+func (t *rtcTransport) ping() error {
+	return nil
+}
+
+func (t *rtcTransport) closeWith(code int, cursor string) error {
+	return t.dc.SendText(string(rtcClosePayload(t.reconnect, code, cursor)))
+}
+
+func (t *rtcTransport) Close() error {
+	return t.pc.Close()
+}
+
+// answerRTCOffer sets up a peer connection for an overlay's offer. The overlay
+// is registered as a streaming listener once its "tts" data channel opens.
+func (hub *Hub) answerRTCOffer(ctx context.Context, channel string, key *APIKey, offer RTCSessionDescription) (*RTCSessionDescription, error) {
+	var iceServers []webrtc.ICEServer
+	if len(hub.rtc.ICEServers) > 0 {
+		iceServers = []webrtc.ICEServer{{URLs: hub.rtc.ICEServers}}
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: iceServers})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %w", err)
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			pc.Close()
+		}
+	})
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != rtcDataChannel {
+			log.Printf("Ignoring WebRTC data channel %q", dc.Label())
+			return
+		}
+
+		conn := &rtcTransport{pc: pc, dc: dc, reconnect: hub.reconnect}
+		client := hub.newListener(conn, channel, formatNative)
+		client.streams = true
+		var release func()
+
+		dc.OnOpen(func() {
+			if key != nil {
+				release = trackKeyConnection(key, conn)
+			}
+			go client.writePump()
+			hub.register <- client
+		})
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			if msg.IsString {
+				hub.handleListenerFrame(client, msg.Data)
+			}
+		})
+		// Closing can start inside the hub (kicks, slow consumers), so unregister from its own goroutine
+		dc.OnClose(func() {
+			go func() { hub.unregister <- client }()
+			if release != nil {
+				release()
+			}
+			pc.Close()
+		})
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP}); err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to apply offer: %w", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to apply answer: %w", err)
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		pc.Close()
+		return nil, ctx.Err()
+	}
+
+	local := pc.LocalDescription()
+	return &RTCSessionDescription{Type: local.Type.String(), SDP: local.SDP}, nil
+}
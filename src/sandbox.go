@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sandboxSuffix names a channel's sandbox: the sandbox of "streamer" is
+// "streamer-sandbox"
+const sandboxSuffix = "-sandbox"
+
+// sandboxSessionTTL is how long an impersonation key lasts
+const sandboxSessionTTL = time.Hour
+
+// sandboxInterval is how often expired sandbox messages are purged
+const sandboxInterval = 10 * time.Minute
+
+// sandboxChannel is the sandbox of a channel. Messages sent there are
+// synthesized, moderated and played like any other, but are kept out of
+// reports, billing and the server-wide features (ticker, charity matching,
+// bid wars, polls, the wheel), and are purged after a while.
+func sandboxChannel(channel string) string {
+	if isSandboxChannel(channel) {
+		return channel
+	}
+	return channel + sandboxSuffix
+}
+
+// isSandboxChannel reports whether channel is some channel's sandbox
+func isSandboxChannel(channel string) bool {
+	return strings.HasSuffix(channel, sandboxSuffix) && len(channel) > len(sandboxSuffix)
+}
+
+// sandboxOwner is the channel a sandbox belongs to
+func sandboxOwner(channel string) string {
+	return strings.TrimSuffix(channel, sandboxSuffix)
+}
+
+// sandboxSettings are the settings a sandbox without its own runs on: its
+// owner's, without the integrations that reach anyone but the streamer, so
+// experiments don't notify followers, thank donors or get billed
+func sandboxSettings(channel string, owner *ChannelSettings) *ChannelSettings {
+	settings := *owner
+	settings.Channel = channel
+	settings.Webhooks = []string{}
+	settings.Discord = DiscordSettings{}
+	settings.Telegram = TelegramSettings{}
+	settings.ThankYou = ThankYouSettings{}
+	settings.Billing = BillingSettings{}
+	settings.Version = 0
+	return &settings
+}
+
+// startSandboxPurge deletes sandbox messages older than maxAge from hub's
+// store every sandboxInterval
+func startSandboxPurge(maxAge time.Duration, hub *Hub) {
+	if maxAge <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(sandboxInterval)
+		defer ticker.Stop()
+		for {
+			if hub.standby.active() {
+				<-ticker.C
+				continue
+			}
+			deleted, err := purgeSandbox(context.Background(), hub.store, "", clock.Now().Add(-maxAge))
+			if err != nil {
+				log.Printf("Error purging sandbox messages: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Purged %d sandbox messages", deleted)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Keeping sandbox messages for %s", maxAge)
+}
+
+// purgeSandbox deletes the messages of a sandbox channel, or of every
+// sandbox when channel is "", created before the cutoff, a batch at a time
+func purgeSandbox(ctx context.Context, store Store, channel string, before time.Time) (int64, error) {
+	var deleted int64
+	for {
+		count, err := store.DeleteSandboxMessages(channel, before, retentionBatchSize)
+		deleted += count
+		if err != nil {
+			return deleted, err
+		}
+		if count < retentionBatchSize {
+			return deleted, nil
+		}
+		select {
+		case <-ctx.Done():
+			return deleted, ctx.Err()
+		case <-time.After(retentionBatchPause):
+		}
+	}
+}
+
+// sandboxChannelParam reads the channel of a sandbox request, aborting on a
+// bad name
+func sandboxChannelParam(c *gin.Context) (string, bool) {
+	channel := sandboxChannel(c.Param("channel"))
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return "", false
+	}
+	return channel, true
+}
+
+// impersonateSandboxHandler gives an admin a short-lived listen and send key
+// for a channel's sandbox, to try things out as the streamer would
+func (s *Server) impersonateSandboxHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+	channel, ok := sandboxChannelParam(c)
+	if !ok {
+		return
+	}
+
+	expiresAt := clock.Now().Add(sandboxSessionTTL)
+	key := &APIKey{
+		Name:      "sandbox session for " + sandboxOwner(channel),
+		Scopes:    []string{scopeListen, scopeSend},
+		Channel:   channel,
+		ExpiresAt: &expiresAt,
+		CreatedBy: user,
+	}
+	if !mintableBy(c, key) {
+		return
+	}
+	raw, err := s.db.mintAPIKey(key)
+	if err != nil {
+		log.Printf("Error creating sandbox key for %s: %v", channel, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	s.db.recordAudit("sandbox.impersonated", user, sandboxOwner(channel), gin.H{"channel": channel, "key": key.Prefix})
+	c.JSON(http.StatusCreated, gin.H{"channel": channel, "key": raw, "api_key": key})
+}
+
+// purgeSandboxHandler deletes every message of a channel's sandbox now
+func (s *Server) purgeSandboxHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+	channel, ok := sandboxChannelParam(c)
+	if !ok {
+		return
+	}
+
+	deleted, err := purgeSandbox(c.Request.Context(), s.store, channel, clock.Now())
+	if err != nil {
+		log.Printf("Error purging sandbox %s: %v", channel, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge sandbox", "deleted": deleted})
+		return
+	}
+
+	s.db.recordAudit("sandbox.purged", user, sandboxOwner(channel), gin.H{"channel": channel, "deleted": deleted})
+	c.JSON(http.StatusOK, gin.H{"channel": channel, "deleted": deleted})
+}
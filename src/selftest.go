@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	metricSelfTests       = "tts_selftest_total"
+	metricSelfTestSeconds = "tts_selftest_seconds"
+)
+
+// SelfTestConfig controls the synthetic end-to-end probe
+type SelfTestConfig struct {
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+	AlertWebhook     string
+}
+
+// SelfTestStatus is the latest outcome of the probe, reported by /admin/status
+type SelfTestStatus struct {
+	LastRun             *time.Time `json:"last_run,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastLatencyMs       float64    `json:"last_latency_ms"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Stalled             bool       `json:"stalled"`
+}
+
+type selfTester struct {
+	mutex  sync.Mutex
+	config SelfTestConfig
+	// keys signs the alert webhook's requests
+	keys   *signingKeyRing
+	status SelfTestStatus
+	seq    int
+}
+
+var selfTest = &selfTester{}
+
+// startSelfTest runs the probe through hub on its interval until the process
+// exits
+func startSelfTest(config SelfTestConfig, hub *Hub) {
+	if config.Interval <= 0 {
+		return
+	}
+	selfTest.config = config
+	selfTest.keys = hub.signingKeys
+
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			selfTest.run(hub)
+		}
+	}()
+	log.Printf("Self-test probe running every %s", config.Interval)
+}
+
+func (t *selfTester) snapshot() SelfTestStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status
+}
+
+// run pushes one probe message through the hub and waits for it to come out the other side
+func (t *selfTester) run(hub *Hub) {
+	t.mutex.Lock()
+	t.seq++
+	sessionID := fmt.Sprintf("selftest-%s-%d", instance.ID, t.seq)
+	t.mutex.Unlock()
+
+	tap := hub.addTap(16)
+	defer hub.removeTap(tap)
+
+	started := time.Now()
+	probe := Message{SessionID: sessionID, Name: "self-test", Message: "self-test", Probe: true}
+
+	delivered := false
+	deadline := time.After(t.config.Timeout)
+	select {
+	case hub.broadcast <- probe:
+	wait:
+		for {
+			select {
+			case payload := <-tap:
+				var msg Message
+				if json.Unmarshal(payload, &msg) == nil && msg.SessionID == sessionID {
+					delivered = true
+					break wait
+				}
+			case <-deadline:
+				break wait
+			}
+		}
+	case <-deadline:
+	}
+
+	t.record(hub, started, delivered)
+}
+
+// record updates the status and alerts when the probe starts or stops failing
+func (t *selfTester) record(hub *Hub, started time.Time, delivered bool) {
+	latency := time.Since(started)
+	now := time.Now()
+
+	t.mutex.Lock()
+	t.status.LastRun = &now
+	wasStalled := t.status.Stalled
+	if delivered {
+		t.status.LastSuccess = &now
+		t.status.LastLatencyMs = float64(latency.Microseconds()) / 1000
+		t.status.ConsecutiveFailures = 0
+		t.status.Stalled = false
+	} else {
+		t.status.ConsecutiveFailures++
+		t.status.Stalled = t.status.ConsecutiveFailures >= t.config.FailureThreshold
+	}
+	status := t.status
+	t.mutex.Unlock()
+
+	if delivered {
+		hub.metrics.inc(metricSelfTests, MetricLabels{Kind: "success"}, 1)
+		hub.metrics.observe(metricSelfTestSeconds, MetricLabels{Kind: "success"}, latency.Seconds())
+	} else {
+		hub.metrics.inc(metricSelfTests, MetricLabels{Kind: "failure"}, 1)
+		log.Printf("Self-test probe was not delivered within %s (%d consecutive failures)", t.config.Timeout, status.ConsecutiveFailures)
+	}
+
+	if status.Stalled != wasStalled {
+		t.alert(status)
+	}
+}
+
+// alert notifies the configured webhook that delivery stalled or recovered
+func (t *selfTester) alert(status SelfTestStatus) {
+	state := "recovered"
+	if status.Stalled {
+		state = "stalled"
+	}
+	log.Printf("Self-test delivery %s", state)
+
+	if t.config.AlertWebhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"event":       "selftest." + state,
+		"instance_id": instance.ID,
+		"status":      status,
+	})
+	if err != nil {
+		log.Printf("Error marshaling self-test alert: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.config.AlertWebhook, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error building self-test alert: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.keys.configured() {
+		req.Header.Set(signatureHeader, t.keys.sign(body))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error sending self-test alert: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Server is a tts-server instance: its configuration and the hub, store,
+// WebSocket upgrader and router built from it
+type Server struct {
+	config *Config
+	hub    *Hub
+	store  Store
+	// db is the hub's store for the Postgres-only features
+	db *postgresStore
+	// auth holds the credential chains of the listen, send and admin routes
+	auth     *authChains
+	upgrader websocket.Upgrader
+	router   *gin.Engine
+	http     *http.Server
+	// adminHTTP serves the admin API on its own addresses, when
+	// ADMIN_LISTEN_ADDR is set
+	adminHTTP *http.Server
+}
+
+// newServer opens the store, runs the startup work config asks for and
+// builds the router. The server doesn't accept connections or deliver
+// alerts until ListenAndServe.
+func newServer(config *Config) (*Server, error) {
+	filter, err := newContentFilter(config.ContentFilter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content filter: %w", err)
+	}
+	synthesis, err := newSpeech(config.Audio)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TTS configuration: %w", err)
+	}
+	metrics := newMetricsRegistry(config.MetricsMaxSeries, config.MetricsToken)
+	store, err := openStore(metrics)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	postgres := usesPostgres(store)
+	if config.ModerationEnabled && !postgres {
+		store.Close()
+		return nil, fmt.Errorf("MODERATION_ENABLED requires DB_DRIVER=postgres")
+	}
+	if filter.holds() && !postgres {
+		store.Close()
+		return nil, fmt.Errorf("content filter action %q requires DB_DRIVER=postgres", filterActionHold)
+	}
+	if config.Plugins.FailAction == filterActionHold && !postgres {
+		store.Close()
+		return nil, fmt.Errorf("FILTER_PLUGIN_FAIL_ACTION %q requires DB_DRIVER=postgres", filterActionHold)
+	}
+	if config.EventLog && !postgres {
+		store.Close()
+		return nil, fmt.Errorf("EVENT_LOG_ENABLED requires DB_DRIVER=postgres")
+	}
+	if config.Usage.Enabled && !postgres {
+		store.Close()
+		return nil, fmt.Errorf("USAGE_METERING requires DB_DRIVER=postgres")
+	}
+
+	hub := newHub(store)
+	hub.metrics = metrics
+	hub.filter = filter
+	hub.synthesis = synthesis
+	hub.transcripts = &transcriptLog{dir: config.TranscriptDir}
+	hub.playback = newPlaybackEstimator(config.Playback)
+	hub.cursors = newCursorSigner(config.ResumeCursors, config.AdminPassword)
+	hub.twitch = newTwitchPresence(config.Twitch)
+	accounts := gin.Accounts{config.AdminUsername: config.AdminPassword}
+	auth, err := configureAuth(config.Auth, accounts, config.RequireAPIKeys, config.UseTLS, hub.db)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("invalid authentication configuration: %w", err)
+	}
+	s := &Server{
+		config: config,
+		hub:    hub,
+		store:  store,
+		db:     hub.db,
+		auth:   auth,
+		// With FRONTEND_URL unset only clients that send no Origin are let in
+		upgrader: newUpgrader(os.Getenv("FRONTEND_URL")),
+	}
+
+	// SQLite creates its schema when it is opened; migrations are for Postgres
+	if config.AutoMigrate && postgres {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		s.db.logLegacySchema(ctx)
+		_, err := s.db.runMigrations(ctx)
+		if err == nil {
+			s.db.logVerification(ctx)
+		}
+		cancel()
+		if err != nil {
+			s.store.Close()
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+
+	s.hub.bus, err = startBus(config.RedisURL, config.RedisChannelPrefix, s.hub)
+	if err != nil {
+		s.store.Close()
+		return nil, fmt.Errorf("failed to start Redis broadcast: %w", err)
+	}
+	if config.Standby.Enabled && s.hub.bus == nil {
+		s.store.Close()
+		return nil, fmt.Errorf("STANDBY requires REDIS_URL")
+	}
+
+	s.hub.eventLog = startEventLog(config.EventLog, s.db)
+	s.hub.resumeWebhookDeliveries()
+	if err := startUsageMetering(config.Usage, s.hub); err != nil {
+		s.abandon()
+		return nil, fmt.Errorf("failed to start usage metering: %w", err)
+	}
+	initCharity(s.hub, config)
+	loadBidWars(s.hub)
+	loadPolls(s.hub)
+	loadWheelRules(s.hub)
+	s.hub.signingKeys = startSigningKeys(s.db, []byte(config.ReportSigningKey), config.SigningKeyOverlap)
+
+	s.router = s.setupRouter()
+	// Every instance tracks the streams of its listeners, standbys included
+	s.hub.startStreamHeartbeats()
+	if config.Standby.Enabled {
+		// A standby starts this when it is promoted
+		startLease(config.Standby, s.hub, s.startPrimary)
+	} else {
+		if err := s.startPrimary(); err != nil {
+			s.abandon()
+			return nil, err
+		}
+		startLease(config.Standby, s.hub, nil)
+	}
+
+	tlsConfig := domainTLSConfig(s.auth.tlsConfig())
+	newHTTP := func(handler http.Handler) *http.Server {
+		return &http.Server{
+			Handler:      handler,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			TLSConfig:    tlsConfig,
+		}
+	}
+	if len(config.Listen.AdminAddrs) == 0 {
+		s.http = newHTTP(s.router)
+	} else {
+		s.http = newHTTP(publicRoutes(s.router))
+		s.adminHTTP = newHTTP(s.router)
+	}
+	return s, nil
+}
+
+// startPrimary starts the work only a primary does: taking messages in from
+// chat and payment sources, and the scheduled jobs that write to the store.
+// What they send the hub waits for it to run.
+func (s *Server) startPrimary() error {
+	config := s.config
+	startSimulation(config.Simulation, s.hub)
+	startRetention(config.Retention, s.hub)
+	startSandboxPurge(config.Retention.SandboxMaxAge, s.hub)
+	startMaintenance(config.Maintenance, s.hub)
+	startStreaks(config.Streaks, s.hub)
+	// Shipping reads the archive directories newServer and retention configure
+	if err := startShipping(config.Shipping, s.hub); err != nil {
+		return fmt.Errorf("failed to start archive shipping: %w", err)
+	}
+	// A queue handed off by an instance that shut down before this one
+	// started is played from here
+	go s.hub.adoptHandoffs()
+	if err := startYouTube(config.YouTube, s.hub); err != nil {
+		return fmt.Errorf("failed to start YouTube chat reader: %w", err)
+	}
+	if err := startTikTok(config.TikTok, s.hub); err != nil {
+		return fmt.Errorf("failed to start TikTok gift reader: %w", err)
+	}
+	if err := startCrypto(config.Crypto, s.hub); err != nil {
+		return fmt.Errorf("failed to start crypto payment listeners: %w", err)
+	}
+	return nil
+}
+
+// abandon closes what newServer opened when it fails part way: webhook
+// deliveries resumed from the store are saved again, the event log and
+// usage meter are flushed, and the bus and store are closed
+func (s *Server) abandon() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if s.hub.bus != nil {
+		s.hub.bus.close()
+	}
+	if pending := s.hub.stopWebhookDeliveries(); len(pending) > 0 {
+		if _, err := s.db.savePendingDeliveries(pending); err != nil {
+			log.Printf("Error saving unfinished webhook deliveries: %v", err)
+		}
+	}
+	s.hub.eventLog.close(ctx)
+	s.hub.usage.close(ctx)
+	s.store.Close()
+}
+
+// ListenAndServe listens on every configured address and serves until
+// Shutdown, when it returns http.ErrServerClosed. It returns the first error
+// any listener fails with.
+func (s *Server) ListenAndServe() error {
+	listeners, err := s.listen()
+	if err != nil {
+		return err
+	}
+	go s.hub.run()
+	if s.config.UseTLS {
+		if s.config.CertFile == "" {
+			log.Printf("TLS enabled with certificates from Let's Encrypt")
+		} else {
+			log.Printf("TLS enabled with certificate: %s and key: %s", s.config.CertFile, s.config.KeyFile)
+		}
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			if s.config.UseTLS {
+				errs <- l.server.ServeTLS(l, s.config.CertFile, s.config.KeyFile)
+			} else {
+				errs <- l.server.Serve(l)
+			}
+		}()
+	}
+	return <-errs
+}
+
+// Shutdown stops taking requests, drains the hub, saves the webhook
+// deliveries still retrying, flushes metered usage and closes the store,
+// logging a ShutdownReport last. It returns early, leaving the hub and
+// store as they are, if requests in flight don't finish before ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	report := ShutdownReport{StartedAt: time.Now(), MessagesInFlight: s.hub.acceptsInFlight.Load()}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+		report.log()
+	}()
+
+	s.hub.standby.releaseLease()
+	err := s.http.Shutdown(ctx)
+	if s.adminHTTP != nil {
+		err = errors.Join(err, s.adminHTTP.Shutdown(ctx))
+	}
+	report.MessagesUnfinished = s.hub.acceptsInFlight.Load()
+	if err != nil {
+		report.TimedOut = true
+		return err
+	}
+
+	// Flush held alerts and tell listeners we're going away so they reconnect
+	// to the next instance, storing whatever couldn't be delivered
+	report.HubDrain = s.hub.Shutdown(ctx)
+	log.Printf("Closed %d listener connections", report.Listeners)
+
+	report.HandedOff = s.hub.handOffDrain(report.HubDrain)
+	if s.hub.bus != nil {
+		s.hub.bus.close()
+	}
+	pending := s.hub.stopWebhookDeliveries()
+	report.WebhooksPending = len(pending)
+	if len(pending) > 0 {
+		saved, err := s.db.savePendingDeliveries(pending)
+		report.WebhooksSaved = saved
+		if err != nil {
+			log.Printf("Error saving unfinished webhook deliveries: %v", err)
+		}
+	}
+	report.EventsUnwritten = s.hub.eventLog.close(ctx)
+	if report.EventsUnwritten > 0 {
+		report.TimedOut = true
+	}
+	// Usage since the last flush is billed before the store goes
+	s.hub.usage.close(ctx)
+	s.store.Close()
+	return nil
+}
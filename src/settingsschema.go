@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jsonSchema is the part of JSON Schema channel settings are described and
+// checked with
+type jsonSchema struct {
+	Schema     string                 `json:"$schema,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Type       []string               `json:"type,omitempty"`
+	Format     string                 `json:"format,omitempty"`
+	Enum       []string               `json:"enum,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	// AdditionalProperties is false for objects with fixed fields, or the
+	// schema of a map's values
+	AdditionalProperties any         `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema `json:"items,omitempty"`
+}
+
+// settingsEnums are the string settings with a fixed set of values, by
+// dotted path. "" is always allowed, for the default.
+var settingsEnums = map[string][]string{
+	"pricing.overflow":       {pricingTruncate, pricingReject},
+	"refunds.policy":         {refundIgnore, refundEvent, refundAnnounce},
+	"thank_you.action":       {thankYouEmail, thankYouWebhook},
+	"amount_format.rounding": {roundNearest, roundDown, roundUp},
+	"amount_format.currency": {currencySymbol, currencyCode, currencyNone},
+	"streaks.policy":         {recognizeEvent, recognizeAnnounce},
+}
+
+// templatePlaceholders are the placeholders each settings template may use
+var templatePlaceholders = map[string][]string{
+	"refunds.template":           {"name", "amount", "reason"},
+	"thank_you.template":         {"name", "amount", "currency", "channel", "message", "receipt", "played_at"},
+	"thank_you.subject":          {"name", "amount", "currency", "channel", "message", "receipt", "played_at"},
+	"streaks.template":           {"name", "streak", "best", "streams"},
+	"streaks.returning_template": {"name", "days", "streams"},
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// channelSettingsSchema describes ChannelSettings as PUT
+// /admin/channels/:channel/settings takes them
+var channelSettingsSchema = func() *jsonSchema {
+	schema := schemaFor(reflect.TypeOf(ChannelSettings{}), "")
+	schema.Schema = "https://json-schema.org/draft/2020-12/schema"
+	schema.Title = "Channel settings"
+	return schema
+}()
+
+// schemaFor describes a settings type. Fields are named by their JSON tags,
+// and pointers, slices and maps may also be null.
+func schemaFor(t reflect.Type, path string) *jsonSchema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return &jsonSchema{Type: []string{"string"}, Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaFor(t.Elem(), path)
+		schema.Type = append(schema.Type, "null")
+		return schema
+	case reflect.Struct:
+		schema := &jsonSchema{Type: []string{"object"}, Properties: map[string]*jsonSchema{}, AdditionalProperties: false}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			schema.Properties[name] = schemaFor(field.Type, strings.TrimPrefix(path+"."+name, "."))
+		}
+		return schema
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: []string{"array", "null"}, Items: schemaFor(t.Elem(), path+".*")}
+	case reflect.Map:
+		return &jsonSchema{Type: []string{"object", "null"}, AdditionalProperties: schemaFor(t.Elem(), path+".*")}
+	case reflect.String:
+		schema := &jsonSchema{Type: []string{"string"}}
+		if values, ok := settingsEnums[path]; ok {
+			schema.Enum = append([]string{""}, values...)
+		}
+		return schema
+	case reflect.Bool:
+		return &jsonSchema{Type: []string{"boolean"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: []string{"integer"}}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: []string{"number"}}
+	}
+	return &jsonSchema{}
+}
+
+// jsonType is the JSON Schema type of a value decoded with UseNumber
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return ""
+}
+
+// check adds what is wrong with value to problems, each prefixed with the
+// JSON pointer of where it is
+func (s *jsonSchema) check(value any, pointer string, problems *[]string) {
+	where := pointer
+	if where == "" {
+		where = "/"
+	}
+	if actual := jsonType(value); len(s.Type) > 0 && !slices.Contains(s.Type, actual) &&
+		!(actual == "integer" && slices.Contains(s.Type, "number")) {
+		*problems = append(*problems, fmt.Sprintf("%s: must be %s, not %s", where, strings.Join(s.Type, " or "), actual))
+		return
+	}
+
+	switch v := value.(type) {
+	case string:
+		if s.Enum != nil && !slices.Contains(s.Enum, v) {
+			quoted := make([]string, 0, len(s.Enum))
+			for _, allowed := range s.Enum[1:] {
+				quoted = append(quoted, strconv.Quote(allowed))
+			}
+			*problems = append(*problems, fmt.Sprintf("%s: must be one of %s", where, strings.Join(quoted, ", ")))
+		}
+	case []any:
+		for i, item := range v {
+			if s.Items != nil {
+				s.Items.check(item, pointer+"/"+strconv.Itoa(i), problems)
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if property, ok := s.Properties[key]; ok {
+				property.check(v[key], pointer+"/"+key, problems)
+				continue
+			}
+			switch additional := s.AdditionalProperties.(type) {
+			case bool:
+				if !additional {
+					*problems = append(*problems, fmt.Sprintf("%s/%s: unknown setting", pointer, key))
+				}
+			case *jsonSchema:
+				additional.check(v[key], pointer+"/"+key, problems)
+			}
+		}
+	}
+}
+
+// validateSettingsJSON checks a settings body against the schema before it
+// is decoded, so a misspelled or mistyped setting is refused rather than
+// quietly dropped
+func validateSettingsJSON(body []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	channelSettingsSchema.check(value, "", &problems)
+	return problems, nil
+}
+
+// SettingsChange is one setting a dry run would change
+type SettingsChange struct {
+	Path string `json:"path"`
+	From any    `json:"from"`
+	To   any    `json:"to"`
+}
+
+// settingsChanges lists what saving next over current would change, by
+// dotted path. Lists are compared whole.
+func settingsChanges(current, next *ChannelSettings) []SettingsChange {
+	before, after := flattenSettings(current), flattenSettings(next)
+	paths := make([]string, 0, len(before)+len(after))
+	for path := range before {
+		paths = append(paths, path)
+	}
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := []SettingsChange{}
+	for _, path := range paths {
+		if !reflect.DeepEqual(before[path], after[path]) {
+			changes = append(changes, SettingsChange{Path: path, From: before[path], To: after[path]})
+		}
+	}
+	return changes
+}
+
+// flattenSettings is every setting by dotted path, leaving out what is set
+// on save rather than by the caller
+func flattenSettings(settings *ChannelSettings) map[string]any {
+	raw, _ := json.Marshal(settings)
+	var fields map[string]any
+	json.Unmarshal(raw, &fields)
+	delete(fields, "channel")
+	delete(fields, "updated_at")
+	delete(fields, "version")
+
+	flat := make(map[string]any)
+	var walk func(prefix string, value any)
+	walk = func(prefix string, value any) {
+		switch v := value.(type) {
+		case nil:
+			// Empty and unset lists and maps are the same setting
+			return
+		case []any:
+			if len(v) == 0 {
+				return
+			}
+		case map[string]any:
+			for key, nested := range v {
+				walk(strings.TrimPrefix(prefix+"."+key, "."), nested)
+			}
+			return
+		}
+		flat[prefix] = value
+	}
+	walk("", fields)
+	return flat
+}
+
+// SettingsPreview is what a channel's alerts, corrections and thank-yous
+// would look like with new settings
+type SettingsPreview struct {
+	// Alert is a sample donation as native overlays would receive it
+	Alert                Message `json:"alert"`
+	AnonymousDescription string  `json:"anonymous_description"`
+	// RefundCorrection is only shown with the announce refund policy
+	RefundCorrection string `json:"refund_correction,omitempty"`
+	// ThankYouSubject and ThankYou are only shown with a thank-you action
+	ThankYouSubject string `json:"thank_you_subject,omitempty"`
+	ThankYou        string `json:"thank_you,omitempty"`
+	// StreakRecognition is only shown with a streaks policy
+	StreakRecognition string `json:"streak_recognition,omitempty"`
+}
+
+// previewSettings renders a sample alert with the given settings, without
+// them being saved
+func previewSettings(hub *Hub, settings *ChannelSettings) SettingsPreview {
+	sample := Message{
+		ID:        1042,
+		SessionID: "preview",
+		Channel:   settings.Channel,
+		Name:      "Alice",
+		Amount:    1234.5,
+		Message:   "Hello stream!",
+		Receipt:   "TTS-2024-ABCD12",
+	}
+	sample.AmountText = formatAmount(settings.AmountFormat, sample.Amount, messageCurrency(hub, sample))
+
+	preview := SettingsPreview{
+		Alert:                sample,
+		AnonymousDescription: strings.ReplaceAll(anonymity.DescriptionTemplate, "{amount}", formatTemplateAmount(hub, settings.AmountFormat, sample.Amount, sample.Currency)),
+	}
+	if settings.Refunds.Policy == refundAnnounce {
+		preview.RefundCorrection = refundText(hub, settings, sample.Name, sample.Amount, sample.Currency, "Chargeback")
+	}
+	if settings.ThankYou.Action != "" {
+		replacer := thankYouReplacer(sample, clock.Now())
+		preview.ThankYouSubject = replacer.Replace(firstNonEmpty(settings.ThankYou.Subject, defaultThankYouSubject))
+		preview.ThankYou = replacer.Replace(firstNonEmpty(settings.ThankYou.Template, defaultThankYouTemplate))
+	}
+	if settings.Streaks.enabled() {
+		streak := DonorStreak{Name: sample.Name, Streak: settings.Streaks.milestones()[0], Streams: 12}
+		streak.BestStreak = streak.Streak
+		recognition, _ := streakRecognition(settings.Channel, settings.Streaks, streak, clock.Now())
+		preview.StreakRecognition = recognition.Text
+	}
+	return preview
+}
+
+// templateWarnings lists placeholders in the settings' templates that are
+// never filled in, which would be read out as they are
+func templateWarnings(settings *ChannelSettings) []string {
+	templates := map[string]string{
+		"refunds.template":           settings.Refunds.Template,
+		"thank_you.template":         settings.ThankYou.Template,
+		"thank_you.subject":          settings.ThankYou.Subject,
+		"streaks.template":           settings.Streaks.Template,
+		"streaks.returning_template": settings.Streaks.ReturningTemplate,
+	}
+	paths := make([]string, 0, len(templates))
+	for path := range templates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	warnings := []string{}
+	for _, path := range paths {
+		for _, placeholder := range placeholderPattern.FindAllString(templates[path], -1) {
+			if !slices.Contains(templatePlaceholders[path], strings.Trim(placeholder, "{}")) {
+				warnings = append(warnings, fmt.Sprintf("%s: unknown placeholder %s", path, placeholder))
+			}
+		}
+	}
+	return warnings
+}
+
+// settingsSchemaHandler serves the JSON Schema channel settings are checked
+// against, for editors and CI to validate with
+func settingsSchemaHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, channelSettingsSchema)
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shippingState is the object under the prefix that remembers how far
+// message and audit exports have been shipped, so a restart neither loses
+// nor repeats any
+const shippingState = "state.json"
+
+// shippingLag keeps the newest minute out of an export, so rows still being
+// written land in the next one
+const shippingLag = time.Minute
+
+var (
+	errShipRunning    = errors.New("a shipment is already running")
+	errObjectNotFound = errors.New("object not found")
+)
+
+// ShippingConfig is the S3-compatible bucket transcripts, audit logs and
+// message exports are copied to. Shipping is off without a bucket.
+type ShippingConfig struct {
+	// Endpoint defaults to AWS S3 in Region; set it for MinIO, R2, B2 and the like
+	Endpoint        string
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Prefix is put in front of every key, e.g. "tts/"
+	Prefix string
+	// PathStyle addresses the bucket in the path rather than the host name,
+	// which most S3-compatible services need
+	PathStyle bool
+	Interval  time.Duration
+	// Retention is how long shipped objects are kept; 0 keeps them forever
+	Retention time.Duration
+}
+
+// ShipReport is what one shipment copied to the bucket
+type ShipReport struct {
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Messages     int       `json:"messages"`
+	AuditEntries int       `json:"audit_entries"`
+	Files        int       `json:"files"`
+	Deleted      int       `json:"deleted"`
+}
+
+type shippedState struct {
+	ShippedTo time.Time `json:"shipped_to"`
+}
+
+// archiveShipper copies everything the server keeps on local disk, and
+// exports of what it keeps in the database, to a bucket now and then, so a
+// self-hosted server loses nothing when its disk dies
+type archiveShipper struct {
+	client *s3Client
+	// store is where the exported messages come from, db the audit log and
+	// transcripts the directory transcripts are written to
+	store       Store
+	db          *postgresStore
+	transcripts string
+	running     sync.Mutex
+	// shippedTo is loaded from the bucket on the first shipment
+	shippedTo time.Time
+	loaded    bool
+}
+
+var shipper = &archiveShipper{}
+
+// startShipping ships now and then every Interval, exporting from hub's
+// stores
+func startShipping(config ShippingConfig, hub *Hub) error {
+	if config.Bucket == "" {
+		return nil
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return fmt.Errorf("ARCHIVE_S3_BUCKET requires ARCHIVE_S3_ACCESS_KEY_ID and ARCHIVE_S3_SECRET_ACCESS_KEY")
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("invalid ARCHIVE_S3_ENDPOINT %q", config.Endpoint)
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Hour
+	}
+	shipper.client = &s3Client{config: config, endpoint: endpoint, http: &http.Client{Timeout: 2 * time.Minute}}
+	shipper.store = hub.store
+	shipper.db = hub.db
+	shipper.transcripts = hub.transcripts.dir
+
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			if hub.standby.active() {
+				<-ticker.C
+				continue
+			}
+			if _, err := shipper.ship(context.Background()); err != nil && !errors.Is(err, errShipRunning) {
+				log.Printf("Error shipping archives: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Shipping archives to bucket %s every %s", config.Bucket, config.Interval)
+	return nil
+}
+
+// ship copies what is new since the last shipment to the bucket and deletes
+// objects older than the retention period
+func (s *archiveShipper) ship(ctx context.Context) (ShipReport, error) {
+	if !s.running.TryLock() {
+		return ShipReport{}, errShipRunning
+	}
+	defer s.running.Unlock()
+
+	if !s.loaded {
+		var state shippedState
+		body, err := s.client.get(ctx, shippingState)
+		if err != nil && !errors.Is(err, errObjectNotFound) {
+			return ShipReport{}, fmt.Errorf("failed to load shipping state: %w", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(body, &state); err != nil {
+				return ShipReport{}, fmt.Errorf("failed to parse shipping state: %w", err)
+			}
+		}
+		s.shippedTo, s.loaded = state.ShippedTo, true
+	}
+
+	report := ShipReport{From: s.shippedTo, To: time.Now().UTC().Add(-shippingLag).Truncate(time.Second)}
+	if report.To.After(report.From) {
+		var err error
+		if report.Messages, err = s.shipMessages(ctx, report.From, report.To); err != nil {
+			return report, err
+		}
+		if report.AuditEntries, err = s.shipAudit(ctx, report.From, report.To); err != nil {
+			return report, err
+		}
+		state, _ := json.Marshal(shippedState{ShippedTo: report.To})
+		if err := s.client.put(ctx, shippingState, state, "application/json"); err != nil {
+			return report, fmt.Errorf("failed to save shipping state: %w", err)
+		}
+		s.shippedTo = report.To
+	}
+
+	// Files are only shipped while they are younger than the retention
+	// period, or they would be deleted and shipped again every time
+	var since time.Time
+	if keep := s.client.config.Retention; keep > 0 {
+		since = time.Now().Add(-keep)
+	}
+	for _, dir := range []struct{ local, remote string }{
+		{s.transcripts, "transcripts/"},
+		{audioArchive.dir, "audio/"},
+		{retention.config.ArchiveDir, "retention/"},
+	} {
+		if dir.local == "" {
+			continue
+		}
+		count, err := s.syncDir(ctx, dir.local, dir.remote, since)
+		report.Files += count
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if !since.IsZero() {
+		var err error
+		if report.Deleted, err = s.expire(ctx, since); err != nil {
+			return report, err
+		}
+	}
+
+	if report.Messages > 0 || report.AuditEntries > 0 || report.Files > 0 || report.Deleted > 0 {
+		log.Printf("Shipped %d messages, %d audit entries and %d files, deleted %d expired objects",
+			report.Messages, report.AuditEntries, report.Files, report.Deleted)
+	}
+	return report, nil
+}
+
+// exportKey names an export of [from, to) under kind, in a directory per day
+func exportKey(kind string, from, to time.Time) string {
+	return kind + "/" + to.Format("2006/01/02/") + from.UTC().Format("20060102T150405Z") + "-" + to.Format("20060102T150405Z") + ".jsonl.gz"
+}
+
+// gzipLines collects JSON Lines into a gzipped body
+type gzipLines struct {
+	buffer  bytes.Buffer
+	writer  *gzip.Writer
+	encoder *json.Encoder
+	count   int
+}
+
+func newGzipLines() *gzipLines {
+	lines := &gzipLines{}
+	lines.writer = gzip.NewWriter(&lines.buffer)
+	lines.encoder = json.NewEncoder(lines.writer)
+	return lines
+}
+
+func (g *gzipLines) add(value any) error {
+	g.count++
+	return g.encoder.Encode(value)
+}
+
+func (g *gzipLines) bytes() ([]byte, error) {
+	if err := g.writer.Close(); err != nil {
+		return nil, err
+	}
+	return g.buffer.Bytes(), nil
+}
+
+// shipMessages ships the messages created in [from, to). Statuses are as they
+// were at the time; retention archives ship the final ones.
+func (s *archiveShipper) shipMessages(ctx context.Context, from, to time.Time) (int, error) {
+	lines := newGzipLines()
+	err := s.store.ExportMessages(ctx, ExportQuery{From: from, To: to}, func(msg ExportedMessage) error {
+		return lines.add(msg)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to export messages: %w", err)
+	}
+	return lines.count, s.putLines(ctx, exportKey("messages", from, to), lines)
+}
+
+// shipAudit ships the audit entries made in [from, to). SQLite keeps no audit log.
+func (s *archiveShipper) shipAudit(ctx context.Context, from, to time.Time) (int, error) {
+	lines := newGzipLines()
+	err := s.db.exportAuditEntries(ctx, from, to, func(entry AuditEntry) error {
+		return lines.add(entry)
+	})
+	if errors.Is(err, errPostgresRequired) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to export audit log: %w", err)
+	}
+	return lines.count, s.putLines(ctx, exportKey("audit", from, to), lines)
+}
+
+func (s *archiveShipper) putLines(ctx context.Context, key string, lines *gzipLines) error {
+	if lines.count == 0 {
+		return nil
+	}
+	body, err := lines.bytes()
+	if err != nil {
+		return err
+	}
+	if err := s.client.put(ctx, key, body, "application/gzip"); err != nil {
+		return fmt.Errorf("failed to ship %s: %w", key, err)
+	}
+	return nil
+}
+
+// syncDir ships the files under dir modified since since whose size differs
+// from the bucket's copy. Transcripts and archive indexes are only ever
+// appended to, so a changed file is a longer one.
+func (s *archiveShipper) syncDir(ctx context.Context, dir string, remote string, since time.Time) (int, error) {
+	shipped, err := s.client.list(ctx, remote)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", remote, err)
+	}
+	sizes := make(map[string]int64, len(shipped))
+	for _, object := range shipped {
+		sizes[object.Key] = object.Size
+	}
+
+	count := 0
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := remote + filepath.ToSlash(rel)
+		if info.ModTime().Before(since) {
+			return nil
+		}
+		if size, ok := sizes[key]; ok && size == info.Size() {
+			return nil
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := s.client.put(ctx, key, body, "application/octet-stream"); err != nil {
+			return fmt.Errorf("failed to ship %s: %w", path, err)
+		}
+		count++
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	return count, err
+}
+
+// expire deletes the shipped objects last written before cutoff
+func (s *archiveShipper) expire(ctx context.Context, cutoff time.Time) (int, error) {
+	objects, err := s.client.list(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list shipped objects: %w", err)
+	}
+	deleted := 0
+	for _, object := range objects {
+		if object.Key == shippingState || !object.LastModified.Before(cutoff) {
+			continue
+		}
+		if err := s.client.delete(ctx, object.Key); err != nil {
+			return deleted, fmt.Errorf("failed to delete %s: %w", object.Key, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// shipArchivesHandler ships now instead of waiting for the next shipment
+func (s *Server) shipArchivesHandler(c *gin.Context) {
+	if shipper.client == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Archive shipping is not configured"})
+		return
+	}
+
+	report, err := shipper.ship(c.Request.Context())
+	if errors.Is(err, errShipRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A shipment is already running"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error shipping archives: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to ship archives", "report": report})
+		return
+	}
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.db.recordAudit("archives.ship", user, "", report)
+	c.JSON(http.StatusOK, report)
+}
+
+// s3Client is just enough of the S3 REST API for shipping, signed with SigV4
+// like the Polly provider's requests
+type s3Client struct {
+	config   ShippingConfig
+	endpoint *url.URL
+	http     *http.Client
+}
+
+// s3Object is an object in a ListObjectsV2 result
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+func (s *s3Client) put(ctx context.Context, key string, body []byte, contentType string) error {
+	resp, err := s.do(ctx, http.MethodPut, s.config.Prefix+key, nil, body, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Client) get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.config.Prefix+key, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Client) delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.config.Prefix+key, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns every object whose key starts with prefix, with the client's
+// own prefix taken off their keys
+func (s *s3Client) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	objects := []s3Object{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object list: %w", err)
+		}
+		for _, object := range result.Contents {
+			object.Key = strings.TrimPrefix(object.Key, s.config.Prefix)
+			objects = append(objects, object)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for key, the bucket itself when key is ""
+func (s *s3Client) do(ctx context.Context, method string, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	target := *s.endpoint
+	path := strings.TrimSuffix(target.Path, "/")
+	if s.config.PathStyle {
+		path += "/" + s.config.Bucket
+	} else {
+		target.Host = s.config.Bucket + "." + target.Host
+	}
+	path += "/" + key
+	target.Path = path
+	target.RawPath = s3EscapePath(path)
+	target.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 request failed: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet && key != "" {
+		resp.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("s3 %s %s returned %d: %s", method, key, resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return resp, nil
+}
+
+// sign adds SigV4 headers for the s3 service
+func (s *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := s3SHA256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		signedHeaders = "content-type;" + signedHeaders
+		canonicalHeaders = "content-type:" + contentType + "\n" + canonicalHeaders
+	}
+
+	canonicalRequest := req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n" +
+		canonicalHeaders + "\n" + signedHeaders + "\n" + payloadHash
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + s3SHA256Hex([]byte(canonicalRequest))
+
+	key := s3HMAC([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = s3HMAC(key, s.config.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.config.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3Escape percent-encodes everything but the characters SigV4 leaves as they are
+func s3Escape(value string) string {
+	var out strings.Builder
+	for _, b := range []byte(value) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' {
+			out.WriteByte(b)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", b)
+		}
+	}
+	return out.String()
+}
+
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes query sorted by key, as SigV4 signs it
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3SHA256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"time"
+)
+
+// ShutdownReport is logged as the last thing a server does, so an operator
+// can tell what a shutdown finished and what it left for the next start
+type ShutdownReport struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	// MessagesInFlight were being accepted when shutdown began, and
+	// MessagesUnfinished still were when requests stopped being waited for
+	MessagesInFlight   int64
+	MessagesUnfinished int64
+	HubDrain
+	// HandedOff of the alerts stored as missed were passed to another instance
+	HandedOff int
+	// WebhooksSaved of WebhooksPending deliveries were stored to be resumed
+	WebhooksPending int
+	WebhooksSaved   int
+	EventsUnwritten int
+}
+
+// log writes the report as one structured line
+func (r ShutdownReport) log() {
+	slog.Info("Shutdown report",
+		"duration", r.Duration,
+		"messages_in_flight", r.MessagesInFlight,
+		"messages_unfinished", r.MessagesUnfinished,
+		"alerts_flushed", r.Flushed,
+		"alerts_stored_missed", r.StoredMissed,
+		"alerts_handed_off", r.HandedOff,
+		"listeners_drained", r.Listeners,
+		"webhook_deliveries_pending", r.WebhooksPending,
+		"webhook_deliveries_saved", r.WebhooksSaved,
+		"events_unwritten", r.EventsUnwritten,
+		"timed_out", r.TimedOut,
+	)
+}
+
+// storeAsync stores a delivered message without holding up delivery.
+// Shutdown waits for these writes before the store is closed.
+func (hub *Hub) storeAsync(message Message) {
+	hub.storing.Add(1)
+	go func() {
+		defer hub.storing.Done()
+		hub.storeMessage(message)
+	}()
+}
+
+// storeMissed records an alert that never played, so it can be requeued from
+// /admin/missed. Alerts from other instances are left to the instance they
+// came from, and test alerts aren't recorded at all. The write happens off
+// the hub's mutex, which callers may hold.
+func (hub *Hub) storeMissed(message Message) {
+	if message.Remote || message.Test || message.Probe || message.announcement() {
+		return
+	}
+	broadcastOutcomes.record(false)
+
+	message.Status = statusMissed
+	hub.storing.Add(1)
+	go func() {
+		defer hub.storing.Done()
+		if message.Replay {
+			if err := hub.db.setMessageStatus(message.SessionID, statusMissed); err != nil {
+				log.Printf("Error marking alert missed: %v", err)
+			}
+			return
+		}
+		if err := hub.store.AddMessage(message); err != nil {
+			log.Printf("Error storing missed alert: %v", err)
+		}
+	}()
+}
+
+// HubDrain is what Shutdown did with the hub's alerts and listeners
+type HubDrain struct {
+	// Flushed alerts went out to the listeners still connected, and StoredMissed
+	// were stored as missed for requeueing from /admin/missed
+	Flushed      int
+	StoredMissed int
+	Listeners    int
+	TimedOut     bool
+	// missed are the alerts stored as missed that this instance accepted, and
+	// controls the channels it had paused or quietened, for handing off
+	missed   []Message
+	controls []QueueState
+}
+
+// Shutdown drains the hub before the process exits. Broadcasts that arrive
+// from now on are stored as missed instead of delivered. Held alerts go out
+// to the listeners still connected, except on paused channels and with
+// pacing, where playing them all at once would overlap; those are stored as
+// missed. Each listener's queue is written out before it is sent
+// CloseServerDraining, so it can resume on another instance. It returns
+// once the hub has stopped and every message is stored, or when ctx is done.
+func (hub *Hub) Shutdown(ctx context.Context) HubDrain {
+	var drain HubDrain
+	hub.mutex.Lock()
+	hub.draining = true
+	if !hub.pacing.Enabled {
+		flushed := make(map[string]bool)
+		for _, alert := range hub.pending {
+			channel := alert.message.Channel
+			if !flushed[channel] && !hub.controls[channel].Paused {
+				flushed[channel] = true
+				drain.Flushed += hub.releasePending(channel, -1)
+			}
+		}
+	}
+	for _, alert := range hub.pending {
+		hub.storeMissed(alert.message)
+		if !alert.message.Remote && !alert.message.Test && !alert.message.Probe && !alert.message.announcement() {
+			drain.missed = append(drain.missed, alert.message)
+		}
+	}
+	for _, control := range hub.controls {
+		drain.controls = append(drain.controls, control)
+	}
+	if len(hub.pending) > 0 {
+		log.Printf("Stored %d undelivered alerts as missed", len(hub.pending))
+	}
+	drain.StoredMissed = len(hub.pending)
+	hub.pending = nil
+
+	var listeners []*listener
+	for _, clients := range hub.clients {
+		for client := range clients {
+			listeners = append(listeners, client)
+		}
+	}
+	hub.mutex.Unlock()
+
+	// Let each writer get through what is already queued for it
+	hub.waitForWriters(ctx, listeners)
+
+	hub.mutex.Lock()
+	for _, client := range listeners {
+		if !hub.clients[client.channel][client] {
+			continue
+		}
+		client.conn.closeWith(CloseServerDraining, hub.resumeCursor(client.channel))
+		hub.dropClient(client)
+		drain.Listeners++
+	}
+	hub.mutex.Unlock()
+
+	close(hub.quit)
+	stored := make(chan struct{})
+	go func() {
+		hub.storing.Wait()
+		close(stored)
+	}()
+	for _, done := range []chan struct{}{hub.stopped, stored} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Printf("Hub shutdown timed out: %v", ctx.Err())
+			drain.TimedOut = true
+			return drain
+		}
+	}
+	return drain
+}
+
+// waitForWriters has every listener write out its queue, and waits until
+// they all have, have been dropped, or ctx is done
+func (hub *Hub) waitForWriters(ctx context.Context, listeners []*listener) {
+	for _, client := range listeners {
+		close(client.drain)
+	}
+	for _, client := range listeners {
+		select {
+		case <-client.drained:
+		case <-client.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rheddev/tts-server/src/report"
+)
+
+const (
+	signingKeyPrefix = "whsec_"
+	// signatureHeader carries HMAC signatures on outgoing webhooks and signed API requests
+	signatureHeader = "X-TTS-Signature"
+	// signatureTolerance is how far a signed timestamp may be from now before it is refused as a replay
+	signatureTolerance = 5 * time.Minute
+	// signingKeyRefresh is how often each instance reloads the key ring to pick up rotations made elsewhere
+	signingKeyRefresh = time.Minute
+)
+
+// SigningKey is a shared secret used to sign outgoing webhooks and verify
+// signed requests. The secret is only returned once, at creation. A key that
+// has been rotated out keeps signing and verifying until RetiresAt, so
+// receivers can switch over without downtime.
+type SigningKey struct {
+	ID        int64      `json:"id"`
+	Prefix    string     `json:"prefix"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	secret    []byte
+}
+
+// RotateSigningKeyRequest is the body of POST /admin/keys/signing
+type RotateSigningKeyRequest struct {
+	// OverlapHours is how long the previous keys stay valid; defaults to SIGNING_KEY_OVERLAP_HOURS
+	OverlapHours *int `json:"overlap_hours"`
+}
+
+// active reports whether the key may still sign and verify
+func (k *SigningKey) active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.RetiresAt == nil || k.RetiresAt.After(now))
+}
+
+type signingKeyRing struct {
+	mutex sync.Mutex
+	db    *postgresStore
+	keys  []*SigningKey
+	// fallback is REPORT_SIGNING_KEY, used while no key has been minted
+	fallback []byte
+	overlap  time.Duration
+}
+
+// startSigningKeys loads the key ring from db and keeps it in sync
+func startSigningKeys(db *postgresStore, fallback []byte, overlap time.Duration) *signingKeyRing {
+	ring := &signingKeyRing{db: db, fallback: fallback, overlap: overlap}
+	ring.reload()
+	go func() {
+		ticker := time.NewTicker(signingKeyRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			ring.reload()
+		}
+	}()
+	return ring
+}
+
+func (r *signingKeyRing) reload() {
+	keys, err := r.db.listSigningKeys()
+	if errors.Is(err, errPostgresRequired) {
+		// Without Postgres only REPORT_SIGNING_KEY is available
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading signing keys: %v", err)
+		return
+	}
+	r.mutex.Lock()
+	r.keys = keys
+	r.mutex.Unlock()
+}
+
+// secrets returns the secrets of every active key, newest first
+func (r *signingKeyRing) secrets() [][]byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := clock.Now()
+	var secrets [][]byte
+	for _, key := range r.keys {
+		if key.active(now) {
+			secrets = append(secrets, key.secret)
+		}
+	}
+	if len(secrets) == 0 && len(r.fallback) > 0 {
+		secrets = append(secrets, r.fallback)
+	}
+	return secrets
+}
+
+// configured reports whether there is any key to sign with
+func (r *signingKeyRing) configured() bool {
+	return len(r.secrets()) > 0
+}
+
+// sign returns a signature header value for body, with one v1 signature per
+// active key: t=<unix>,v1=<hex>[,v1=<hex>]
+func (r *signingKeyRing) sign(body []byte) string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	parts := []string{"t=" + timestamp}
+	for _, secret := range r.secrets() {
+		parts = append(parts, "v1="+timestampedSignature(secret, timestamp, body))
+	}
+	return strings.Join(parts, ",")
+}
+
+// signReport signs a rendered report with every active key, as
+// sha256=<hex>[, sha256=<hex>]
+func (r *signingKeyRing) signReport(body []byte) string {
+	var signatures []string
+	for _, secret := range r.secrets() {
+		signatures = append(signatures, "sha256="+report.Sign(secret, body))
+	}
+	return strings.Join(signatures, ", ")
+}
+
+// verify checks a signature header against any active key
+func (r *signingKeyRing) verify(header string, body []byte) error {
+	return verifyTimestampedSignature(header, body, r.secrets(), signatureTolerance)
+}
+
+func timestampedSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyTimestampedSignature checks a t=<unix>,v1=<hex> header (the scheme
+// Stripe uses) against the raw body. Any v1 signature matching any secret is enough.
+func verifyTimestampedSignature(header string, body []byte, secrets [][]byte, tolerance time.Duration) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("malformed signature header")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed signature timestamp")
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("signature timestamp outside tolerance")
+	}
+
+	for _, secret := range secrets {
+		expected, _ := hex.DecodeString(timestampedSignature(secret, timestamp, body))
+		for _, signature := range signatures {
+			if decoded, err := hex.DecodeString(signature); err == nil && hmac.Equal(decoded, expected) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no matching signature")
+}
+
+func (s *Server) listSigningKeysHandler(c *gin.Context) {
+	keys, err := s.db.listSigningKeys()
+	if err != nil {
+		log.Printf("Error listing signing keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list signing keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// rotateSigningKeyHandler mints a new signing key. Keys that were active keep
+// working for the overlap window and then retire on their own.
+func (s *Server) rotateSigningKeyHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	var req RotateSigningKeyRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	overlap := s.hub.signingKeys.overlap
+	if req.OverlapHours != nil {
+		if *req.OverlapHours < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Overlap must not be negative"})
+			return
+		}
+		overlap = time.Duration(*req.OverlapHours) * time.Hour
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Error generating signing key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate signing key"})
+		return
+	}
+	raw := signingKeyPrefix + hex.EncodeToString(buf)
+
+	key := &SigningKey{
+		Prefix:    raw[:len(signingKeyPrefix)+8],
+		CreatedBy: user,
+		secret:    []byte(raw),
+	}
+	retiresAt := clock.Now().Add(overlap)
+	if err := s.db.rotateSigningKey(key, retiresAt); err != nil {
+		log.Printf("Error storing signing key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create signing key"})
+		return
+	}
+	s.hub.signingKeys.reload()
+
+	s.db.recordAudit("signingkey.rotated", user, key.Prefix, gin.H{"previous_retire_at": retiresAt})
+	c.JSON(http.StatusCreated, gin.H{"secret": raw, "signing_key": key, "previous_retire_at": retiresAt})
+}
+
+// revokeSigningKeyHandler retires a key immediately, without an overlap window
+func (s *Server) revokeSigningKeyHandler(c *gin.Context) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key ID"})
+		return
+	}
+
+	revoked, err := s.db.revokeSigningKey(id)
+	if err != nil {
+		log.Printf("Error revoking signing key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke signing key"})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Signing key not found or already revoked"})
+		return
+	}
+	s.hub.signingKeys.reload()
+
+	s.db.recordAudit("signingkey.revoked", user, strconv.FormatInt(id, 10), nil)
+	c.JSON(http.StatusOK, gin.H{"status": "Signing key revoked"})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// HomeAssistantSettings triggers smart home automations (e.g. flashing the
+// lights) when a channel's alerts play. The tier with the highest
+// min_amount the donation reaches is the one that fires.
+type HomeAssistantSettings struct {
+	// MQTTBroker is mqtt://[user:pass@]host[:port] (or mqtts://) for tiers that publish to a topic
+	MQTTBroker string      `json:"mqtt_broker"`
+	Tiers      []AlertTier `json:"tiers"`
+}
+
+// AlertTier is what happens for donations of at least MinAmount: a POST to a
+// Home Assistant webhook (https://<host>/api/webhook/<id>), an MQTT publish,
+// or both. Effect is passed through for the automation to pick a scene.
+type AlertTier struct {
+	MinAmount  float64 `json:"min_amount"`
+	WebhookURL string  `json:"webhook_url,omitempty"`
+	MQTTTopic  string  `json:"mqtt_topic,omitempty"`
+	Effect     string  `json:"effect,omitempty"`
+}
+
+// SmartHomeTrigger is the JSON body sent to webhooks and MQTT topics
+type SmartHomeTrigger struct {
+	Channel   string  `json:"channel"`
+	Name      string  `json:"name"`
+	Amount    float32 `json:"amount"`
+	MinAmount float64 `json:"min_amount"`
+	Effect    string  `json:"effect,omitempty"`
+	// DurationMS is how long the alert is expected to play
+	DurationMS int64 `json:"duration_ms"`
+}
+
+var smartHomeClient = &http.Client{Timeout: 5 * time.Second}
+
+func (s HomeAssistantSettings) validate() error {
+	if s.MQTTBroker != "" {
+		u, err := url.Parse(s.MQTTBroker)
+		if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Hostname() == "" {
+			return fmt.Errorf("invalid home_assistant mqtt_broker: %s", s.MQTTBroker)
+		}
+	}
+	for _, tier := range s.Tiers {
+		if tier.MinAmount < 0 {
+			return fmt.Errorf("home_assistant tier min_amount must not be negative")
+		}
+		if tier.WebhookURL == "" && tier.MQTTTopic == "" {
+			return fmt.Errorf("home_assistant tier for %g needs a webhook_url or mqtt_topic", tier.MinAmount)
+		}
+		if tier.WebhookURL != "" {
+			if err := validateWebhookURL(tier.WebhookURL); err != nil {
+				return err
+			}
+		}
+		if tier.MQTTTopic != "" && s.MQTTBroker == "" {
+			return fmt.Errorf("home_assistant mqtt_broker is required for mqtt_topic %s", tier.MQTTTopic)
+		}
+	}
+	return nil
+}
+
+// tierFor returns the tier a donation amount reaches, if any
+func (s HomeAssistantSettings) tierFor(amount float32) (AlertTier, bool) {
+	tiers := append([]AlertTier(nil), s.Tiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinAmount > tiers[j].MinAmount })
+	for _, tier := range tiers {
+		if float64(amount) >= tier.MinAmount {
+			return tier, true
+		}
+	}
+	return AlertTier{}, false
+}
+
+// triggerSmartHome fires the channel's Home Assistant tier for an alert that
+// is starting to play. Failures are only logged; the alert plays regardless.
+func triggerSmartHome(hub *Hub, msg Message, duration time.Duration) {
+	settings := hub.channelSettings(msg.Channel).HomeAssistant
+	tier, ok := settings.tierFor(msg.Amount)
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(SmartHomeTrigger{
+		Channel:    msg.Channel,
+		Name:       msg.Name,
+		Amount:     msg.Amount,
+		MinAmount:  tier.MinAmount,
+		Effect:     tier.Effect,
+		DurationMS: duration.Milliseconds(),
+	})
+	if err != nil {
+		log.Printf("Error encoding smart home trigger: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if tier.WebhookURL != "" {
+		if err := postSmartHomeWebhook(ctx, tier.WebhookURL, body); err != nil {
+			log.Printf("Error calling Home Assistant webhook for channel %s: %v", msg.Channel, err)
+		}
+	}
+	if tier.MQTTTopic != "" {
+		if err := publishMQTT(ctx, settings.MQTTBroker, tier.MQTTTopic, body); err != nil {
+			log.Printf("Error publishing smart home trigger for channel %s: %v", msg.Channel, err)
+		}
+	}
+}
+
+func postSmartHomeWebhook(ctx context.Context, webhookURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := smartHomeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
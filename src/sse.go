@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errStreamClosed = errors.New("event stream closed")
+
+// sseTransport is a listener's Server-Sent Events response. Frames are the
+// same JSON as on the WebSocket, one event each; messages carry their resume
+// cursor as the event ID so EventSource resumes with Last-Event-ID.
+type sseTransport struct {
+	mutex  sync.Mutex
+	w      gin.ResponseWriter
+	closed bool
+	// done is closed by Close, which ends the request
+	done      chan struct{}
+	reconnect ReconnectPolicy
+}
+
+func newSSETransport(w gin.ResponseWriter, reconnect ReconnectPolicy) *sseTransport {
+	return &sseTransport{w: w, done: make(chan struct{}), reconnect: reconnect}
+}
+
+// send writes one event. Writes after Close are refused, as the response may
+// already be finished.
+func (t *sseTransport) send(event string, id string, payload []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return errStreamClosed
+	}
+
+	// The server's write timeout is meant for ordinary requests; each event
+	// gets its own deadline instead
+	http.NewResponseController(t.w).SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	var frame bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&frame, "event: %s\n", event)
+	}
+	if id != "" {
+		fmt.Fprintf(&frame, "id: %s\n", id)
+	}
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		fmt.Fprintf(&frame, "data: %s\n", line)
+	}
+	frame.WriteString("\n")
+	if _, err := t.w.Write(frame.Bytes()); err != nil {
+		return err
+	}
+	t.w.Flush()
+	return nil
+}
+
+func (t *sseTransport) write(payload []byte) error {
+	var frame struct {
+		Cursor string `json:"cursor"`
+	}
+	json.Unmarshal(payload, &frame)
+	return t.send("", frame.Cursor, payload)
+}
+
+// ping writes a comment, which EventSource ignores, to keep proxies from
+// timing out the idle response
+func (t *sseTransport) ping() error {
+	return t.writeRaw(": ping\n\n")
+}
+
+// writeRaw writes lines that aren't an event, such as comments
+func (t *sseTransport) writeRaw(text string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return errStreamClosed
+	}
+	http.NewResponseController(t.w).SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := t.w.WriteString(text); err != nil {
+		return err
+	}
+	t.w.Flush()
+	return nil
+}
+
+// closeWith sends a close event carrying the same reason as a WebSocket close frame
+func (t *sseTransport) closeWith(code int, cursor string) error {
+	payload, err := json.Marshal(t.reconnect.closeReason(code, cursor))
+	if err != nil {
+		return err
+	}
+	return t.send("close", "", payload)
+}
+
+func (t *sseTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	return nil
+}
+
+// sseListenHandler streams a channel's alerts as text/event-stream, for
+// overlays and proxies that handle it better than WebSockets. It takes the
+// same parameters as /ws/listen; Last-Event-ID resumes like ?since=.
+func (s *Server) sseListenHandler(c *gin.Context) {
+	channel := c.Param("channel")
+	if channel == "" {
+		channel = requestChannel(c)
+	}
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+	if key := apiKeyFrom(c); key != nil && !key.allowsChannel(channel) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key is not valid for this channel"})
+		return
+	}
+	format, err := payloadFormat(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cursor := c.Query("since")
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		cursor = lastEventID
+	}
+	since, err := s.hub.cursors.verify(cursor, channel, apiKeyFrom(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for name, values := range instance.handshakeHeaders() {
+		for _, value := range values {
+			c.Writer.Header().Add(name, value)
+		}
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Keep nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	conn := newSSETransport(c.Writer, s.hub.reconnect)
+	// EventSource waits this long before reconnecting on its own
+	if err := conn.writeRaw("retry: " + strconv.FormatInt(s.hub.reconnect.BaseDelay.Milliseconds(), 10) + "\n\n"); err != nil {
+		return
+	}
+
+	if key := apiKeyFrom(c); key != nil {
+		defer trackKeyConnection(key, conn)()
+	}
+
+	client := s.hub.newListener(conn, channel, format)
+	client.remote = c.ClientIP()
+	client.canary = wantsCanary(c)
+	client.key = apiKeyFrom(c)
+	go client.writePump()
+	if since > 0 {
+		s.hub.replaySince(client, since)
+	}
+	s.hub.register <- client
+
+	select {
+	case <-c.Request.Context().Done():
+	case <-conn.done:
+	}
+	conn.Close()
+	s.hub.unregister <- client
+	log.Printf("Event stream listener on channel %s closed", channel)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Instance roles, as the status snapshot reports them
+const (
+	rolePrimary = "primary"
+	roleStandby = "standby"
+)
+
+// StandbyConfig makes an instance a warm standby: it serves reads and
+// listener connections, and refuses writes, until the primary's lease in
+// Redis lapses and it takes over
+type StandbyConfig struct {
+	Enabled bool
+	// LeaseTTL is how long the primary's lease lasts without being renewed,
+	// and so how soon a standby takes over from a primary that died
+	LeaseTTL time.Duration
+}
+
+type standbyState struct {
+	mutex sync.Mutex
+	// bus holds the lease
+	bus *redisBus
+	// db is where admins are notified of takeovers
+	db      *postgresStore
+	standby bool
+	// primary is the instance that held the lease when it was last checked
+	primary string
+	ttl     time.Duration
+	// epoch counts takeovers; a primary renews the lease only while it is
+	// the epoch it last saw, so one a standby took over from steps down
+	epoch      int64
+	epochKnown bool
+	// promote starts the work only the primary does, once started is set
+	// it is left running and pauses while the instance is a standby
+	promote func() error
+	started bool
+	// resumed is closed when a standby becomes primary, waking the readers
+	// waiting for it
+	resumed chan struct{}
+}
+
+// releaseLeaseScript deletes the lease only if this instance still holds it
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// renewLeaseScript renews the lease only if no standby has taken over since
+// the epoch the primary knows
+var renewLeaseScript = redis.NewScript(`
+if (redis.call("GET", KEYS[2]) or "0") ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[3])
+return 1`)
+
+// takeLeaseScript takes a lapsed lease and starts a new epoch, returning it,
+// or 0 while the lease is held
+var takeLeaseScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0`)
+
+func (b *redisBus) leaseKey() string {
+	return b.prefix + ":primary"
+}
+
+func (b *redisBus) epochKey() string {
+	return b.prefix + ":primary_epoch"
+}
+
+// startLease keeps the primary lease on hub's bus renewed, or as a standby
+// watches it and is promoted once it lapses. Without Redis there is no lease
+// and every instance is a primary.
+func startLease(config StandbyConfig, hub *Hub, promote func() error) {
+	bus := hub.bus
+	if bus == nil {
+		return
+	}
+	standby := hub.standby
+	standby.mutex.Lock()
+	standby.bus = bus
+	standby.db = hub.db
+	standby.standby = config.Enabled
+	standby.ttl = config.LeaseTTL
+	standby.promote = promote
+	standby.started = promote == nil
+	standby.mutex.Unlock()
+	if config.Enabled {
+		log.Printf("Starting as a standby; taking over when the primary lease %s lapses", bus.leaseKey())
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.LeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			standby.renew()
+			<-ticker.C
+		}
+	}()
+}
+
+// renew renews the lease as a primary, or as a standby tries to take it
+func (s *standbyState) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	key := s.bus.leaseKey()
+
+	if !s.active() {
+		// Primaries running side by side all renew the same lease; a standby
+		// only needs to know one of them is alive
+		s.mutex.Lock()
+		epoch, known := s.epoch, s.epochKnown
+		s.mutex.Unlock()
+		if !known {
+			var err error
+			if epoch, err = s.bus.client.Get(ctx, s.bus.epochKey()).Int64(); err != nil && err != redis.Nil {
+				log.Printf("Error checking primary lease: %v", err)
+				return
+			}
+			s.mutex.Lock()
+			s.epoch, s.epochKnown = epoch, true
+			s.mutex.Unlock()
+		}
+		renewed, err := renewLeaseScript.Run(ctx, s.bus.client, []string{key, s.bus.epochKey()},
+			instance.ID, strconv.FormatInt(epoch, 10), s.ttl.Milliseconds()).Int()
+		if err != nil {
+			log.Printf("Error renewing primary lease: %v", err)
+			return
+		}
+		if renewed == 0 {
+			s.stepDown(ctx)
+		}
+		return
+	}
+
+	epoch, err := takeLeaseScript.Run(ctx, s.bus.client, []string{key, s.bus.epochKey()}, instance.ID, s.ttl.Milliseconds()).Int64()
+	if err != nil {
+		log.Printf("Error checking primary lease: %v", err)
+		return
+	}
+	if epoch == 0 {
+		if primary, err := s.bus.client.Get(ctx, key).Result(); err == nil {
+			s.mutex.Lock()
+			s.primary = primary
+			s.mutex.Unlock()
+		}
+		return
+	}
+	s.takeOver(epoch)
+}
+
+// takeOver promotes this standby to primary, starting the primary's work
+// unless it was already running from before a step down
+func (s *standbyState) takeOver(epoch int64) {
+	s.mutex.Lock()
+	previous := s.primary
+	s.standby = false
+	s.primary = ""
+	s.epoch, s.epochKnown = epoch, true
+	promote := s.promote
+	if s.started {
+		promote = nil
+	}
+	s.started = true
+	if s.resumed != nil {
+		close(s.resumed)
+		s.resumed = nil
+	}
+	s.mutex.Unlock()
+
+	log.Printf("Primary lease lapsed; instance %s is now the primary", instance.ID)
+	s.db.notifyAdmins("standby_promoted", fmt.Sprintf("Standby %s took over from primary %s", instance.ID, firstNonEmpty(previous, "(unknown)")), gin.H{"instance_id": instance.ID, "previous": previous})
+	if promote != nil {
+		if err := promote(); err != nil {
+			log.Printf("Error starting primary work after promotion: %v", err)
+		}
+	}
+}
+
+// stepDown makes a primary that a standby took over from a standby itself,
+// as when its lease lapsed during a Redis outage, so there is only ever one
+// primary. It refuses writes and its primary work pauses until it takes the
+// lease back.
+func (s *standbyState) stepDown(ctx context.Context) {
+	primary, _ := s.bus.client.Get(ctx, s.bus.leaseKey()).Result()
+	s.mutex.Lock()
+	s.standby = true
+	s.primary = primary
+	s.epochKnown = false
+	s.mutex.Unlock()
+
+	log.Printf("Instance %s lost the primary lease to %s; it is now a standby", instance.ID, firstNonEmpty(primary, "(unknown)"))
+	s.db.notifyAdmins("primary_demoted", fmt.Sprintf("Primary %s stepped down; %s took over", instance.ID, firstNonEmpty(primary, "(unknown)")), gin.H{"instance_id": instance.ID, "primary": primary})
+}
+
+// releaseLease gives up the lease on shutdown, so a standby takes over
+// without waiting for it to lapse
+func (s *standbyState) releaseLease() {
+	s.mutex.Lock()
+	bus := s.bus
+	s.mutex.Unlock()
+	if bus == nil || s.active() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := releaseLeaseScript.Run(ctx, bus.client, []string{bus.leaseKey()}, instance.ID).Err(); err != nil {
+		log.Printf("Error releasing primary lease: %v", err)
+	}
+}
+
+// active reports whether this instance is still a standby
+func (s *standbyState) active() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.standby
+}
+
+// waitPrimary blocks while this instance is a standby. Payment and chat
+// readers left running by a step down wait here with what they have read,
+// rather than drop it with their cursor already past it.
+func (s *standbyState) waitPrimary(what string) {
+	logged := false
+	for {
+		s.mutex.Lock()
+		if !s.standby {
+			s.mutex.Unlock()
+			return
+		}
+		if s.resumed == nil {
+			s.resumed = make(chan struct{})
+		}
+		resumed := s.resumed
+		s.mutex.Unlock()
+		if !logged {
+			log.Printf("Holding %s until this instance is the primary again", what)
+			logged = true
+		}
+		<-resumed
+	}
+}
+
+// role is the instance's role for the status snapshot
+func (s *standbyState) role() string {
+	if s.active() {
+		return roleStandby
+	}
+	return rolePrimary
+}
+
+// standbyGuard refuses writes while standby says this instance is a standby,
+// so load balancers and webhook senders retry them against the primary
+func standbyGuard(standby *standbyState) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isWrite(c.Request) || !standby.active() {
+			c.Next()
+			return
+		}
+		standby.mutex.Lock()
+		primary, ttl := standby.primary, standby.ttl
+		standby.mutex.Unlock()
+		if primary != "" {
+			c.Header("X-Primary-Instance", primary)
+		}
+		c.Header("Retry-After", strconv.Itoa(int(ttl.Seconds())))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "This instance is a standby and takes no writes"})
+	}
+}
+
+// isWrite reports whether a request may change anything
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		// Moderators approve and reject over the admin socket
+		return r.URL.Path == "/ws/admin"
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestStandby is a standby's lease state on a Redis nobody listens on, so
+// lease lookups fail at once, and without Postgres for its notifications
+func newTestStandby(t *testing.T) *standbyState {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	return &standbyState{
+		bus:     &redisBus{client: client, prefix: "test"},
+		db:      postgresOf(nil),
+		standby: true,
+		ttl:     15 * time.Second,
+	}
+}
+
+// holdReader runs a reader that waits for the primary and returns once it is
+// holding, with a channel closed when the reader is let through
+func holdReader(t *testing.T, s *standbyState) <-chan struct{} {
+	t.Helper()
+	released := make(chan struct{})
+	go func() {
+		s.waitPrimary("test reader")
+		close(released)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mutex.Lock()
+		holding := s.resumed != nil
+		s.mutex.Unlock()
+		if holding {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("reader never waited for the primary")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-released:
+		t.Fatal("reader let through while the instance is a standby")
+	default:
+	}
+	return released
+}
+
+// waitReleased fails the test unless the held reader is let through
+func waitReleased(t *testing.T, released <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader still held after the takeover")
+	}
+}
+
+func TestTakeOverReleasesHeldReaders(t *testing.T) {
+	s := newTestStandby(t)
+	released := holdReader(t, s)
+
+	s.takeOver(1)
+	waitReleased(t, released)
+	if s.active() {
+		t.Fatal("instance is still a standby after taking over")
+	}
+	if s.epoch != 1 || !s.epochKnown {
+		t.Fatalf("epoch = %d (known %t), want 1", s.epoch, s.epochKnown)
+	}
+}
+
+func TestSteppedDownPrimaryHoldsReadersUntilItTakesBackTheLease(t *testing.T) {
+	s := newTestStandby(t)
+	promotions := 0
+	s.promote = func() error {
+		promotions++
+		return nil
+	}
+
+	s.takeOver(1)
+	if promotions != 1 {
+		t.Fatalf("promoted %d times on takeover, want 1", promotions)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	s.stepDown(ctx)
+	if !s.active() {
+		t.Fatal("instance is still the primary after stepping down")
+	}
+	if s.epochKnown {
+		t.Fatal("stepped down primary still trusts its old epoch")
+	}
+	released := holdReader(t, s)
+
+	s.takeOver(2)
+	waitReleased(t, released)
+	// The primary's work was left running through the step down
+	if promotions != 1 {
+		t.Fatalf("promoted %d times after taking the lease back, want 1", promotions)
+	}
+	if s.role() != rolePrimary {
+		t.Fatalf("role = %s, want %s", s.role(), rolePrimary)
+	}
+}
+
+func TestStandbyGuardRefusesWritesUntilPromoted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newTestStandby(t)
+	s.primary = "instance-a"
+
+	router := gin.New()
+	router.Use(standbyGuard(s))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/messages", ok)
+	router.POST("/ws/send", ok)
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	if code := request(http.MethodGet, "/messages").Code; code != http.StatusOK {
+		t.Fatalf("read on a standby: status %d, want %d", code, http.StatusOK)
+	}
+	refused := request(http.MethodPost, "/ws/send")
+	if refused.Code != http.StatusServiceUnavailable {
+		t.Fatalf("write on a standby: status %d, want %d", refused.Code, http.StatusServiceUnavailable)
+	}
+	if primary := refused.Header().Get("X-Primary-Instance"); primary != "instance-a" {
+		t.Fatalf("X-Primary-Instance = %q, want instance-a", primary)
+	}
+	if retry := refused.Header().Get("Retry-After"); retry != "15" {
+		t.Fatalf("Retry-After = %q, want the lease TTL of 15", retry)
+	}
+
+	s.takeOver(1)
+	if code := request(http.MethodPost, "/ws/send").Code; code != http.StatusOK {
+		t.Fatalf("write after the takeover: status %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StatusSnapshot is a machine-readable view of server health for dashboards and uptime monitors
+type StatusSnapshot struct {
+	InstanceID    string            `json:"instance_id"`
+	Role          string            `json:"role"`
+	Uptime        float64           `json:"uptime_seconds"`
+	Listeners     map[string]int    `json:"listeners"`
+	QueueDepths   map[string]int    `json:"queue_depths"`
+	LastBroadcast *time.Time        `json:"last_broadcast,omitempty"`
+	Database      DatabaseStatus    `json:"database"`
+	Providers     map[string]string `json:"providers"`
+	SelfTest      SelfTestStatus    `json:"selftest"`
+	// Maintenance is the last database maintenance run's report
+	Maintenance *MaintenanceReport `json:"maintenance,omitempty"`
+	Timestamp   time.Time          `json:"timestamp"`
+}
+
+// DatabaseStatus reports connectivity and round-trip latency to the database
+type DatabaseStatus struct {
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// pingDatabase measures a single round trip to store's database
+func pingDatabase(ctx context.Context, store Store) DatabaseStatus {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	started := time.Now()
+	err := store.Ping(ctx)
+	status := DatabaseStatus{
+		OK:        err == nil,
+		LatencyMs: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// collectStatus gathers the current status snapshot
+func (s *Server) collectStatus(ctx context.Context) StatusSnapshot {
+	s.hub.mutex.Lock()
+	listeners := s.hub.listenerCount()
+	lastBroadcast := s.hub.lastBroadcast
+	s.hub.mutex.Unlock()
+
+	donationTicker.mutex.Lock()
+	tickerListeners := len(donationTicker.clients)
+	donationTicker.mutex.Unlock()
+
+	snapshot := StatusSnapshot{
+		InstanceID: instance.ID,
+		Role:       s.hub.standby.role(),
+		Uptime:     time.Since(instance.StartedAt).Seconds(),
+		Listeners: map[string]int{
+			"ws":     listeners,
+			"ticker": tickerListeners,
+		},
+		QueueDepths: map[string]int{
+			"broadcast": len(s.hub.broadcast),
+			"events":    len(s.hub.events),
+		},
+		Database:    pingDatabase(ctx, s.store),
+		Providers:   s.hub.synthesis.providerHealth(),
+		SelfTest:    selfTest.snapshot(),
+		Maintenance: maintenance.lastReport(),
+		Timestamp:   time.Now(),
+	}
+	if !lastBroadcast.IsZero() {
+		snapshot.LastBroadcast = &lastBroadcast
+	}
+
+	return snapshot
+}
+
+// statusHandler serves the status snapshot; it responds 503 when the database is unreachable
+func (s *Server) statusHandler(c *gin.Context) {
+	snapshot := s.collectStatus(c.Request.Context())
+
+	code := http.StatusOK
+	if !snapshot.Database.OK {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, snapshot)
+}
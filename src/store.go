@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Storage drivers selected by DB_DRIVER
+const (
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+// errPostgresRequired is returned by features that only the Postgres store supports
+var errPostgresRequired = errors.New("not available with DB_DRIVER=sqlite")
+
+var errMessageNotFound = errors.New("message not found")
+
+// Store keeps the message log: everything sending, listening and the message
+// history need. Postgres backs every other feature as well; SQLite covers just
+// the message log, for single-streamer setups that don't want to run a server.
+type Store interface {
+	AddMessage(msg Message) error
+	// GetMessages returns a page of the delivered message history
+	GetMessages(query MessageQuery) []Message
+	// CheckSessionID and NextMessageID are on the send path, so they give up
+	// when ctx does, e.g. when the sender disconnects
+	CheckSessionID(ctx context.Context, sessionID string) (bool, error)
+	// NextMessageID reserves the ID a new message will be stored under
+	NextMessageID(ctx context.Context) (int64, error)
+	// GetMessagesSince returns up to limit delivered messages of a channel
+	// stored after the given ID, oldest first
+	GetMessagesSince(channel string, since int64, limit int) ([]Message, error)
+	// AckMessage records that an overlay on the channel finished playing a message
+	AckMessage(id int64, channel string) error
+	// RedactMessage blanks a stored message's text and donor and takes it out
+	// of the history. It reports false if no message has the session ID.
+	RedactMessage(sessionID string) (bool, error)
+	// ExportMessages calls fn with every stored message the query selects,
+	// whatever its status, oldest first
+	ExportMessages(ctx context.Context, query ExportQuery, fn func(ExportedMessage) error) error
+	// GetMessageByID returns a stored message whatever its status, or
+	// errMessageNotFound
+	GetMessageByID(ctx context.Context, id int64) (ExportedMessage, error)
+	// GetDonorSummary adds up a donor's donations on a channel and lists
+	// their latest
+	GetDonorSummary(ctx context.Context, query DonorQuery) (DonorSummary, error)
+	// DeleteExpiredMessages deletes up to limit of the oldest messages created
+	// before the cutoff and returns how many it deleted
+	DeleteExpiredMessages(before time.Time, limit int) (int64, error)
+	// DeleteSandboxMessages deletes up to limit of the oldest messages of a
+	// sandbox channel, or of every sandbox when channel is "", created before
+	// the cutoff
+	DeleteSandboxMessages(channel string, before time.Time, limit int) (int64, error)
+	// MaintainTables vacuums and analyzes the message tables, and reports
+	// their health and any invalid indexes or failed integrity checks. SQLite
+	// is only vacuumed once bloatPercent of its file is free pages, since
+	// that rewrites the whole file.
+	MaintainTables(ctx context.Context, bloatPercent float64) ([]TableHealth, []string, error)
+	Ping(ctx context.Context) error
+	Close()
+}
+
+// MessageQuery selects a page of the message history
+type MessageQuery struct {
+	From    time.Time
+	To      time.Time
+	Channel string
+	// Name matches donor names case-insensitively, anywhere in the name
+	Name string
+	// Ascending lists the oldest messages first instead of the newest
+	Ascending bool
+	Limit     int
+	Offset    int
+}
+
+// order is the SQL sort direction for the query
+func (q MessageQuery) order() string {
+	if q.Ascending {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// openStore connects the storage driver from DB_DRIVER, recording database
+// calls in metrics
+func openStore(metrics *metricsRegistry) (Store, error) {
+	config, err := loadDBConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load database config: %w", err)
+	}
+
+	switch config.Driver {
+	case driverPostgres:
+		postgres, err := connectPostgres(metrics)
+		if err != nil {
+			return nil, err
+		}
+		return postgres, nil
+	case driverSQLite:
+		sqlite, err := openSQLiteStore(config.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		return sqlite, nil
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", config.Driver)
+	}
+}
+
+// usesPostgres reports whether the Postgres-only features are available
+func usesPostgres(store Store) bool {
+	_, ok := store.(*postgresStore)
+	return ok
+}
+
+// postgresOf is the store the Postgres-only features use: store itself under
+// Postgres, and under SQLite one that fails every call with
+// errPostgresRequired
+func postgresOf(store Store) *postgresStore {
+	if postgres, ok := store.(*postgresStore); ok {
+		return postgres
+	}
+	return &postgresStore{pool: unavailablePool{}}
+}
+
+// pgPool is the part of pgxpool.Pool the database functions use
+type pgPool interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Acquire(ctx context.Context) (*pgxpool.Conn, error)
+	Ping(ctx context.Context) error
+	Close()
+}
+
+// unavailablePool stands in for the Postgres pool under SQLite, failing every
+// call with errPostgresRequired
+type unavailablePool struct{}
+
+func (unavailablePool) Exec(context.Context, string, ...any) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, errPostgresRequired
+}
+
+func (unavailablePool) Query(context.Context, string, ...any) (pgx.Rows, error) {
+	return nil, errPostgresRequired
+}
+
+func (unavailablePool) QueryRow(context.Context, string, ...any) pgx.Row {
+	return unavailableRow{}
+}
+
+func (unavailablePool) Acquire(context.Context) (*pgxpool.Conn, error) {
+	return nil, errPostgresRequired
+}
+
+func (unavailablePool) Ping(context.Context) error {
+	return errPostgresRequired
+}
+
+func (unavailablePool) Close() {}
+
+type unavailableRow struct{}
+
+func (unavailableRow) Scan(...any) error {
+	return errPostgresRequired
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema is created when the store is opened. message_ids stands in for
+// the Postgres sequence that hands out message IDs before they are stored.
+const sqliteSchema = `
+	CREATE TABLE IF NOT EXISTS tts_messages (
+		id             INTEGER PRIMARY KEY,
+		session_id     TEXT NOT NULL,
+		name           TEXT NOT NULL,
+		amount         REAL NOT NULL,
+		message        TEXT NOT NULL,
+		description    TEXT NOT NULL DEFAULT '',
+		anonymous      INTEGER NOT NULL DEFAULT 0,
+		name_encrypted BLOB,
+		status         TEXT NOT NULL DEFAULT 'broadcast',
+		channel        TEXT NOT NULL DEFAULT 'default',
+		status_token   TEXT UNIQUE,
+		played_at      INTEGER,
+		created_at     INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS tts_messages_channel_id_idx ON tts_messages (channel, id);
+	DROP INDEX IF EXISTS tts_messages_session_idx;
+	DELETE FROM tts_messages WHERE id NOT IN (SELECT MIN(id) FROM tts_messages GROUP BY session_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS tts_messages_session_id_key ON tts_messages (session_id);
+	CREATE INDEX IF NOT EXISTS tts_messages_created_idx ON tts_messages (created_at);
+	CREATE INDEX IF NOT EXISTS tts_messages_donor_idx ON tts_messages (channel, name COLLATE NOCASE) WHERE NOT anonymous;
+	CREATE TABLE IF NOT EXISTS message_ids (
+		id INTEGER PRIMARY KEY AUTOINCREMENT
+	);
+`
+
+var (
+	sqliteInsertMessageQuery = `
+		INSERT INTO tts_messages (id, session_id, name, amount, message, description, anonymous, name_encrypted, status, channel, status_token, created_at)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, COALESCE(NULLIF(?9, ''), 'broadcast'), ?10, NULLIF(?11, ''), ?12)
+		ON CONFLICT (session_id) DO NOTHING
+	`
+	sqliteSelectMessagesSinceQuery = `
+		SELECT id, session_id, name, amount, message, description, anonymous, channel
+		FROM tts_messages
+		WHERE channel = ?1 AND id > ?2 AND status NOT IN ('hidden', 'rejected', 'missed', 'blocked', 'redacted')
+		ORDER BY id
+		LIMIT ?3
+	`
+	sqliteAckMessageQuery = `
+		UPDATE tts_messages SET played_at = ?3
+		WHERE id = ?1 AND channel = ?2 AND played_at IS NULL
+	`
+	// sqliteSelectMessagesQuery is formatted with the sort direction
+	sqliteSelectMessagesQuery = `
+		SELECT session_id, name, amount, message, description, anonymous, channel
+		FROM tts_messages
+		WHERE created_at >= ?1 AND created_at <= ?2 AND status NOT IN ('hidden', 'rejected', 'blocked', 'redacted')
+			AND (?3 = '' OR channel = ?3)
+			AND (?4 = '' OR instr(lower(name), lower(?4)) > 0)
+		ORDER BY created_at %[1]s, id %[1]s
+		LIMIT ?5 OFFSET ?6
+	`
+	sqliteExportMessagesQuery = `
+		SELECT id, session_id, channel, name, amount, message, description, anonymous, status, created_at, played_at
+		FROM tts_messages
+		WHERE created_at >= ?1 AND created_at < ?2 AND (?3 = '' OR channel = ?3)
+		ORDER BY created_at, id
+	`
+	sqliteSelectMessageByIDQuery = `
+		SELECT id, session_id, channel, name, amount, message, description, anonymous, status, created_at, played_at
+		FROM tts_messages
+		WHERE id = ?1
+	`
+	// sqliteDonorMessagesFilter matches donorMessagesFilter; refunds and
+	// message kinds are only recorded in Postgres
+	sqliteDonorMessagesFilter = `
+		channel = ?1 AND name = ?2 COLLATE NOCASE AND NOT anonymous AND amount > 0
+		AND status NOT IN ('hidden', 'rejected', 'blocked', 'redacted', 'pending')
+	`
+	sqliteSelectDonorTotalsQuery = `
+		SELECT COUNT(*), COALESCE(SUM(amount), 0),
+			COUNT(CASE WHEN created_at >= ?3 THEN 1 END), COALESCE(SUM(CASE WHEN created_at >= ?3 THEN amount END), 0),
+			MIN(created_at), MAX(created_at)
+		FROM tts_messages
+		WHERE` + sqliteDonorMessagesFilter
+	sqliteSelectDonorDonationsQuery = `
+		SELECT id, amount, created_at
+		FROM tts_messages
+		WHERE` + sqliteDonorMessagesFilter + `
+		ORDER BY id DESC
+		LIMIT ?3
+	`
+	sqliteDeleteExpiredMessagesQuery = `
+		DELETE FROM tts_messages
+		WHERE id IN (SELECT id FROM tts_messages WHERE created_at < ?1 ORDER BY created_at LIMIT ?2)
+	`
+	sqliteDeleteSandboxMessagesQuery = `
+		DELETE FROM tts_messages
+		WHERE id IN (
+			SELECT id FROM tts_messages
+			WHERE created_at < ?1 AND channel LIKE '%-sandbox' AND (?3 = '' OR channel = ?3)
+			ORDER BY created_at LIMIT ?2
+		)
+	`
+	sqliteRedactMessageQuery = `
+		UPDATE tts_messages
+		SET name = '', message = '', description = '', name_encrypted = NULL, status = 'redacted'
+		WHERE session_id = ?1
+	`
+)
+
+// sqliteStore keeps the message log in a local SQLite file. Times are stored
+// as Unix milliseconds.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	// One connection serializes writes, which is all a single streamer needs
+	// and keeps SQLite from reporting the database as busy
+	dsn := "file:" + path + "?_pragma=" + url.QueryEscape("busy_timeout(5000)") + "&_pragma=" + url.QueryEscape("journal_mode(WAL)")
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create SQLite schema: %w", err)
+	}
+
+	log.Printf("Storing messages in SQLite database %s", path)
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) AddMessage(msg Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if msg.ID == 0 {
+		id, err := s.NextMessageID(ctx)
+		if err != nil {
+			return err
+		}
+		msg.ID = id
+	}
+
+	result, err := s.db.ExecContext(ctx, sqliteInsertMessageQuery,
+		msg.ID,
+		msg.SessionID,
+		msg.Name,
+		msg.Amount,
+		msg.Message,
+		msg.Description,
+		msg.Anonymous,
+		msg.EncryptedName,
+		msg.Status,
+		msg.Channel,
+		msg.StatusToken,
+		time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert message: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return errDuplicateSession
+	}
+	return nil
+}
+
+func (s *sqliteStore) GetMessages(query MessageQuery) []Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(sqliteSelectMessagesQuery, query.order()),
+		query.From.UnixMilli(), query.To.UnixMilli(), query.Channel, query.Name, query.Limit, query.Offset)
+	if err != nil {
+		log.Printf("Error querying database: %v", err)
+		return []Message{}
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating rows: %v", err)
+	}
+
+	return messages
+}
+
+func (s *sqliteStore) CheckSessionID(ctx context.Context, sessionID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM tts_messages WHERE session_id = ?1", sessionID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("failed to query database: %w", err)
+	}
+
+	log.Printf("Session ID %s exists check: count = %d", sessionID, count)
+
+	return count > 0, nil
+}
+
+// NextMessageID draws from message_ids, whose AUTOINCREMENT never reuses an ID
+func (s *sqliteStore) NextMessageID(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, "INSERT INTO message_ids DEFAULT VALUES")
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve message ID: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve message ID: %w", err)
+	}
+	// Only the sequence matters, not the rows
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM message_ids WHERE id < ?1", id); err != nil {
+		log.Printf("Error trimming message IDs: %v", err)
+	}
+	return id, nil
+}
+
+func (s *sqliteStore) GetMessagesSince(channel string, since int64, limit int) ([]Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, sqliteSelectMessagesSinceQuery, channel, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Name, &msg.Amount, &msg.Message, &msg.Description, &msg.Anonymous, &msg.Channel); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *sqliteStore) AckMessage(id int64, channel string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, sqliteAckMessageQuery, id, channel, time.Now().UnixMilli()); err != nil {
+		return fmt.Errorf("failed to acknowledge message: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) RedactMessage(sessionID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, sqliteRedactMessageQuery, sessionID)
+	if err != nil {
+		return false, fmt.Errorf("failed to redact message: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to redact message: %w", err)
+	}
+	return affected > 0, nil
+}
+
+func (s *sqliteStore) ExportMessages(ctx context.Context, query ExportQuery, fn func(ExportedMessage) error) error {
+	rows, err := s.db.QueryContext(ctx, sqliteExportMessagesQuery, query.From.UnixMilli(), query.To.UnixMilli(), query.Channel)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	defer rows.Close()
+
+	// Only one connection is open, so rows are collected before fn can be slow
+	// about writing them out
+	var messages []ExportedMessage
+	for rows.Next() {
+		msg, err := scanSQLiteExportedMessage(rows)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query messages: %w", err)
+	}
+	rows.Close()
+
+	for _, msg := range messages {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) GetMessageByID(ctx context.Context, id int64) (ExportedMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	msg, err := scanSQLiteExportedMessage(s.db.QueryRowContext(ctx, sqliteSelectMessageByIDQuery, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return msg, errMessageNotFound
+	}
+	return msg, err
+}
+
+func (s *sqliteStore) GetDonorSummary(ctx context.Context, query DonorQuery) (DonorSummary, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	summary := DonorSummary{Recent: []DonorDonation{}}
+	var firstAt, lastAt sql.NullInt64
+	err := s.db.QueryRowContext(ctx, sqliteSelectDonorTotalsQuery, query.Channel, query.Donor, query.Month.UnixMilli()).Scan(
+		&summary.Lifetime.Count, &summary.Lifetime.Total, &summary.ThisMonth.Count, &summary.ThisMonth.Total, &firstAt, &lastAt)
+	if err != nil {
+		return summary, fmt.Errorf("failed to add up donor donations: %w", err)
+	}
+	if summary.Lifetime.Count == 0 {
+		return summary, nil
+	}
+	first, last := time.UnixMilli(firstAt.Int64), time.UnixMilli(lastAt.Int64)
+	summary.FirstAt, summary.LastAt = &first, &last
+
+	rows, err := s.db.QueryContext(ctx, sqliteSelectDonorDonationsQuery, query.Channel, query.Donor, query.Recent)
+	if err != nil {
+		return summary, fmt.Errorf("failed to query donor donations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var donation DonorDonation
+		var createdAt int64
+		if err := rows.Scan(&donation.ID, &donation.Amount, &createdAt); err != nil {
+			return summary, fmt.Errorf("failed to scan donor donation: %w", err)
+		}
+		donation.CreatedAt = time.UnixMilli(createdAt)
+		summary.Recent = append(summary.Recent, donation)
+	}
+	return summary, rows.Err()
+}
+
+func (s *sqliteStore) DeleteExpiredMessages(before time.Time, limit int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, sqliteDeleteExpiredMessagesQuery, before.UnixMilli(), limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete messages: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete messages: %w", err)
+	}
+	return affected, nil
+}
+
+func (s *sqliteStore) MaintainTables(ctx context.Context, bloatPercent float64) ([]TableHealth, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	var problems []string
+	rows, err := s.db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("failed to check database integrity: %w", err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to check database integrity: %w", err)
+	}
+
+	free, err := s.freePercent(ctx)
+	if err != nil {
+		return nil, problems, err
+	}
+	// VACUUM would copy a corrupt index along with everything else
+	if free >= bloatPercent && len(problems) == 0 {
+		if _, err := s.db.ExecContext(ctx, "VACUUM"); err != nil {
+			return nil, problems, fmt.Errorf("failed to vacuum database: %w", err)
+		}
+		if free, err = s.freePercent(ctx); err != nil {
+			return nil, problems, err
+		}
+	}
+	if _, err := s.db.ExecContext(ctx, "ANALYZE tts_messages"); err != nil {
+		return nil, problems, fmt.Errorf("failed to analyze tts_messages: %w", err)
+	}
+
+	table := TableHealth{Table: "tts_messages", BloatPercent: free}
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*), (SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()) FROM tts_messages").Scan(&table.Rows, &table.SizeBytes)
+	if err != nil {
+		return nil, problems, fmt.Errorf("failed to query table health: %w", err)
+	}
+	return []TableHealth{table}, problems, nil
+}
+
+// freePercent is the share of the database file that is free pages
+func (s *sqliteStore) freePercent(ctx context.Context) (float64, error) {
+	var free, total int64
+	if err := s.db.QueryRowContext(ctx, "SELECT freelist_count, page_count FROM pragma_freelist_count(), pragma_page_count()").Scan(&free, &total); err != nil {
+		return 0, fmt.Errorf("failed to count free pages: %w", err)
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(free) / float64(total) * 100, nil
+}
+
+func (s *sqliteStore) DeleteSandboxMessages(channel string, before time.Time, limit int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, sqliteDeleteSandboxMessagesQuery, before.UnixMilli(), limit, channel)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sandbox messages: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sandbox messages: %w", err)
+	}
+	return affected, nil
+}
+
+func scanSQLiteExportedMessage(rows rowScanner) (ExportedMessage, error) {
+	var msg ExportedMessage
+	var createdAt int64
+	var playedAt sql.NullInt64
+	err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Channel, &msg.Name, &msg.Amount, &msg.Message, &msg.Description,
+		&msg.Anonymous, &msg.Status, &createdAt, &playedAt)
+	if err != nil {
+		return msg, fmt.Errorf("failed to scan message: %w", err)
+	}
+	msg.CreatedAt = time.UnixMilli(createdAt)
+	if playedAt.Valid {
+		played := time.UnixMilli(playedAt.Int64)
+		msg.PlayedAt = &played
+	}
+	return msg, nil
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Close() {
+	if err := s.db.Close(); err != nil {
+		log.Printf("Error closing SQLite database: %v", err)
+		return
+	}
+	log.Println("SQLite database closed")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What a channel does when a donor is recognized
+const (
+	recognizeEvent    = "event"
+	recognizeAnnounce = "announce"
+)
+
+// Kinds of donor recognition
+const (
+	recognitionStreak    = "streak"
+	recognitionReturning = "returning"
+)
+
+// EventDonorRecognized celebrates a donor's streak or return
+const EventDonorRecognized = "donor_recognized"
+
+const (
+	defaultStreakTemplate    = "{name} has donated {streak} streams in a row!"
+	defaultReturningTemplate = "Welcome back, {name}! It's been {days} days."
+)
+
+// defaultStreakMilestones are the streaks recognized when a channel names none
+var defaultStreakMilestones = []int{3, 5, 10}
+
+// minStreakStream is how long a stream must have run for a donor to keep
+// their streak by donating in it; shorter ones, such as test runs, neither
+// keep nor break streaks
+const minStreakStream = 10 * time.Minute
+
+// streakCatchUp is how far back the job looks for stopped streams when it
+// starts, for those that stopped while no primary was counting
+const streakCatchUp = 24 * time.Hour
+
+// maxStreakMilestones bounds the milestones a channel can name
+const maxStreakMilestones = 20
+
+// StreakConfig schedules the job that counts donors' streaks
+type StreakConfig struct {
+	// Interval is how often the running streams' donations are counted, and
+	// so how long after a donation its donor is recognized at most
+	Interval time.Duration
+}
+
+func (c StreakConfig) validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("STREAK_INTERVAL_SECONDS must be positive")
+	}
+	return nil
+}
+
+// StreakSettings recognize donors who donate stream after stream, and ones
+// who come back after a long while. With the event policy a donor_recognized
+// event goes out; announce also plays it as an alert.
+type StreakSettings struct {
+	Policy string `json:"policy,omitempty"`
+	// Milestones are the streaks recognized, in consecutive streams; by
+	// default 3, 5 and 10
+	Milestones []int `json:"milestones,omitempty"`
+	// ReturningAfterDays recognizes donors whose last donation was at least
+	// this many days before the stream; 0 doesn't
+	ReturningAfterDays int `json:"returning_after_days,omitempty"`
+	// Template may use {name}, {streak}, {best} and {streams}
+	Template string `json:"template,omitempty"`
+	// ReturningTemplate may use {name}, {days} and {streams}
+	ReturningTemplate string `json:"returning_template,omitempty"`
+	// Voice reads announced recognitions, instead of the server's default
+	Voice string `json:"voice,omitempty"`
+}
+
+func (s StreakSettings) enabled() bool {
+	return s.Policy == recognizeEvent || s.Policy == recognizeAnnounce
+}
+
+func (s StreakSettings) validate() error {
+	switch s.Policy {
+	case "", recognizeEvent, recognizeAnnounce:
+	default:
+		return fmt.Errorf("streaks policy must be %q or %q", recognizeEvent, recognizeAnnounce)
+	}
+	if len(s.Milestones) > maxStreakMilestones {
+		return fmt.Errorf("at most %d streak milestones are allowed", maxStreakMilestones)
+	}
+	for _, milestone := range s.Milestones {
+		if milestone < 2 {
+			return errors.New("streak milestones must be at least 2 streams")
+		}
+	}
+	if s.ReturningAfterDays < 0 {
+		return errors.New("streaks returning_after_days must not be negative")
+	}
+	return nil
+}
+
+func (s StreakSettings) milestones() []int {
+	if len(s.Milestones) == 0 {
+		return defaultStreakMilestones
+	}
+	return s.Milestones
+}
+
+// StreamRun is a stream as every instance tracks it together: running while
+// any of them has the channel's listeners
+type StreamRun struct {
+	Channel   string
+	StartedAt time.Time
+	// StoppedAt is nil while the stream runs
+	StoppedAt *time.Time
+}
+
+// DonorStreak is a donor's streak once a stream's donations are counted
+type DonorStreak struct {
+	Name       string
+	Streak     int
+	BestStreak int
+	Streams    int
+	// PreviousAt is the donor's last donation before the stream, if any
+	PreviousAt *time.Time
+}
+
+// DonorRecognition is the data of donor_recognized events, and marks the
+// alerts that announce them
+type DonorRecognition struct {
+	Kind    string `json:"kind"`
+	Channel string `json:"channel"`
+	Name    string `json:"name"`
+	// Streak is the consecutive streams the donor has donated in, counting
+	// this one, and BestStreak their longest
+	Streak     int `json:"streak"`
+	BestStreak int `json:"best_streak"`
+	// Streams is every stream the donor has donated in
+	Streams int `json:"streams"`
+	// DaysAway is set for returning donors
+	DaysAway int `json:"days_away,omitempty"`
+	// Text is the channel's template filled in
+	Text string `json:"text"`
+}
+
+// startStreaks counts the donations of running streams every interval and
+// recognizes the donors who reached a milestone or came back. Streams count
+// once they have run minStreakStream, and those that stopped since the last
+// count are counted once more, for the donations made at their very end.
+// Streams are tracked in the database by every instance, so listeners on
+// any of them count; only the primary runs the job. Recognitions go out on
+// hub.
+func startStreaks(config StreakConfig, hub *Hub) {
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		since := clock.Now().Add(-streakCatchUp)
+		for range ticker.C {
+			if hub.standby.active() {
+				continue
+			}
+			// Counting a stream again changes nothing, so the window
+			// overlaps the last one in case the clocks disagree
+			next := clock.Now().Add(-config.Interval)
+			streams, err := hub.db.countedStreams(since, hub.streamStaleAfter())
+			if errors.Is(err, errPostgresRequired) {
+				log.Printf("Donor streaks need Postgres, not counting them")
+				return
+			}
+			if err != nil {
+				log.Printf("Error listing streams for donor streaks: %v", err)
+				continue
+			}
+			since = next
+
+			for _, stream := range streams {
+				if settings := hub.channelSettings(stream.Channel).Streaks; settings.enabled() {
+					countStreaks(hub, stream, settings)
+				}
+			}
+		}
+	}()
+}
+
+// countStreaks counts a stream's donations in their donors' streaks and
+// recognizes the donors the channel's settings call for
+func countStreaks(hub *Hub, stream StreamRun, settings StreakSettings) {
+	streaks, err := hub.db.updateDonorStreaks(stream)
+	if err != nil {
+		log.Printf("Error counting donor streaks on channel %s: %v", stream.Channel, err)
+		return
+	}
+	for _, streak := range streaks {
+		recognizeDonor(hub, stream.Channel, settings, streak, stream.StartedAt)
+	}
+}
+
+// streakRecognition is how a channel recognizes a donor's streak, if it does
+func streakRecognition(channel string, settings StreakSettings, streak DonorStreak, startedAt time.Time) (DonorRecognition, bool) {
+	recognition := DonorRecognition{
+		Channel:    channel,
+		Name:       streak.Name,
+		Streak:     streak.Streak,
+		BestStreak: streak.BestStreak,
+		Streams:    streak.Streams,
+	}
+	var template string
+	switch {
+	case slices.Contains(settings.milestones(), streak.Streak):
+		recognition.Kind = recognitionStreak
+		template = firstNonEmpty(settings.Template, defaultStreakTemplate)
+	case settings.ReturningAfterDays > 0 && streak.PreviousAt != nil &&
+		startedAt.Sub(*streak.PreviousAt) >= time.Duration(settings.ReturningAfterDays)*24*time.Hour:
+		recognition.Kind = recognitionReturning
+		recognition.DaysAway = int(startedAt.Sub(*streak.PreviousAt).Hours() / 24)
+		template = firstNonEmpty(settings.ReturningTemplate, defaultReturningTemplate)
+	default:
+		return recognition, false
+	}
+	recognition.Text = strings.NewReplacer(
+		"{name}", recognition.Name,
+		"{streak}", strconv.Itoa(recognition.Streak),
+		"{best}", strconv.Itoa(recognition.BestStreak),
+		"{streams}", strconv.Itoa(recognition.Streams),
+		"{days}", strconv.Itoa(recognition.DaysAway),
+	).Replace(template)
+	return recognition, true
+}
+
+// recognizeDonor tells the channel's overlays about a donor's streak or
+// return, as its streak settings say to
+func recognizeDonor(hub *Hub, channel string, settings StreakSettings, streak DonorStreak, startedAt time.Time) {
+	recognition, ok := streakRecognition(channel, settings, streak, startedAt)
+	if !ok {
+		return
+	}
+	log.Printf("Recognizing %s donor on channel %s", recognition.Kind, channel)
+	hub.publishEvent(channel, EventDonorRecognized, recognition)
+	if settings.Policy != recognizeAnnounce {
+		return
+	}
+
+	msg := Message{
+		SessionID:   "recognition-" + newDeliveryID()[:8],
+		Channel:     channel,
+		Name:        recognition.Name,
+		Message:     recognition.Text,
+		Voice:       settings.Voice,
+		Recognition: &recognition,
+	}
+	if hub.isQuiet(msg.Channel) {
+		msg.Quiet = true
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		synthesizeMessage(ctx, hub, &msg)
+		cancel()
+	}
+	hub.dispatch(msg)
+}
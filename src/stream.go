@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/rheddev/tts-server/src/tts"
+)
+
+// AudioChunkFrame carries a piece of a message's audio to streaming listeners
+// while it is being synthesized, ahead of the message itself. Chunks of a
+// message share its ID and are numbered from 0; the last frame has final set
+// and no data, and failed set if synthesis broke off.
+type AudioChunkFrame struct {
+	Type   string `json:"type"`
+	ID     int64  `json:"id"`
+	Seq    int    `json:"seq"`
+	Data   string `json:"data,omitempty"`
+	Final  bool   `json:"final,omitempty"`
+	Failed bool   `json:"failed,omitempty"`
+}
+
+// audioStream sends one message's audio to the streaming listeners of its channel
+type audioStream struct {
+	hub     *Hub
+	channel string
+	id      int64
+	seq     int
+}
+
+// openAudioStream starts streaming msg's audio, or returns nil when nobody on
+// its channel takes chunks. With Redis, listeners may be on any instance, so
+// the audio is always streamed.
+func (hub *Hub) openAudioStream(msg *Message) *audioStream {
+	channel := msg.Channel
+	if channel == "" {
+		channel = defaultChannel
+	}
+	if msg.ID == 0 || (hub.bus == nil && !hub.hasStreamingListeners(channel)) {
+		return nil
+	}
+	return &audioStream{hub: hub, channel: channel, id: msg.ID}
+}
+
+// synthesizeStreamed renders req while streaming the audio. Engines that
+// stream hand out chunks as they render; for the others long text is split
+// into segments of segmentChars and synthesized one after the other, so the
+// first segment plays while the rest render.
+func synthesizeStreamed(ctx context.Context, synthesizer tts.Synthesizer, req tts.Request, stream *audioStream, segmentChars int) (*tts.Audio, error) {
+	if streamer, ok := synthesizer.(tts.StreamSynthesizer); ok {
+		return streamer.SynthesizeStream(ctx, req, stream.chunk)
+	}
+
+	audio := &tts.Audio{}
+	for _, segment := range tts.Segments(req.Text, segmentChars) {
+		segmentReq := req
+		segmentReq.Text = segment
+		part, err := synthesizer.Synthesize(ctx, segmentReq)
+		if err != nil {
+			return nil, err
+		}
+		stream.replay(part.Data)
+		audio.Data = append(audio.Data, part.Data...)
+		audio.ContentType = part.ContentType
+	}
+	return audio, nil
+}
+
+// chunk sends the next piece of audio
+func (s *audioStream) chunk(data []byte) error {
+	s.send(AudioChunkFrame{Data: base64.StdEncoding.EncodeToString(data)})
+	return nil
+}
+
+// replay streams audio that was rendered in one go, for providers that can't stream
+func (s *audioStream) replay(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), tts.StreamChunkSize)
+		s.chunk(data[:n])
+		data = data[n:]
+	}
+}
+
+// end closes the stream
+func (s *audioStream) end(failed bool) {
+	s.send(AudioChunkFrame{Final: true, Failed: failed})
+}
+
+func (s *audioStream) send(frame AudioChunkFrame) {
+	frame.Type = "audio_chunk"
+	frame.ID = s.id
+	frame.Seq = s.seq
+	s.seq++
+
+	s.hub.dispatchAudioChunk(s.channel, frame)
+}
+
+// dispatchAudioChunk hands an audio chunk to every instance's streaming
+// listeners, or just the local ones without Redis
+func (hub *Hub) dispatchAudioChunk(channel string, frame AudioChunkFrame) {
+	if hub.bus != nil {
+		err := hub.bus.publish(busEnvelope{AudioChunk: &frame, Channel: channel})
+		if err == nil {
+			return
+		}
+		log.Printf("Error publishing audio chunk to Redis, delivering locally: %v", err)
+	}
+	hub.streamAudio(channel, frame)
+}
+
+// hasStreamingListeners reports whether any listener on a channel takes audio chunks
+func (hub *Hub) hasStreamingListeners(channel string) bool {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for client := range hub.clients[channel] {
+		if client.streams {
+			return true
+		}
+	}
+	return false
+}
+
+// streamAudio queues an audio chunk frame for the streaming listeners of a channel
+func (hub *Hub) streamAudio(channel string, frame AudioChunkFrame) {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		log.Printf("Error marshaling audio chunk: %v", err)
+		return
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for client := range hub.clients[channel] {
+		if client.streams {
+			hub.deliver(client, payload)
+		}
+	}
+}
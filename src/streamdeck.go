@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Queue control events. Every instance's hub applies them before passing them
+// on, so overlays can also pause their own queue or show a quiet indicator.
+const (
+	EventQueueState = "queue_state"
+	EventQueueNext  = "queue_next"
+)
+
+// idempotencyTTL is how long a response is replayed for a repeated Idempotency-Key
+const idempotencyTTL = 10 * time.Minute
+
+// QueueState is what the Stream Deck controls on a channel. Paused channels
+// hold new alerts until resumed or stepped through with next; quiet ones are
+// shown without being read out.
+type QueueState struct {
+	Channel  string `json:"channel"`
+	Paused   bool   `json:"paused"`
+	Quiet    bool   `json:"quiet"`
+	IssuedBy string `json:"issued_by,omitempty"`
+}
+
+// QueueNext releases the next alert held on a channel
+type QueueNext struct {
+	Channel  string `json:"channel"`
+	IssuedBy string `json:"issued_by,omitempty"`
+}
+
+// DeckState is the answer to every Stream Deck request: enough for a plugin to
+// redraw its keys without a second call
+type DeckState struct {
+	Channel   string `json:"channel"`
+	Paused    bool   `json:"paused"`
+	Quiet     bool   `json:"quiet"`
+	Held      int    `json:"held"`
+	Listeners int    `json:"listeners"`
+	// Pending is set when the change was still being handed to the other
+	// instances when the latency budget ran out. It is applied regardless.
+	Pending bool `json:"pending,omitempty"`
+	// Released is the session ID next released, SessionID that of a test alert
+	Released  string `json:"released,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// applyQueueControl updates the hub from a queue control event. Resuming
+// releases everything held; next releases one alert even while paused.
+// Must be called with the mutex held.
+func (hub *Hub) applyQueueControl(event Event) {
+	switch event.Type {
+	case EventQueueState:
+		var state QueueState
+		if !decodeEventData(event, &state) {
+			return
+		}
+		wasPaused := hub.controls[state.Channel].Paused
+		if state.Paused || state.Quiet {
+			hub.controls[state.Channel] = state
+		} else {
+			delete(hub.controls, state.Channel)
+		}
+		// Paced channels pick up from the queue on their own
+		if wasPaused && !state.Paused && !hub.pacing.Enabled {
+			if released := hub.releasePending(state.Channel, -1); released > 0 {
+				log.Printf("Released %d held alerts on resumed channel %s", released, state.Channel)
+			}
+		}
+	case EventQueueNext:
+		var next QueueNext
+		if decodeEventData(event, &next) {
+			hub.releasePending(next.Channel, 1)
+		}
+	case EventQueueCleared:
+		var cleared QueueCleared
+		if decodeEventData(event, &cleared) {
+			if count := hub.clearPending(cleared.Channel); count > 0 {
+				log.Printf("Cleared %d held alerts on channel %s", count, cleared.Channel)
+			}
+		}
+	case EventSkip:
+		// A skipped alert is done, so the next one needn't wait for it
+		var skip struct {
+			Channel string `json:"channel"`
+		}
+		if decodeEventData(event, &skip) {
+			hub.finishPlaying(skip.Channel, 0)
+		}
+	}
+}
+
+// decodeEventData reads an event's data into target. Events from other
+// instances arrive decoded as plain JSON values rather than their own types.
+func decodeEventData(event Event, target interface{}) bool {
+	data, err := json.Marshal(event.Data)
+	if err == nil {
+		err = json.Unmarshal(data, target)
+	}
+	if err != nil {
+		log.Printf("Error decoding %s event: %v", event.Type, err)
+		return false
+	}
+	return true
+}
+
+// releasePending hands up to max (every one if max < 0) of a channel's held
+// alerts to all of its listeners, in release order, and returns how many it
+// released. Nothing is released while the channel has no listeners.
+// Must be called with the mutex held.
+func (hub *Hub) releasePending(channel string, max int) int {
+	if len(hub.clients[channel]) == 0 {
+		return 0
+	}
+
+	order := hub.releaseOrder(channel)
+	if max >= 0 && len(order) > max {
+		order = order[:max]
+	}
+	release := make(map[int]bool, len(order))
+	for _, i := range order {
+		release[i] = true
+	}
+
+	kept := hub.pending[:0]
+	released := 0
+	for i, alert := range hub.pending {
+		if !release[i] {
+			kept = append(kept, alert)
+			continue
+		}
+		msg, native := hub.withPlayAt(alert.message, alert.payload)
+		for client := range hub.clients[channel] {
+			payload, err := renderMessage(hub, client.format, msg, native)
+			if err != nil {
+				log.Printf("Error rendering %s message: %v", client.format, err)
+				continue
+			}
+			hub.deliver(client, payload)
+		}
+		hub.startPlaying(alert.message)
+		if !alert.message.Replay && !alert.message.Remote {
+			if !alert.message.Test {
+				hub.storeAsync(alert.message)
+			}
+			ducking.cue(hub, alert.message)
+		}
+		hub.announceDelivered(alert.message)
+		released++
+	}
+	hub.pending = kept
+	return released
+}
+
+// nextHeld is the session ID of the alert next would release, or "".
+// Must be called with the mutex held.
+func (hub *Hub) nextHeld(channel string) string {
+	if order := hub.releaseOrder(channel); len(order) > 0 {
+		return hub.pending[order[0]].message.SessionID
+	}
+	return ""
+}
+
+// isQuiet reports whether a channel's alerts are currently shown without speech
+func (hub *Hub) isQuiet(channel string) bool {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return hub.controls[channel].Quiet
+}
+
+// deckState reads a channel's controls and counts
+func (hub *Hub) deckState(channel string) DeckState {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	state := hub.controls[channel]
+	return DeckState{
+		Channel:   channel,
+		Paused:    state.Paused,
+		Quiet:     state.Quiet,
+		Held:      hub.pendingCount(channel),
+		Listeners: len(hub.clients[channel]),
+	}
+}
+
+// latencyBudget gives each request a deadline. Stream Deck actions answer by
+// then even if broadcasting the change takes longer.
+func latencyBudget(budget time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if budget <= 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), budget)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// withinBudget runs action, waiting for it only until the request's deadline,
+// and reports whether it finished. An action that overruns still completes.
+func withinBudget(c *gin.Context, action func()) bool {
+	done := make(chan struct{})
+	go func() {
+		action()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// idempotentResponse is a response kept for replay; done is closed once it is recorded
+type idempotentResponse struct {
+	done        chan struct{}
+	status      int
+	contentType string
+	body        []byte
+	recorded    time.Time
+}
+
+var idempotencyCache = struct {
+	mutex     sync.Mutex
+	responses map[string]*idempotentResponse
+}{responses: make(map[string]*idempotentResponse)}
+
+// responseRecorder copies what a handler writes so it can be replayed
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// idempotent is middleware that answers a repeated Idempotency-Key with the
+// first response instead of running the action again, so a plugin retrying a
+// press can't toggle twice. Keys are scoped to the user and endpoint; server
+// errors aren't kept, so those can be retried.
+func idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			return
+		}
+		key = c.GetString(gin.AuthUserKey) + " " + c.Request.Method + " " + c.Request.URL.RequestURI() + " " + key
+
+		cache := &idempotencyCache
+		cache.mutex.Lock()
+		for cached, response := range cache.responses {
+			if !response.recorded.IsZero() && clock.Now().Sub(response.recorded) > idempotencyTTL {
+				delete(cache.responses, cached)
+			}
+		}
+		response, seen := cache.responses[key]
+		if !seen {
+			response = &idempotentResponse{done: make(chan struct{})}
+			cache.responses[key] = response
+		}
+		cache.mutex.Unlock()
+
+		if seen {
+			select {
+			case <-response.done:
+			case <-c.Request.Context().Done():
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+				return
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(response.status, response.contentType, response.body)
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		cache.mutex.Lock()
+		response.status = recorder.Status()
+		response.contentType = recorder.Header().Get("Content-Type")
+		response.body = recorder.body.Bytes()
+		response.recorded = clock.Now()
+		if response.status >= http.StatusInternalServerError {
+			delete(cache.responses, key)
+		}
+		cache.mutex.Unlock()
+		close(response.done)
+	}
+}
+
+// deckChannel reads the channel a request is for, from ?channel= (default:
+// the custom domain's, or default)
+func deckChannel(c *gin.Context) (string, bool) {
+	channel := c.DefaultQuery("channel", requestChannel(c))
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return "", false
+	}
+	return channel, true
+}
+
+func (s *Server) deckStateHandler(c *gin.Context) {
+	channel, ok := deckChannel(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, s.hub.deckState(channel))
+}
+
+// setDeckState broadcasts a channel's new controls and answers with them
+func (s *Server) setDeckState(c *gin.Context, channel string, update func(*QueueState), action string) {
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	current := s.hub.deckState(channel)
+	state := QueueState{Channel: channel, Paused: current.Paused, Quiet: current.Quiet, IssuedBy: user}
+	update(&state)
+
+	applied := withinBudget(c, func() {
+		s.hub.publishEvent(channel, EventQueueState, state)
+		s.db.recordAudit(action, user, channel, state)
+	})
+	log.Printf("User %s set channel %s to paused=%t quiet=%t", user, channel, state.Paused, state.Quiet)
+
+	// The hub applies the event just after taking it, so the counts are what
+	// the change will leave rather than a read that could race it
+	if current.Paused && !state.Paused && current.Listeners > 0 {
+		current.Held = 0
+	}
+	current.Paused = state.Paused
+	current.Quiet = state.Quiet
+	current.Pending = !applied
+	c.JSON(http.StatusOK, current)
+}
+
+func (s *Server) deckPauseHandler(c *gin.Context) {
+	if channel, ok := deckChannel(c); ok {
+		s.setDeckState(c, channel, func(s *QueueState) { s.Paused = true }, "queue.paused")
+	}
+}
+
+func (s *Server) deckResumeHandler(c *gin.Context) {
+	if channel, ok := deckChannel(c); ok {
+		s.setDeckState(c, channel, func(s *QueueState) { s.Paused = false }, "queue.resumed")
+	}
+}
+
+// deckQuietHoursHandler sets quiet hours with ?enabled=true|false, or toggles
+// them without it. Toggles should carry an Idempotency-Key.
+func (s *Server) deckQuietHoursHandler(c *gin.Context) {
+	channel, ok := deckChannel(c)
+	if !ok {
+		return
+	}
+	update := func(s *QueueState) { s.Quiet = !s.Quiet }
+	if raw, set := c.GetQuery("enabled"); set {
+		enabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'enabled' parameter"})
+			return
+		}
+		update = func(s *QueueState) { s.Quiet = enabled }
+	}
+	s.setDeckState(c, channel, update, "queue.quiet_hours")
+}
+
+// deckNextHandler plays the next held alert, e.g. to step through a paused queue
+func (s *Server) deckNextHandler(c *gin.Context) {
+	channel, ok := deckChannel(c)
+	if !ok {
+		return
+	}
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	state := s.hub.deckState(channel)
+	s.hub.mutex.Lock()
+	released := ""
+	if state.Listeners > 0 {
+		released = s.hub.nextHeld(channel)
+	}
+	s.hub.mutex.Unlock()
+
+	next := QueueNext{Channel: channel, IssuedBy: user}
+	applied := true
+	if released != "" {
+		applied = withinBudget(c, func() {
+			s.hub.publishEvent(channel, EventQueueNext, next)
+			s.db.recordAudit("queue.next", user, released, next)
+		})
+	}
+
+	if released != "" {
+		state.Held--
+	}
+	state.Pending = !applied
+	state.Released = released
+	c.JSON(http.StatusOK, state)
+}
+
+// deckSkipHandler cuts the alert that is playing short
+func (s *Server) deckSkipHandler(c *gin.Context) {
+	channel, ok := deckChannel(c)
+	if !ok {
+		return
+	}
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	applied := withinBudget(c, func() {
+		if _, err := skipCommand(s.hub, user, moderatorParams{Channel: channel}); err != nil {
+			log.Printf("Error skipping alert on channel %s: %v", channel, err)
+		}
+	})
+
+	state := s.hub.deckState(channel)
+	state.Pending = !applied
+	c.JSON(http.StatusOK, state)
+}
+
+// deckTestAlertHandler sends a test alert through the whole playback path.
+// Synthesis can take longer than the budget, so the answer comes at once.
+func (s *Server) deckTestAlertHandler(c *gin.Context) {
+	channel, ok := deckChannel(c)
+	if !ok {
+		return
+	}
+	user := c.MustGet(gin.AuthUserKey).(string)
+
+	msg := Message{
+		SessionID: "test_" + newStatusToken()[:16],
+		Channel:   channel,
+		Name:      "Stream Deck",
+		Amount:    5,
+		Message:   "This is a test alert.",
+		Test:      true,
+	}
+	s.hub.playTestAlert(msg, func() {
+		s.db.recordAudit("alert.test", user, msg.SessionID, gin.H{"channel": channel})
+	})
+
+	state := s.hub.deckState(channel)
+	state.SessionID = msg.SessionID
+	c.JSON(http.StatusAccepted, state)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// summaryNames is how many donors a summary names before counting the rest
+const summaryNames = 3
+
+// HeldSummary lists the alerts an offline summary stands in for
+type HeldSummary struct {
+	Count int     `json:"count"`
+	Total float32 `json:"total"`
+	// Currency is set when every alert was in the same one
+	Currency   string   `json:"currency,omitempty"`
+	Names      []string `json:"names"`
+	SessionIDs []string `json:"session_ids"`
+}
+
+// summarizeHeld folds alerts held while a channel had no listener into one
+// summary alert. It carries the ID of the newest alert, so a listener that
+// resumes after it doesn't get them again one by one.
+func summarizeHeld(hub *Hub, alerts []pendingAlert) Message {
+	summary := &HeldSummary{Count: len(alerts), Currency: messageCurrency(hub, alerts[0].message)}
+	msg := Message{Channel: alerts[0].message.Channel, Summary: summary, Test: true}
+	seen := make(map[string]bool)
+	for _, alert := range alerts {
+		held := alert.message
+		summary.Total += held.Amount
+		summary.SessionIDs = append(summary.SessionIDs, held.SessionID)
+		if messageCurrency(hub, held) != summary.Currency {
+			summary.Currency = ""
+		}
+		if held.Name != "" && !seen[held.Name] {
+			seen[held.Name] = true
+			summary.Names = append(summary.Names, held.Name)
+		}
+		if held.ID > msg.ID {
+			msg.ID = held.ID
+		}
+		// Only a summary of nothing but test alerts is a test alert
+		msg.Test = msg.Test && held.Test
+	}
+
+	msg.SessionID = "summary_" + alerts[len(alerts)-1].message.SessionID
+	msg.Amount = summary.Total
+	msg.Currency = summary.Currency
+	msg.Description = fmt.Sprintf("%d alerts while you were away", summary.Count)
+	total := fmt.Sprintf("%.2f", summary.Total)
+	if summary.Currency != "" {
+		total += " " + summary.Currency
+	}
+	msg.Message = fmt.Sprintf("Thanks to %s for %s in total", summaryDonors(summary.Names), total)
+	return msg
+}
+
+// summaryDonors names the first few donors and counts the rest
+func summaryDonors(names []string) string {
+	switch {
+	case len(names) == 0:
+		return "everyone"
+	case len(names) == 1:
+		return names[0]
+	case len(names) <= summaryNames:
+		return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	case len(names) == summaryNames+1:
+		return strings.Join(names[:summaryNames], ", ") + " and 1 other"
+	}
+	return fmt.Sprintf("%s and %d others", strings.Join(names[:summaryNames], ", "), len(names)-summaryNames)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// TallyOption is a choice donations can be attributed to, in a bid war or a poll
+type TallyOption struct {
+	Key      string   `json:"key"`
+	Label    string   `json:"label"`
+	Keywords []string `json:"keywords"`
+}
+
+// Tally is the running total for a single option
+type Tally struct {
+	Key   string  `json:"key"`
+	Label string  `json:"label"`
+	Total float32 `json:"total"`
+	Bids  int     `json:"bids"`
+}
+
+// validateOptions requires at least two options with unique, non-empty keys
+func validateOptions(options []TallyOption) error {
+	if len(options) < 2 {
+		return errors.New("at least two options are required")
+	}
+
+	seen := make(map[string]bool)
+	for _, option := range options {
+		key := strings.ToLower(option.Key)
+		if key == "" || seen[key] {
+			return errors.New("option keys must be unique and non-empty")
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// matchOption picks the option a donation is attributed to: the explicit option key
+// if given, otherwise the first option whose keyword appears in the message
+func matchOption(options []TallyOption, explicit string, message string) (TallyOption, bool) {
+	if explicit != "" {
+		for _, option := range options {
+			if strings.EqualFold(option.Key, explicit) {
+				return option, true
+			}
+		}
+		return TallyOption{}, false
+	}
+
+	text := strings.ToLower(message)
+	for _, option := range options {
+		for _, keyword := range append([]string{option.Key}, option.Keywords...) {
+			if keyword == "" {
+				continue
+			}
+			pattern := `\b` + regexp.QuoteMeta(strings.ToLower(keyword)) + `\b`
+			if matched, _ := regexp.MatchString(pattern, text); matched {
+				return option, true
+			}
+		}
+	}
+
+	return TallyOption{}, false
+}
+
+// buildTallies orders tallies by option, filling in options nobody has bid on
+func buildTallies(options []TallyOption, sums map[string]Tally) []Tally {
+	tallies := make([]Tally, 0, len(options))
+	for _, option := range options {
+		tally := sums[option.Key]
+		tally.Key = option.Key
+		tally.Label = option.Label
+		tallies = append(tallies, tally)
+	}
+	return tallies
+}
+
+// leader returns the tally with the highest total, preferring earlier options on ties
+func leader(tallies []Tally) (Tally, bool) {
+	var best Tally
+	found := false
+	for _, tally := range tallies {
+		if tally.Bids == 0 {
+			continue
+		}
+		if !found || tally.Total > best.Total {
+			best = tally
+			found = true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SimulationConfig plays a made-up test alert every Interval on Channel, for
+// building overlays without real donations. 0 turns it off.
+type SimulationConfig struct {
+	Interval time.Duration
+	Channel  string
+}
+
+// TestAlertRequest is the optional body of POST /admin/test-alert. Fields
+// left out are filled in at random.
+type TestAlertRequest struct {
+	Channel     string   `json:"channel"`
+	Name        string   `json:"name"`
+	Amount      *float32 `json:"amount"`
+	Message     string   `json:"message"`
+	Description string   `json:"description"`
+	Anonymous   bool     `json:"anonymous"`
+	Voice       string   `json:"voice"`
+	Language    string   `json:"language"`
+	Speed       float64  `json:"speed"`
+}
+
+var (
+	testAlertNames    = []string{"Alice", "Bob", "Charlie", "Dana", "Eve", "Frankie", "Grace", "Hiro"}
+	testAlertAmounts  = []float32{1, 2.5, 5, 10, 20, 50, 100}
+	testAlertMessages = []string{
+		"This is a test alert.",
+		"Hello from the test alert generator!",
+		"Testing, testing, one two three.",
+		"Keep up the great stream!",
+		"A slightly longer test message to see how the overlay wraps text that runs across more than one line.",
+	}
+)
+
+// randomTestAlert makes up a test alert for a channel
+func randomTestAlert(channel string) Message {
+	return Message{
+		SessionID: "test_" + newStatusToken()[:16],
+		Channel:   channel,
+		Name:      testAlertNames[rand.Intn(len(testAlertNames))],
+		Amount:    testAlertAmounts[rand.Intn(len(testAlertAmounts))],
+		Message:   testAlertMessages[rand.Intn(len(testAlertMessages))],
+		Test:      true,
+	}
+}
+
+// playTestAlert sends a test alert through the whole playback path: it is
+// synthesized and queued like a donation, but never stored or counted as one.
+// Synthesis can take a while, so it happens in the background.
+func (hub *Hub) playTestAlert(msg Message, done func()) {
+	go func() {
+		if hub.isQuiet(msg.Channel) {
+			msg.Quiet = true
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			synthesizeMessage(ctx, hub, &msg)
+			cancel()
+		}
+		hub.dispatch(msg)
+		if done != nil {
+			done()
+		}
+	}()
+}
+
+// testAlertHandler plays a test alert, made up except for the fields given
+func (s *Server) testAlertHandler(c *gin.Context) {
+	var req TestAlertRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Channel == "" {
+		req.Channel = requestChannel(c)
+	}
+	if !validChannelName(req.Channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+
+	msg := randomTestAlert(req.Channel)
+	msg.Name = firstNonEmpty(req.Name, msg.Name)
+	msg.Message = firstNonEmpty(req.Message, msg.Message)
+	msg.Description = req.Description
+	msg.Anonymous = req.Anonymous
+	msg.Voice, msg.Language, msg.Speed = req.Voice, req.Language, req.Speed
+	if req.Amount != nil {
+		msg.Amount = *req.Amount
+	}
+	if reason := checkSendLimits(s.hub, msg); reason != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": reason})
+		return
+	}
+	if reason := voices.check(msg); reason != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": reason})
+		return
+	}
+	anonymize(s.hub, &msg)
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	s.hub.playTestAlert(msg, func() {
+		s.db.recordAudit("alert.test", user, msg.SessionID, gin.H{"channel": msg.Channel})
+	})
+	c.JSON(http.StatusAccepted, gin.H{"status": "Test alert sent", "message": msg})
+}
+
+// startSimulation plays a random test alert on hub every interval
+func startSimulation(config SimulationConfig, hub *Hub) {
+	if config.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !hub.standby.active() {
+				hub.playTestAlert(randomTestAlert(config.Channel), nil)
+			}
+		}
+	}()
+	log.Printf("Simulation playing a test alert on channel %s every %s", config.Channel, config.Interval)
+}
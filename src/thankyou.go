@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thank-you actions a channel can take once a donation has played
+const (
+	thankYouEmail   = "email"
+	thankYouWebhook = "webhook"
+)
+
+const (
+	defaultThankYouSubject  = "Thank you for your donation!"
+	defaultThankYouTemplate = "Thank you for your donation of {amount} {currency}, {name}! It was read out on stream at {played_at}."
+)
+
+// SMTPConfig is the mail server thank-you emails are sent through. STARTTLS
+// is used whenever the server offers it.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// ThankYouSettings thanks donors once their alert has played, by email to the
+// address the payment provider gave or with a POST to WebhookURL, e.g. a
+// bridge to the provider's messaging API. Action is empty to send nothing.
+type ThankYouSettings struct {
+	Action    string  `json:"action,omitempty"`
+	MinAmount float32 `json:"min_amount,omitempty"`
+	Subject   string  `json:"subject,omitempty"`
+	// Template may use {name}, {amount}, {currency}, {channel}, {message},
+	// {receipt} and {played_at}
+	Template   string `json:"template,omitempty"`
+	WebhookURL string `json:"webhook_url,omitempty"`
+	// WebhookSecret signs webhook bodies in X-TTS-Signature, like outbound webhooks
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+}
+
+func (t ThankYouSettings) validate(smtp SMTPConfig) error {
+	switch t.Action {
+	case "":
+		return nil
+	case thankYouEmail:
+		if smtp.Host == "" || smtp.From == "" {
+			return fmt.Errorf("thank_you email action requires SMTP_HOST and SMTP_FROM")
+		}
+		return nil
+	case thankYouWebhook:
+		if t.WebhookURL == "" {
+			return fmt.Errorf("thank_you webhook action requires a webhook_url")
+		}
+		return validateWebhookURL(t.WebhookURL)
+	}
+	return fmt.Errorf("thank_you action must be %q or %q", thankYouEmail, thankYouWebhook)
+}
+
+// ThankYou is the JSON body POSTed to thank-you webhooks
+type ThankYou struct {
+	SessionID string  `json:"session_id"`
+	Provider  string  `json:"provider,omitempty"`
+	Channel   string  `json:"channel"`
+	Name      string  `json:"name"`
+	Email     string  `json:"email,omitempty"`
+	Amount    float32 `json:"amount"`
+	Currency  string  `json:"currency,omitempty"`
+	Receipt   string  `json:"receipt,omitempty"`
+	// Text is the channel's template filled in
+	Text     string    `json:"text"`
+	PlayedAt time.Time `json:"played_at"`
+}
+
+var thankYouClient = &http.Client{Timeout: 10 * time.Second}
+
+// thankYouReplacer fills in the placeholders of thank-you templates and
+// subjects for a donation that played at playedAt
+func thankYouReplacer(msg Message, playedAt time.Time) *strings.Replacer {
+	return strings.NewReplacer(
+		"{name}", msg.Name,
+		"{amount}", fmt.Sprintf("%.2f", msg.Amount),
+		"{currency}", msg.Currency,
+		"{channel}", msg.Channel,
+		"{receipt}", msg.Receipt,
+		"{message}", msg.Message,
+		"{played_at}", playedAt.UTC().Format("2006-01-02 15:04 UTC"),
+	)
+}
+
+// thankDonor sends the channel's thank-you for a donation that started
+// playing at playedAt. Failures are only logged.
+func thankDonor(hub *Hub, msg Message, playedAt time.Time) {
+	if msg.Test || msg.Probe || msg.announcement() || msg.Summary != nil {
+		return
+	}
+	settings := hub.channelSettings(msg.Channel).ThankYou
+	if settings.Action == "" || msg.Amount < settings.MinAmount {
+		return
+	}
+
+	playedAt = playedAt.UTC()
+	thanks := ThankYou{
+		SessionID: msg.SessionID,
+		Provider:  msg.Provider,
+		Channel:   msg.Channel,
+		Name:      msg.Name,
+		Email:     msg.DonorEmail,
+		Amount:    msg.Amount,
+		Currency:  msg.Currency,
+		Receipt:   msg.Receipt,
+		PlayedAt:  playedAt,
+	}
+	replacer := thankYouReplacer(msg, playedAt)
+	thanks.Text = replacer.Replace(firstNonEmpty(settings.Template, defaultThankYouTemplate))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var err error
+	switch settings.Action {
+	case thankYouEmail:
+		if msg.DonorEmail == "" {
+			return
+		}
+		err = sendThankYouEmail(hub, ctx, msg.DonorEmail, replacer.Replace(firstNonEmpty(settings.Subject, defaultThankYouSubject)), thanks.Text)
+	case thankYouWebhook:
+		err = postThankYou(ctx, settings, thanks)
+	}
+	if err != nil {
+		log.Printf("Error sending %s thank-you for session %s: %v", settings.Action, msg.SessionID, err)
+		return
+	}
+	log.Printf("Sent %s thank-you for session %s", settings.Action, msg.SessionID)
+}
+
+// sendThankYouEmail sends a plain text email. Donor names end up in the
+// subject, so line breaks are taken out of it.
+func sendThankYouEmail(hub *Hub, ctx context.Context, to string, subject string, text string) error {
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid donor email: %w", err)
+	}
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", hub.smtp.From)
+	fmt.Fprintf(&body, "To: %s\r\n", recipient.String())
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(text, "\n", "\r\n") + "\r\n")
+
+	sender, err := mail.ParseAddress(hub.smtp.From)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	var auth smtp.Auth
+	if hub.smtp.Username != "" {
+		auth = smtp.PlainAuth("", hub.smtp.Username, hub.smtp.Password, hub.smtp.Host)
+	}
+	address := net.JoinHostPort(hub.smtp.Host, strconv.Itoa(hub.smtp.Port))
+	// net/smtp takes no context, so the send is left to finish on its own
+	// when ctx ends first
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(address, auth, sender.Address, []string{recipient.Address}, body.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func postThankYou(ctx context.Context, settings ThankYouSettings, thanks ThankYou) error {
+	body, err := json.Marshal(thanks)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, settings.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if settings.WebhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(signatureHeader, "t="+timestamp+",v1="+timestampedSignature([]byte(settings.WebhookSecret), timestamp, body))
+	}
+
+	resp, err := thankYouClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
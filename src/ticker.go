@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// TickerEntry is the reduced view of a donation sent to ticker/marquee widgets.
+// It deliberately omits the message text.
+type TickerEntry struct {
+	Name      string    `json:"name"`
+	Amount    float32   `json:"amount"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// tickerFilter narrows which entries a ticker client receives
+type tickerFilter struct {
+	MinAmount float32
+}
+
+func (f tickerFilter) allows(entry TickerEntry) bool {
+	return entry.Amount >= f.MinAmount
+}
+
+// tickerFeed keeps its own short history, independent of message storage
+type tickerFeed struct {
+	mutex      sync.Mutex
+	entries    []TickerEntry
+	clients    map[*websocket.Conn]tickerFilter
+	retention  time.Duration
+	maxEntries int
+}
+
+var donationTicker = &tickerFeed{
+	clients:    make(map[*websocket.Conn]tickerFilter),
+	retention:  time.Hour,
+	maxEntries: 50,
+}
+
+func (t *tickerFeed) configure(retention time.Duration, maxEntries int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.retention = retention
+	t.maxEntries = maxEntries
+}
+
+// prune drops entries past retention or over the size limit. Must be called with the mutex held.
+func (t *tickerFeed) prune() {
+	cutoff := clock.Now().Add(-t.retention)
+	start := 0
+	for start < len(t.entries) && t.entries[start].Timestamp.Before(cutoff) {
+		start++
+	}
+	if len(t.entries)-start > t.maxEntries {
+		start = len(t.entries) - t.maxEntries
+	}
+	t.entries = t.entries[start:]
+}
+
+// recent returns retained entries matching the filter, oldest first
+func (t *tickerFeed) recent(filter tickerFilter) []TickerEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune()
+	entries := []TickerEntry{}
+	for _, entry := range t.entries {
+		if filter.allows(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// publish records a donation and pushes it to matching ticker clients
+func (t *tickerFeed) publish(msg Message) {
+	entry := TickerEntry{
+		Name:      msg.Name,
+		Amount:    msg.Amount,
+		Timestamp: clock.Now(),
+	}
+
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error marshaling ticker entry: %v", err)
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.entries = append(t.entries, entry)
+	t.prune()
+
+	for client, filter := range t.clients {
+		if !filter.allows(entry) {
+			continue
+		}
+		client.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := client.WriteMessage(websocket.TextMessage, payload); err != nil {
+			log.Printf("Error writing to ticker client: %v", err)
+			client.Close()
+			delete(t.clients, client)
+		}
+	}
+}
+
+func parseTickerFilter(c *gin.Context) (tickerFilter, bool) {
+	filter := tickerFilter{}
+	if raw := c.Query("min_amount"); raw != "" {
+		amount, err := strconv.ParseFloat(raw, 32)
+		if err != nil {
+			return filter, false
+		}
+		filter.MinAmount = float32(amount)
+	}
+	return filter, true
+}
+
+// tickerListenHandler streams ticker entries over a WebSocket, starting with recent history
+func (s *Server) tickerListenHandler(c *gin.Context) {
+	filter, ok := parseTickerFilter(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'min_amount' parameter"})
+		return
+	}
+
+	ws, err := s.upgradeWebSocket(c, &s.upgrader)
+	if err != nil {
+		log.Printf("Error upgrading ticker connection: %v", err)
+		return
+	}
+	defer ws.Close()
+	readLimited(ws, s.hub.wsLimits)
+
+	// Send history and register under the same lock so no entry is sent twice or missed
+	donationTicker.mutex.Lock()
+	donationTicker.prune()
+	for _, entry := range donationTicker.entries {
+		if !filter.allows(entry) {
+			continue
+		}
+		ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := ws.WriteJSON(entry); err != nil {
+			donationTicker.mutex.Unlock()
+			return
+		}
+	}
+	donationTicker.clients[ws] = filter
+	donationTicker.mutex.Unlock()
+
+	defer func() {
+		donationTicker.mutex.Lock()
+		delete(donationTicker.clients, ws)
+		donationTicker.mutex.Unlock()
+	}()
+
+	// Ticker clients are receive-only; reading just detects disconnects
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// tickerHandler returns recent ticker entries for widgets that poll instead of streaming
+func tickerHandler(c *gin.Context) {
+	filter, ok := parseTickerFilter(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'min_amount' parameter"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": donationTicker.recent(filter)})
+}
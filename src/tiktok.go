@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// tiktokStreakGift is the giftType of gifts sent as a combo, which are
+// reported on every repeat until the streak ends
+const tiktokStreakGift = 1
+
+// TikTokConfig selects the TikTok LIVE whose gifts become alerts. TikTok has
+// no public API for this, so events come from a relay speaking the community
+// TikTok-Live-Connector websocket protocol.
+type TikTokConfig struct {
+	// URL is the relay's websocket; Username is passed to it as uniqueId
+	URL      string
+	Username string
+	Channel  string
+	// CoinValue is what one coin is worth in COMPAT_CURRENCY
+	CoinValue float64
+	// GiftValues overrides the coin value of gifts, as name=coins or id=coins pairs
+	GiftValues []string
+}
+
+func (c TikTokConfig) enabled() bool {
+	return c.URL != "" && c.Username != ""
+}
+
+// tiktokFrame is one event from the relay
+type tiktokFrame struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type tiktokGift struct {
+	MsgID        string `json:"msgId"`
+	UniqueID     string `json:"uniqueId"`
+	Nickname     string `json:"nickname"`
+	GiftID       int    `json:"giftId"`
+	GiftName     string `json:"giftName"`
+	GiftType     int    `json:"giftType"`
+	DiamondCount int    `json:"diamondCount"`
+	RepeatCount  int    `json:"repeatCount"`
+	RepeatEnd    bool   `json:"repeatEnd"`
+}
+
+// tiktokReader follows a TikTok LIVE through the relay
+type tiktokReader struct {
+	config TikTokConfig
+	// values holds coins per gift, keyed by lower-case name or by ID
+	values map[string]int
+	hub    *Hub
+}
+
+// startTikTok reads gifts from the relay into hub until the process exits
+func startTikTok(config TikTokConfig, hub *Hub) error {
+	if !config.enabled() {
+		return nil
+	}
+	values, err := parseGiftValues(config.GiftValues)
+	if err != nil {
+		return err
+	}
+	if config.Channel == "" {
+		config.Channel = defaultChannel
+	}
+	if !validChannelName(config.Channel) {
+		return fmt.Errorf("invalid TIKTOK_CHANNEL %q", config.Channel)
+	}
+	if config.CoinValue < 0 {
+		return fmt.Errorf("invalid TIKTOK_COIN_VALUE %v", config.CoinValue)
+	}
+
+	reader := &tiktokReader{config: config, values: values, hub: hub}
+	go reader.run()
+	log.Printf("Reading TikTok LIVE gifts for %s into channel %s", config.Username, config.Channel)
+	return nil
+}
+
+// parseGiftValues reads gift=coins pairs, e.g. Rose=1 or 5655=1
+func parseGiftValues(pairs []string) (map[string]int, error) {
+	values := make(map[string]int)
+	for _, pair := range pairs {
+		gift, value, ok := strings.Cut(pair, "=")
+		coins, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || coins < 0 {
+			return nil, fmt.Errorf("invalid gift value %q, expected gift=coins", pair)
+		}
+		values[strings.ToLower(strings.TrimSpace(gift))] = coins
+	}
+	return values, nil
+}
+
+// run keeps a connection to the relay open, reconnecting with a backoff of
+// up to five minutes. The relay reconnects to TikTok itself when the LIVE
+// restarts.
+func (r *tiktokReader) run() {
+	backoff := time.Duration(0)
+	for {
+		connected, err := r.read()
+		if connected {
+			backoff = 0
+		}
+		backoff = min(max(2*backoff, 5*time.Second), 5*time.Minute)
+		log.Printf("TikTok relay connection lost, reconnecting in %s: %v", backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+// read handles the relay's events until the connection drops, reporting
+// whether it got as far as connecting
+func (r *tiktokReader) read() (bool, error) {
+	endpoint, err := url.Parse(r.config.URL)
+	if err != nil {
+		return false, fmt.Errorf("invalid TIKTOK_WS_URL: %w", err)
+	}
+	query := endpoint.Query()
+	query.Set("uniqueId", r.config.Username)
+	endpoint.RawQuery = query.Encode()
+
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, resp, err := dialer.Dial(endpoint.String(), nil)
+	if err != nil {
+		if resp != nil {
+			return false, fmt.Errorf("relay returned %s", resp.Status)
+		}
+		return false, err
+	}
+	defer conn.Close()
+	log.Printf("Connected to TikTok relay for %s", r.config.Username)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		var frame tiktokFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			log.Printf("Ignoring invalid TikTok relay frame: %v", err)
+			continue
+		}
+		if frame.Event != "gift" {
+			continue
+		}
+		var gift tiktokGift
+		if err := json.Unmarshal(frame.Data, &gift); err != nil {
+			log.Printf("Ignoring invalid TikTok gift: %v", err)
+			continue
+		}
+		if msg, ok := r.toMessage(gift); ok {
+			r.accept(msg)
+		}
+	}
+}
+
+// toMessage converts a gift into a message. Streaks are only counted once
+// they end, as one alert for the whole combo.
+func (r *tiktokReader) toMessage(gift tiktokGift) (Message, bool) {
+	if gift.GiftType == tiktokStreakGift && !gift.RepeatEnd {
+		return Message{}, false
+	}
+	if gift.MsgID == "" {
+		log.Printf("Ignoring TikTok gift from %s without a message ID", gift.UniqueID)
+		return Message{}, false
+	}
+
+	name := gift.Nickname
+	if name == "" {
+		name = gift.UniqueID
+	}
+	count := max(gift.RepeatCount, 1)
+	coins := count * r.coins(gift)
+
+	msg := Message{
+		SessionID: "tiktok_" + gift.MsgID,
+		Channel:   r.config.Channel,
+		Name:      name,
+		Amount:    float32(float64(coins) * r.config.CoinValue),
+	}
+	if count > 1 {
+		msg.Description = fmt.Sprintf("%s sent %d %s gifts (%d coins)", name, count, gift.GiftName, coins)
+	} else {
+		msg.Description = fmt.Sprintf("%s sent a %s (%d coins)", name, gift.GiftName, coins)
+	}
+	return msg, true
+}
+
+// coins is what one of the gifts is worth: its configured value, or else
+// the diamond count TikTok reports
+func (r *tiktokReader) coins(gift tiktokGift) int {
+	if value, ok := r.values[strings.ToLower(gift.GiftName)]; ok {
+		return value
+	}
+	if value, ok := r.values[strconv.Itoa(gift.GiftID)]; ok {
+		return value
+	}
+	return gift.DiamondCount
+}
+
+// accept sends a gift down the regular send pipeline. Message IDs are
+// stable, so gifts the relay sends again are refused as duplicates.
+// On an instance that stepped down the reader pauses here, holding the gift,
+// until the instance is primary again.
+func (r *tiktokReader) accept(msg Message) {
+	r.hub.standby.waitPrimary("TikTok gift " + msg.SessionID)
+	msg.Provider = "tiktok"
+	r.hub.metrics.inc(metricMessagesReceived, MetricLabels{Channel: msg.Channel, Kind: "donation"}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if result, err := r.hub.acceptMessage(ctx, msg, ""); err != nil {
+		if !result.Duplicate {
+			log.Printf("Ignoring TikTok gift %s: %s", msg.SessionID, err.message)
+		}
+		return
+	}
+	r.hub.db.recordAudit("payment.received", "tiktok", msg.SessionID, gin.H{"amount": msg.Amount, "channel": msg.Channel})
+}
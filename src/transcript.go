@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Formats a transcript can be downloaded in
+const (
+	transcriptJSONL = "jsonl"
+	transcriptSRT   = "srt"
+	transcriptVTT   = "vtt"
+)
+
+// transcriptSessionLayout names a transcript after when its stream started
+const transcriptSessionLayout = "20060102T150405Z"
+
+// TranscriptLine is one alert as it was read out. Times are when it was
+// expected to play, after the alerts ahead of it on the channel.
+type TranscriptLine struct {
+	SessionID string    `json:"session_id"`
+	Name      string    `json:"name"`
+	Text      string    `json:"text"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	// OffsetMS is how far into the stream the alert started
+	OffsetMS   int64 `json:"offset_ms"`
+	DurationMS int64 `json:"duration_ms"`
+	Test       bool  `json:"test,omitempty"`
+}
+
+// TranscriptSession is one stream's transcript on a channel
+type TranscriptSession struct {
+	Channel   string    `json:"channel"`
+	Session   string    `json:"session"`
+	StartedAt time.Time `json:"started_at"`
+	Lines     int       `json:"lines"`
+}
+
+// transcriptLog appends every alert read out to a JSON Lines file per
+// channel and stream in dir. It is off without TRANSCRIPT_DIR.
+type transcriptLog struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+// recordTranscript adds an alert that has started playing to its stream's
+// transcript. Alerts cued on an instance without the channel's listeners,
+// which have no stream here, go in a transcript for the day.
+func recordTranscript(hub *Hub, msg Message, start time.Time, duration time.Duration) {
+	transcripts := hub.transcripts
+	transcripts.mutex.Lock()
+	defer transcripts.mutex.Unlock()
+	if transcripts.dir == "" || msg.Quiet || msg.Probe {
+		return
+	}
+	text := spokenText(&msg)
+	if text == "" {
+		return
+	}
+
+	startedAt, ok := hub.streamStartedAt(msg.Channel)
+	if !ok {
+		startedAt = start.UTC().Truncate(24 * time.Hour)
+	}
+	line := TranscriptLine{
+		SessionID:  msg.SessionID,
+		Name:       msg.Name,
+		Text:       text,
+		Start:      start.UTC(),
+		End:        start.Add(duration).UTC(),
+		OffsetMS:   start.Sub(startedAt).Milliseconds(),
+		DurationMS: duration.Milliseconds(),
+		Test:       msg.Test,
+	}
+	entry, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(transcripts.dir, msg.Channel)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("Error creating transcript directory: %v", err)
+		return
+	}
+	path := filepath.Join(dir, startedAt.UTC().Format(transcriptSessionLayout)+".jsonl")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		log.Printf("Error opening transcript: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(entry, '\n')); err != nil {
+		log.Printf("Error writing transcript: %v", err)
+	}
+}
+
+// readTranscript returns the lines of a channel's transcript in dir for a session
+func readTranscript(dir string, channel string, session string) ([]TranscriptLine, error) {
+	file, err := os.Open(filepath.Join(dir, channel, session+".jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []TranscriptLine{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line TranscriptLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err == nil {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// captionTime formats an offset as an SRT or WebVTT timestamp
+func captionTime(offset time.Duration, separator string) string {
+	if offset < 0 {
+		offset = 0
+	}
+	ms := offset.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+// renderCaptions writes lines as SRT or WebVTT cues timed from the start of
+// the stream
+func renderCaptions(lines []TranscriptLine, format string) string {
+	var out strings.Builder
+	separator := ","
+	if format == transcriptVTT {
+		separator = "."
+		out.WriteString("WEBVTT\n\n")
+	}
+	for i, line := range lines {
+		start := time.Duration(line.OffsetMS) * time.Millisecond
+		end := start + time.Duration(line.DurationMS)*time.Millisecond
+		if format == transcriptSRT {
+			fmt.Fprintf(&out, "%d\n", i+1)
+		}
+		fmt.Fprintf(&out, "%s --> %s\n", captionTime(start, separator), captionTime(end, separator))
+		text := line.Text
+		if line.Name != "" {
+			text = line.Name + ": " + text
+		}
+		// A blank line ends a cue, so the text can't contain one
+		out.WriteString(strings.Join(strings.Fields(text), " ") + "\n\n")
+	}
+	return out.String()
+}
+
+// listTranscriptsHandler lists the transcripts kept for a channel, newest first
+func (s *Server) listTranscriptsHandler(c *gin.Context) {
+	dir := s.hub.transcripts.dir
+	if dir == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Transcripts are not configured"})
+		return
+	}
+	channel := c.Param("channel")
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, channel))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error listing transcripts: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list transcripts"})
+		return
+	}
+	sessions := []TranscriptSession{}
+	for _, entry := range entries {
+		session := strings.TrimSuffix(entry.Name(), ".jsonl")
+		startedAt, err := time.Parse(transcriptSessionLayout, session)
+		if err != nil {
+			continue
+		}
+		lines, err := readTranscript(dir, channel, session)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, TranscriptSession{Channel: channel, Session: session, StartedAt: startedAt, Lines: len(lines)})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.After(sessions[j].StartedAt) })
+	c.JSON(http.StatusOK, gin.H{"transcripts": sessions})
+}
+
+// transcriptHandler downloads a stream's transcript as JSON Lines, SRT or
+// WebVTT, for captioning the VOD
+func (s *Server) transcriptHandler(c *gin.Context) {
+	dir := s.hub.transcripts.dir
+	if dir == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Transcripts are not configured"})
+		return
+	}
+	channel, session := c.Param("channel"), c.Param("session")
+	if _, err := time.Parse(transcriptSessionLayout, session); err != nil || !validChannelName(channel) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transcript not found"})
+		return
+	}
+	format := c.DefaultQuery("format", transcriptJSONL)
+	if format != transcriptJSONL && format != transcriptSRT && format != transcriptVTT {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'format' parameter, use 'jsonl', 'srt' or 'vtt'"})
+		return
+	}
+
+	path := filepath.Join(dir, channel, session+".jsonl")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transcript not found"})
+		return
+	}
+	if format == transcriptJSONL {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.jsonl"`, channel, session))
+		c.File(path)
+		return
+	}
+	lines, err := readTranscript(dir, channel, session)
+	if err != nil {
+		log.Printf("Error reading transcript: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read transcript"})
+		return
+	}
+	contentType := "application/x-subrip"
+	if format == transcriptVTT {
+		contentType = "text/vtt"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, channel, session, format))
+	c.Data(http.StatusOK, contentType+"; charset=utf-8", []byte(renderCaptions(lines, format)))
+}
@@ -0,0 +1,81 @@
+package tts
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const googleSynthesizeURL = "https://texttospeech.googleapis.com/v1/text:synthesize"
+
+// googleSynthesizer uses the Google Cloud Text-to-Speech REST API with an API key
+type googleSynthesizer struct {
+	config Config
+}
+
+func (g *googleSynthesizer) Name() string {
+	return ProviderGoogle
+}
+
+func (g *googleSynthesizer) Synthesize(ctx context.Context, req Request) (*Audio, error) {
+	voice := map[string]string{"languageCode": firstNonEmpty(req.Language, g.config.Language)}
+	if name := firstNonEmpty(req.Voice, g.config.Voice); name != "" {
+		voice["name"] = name
+	}
+	audioConfig := map[string]interface{}{"audioEncoding": "MP3"}
+	if req.Rate > 0 {
+		audioConfig["speakingRate"] = req.Rate
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"input":       map[string]string{"text": req.Text},
+		"voice":       voice,
+		"audioConfig": audioConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := googleSynthesizeURL + "?key=" + url.QueryEscape(g.config.GoogleAPIKey)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.config.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("google TTS request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, providerError("google TTS", resp)
+	}
+
+	var result struct {
+		AudioContent string `json:"audioContent"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode google TTS response: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(result.AudioContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode google TTS audio: %w", err)
+	}
+	return &Audio{Data: data, ContentType: "audio/mpeg"}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
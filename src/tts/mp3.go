@@ -0,0 +1,265 @@
+package tts
+
+import (
+	"bytes"
+	"time"
+)
+
+// trimPadding is how many silent frames are kept either side of the speech.
+// Leading ones also hold bit reservoir data the first spoken frame refers to.
+const trimPadding = 2
+
+// silentBits is the most Huffman data a frame may carry and still count as
+// silence: no big values, just a few ±1 coefficients at most
+const silentBits = 64
+
+var (
+	mpeg1Bitrates = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mpeg2Bitrates = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	sampleRates   = map[byte][3]int{
+		3: {44100, 48000, 32000}, // MPEG 1
+		2: {22050, 24000, 16000}, // MPEG 2
+		0: {11025, 12000, 8000},  // MPEG 2.5
+	}
+)
+
+// mp3Frame is one parsed MPEG audio Layer III frame
+type mp3Frame struct {
+	data     []byte
+	silent   bool
+	duration time.Duration
+	// info marks a Xing/Info/VBRI header frame, whose frame count trimming invalidates
+	info bool
+}
+
+// parseMP3Frame reads the frame at the start of data. It returns the frame
+// length, 0 if more data is needed, or -1 if data doesn't start with a frame.
+func parseMP3Frame(data []byte) (mp3Frame, int) {
+	if len(data) < 4 {
+		return mp3Frame{}, 0
+	}
+	if data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, -1
+	}
+
+	version := (data[1] >> 3) & 3
+	layer := (data[1] >> 1) & 3
+	rates, ok := sampleRates[version]
+	bitrateIndex := data[2] >> 4
+	rateIndex := (data[2] >> 2) & 3
+	if !ok || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, -1
+	}
+
+	mpeg1 := version == 3
+	padding := int(data[2]>>1) & 1
+	var length int
+	if mpeg1 {
+		length = 144*mpeg1Bitrates[bitrateIndex]*1000/rates[rateIndex] + padding
+	} else {
+		length = 72*mpeg2Bitrates[bitrateIndex]*1000/rates[rateIndex] + padding
+	}
+	if len(data) < length {
+		return mp3Frame{}, 0
+	}
+
+	channels := 2
+	if data[3]>>6 == 3 {
+		channels = 1
+	}
+	offset := 4
+	if data[1]&1 == 0 {
+		offset += 2 // CRC
+	}
+
+	// Side information: main_data_begin, private bits and (MPEG 1) scfsi,
+	// then per granule and channel the fields below
+	samples := 576
+	if mpeg1 {
+		samples = 1152
+	}
+	frame := mp3Frame{data: data[:length], silent: true, duration: time.Duration(samples) * time.Second / time.Duration(rates[rateIndex])}
+	side := &bitReader{data: data[offset:length]}
+	var granules, sideLength int
+	switch {
+	case mpeg1 && channels == 1:
+		granules, sideLength = 2, 17
+		side.skip(9 + 5 + 4)
+	case mpeg1:
+		granules, sideLength = 2, 32
+		side.skip(9 + 3 + 8)
+	case channels == 1:
+		granules, sideLength = 1, 9
+		side.skip(8 + 1)
+	default:
+		granules, sideLength = 1, 17
+		side.skip(8 + 2)
+	}
+	for gr := 0; gr < granules; gr++ {
+		for ch := 0; ch < channels; ch++ {
+			part23 := side.read(12)
+			bigValues := side.read(9)
+			if bigValues > 0 || part23 > silentBits {
+				frame.silent = false
+			}
+			if mpeg1 {
+				side.skip(8 + 4 + 1 + 22 + 3)
+			} else {
+				side.skip(8 + 9 + 1 + 22 + 2)
+			}
+		}
+	}
+
+	if tag := offset + sideLength; tag+4 <= length {
+		marker := data[tag : tag+4]
+		frame.info = bytes.Equal(marker, []byte("Xing")) || bytes.Equal(marker, []byte("Info"))
+	}
+	if offset+32+4 <= length && bytes.Equal(data[offset+32:offset+36], []byte("VBRI")) {
+		frame.info = true
+	}
+	return frame, length
+}
+
+// bitReader reads big-endian bit fields, returning zeros past the end
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) read(bits int) int {
+	value := 0
+	for i := 0; i < bits; i++ {
+		value <<= 1
+		if byteIndex := r.pos / 8; byteIndex < len(r.data) {
+			value |= int(r.data[byteIndex]>>(7-r.pos%8)) & 1
+		}
+		r.pos++
+	}
+	return value
+}
+
+func (r *bitReader) skip(bits int) {
+	r.pos += bits
+}
+
+// silenceTrimmer drops the silent frames at the start and end of an MP3 as it
+// is written, holding back runs of silence until it knows whether speech follows
+type silenceTrimmer struct {
+	buffer  []byte
+	checked bool
+	started bool
+	// held is the trailing run of silent frames, or the leading padding before speech
+	held [][]byte
+}
+
+// write takes the next piece of audio and returns what can be played so far
+func (t *silenceTrimmer) write(data []byte) []byte {
+	t.buffer = append(t.buffer, data...)
+	var out []byte
+
+	if !t.checked {
+		// An ID3v2 tag is passed through untouched
+		if len(t.buffer) < 10 {
+			return nil
+		}
+		t.checked = true
+		if size := id3Size(t.buffer); size > 0 {
+			size = min(size, len(t.buffer))
+			out = append(out, t.buffer[:size]...)
+			t.buffer = t.buffer[size:]
+		}
+	}
+
+	for {
+		frame, length := parseMP3Frame(t.buffer)
+		if length == 0 {
+			break
+		}
+		if length < 0 {
+			// Not a frame (e.g. an ID3v1 tag or garbage): skip to the next sync byte
+			next := bytes.IndexByte(t.buffer[1:], 0xFF)
+			if next < 0 {
+				t.buffer = t.buffer[:0]
+				break
+			}
+			t.buffer = t.buffer[next+1:]
+			continue
+		}
+		frameData := append([]byte(nil), frame.data...)
+		t.buffer = t.buffer[length:]
+
+		switch {
+		case frame.info:
+		case frame.silent && !t.started:
+			t.held = append(t.held, frameData)
+			if len(t.held) > trimPadding {
+				t.held = t.held[1:]
+			}
+		case frame.silent:
+			t.held = append(t.held, frameData)
+		default:
+			for _, held := range t.held {
+				out = append(out, held...)
+			}
+			t.held = t.held[:0]
+			out = append(out, frameData...)
+			t.started = true
+		}
+	}
+	return out
+}
+
+// finish returns the padding kept after the speech. Audio that is silent
+// throughout keeps its padding frames so it still plays.
+func (t *silenceTrimmer) finish() []byte {
+	var out []byte
+	for i, held := range t.held {
+		if i == trimPadding {
+			break
+		}
+		out = append(out, held...)
+	}
+	t.held = nil
+	return out
+}
+
+// TrimSilence drops the silence at the start and end of MP3 audio. Data that
+// isn't MP3 is returned unchanged.
+func TrimSilence(data []byte) []byte {
+	var t silenceTrimmer
+	trimmed := t.write(data)
+	trimmed = append(trimmed, t.finish()...)
+	if !t.started && len(trimmed) == 0 {
+		return data
+	}
+	return trimmed
+}
+
+// id3Size is the length of the ID3v2 tag data starts with, or 0 without one
+func id3Size(data []byte) int {
+	if len(data) < 10 || !bytes.HasPrefix(data, []byte("ID3")) {
+		return 0
+	}
+	return 10 + (int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9]))
+}
+
+// Duration is the playing time of MP3 audio, or 0 if data isn't MP3
+func Duration(data []byte) time.Duration {
+	data = data[min(id3Size(data), len(data)):]
+	var total time.Duration
+	for len(data) > 0 {
+		frame, length := parseMP3Frame(data)
+		if length == 0 {
+			break
+		}
+		if length < 0 {
+			data = data[1:]
+			continue
+		}
+		if !frame.info {
+			total += frame.duration
+		}
+		data = data[length:]
+	}
+	return total
+}
@@ -0,0 +1,156 @@
+package tts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// pollySynthesizer calls the AWS Polly SynthesizeSpeech REST API, signing
+// requests with Signature Version 4 so no AWS SDK is needed
+type pollySynthesizer struct {
+	config Config
+}
+
+func (p *pollySynthesizer) Name() string {
+	return ProviderPolly
+}
+
+func (p *pollySynthesizer) Synthesize(ctx context.Context, req Request) (*Audio, error) {
+	resp, err := p.request(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read polly audio: %w", err)
+	}
+	return &Audio{Data: data, ContentType: "audio/mpeg"}, nil
+}
+
+// SynthesizeStream hands out the MP3 as Polly streams it back, so playback can
+// start before the whole message is rendered
+func (p *pollySynthesizer) SynthesizeStream(ctx context.Context, req Request, chunk func([]byte) error) (*Audio, error) {
+	resp, err := p.request(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var data []byte
+	buf := make([]byte, StreamChunkSize)
+	for {
+		n, err := io.ReadFull(resp.Body, buf)
+		if n > 0 {
+			data = append(data, buf[:n]...)
+			if err := chunk(append([]byte(nil), buf[:n]...)); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read polly audio: %w", err)
+		}
+	}
+	return &Audio{Data: data, ContentType: "audio/mpeg"}, nil
+}
+
+// request starts a SynthesizeSpeech call, returning the response once it has succeeded
+func (p *pollySynthesizer) request(ctx context.Context, req Request) (*http.Response, error) {
+	payload := map[string]interface{}{
+		"Engine":       p.config.PollyEngine,
+		"OutputFormat": "mp3",
+		"Text":         req.Text,
+		"VoiceId":      firstNonEmpty(req.Voice, p.config.Voice),
+		"LanguageCode": firstNonEmpty(req.Language, p.config.Language),
+	}
+	// Polly only takes a rate through SSML
+	if req.Rate > 0 && req.Rate != 1 {
+		var text bytes.Buffer
+		xml.EscapeText(&text, []byte(req.Text))
+		payload["Text"] = fmt.Sprintf(`<speak><prosody rate="%d%%">%s</prosody></speak>`, int(math.Round(req.Rate*100)), text.String())
+		payload["TextType"] = "ssml"
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	host := "polly." + p.config.AWSRegion + ".amazonaws.com"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/v1/speech", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	p.sign(httpReq, body, time.Now().UTC())
+
+	resp, err := p.config.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("polly request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, providerError("polly", resp)
+	}
+	return resp, nil
+}
+
+// sign adds SigV4 headers for the polly service
+func (p *pollySynthesizer) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if p.config.AWSSessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.config.AWSSessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + p.config.AWSSessionToken + "\n"
+	}
+
+	canonicalRequest := req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n" +
+		canonicalHeaders + "\n" + signedHeaders + "\n" + payloadHash
+
+	scope := date + "/" + p.config.AWSRegion + "/polly/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+p.config.AWSSecretAccessKey), date)
+	key = hmacSHA256(key, p.config.AWSRegion)
+	key = hmacSHA256(key, "polly")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+p.config.AWSAccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,84 @@
+package tts
+
+import "context"
+
+// processed applies what every provider's output goes through: the speaking
+// rate default and cap, and silence trimming
+type processed struct {
+	Synthesizer
+	rate    float64
+	maxRate float64
+	trim    bool
+}
+
+// processedStream is processed for providers that can stream
+type processedStream struct {
+	*processed
+	streamer StreamSynthesizer
+}
+
+func postProcess(synthesizer Synthesizer, config Config) Synthesizer {
+	p := &processed{
+		Synthesizer: synthesizer,
+		rate:        config.Rate,
+		maxRate:     config.MaxRate,
+		trim:        config.TrimSilence,
+	}
+	if streamer, ok := synthesizer.(StreamSynthesizer); ok {
+		return &processedStream{processed: p, streamer: streamer}
+	}
+	return p
+}
+
+// request fills in the default rate and holds it to the cap
+func (p *processed) request(req Request) Request {
+	if req.Rate <= 0 {
+		req.Rate = p.rate
+	}
+	if p.maxRate > 0 && req.Rate > p.maxRate {
+		req.Rate = p.maxRate
+	}
+	return req
+}
+
+func (p *processed) Synthesize(ctx context.Context, req Request) (*Audio, error) {
+	audio, err := p.Synthesizer.Synthesize(ctx, p.request(req))
+	if err != nil {
+		return nil, err
+	}
+	if p.trim {
+		audio.Data = TrimSilence(audio.Data)
+	}
+	return audio, nil
+}
+
+// SynthesizeStream trims as the audio arrives, holding back silence until
+// speech follows it, so streamed chunks match the trimmed audio
+func (p *processedStream) SynthesizeStream(ctx context.Context, req Request, chunk func([]byte) error) (*Audio, error) {
+	if !p.trim {
+		return p.streamer.SynthesizeStream(ctx, p.request(req), chunk)
+	}
+
+	var trimmer silenceTrimmer
+	emit := func(data []byte) error {
+		for len(data) > 0 {
+			n := min(len(data), StreamChunkSize)
+			if err := chunk(data[:n]); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	}
+	audio, err := p.streamer.SynthesizeStream(ctx, p.request(req), func(data []byte) error {
+		return emit(trimmer.write(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := emit(trimmer.finish()); err != nil {
+		return nil, err
+	}
+	audio.Data = TrimSilence(audio.Data)
+	return audio, nil
+}
@@ -0,0 +1,63 @@
+package tts
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Segments splits text into pieces of at most max characters, breaking after
+// sentences where possible and between words otherwise, so a long message can
+// be synthesized piece by piece. Text that already fits is returned whole.
+func Segments(text string, max int) []string {
+	text = strings.TrimSpace(text)
+	if max <= 0 || len(text) <= max {
+		return []string{text}
+	}
+
+	var segments []string
+	var current strings.Builder
+	flush := func() {
+		if segment := strings.TrimSpace(current.String()); segment != "" {
+			segments = append(segments, segment)
+		}
+		current.Reset()
+	}
+
+	for _, sentence := range sentences(text) {
+		if current.Len()+len(sentence) > max {
+			flush()
+		}
+		for len(sentence) > max {
+			cut := strings.LastIndexFunc(sentence[:max], unicode.IsSpace)
+			if cut <= 0 {
+				// No space to break at; cut on a rune boundary instead
+				for cut = max; cut > 1 && !utf8.RuneStart(sentence[cut]); cut-- {
+				}
+			}
+			current.WriteString(sentence[:cut])
+			flush()
+			sentence = strings.TrimLeftFunc(sentence[cut:], unicode.IsSpace)
+		}
+		current.WriteString(sentence)
+	}
+	flush()
+	return segments
+}
+
+// sentences splits text after each '.', '!' or '?' that is followed by a space,
+// keeping the trailing space with the sentence
+func sentences(text string) []string {
+	var result []string
+	start := 0
+	for i := 0; i < len(text)-1; i++ {
+		if strings.IndexByte(".!?", text[i]) >= 0 && text[i+1] == ' ' {
+			result = append(result, text[start:i+2])
+			start = i + 2
+		}
+	}
+	if start < len(text) {
+		result = append(result, text[start:])
+	}
+	return result
+}
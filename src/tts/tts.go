@@ -0,0 +1,111 @@
+// Package tts synthesizes speech on the server for overlays that can't use
+// browser TTS.
+package tts
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Supported providers
+const (
+	ProviderGoogle = "google"
+	ProviderPolly  = "polly"
+)
+
+// Request is the text to speak and how to speak it. Empty fields use the
+// provider's configured defaults.
+type Request struct {
+	Text     string
+	Voice    string
+	Language string
+	// Rate is the speaking rate multiplier, 1 being the voice's normal speed
+	Rate float64
+}
+
+// Audio is synthesized speech
+type Audio struct {
+	Data        []byte
+	ContentType string
+}
+
+// Synthesizer turns text into speech
+type Synthesizer interface {
+	Name() string
+	Synthesize(ctx context.Context, req Request) (*Audio, error)
+}
+
+// StreamChunkSize is the most audio a streaming synthesizer hands out at once
+const StreamChunkSize = 12 * 1024
+
+// StreamSynthesizer is implemented by providers that can hand out audio while
+// it is still being rendered. chunk is called with each piece in order; the
+// complete audio is returned at the end as with Synthesize.
+type StreamSynthesizer interface {
+	Synthesizer
+	SynthesizeStream(ctx context.Context, req Request, chunk func([]byte) error) (*Audio, error)
+}
+
+// Config selects and configures a provider
+type Config struct {
+	Provider string
+	Voice    string
+	Language string
+	// Rate is the default speaking rate; MaxRate caps any rate asked for (0 = no cap)
+	Rate    float64
+	MaxRate float64
+	// TrimSilence drops silence at the start and end of the audio
+	TrimSilence bool
+
+	GoogleAPIKey string
+
+	AWSRegion          string
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+	PollyEngine        string
+
+	HTTPClient *http.Client
+}
+
+// New returns the configured synthesizer, or nil if no provider is set
+func New(config Config) (Synthesizer, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 15 * time.Second}
+	}
+	if config.Language == "" {
+		config.Language = "en-US"
+	}
+
+	switch config.Provider {
+	case "":
+		return nil, nil
+	case ProviderGoogle:
+		if config.GoogleAPIKey == "" {
+			return nil, fmt.Errorf("google TTS needs an API key")
+		}
+		return postProcess(&googleSynthesizer{config: config}, config), nil
+	case ProviderPolly:
+		if config.AWSRegion == "" || config.AWSAccessKeyID == "" || config.AWSSecretAccessKey == "" {
+			return nil, fmt.Errorf("polly needs an AWS region and credentials")
+		}
+		if config.Voice == "" {
+			config.Voice = "Joanna"
+		}
+		if config.PollyEngine == "" {
+			config.PollyEngine = "neural"
+		}
+		return postProcess(&pollySynthesizer{config: config}, config), nil
+	default:
+		return nil, fmt.Errorf("unknown TTS provider %q", config.Provider)
+	}
+}
+
+// providerError turns a non-2xx response into an error that includes the start of the body
+func providerError(provider string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s returned %s: %s", provider, resp.Status, body)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Twitch verification results attached to messages
+const (
+	twitchVerified   = "verified"
+	twitchUnverified = "unverified"
+	twitchUnknown    = "unknown"
+)
+
+const (
+	twitchHelixURL    = "https://api.twitch.tv/helix"
+	twitchChattersURL = twitchHelixURL + "/chat/chatters"
+	chattersCacheTTL  = 30 * time.Second
+)
+
+// TwitchConfig holds the credentials used to look up chatters. The access
+// token needs the moderator:read:chatters scope for the moderator account.
+type TwitchConfig struct {
+	ClientID      string
+	AccessToken   string
+	BroadcasterID string
+	ModeratorID   string
+}
+
+func (c TwitchConfig) enabled() bool {
+	return c.ClientID != "" && c.AccessToken != "" && c.BroadcasterID != ""
+}
+
+type chattersResponse struct {
+	Data []struct {
+		UserLogin string `json:"user_login"`
+		UserName  string `json:"user_name"`
+	} `json:"data"`
+	Pagination struct {
+		Cursor string `json:"cursor"`
+	} `json:"pagination"`
+}
+
+// twitchPresence caches the set of users currently in the streamer's chat
+type twitchPresence struct {
+	mutex    sync.Mutex
+	config   TwitchConfig
+	client   *http.Client
+	chatters map[string]bool
+	loadedAt time.Time
+}
+
+func newTwitchPresence(config TwitchConfig) *twitchPresence {
+	if config.ModeratorID == "" {
+		config.ModeratorID = config.BroadcasterID
+	}
+	return &twitchPresence{config: config, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// verify reports whether a donor name is in chat right now, or "" when verification is off
+func (t *twitchPresence) verify(ctx context.Context, name string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.config.enabled() {
+		return ""
+	}
+
+	if t.chatters == nil || clock.Now().Sub(t.loadedAt) > chattersCacheTTL {
+		chatters, err := t.fetchChatters(ctx)
+		if err != nil {
+			log.Printf("Error fetching Twitch chatters: %v", err)
+			return twitchUnknown
+		}
+		t.chatters = chatters
+		t.loadedAt = clock.Now()
+	}
+
+	login := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "@"))
+	if t.chatters[login] {
+		return twitchVerified
+	}
+	return twitchUnverified
+}
+
+// fetchChatters pages through the Get Chatters endpoint. Must be called with the mutex held.
+func (t *twitchPresence) fetchChatters(ctx context.Context) (map[string]bool, error) {
+	chatters := make(map[string]bool)
+	cursor := ""
+
+	for {
+		params := url.Values{}
+		params.Set("broadcaster_id", t.config.BroadcasterID)
+		params.Set("moderator_id", t.config.ModeratorID)
+		params.Set("first", "1000")
+		if cursor != "" {
+			params.Set("after", cursor)
+		}
+
+		var page chattersResponse
+		if err := helixGet(ctx, t.client, t.config, twitchChattersURL, params, &page); err != nil {
+			return nil, err
+		}
+
+		for _, chatter := range page.Data {
+			chatters[strings.ToLower(chatter.UserLogin)] = true
+			chatters[strings.ToLower(chatter.UserName)] = true
+		}
+
+		if page.Pagination.Cursor == "" {
+			return chatters, nil
+		}
+		cursor = page.Pagination.Cursor
+	}
+}
+
+// helixGet performs an authenticated Helix GET and decodes the JSON response into out
+func helixGet(ctx context.Context, client *http.Client, config TwitchConfig, endpoint string, params url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Client-Id", config.ClientID)
+	req.Header.Set("Authorization", "Bearer "+config.AccessToken)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("twitch API returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", endpoint, err)
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Usage hooks that metered usage can be reported to
+const (
+	usageHookStripe  = "stripe"
+	usageHookWebhook = "webhook"
+)
+
+// usageHookBacklog is how many records a failing hook keeps for its next try
+const usageHookBacklog = 10000
+
+// UsageConfig turns on usage metering for hosted deployments, where each
+// channel is an account billed for what it uses
+type UsageConfig struct {
+	Enabled       bool
+	FlushInterval time.Duration
+	Hooks         []string
+	Stripe        StripeMeterConfig
+	WebhookURL    string
+	WebhookSecret string
+}
+
+// StripeMeterConfig names the Stripe billing meters usage is reported to. A
+// meter left empty isn't reported.
+type StripeMeterConfig struct {
+	APIKey                string
+	MessagesMeter         string
+	SynthesisSecondsMeter string
+	ListenerMinutesMeter  string
+}
+
+// BillingSettings ties a channel to its billing account and limits it
+type BillingSettings struct {
+	StripeCustomerID string `json:"stripe_customer_id,omitempty"`
+	// MonthlyMessages caps the messages a channel is sent each calendar month
+	// (UTC); 0 is no cap
+	MonthlyMessages int64 `json:"monthly_messages,omitempty"`
+}
+
+func (b BillingSettings) validate() error {
+	if b.MonthlyMessages < 0 {
+		return fmt.Errorf("billing monthly_messages must not be negative")
+	}
+	return nil
+}
+
+// UsageRecord is a channel's usage in the hour from PeriodStart. Records
+// handed to hooks are what was used since the last flush.
+type UsageRecord struct {
+	// ID is unique to a flush, so hooks can make reporting it idempotent
+	ID               string    `json:"id,omitempty"`
+	Channel          string    `json:"channel"`
+	PeriodStart      time.Time `json:"period_start"`
+	Messages         int64     `json:"messages"`
+	SynthesisSeconds float64   `json:"synthesis_seconds"`
+	ListenerMinutes  int64     `json:"listener_minutes"`
+}
+
+// usageHook reports metered usage to a billing system
+type usageHook interface {
+	name() string
+	report(ctx context.Context, records []UsageRecord) error
+}
+
+type usageKey struct {
+	channel string
+	period  time.Time
+}
+
+// usageMeter counts usage in memory and flushes it to the database and the
+// hooks every FlushInterval
+type usageMeter struct {
+	mutex   sync.Mutex
+	pending map[usageKey]*UsageRecord
+	hooks   []usageHook
+	backlog map[string][]UsageRecord
+	// monthly caches each channel's messages this month as of the last flush
+	monthly map[string]monthlyUsage
+	// hub has the listeners whose minutes are metered
+	hub  *Hub
+	quit chan struct{}
+	done chan struct{}
+}
+
+type monthlyUsage struct {
+	month    time.Time
+	messages int64
+}
+
+// startUsageMetering starts hub's meter, for its listeners, and the hooks
+// config names
+func startUsageMetering(config UsageConfig, hub *Hub) error {
+	if !config.Enabled {
+		return nil
+	}
+	if config.FlushInterval <= 0 {
+		return fmt.Errorf("USAGE_FLUSH_SECONDS must be positive")
+	}
+
+	meter := &usageMeter{
+		pending: make(map[usageKey]*UsageRecord),
+		backlog: make(map[string][]UsageRecord),
+		monthly: make(map[string]monthlyUsage),
+		hub:     hub,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, name := range config.Hooks {
+		switch name {
+		case usageHookStripe:
+			if config.Stripe.APIKey == "" {
+				return fmt.Errorf("the stripe usage hook needs STRIPE_API_KEY")
+			}
+			meter.hooks = append(meter.hooks, &stripeUsageHook{
+				hub:    hub,
+				config: config.Stripe,
+				client: &http.Client{Timeout: 10 * time.Second},
+				carry:  make(map[string]float64),
+			})
+		case usageHookWebhook:
+			if config.WebhookURL == "" {
+				return fmt.Errorf("the webhook usage hook needs USAGE_WEBHOOK_URL")
+			}
+			meter.hooks = append(meter.hooks, webhookUsageHook{
+				url:    config.WebhookURL,
+				secret: []byte(config.WebhookSecret),
+				client: &http.Client{Timeout: 10 * time.Second},
+			})
+		default:
+			return fmt.Errorf("unknown usage hook %q", name)
+		}
+	}
+
+	hub.usage = meter
+	go meter.run(config.FlushInterval)
+	log.Printf("Metering usage, flushing every %s", config.FlushInterval)
+	return nil
+}
+
+// record adds to a channel's usage this hour. It is a no-op when metering is off.
+func (m *usageMeter) record(channel string, messages int64, synthesisSeconds float64, listenerMinutes int64) {
+	if m == nil {
+		return
+	}
+	if channel == "" {
+		channel = defaultChannel
+	}
+	if isSandboxChannel(channel) {
+		return
+	}
+	key := usageKey{channel: channel, period: clock.Now().UTC().Truncate(time.Hour)}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	record, ok := m.pending[key]
+	if !ok {
+		record = &UsageRecord{Channel: key.channel, PeriodStart: key.period}
+		m.pending[key] = record
+	}
+	record.Messages += messages
+	record.SynthesisSeconds += synthesisSeconds
+	record.ListenerMinutes += listenerMinutes
+}
+
+// checkQuota returns a *QuotaError when channel has used its monthly messages
+func (m *usageMeter) checkQuota(channel string) error {
+	if m == nil {
+		return nil
+	}
+	limit := m.hub.channelSettings(channel).Billing.MonthlyMessages
+	if limit <= 0 {
+		return nil
+	}
+
+	now := clock.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	m.mutex.Lock()
+	cached, ok := m.monthly[channel]
+	m.mutex.Unlock()
+	if !ok || !cached.month.Equal(month) {
+		messages, err := m.hub.db.getUsageMessages(channel, month)
+		if err != nil {
+			// Metering problems shouldn't stop messages
+			log.Printf("Error checking the message quota of channel %s: %v", channel, err)
+			return nil
+		}
+		cached = monthlyUsage{month: month, messages: messages}
+		m.mutex.Lock()
+		m.monthly[channel] = cached
+		m.mutex.Unlock()
+	}
+
+	used := cached.messages
+	m.mutex.Lock()
+	for key, record := range m.pending {
+		if key.channel == channel && !key.period.Before(month) {
+			used += record.Messages
+		}
+	}
+	m.mutex.Unlock()
+	if used < limit {
+		return nil
+	}
+	return &QuotaError{RetryAfter: month.AddDate(0, 1, 0).Sub(now)}
+}
+
+func (m *usageMeter) run(interval time.Duration) {
+	defer close(m.done)
+	flush := time.NewTicker(interval)
+	defer flush.Stop()
+	minute := time.NewTicker(time.Minute)
+	defer minute.Stop()
+
+	for {
+		select {
+		case <-minute.C:
+			m.sampleListeners()
+		case <-flush.C:
+			m.flush()
+		case <-m.quit:
+			m.flush()
+			return
+		}
+	}
+}
+
+// sampleListeners adds a minute for every listener connected now
+func (m *usageMeter) sampleListeners() {
+	counts := make(map[string]int)
+	m.hub.mutex.Lock()
+	for channel, clients := range m.hub.clients {
+		counts[channel] = len(clients)
+	}
+	m.hub.mutex.Unlock()
+	for channel, count := range counts {
+		m.record(channel, 0, 0, int64(count))
+	}
+}
+
+// flush writes what was used since the last flush to the database and hands
+// it to the hooks. Usage the database refuses is kept for the next flush.
+func (m *usageMeter) flush() {
+	m.mutex.Lock()
+	records := make([]UsageRecord, 0, len(m.pending))
+	for _, record := range m.pending {
+		records = append(records, *record)
+	}
+	m.pending = make(map[usageKey]*UsageRecord)
+	// Cached monthly totals are stale once the flushed messages are stored
+	m.monthly = make(map[string]monthlyUsage)
+	m.mutex.Unlock()
+	if len(records) == 0 {
+		return
+	}
+
+	if err := m.hub.db.addUsage(records); err != nil {
+		log.Printf("Error storing usage, keeping it for the next flush: %v", err)
+		m.mutex.Lock()
+		for _, record := range records {
+			key := usageKey{channel: record.Channel, period: record.PeriodStart}
+			if pending, ok := m.pending[key]; ok {
+				pending.Messages += record.Messages
+				pending.SynthesisSeconds += record.SynthesisSeconds
+				pending.ListenerMinutes += record.ListenerMinutes
+			} else {
+				kept := record
+				m.pending[key] = &kept
+			}
+		}
+		m.mutex.Unlock()
+		return
+	}
+
+	for i := range records {
+		records[i].ID = newDeliveryID()
+	}
+	for _, hook := range m.hooks {
+		batch := append(m.backlog[hook.name()], records...)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := hook.report(ctx, batch)
+		cancel()
+		if err == nil {
+			delete(m.backlog, hook.name())
+			continue
+		}
+		if len(batch) > usageHookBacklog {
+			log.Printf("Dropping %d usage records the %s hook couldn't take", len(batch)-usageHookBacklog, hook.name())
+			batch = batch[len(batch)-usageHookBacklog:]
+		}
+		m.backlog[hook.name()] = batch
+		log.Printf("Error reporting usage to the %s hook, retrying next flush: %v", hook.name(), err)
+	}
+}
+
+// close stops the meter after a last flush, or gives up when ctx is done
+func (m *usageMeter) close(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	close(m.quit)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		log.Printf("Usage meter shutdown timed out: %v", ctx.Err())
+	}
+}
+
+// stripeUsageHook sends usage to Stripe billing meters as meter events for
+// each channel's customer. Stripe meters count whole units, so fractions of
+// synthesis seconds are carried to the next report.
+type stripeUsageHook struct {
+	// hub has the channel settings naming each channel's customer
+	hub    *Hub
+	config StripeMeterConfig
+	client *http.Client
+	carry  map[string]float64
+}
+
+func (h *stripeUsageHook) name() string {
+	return usageHookStripe
+}
+
+func (h *stripeUsageHook) report(ctx context.Context, records []UsageRecord) error {
+	for i, record := range records {
+		customer := h.hub.channelSettings(record.Channel).Billing.StripeCustomerID
+		if customer == "" {
+			continue
+		}
+		seconds := record.SynthesisSeconds + h.carry[record.Channel]
+		whole := math.Floor(seconds)
+		for _, event := range []struct {
+			meter  string
+			suffix string
+			value  int64
+		}{
+			{h.config.MessagesMeter, "messages", record.Messages},
+			{h.config.SynthesisSecondsMeter, "synthesis", int64(whole)},
+			{h.config.ListenerMinutesMeter, "listeners", record.ListenerMinutes},
+		} {
+			if event.meter == "" || event.value <= 0 {
+				continue
+			}
+			if err := h.send(ctx, event.meter, customer, event.value, record.ID+"-"+event.suffix, record.PeriodStart); err != nil {
+				// Stripe drops repeats of an identifier, so resending from here is safe
+				return fmt.Errorf("failed to report usage of channel %s: %w", records[i].Channel, err)
+			}
+		}
+		h.carry[record.Channel] = seconds - whole
+	}
+	return nil
+}
+
+func (h *stripeUsageHook) send(ctx context.Context, meter string, customer string, value int64, identifier string, at time.Time) error {
+	form := url.Values{
+		"event_name":                  {meter},
+		"identifier":                  {identifier},
+		"timestamp":                   {strconv.FormatInt(at.Unix(), 10)},
+		"payload[stripe_customer_id]": {customer},
+		"payload[value]":              {strconv.FormatInt(value, 10)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.stripe.com/v1/billing/meter_events", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(h.config.APIKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("stripe returned %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookUsageHook POSTs each flush's usage as JSON, signed like outbound webhooks
+type webhookUsageHook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func (h webhookUsageHook) name() string {
+	return usageHookWebhook
+}
+
+func (h webhookUsageHook) report(ctx context.Context, records []UsageRecord) error {
+	body, err := json.Marshal(gin.H{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(h.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(signatureHeader, "t="+timestamp+",v1="+timestampedSignature(h.secret, timestamp, body))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("usage webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// rejectOverQuota answers a send over the channel's monthly quota
+func rejectOverQuota(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	localizedError(c, http.StatusTooManyRequests, "Monthly message quota reached")
+}
+
+// usageHandler lists metered usage by channel and hour
+func (s *Server) usageHandler(c *gin.Context) {
+	if s.hub.usage == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usage metering is not enabled"})
+		return
+	}
+	from, err := time.Parse(time.RFC3339, c.DefaultQuery("from", time.Now().AddDate(0, 0, -30).Format(time.RFC3339)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+	to, err := time.Parse(time.RFC3339, c.DefaultQuery("to", time.Now().Format(time.RFC3339)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' parameter"})
+		return
+	}
+
+	records, err := s.db.getUsage(from, to, c.Query("channel"))
+	if errors.Is(err, errPostgresRequired) {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Error listing usage: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list usage"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"usage": records})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rheddev/tts-server/src/tts"
+)
+
+// What happens to a message asking for a voice its amount doesn't unlock
+const (
+	voiceTierReject    = "reject"
+	voiceTierDowngrade = "downgrade"
+)
+
+// VoiceConfig lists the voices and languages senders may pick for a message
+// and the speaking speeds they may ask for. Empty lists allow only the defaults.
+type VoiceConfig struct {
+	// Voices are voice, voice=min_amount or voice=tier entries; a voice with
+	// an amount, or in a tier, is only used for donations of at least that much
+	Voices []string
+	// Tiers are tier=min_amount entries naming the amounts voices unlock at
+	Tiers     []string
+	Overflow  string
+	Languages []string
+	MinSpeed  float64
+	MaxSpeed  float64
+}
+
+// VoiceOption is a voice senders may pick, as listed by GET /voices
+type VoiceOption struct {
+	Name      string  `json:"name"`
+	Tier      string  `json:"tier,omitempty"`
+	MinAmount float64 `json:"min_amount,omitempty"`
+}
+
+// VoiceTier is a named amount that premium voices unlock at
+type VoiceTier struct {
+	Name      string   `json:"name"`
+	MinAmount float64  `json:"min_amount"`
+	Voices    []string `json:"voices"`
+}
+
+type voiceCatalog struct {
+	voices    []VoiceOption
+	tiers     []VoiceTier
+	overflow  string
+	languages []string
+	minSpeed  float64
+	maxSpeed  float64
+}
+
+var voices voiceCatalog
+
+// configureVoices parses the allowlists in VoiceConfig
+func configureVoices(config VoiceConfig) error {
+	catalog := voiceCatalog{languages: []string{}, overflow: config.Overflow, minSpeed: config.MinSpeed, maxSpeed: config.MaxSpeed}
+	if catalog.minSpeed < 0 || (catalog.maxSpeed > 0 && catalog.maxSpeed < catalog.minSpeed) {
+		return fmt.Errorf("VOICE_MIN_SPEED must be at least 0 and no more than VOICE_MAX_SPEED")
+	}
+	if catalog.overflow == "" {
+		catalog.overflow = voiceTierReject
+	}
+	if catalog.overflow != voiceTierReject && catalog.overflow != voiceTierDowngrade {
+		return fmt.Errorf("TTS_VOICE_TIER_OVERFLOW must be %q or %q", voiceTierReject, voiceTierDowngrade)
+	}
+
+	catalog.tiers = []VoiceTier{}
+	tiers := make(map[string]int)
+	for _, entry := range config.Tiers {
+		name, value, _ := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		amount, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if name == "" || err != nil || amount < 0 {
+			return fmt.Errorf("invalid voice tier %q, expected tier=min_amount", entry)
+		}
+		if _, ok := tiers[name]; ok {
+			return fmt.Errorf("voice tier %q is listed twice", name)
+		}
+		tiers[name] = len(catalog.tiers)
+		catalog.tiers = append(catalog.tiers, VoiceTier{Name: name, MinAmount: amount, Voices: []string{}})
+	}
+
+	catalog.voices = []VoiceOption{}
+	for _, entry := range config.Voices {
+		name, value, hasAmount := strings.Cut(entry, "=")
+		option := VoiceOption{Name: strings.TrimSpace(name)}
+		if hasAmount {
+			value = strings.TrimSpace(value)
+			if i, ok := tiers[value]; ok {
+				option.Tier = value
+				option.MinAmount = catalog.tiers[i].MinAmount
+				catalog.tiers[i].Voices = append(catalog.tiers[i].Voices, option.Name)
+			} else {
+				amount, err := strconv.ParseFloat(value, 64)
+				if err != nil || amount < 0 {
+					return fmt.Errorf("invalid voice %q, expected voice, voice=min_amount or voice=tier", entry)
+				}
+				option.MinAmount = amount
+			}
+		}
+		if option.Name == "" {
+			return fmt.Errorf("invalid voice %q, expected voice, voice=min_amount or voice=tier", entry)
+		}
+		catalog.voices = append(catalog.voices, option)
+	}
+	sort.SliceStable(catalog.tiers, func(i, j int) bool { return catalog.tiers[i].MinAmount < catalog.tiers[j].MinAmount })
+	for _, language := range config.Languages {
+		catalog.languages = append(catalog.languages, strings.TrimSpace(language))
+	}
+
+	voices = catalog
+	return nil
+}
+
+// check validates a message's voice, language and speed, returning the
+// reason it is refused or "" if they are allowed
+func (v voiceCatalog) check(msg Message) string {
+	if msg.Voice != "" {
+		option, ok := v.voice(msg.Voice)
+		if !ok {
+			return "Unknown voice: " + msg.Voice
+		}
+		if float64(msg.Amount) < option.MinAmount && v.overflow == voiceTierReject {
+			return fmt.Sprintf("Voice %s needs a donation of at least %g", option.Name, option.MinAmount)
+		}
+	}
+	if msg.Language != "" && !v.hasLanguage(msg.Language) {
+		return "Unknown language: " + msg.Language
+	}
+	if msg.Speed != 0 {
+		if msg.Speed < v.minSpeed || (v.maxSpeed > 0 && msg.Speed > v.maxSpeed) {
+			return fmt.Sprintf("Speed must be between %g and %g", v.minSpeed, v.maxSpeed)
+		}
+	}
+	return ""
+}
+
+// fit swaps msg's voice for one its amount unlocks when the voice it asked
+// for needs more and voices are downgraded rather than refused: the priciest
+// voice the amount does unlock, or the default voice if there is none. It
+// returns the voice asked for when it downgrades, or "".
+func (v voiceCatalog) fit(msg *Message) string {
+	if msg.Voice == "" || v.overflow != voiceTierDowngrade {
+		return ""
+	}
+	option, ok := v.voice(msg.Voice)
+	if !ok || float64(msg.Amount) >= option.MinAmount {
+		return ""
+	}
+
+	requested := msg.Voice
+	msg.Voice = ""
+	best := -1.0
+	for _, candidate := range v.voices {
+		if candidate.MinAmount <= float64(msg.Amount) && candidate.MinAmount > best {
+			msg.Voice, best = candidate.Name, candidate.MinAmount
+		}
+	}
+	return requested
+}
+
+func (v voiceCatalog) voice(name string) (VoiceOption, bool) {
+	for _, option := range v.voices {
+		if option.Name == name {
+			return option, true
+		}
+	}
+	return VoiceOption{}, false
+}
+
+func (v voiceCatalog) hasLanguage(language string) bool {
+	for _, allowed := range v.languages {
+		if strings.EqualFold(allowed, language) {
+			return true
+		}
+	}
+	return false
+}
+
+// SynthesisSettings switches off TTS providers and voices on a channel,
+// whatever a message asks for. Messages for a disabled provider are left to
+// browser TTS, and with "browser" disabled too they are shown without being
+// read out. Messages asking for a disabled voice get the default one.
+type SynthesisSettings struct {
+	DisabledProviders []string `json:"disabled_providers,omitempty"`
+	DisabledVoices    []string `json:"disabled_voices,omitempty"`
+}
+
+func (s SynthesisSettings) validate() error {
+	for _, provider := range s.DisabledProviders {
+		switch strings.ToLower(provider) {
+		case tts.ProviderGoogle, tts.ProviderPolly, engineBrowser:
+		default:
+			return fmt.Errorf("unknown synthesis provider %q, use %q, %q or %q", provider, tts.ProviderGoogle, tts.ProviderPolly, engineBrowser)
+		}
+	}
+	for _, voice := range s.DisabledVoices {
+		if strings.TrimSpace(voice) == "" {
+			return fmt.Errorf("synthesis disabled_voices must not be empty")
+		}
+	}
+	return nil
+}
+
+func (s SynthesisSettings) disablesProvider(provider string) bool {
+	for _, disabled := range s.DisabledProviders {
+		if strings.EqualFold(disabled, provider) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s SynthesisSettings) disablesVoice(voice string) bool {
+	for _, disabled := range s.DisabledVoices {
+		if voice != "" && strings.EqualFold(disabled, voice) {
+			return true
+		}
+	}
+	return false
+}
+
+// voicesHandler lists the voices, languages and speeds a message may ask for
+func voicesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"voices":    voices.voices,
+		"tiers":     voices.tiers,
+		"overflow":  voices.overflow,
+		"languages": voices.languages,
+		"speed":     gin.H{"min": voices.minSpeed, "max": voices.maxSpeed},
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WheelReward is one slice of a reward wheel
+type WheelReward struct {
+	Label  string `json:"label"`
+	Weight int    `json:"weight"`
+}
+
+// WheelRule grants a wheel spin to donations at or above MinAmount
+type WheelRule struct {
+	Name      string        `json:"name"`
+	MinAmount float32       `json:"min_amount"`
+	Rewards   []WheelReward `json:"rewards"`
+	Enabled   bool          `json:"enabled"`
+	Version   int           `json:"version"`
+}
+
+// WheelSpin is the auditable outcome of a single draw. The roll is derived from
+// HMAC-SHA256(seed, session_id), so anyone holding the seed can reproduce it.
+type WheelSpin struct {
+	Rule      string    `json:"rule"`
+	SessionID string    `json:"session_id"`
+	Name      string    `json:"name"`
+	Amount    float32   `json:"amount"`
+	Seed      string    `json:"seed"`
+	Roll      uint64    `json:"roll"`
+	Reward    string    `json:"reward"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type wheelRegistry struct {
+	mutex sync.Mutex
+	rules map[string]WheelRule
+}
+
+var wheel = &wheelRegistry{rules: make(map[string]WheelRule)}
+
+// loadWheelRules restores the configured reward rules at startup
+func loadWheelRules(hub *Hub) {
+	rules, err := hub.db.listWheelRules()
+	if err != nil {
+		log.Printf("Error loading wheel rules: %v", err)
+		return
+	}
+
+	wheel.mutex.Lock()
+	defer wheel.mutex.Unlock()
+	for _, rule := range rules {
+		wheel.rules[rule.Name] = rule
+	}
+}
+
+func (rule WheelRule) validate() error {
+	// Rule names follow the same slug format as channel names
+	if !validChannelName(rule.Name) {
+		return errors.New("invalid rule name")
+	}
+	if rule.MinAmount < 0 {
+		return errors.New("min_amount must not be negative")
+	}
+	if len(rule.Rewards) == 0 {
+		return errors.New("at least one reward is required")
+	}
+	for _, reward := range rule.Rewards {
+		if reward.Label == "" || reward.Weight <= 0 {
+			return errors.New("rewards need a label and a positive weight")
+		}
+	}
+	return nil
+}
+
+// spin draws a reward for a donation using a fresh random seed
+func (rule WheelRule) spin(msg Message) (WheelSpin, error) {
+	seed := make([]byte, 16)
+	if _, err := rand.Read(seed); err != nil {
+		return WheelSpin{}, err
+	}
+
+	roll := wheelRoll(seed, msg.SessionID)
+	return WheelSpin{
+		Rule:      rule.Name,
+		SessionID: msg.SessionID,
+		Name:      msg.Name,
+		Amount:    msg.Amount,
+		Seed:      hex.EncodeToString(seed),
+		Roll:      roll,
+		Reward:    pickReward(rule.Rewards, roll),
+		CreatedAt: clock.Now(),
+	}, nil
+}
+
+func wheelRoll(seed []byte, sessionID string) uint64 {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write([]byte(sessionID))
+	return binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+}
+
+// pickReward maps a roll onto the weighted rewards
+func pickReward(rewards []WheelReward, roll uint64) string {
+	var total uint64
+	for _, reward := range rewards {
+		total += uint64(reward.Weight)
+	}
+
+	point := roll % total
+	for _, reward := range rewards {
+		if point < uint64(reward.Weight) {
+			return reward.Label
+		}
+		point -= uint64(reward.Weight)
+	}
+	return rewards[len(rewards)-1].Label
+}
+
+// applyWheelSpins spins every enabled wheel the donation qualifies for
+func applyWheelSpins(hub *Hub, msg Message) {
+	wheel.mutex.Lock()
+	var rules []WheelRule
+	for _, rule := range wheel.rules {
+		if rule.Enabled && msg.Amount >= rule.MinAmount {
+			rules = append(rules, rule)
+		}
+	}
+	wheel.mutex.Unlock()
+
+	for _, rule := range rules {
+		result, err := rule.spin(msg)
+		if err != nil {
+			log.Printf("Error spinning wheel %s: %v", rule.Name, err)
+			continue
+		}
+
+		if err := hub.db.addWheelSpin(result); err != nil {
+			log.Printf("Error recording wheel spin for session %s: %v", msg.SessionID, err)
+		}
+
+		hub.publishEvent(msg.Channel, EventWheelSpin, result)
+	}
+}
+
+func listWheelRulesHandler(c *gin.Context) {
+	wheel.mutex.Lock()
+	rules := make([]WheelRule, 0, len(wheel.rules))
+	for _, rule := range wheel.rules {
+		rules = append(rules, rule)
+	}
+	wheel.mutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (s *Server) putWheelRuleHandler(c *gin.Context) {
+	expected, err := expectedVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rule WheelRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	rule.Name = c.Param("name")
+
+	if err := rule.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	version, err := s.db.saveWheelRule(rule, expected)
+	if errors.Is(err, errVersionConflict) {
+		wheel.mutex.Lock()
+		current, ok := wheel.rules[rule.Name]
+		wheel.mutex.Unlock()
+		if ok {
+			setVersionETag(c, current.Version)
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Wheel rule was changed by someone else", "current": current})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving wheel rule %s: %v", rule.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save wheel rule"})
+		return
+	}
+	rule.Version = version
+
+	wheel.mutex.Lock()
+	wheel.rules[rule.Name] = rule
+	wheel.mutex.Unlock()
+
+	user := c.MustGet(gin.AuthUserKey).(string)
+	log.Printf("User %s saved wheel rule %s", user, rule.Name)
+	setVersionETag(c, rule.Version)
+	c.JSON(http.StatusOK, rule)
+}
+
+func (s *Server) deleteWheelRuleHandler(c *gin.Context) {
+	name := c.Param("name")
+	if err := s.db.deleteWheelRule(name); err != nil {
+		log.Printf("Error deleting wheel rule %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete wheel rule"})
+		return
+	}
+
+	wheel.mutex.Lock()
+	delete(wheel.rules, name)
+	wheel.mutex.Unlock()
+
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) listWheelSpinsHandler(c *gin.Context) {
+	from := c.DefaultQuery("from", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
+	fromTime, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+
+	spins, err := s.db.getWheelSpins(fromTime)
+	if err != nil {
+		log.Printf("Error listing wheel spins: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list wheel spins"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"spins": spins})
+}
@@ -1,60 +1,418 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// Add CORS check
-	CheckOrigin: func(r *http.Request) bool {
-		// Only allow requests from the frontend url
-		return r.Header.Get("Origin") == os.Getenv("FRONTEND_URL")
-	},
+// newUpgrader accepts WebSocket handshakes from origin only
+func newUpgrader(origin string) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// Add CORS check
+		CheckOrigin: func(r *http.Request) bool {
+			// Only allow requests from the frontend url, or overlays on the
+			// custom domain being connected to
+			return r.Header.Get("Origin") == origin || isDomainOrigin(r)
+		},
+	}
 }
 
+// Overflow policies for listeners whose send queue is full
+const (
+	overflowDrop       = "drop"
+	overflowDisconnect = "disconnect"
+)
+
 type Hub struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan Message
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
-	mutex      sync.Mutex
+	// clients holds the listeners of each channel
+	clients       map[string]map[*listener]bool
+	broadcast     chan Message
+	events        chan Event
+	register      chan *listener
+	unregister    chan *listener
+	mutex         sync.Mutex
+	lastBroadcast time.Time
+	// lastMessageID is the highest message ID broadcast, handed out as the resume cursor
+	lastMessageID int64
+	// taps receive a copy of every broadcast message for in-process consumers
+	taps map[chan []byte]bool
+	// moderators receive every delivered message and event on /ws/admin
+	moderators map[chan ModeratorFrame]bool
+	// pending holds alerts that arrived while no listener was connected
+	pending    []pendingAlert
+	messageTTL time.Duration
+	// summaryMin is how many held alerts a new listener gets as one summary
+	summaryMin int
+	// controls holds the channels the Stream Deck has paused or quietened
+	controls map[string]QueueState
+	// pacing holds alerts back while another is playing on the channel
+	pacing  PacingConfig
+	playing map[string]pacedAlert
+	// syncDelay is how far ahead of now alerts are told to play, so a
+	// channel's overlays play them together
+	syncDelay time.Duration
+	// sendBuffer is the outbound queue length of each listener, and overflow
+	// what happens to a listener that falls that far behind
+	sendBuffer int
+	overflow   string
+	// reconnect is the delay suggested to listeners closed with a
+	// reconnectable code, wsLimits what they may send, and resumeLimit how
+	// many stored messages one that reconnects is sent
+	reconnect   ReconnectPolicy
+	wsLimits    frameLimits
+	resumeLimit int
+	// moderation holds incoming messages for approval before they are
+	// broadcast, and sendDetach is what SEND_DETACH does with a message
+	// whose sender went away
+	moderation bool
+	sendDetach string
+	// sendLimits caps what is sent, and sessionLimiter how often each
+	// session sends
+	sendLimits     SendLimits
+	sessionLimiter *rateLimiter
+	// currency is COMPAT_CURRENCY, for messages that don't name their own
+	currency string
+	// handoffTTL is how long a draining instance's handoff waits in Redis for
+	// another instance to take it; zero turns handoff off
+	handoffTTL time.Duration
+	// mediaHosts is the allowlist of hosts overlays may be told to load
+	// media from
+	mediaHosts []string
+	mediaShare MediaShareConfig
+	payments   PaymentConfig
+	smtp       SMTPConfig
+	rtc        RTCConfig
+	// standby holds the primary lease, or says this instance is a standby
+	standby *standbyState
+	// usage meters what each channel uses; it is nil unless USAGE_METERING is set
+	usage *usageMeter
+	// synthesis renders server-side TTS and keeps the audio served from /audio/:id
+	synthesis *speech
+	// playback estimates when alerts will have been read out
+	playback *playbackEstimator
+	// transcripts records what is read out, when TRANSCRIPT_DIR is set
+	transcripts *transcriptLog
+	// metrics collects what /metrics serves
+	metrics *metricsRegistry
+	// filter is the content filter every message passes before it is read out
+	filter *contentFilter
+	// cursors signs the resume cursors listeners are sent
+	cursors *cursorSigner
+	// twitch checks donor names against the streamer's chat
+	twitch *twitchPresence
+	// sessionClaims are the session IDs being accepted or accepted lately,
+	// and acceptsInFlight counts the messages being accepted, from any source
+	sessionClaims   *sessionClaims
+	acceptsInFlight atomic.Int64
+	// draining is set by Shutdown; quit stops run, which closes stopped
+	draining bool
+	quit     chan struct{}
+	stopped  chan struct{}
+	// storing counts messages still being written to the store
+	storing sync.WaitGroup
+	// store keeps delivered and missed alerts, and bus carries broadcasts to
+	// the other instances when Redis is configured
+	store Store
+	bus   *redisBus
+	// db is what the Postgres-only features store; under SQLite it fails
+	// every call with errPostgresRequired
+	db *postgresStore
+	// settings caches channel settings loaded from db
+	settings settingsCache
+	// eventLog records what happens to each message; it is nil unless
+	// EVENT_LOG_ENABLED is set
+	eventLog *eventLog
+	// signingKeys signs outgoing webhooks and reports and verifies signed
+	// sends
+	signingKeys *signingKeyRing
+	// webhooks caches the registered outbound webhooks, and deliveries
+	// tracks the deliveries to them under way
+	webhooks   webhookCache
+	deliveries webhookDeliveries
+	// presence tracks the streams of the channels with listeners here
+	presence presenceState
+}
+
+// transport is the connection a listener's alerts are written to: a WebSocket,
+// or a WebRTC data channel
+type transport interface {
+	write(payload []byte) error
+	ping() error
+	// closeWith tells the client why it is being disconnected, leaving the
+	// connection for the caller to close
+	closeWith(code int, cursor string) error
+	Close() error
+}
+
+// wsTransport is a listener's WebSocket connection
+type wsTransport struct {
+	*websocket.Conn
+	reconnect ReconnectPolicy
+}
+
+func (t wsTransport) write(payload []byte) error {
+	t.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return t.WriteMessage(websocket.TextMessage, payload)
+}
+
+func (t wsTransport) ping() error {
+	return t.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second))
+}
+
+func (t wsTransport) closeWith(code int, cursor string) error {
+	return sendClose(t.Conn, t.reconnect, code, cursor)
+}
+
+// listener is an overlay connected to a channel. Writes go through its own
+// queue and writer goroutine so a slow connection only holds up itself.
+type listener struct {
+	id      string
+	conn    transport
+	channel string
+	format  string
+	// remote is the client's address, where the transport knows it
+	remote      string
+	connectedAt time.Time
+	writes      writeStats
+	// metrics is the hub's, which the listener's writes are recorded in
+	metrics *metricsRegistry
+	// violations counts the malformed frames the listener has sent
+	violations atomic.Int32
+	// streams is set for listeners that take audio_chunk frames while a message is synthesized
+	streams bool
+	// canary is set for listeners that take canary broadcasts
+	canary bool
+	// key is the API key the listener connected with, if any, which resume
+	// cursors are checked against
+	key  *APIKey
+	send chan []byte
+	// done is closed once the hub has dropped the listener
+	done      chan struct{}
+	closeOnce sync.Once
+	// drain asks the writer to write out its queue and stop, closing drained
+	drain   chan struct{}
+	drained chan struct{}
 }
 
-var hub = Hub{
-	clients:    make(map[*websocket.Conn]bool),
-	broadcast:  make(chan Message),
-	register:   make(chan *websocket.Conn),
-	unregister: make(chan *websocket.Conn),
-	mutex:      sync.Mutex{},
+// pendingAlert is an alert waiting in the playback queue for a listener
+type pendingAlert struct {
+	message  Message
+	payload  []byte
+	queuedAt time.Time
+}
+
+func newHub(store Store) *Hub {
+	return &Hub{
+		store:         store,
+		db:            postgresOf(store),
+		settings:      settingsCache{entries: make(map[string]cachedSettings)},
+		deliveries:    webhookDeliveries{pending: make(map[*pendingDelivery]bool), stop: make(chan struct{})},
+		presence:      presenceState{channels: make(map[string]*channelPresence), grace: 30 * time.Second},
+		sessionClaims: newSessionClaims(),
+		twitch:        newTwitchPresence(TwitchConfig{}),
+		cursors:       &cursorSigner{maxAge: 24 * time.Hour},
+		metrics:       newMetricsRegistry(defaultMetricsMaxSeries, ""),
+		filter:        &contentFilter{},
+		transcripts:   &transcriptLog{},
+		standby:       &standbyState{},
+		synthesis:     &speech{audio: make(map[string]storedAudio)},
+		playback:      newPlaybackEstimator(PlaybackConfig{WordsPerMinute: 150, AlertOverhead: 5 * time.Second}),
+		clients:       make(map[string]map[*listener]bool),
+		taps:          make(map[chan []byte]bool),
+		moderators:    make(map[chan ModeratorFrame]bool),
+		controls:      make(map[string]QueueState),
+		playing:       make(map[string]pacedAlert),
+		broadcast:     make(chan Message),
+		events:        make(chan Event),
+		register:      make(chan *listener),
+		unregister:    make(chan *listener),
+		quit:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		mutex:         sync.Mutex{},
+		sendBuffer:    64,
+		overflow:      overflowDisconnect,
+		reconnect:     ReconnectPolicy{BaseDelay: 2 * time.Second, Jitter: 10 * time.Second},
+		wsLimits:      frameLimits{MaxFrameBytes: 4096, MaxViolations: 5},
+		resumeLimit:   50,
+		sendDetach:    detachBroadcast,
+		currency:      "USD",
+		mediaHosts:    defaultMediaHosts,
+	}
+}
+
+func (hub *Hub) newListener(conn transport, channel string, format string) *listener {
+	return &listener{
+		id:          newListenerID(),
+		conn:        conn,
+		channel:     channel,
+		format:      format,
+		connectedAt: time.Now(),
+		metrics:     hub.metrics,
+		send:        make(chan []byte, hub.sendBuffer),
+		done:        make(chan struct{}),
+		drain:       make(chan struct{}),
+		drained:     make(chan struct{}),
+	}
+}
+
+// write writes a payload to the listener's connection, timing it
+func (l *listener) write(payload []byte) error {
+	started := time.Now()
+	err := l.conn.write(payload)
+	took := time.Since(started)
+	l.writes.record(took)
+	l.metrics.observe(metricListenerWriteSeconds, MetricLabels{Channel: l.channel, Kind: "listener"}, took.Seconds())
+	return err
+}
+
+// writePump writes queued payloads and keepalive pings until the listener is dropped
+func (l *listener) writePump() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case payload := <-l.send:
+			if chaos.strikes(chaos.DisconnectRate) {
+				log.Printf("Chaos mode disconnected a listener on channel %s", l.channel)
+				l.conn.Close()
+				return
+			}
+			if err := l.write(payload); err != nil {
+				log.Printf("Error writing message to client: %v", err)
+				l.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := l.conn.ping(); err != nil {
+				log.Printf("Error sending ping: %v", err)
+				l.conn.Close()
+				return
+			}
+		case <-l.drain:
+			l.writeQueued()
+			close(l.drained)
+			return
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// writeQueued writes whatever is left in the send queue
+func (l *listener) writeQueued() {
+	for {
+		select {
+		case payload := <-l.send:
+			if err := l.write(payload); err != nil {
+				log.Printf("Error writing message to client: %v", err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// enqueue hands a payload to the listener's writer without blocking
+func (l *listener) enqueue(payload []byte) bool {
+	select {
+	case l.send <- payload:
+		l.metrics.observe(metricListenerQueueOccupancy, MetricLabels{Channel: l.channel, Kind: "listener"}, float64(len(l.send))/float64(cap(l.send)))
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver queues a payload for a listener, applying the overflow policy when
+// its queue is full. It reports whether the payload was queued.
+// Must be called with the mutex held.
+func (hub *Hub) deliver(l *listener, payload []byte) bool {
+	if l.enqueue(payload) {
+		return true
+	}
+
+	hub.metrics.inc(metricListenerOverflows, MetricLabels{Channel: l.channel, Kind: hub.overflow}, 1)
+	if hub.overflow == overflowDrop {
+		log.Printf("Dropped message for slow listener on channel %s", l.channel)
+		return false
+	}
+
+	log.Printf("Disconnecting slow listener on channel %s", l.channel)
+	hub.forgetClient(l)
+	cursor := hub.resumeCursor(l.channel)
+	go func() {
+		l.conn.closeWith(CloseSlowConsumer, cursor)
+		l.conn.Close()
+	}()
+	return false
 }
 
 func (hub *Hub) run() {
+	expiry := time.NewTicker(30 * time.Second)
+	defer expiry.Stop()
+	var pace <-chan time.Time
+	if hub.pacing.Enabled {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+
 	for {
 		select {
-		case client := <-hub.register:
+		case <-hub.quit:
+			close(hub.stopped)
+			return
+		case <-pace:
+			hub.mutex.Lock()
+			hub.advancePacing()
+			hub.mutex.Unlock()
+		case <-expiry.C:
 			hub.mutex.Lock()
-			hub.clients[client] = true
+			hub.expirePending()
+			hub.retryPending()
 			hub.mutex.Unlock()
-			log.Printf("Client connected. Total clients: %d", len(hub.clients))
-		case client := <-hub.unregister:
+		case l := <-hub.register:
 			hub.mutex.Lock()
-			if _, ok := hub.clients[client]; ok {
-				delete(hub.clients, client)
-				client.Close()
-				log.Printf("Client disconnected. Total clients: %d", len(hub.clients))
+			if hub.clients[l.channel] == nil {
+				hub.clients[l.channel] = make(map[*listener]bool)
+				hub.listenerJoined(l.channel)
+			}
+			hub.clients[l.channel][l] = true
+			hub.metrics.add(metricListeners, MetricLabels{Channel: l.channel, Kind: "listener"}, 1)
+			hub.flushPending(l.channel)
+			total := hub.listenerCount()
+			hub.mutex.Unlock()
+			log.Printf("Client connected to channel %s on instance %s. Total clients: %d", l.channel, instance.ID, total)
+		case l := <-hub.unregister:
+			hub.mutex.Lock()
+			if hub.clients[l.channel][l] {
+				hub.dropClient(l)
+				log.Printf("Client disconnected from channel %s. Total clients: %d", l.channel, hub.listenerCount())
 			}
 			hub.mutex.Unlock()
 		case message := <-hub.broadcast:
+			started := time.Now()
+			// Internal senders (poll announcements, probes) don't pick a channel
+			if message.Channel == "" {
+				message.Channel = defaultChannel
+			}
+			message.Cursor = hub.cursors.sign(message.Channel, message.ID)
 			hub.mutex.Lock()
 			messageJSON, err := json.Marshal(message)
 			if err != nil {
@@ -63,36 +421,445 @@ func (hub *Hub) run() {
 				continue
 			}
 
-			for client := range hub.clients {
-				// Set write deadline
-				client.SetWriteDeadline(time.Now().Add(10 * time.Second))
-				if err := client.WriteMessage(websocket.TextMessage, messageJSON); err != nil {
-					log.Printf("Error writing message to client: %v", err)
-					client.Close()
-					delete(hub.clients, client)
+			for tap := range hub.taps {
+				select {
+				case tap <- messageJSON:
+				default:
+				}
+			}
+
+			// Probes only travel as far as the taps; overlays, storage and stats never see them
+			if message.Probe {
+				hub.mutex.Unlock()
+				continue
+			}
+			// Once draining, nothing new goes out; it is kept for requeueing instead
+			if hub.draining {
+				hub.storeMissed(message)
+				hub.mutex.Unlock()
+				continue
+			}
+			hub.lastBroadcast = time.Now()
+			if message.ID > hub.lastMessageID {
+				hub.lastMessageID = message.ID
+			}
+			hub.notifyModerators("message", messageJSON)
+			if message.Canary {
+				hub.deliverCanary(message, messageJSON)
+				hub.mutex.Unlock()
+				continue
+			}
+
+			// Nobody is listening on the channel (e.g. OBS is closed), it is
+			// paused or another alert is playing: hold the alert until someone
+			// connects, it is resumed or its turn comes
+			if len(hub.clients[message.Channel]) == 0 || hub.controls[message.Channel].Paused || hub.pacingBusy(message.Channel) {
+				slog.DebugContext(withRequestID(context.Background(), message.RequestID), "Holding alert in the playback queue", messageAttrs(message)...)
+				hub.pending = append(hub.pending, pendingAlert{message: message, payload: messageJSON, queuedAt: clock.Now()})
+				hub.mutex.Unlock()
+				continue
+			}
+
+			message, messageJSON = hub.withPlayAt(message, messageJSON)
+			rendered := map[string][]byte{formatNative: messageJSON}
+			for client := range hub.clients[message.Channel] {
+				payload, ok := rendered[client.format]
+				if !ok {
+					if payload, err = renderMessage(hub, client.format, message, messageJSON); err != nil {
+						log.Printf("Error rendering %s message: %v", client.format, err)
+						continue
+					}
+					rendered[client.format] = payload
 				}
-				addMessage(message.SessionID, message.Name, message.Amount, message.Message, message.Description)
+				hub.deliver(client, payload)
+			}
+			slog.DebugContext(withRequestID(context.Background(), message.RequestID), "Broadcast message",
+				append(messageAttrs(message), "listeners", len(hub.clients[message.Channel]))...)
+			hub.startPlaying(message)
+			hub.announceDelivered(message)
+			if !message.Replay && !message.Remote {
+				ducking.cue(hub, message)
 			}
 			hub.mutex.Unlock()
+
+			// Stored once per message, outside the lock so the database never holds up delivery
+			if !message.Replay && !message.Remote && !message.Test {
+				hub.storeAsync(message)
+			}
+			labels := MetricLabels{Channel: message.Channel, Kind: "donation"}
+			if message.Audio != nil {
+				labels.Engine = message.Audio.Provider
+			}
+			hub.metrics.inc(metricMessagesBroadcast, labels, 1)
+			hub.metrics.observe(metricBroadcastSeconds, labels, time.Since(started).Seconds())
+		case event := <-hub.events:
+			eventJSON, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error marshaling %s event: %v", event.Type, err)
+				continue
+			}
+
+			hub.mutex.Lock()
+			hub.applyQueueControl(event)
+			hub.notifyModerators("event", eventJSON)
+			for channel, clients := range hub.clients {
+				if event.Channel != "" && channel != event.Channel {
+					continue
+				}
+				for client := range clients {
+					if wantsEvents(client.format) && (!event.Canary || client.canary) {
+						hub.deliver(client, eventJSON)
+					}
+				}
+			}
+			hub.mutex.Unlock()
+		}
+	}
+}
+
+// storeMessage records a delivered message and tells webhooks and the
+// channel's integrations it went out
+func (hub *Hub) storeMessage(message Message) {
+	if message.announcement() {
+		return
+	}
+	ctx := withRequestID(context.Background(), message.RequestID)
+	hub.notifyWebhooks(webhookMessageBroadcast, message)
+	go notifyChannelIntegrations(hub, message)
+	status := message.Status
+	if status == "" {
+		status = statusBroadcast
+	}
+	if !message.Test && !message.Probe {
+		broadcastOutcomes.record(status != statusMissed)
+	}
+	hub.eventLog.record(eventMessageBroadcast, message, gin.H{"status": status})
+	if err := hub.store.AddMessage(message); err != nil {
+		slog.ErrorContext(ctx, "Error storing message", "session_id", message.SessionID, "error", err)
+		return
+	}
+	slog.DebugContext(ctx, "Stored message", "session_id", message.SessionID, "status", message.Status)
+}
+
+// expirePending moves queued alerts older than the TTL to the missed state.
+// Alerts held by a paused channel don't expire. Must be called with the mutex held.
+func (hub *Hub) expirePending() {
+	if hub.messageTTL <= 0 || len(hub.pending) == 0 {
+		return
+	}
+
+	kept := hub.pending[:0]
+	for _, alert := range hub.pending {
+		if clock.Now().Sub(alert.queuedAt) <= hub.messageTTL || hub.controls[alert.message.Channel].Paused {
+			kept = append(kept, alert)
+			continue
+		}
+
+		log.Printf("Alert for session %s expired after %s in the queue", alert.message.SessionID, hub.messageTTL)
+		hub.storeMissed(alert.message)
+	}
+	hub.pending = kept
+}
+
+// dropDelivered lets go of an alert another instance delivered to its
+// listeners, when this instance is only holding it for want of listeners of
+// its own. The instance that accepted it stores it as delivered then, as it
+// would have on delivering it itself.
+func (hub *Hub) dropDelivered(channel string, sessionID string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.draining || len(hub.clients[channel]) > 0 {
+		return
+	}
+	kept := hub.pending[:0]
+	for _, alert := range hub.pending {
+		if alert.message.Channel != channel || alert.message.SessionID != sessionID {
+			kept = append(kept, alert)
+			continue
+		}
+		if !alert.message.Replay && !alert.message.Remote {
+			if !alert.message.Test {
+				hub.storeAsync(alert.message)
+			}
+			ducking.cue(hub, alert.message)
+		}
+	}
+	hub.pending = kept
+}
+
+// flushPending hands a channel's queued alerts to all of its listeners,
+// expiring stale ones first. With summaryMin set and at least that many
+// alerts queued, they are handed over as one summary instead. A listener
+// whose send queue fills up misses the alerts the others take; those none of
+// them has room for stay queued for the next retry. Paused channels keep
+// theirs until resumed, and paced channels until their turn.
+// Must be called with the mutex held.
+func (hub *Hub) flushPending(channel string) {
+	hub.expirePending()
+	// Paced channels release one alert at a time to all their listeners instead
+	if hub.controls[channel].Paused || hub.pacing.Enabled || len(hub.clients[channel]) == 0 {
+		return
+	}
+	if hub.summaryMin > 0 && hub.pendingCount(channel) >= hub.summaryMin {
+		hub.flushSummary(channel)
+		return
+	}
+
+	kept := hub.pending[:0]
+	delivered := 0
+	full := make(map[*listener]bool)
+	stuck := false
+	for _, alert := range hub.pending {
+		if stuck || alert.message.Channel != channel {
+			kept = append(kept, alert)
+			continue
+		}
+
+		taken := false
+		for client := range hub.clients[channel] {
+			if full[client] {
+				continue
+			}
+			payload, err := renderMessage(hub, client.format, alert.message, alert.payload)
+			if err != nil {
+				log.Printf("Error rendering %s message: %v", client.format, err)
+				continue
+			}
+			if !client.enqueue(payload) {
+				full[client] = true
+				continue
+			}
+			taken = true
+		}
+		if !taken {
+			// Later alerts wait too, so they aren't played out of order
+			stuck = true
+			kept = append(kept, alert)
+			continue
+		}
+		if !alert.message.Replay && !alert.message.Remote {
+			if !alert.message.Test {
+				hub.storeAsync(alert.message)
+			}
+			ducking.cue(hub, alert.message)
+		}
+		hub.announceDelivered(alert.message)
+		delivered++
+	}
+	hub.pending = kept
+
+	if delivered > 0 {
+		log.Printf("Delivered %d queued alerts to %d listeners on channel %s", delivered, len(hub.clients[channel]), channel)
+	}
+	if len(full) > 0 {
+		log.Printf("%d listeners on channel %s had no room for some queued alerts", len(full), channel)
+	}
+}
+
+// flushSummary hands a channel's queued alerts to all of its listeners as one
+// summary. Each alert is still stored as delivered. If no listener has room
+// for it, the alerts stay queued for the next retry.
+// Must be called with the mutex held.
+func (hub *Hub) flushSummary(channel string) {
+	var held []pendingAlert
+	kept := hub.pending[:0]
+	for _, alert := range hub.pending {
+		if alert.message.Channel == channel {
+			held = append(held, alert)
+		} else {
+			kept = append(kept, alert)
+		}
+	}
+
+	summary := summarizeHeld(hub, held)
+	native, err := json.Marshal(summary)
+	if err != nil {
+		log.Printf("Error rendering summary of queued alerts: %v", err)
+		return
+	}
+	taken := 0
+	for client := range hub.clients[channel] {
+		payload, err := renderMessage(hub, client.format, summary, native)
+		if err != nil {
+			log.Printf("Error rendering summary of queued alerts: %v", err)
+			continue
+		}
+		if client.enqueue(payload) {
+			taken++
+		}
+	}
+	if taken == 0 {
+		// Left queued for the next retry
+		return
+	}
+
+	hub.pending = kept
+	for _, alert := range held {
+		if !alert.message.Replay && !alert.message.Remote && !alert.message.Test {
+			hub.storeAsync(alert.message)
+		}
+		hub.announceDelivered(alert.message)
+	}
+	ducking.cue(hub, summary)
+	log.Printf("Delivered %d queued alerts as a summary to %d listeners on channel %s", len(held), taken, channel)
+}
+
+// retryPending hands alerts left over from an earlier flush to the listeners
+// of their channel. Must be called with the mutex held.
+func (hub *Hub) retryPending() {
+	// Flushing rewrites hub.pending, so the channels are gathered first
+	var channels []string
+	seen := make(map[string]bool)
+	for _, alert := range hub.pending {
+		if channel := alert.message.Channel; !seen[channel] {
+			seen[channel] = true
+			channels = append(channels, channel)
+		}
+	}
+	for _, channel := range channels {
+		hub.flushPending(channel)
+	}
+}
+
+// pendingCount is the number of alerts held for a channel. Must be called with the mutex held.
+func (hub *Hub) pendingCount(channel string) int {
+	count := 0
+	for _, alert := range hub.pending {
+		if alert.message.Channel == channel {
+			count++
 		}
 	}
+	return count
+}
+
+// listenerCount is the number of listeners across all channels. Must be called with the mutex held.
+func (hub *Hub) listenerCount() int {
+	count := 0
+	for _, clients := range hub.clients {
+		count += len(clients)
+	}
+	return count
 }
 
-func listenHandler(c *gin.Context) {
-	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+// dropClient closes a listener and forgets it. Must be called with the mutex held.
+func (hub *Hub) dropClient(client *listener) {
+	hub.forgetClient(client)
+	client.conn.Close()
+}
+
+// forgetClient stops a listener's writer and removes it from its channel.
+// Must be called with the mutex held.
+func (hub *Hub) forgetClient(client *listener) {
+	client.closeOnce.Do(func() { close(client.done) })
+	if hub.clients[client.channel][client] {
+		hub.metrics.add(metricListeners, MetricLabels{Channel: client.channel, Kind: "listener"}, -1)
+	}
+	_, known := hub.clients[client.channel]
+	delete(hub.clients[client.channel], client)
+	if known && len(hub.clients[client.channel]) == 0 {
+		delete(hub.clients, client.channel)
+		hub.listenerLeft(client.channel, hub.draining)
+	}
+}
+
+// addTap registers an in-process consumer of broadcast messages
+func (hub *Hub) addTap(buffer int) chan []byte {
+	tap := make(chan []byte, buffer)
+	hub.mutex.Lock()
+	hub.taps[tap] = true
+	hub.mutex.Unlock()
+	return tap
+}
+
+func (hub *Hub) removeTap(tap chan []byte) {
+	hub.mutex.Lock()
+	delete(hub.taps, tap)
+	hub.mutex.Unlock()
+}
+
+// resumeCursor is the ID of the last broadcast message, signed for a
+// listener of channel to pass back as ?since= to catch up. Must be called
+// with the mutex held.
+func (hub *Hub) resumeCursor(channel string) string {
+	return hub.cursors.sign(channel, hub.lastMessageID)
+}
+
+// closeAll sends the given close code to every connected client and drops them
+func (hub *Hub) closeAll(code int) int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	count := hub.listenerCount()
+	for _, clients := range hub.clients {
+		for client := range clients {
+			client.conn.closeWith(code, hub.resumeCursor(client.channel))
+			hub.dropClient(client)
+		}
+	}
+
+	return count
+}
+
+// listenHandler streams a channel's alerts; /ws/listen without a channel listens on the default one
+func (s *Server) listenHandler(c *gin.Context) {
+	channel := c.Param("channel")
+	if channel == "" {
+		channel = requestChannel(c)
+	}
+	if !validChannelName(channel) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel name"})
+		return
+	}
+	if key := apiKeyFrom(c); key != nil && !key.allowsChannel(channel) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key is not valid for this channel"})
+		return
+	}
+	format, err := payloadFormat(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	since, err := s.hub.cursors.verify(c.Query("since"), channel, apiKeyFrom(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Audio chunks are only part of the native format
+	streams := c.Query("audio") == "stream"
+	if streams && format != formatNative {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Audio streaming needs the native format"})
+		return
+	}
+
+	ws, err := s.upgradeWebSocket(c, &s.upgrader)
 	if err != nil {
 		log.Printf("Error upgrading connection: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade connection"})
 		return
 	}
 
-	hub.register <- ws
+	if key := apiKeyFrom(c); key != nil {
+		defer trackKeyConnection(key, wsTransport{ws, s.hub.reconnect})()
+	}
+
+	client := s.hub.newListener(wsTransport{ws, s.hub.reconnect}, channel, format)
+	client.remote = c.ClientIP()
+	client.streams = streams
+	client.canary = wantsCanary(c)
+	client.key = apiKeyFrom(c)
+	go client.writePump()
+	// Catch up from storage before live alerts start arriving
+	if since > 0 {
+		s.hub.replaySince(client, since)
+	}
+	s.hub.register <- client
 
 	defer func() {
-		hub.unregister <- ws
+		s.hub.unregister <- client
 		ws.Close()
 	}()
 
+	readLimited(ws, s.hub.wsLimits)
 	// Set read deadline
 	ws.SetReadDeadline(time.Now().Add(24 * time.Hour))
 	ws.SetPongHandler(func(string) error {
@@ -100,59 +867,328 @@ func listenHandler(c *gin.Context) {
 		return nil
 	})
 
-	// Start ping ticker
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
 	for {
-		select {
-		case <-ticker.C:
-			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
-				log.Printf("Error sending ping: %v", err)
-				return
-			}
-		default:
-			if _, _, err := ws.ReadMessage(); err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("Error reading message: %v", err)
-				}
-				return
+		messageType, data, err := ws.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			log.Printf("Closed listener %s on channel %s after a frame over %d bytes", client.id, channel, s.hub.wsLimits.MaxFrameBytes)
+			s.hub.metrics.inc(metricListenerViolations, MetricLabels{Channel: channel, Kind: "too_big"}, 1)
+			return
+		}
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Error reading message: %v", err)
 			}
+			return
+		}
+
+		// Listeners only receive text frames; binary input is not part of the protocol
+		if messageType == websocket.BinaryMessage {
+			log.Printf("Closing listener after binary frame")
+			s.hub.metrics.inc(metricListenerViolations, MetricLabels{Channel: channel, Kind: "binary"}, 1)
+			sendClose(ws, s.hub.reconnect, CloseProtocolViolation, "")
+			return
+		}
+		if s.hub.handleListenerFrame(client, data) {
+			continue
+		}
+		s.hub.metrics.inc(metricListenerViolations, MetricLabels{Channel: channel, Kind: "malformed"}, 1)
+		if violations := client.violations.Add(1); int(violations) > s.hub.wsLimits.MaxViolations {
+			log.Printf("Closing listener %s on channel %s after %d malformed frames", client.id, channel, violations)
+			sendClose(ws, s.hub.reconnect, CloseProtocolViolation, "")
+			return
 		}
 	}
 }
 
-func sendHandler(c *gin.Context) {
+func (s *Server) sendHandler(c *gin.Context) {
 	var req Message
-	if err := c.ShouldBindJSON(&req); err != nil {
+	var tooLarge *http.MaxBytesError
+	if err := bindSendRequest(s.hub, c, &req); errors.Is(err, errInvalidSignature) {
+		localizedError(c, http.StatusUnauthorized, "Invalid request signature")
+		return
+	} else if errors.As(err, &tooLarge) {
+		localizedError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit))
+		return
+	} else if err != nil {
 		log.Printf("Error binding JSON: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		localizedError(c, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	// Frontends without their own session ID can send an Idempotency-Key instead
+	if idempotencyKey := c.GetHeader("Idempotency-Key"); idempotencyKey != "" {
+		if req.SessionID != "" && req.SessionID != idempotencyKey {
+			localizedError(c, http.StatusBadRequest, "Idempotency-Key does not match session_id")
+			return
+		}
+		req.SessionID = idempotencyKey
+	}
+	if req.SessionID == "" {
+		localizedError(c, http.StatusBadRequest, "session_id or an Idempotency-Key header is required")
 		return
 	}
+	key := apiKeyFrom(c)
+	if req.Channel == "" && key != nil {
+		req.Channel = key.Channel
+	}
+	if req.Channel == "" {
+		req.Channel = requestChannel(c)
+	}
+	if !validChannelName(req.Channel) || !domainAllows(c, req.Channel) {
+		localizedError(c, http.StatusBadRequest, "Invalid channel name")
+		return
+	}
+	if key != nil && !key.allowsChannel(req.Channel) {
+		localizedError(c, http.StatusForbidden, "API key is not valid for this channel")
+		return
+	}
+	s.hub.metrics.inc(metricMessagesReceived, MetricLabels{Channel: req.Channel, Kind: "donation"}, 1)
 
-	// If session exists, send Bad Request, Status code 409
-	exists, err := checkSessionID(req.SessionID)
-	if exists && err == nil {
-		log.Printf("Session already exists: %s", req.SessionID)
-		c.JSON(http.StatusConflict, gin.H{"error": "Session already exists"})
+	// Validate message
+	if req.Message == "" {
+		localizedError(c, http.StatusBadRequest, "Message cannot be empty")
+		return
+	}
+	if reason := checkSendLimits(s.hub, req); reason != "" {
+		localizedError(c, http.StatusBadRequest, reason)
+		return
+	}
+	if reason := voices.check(req); reason != "" {
+		localizedError(c, http.StatusBadRequest, reason)
+		return
+	}
+	if reason := checkPricing(s.hub, req); reason != "" {
+		localizedError(c, http.StatusPaymentRequired, reason)
+		return
+	}
+	if reason := checkPrivateNote(s.hub, req); reason != "" {
+		localizedError(c, http.StatusBadRequest, reason)
+		return
+	}
+	var quota *QuotaError
+	if err := s.hub.sessionLimiter.take(req.SessionID); errors.As(err, &quota) {
+		slog.WarnContext(c.Request.Context(), "Rate limited session", "session_id", req.SessionID)
+		rejectRateLimited(c, quota.RetryAfter)
+		return
+	}
+	if err := s.hub.usage.checkQuota(req.Channel); errors.As(err, &quota) {
+		rejectOverQuota(c, quota.RetryAfter)
 		return
 	}
 
+	result, err := s.hub.acceptMessage(c.Request.Context(), req, c.ClientIP())
+	if result.Duplicate {
+		// Retries get the first request's answer, or a conflict while it is unknown
+		if err.status == http.StatusOK {
+			c.JSON(http.StatusOK, result)
+			return
+		}
+		c.JSON(err.status, gin.H{"error": localizeFor(c, err.message), "duplicate": true})
+		return
+	}
 	if err != nil {
-		log.Printf("Error checking session ID: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session ID"})
+		localizedError(c, err.status, err.message)
+		return
+	}
+	if result.State == deliveryPending {
+		c.JSON(http.StatusAccepted, result)
 		return
 	}
+	c.JSON(http.StatusOK, result)
+}
 
-	// log exists
-	log.Printf("Session ID exists: %t", exists)
+// acceptMessage runs a new donation through duplicate, ban and fraud checks,
+// then either holds it for moderation or delivers it. It is shared by
+// /ws/send and the payment provider webhooks.
+//
+// Each session ID is accepted once, even when repeats arrive concurrently or
+// on other instances. A repeat comes back with Duplicate set: with the first
+// request's result and a 200 once that is known, with a 409 before then.
+func (hub *Hub) acceptMessage(ctx context.Context, req Message, clientIP string) (SendResult, *sendError) {
+	hub.acceptsInFlight.Add(1)
+	defer hub.acceptsInFlight.Add(-1)
+	req.RequestID = requestIDFrom(ctx)
+	slog.InfoContext(ctx, "Received message", messageAttrs(req)...)
 
-	// Validate message
-	if req.Message == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Message cannot be empty"})
-		return
+	claimed, original := claimSession(hub, req.SessionID)
+	if !claimed {
+		slog.InfoContext(ctx, "Duplicate message", "session_id", req.SessionID)
+		if original != nil {
+			result := *original
+			result.Duplicate = true
+			return result, &sendError{http.StatusOK, "Duplicate message", ErrSessionUsed}
+		}
+		return SendResult{Duplicate: true}, &sendError{http.StatusConflict, "Session already exists", ErrSessionUsed}
+	}
+
+	result, err := hub.acceptClaimedMessage(ctx, req, clientIP)
+	switch {
+	case err == nil:
+		completeSession(hub, req.SessionID, result)
+		if !req.Test {
+			hub.usage.record(req.Channel, 1, 0, 0)
+		}
+	case !errors.Is(err, ErrSessionUsed):
+		// Nothing was accepted, so a retry, corrected or after our failure,
+		// should get another go
+		releaseSession(hub, req.SessionID)
+	}
+	return result, err
+}
+
+// acceptClaimedMessage does the work of acceptMessage once the session ID is claimed
+func (hub *Hub) acceptClaimedMessage(ctx context.Context, req Message, clientIP string) (SendResult, *sendError) {
+	// The claim is forgotten after a day, and on restart without Redis; the
+	// message log remembers for good
+	exists, err := hub.store.CheckSessionID(ctx, req.SessionID)
+	if exists && err == nil {
+		slog.InfoContext(ctx, "Session already exists", "session_id", req.SessionID)
+		return SendResult{Duplicate: true}, &sendError{http.StatusConflict, "Session already exists", ErrSessionUsed}
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking session ID", "session_id", req.SessionID, "error", err)
+		return SendResult{}, &sendError{http.StatusInternalServerError, "Failed to check session ID", err}
+	}
+
+	if banned, ok := matchBannedName(req.Name, hub.channelSettings(req.Channel).BannedNames); ok {
+		slog.WarnContext(ctx, "Rejected message: donor name matches a banned name", "session_id", req.SessionID)
+		hub.db.recordAudit("message.banned_name", actorSystem, req.SessionID, gin.H{"banned": banned})
+		// Hooks only ever see the masked name, as on the other reject paths
+		anonymize(hub, &req)
+		hooks.run(hookOnReject, req, "banned_name")
+		return SendResult{}, &sendError{http.StatusForbidden, "Donor name is not allowed", ErrMessageRejected}
+	}
+
+	if requested := voices.fit(&req); requested != "" {
+		slog.InfoContext(ctx, "Downgraded voice to what the amount unlocks", "session_id", req.SessionID, "requested", requested, "voice", req.Voice)
+	}
+	// Paid-for length comes first, so the filter sees the text that is read out
+	if applyPricing(hub, &req) {
+		slog.InfoContext(ctx, "Truncated message to what its amount pays for", "session_id", req.SessionID, "amount", req.Amount)
+	}
+	// The filter runs before anything downstream reads the text out or stores it
+	action := hub.filter.apply(hub, &req)
+	action = filterPlugins.apply(ctx, hub, &req, action, usesPostgres(hub.store))
+	countFilterTiers(hub, req)
+	if action == filterActionBan {
+		banDonor(hub, req)
+	}
+	if action == filterActionBlock || action == filterActionBan || (req.Message == "" && req.OriginalMessage != "") {
+		return SendResult{}, hub.blockMessage(ctx, req)
+	}
+
+	go checkFraud(hub, req, clientIP)
+
+	// Verify against the real name before it is masked; anonymous donors aren't checked
+	if !req.Anonymous {
+		verifyCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		req.TwitchVerified = hub.twitch.verify(verifyCtx, req.Name)
+		cancel()
+	}
+
+	// Everything downstream of here only ever sees the masked name
+	anonymize(hub, &req)
+	annotateEmotes(&req)
+
+	// Clients never pick the ID; it comes from the database so it orders across instances
+	req.ID, err = hub.store.NextMessageID(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reserving message ID", "session_id", req.SessionID, "error", err)
+		return SendResult{}, &sendError{http.StatusInternalServerError, "Failed to store message", err}
+	}
+	req.StatusToken = newStatusToken()
+	if !req.Test && messageKind(req) == kindDonation {
+		req.Receipt = receiptCode(req.ID, clock.Now())
+	}
+	hub.notifyWebhooks(webhookMessageReceived, req)
+	hooks.run(hookOnMessage, req, "")
+	hub.eventLog.record(eventMessageReceived, req, req)
+	if hub.sendDetach == detachAccept {
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	// In moderation mode nothing reaches the overlays until a moderator approves
+	// it, and the content filter can ask for the same for a single message, as
+	// can an amount too large to be read out unconfirmed
+	if hub.moderation || action == filterActionHold || overCeiling(hub, req) {
+		return hub.holdForModeration(req)
+	}
+
+	return hub.deliverMessage(ctx, req)
+}
+
+// blockMessage stores a message the content filter refused, for moderators
+// to review, without it ever reaching the overlays
+func (hub *Hub) blockMessage(ctx context.Context, req Message) *sendError {
+	slog.WarnContext(ctx, "Content filter blocked message", "session_id", req.SessionID, "reasons", strings.Join(req.FilterReasons, ", "), "original_message", req.OriginalMessage)
+	anonymize(hub, &req)
+	id, err := hub.store.NextMessageID(ctx)
+	if err != nil {
+		log.Printf("Error reserving message ID: %v", err)
+		return &sendError{http.StatusInternalServerError, "Failed to store message", err}
+	}
+	req.ID = id
+	req.Status = statusBlocked
+	hub.eventLog.record(eventMessageReceived, req, req)
+	hub.eventLog.record(eventMessageModerated, req, moderationEvent{Decision: statusBlocked, By: actorSystem, Reason: strings.Join(req.FilterReasons, ", ")})
+	if err := hub.store.AddMessage(req); err != nil {
+		log.Printf("Error storing blocked message for session %s: %v", req.SessionID, err)
+	}
+	hub.db.recordAudit("message.blocked", actorSystem, req.SessionID, gin.H{"reasons": req.FilterReasons})
+	hub.notifyWebhooks(webhookMessageFiltered, req)
+	hooks.run(hookOnReject, req, strings.Join(req.FilterReasons, ", "))
+	return &sendError{http.StatusUnprocessableEntity, "Message was blocked by the content filter", ErrMessageRejected}
+}
+
+// When the sender goes away, or ctx ends, after a message is accepted
+const (
+	// detachAccept finishes delivering the message as if they were still there
+	detachAccept = "accept"
+	// detachBroadcast gives up on synthesis and broadcasts the message without
+	// audio, so overlays read it out themselves
+	detachBroadcast = "broadcast"
+	// detachNever drops the message, and its session ID can be sent again
+	detachNever = "never"
+)
+
+// deliverMessage sends an accepted message to the overlays and to the features
+// that react to donations. Synthesis stops when ctx ends; what happens to the
+// message then is up to SEND_DETACH.
+func (hub *Hub) deliverMessage(ctx context.Context, req Message) (SendResult, *sendError) {
+	mediaURL := req.MediaURL
+	req.MediaURL = ""
+
+	// Quiet hours show alerts without reading them out
+	if hub.isQuiet(req.Channel) {
+		req.Quiet = true
+	} else {
+		synthCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		synthesizeMessage(synthCtx, hub, &req)
+		cancel()
+		if req.Audio != nil {
+			hub.eventLog.record(eventMessageSynthesized, req, gin.H{"provider": req.Audio.Provider, "duration_ms": req.Audio.DurationMS})
+		}
+	}
+
+	if err := ctx.Err(); err != nil && hub.sendDetach == detachNever {
+		slog.WarnContext(ctx, "Dropped message: the request ended before it was broadcast", "session_id", req.SessionID, "error", err)
+		return SendResult{}, &sendError{http.StatusServiceUnavailable, "Request ended before the message was broadcast", err}
+	}
+
+	result := hub.enqueueResult(&req)
+	hub.dispatch(req)
+	hype.observe(hub, req)
+	// These are shared by every channel, so sandbox donations stay out of them
+	if !isSandboxChannel(req.Channel) {
+		donationTicker.publish(req)
+		applyCharityMatch(hub, req)
+		applyBids(hub, req)
+		applyVotes(hub, req)
+		applyWheelSpins(hub, req)
+	}
+	if mediaURL != "" && hub.mediaShare.Enabled {
+		go submitMediaRequest(hub, req, mediaURL)
 	}
 
-	hub.broadcast <- req
-	c.JSON(http.StatusOK, gin.H{"status": "Message successfully sent"})
+	return result, nil
 }
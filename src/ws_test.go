@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeTransport stands in for a listener's connection; alerts are read from
+// the listener's send queue instead
+type fakeTransport struct {
+	// closed receives the code the listener is closed with
+	closed chan int
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{closed: make(chan int, 1)}
+}
+
+func (t *fakeTransport) write(payload []byte) error { return nil }
+func (t *fakeTransport) ping() error                { return nil }
+func (t *fakeTransport) Close() error               { return nil }
+
+func (t *fakeTransport) closeWith(code int, cursor string) error {
+	t.closed <- code
+	return nil
+}
+
+// startTestHub runs a hub on a SQLite store of its own until the test ends.
+// The tests send alerts as if relayed from another instance, which stores and
+// cues them itself, so nothing the hub starts for an alert outlives the test.
+func startTestHub(t *testing.T) *Hub {
+	t.Helper()
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "tts.db"))
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	hub := newHub(store)
+	go hub.run()
+	t.Cleanup(func() {
+		close(hub.quit)
+		<-hub.stopped
+		hub.storing.Wait()
+		store.Close()
+	})
+	return hub
+}
+
+// connect registers a listener on channel. The hub handles the registration
+// before anything sent to it afterwards.
+func connect(hub *Hub, channel string) (*listener, *fakeTransport) {
+	conn := newFakeTransport()
+	client := hub.newListener(conn, channel, formatNative)
+	hub.register <- client
+	return client, conn
+}
+
+// receive waits for the next alert queued for client
+func receive(t *testing.T, client *listener) Message {
+	t.Helper()
+	select {
+	case payload := <-client.send:
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Fatalf("decoding delivered payload: %v", err)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nothing delivered to the listener on channel %s", client.channel)
+	}
+	return Message{}
+}
+
+func TestHubDeliversToTheChannelsListeners(t *testing.T) {
+	t.Parallel()
+	hub := startTestHub(t)
+	first, _ := connect(hub, "alpha")
+	second, _ := connect(hub, "alpha")
+	other, _ := connect(hub, "beta")
+
+	hub.broadcast <- Message{SessionID: "session-1", Channel: "alpha", Name: "Ada", Amount: 5, Remote: true}
+
+	for _, client := range []*listener{first, second} {
+		if msg := receive(t, client); msg.SessionID != "session-1" {
+			t.Fatalf("delivered session %q, want session-1", msg.SessionID)
+		}
+	}
+	// The hub queues for every listener before taking the next message
+	hub.broadcast <- Message{SessionID: "session-2", Channel: "alpha", Remote: true}
+	if queued := len(other.send); queued != 0 {
+		t.Fatalf("listener on another channel was sent %d alerts", queued)
+	}
+}
+
+func TestHubHoldsAlertsUntilAListenerConnects(t *testing.T) {
+	t.Parallel()
+	hub := startTestHub(t)
+	hub.broadcast <- Message{SessionID: "held-1", Channel: "alpha", Remote: true}
+	hub.broadcast <- Message{SessionID: "held-2", Channel: "alpha", Remote: true}
+
+	client, _ := connect(hub, "alpha")
+	for _, want := range []string{"held-1", "held-2"} {
+		if msg := receive(t, client); msg.SessionID != want {
+			t.Fatalf("delivered session %q, want %q", msg.SessionID, want)
+		}
+	}
+	hub.mutex.Lock()
+	pending := hub.pendingCount("alpha")
+	hub.mutex.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d alerts still held after delivery", pending)
+	}
+}
+
+func TestHubExpiresHeldAlerts(t *testing.T) {
+	manual := newManualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	useClock(t, manual)
+	hub := startTestHub(t)
+	hub.mutex.Lock()
+	hub.messageTTL = time.Minute
+	hub.mutex.Unlock()
+
+	hub.broadcast <- Message{SessionID: "stale", Channel: "alpha", Remote: true}
+	// Once the next is taken the first is queued, at the time before the advance
+	hub.broadcast <- Message{SessionID: "other", Channel: "beta", Remote: true}
+	manual.Advance(2 * time.Minute)
+	hub.broadcast <- Message{SessionID: "fresh", Channel: "alpha", Remote: true}
+
+	client, _ := connect(hub, "alpha")
+	if msg := receive(t, client); msg.SessionID != "fresh" {
+		t.Fatalf("delivered session %q, want only the unexpired one", msg.SessionID)
+	}
+	if queued := len(client.send); queued != 0 {
+		t.Fatalf("%d more alerts delivered, want none", queued)
+	}
+}
+
+func TestHubDisconnectsSlowListeners(t *testing.T) {
+	t.Parallel()
+	hub := startTestHub(t)
+	hub.mutex.Lock()
+	hub.sendBuffer = 1
+	hub.mutex.Unlock()
+	client, conn := connect(hub, "alpha")
+
+	hub.broadcast <- Message{SessionID: "session-1", Channel: "alpha", Remote: true}
+	hub.broadcast <- Message{SessionID: "session-2", Channel: "alpha", Remote: true}
+
+	select {
+	case code := <-conn.closed:
+		if code != CloseSlowConsumer {
+			t.Fatalf("closed with %d, want %d", code, CloseSlowConsumer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow listener was not closed")
+	}
+	hub.mutex.Lock()
+	connected := hub.clients["alpha"][client]
+	hub.mutex.Unlock()
+	if connected {
+		t.Fatal("slow listener is still registered")
+	}
+}
+
+func TestHubDropsForSlowListenersWhenConfigured(t *testing.T) {
+	t.Parallel()
+	hub := startTestHub(t)
+	hub.mutex.Lock()
+	hub.sendBuffer = 1
+	hub.overflow = overflowDrop
+	hub.mutex.Unlock()
+	client, conn := connect(hub, "alpha")
+
+	hub.broadcast <- Message{SessionID: "session-1", Channel: "alpha", Remote: true}
+	hub.broadcast <- Message{SessionID: "session-2", Channel: "alpha", Remote: true}
+	// Once the third is taken the second has been dealt with
+	hub.broadcast <- Message{SessionID: "session-3", Channel: "beta", Remote: true}
+
+	if msg := receive(t, client); msg.SessionID != "session-1" {
+		t.Fatalf("kept session %q, want session-1", msg.SessionID)
+	}
+	select {
+	case code := <-conn.closed:
+		t.Fatalf("listener closed with %d, want it kept", code)
+	default:
+	}
+	hub.mutex.Lock()
+	connected := hub.clients["alpha"][client]
+	hub.mutex.Unlock()
+	if !connected {
+		t.Fatal("listener was dropped")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Outcomes of a WebSocket upgrade, the kind label of tts_ws_upgrades_total
+const (
+	upgradeAccepted       = "accepted"
+	upgradeOriginRejected = "origin_rejected"
+	upgradeAuthFailed     = "auth_failed"
+	upgradeHandshakeError = "handshake_error"
+	// upgradeRejected is a request refused before the handshake for anything
+	// else, such as an invalid channel or resume cursor
+	upgradeRejected = "rejected"
+)
+
+// upgradeFailureLogSize is how many failed upgrades the diagnostics keep
+const upgradeFailureLogSize = 200
+
+// upgradeRecordedKey marks requests whose upgrade outcome is already recorded
+const upgradeRecordedKey = "ws_upgrade_recorded"
+
+// UpgradeFailure is one WebSocket connection that never got going, as
+// GET /admin/diagnostics/ws lists them
+type UpgradeFailure struct {
+	Time  time.Time `json:"time"`
+	Cause string    `json:"cause"`
+	// Path leaves out the query string, which can carry keys
+	Path    string `json:"path"`
+	Channel string `json:"channel,omitempty"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Origin  string `json:"origin,omitempty"`
+	// Credentials is whether the request carried a key or other credentials,
+	// to tell an overlay missing its key from one with a wrong key
+	Credentials bool   `json:"credentials"`
+	RemoteAddr  string `json:"remote_addr"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+}
+
+// upgradeLog is a rolling log of failed upgrades, with a count of every
+// outcome since the server started
+type upgradeLog struct {
+	mutex    sync.Mutex
+	failures []UpgradeFailure
+	next     int
+	counts   map[string]int64
+}
+
+var upgradeDiagnostics = &upgradeLog{counts: make(map[string]int64)}
+
+// record counts an upgrade's outcome in the log and in metrics, keeping
+// failures in the log
+func (l *upgradeLog) record(c *gin.Context, metrics *metricsRegistry, cause string, status int, detail string) {
+	c.Set(upgradeRecordedKey, true)
+	metrics.inc(metricWSUpgrades, MetricLabels{Kind: cause}, 1)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.counts[cause]++
+	if cause == upgradeAccepted {
+		return
+	}
+	failure := UpgradeFailure{
+		Time:        clock.Now(),
+		Cause:       cause,
+		Path:        c.Request.URL.Path,
+		Channel:     c.Param("channel"),
+		Status:      status,
+		Error:       detail,
+		Origin:      c.GetHeader("Origin"),
+		Credentials: hasCredentials(c),
+		RemoteAddr:  c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		RequestID:   requestIDFrom(c.Request.Context()),
+	}
+	if len(l.failures) < upgradeFailureLogSize {
+		l.failures = append(l.failures, failure)
+		return
+	}
+	l.failures[l.next] = failure
+	l.next = (l.next + 1) % upgradeFailureLogSize
+}
+
+// recent is the logged failures, newest first, optionally of one cause
+func (l *upgradeLog) recent(cause string, limit int) []UpgradeFailure {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	failures := []UpgradeFailure{}
+	for i := range l.failures {
+		failure := l.failures[(l.next+len(l.failures)-1-i)%len(l.failures)]
+		if cause != "" && failure.Cause != cause {
+			continue
+		}
+		failures = append(failures, failure)
+		if len(failures) == limit {
+			break
+		}
+	}
+	return failures
+}
+
+func (l *upgradeLog) snapshot() map[string]int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	counts := make(map[string]int64, len(l.counts))
+	for cause, count := range l.counts {
+		counts[cause] = count
+	}
+	return counts
+}
+
+// upgradeWebSocket upgrades a request with the given upgrader and records
+// how it went. Failures have already been answered by the upgrader.
+func (s *Server) upgradeWebSocket(c *gin.Context, upgrader *websocket.Upgrader) (*websocket.Conn, error) {
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, instance.handshakeHeaders())
+	if err != nil {
+		cause, status := upgradeHandshakeError, http.StatusBadRequest
+		if upgrader.CheckOrigin != nil && !upgrader.CheckOrigin(c.Request) {
+			cause, status = upgradeOriginRejected, http.StatusForbidden
+		}
+		upgradeDiagnostics.record(c, s.hub.metrics, cause, status, err.Error())
+		return nil, err
+	}
+	upgradeDiagnostics.record(c, s.hub.metrics, upgradeAccepted, http.StatusSwitchingProtocols, "")
+	return ws, nil
+}
+
+// watchUpgrades records WebSocket upgrade requests refused before their
+// handler upgraded them, such as by authentication
+func watchUpgrades(metrics *metricsRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if !websocket.IsWebSocketUpgrade(c.Request) || c.GetBool(upgradeRecordedKey) {
+			return
+		}
+		switch status := c.Writer.Status(); {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			upgradeDiagnostics.record(c, metrics, upgradeAuthFailed, status, http.StatusText(status))
+		case status >= http.StatusBadRequest:
+			upgradeDiagnostics.record(c, metrics, upgradeRejected, status, http.StatusText(status))
+		}
+	}
+}
+
+// wsDiagnosticsHandler shows why WebSocket connections failed, newest first,
+// optionally only those of one cause, for debugging an overlay that won't
+// connect
+func wsDiagnosticsHandler(c *gin.Context) {
+	cause := c.Query("cause")
+	switch cause {
+	case "", upgradeOriginRejected, upgradeAuthFailed, upgradeHandshakeError, upgradeRejected:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'cause' parameter"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(upgradeFailureLogSize)))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'limit' parameter"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"counts":   upgradeDiagnostics.snapshot(),
+		"failures": upgradeDiagnostics.recent(cause, limit),
+	})
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const youtubeAPIURL = "https://www.googleapis.com/youtube/v3"
+
+// Live chat message types that become alerts
+const (
+	youtubeSuperChat       = "superChatEvent"
+	youtubeSuperSticker    = "superStickerEvent"
+	youtubeNewMember       = "newSponsorEvent"
+	youtubeMemberMilestone = "memberMilestoneChatEvent"
+	youtubeGiftMembership  = "membershipGiftingEvent"
+)
+
+// errLiveChatEnded means the broadcast is over and its chat can't be read any more
+var errLiveChatEnded = errors.New("live chat has ended")
+
+// YouTubeConfig selects the broadcast whose Super Chats are read out. Either
+// an API key or an OAuth access token (youtube.readonly) authorizes the calls.
+type YouTubeConfig struct {
+	APIKey      string
+	AccessToken string
+	// VideoID is the broadcast to follow; LiveChatID skips looking its chat up
+	VideoID    string
+	LiveChatID string
+	Channel    string
+	// Memberships also turns new members, milestones and gifted memberships into alerts
+	Memberships bool
+	// MinPoll is the shortest wait between polls, even if YouTube allows less
+	MinPoll time.Duration
+	// Rates converts amounts into COMPAT_CURRENCY, as CUR=rate pairs
+	Rates []string
+}
+
+func (c YouTubeConfig) enabled() bool {
+	return (c.APIKey != "" || c.AccessToken != "") && (c.VideoID != "" || c.LiveChatID != "")
+}
+
+type liveChatMessages struct {
+	NextPageToken         string            `json:"nextPageToken"`
+	PollingIntervalMillis int               `json:"pollingIntervalMillis"`
+	Items                 []liveChatMessage `json:"items"`
+}
+
+type liveChatMessage struct {
+	ID      string `json:"id"`
+	Snippet struct {
+		Type             string `json:"type"`
+		SuperChatDetails struct {
+			AmountMicros        json.Number `json:"amountMicros"`
+			Currency            string      `json:"currency"`
+			AmountDisplayString string      `json:"amountDisplayString"`
+			UserComment         string      `json:"userComment"`
+		} `json:"superChatDetails"`
+		SuperStickerDetails struct {
+			AmountMicros         json.Number `json:"amountMicros"`
+			Currency             string      `json:"currency"`
+			AmountDisplayString  string      `json:"amountDisplayString"`
+			SuperStickerMetadata struct {
+				AltText string `json:"altText"`
+			} `json:"superStickerMetadata"`
+		} `json:"superStickerDetails"`
+		NewSponsorDetails struct {
+			MemberLevelName string `json:"memberLevelName"`
+			IsUpgrade       bool   `json:"isUpgrade"`
+		} `json:"newSponsorDetails"`
+		MemberMilestoneChatDetails struct {
+			MemberLevelName string `json:"memberLevelName"`
+			MemberMonth     int    `json:"memberMonth"`
+			UserComment     string `json:"userComment"`
+		} `json:"memberMilestoneChatDetails"`
+		MembershipGiftingDetails struct {
+			GiftMembershipsCount     int    `json:"giftMembershipsCount"`
+			GiftMembershipsLevelName string `json:"giftMembershipsLevelName"`
+		} `json:"membershipGiftingDetails"`
+	} `json:"snippet"`
+	AuthorDetails struct {
+		DisplayName string `json:"displayName"`
+	} `json:"authorDetails"`
+}
+
+type videosResponse struct {
+	Items []struct {
+		LiveStreamingDetails struct {
+			ActiveLiveChatID string `json:"activeLiveChatId"`
+		} `json:"liveStreamingDetails"`
+	} `json:"items"`
+}
+
+// youtubeReader polls a broadcast's live chat
+type youtubeReader struct {
+	config YouTubeConfig
+	client *http.Client
+	rates  map[string]float64
+	// unpriced remembers currencies already warned about
+	unpriced map[string]bool
+	hub      *Hub
+}
+
+// startYouTube polls the configured broadcast's chat into hub until the
+// process exits
+func startYouTube(config YouTubeConfig, hub *Hub) error {
+	if !config.enabled() {
+		return nil
+	}
+	rates, err := parseCurrencyRates(hub, config.Rates)
+	if err != nil {
+		return err
+	}
+	if config.Channel == "" {
+		config.Channel = defaultChannel
+	}
+	if !validChannelName(config.Channel) {
+		return fmt.Errorf("invalid YOUTUBE_CHANNEL %q", config.Channel)
+	}
+
+	reader := &youtubeReader{
+		config:   config,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		rates:    rates,
+		unpriced: make(map[string]bool),
+		hub:      hub,
+	}
+	go reader.run()
+	log.Printf("Reading YouTube Super Chats into channel %s", config.Channel)
+	return nil
+}
+
+// parseCurrencyRates reads CUR=rate pairs, e.g. EUR=1.08
+func parseCurrencyRates(hub *Hub, pairs []string) (map[string]float64, error) {
+	rates := map[string]float64{strings.ToUpper(hub.currency): 1}
+	for _, pair := range pairs {
+		currency, value, ok := strings.Cut(pair, "=")
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid currency rate %q, expected CUR=rate", pair)
+		}
+		rates[strings.ToUpper(strings.TrimSpace(currency))] = rate
+	}
+	return rates, nil
+}
+
+// run finds the live chat, then polls it at the interval YouTube asks for.
+// Errors back off up to five minutes; once the chat ends the broadcast is
+// looked up again, in case a new stream reuses the video.
+func (r *youtubeReader) run() {
+	backoff := time.Duration(0)
+	retry := func(err error) {
+		backoff = min(max(2*backoff, 5*time.Second), 5*time.Minute)
+		log.Printf("Error reading YouTube live chat, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+	}
+
+	for {
+		chatID := r.config.LiveChatID
+		if chatID == "" {
+			var err error
+			if chatID, err = r.liveChatID(); err != nil {
+				retry(err)
+				continue
+			}
+		}
+
+		pageToken := ""
+		for {
+			page, err := r.fetchMessages(chatID, pageToken)
+			if errors.Is(err, errLiveChatEnded) {
+				log.Printf("YouTube live chat %s has ended", chatID)
+				break
+			}
+			if err != nil {
+				retry(err)
+				continue
+			}
+			backoff = 0
+
+			for _, item := range page.Items {
+				if msg, ok := r.toMessage(item); ok {
+					r.accept(msg)
+				}
+			}
+			pageToken = page.NextPageToken
+			time.Sleep(max(time.Duration(page.PollingIntervalMillis)*time.Millisecond, r.config.MinPoll))
+		}
+		// A fixed chat ID never comes back once it has ended
+		if r.config.LiveChatID != "" {
+			return
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// get performs an authorized Data API GET and decodes the JSON response into out
+func (r *youtubeReader) get(endpoint string, params url.Values, out interface{}) error {
+	if r.config.AccessToken == "" {
+		params.Set("key", r.config.APIKey)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, youtubeAPIURL+endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if r.config.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.config.AccessToken)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error struct {
+				Errors []struct {
+					Reason string `json:"reason"`
+				} `json:"errors"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		for _, reason := range failure.Error.Errors {
+			if reason.Reason == "liveChatEnded" || reason.Reason == "liveChatNotFound" {
+				return errLiveChatEnded
+			}
+		}
+		return fmt.Errorf("youtube API returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// liveChatID looks up the chat of the configured broadcast
+func (r *youtubeReader) liveChatID() (string, error) {
+	var videos videosResponse
+	params := url.Values{"part": {"liveStreamingDetails"}, "id": {r.config.VideoID}}
+	if err := r.get("/videos", params, &videos); err != nil {
+		return "", err
+	}
+	if len(videos.Items) == 0 || videos.Items[0].LiveStreamingDetails.ActiveLiveChatID == "" {
+		return "", fmt.Errorf("video %s has no active live chat", r.config.VideoID)
+	}
+	return videos.Items[0].LiveStreamingDetails.ActiveLiveChatID, nil
+}
+
+func (r *youtubeReader) fetchMessages(chatID string, pageToken string) (*liveChatMessages, error) {
+	params := url.Values{"liveChatId": {chatID}, "part": {"snippet,authorDetails"}, "maxResults": {"2000"}}
+	if pageToken != "" {
+		params.Set("pageToken", pageToken)
+	}
+	var page liveChatMessages
+	if err := r.get("/liveChat/messages", params, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// toMessage converts a paid or membership chat event into a message; other
+// chat messages are skipped
+func (r *youtubeReader) toMessage(item liveChatMessage) (Message, bool) {
+	snippet := item.Snippet
+	name := item.AuthorDetails.DisplayName
+	msg := Message{SessionID: "youtube_" + item.ID, Channel: r.config.Channel, Name: name}
+
+	switch snippet.Type {
+	case youtubeSuperChat:
+		details := snippet.SuperChatDetails
+		msg.Amount = r.convert(details.AmountMicros, details.Currency)
+		msg.Message = details.UserComment
+		msg.Description = fmt.Sprintf("%s sent a Super Chat of %s", name, details.AmountDisplayString)
+	case youtubeSuperSticker:
+		details := snippet.SuperStickerDetails
+		msg.Amount = r.convert(details.AmountMicros, details.Currency)
+		msg.Description = fmt.Sprintf("%s sent a Super Sticker of %s", name, details.AmountDisplayString)
+		if alt := details.SuperStickerMetadata.AltText; alt != "" {
+			msg.Description += ": " + alt
+		}
+	case youtubeNewMember:
+		if !r.config.Memberships {
+			return Message{}, false
+		}
+		details := snippet.NewSponsorDetails
+		verb := "became a member"
+		if details.IsUpgrade {
+			verb = "upgraded their membership"
+		}
+		msg.Description = strings.TrimSuffix(fmt.Sprintf("%s %s (%s)", name, verb, details.MemberLevelName), " ()")
+	case youtubeMemberMilestone:
+		if !r.config.Memberships {
+			return Message{}, false
+		}
+		details := snippet.MemberMilestoneChatDetails
+		msg.Message = details.UserComment
+		msg.Description = fmt.Sprintf("%s has been a member for %d months", name, details.MemberMonth)
+	case youtubeGiftMembership:
+		if !r.config.Memberships {
+			return Message{}, false
+		}
+		details := snippet.MembershipGiftingDetails
+		msg.Description = fmt.Sprintf("%s gifted %d memberships", name, details.GiftMembershipsCount)
+	default:
+		return Message{}, false
+	}
+	return msg, true
+}
+
+// convert turns an amount in micros (millionths of the currency's unit) into
+// COMPAT_CURRENCY. Currencies without a rate keep their own amount.
+func (r *youtubeReader) convert(micros json.Number, currency string) float32 {
+	value, err := micros.Int64()
+	if err != nil {
+		log.Printf("Ignoring invalid YouTube amount %q", micros)
+		return 0
+	}
+	amount := float64(value) / 1e6
+
+	currency = strings.ToUpper(currency)
+	rate, ok := r.rates[currency]
+	if !ok {
+		if !r.unpriced[currency] {
+			r.unpriced[currency] = true
+			log.Printf("No YOUTUBE_CURRENCY_RATES entry for %s, using amounts as they are", currency)
+		}
+		rate = 1
+	}
+	return float32(math.Round(amount*rate*100) / 100)
+}
+
+// accept sends a chat event down the regular send pipeline. Event IDs are
+// stable, so events seen again after a restart are refused as duplicates.
+// On an instance that stepped down the reader pauses here, holding the event,
+// until the instance is primary again.
+func (r *youtubeReader) accept(msg Message) {
+	r.hub.standby.waitPrimary("YouTube event " + msg.SessionID)
+	msg.Provider = "youtube"
+	r.hub.metrics.inc(metricMessagesReceived, MetricLabels{Channel: msg.Channel, Kind: "donation"}, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if result, err := r.hub.acceptMessage(ctx, msg, ""); err != nil {
+		if !result.Duplicate {
+			log.Printf("Ignoring YouTube event %s: %s", msg.SessionID, err.message)
+		}
+		return
+	}
+	r.hub.db.recordAudit("payment.received", "youtube", msg.SessionID, gin.H{"amount": msg.Amount, "channel": msg.Channel})
+}